@@ -7,12 +7,14 @@ import (
 	syncv3 "github.com/matrix-org/sliding-sync"
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -37,6 +39,54 @@ const (
 	EnvDebug      = "SYNCV3_DEBUG"
 	EnvJaeger     = "SYNCV3_JAEGER_URL"
 	EnvSentryDsn  = "SYNCV3_SENTRY_DSN"
+
+	EnvInitialSyncDeadline     = "SYNCV3_INITIAL_SYNC_DEADLINE"
+	EnvIncrementalSyncDeadline = "SYNCV3_INCREMENTAL_SYNC_DEADLINE"
+	EnvV2Compat                = "SYNCV3_V2_COMPAT"
+	EnvAdminToken              = "SYNCV3_ADMIN_TOKEN"
+	EnvListSnapshotDir         = "SYNCV3_LIST_SNAPSHOT_DIR"
+	EnvListSnapshotInterval    = "SYNCV3_LIST_SNAPSHOT_INTERVAL"
+	EnvListSnapshotRetention   = "SYNCV3_LIST_SNAPSHOT_RETENTION"
+	EnvListSnapshotSampleRate  = "SYNCV3_LIST_SNAPSHOT_SAMPLE_RATE"
+	EnvMaxListOpsPerResponse   = "SYNCV3_MAX_LIST_OPS_PER_RESPONSE"
+	EnvMaxListOpsPerMinute     = "SYNCV3_MAX_LIST_OPS_PER_MINUTE"
+	EnvInactiveUserGCAfter     = "SYNCV3_INACTIVE_USER_GC_AFTER"
+	EnvStorageBreakerThreshold = "SYNCV3_STORAGE_BREAKER_THRESHOLD"
+	EnvPrefetchTimelineLimit   = "SYNCV3_PREFETCH_TIMELINE_LIMIT"
+	EnvEventEncryptionKey      = "SYNCV3_EVENT_ENCRYPTION_KEY"
+	EnvMaxTimelineLimit        = "SYNCV3_MAX_TIMELINE_LIMIT"
+	EnvMaxToDeviceLimit        = "SYNCV3_MAX_TO_DEVICE_LIMIT"
+	EnvMaxEventContextLimit    = "SYNCV3_MAX_EVENT_CONTEXT_LIMIT"
+	EnvMaxLists                = "SYNCV3_MAX_LISTS"
+	EnvMaxRoomSubscriptions    = "SYNCV3_MAX_ROOM_SUBSCRIPTIONS"
+	EnvStatsEndpoint           = "SYNCV3_STATS_ENDPOINT"
+	EnvIgnoredLatestEventTypes = "SYNCV3_IGNORED_LATEST_EVENT_TYPES"
+	EnvInviteBurstThreshold    = "SYNCV3_INVITE_BURST_THRESHOLD"
+	EnvInviteBurstWindow       = "SYNCV3_INVITE_BURST_WINDOW"
+	EnvEarlyFlushMinRooms      = "SYNCV3_EARLY_FLUSH_MIN_ROOMS"
+	EnvGlobalCacheMaxRooms     = "SYNCV3_GLOBAL_CACHE_MAX_ROOMS"
+	EnvEnableNotify            = "SYNCV3_ENABLE_NOTIFY"
+	EnvCostAccountingHours     = "SYNCV3_COST_ACCOUNTING_HOURS"
+	EnvStartupSnapshotPath     = "SYNCV3_STARTUP_SNAPSHOT_PATH"
+	EnvStartupSnapshotInterval = "SYNCV3_STARTUP_SNAPSHOT_INTERVAL"
+	EnvLazyGlobalCache         = "SYNCV3_LAZY_GLOBAL_CACHE"
+	EnvAsyncDispatchQueueSize  = "SYNCV3_ASYNC_DISPATCH_QUEUE_SIZE"
+	EnvExtensionTimeout        = "SYNCV3_EXTENSION_TIMEOUT"
+	EnvTenantsFile             = "SYNCV3_TENANTS_FILE"
+	EnvPersistentQueue         = "SYNCV3_PERSISTENT_QUEUE"
+	EnvIndexedStateTypes       = "SYNCV3_INDEXED_STATE_TYPES"
+	EnvDepartedDeviceGrace     = "SYNCV3_DEPARTED_DEVICE_GRACE_PERIOD"
+	EnvBackgroundStartup       = "SYNCV3_BACKGROUND_STARTUP"
+	EnvContentHints            = "SYNCV3_CONTENT_HINTS"
+	EnvToDeviceMaxPerDevice    = "SYNCV3_TO_DEVICE_MAX_PER_DEVICE"
+	EnvToDeviceMaxAge          = "SYNCV3_TO_DEVICE_MAX_AGE"
+	EnvTransactionIDMaxAge     = "SYNCV3_TXN_ID_MAX_AGE"
+	EnvDBMaintenanceInterval   = "SYNCV3_DB_MAINTENANCE_INTERVAL"
+	EnvPollerBackpressure      = "SYNCV3_POLLER_BACKPRESSURE_LATENCY"
+	EnvEnableDiagnostics       = "SYNCV3_ENABLE_DIAGNOSTICS"
+	EnvEventsPartitions        = "SYNCV3_EVENTS_PARTITIONS"
+	EnvSinceBatchInterval      = "SYNCV3_SINCE_BATCH_INTERVAL"
+	EnvDBReadReplica           = "SYNCV3_DB_READ_REPLICA"
 )
 
 var helpMsg = fmt.Sprintf(`
@@ -51,7 +101,66 @@ Environment var
 %s       Default: unset. The bind addr for Prometheus metrics, which will be accessible at /metrics at this address.
 %s Default: unset. The Jaeger URL to send spans to e.g http://localhost:14268/api/traces - if unset does not send OTLP traces.
 %s Default: unset. The Sentry DSN to report events to e.g https://sliding-sync@sentry.example.com/123 - if unset does not send sentry events.
-`, EnvServer, EnvDB, EnvSecret, EnvBindAddr, EnvTLSCert, EnvTLSKey, EnvPPROF, EnvPrometheus, EnvJaeger, EnvSentryDsn)
+%s Default: unset. The max time to spend on an initial sync request e.g '30s'. A partial response is returned when the deadline is near, and the rest of the rooms are sent in the next response.
+%s Default: unset. The max time to spend on an incremental sync request, including long-polling e.g '35s'.
+%s Default: unset. If '1', GET /sync requests from legacy clients are served a sync v2 response from the proxy's database.
+%s Default: unset. The bearer token for the admin API under /_syncv3/admin/ - if unset the admin API is disabled.
+%s Default: unset. The directory to write periodic gzipped snapshots of sampled users' room lists to, for debugging.
+%s Default: 5m. How often to snapshot each sampled connection's lists.
+%s Default: 1h. How long to keep list snapshots for.
+%s Default: 0. The fraction of users to snapshot between 0 and 1 e.g '0.01'. Snapshots are disabled if 0.
+%s Default: unset. The max number of live list operations per list in a response. If exceeded, the list is resent as a SYNC.
+%s Default: unset. The max number of live list operations per minute per connection. If exceeded, lists are resent as a SYNC.
+%s Default: unset. Stop polling and delete the data of devices which have not made a request for this long e.g '2160h'. Their data is refetched if they return.
+%s Default: unset. The number of database errors within 30s which trips the circuit breaker, rejecting new connections and serving existing ones from caches.
+%s Default: unset. The number of timeline events to prefetch for rooms which were just highlighted or are near the top of a list sorted by recency e.g '20'.
+%s Default: unset. A secret to encrypt event JSON in the database with. Events written before this is set remain readable. Must not be changed or removed once set.
+%s Default: unset. The max timeline_limit for lists and room subscriptions. Larger values are lowered to this.
+%s Default: unset. The max limit for the to_device extension. Larger values are lowered to this.
+%s Default: unset. The max limit for event_context on room subscriptions. Larger values are lowered to this.
+%s Default: unset. The max number of lists per connection. Requests which exceed this are rejected.
+%s Default: unset. The max number of room subscriptions per connection. Requests which exceed this are rejected.
+%s Default: unset. Opt-in. A URL to post anonymous usage stats (version, number of users, rooms and events per day) to once a day.
+%s Default: reactions, redactions and room settings changes. Comma-separated event types which don't bump rooms in lists sorted by recency e.g 'm.reaction,m.room.redaction'.
+%s Default: unset. Collapse invites into a count when a user receives more than this many invites within the burst window, to protect clients from invite spam.
+%s Default: 1m. The window for SYNCV3_INVITE_BURST_THRESHOLD.
+%s Default: unset. If set, initial syncs with at least this many rooms are streamed, sending lists and the highest priority rooms first.
+%s Default: unset. The max number of rooms to hold metadata for in memory. Least recently used rooms are reloaded from the database when needed.
+%s Default: unset. If '1', clients can POST to /_matrix/client/unstable/org.matrix.msc3575/sync/notify after sending events so they come down sync sooner.
+%s Default: unset. The number of hours of per-user costs (DB time, bytes and events served) to keep, viewable at /_syncv3/admin/costs.
+%s Default: unset. A file to keep a snapshot of room metadata in, so restarts only load rooms which changed since. Delete it after changing SYNCV3_IGNORED_LATEST_EVENT_TYPES.
+%s Default: 10m. How often to refresh the startup snapshot.
+%s Default: unset. If '1', room metadata is loaded when a room is first used instead of for every room at startup.
+%s Default: unset. If set, each user's caches are updated on their own goroutine with up to this many pending updates, so slow users cannot delay live updates for everyone. Users who fall further behind are reloaded from the database.
+%s Default: unset. The longest an extension (e.g receipts) can take before the response is sent without it, e.g '2s'. Its data is sent in the next response.
+%s Default: unset. A JSON file of per-tenant quotas (max_users, max_conns, db_budget_ms_per_hour). Each homeserver is a tenant unless grouped under "servers".
+%s Default: unset. If '1', notifications from pollers are queued in the database, so pollers never wait for slow delivery and undelivered notifications survive a restart.
+%s Default: unset. Comma-separated custom state event types to keep in memory for each room e.g 'im.vector.modular.widgets'. io.element.functional_members is always kept. Delete the startup snapshot after changing this.
+%s Default: unset. How long to keep the to-device messages and device data of a device after the homeserver rejects its access token e.g '10m', in case the token is used again.
+%s Default: unset. If '1', start listening straight away and load rooms in the background. Requests get HTTP 503 until memberships have loaded. Progress is shown at /_syncv3/ready.
+%s Default: unset. If '1', rooms include content_hints guessed from recent messages: the script they are written in and whether they are mostly media.
+%s Default: unset. The max number of unacknowledged to-device messages to keep per device. The oldest are dropped when exceeded.
+%s Default: unset. Delete to-device messages which have not been acknowledged for this long e.g '720h', so dead devices don't grow the database forever.
+%s Default: unset. Delete the transaction IDs of sent events after this long e.g '24h'. Clients only need them shortly after sending, to match up their local echo.
+%s Default: unset. How often to analyze tables with stale statistics and report table and index bloat as metrics e.g '1h'. Missing indexes are logged at startup.
+%s Default: unset. Pause pollers of devices which have not made a request for a day whilst writing poll data to the database takes longer than this on average e.g '500ms', so active users stay responsive.
+%s Default: unset. If '1', clients can GET /_matrix/client/unstable/org.matrix.msc3575/sync/diagnostics to download their sticky request, poller state and recent response sizes for bug reports.
+%s Default: unset. Partition the events table by room into this many partitions e.g '32', for databases with hundreds of millions of events. Existing events are copied at startup, which can take hours. Cannot be changed once set.
+%s Default: unset. Write pollers' since tokens in one batch this often e.g '5s', rather than after every poll. After a crash, up to this much data is polled again.
+%s Default: unset. Postgres connection string of a read-only replica of SYNCV3_DB. Timelines and room state are read from it when it has replayed every event written so far, otherwise from SYNCV3_DB.
+`, EnvServer, EnvDB, EnvSecret, EnvBindAddr, EnvTLSCert, EnvTLSKey, EnvPPROF, EnvPrometheus, EnvJaeger, EnvSentryDsn,
+	EnvInitialSyncDeadline, EnvIncrementalSyncDeadline, EnvV2Compat, EnvAdminToken,
+	EnvListSnapshotDir, EnvListSnapshotInterval, EnvListSnapshotRetention, EnvListSnapshotSampleRate,
+	EnvMaxListOpsPerResponse, EnvMaxListOpsPerMinute, EnvInactiveUserGCAfter,
+	EnvStorageBreakerThreshold, EnvPrefetchTimelineLimit, EnvEventEncryptionKey,
+	EnvMaxTimelineLimit, EnvMaxToDeviceLimit, EnvMaxEventContextLimit, EnvMaxLists, EnvMaxRoomSubscriptions, EnvStatsEndpoint,
+	EnvIgnoredLatestEventTypes, EnvInviteBurstThreshold, EnvInviteBurstWindow,
+	EnvEarlyFlushMinRooms, EnvGlobalCacheMaxRooms, EnvEnableNotify, EnvCostAccountingHours,
+	EnvStartupSnapshotPath, EnvStartupSnapshotInterval, EnvLazyGlobalCache, EnvAsyncDispatchQueueSize,
+	EnvExtensionTimeout, EnvTenantsFile, EnvPersistentQueue, EnvIndexedStateTypes,
+	EnvDepartedDeviceGrace, EnvBackgroundStartup, EnvContentHints, EnvToDeviceMaxPerDevice, EnvToDeviceMaxAge,
+	EnvTransactionIDMaxAge, EnvDBMaintenanceInterval, EnvPollerBackpressure, EnvEnableDiagnostics, EnvEventsPartitions,
+	EnvSinceBatchInterval, EnvDBReadReplica)
 
 func defaulting(in, dft string) string {
 	if in == "" {
@@ -60,6 +169,62 @@ func defaulting(in, dft string) string {
 	return in
 }
 
+// parseDuration parses an optional duration env var, exiting if it is malformed.
+func parseDuration(envVar, in string) time.Duration {
+	if in == "" {
+		return 0
+	}
+	dur, err := time.ParseDuration(in)
+	if err != nil {
+		fmt.Print(helpMsg)
+		fmt.Printf("\n%s is not a valid duration: %s\n", envVar, err)
+		os.Exit(1)
+	}
+	return dur
+}
+
+// parseSampleRate parses an optional fraction between 0 and 1, exiting if it is malformed.
+func parseSampleRate(envVar, in string) float64 {
+	if in == "" {
+		return 0
+	}
+	rate, err := strconv.ParseFloat(in, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		fmt.Print(helpMsg)
+		fmt.Printf("\n%s must be a number between 0 and 1\n", envVar)
+		os.Exit(1)
+	}
+	return rate
+}
+
+// parseLimit parses an optional non-negative integer, exiting if it is malformed.
+func parseLimit(envVar, in string) int {
+	if in == "" {
+		return 0
+	}
+	limit, err := strconv.Atoi(in)
+	if err != nil || limit < 0 {
+		fmt.Print(helpMsg)
+		fmt.Printf("\n%s must be a non-negative integer\n", envVar)
+		os.Exit(1)
+	}
+	return limit
+}
+
+// parseList parses an optional comma-separated list, returning nil if it is unset.
+func parseList(in string) []string {
+	if in == "" {
+		return nil
+	}
+	list := []string{}
+	for _, item := range strings.Split(in, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 func main() {
 	fmt.Printf("Sync v3 [%s] (%s)\n", version, GitCommit)
 	sync2.ProxyVersion = version
@@ -76,6 +241,54 @@ func main() {
 		EnvDebug:      os.Getenv(EnvDebug),
 		EnvJaeger:     os.Getenv(EnvJaeger),
 		EnvSentryDsn:  os.Getenv(EnvSentryDsn),
+
+		EnvInitialSyncDeadline:     os.Getenv(EnvInitialSyncDeadline),
+		EnvIncrementalSyncDeadline: os.Getenv(EnvIncrementalSyncDeadline),
+		EnvV2Compat:                os.Getenv(EnvV2Compat),
+		EnvAdminToken:              os.Getenv(EnvAdminToken),
+		EnvListSnapshotDir:         os.Getenv(EnvListSnapshotDir),
+		EnvListSnapshotInterval:    os.Getenv(EnvListSnapshotInterval),
+		EnvListSnapshotRetention:   os.Getenv(EnvListSnapshotRetention),
+		EnvListSnapshotSampleRate:  os.Getenv(EnvListSnapshotSampleRate),
+		EnvMaxListOpsPerResponse:   os.Getenv(EnvMaxListOpsPerResponse),
+		EnvMaxListOpsPerMinute:     os.Getenv(EnvMaxListOpsPerMinute),
+		EnvInactiveUserGCAfter:     os.Getenv(EnvInactiveUserGCAfter),
+		EnvStorageBreakerThreshold: os.Getenv(EnvStorageBreakerThreshold),
+		EnvPrefetchTimelineLimit:   os.Getenv(EnvPrefetchTimelineLimit),
+		EnvEventEncryptionKey:      os.Getenv(EnvEventEncryptionKey),
+		EnvMaxTimelineLimit:        os.Getenv(EnvMaxTimelineLimit),
+		EnvMaxToDeviceLimit:        os.Getenv(EnvMaxToDeviceLimit),
+		EnvMaxEventContextLimit:    os.Getenv(EnvMaxEventContextLimit),
+		EnvMaxLists:                os.Getenv(EnvMaxLists),
+		EnvMaxRoomSubscriptions:    os.Getenv(EnvMaxRoomSubscriptions),
+		EnvStatsEndpoint:           os.Getenv(EnvStatsEndpoint),
+		EnvIgnoredLatestEventTypes: os.Getenv(EnvIgnoredLatestEventTypes),
+		EnvInviteBurstThreshold:    os.Getenv(EnvInviteBurstThreshold),
+		EnvInviteBurstWindow:       os.Getenv(EnvInviteBurstWindow),
+		EnvEarlyFlushMinRooms:      os.Getenv(EnvEarlyFlushMinRooms),
+		EnvGlobalCacheMaxRooms:     os.Getenv(EnvGlobalCacheMaxRooms),
+		EnvEnableNotify:            os.Getenv(EnvEnableNotify),
+		EnvCostAccountingHours:     os.Getenv(EnvCostAccountingHours),
+		EnvStartupSnapshotPath:     os.Getenv(EnvStartupSnapshotPath),
+		EnvStartupSnapshotInterval: os.Getenv(EnvStartupSnapshotInterval),
+		EnvLazyGlobalCache:         os.Getenv(EnvLazyGlobalCache),
+		EnvAsyncDispatchQueueSize:  os.Getenv(EnvAsyncDispatchQueueSize),
+		EnvExtensionTimeout:        os.Getenv(EnvExtensionTimeout),
+		EnvTenantsFile:             os.Getenv(EnvTenantsFile),
+		EnvPersistentQueue:         os.Getenv(EnvPersistentQueue),
+		EnvIndexedStateTypes:       os.Getenv(EnvIndexedStateTypes),
+		EnvDepartedDeviceGrace:     os.Getenv(EnvDepartedDeviceGrace),
+		EnvBackgroundStartup:       os.Getenv(EnvBackgroundStartup),
+		EnvContentHints:            os.Getenv(EnvContentHints),
+		EnvToDeviceMaxPerDevice:    os.Getenv(EnvToDeviceMaxPerDevice),
+		EnvToDeviceMaxAge:          os.Getenv(EnvToDeviceMaxAge),
+		EnvTransactionIDMaxAge:     os.Getenv(EnvTransactionIDMaxAge),
+		EnvDBMaintenanceInterval:   os.Getenv(EnvDBMaintenanceInterval),
+		EnvPollerBackpressure:      os.Getenv(EnvPollerBackpressure),
+		EnvEnableDiagnostics:       os.Getenv(EnvEnableDiagnostics),
+		EnvEventsPartitions:        os.Getenv(EnvEventsPartitions),
+		EnvSinceBatchInterval:      os.Getenv(EnvSinceBatchInterval),
+		EnvDBReadReplica:           os.Getenv(EnvDBReadReplica),
 	}
 	requiredEnvVars := []string{EnvServer, EnvDB, EnvSecret, EnvBindAddr}
 	for _, requiredEnvVar := range requiredEnvVars {
@@ -132,8 +345,57 @@ func main() {
 	}
 
 	h2, h3 := syncv3.Setup(args[EnvServer], args[EnvDB], args[EnvSecret], syncv3.Opts{
-		Debug:                args[EnvDebug] == "1",
-		AddPrometheusMetrics: args[EnvPrometheus] != "",
+		Debug:                   args[EnvDebug] == "1",
+		AddPrometheusMetrics:    args[EnvPrometheus] != "",
+		InitialSyncDeadline:     parseDuration(EnvInitialSyncDeadline, args[EnvInitialSyncDeadline]),
+		IncrementalSyncDeadline: parseDuration(EnvIncrementalSyncDeadline, args[EnvIncrementalSyncDeadline]),
+		EnableV2Compat:          args[EnvV2Compat] == "1",
+		AdminToken:              args[EnvAdminToken],
+		ListSnapshotDir:         args[EnvListSnapshotDir],
+		ListSnapshotInterval:    parseDuration(EnvListSnapshotInterval, args[EnvListSnapshotInterval]),
+		ListSnapshotRetention:   parseDuration(EnvListSnapshotRetention, args[EnvListSnapshotRetention]),
+		ListSnapshotSampleRate:  parseSampleRate(EnvListSnapshotSampleRate, args[EnvListSnapshotSampleRate]),
+		MaxListOpsPerResponse:   parseLimit(EnvMaxListOpsPerResponse, args[EnvMaxListOpsPerResponse]),
+		MaxListOpsPerMinute:     parseLimit(EnvMaxListOpsPerMinute, args[EnvMaxListOpsPerMinute]),
+		InactiveUserGCAfter:     parseDuration(EnvInactiveUserGCAfter, args[EnvInactiveUserGCAfter]),
+		StorageBreakerThreshold: parseLimit(EnvStorageBreakerThreshold, args[EnvStorageBreakerThreshold]),
+		PrefetchTimelineLimit:   parseLimit(EnvPrefetchTimelineLimit, args[EnvPrefetchTimelineLimit]),
+		EventEncryptionKey:      args[EnvEventEncryptionKey],
+		StatsEndpoint:           args[EnvStatsEndpoint],
+		IgnoredLatestEventTypes: parseList(args[EnvIgnoredLatestEventTypes]),
+		InviteBurstThreshold:    parseLimit(EnvInviteBurstThreshold, args[EnvInviteBurstThreshold]),
+		InviteBurstWindow:       parseDuration(EnvInviteBurstWindow, args[EnvInviteBurstWindow]),
+		EarlyFlushMinRooms:      parseLimit(EnvEarlyFlushMinRooms, args[EnvEarlyFlushMinRooms]),
+		GlobalCacheMaxRooms:     parseLimit(EnvGlobalCacheMaxRooms, args[EnvGlobalCacheMaxRooms]),
+		EnableNotify:            args[EnvEnableNotify] == "1",
+		CostAccountingHours:     parseLimit(EnvCostAccountingHours, args[EnvCostAccountingHours]),
+		StartupSnapshotPath:     args[EnvStartupSnapshotPath],
+		StartupSnapshotInterval: parseDuration(EnvStartupSnapshotInterval, args[EnvStartupSnapshotInterval]),
+		LazyGlobalCache:         args[EnvLazyGlobalCache] == "1",
+		AsyncDispatchQueueSize:  parseLimit(EnvAsyncDispatchQueueSize, args[EnvAsyncDispatchQueueSize]),
+		ExtensionTimeout:        parseDuration(EnvExtensionTimeout, args[EnvExtensionTimeout]),
+		TenantsFile:             args[EnvTenantsFile],
+		PersistentQueue:         args[EnvPersistentQueue] == "1",
+		IndexedStateTypes:       parseList(args[EnvIndexedStateTypes]),
+		DepartedDeviceGrace:     parseDuration(EnvDepartedDeviceGrace, args[EnvDepartedDeviceGrace]),
+		BackgroundStartup:       args[EnvBackgroundStartup] == "1",
+		ContentHints:            args[EnvContentHints] == "1",
+		ToDeviceMaxPerDevice:    parseLimit(EnvToDeviceMaxPerDevice, args[EnvToDeviceMaxPerDevice]),
+		ToDeviceMaxAge:          parseDuration(EnvToDeviceMaxAge, args[EnvToDeviceMaxAge]),
+		TransactionIDMaxAge:     parseDuration(EnvTransactionIDMaxAge, args[EnvTransactionIDMaxAge]),
+		DBMaintenanceInterval:   parseDuration(EnvDBMaintenanceInterval, args[EnvDBMaintenanceInterval]),
+		PollerBackpressure:      parseDuration(EnvPollerBackpressure, args[EnvPollerBackpressure]),
+		EnableDiagnostics:       args[EnvEnableDiagnostics] == "1",
+		EventsPartitions:        parseLimit(EnvEventsPartitions, args[EnvEventsPartitions]),
+		SinceBatchInterval:      parseDuration(EnvSinceBatchInterval, args[EnvSinceBatchInterval]),
+		ReadReplicaDB:           args[EnvDBReadReplica],
+		Limits: sync3.Limits{
+			MaxTimelineLimit:     int64(parseLimit(EnvMaxTimelineLimit, args[EnvMaxTimelineLimit])),
+			MaxToDeviceLimit:     parseLimit(EnvMaxToDeviceLimit, args[EnvMaxToDeviceLimit]),
+			MaxEventContextLimit: int64(parseLimit(EnvMaxEventContextLimit, args[EnvMaxEventContextLimit])),
+			MaxLists:             parseLimit(EnvMaxLists, args[EnvMaxLists]),
+			MaxRoomSubscriptions: parseLimit(EnvMaxRoomSubscriptions, args[EnvMaxRoomSubscriptions]),
+		},
 	})
 
 	go h2.StartV2Pollers()
@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"unicode"
+
+	"github.com/tidwall/gjson"
+)
+
+// The number of recent messages per room which content hints are derived from.
+const contentHintsWindow = 32
+
+// Rooms need at least this many recent messages before any hints are given.
+const contentHintsMinMessages = 5
+
+// The number of runes of each message body which are looked at to guess its script.
+const contentHintsMaxRunes = 64
+
+// Each recent message is stored as a byte: whether it is set and is media, and the index of its script
+// in contentHintScripts, or 0 if no script was found.
+const (
+	contentHintSet   = 0x80
+	contentHintMedia = 0x40
+	contentHintIndex = 0x3f
+)
+
+// The scripts which message bodies are classified into, as ISO 15924 codes. A script is a cheap stand-in
+// for the language of a message: it tells Russian from English, but not English from French.
+var contentHintScripts = []struct {
+	code   string
+	tables []*unicode.RangeTable
+}{
+	{}, // no script
+	{"Latn", []*unicode.RangeTable{unicode.Latin}},
+	{"Cyrl", []*unicode.RangeTable{unicode.Cyrillic}},
+	{"Grek", []*unicode.RangeTable{unicode.Greek}},
+	{"Arab", []*unicode.RangeTable{unicode.Arabic}},
+	{"Hebr", []*unicode.RangeTable{unicode.Hebrew}},
+	{"Deva", []*unicode.RangeTable{unicode.Devanagari}},
+	{"Thai", []*unicode.RangeTable{unicode.Thai}},
+	{"Hang", []*unicode.RangeTable{unicode.Hangul}},
+	{"Jpan", []*unicode.RangeTable{unicode.Hiragana, unicode.Katakana}},
+	{"Hani", []*unicode.RangeTable{unicode.Han}},
+}
+
+// indexes into contentHintScripts
+const (
+	contentHintJpan = 9
+	contentHintHani = 10
+)
+
+// ContentHints are derived from the recent messages in a room, for clients which want to group rooms by
+// what they contain. They are a fixed size so that copies of RoomMetadata don't share them.
+type ContentHints struct {
+	// ring buffer of the most recent messages
+	messages [contentHintsWindow]uint8
+	next     int
+}
+
+// AddMessage updates the hints with the content of a new m.room.message event. Edits are ignored, as the
+// original message has already been counted.
+func (h *ContentHints) AddMessage(content gjson.Result) {
+	if content.Get("m\\.relates_to.rel_type").Str == "m.replace" {
+		return
+	}
+	msg := uint8(contentHintSet)
+	switch content.Get("msgtype").Str {
+	case "m.image", "m.video", "m.audio", "m.file":
+		msg |= contentHintMedia
+	default:
+		msg |= scriptIndex(content.Get("body").Str)
+	}
+	h.messages[h.next] = msg
+	h.next = (h.next + 1) % contentHintsWindow
+}
+
+// Script returns the ISO 15924 code of the script most recent messages are written in, or "" if there
+// aren't enough messages or no script is used by more than half of them.
+func (h *ContentHints) Script() string {
+	var counts [64]int
+	total := 0
+	for _, msg := range h.messages {
+		if msg&contentHintSet == 0 || msg&contentHintMedia != 0 {
+			continue
+		}
+		total++
+		counts[msg&contentHintIndex]++
+	}
+	if total < contentHintsMinMessages {
+		return ""
+	}
+	for i := 1; i < len(contentHintScripts); i++ {
+		if counts[i]*2 > total {
+			return contentHintScripts[i].code
+		}
+	}
+	return ""
+}
+
+// MediaHeavy returns true if at least half of the recent messages are images, videos, audio or files.
+func (h *ContentHints) MediaHeavy() bool {
+	total := 0
+	media := 0
+	for _, msg := range h.messages {
+		if msg&contentHintSet == 0 {
+			continue
+		}
+		total++
+		if msg&contentHintMedia != 0 {
+			media++
+		}
+	}
+	return total >= contentHintsMinMessages && media*2 >= total
+}
+
+// scriptIndex returns the index in contentHintScripts of the script used by the most letters at the start
+// of this body. Japanese uses kanji alongside kana, so any kana makes it Japanese.
+func scriptIndex(body string) uint8 {
+	var counts [64]int
+	n := 0
+	for _, r := range body {
+		if n == contentHintsMaxRunes {
+			break
+		}
+		n++
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		for i := 1; i < len(contentHintScripts); i++ {
+			if unicode.IsOneOf(contentHintScripts[i].tables, r) {
+				counts[i]++
+				break
+			}
+		}
+	}
+	best := 0
+	for i := 1; i < len(contentHintScripts); i++ {
+		if counts[i] > counts[best] {
+			best = i
+		}
+	}
+	if best == contentHintHani && counts[contentHintJpan] > 0 {
+		return contentHintJpan
+	}
+	return uint8(best)
+}
@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestContentHints(t *testing.T) {
+	text := func(body string) string {
+		return `{"msgtype":"m.text","body":"` + body + `"}`
+	}
+	image := `{"msgtype":"m.image","body":"cat.png","url":"mxc://x/cat"}`
+	repeat := func(n int, content string) []string {
+		contents := make([]string, n)
+		for i := range contents {
+			contents[i] = content
+		}
+		return contents
+	}
+	testCases := []struct {
+		name           string
+		messages       []string
+		wantScript     string
+		wantMediaHeavy bool
+	}{
+		{
+			name:     "no messages",
+			messages: nil,
+		},
+		{
+			name:     "too few messages",
+			messages: repeat(contentHintsMinMessages-1, text("hello world")),
+		},
+		{
+			name:       "latin",
+			messages:   repeat(contentHintsMinMessages, text("hello world")),
+			wantScript: "Latn",
+		},
+		{
+			name:       "cyrillic with some latin",
+			messages:   append(repeat(4, text("привет, как дела? ok")), text("ok")),
+			wantScript: "Cyrl",
+		},
+		{
+			name:       "kanji and kana is japanese",
+			messages:   repeat(contentHintsMinMessages, text("日本語を話します")),
+			wantScript: "Jpan",
+		},
+		{
+			name:       "kanji alone is han",
+			messages:   repeat(contentHintsMinMessages, text("你好世界")),
+			wantScript: "Hani",
+		},
+		{
+			name:     "no majority script",
+			messages: append(repeat(3, text("hello")), repeat(3, text("привет"))...),
+		},
+		{
+			name:     "emoji only",
+			messages: repeat(contentHintsMinMessages, text("🎉🎉")),
+		},
+		{
+			name:           "media heavy",
+			messages:       append(append(repeat(3, image), repeat(2, text("cute"))...), text("so cute")),
+			wantMediaHeavy: true,
+		},
+		{
+			name:           "media and a majority script",
+			messages:       append(repeat(6, image), repeat(5, text("cute"))...),
+			wantScript:     "Latn",
+			wantMediaHeavy: true,
+		},
+		{
+			name:       "edits are ignored",
+			messages:   append(repeat(5, text("hello")), repeat(10, `{"msgtype":"m.text","body":"* привет","m.relates_to":{"rel_type":"m.replace","event_id":"$a"}}`)...),
+			wantScript: "Latn",
+		},
+		{
+			name:       "only recent messages count",
+			messages:   append(repeat(contentHintsWindow, image), repeat(contentHintsWindow, text("hello"))...),
+			wantScript: "Latn",
+		},
+	}
+	for _, tc := range testCases {
+		var h ContentHints
+		for _, msg := range tc.messages {
+			h.AddMessage(gjson.Parse(msg))
+		}
+		if got := h.Script(); got != tc.wantScript {
+			t.Errorf("%s: Script() got %q want %q", tc.name, got, tc.wantScript)
+		}
+		if got := h.MediaHeavy(); got != tc.wantMediaHeavy {
+			t.Errorf("%s: MediaHeavy() got %v want %v", tc.name, got, tc.wantMediaHeavy)
+		}
+	}
+}
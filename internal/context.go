@@ -2,6 +2,9 @@ package internal
 
 import (
 	"context"
+	"sync/atomic"
+	"time"
+
 	"github.com/getsentry/sentry-go"
 
 	"github.com/rs/zerolog"
@@ -15,6 +18,10 @@ var (
 
 // logging metadata for a single request
 type data struct {
+	// nanoseconds spent in database queries, updated atomically as queries may run concurrently.
+	// First in the struct so it is 64-bit aligned on 32-bit platforms.
+	dbTimeNanos int64
+
 	userID               string
 	since                int64
 	next                 int64
@@ -70,6 +77,25 @@ func SetRequestContextResponseInfo(
 	da.numLeftDevices = numLeftDevices
 }
 
+// TrackDBTime adds the time since start to the time spent in database queries for this request. Call it
+// after a query made whilst serving a request, so the cost can be attributed to the user.
+func TrackDBTime(ctx context.Context, start time.Time) {
+	d := ctx.Value(ctxData)
+	if d == nil {
+		return
+	}
+	atomic.AddInt64(&d.(*data).dbTimeNanos, int64(time.Since(start)))
+}
+
+// RequestContextDBTime returns the time spent in database queries for this request so far.
+func RequestContextDBTime(ctx context.Context) time.Duration {
+	d := ctx.Value(ctxData)
+	if d == nil {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&d.(*data).dbTimeNanos))
+}
+
 func DecorateLogger(ctx context.Context, l *zerolog.Event) *zerolog.Event {
 	d := ctx.Value(ctxData)
 	if d == nil {
@@ -3,6 +3,7 @@ package internal
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/getsentry/sentry-go"
 	"os"
@@ -16,6 +17,17 @@ var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.C
 	TimeFormat: "15:04:05",
 })
 
+// Errors which callers can check for with errors.Is. Wrap them with context using fmt.Errorf and %w.
+// ToHandlerError maps them to HTTP responses.
+var (
+	// The room is not known to the proxy.
+	ErrRoomNotFound = errors.New("room not found")
+	// The position in the request refers to a connection or response which no longer exists.
+	ErrPosExpired = errors.New("session expired")
+	// The poller for the device stopped, e.g because the homeserver rejected the access token.
+	ErrPollerDead = errors.New("poller is not running")
+)
+
 type HandlerError struct {
 	StatusCode int
 	Err        error
@@ -26,6 +38,10 @@ func (e *HandlerError) Error() string {
 	return fmt.Sprintf("HTTP %d : %s", e.StatusCode, e.Err.Error())
 }
 
+func (e *HandlerError) Unwrap() error {
+	return e.Err
+}
+
 type jsonError struct {
 	Err  string `json:"error"`
 	Code string `json:"errcode,omitempty"`
@@ -41,11 +57,25 @@ func (e HandlerError) JSON() []byte {
 }
 
 func ExpiredSessionError() *HandlerError {
-	return &HandlerError{
-		StatusCode: 400,
-		Err:        fmt.Errorf("session expired"),
-		ErrCode:    "M_UNKNOWN_POS",
+	return ToHandlerError(ErrPosExpired)
+}
+
+// ToHandlerError returns the HTTP response to send for this error. HandlerErrors are returned as they are,
+// errors which wrap a known error kind get its status code and errcode, and anything else is a 500.
+func ToHandlerError(err error) *HandlerError {
+	var herr *HandlerError
+	if errors.As(err, &herr) {
+		return herr
+	}
+	switch {
+	case errors.Is(err, ErrPosExpired):
+		return &HandlerError{StatusCode: 400, Err: err, ErrCode: "M_UNKNOWN_POS"}
+	case errors.Is(err, ErrRoomNotFound):
+		return &HandlerError{StatusCode: 404, Err: err, ErrCode: "M_NOT_FOUND"}
+	case errors.Is(err, ErrPollerDead):
+		return &HandlerError{StatusCode: 401, Err: err, ErrCode: "M_UNKNOWN_TOKEN"}
 	}
+	return &HandlerError{StatusCode: 500, Err: err}
 }
 
 // Assert that the expression is true, similar to assert() in C. If expr is false, print or panic.
@@ -1,6 +1,8 @@
 package internal
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"testing"
 )
@@ -44,3 +46,28 @@ func try(t *testing.T, shouldPanic bool, fn func()) {
 	}()
 	fn()
 }
+
+func TestToHandlerError(t *testing.T) {
+	custom := &HandlerError{StatusCode: 418, Err: fmt.Errorf("teapot")}
+	testCases := []struct {
+		err            error
+		wantStatusCode int
+		wantErrCode    string
+	}{
+		{err: ErrPosExpired, wantStatusCode: 400, wantErrCode: "M_UNKNOWN_POS"},
+		{err: fmt.Errorf("room !a:b: %w", ErrRoomNotFound), wantStatusCode: 404, wantErrCode: "M_NOT_FOUND"},
+		{err: fmt.Errorf("device ABC: %w", ErrPollerDead), wantStatusCode: 401, wantErrCode: "M_UNKNOWN_TOKEN"},
+		{err: fmt.Errorf("wrapped: %w", custom), wantStatusCode: 418},
+		{err: fmt.Errorf("something else"), wantStatusCode: 500},
+	}
+	for _, tc := range testCases {
+		herr := ToHandlerError(tc.err)
+		if herr.StatusCode != tc.wantStatusCode || herr.ErrCode != tc.wantErrCode {
+			t.Errorf("ToHandlerError(%v): got %d %q want %d %q", tc.err, herr.StatusCode, herr.ErrCode, tc.wantStatusCode, tc.wantErrCode)
+		}
+	}
+	// the kind of error survives being turned into a HandlerError
+	if !errors.Is(ExpiredSessionError(), ErrPosExpired) {
+		t.Errorf("ExpiredSessionError is not ErrPosExpired")
+	}
+}
@@ -1,6 +1,11 @@
 package internal
 
-import "github.com/tidwall/gjson"
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/tidwall/gjson"
+)
 
 func IsMembershipChange(eventJSON gjson.Result) bool {
 	// membership event possibly, make sure the membership has changed else
@@ -17,3 +22,102 @@ func IsMembershipChange(eventJSON gjson.Result) bool {
 	}
 	return prevMembership != currMembership // membership was changed
 }
+
+// The top-level keys of a client event which survive redaction.
+var preservedEventKeys = map[string]bool{
+	"event_id":         true,
+	"type":             true,
+	"room_id":          true,
+	"sender":           true,
+	"state_key":        true,
+	"origin_server_ts": true,
+}
+
+// The content keys which survive redaction, by event type. A nil set preserves all content. Event types
+// not listed here have all of their content removed.
+var preservedContentKeys = map[string]map[string]bool{
+	"m.room.member":     {"membership": true, "join_authorised_via_users_server": true},
+	"m.room.create":     nil,
+	"m.room.join_rules": {"join_rule": true, "allow": true},
+	"m.room.power_levels": {
+		"ban": true, "events": true, "events_default": true, "invite": true, "kick": true,
+		"redact": true, "state_default": true, "users": true, "users_default": true,
+	},
+	"m.room.history_visibility": {"history_visibility": true},
+}
+
+// UserPowerLevel returns the power level of userID in a room, given the m.room.power_levels event and the
+// sender of the m.room.create event. powerLevels may be missing if the room has no power levels event, in
+// which case the creator has 100 and everyone else has 0.
+func UserPowerLevel(powerLevels gjson.Result, creator, userID string) int64 {
+	if !powerLevels.Exists() {
+		if userID == creator {
+			return 100
+		}
+		return 0
+	}
+	// user IDs contain dots, so look for the user by key rather than by path. Old rooms may have levels as
+	// strings, which Int() parses.
+	level := powerLevels.Get("content.users_default").Int()
+	powerLevels.Get("content.users").ForEach(func(key, value gjson.Result) bool {
+		if key.Str != userID {
+			return true
+		}
+		level = value.Int()
+		return false
+	})
+	return level
+}
+
+// RedactsEventID returns the ID of the event which this redaction event redacts, or "" if it isn't a
+// redaction. Newer room versions put `redacts` in the content rather than at the top level.
+func RedactsEventID(eventJSON gjson.Result) string {
+	if eventJSON.Get("type").Str != "m.room.redaction" {
+		return ""
+	}
+	if redacts := eventJSON.Get("redacts").Str; redacts != "" {
+		return redacts
+	}
+	return eventJSON.Get("content.redacts").Str
+}
+
+// RedactEventJSON strips the event down to the keys which survive redaction, and records the redaction
+// event in unsigned.redacted_because if it is given.
+func RedactEventJSON(eventJSON, redactedBecause json.RawMessage) (json.RawMessage, error) {
+	var event map[string]json.RawMessage
+	if err := json.Unmarshal(eventJSON, &event); err != nil {
+		return nil, fmt.Errorf("RedactEventJSON: %w", err)
+	}
+	redacted := make(map[string]json.RawMessage, len(preservedEventKeys)+2)
+	for key, val := range event {
+		if preservedEventKeys[key] {
+			redacted[key] = val
+		}
+	}
+	content := make(map[string]json.RawMessage)
+	evType := gjson.GetBytes(eventJSON, "type").Str
+	if keep, ok := preservedContentKeys[evType]; ok {
+		var original map[string]json.RawMessage
+		// content which isn't an object has nothing worth keeping
+		_ = json.Unmarshal(event["content"], &original)
+		for key, val := range original {
+			if keep == nil || keep[key] {
+				content[key] = val
+			}
+		}
+	}
+	var err error
+	if redacted["content"], err = json.Marshal(content); err != nil {
+		return nil, fmt.Errorf("RedactEventJSON: %w", err)
+	}
+	if redactedBecause != nil {
+		unsigned, err := json.Marshal(map[string]json.RawMessage{
+			"redacted_because": redactedBecause,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("RedactEventJSON: %w", err)
+		}
+		redacted["unsigned"] = unsigned
+	}
+	return json.Marshal(redacted)
+}
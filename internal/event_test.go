@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestUserPowerLevel(t *testing.T) {
+	powerLevels := gjson.Parse(`{"type":"m.room.power_levels","content":{"users":{"@alice:localhost":100,"@bob:localhost":"50"},"users_default":10}}`)
+	testCases := []struct {
+		powerLevels gjson.Result
+		userID      string
+		want        int64
+	}{
+		{powerLevels: powerLevels, userID: "@alice:localhost", want: 100},
+		{powerLevels: powerLevels, userID: "@bob:localhost", want: 50},
+		{powerLevels: powerLevels, userID: "@charlie:localhost", want: 10},
+		// no power levels: only the creator has power
+		{powerLevels: gjson.Result{}, userID: "@creator:localhost", want: 100},
+		{powerLevels: gjson.Result{}, userID: "@alice:localhost", want: 0},
+	}
+	for _, tc := range testCases {
+		if got := UserPowerLevel(tc.powerLevels, "@creator:localhost", tc.userID); got != tc.want {
+			t.Errorf("UserPowerLevel(%s): got %d want %d", tc.userID, got, tc.want)
+		}
+	}
+}
+
+func TestRedactsEventID(t *testing.T) {
+	testCases := []struct {
+		event string
+		want  string
+	}{
+		{event: `{"type":"m.room.redaction","redacts":"$a","content":{}}`, want: "$a"},
+		{event: `{"type":"m.room.redaction","content":{"redacts":"$b"}}`, want: "$b"},
+		{event: `{"type":"m.room.message","redacts":"$c","content":{"redacts":"$c"}}`, want: ""},
+		{event: `{"type":"m.room.redaction","content":{}}`, want: ""},
+	}
+	for _, tc := range testCases {
+		if got := RedactsEventID(gjson.Parse(tc.event)); got != tc.want {
+			t.Errorf("RedactsEventID(%s): got %q want %q", tc.event, got, tc.want)
+		}
+	}
+}
+
+func TestRedactEventJSON(t *testing.T) {
+	redaction := json.RawMessage(`{"type":"m.room.redaction","event_id":"$r","redacts":"$a","content":{}}`)
+	testCases := []struct {
+		name      string
+		event     string
+		redaction json.RawMessage
+		want      string
+	}{
+		{
+			name:      "message content is removed",
+			event:     `{"type":"m.room.message","event_id":"$a","sender":"@a:b","origin_server_ts":1,"content":{"body":"secret"},"unsigned":{"age":5}}`,
+			redaction: redaction,
+			want:      `{"type":"m.room.message","event_id":"$a","sender":"@a:b","origin_server_ts":1,"content":{},"unsigned":{"redacted_because":{"type":"m.room.redaction","event_id":"$r","redacts":"$a","content":{}}}}`,
+		},
+		{
+			name:  "member keeps membership",
+			event: `{"type":"m.room.member","event_id":"$a","state_key":"@a:b","content":{"membership":"join","displayname":"Alice"}}`,
+			want:  `{"type":"m.room.member","event_id":"$a","state_key":"@a:b","content":{"membership":"join"}}`,
+		},
+		{
+			name:  "create keeps all content",
+			event: `{"type":"m.room.create","event_id":"$a","state_key":"","content":{"creator":"@a:b","room_version":"10"}}`,
+			want:  `{"type":"m.room.create","event_id":"$a","state_key":"","content":{"creator":"@a:b","room_version":"10"}}`,
+		},
+		{
+			name:  "name is removed",
+			event: `{"type":"m.room.name","event_id":"$a","state_key":"","content":{"name":"Secret room"}}`,
+			want:  `{"type":"m.room.name","event_id":"$a","state_key":"","content":{}}`,
+		},
+	}
+	for _, tc := range testCases {
+		got, err := RedactEventJSON(json.RawMessage(tc.event), tc.redaction)
+		if err != nil {
+			t.Fatalf("%s: RedactEventJSON returned error: %s", tc.name, err)
+		}
+		var gotVal, wantVal interface{}
+		if err := json.Unmarshal(got, &gotVal); err != nil {
+			t.Fatalf("%s: RedactEventJSON returned invalid JSON: %s", tc.name, err)
+		}
+		if err := json.Unmarshal([]byte(tc.want), &wantVal); err != nil {
+			t.Fatalf("%s: invalid test case JSON: %s", tc.name, err)
+		}
+		if !reflect.DeepEqual(gotVal, wantVal) {
+			t.Errorf("%s: got %s want %s", tc.name, string(got), tc.want)
+		}
+	}
+	if _, err := RedactEventJSON(json.RawMessage(`not json`), nil); err == nil {
+		t.Errorf("RedactEventJSON: expected error for invalid JSON")
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !faults
+// +build !faults
+
+package internal
+
+import "context"
+
+// Fault injection points for chaos testing, which do nothing unless built with `-tags faults`. See
+// faults_enabled.go.
+
+// FaultsEnabled is true if this binary was built with fault injection.
+const FaultsEnabled = false
+
+// InjectDBFault returns an error to fail a database transaction with, or nil.
+func InjectDBFault() error { return nil }
+
+// InjectPollerDelay delays a poller's response from the homeserver.
+func InjectPollerDelay(ctx context.Context) {}
+
+// InjectDroppedNotification returns true if a notification should be silently dropped.
+func InjectDroppedNotification() bool { return false }
@@ -0,0 +1,96 @@
+//go:build faults
+// +build faults
+
+package internal
+
+// Fault injection for chaos testing, enabled with `-tags faults`. This must never be used in production.
+// Faults are configured with environment variables when the process starts:
+//   SYNCV3_FAULT_DB_ERROR_RATE     the fraction of database transactions which fail e.g '0.01'
+//   SYNCV3_FAULT_POLLER_DELAY      the max random delay added to each sync v2 response e.g '2s'
+//   SYNCV3_FAULT_DROP_NOTIFY_RATE  the fraction of in-memory notifications which are dropped e.g '0.01'
+//   SYNCV3_FAULT_SEED              the random seed, to help repeat a failing run. Defaults to the time.
+// For example, to run the end-to-end tests with faults:
+//   go build -tags faults ./cmd/syncv3 && SYNCV3_FAULT_DB_ERROR_RATE=0.01 ./tests-e2e/run-tests.sh .
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrInjectedFault is returned by InjectDBFault when a fault is injected.
+var ErrInjectedFault = errors.New("injected fault")
+
+const FaultsEnabled = true
+
+type faultConfig struct {
+	dbErrorRate    float64
+	pollerDelay    time.Duration
+	dropNotifyRate float64
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+var faults = newFaultConfig(os.Getenv)
+
+func newFaultConfig(getenv func(string) string) *faultConfig {
+	seed := time.Now().UnixNano()
+	if s, err := strconv.ParseInt(getenv("SYNCV3_FAULT_SEED"), 10, 64); err == nil {
+		seed = s
+	}
+	c := &faultConfig{
+		rng: rand.New(rand.NewSource(seed)),
+	}
+	c.dbErrorRate, _ = strconv.ParseFloat(getenv("SYNCV3_FAULT_DB_ERROR_RATE"), 64)
+	c.pollerDelay, _ = time.ParseDuration(getenv("SYNCV3_FAULT_POLLER_DELAY"))
+	c.dropNotifyRate, _ = strconv.ParseFloat(getenv("SYNCV3_FAULT_DROP_NOTIFY_RATE"), 64)
+	logger.Warn().Int64("seed", seed).Float64("db_error_rate", c.dbErrorRate).Dur("poller_delay", c.pollerDelay).
+		Float64("drop_notify_rate", c.dropNotifyRate).Msg("FAULT INJECTION IS ENABLED, DO NOT USE IN PRODUCTION")
+	return c
+}
+
+// happens returns true with the given probability.
+func (c *faultConfig) happens(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rng.Float64() < rate
+}
+
+// randomDuration returns a duration in [0, max).
+func (c *faultConfig) randomDuration(max time.Duration) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Duration(c.rng.Int63n(int64(max)))
+}
+
+// InjectDBFault returns an error to fail a database transaction with, or nil.
+func InjectDBFault() error {
+	if faults.happens(faults.dbErrorRate) {
+		return ErrInjectedFault
+	}
+	return nil
+}
+
+// InjectPollerDelay delays a poller's response from the homeserver.
+func InjectPollerDelay(ctx context.Context) {
+	if faults.pollerDelay <= 0 {
+		return
+	}
+	select {
+	case <-time.After(faults.randomDuration(faults.pollerDelay)):
+	case <-ctx.Done():
+	}
+}
+
+// InjectDroppedNotification returns true if a notification should be silently dropped.
+func InjectDroppedNotification() bool {
+	return faults.happens(faults.dropNotifyRate)
+}
@@ -0,0 +1,56 @@
+//go:build faults
+// +build faults
+
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFaultConfig(t *testing.T) {
+	env := map[string]string{
+		"SYNCV3_FAULT_DB_ERROR_RATE":    "1",
+		"SYNCV3_FAULT_POLLER_DELAY":     "2s",
+		"SYNCV3_FAULT_DROP_NOTIFY_RATE": "0.5",
+		"SYNCV3_FAULT_SEED":             "42",
+	}
+	c := newFaultConfig(func(key string) string { return env[key] })
+	if c.dbErrorRate != 1 || c.pollerDelay != 2*time.Second || c.dropNotifyRate != 0.5 {
+		t.Fatalf("wrong config: %+v", c)
+	}
+	if !c.happens(c.dbErrorRate) {
+		t.Errorf("happens(1) returned false")
+	}
+	if c.happens(0) {
+		t.Errorf("happens(0) returned true")
+	}
+	for i := 0; i < 100; i++ {
+		if d := c.randomDuration(c.pollerDelay); d < 0 || d >= c.pollerDelay {
+			t.Fatalf("randomDuration: got %v want [0, %v)", d, c.pollerDelay)
+		}
+	}
+
+	// the same seed injects the same faults
+	drops := func() []bool {
+		c := newFaultConfig(func(key string) string { return env[key] })
+		result := make([]bool, 20)
+		for i := range result {
+			result[i] = c.happens(c.dropNotifyRate)
+		}
+		return result
+	}
+	first := drops()
+	second := drops()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("same seed gave different faults: %v and %v", first, second)
+		}
+	}
+
+	// no faults unless configured
+	c = newFaultConfig(func(key string) string { return "" })
+	if c.happens(c.dbErrorRate) || c.happens(c.dropNotifyRate) || c.pollerDelay != 0 {
+		t.Errorf("faults injected without config: %+v", c)
+	}
+}
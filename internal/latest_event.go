@@ -0,0 +1,55 @@
+package internal
+
+import "sort"
+
+// The event types which do not count as a room's latest event by default. These events don't change what
+// a user would want to see in a room preview, so they shouldn't bump the room to the top of the room list.
+var DefaultIgnoredLatestEventTypes = []string{
+	"m.reaction",
+	"m.room.redaction",
+	"m.room.power_levels",
+	"m.room.join_rules",
+	"m.room.history_visibility",
+	"m.room.guest_access",
+	"m.room.server_acl",
+	"m.room.pinned_events",
+}
+
+// LatestEventFilter decides which events are relevant enough to be a room's latest event, which is used for
+// the room's LastMessageTimestamp. A nil filter treats every event as relevant.
+type LatestEventFilter struct {
+	ignoredTypes map[string]struct{}
+}
+
+// NewLatestEventFilter makes a filter which ignores events of the given types.
+func NewLatestEventFilter(ignoredTypes []string) *LatestEventFilter {
+	f := &LatestEventFilter{
+		ignoredTypes: make(map[string]struct{}, len(ignoredTypes)),
+	}
+	for _, evType := range ignoredTypes {
+		f.ignoredTypes[evType] = struct{}{}
+	}
+	return f
+}
+
+// IsRelevant returns true if an event of this type can be a room's latest event.
+func (f *LatestEventFilter) IsRelevant(eventType string) bool {
+	if f == nil {
+		return true
+	}
+	_, ignored := f.ignoredTypes[eventType]
+	return !ignored
+}
+
+// IgnoredTypes returns the sorted list of ignored event types.
+func (f *LatestEventFilter) IgnoredTypes() []string {
+	if f == nil {
+		return nil
+	}
+	types := make([]string, 0, len(f.ignoredTypes))
+	for evType := range f.ignoredTypes {
+		types = append(types, evType)
+	}
+	sort.Strings(types)
+	return types
+}
@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLatestEventFilter(t *testing.T) {
+	f := NewLatestEventFilter([]string{"m.room.redaction", "m.reaction"})
+	testCases := []struct {
+		eventType string
+		want      bool
+	}{
+		{eventType: "m.room.message", want: true},
+		{eventType: "m.room.encrypted", want: true},
+		{eventType: "m.room.member", want: true},
+		{eventType: "m.reaction", want: false},
+		{eventType: "m.room.redaction", want: false},
+	}
+	for _, tc := range testCases {
+		if got := f.IsRelevant(tc.eventType); got != tc.want {
+			t.Errorf("IsRelevant(%s): got %v want %v", tc.eventType, got, tc.want)
+		}
+	}
+	if got, want := f.IgnoredTypes(), []string{"m.reaction", "m.room.redaction"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("IgnoredTypes: got %v want %v", got, want)
+	}
+
+	var nilFilter *LatestEventFilter
+	if !nilFilter.IsRelevant("m.reaction") {
+		t.Errorf("nil filter should treat every event as relevant")
+	}
+	if got := nilFilter.IgnoredTypes(); got != nil {
+		t.Errorf("nil filter: got ignored types %v want nil", got)
+	}
+}
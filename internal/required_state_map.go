@@ -8,6 +8,8 @@ type RequiredStateMap struct {
 	eventTypeToStateKeys            map[string][]string
 	allState                        bool
 	lazyLoading                     bool
+	// state which is always included, and served from memory where possible. See SetEssentialState.
+	essentialState [][2]string
 }
 
 func NewRequiredStateMap(eventTypesWithWildcardStateKeys map[string]struct{},
@@ -23,6 +25,17 @@ func NewRequiredStateMap(eventTypesWithWildcardStateKeys map[string]struct{},
 	}
 }
 
+// SetEssentialState includes these (event type, state key) pairs in addition to the rest of the map. Unlike
+// the rest of the map, they can be served from memory even when the map uses wildcards or lazy loading.
+func (rsm *RequiredStateMap) SetEssentialState(tuples [][2]string) {
+	rsm.essentialState = tuples
+}
+
+// EssentialStateTuples returns the pairs passed to SetEssentialState.
+func (rsm *RequiredStateMap) EssentialStateTuples() [][2]string {
+	return rsm.essentialState
+}
+
 func (rsm *RequiredStateMap) IsLazyLoading() bool {
 	return rsm.lazyLoading
 }
@@ -59,19 +72,53 @@ func (rsm *RequiredStateMap) Include(evType, stateKey string) bool {
 			return true
 		}
 	}
+	for _, tuple := range rsm.essentialState {
+		if tuple[0] == evType && tuple[1] == stateKey {
+			return true
+		}
+	}
 	return false
 }
 
+// ExactStateTuples returns the (event type, state key) pairs to include, including the essential state, if
+// they are all listed explicitly without wildcards or lazy loading. Returns false otherwise.
+func (rsm *RequiredStateMap) ExactStateTuples() ([][2]string, bool) {
+	if rsm.allState || rsm.lazyLoading || len(rsm.stateKeysForWildcardEventType) > 0 || len(rsm.eventTypesWithWildcardStateKeys) > 0 {
+		return nil, false
+	}
+	var tuples [][2]string
+	seen := make(map[[2]string]struct{})
+	for evType, stateKeys := range rsm.eventTypeToStateKeys {
+		for _, stateKey := range stateKeys {
+			tuple := [2]string{evType, stateKey}
+			if _, ok := seen[tuple]; ok {
+				continue
+			}
+			seen[tuple] = struct{}{}
+			tuples = append(tuples, tuple)
+		}
+	}
+	for _, tuple := range rsm.essentialState {
+		if _, ok := seen[tuple]; ok {
+			continue
+		}
+		seen[tuple] = struct{}{}
+		tuples = append(tuples, tuple)
+	}
+	return tuples, true
+}
+
 func (rsm *RequiredStateMap) Empty() bool {
 	return !rsm.allState && !rsm.lazyLoading &&
 		len(rsm.eventTypeToStateKeys) == 0 &&
+		len(rsm.essentialState) == 0 &&
 		len(rsm.stateKeysForWildcardEventType) == 0 &&
 		len(rsm.eventTypesWithWildcardStateKeys) == 0
 }
 
 // work out what to ask the storage layer: if we have wildcard event types we need to pull all
 // room state and cannot only pull out certain event types. If we have wildcard state keys we
-// need to use an empty list for state keys.
+// need to use an empty list for state keys. The essential state is not included, see EssentialStateTuples.
 func (rsm *RequiredStateMap) QueryStateMap() map[string][]string {
 	queryStateMap := make(map[string][]string)
 	if rsm.allState {
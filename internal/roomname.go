@@ -4,25 +4,46 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+
+	"github.com/tidwall/gjson"
 )
 
+// The state event listing a room's functional members, e.g bots and bridges, which are not shown as part of
+// the room's name or member counts.
+const FunctionalMembersEventType = "io.element.functional_members"
+
+// The state event types which are always indexed. See RoomMetadata.IndexedState.
+var DefaultIndexedStateTypes = []string{FunctionalMembersEventType}
+
 // Metadata about a room that is consistent between all users in the room.
 type RoomMetadata struct {
 	RoomID               string
 	Heroes               []Hero
 	NameEvent            string // the content of m.room.name, NOT the calculated name
 	CanonicalAlias       string
+	AvatarEvent          string // the content.url of m.room.avatar
 	JoinCount            int
 	InviteCount          int
-	LastMessageTimestamp uint64
+	LastMessageTimestamp uint64 // the latest event not ignored by the LatestEventFilter, used for recency
+	LatestEventTimestamp uint64 // the latest event of any type
 	Encrypted            bool
 	PredecessorRoomID    *string
 	UpgradedRoomID       *string
 	RoomType             *string
+	// from the create event, or "" if it was not specified (which means room version 1)
+	RoomVersion string
+	// the join_rule from the current m.room.join_rules event, as written. See NormaliseJoinRule.
+	JoinRule string
 	// if this room is a space, which rooms are m.space.child state events. This is the same for all users hence is global.
 	ChildSpaceRooms map[string]struct{}
-	// The latest m.typing ephemeral event for this room.
-	TypingEvent json.RawMessage
+	// The content of current state events whose types are indexed, e.g custom state events which affect how
+	// the room is shown: event type -> state key -> content. See SetIndexedState.
+	IndexedState map[string]map[string]json.RawMessage
+	// The latest m.typing ephemeral event for this room. Ephemeral, so not written to startup snapshots.
+	TypingEvent json.RawMessage `json:"-"`
+	// Derived from recent messages, if GlobalCache.SetContentHints is enabled. Only messages received since
+	// the room was loaded are counted, so these are not written to startup snapshots.
+	ContentHints ContentHints `json:"-"`
 }
 
 // SameRoomName checks if the fields relevant for room names have changed between the two metadatas.
@@ -36,6 +57,16 @@ func (m *RoomMetadata) SameRoomName(other *RoomMetadata) bool {
 		sameHeroes(m.Heroes, other.Heroes))
 }
 
+// SameHeroes checks if the heroes have changed between the two metadatas.
+func (m *RoomMetadata) SameHeroes(other *RoomMetadata) bool {
+	return sameHeroes(m.Heroes, other.Heroes)
+}
+
+// SameAvatar checks if the room avatar has changed between the two metadatas.
+func (m *RoomMetadata) SameAvatar(other *RoomMetadata) bool {
+	return m.AvatarEvent == other.AvatarEvent
+}
+
 func (m *RoomMetadata) SameJoinCount(other *RoomMetadata) bool {
 	return m.JoinCount == other.JoinCount
 }
@@ -59,13 +90,98 @@ func sameHeroes(a, b []Hero) bool {
 	return true
 }
 
+// RemoveHero removes this user from the heroes. Like all the setters on RoomMetadata, the slice is replaced
+// rather than modified, as copies of the metadata handed out to requests share it.
 func (m *RoomMetadata) RemoveHero(userID string) {
 	for i, h := range m.Heroes {
 		if h.ID == userID {
-			m.Heroes = append(m.Heroes[0:i], m.Heroes[i+1:]...)
+			heroes := make([]Hero, 0, len(m.Heroes)-1)
+			heroes = append(heroes, m.Heroes[:i]...)
+			m.Heroes = append(heroes, m.Heroes[i+1:]...)
+			return
+		}
+	}
+}
+
+// SetHero updates the name of this hero, adding them to the end of the heroes if they are not one already.
+func (m *RoomMetadata) SetHero(hero Hero) {
+	heroes := make([]Hero, len(m.Heroes), len(m.Heroes)+1)
+	copy(heroes, m.Heroes)
+	for i := range heroes {
+		if heroes[i].ID == hero.ID {
+			heroes[i].Name = hero.Name
+			m.Heroes = heroes
 			return
 		}
 	}
+	m.Heroes = append(heroes, hero)
+}
+
+// SetChildSpaceRoom adds or removes this room from the children of this space. The map is replaced rather
+// than modified, as copies of the metadata handed out to requests share it.
+func (m *RoomMetadata) SetChildSpaceRoom(roomID string, isChild bool) {
+	children := make(map[string]struct{}, len(m.ChildSpaceRooms)+1)
+	for childRoomID := range m.ChildSpaceRooms {
+		children[childRoomID] = struct{}{}
+	}
+	if isChild {
+		children[roomID] = struct{}{}
+	} else {
+		delete(children, roomID)
+	}
+	m.ChildSpaceRooms = children
+}
+
+// IndexedStateContent returns the content of this indexed state event, or nil if the room doesn't have it.
+func (m *RoomMetadata) IndexedStateContent(evType, stateKey string) json.RawMessage {
+	return m.IndexedState[evType][stateKey]
+}
+
+// SetIndexedState sets the content of this indexed state event, removing it if the content is empty.
+// The maps are replaced rather than modified, as copies of the metadata handed out to requests share them.
+func (m *RoomMetadata) SetIndexedState(evType, stateKey string, content json.RawMessage) {
+	indexed := make(map[string]map[string]json.RawMessage, len(m.IndexedState)+1)
+	for t, stateKeys := range m.IndexedState {
+		indexed[t] = stateKeys
+	}
+	stateKeys := make(map[string]json.RawMessage, len(indexed[evType])+1)
+	for sk, c := range indexed[evType] {
+		stateKeys[sk] = c
+	}
+	if len(content) == 0 || string(content) == "{}" {
+		delete(stateKeys, stateKey)
+	} else {
+		stateKeys[stateKey] = content
+	}
+	if len(stateKeys) == 0 {
+		delete(indexed, evType)
+	} else {
+		indexed[evType] = stateKeys
+	}
+	if len(indexed) == 0 {
+		indexed = nil
+	}
+	m.IndexedState = indexed
+}
+
+// FunctionalMembers returns the user IDs listed as service members in the room's functional members state
+// event, if any.
+func (m *RoomMetadata) FunctionalMembers() map[string]struct{} {
+	content := m.IndexedStateContent(FunctionalMembersEventType, "")
+	if content == nil {
+		return nil
+	}
+	var members map[string]struct{}
+	gjson.GetBytes(content, "service_members").ForEach(func(_, v gjson.Result) bool {
+		if v.Type == gjson.String {
+			if members == nil {
+				members = make(map[string]struct{})
+			}
+			members[v.Str] = struct{}{}
+		}
+		return true
+	})
+	return members
 }
 
 func (m *RoomMetadata) IsSpace() bool {
@@ -156,8 +272,13 @@ func disambiguate(heroes []Hero) []string {
 			if name == "" {
 				name = h.ID
 			}
-			disambiguatedNames[i] = fmt.Sprintf("%s (%s)", name, h.ID)
+			disambiguatedNames[i] = DisambiguatedName(name, h.ID)
 		}
 	}
 	return disambiguatedNames
 }
+
+// DisambiguatedName returns the name to show for a user whose display name is shared with another member.
+func DisambiguatedName(displayName, userID string) string {
+	return fmt.Sprintf("%s (%s)", displayName, userID)
+}
@@ -0,0 +1,44 @@
+package internal
+
+import "strconv"
+
+// The room version to assume when the create event does not specify one.
+const DefaultRoomVersion = "1"
+
+// The first room version which supports each join rule. Join rules not listed here are supported by all
+// room versions.
+var joinRuleMinRoomVersion = map[string]int{
+	"knock":            7,
+	"restricted":       8,
+	"knock_restricted": 10,
+}
+
+// NormaliseJoinRule returns the effective join rule for a room, given the room version from the create
+// event. Join rules which are not supported by the room version are not enforced by servers as written,
+// so they are treated as "invite". Unknown room versions (e.g. experimental ones) are assumed to support
+// every join rule. A missing join rule is "invite".
+func NormaliseJoinRule(roomVersion, joinRule string) string {
+	if joinRule == "" {
+		return "invite"
+	}
+	minVersion, ok := joinRuleMinRoomVersion[joinRule]
+	if !ok {
+		return joinRule
+	}
+	if roomVersion == "" {
+		roomVersion = DefaultRoomVersion
+	}
+	version, err := strconv.Atoi(roomVersion)
+	if err != nil {
+		return joinRule
+	}
+	if version < minVersion {
+		return "invite"
+	}
+	return joinRule
+}
+
+// IsPublic returns true if anyone can join this room without an invite.
+func (m *RoomMetadata) IsPublic() bool {
+	return NormaliseJoinRule(m.RoomVersion, m.JoinRule) == "public"
+}
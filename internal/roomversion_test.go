@@ -0,0 +1,29 @@
+package internal
+
+import "testing"
+
+func TestNormaliseJoinRule(t *testing.T) {
+	testCases := []struct {
+		roomVersion string
+		joinRule    string
+		want        string
+	}{
+		{roomVersion: "10", joinRule: "public", want: "public"},
+		{roomVersion: "", joinRule: "public", want: "public"},
+		{roomVersion: "9", joinRule: "", want: "invite"},
+		{roomVersion: "6", joinRule: "knock", want: "invite"},
+		{roomVersion: "7", joinRule: "knock", want: "knock"},
+		{roomVersion: "7", joinRule: "restricted", want: "invite"},
+		{roomVersion: "8", joinRule: "restricted", want: "restricted"},
+		{roomVersion: "", joinRule: "restricted", want: "invite"},
+		{roomVersion: "9", joinRule: "knock_restricted", want: "invite"},
+		{roomVersion: "11", joinRule: "knock_restricted", want: "knock_restricted"},
+		{roomVersion: "org.matrix.msc1234", joinRule: "knock_restricted", want: "knock_restricted"},
+	}
+	for _, tc := range testCases {
+		got := NormaliseJoinRule(tc.roomVersion, tc.joinRule)
+		if got != tc.want {
+			t.Errorf("NormaliseJoinRule(%q, %q): got %q want %q", tc.roomVersion, tc.joinRule, got, tc.want)
+		}
+	}
+}
@@ -8,3 +8,9 @@ type Receipt struct {
 	ThreadID  string `db:"thread_id"`
 	IsPrivate bool
 }
+
+// ThreadUnreadCounts are the unread counts for a single thread in a room.
+type ThreadUnreadCounts struct {
+	HighlightCount    int `json:"highlight_count"`
+	NotificationCount int `json:"notification_count"`
+}
@@ -6,6 +6,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 )
@@ -76,6 +77,10 @@ func (ps *PubSub) getChan(chanName string) chan Payload {
 }
 
 func (ps *PubSub) Notify(chanName string, p Payload) error {
+	if internal.InjectDroppedNotification() {
+		logger.Warn().Str("chan", chanName).Str("type", p.Type()).Msg("dropping notification: injected fault")
+		return nil
+	}
 	ch := ps.getChan(chanName)
 	select {
 	case ch <- p:
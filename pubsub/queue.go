@@ -0,0 +1,155 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/state"
+)
+
+// QueueStore persists the payloads of a PersistentQueue. Implemented by state.NotificationQueueTable.
+type QueueStore interface {
+	Insert(chanName, payloadType string, payload []byte) (int64, error)
+	Select(chanName string, limit int) ([]state.QueuedNotification, error)
+	Delete(chanName string, ids []int64) error
+}
+
+// the payloads which can be sent via a PersistentQueue: payload type => struct type
+var queueablePayloads = func() map[string]reflect.Type {
+	payloads := []Payload{
+		&V2Initialise{}, &V2Accumulate{}, &V2UnreadCounts{}, &V2ThreadUnreadCounts{}, &V2AccountData{},
+		&V2LeaveRoom{}, &V2InviteRoom{}, &V2InitialSyncComplete{}, &V2DeviceData{}, &V2Typing{}, &V2Receipt{},
+		&V2DeviceMessages{}, &V2ExpiredToken{}, &V2UserArchived{}, &V2GappySync{},
+		&V3EnsurePolling{}, &V3Nudge{},
+	}
+	result := make(map[string]reflect.Type, len(payloads))
+	for _, p := range payloads {
+		result[p.Type()] = reflect.TypeOf(p).Elem()
+	}
+	return result
+}()
+
+// PersistentQueue is a Notifier and Listener which writes payloads to the database before delivering them.
+// Notify returns as soon as the payload is written, so producers never wait for consumers. Payloads are
+// deleted once they have been delivered, so if the process crashes, undelivered payloads are delivered
+// when it restarts. A payload may be delivered twice if the process crashes whilst delivering it.
+// Each channel must only have one listener.
+type PersistentQueue struct {
+	store QueueStore
+	// the max number of payloads to load at once
+	batchSize int
+	// how often to check for payloads written by other processes
+	pollInterval time.Duration
+
+	mu    sync.Mutex
+	wakes map[string]chan struct{}
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewPersistentQueue(store QueueStore) *PersistentQueue {
+	return &PersistentQueue{
+		store:        store,
+		batchSize:    100,
+		pollInterval: time.Second,
+		wakes:        make(map[string]chan struct{}),
+		closed:       make(chan struct{}),
+	}
+}
+
+func (q *PersistentQueue) wake(chanName string) chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ch := q.wakes[chanName]
+	if ch == nil {
+		ch = make(chan struct{}, 1)
+		q.wakes[chanName] = ch
+	}
+	return ch
+}
+
+func (q *PersistentQueue) Notify(chanName string, p Payload) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload %s: %s", p.Type(), err)
+	}
+	if _, err = q.store.Insert(chanName, p.Type(), data); err != nil {
+		return fmt.Errorf("failed to queue payload %s: %s", p.Type(), err)
+	}
+	// wake up the listener, unless it has already been woken up
+	select {
+	case q.wake(chanName) <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (q *PersistentQueue) Close() error {
+	q.closeOnce.Do(func() {
+		close(q.closed)
+	})
+	return nil
+}
+
+func (q *PersistentQueue) Listen(chanName string, fn func(p Payload)) error {
+	wake := q.wake(chanName)
+	for {
+		select {
+		case <-q.closed:
+			return nil
+		default:
+		}
+		delivered, err := q.deliver(chanName, fn)
+		if err != nil {
+			logger.Err(err).Str("chan", chanName).Msg("PersistentQueue: failed to deliver payloads")
+		}
+		if delivered > 0 && err == nil {
+			continue // there may be more payloads waiting
+		}
+		select {
+		case <-q.closed:
+			return nil
+		case <-wake:
+		case <-time.After(q.pollInterval):
+		}
+	}
+}
+
+// deliver calls fn with the next batch of payloads on this channel, then deletes them. Returns the number of
+// payloads delivered.
+func (q *PersistentQueue) deliver(chanName string, fn func(p Payload)) (int, error) {
+	queued, err := q.store.Select(chanName, q.batchSize)
+	if err != nil || len(queued) == 0 {
+		return 0, err
+	}
+	ids := make([]int64, 0, len(queued))
+	for _, qn := range queued {
+		ids = append(ids, qn.ID)
+		p, err := decodePayload(qn)
+		if err != nil {
+			// there's no point retrying this payload, so drop it
+			logger.Err(err).Str("chan", chanName).Int64("id", qn.ID).Msg("PersistentQueue: dropping payload")
+			continue
+		}
+		fn(p)
+	}
+	// Only delete what was delivered: Notify is called concurrently, so a payload with a lower ID than these
+	// may commit after they were selected, and must still be delivered.
+	return len(queued), q.store.Delete(chanName, ids)
+}
+
+func decodePayload(qn state.QueuedNotification) (Payload, error) {
+	t, ok := queueablePayloads[qn.PayloadType]
+	if !ok {
+		return nil, fmt.Errorf("unknown payload type %s", qn.PayloadType)
+	}
+	p := reflect.New(t).Interface().(Payload)
+	if err := json.Unmarshal(qn.Payload, p); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal payload %s: %s", qn.PayloadType, err)
+	}
+	return p, nil
+}
@@ -0,0 +1,161 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/state"
+)
+
+type memQueueStore struct {
+	mu     sync.Mutex
+	nextID int64
+	queued []state.QueuedNotification
+	// called once, before the next Delete
+	beforeDelete func()
+}
+
+func (s *memQueueStore) Insert(chanName, payloadType string, payload []byte) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	s.queued = append(s.queued, state.QueuedNotification{
+		ID: s.nextID, Chan: chanName, PayloadType: payloadType, Payload: payload,
+	})
+	return s.nextID, nil
+}
+
+func (s *memQueueStore) Select(chanName string, limit int) ([]state.QueuedNotification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result []state.QueuedNotification
+	for _, qn := range s.queued {
+		if qn.Chan == chanName && len(result) < limit {
+			result = append(result, qn)
+		}
+	}
+	return result, nil
+}
+
+func (s *memQueueStore) Delete(chanName string, ids []int64) error {
+	s.mu.Lock()
+	beforeDelete := s.beforeDelete
+	s.beforeDelete = nil
+	s.mu.Unlock()
+	if beforeDelete != nil {
+		beforeDelete()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deleted := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		deleted[id] = true
+	}
+	var remaining []state.QueuedNotification
+	for _, qn := range s.queued {
+		if qn.Chan != chanName || !deleted[qn.ID] {
+			remaining = append(remaining, qn)
+		}
+	}
+	s.queued = remaining
+	return nil
+}
+
+func TestPersistentQueue(t *testing.T) {
+	store := &memQueueStore{}
+	payloads := []Payload{
+		&V2Accumulate{RoomID: "!a:localhost", PrevBatch: "p", EventNIDs: []int64{1, 2}},
+		&V2UnreadCounts{UserID: "@alice:localhost", RoomID: "!a:localhost"},
+		&V2Typing{RoomID: "!a:localhost", EphemeralEvent: []byte(`{"type":"m.typing"}`)},
+	}
+	// payloads sent before anyone is listening, e.g before a crash, are not lost
+	q := NewPersistentQueue(store)
+	for _, p := range payloads[:2] {
+		if err := q.Notify(ChanV2, p); err != nil {
+			t.Fatalf("Notify: %s", err)
+		}
+	}
+	q.Close()
+
+	q = NewPersistentQueue(store)
+	q.batchSize = 1
+	received := make(chan Payload, 10)
+	go q.Listen(ChanV2, func(p Payload) {
+		received <- p
+	})
+	defer q.Close()
+	if err := q.Notify(ChanV2, payloads[2]); err != nil {
+		t.Fatalf("Notify: %s", err)
+	}
+	for i, want := range payloads {
+		select {
+		case got := <-received:
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("payload %d: got %+v want %+v", i, got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for payload %d", i)
+		}
+	}
+	// delivered payloads are removed from the queue
+	deadline := time.Now().Add(time.Second)
+	for {
+		queued, _ := store.Select(ChanV2, 10)
+		if len(queued) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("delivered payloads were not removed: %+v", queued)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Tests that a payload given a lower ID, which becomes visible after a payload with a higher ID was selected,
+// is still delivered.
+func TestPersistentQueueOutOfOrderCommits(t *testing.T) {
+	store := &memQueueStore{}
+	q := NewPersistentQueue(store)
+	q.pollInterval = 10 * time.Millisecond
+	received := make(chan Payload, 10)
+	go q.Listen(ChanV2, func(p Payload) {
+		received <- p
+	})
+	defer q.Close()
+
+	late := &V2DeviceMessages{UserID: "@alice:localhost", DeviceID: "A"}
+	lateData, err := json.Marshal(late)
+	if err != nil {
+		t.Fatalf("Marshal: %s", err)
+	}
+	// reserve the lower ID, and commit it between the higher ID being selected and deleted
+	store.mu.Lock()
+	store.nextID++
+	lateID := store.nextID
+	store.beforeDelete = func() {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		store.queued = append([]state.QueuedNotification{{
+			ID: lateID, Chan: ChanV2, PayloadType: late.Type(), Payload: lateData,
+		}}, store.queued...)
+	}
+	store.mu.Unlock()
+
+	early := &V2InitialSyncComplete{UserID: "@alice:localhost", DeviceID: "A"}
+	if err := q.Notify(ChanV2, early); err != nil {
+		t.Fatalf("Notify: %s", err)
+	}
+	for i, want := range []Payload{early, late} {
+		select {
+		case got := <-received:
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("payload %d: got %+v want %+v", i, got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for payload %d", i)
+		}
+	}
+}
@@ -16,12 +16,15 @@ type V2Listener interface {
 	OnInvite(p *V2InviteRoom)
 	OnLeftRoom(p *V2LeaveRoom)
 	OnUnreadCounts(p *V2UnreadCounts)
+	OnThreadUnreadCounts(p *V2ThreadUnreadCounts)
 	OnInitialSyncComplete(p *V2InitialSyncComplete)
 	OnDeviceData(p *V2DeviceData)
 	OnTyping(p *V2Typing)
 	OnReceipt(p *V2Receipt)
 	OnDeviceMessages(p *V2DeviceMessages)
 	OnExpiredToken(p *V2ExpiredToken)
+	OnUserArchived(p *V2UserArchived)
+	OnGappySync(p *V2GappySync)
 }
 
 type V2Initialise struct {
@@ -48,10 +51,20 @@ type V2UnreadCounts struct {
 
 func (*V2UnreadCounts) Type() string { return "V2UnreadCounts" }
 
-type V2AccountData struct {
+type V2ThreadUnreadCounts struct {
 	UserID string
 	RoomID string
-	Types  []string
+	// the complete set of thread counts for this room: thread ID -> counts
+	Counts map[string]internal.ThreadUnreadCounts
+}
+
+func (*V2ThreadUnreadCounts) Type() string { return "V2ThreadUnreadCounts" }
+
+// V2AccountData is sent once per poll with all the account data which changed in that poll.
+type V2AccountData struct {
+	UserID string
+	// room ID -> the account data types which changed. Global account data has an empty room ID.
+	Types map[string][]string
 }
 
 func (*V2AccountData) Type() string { return "V2AccountData" }
@@ -111,6 +124,23 @@ type V2ExpiredToken struct {
 
 func (*V2ExpiredToken) Type() string { return "V2ExpiredToken" }
 
+// V2UserArchived is sent when all of a user's devices have been inactive for long enough that their
+// pollers were stopped and their data deleted.
+type V2UserArchived struct {
+	UserID    string
+	DeviceIDs []string
+}
+
+func (*V2UserArchived) Type() string { return "V2UserArchived" }
+
+// V2GappySync is sent when a poller receives a state block for a room we already know about, meaning some
+// events in the room were missed and in-memory membership counts may be wrong.
+type V2GappySync struct {
+	RoomID string
+}
+
+func (*V2GappySync) Type() string { return "V2GappySync" }
+
 type V2Sub struct {
 	listener Listener
 	receiver V2Listener
@@ -143,6 +173,8 @@ func (v *V2Sub) onMessage(p Payload) {
 		v.receiver.OnLeftRoom(pl)
 	case *V2UnreadCounts:
 		v.receiver.OnUnreadCounts(pl)
+	case *V2ThreadUnreadCounts:
+		v.receiver.OnThreadUnreadCounts(pl)
 	case *V2InitialSyncComplete:
 		v.receiver.OnInitialSyncComplete(pl)
 	case *V2DeviceData:
@@ -153,6 +185,10 @@ func (v *V2Sub) onMessage(p Payload) {
 		v.receiver.OnDeviceMessages(pl)
 	case *V2ExpiredToken:
 		v.receiver.OnExpiredToken(pl)
+	case *V2UserArchived:
+		v.receiver.OnUserArchived(pl)
+	case *V2GappySync:
+		v.receiver.OnGappySync(pl)
 	default:
 		logger.Warn().Str("type", p.Type()).Msg("V2Sub: unhandled payload type")
 	}
@@ -5,6 +5,7 @@ const ChanV3 = "v3ch"
 
 type V3Listener interface {
 	EnsurePolling(p *V3EnsurePolling)
+	Nudge(p *V3Nudge)
 }
 
 type V3EnsurePolling struct {
@@ -14,6 +15,14 @@ type V3EnsurePolling struct {
 
 func (*V3EnsurePolling) Type() string { return "V3EnsurePolling" }
 
+// V3Nudge asks the poller for this device to poll again straight away, as the user has just done
+// something which will show up in their sync stream.
+type V3Nudge struct {
+	DeviceID string
+}
+
+func (*V3Nudge) Type() string { return "V3Nudge" }
+
 type V3Sub struct {
 	listener Listener
 	receiver V3Listener
@@ -34,6 +43,8 @@ func (v *V3Sub) onMessage(p Payload) {
 	switch pl := p.(type) {
 	case *V3EnsurePolling:
 		v.receiver.EnsurePolling(pl)
+	case *V3Nudge:
+		v.receiver.Nudge(pl)
 	default:
 		logger.Warn().Str("type", p.Type()).Msg("V3Sub: unhandled payload type")
 	}
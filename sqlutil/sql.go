@@ -4,12 +4,16 @@ import (
 	"fmt"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/internal"
 )
 
 // WithTransaction runs a block of code passing in an SQL transaction
 // If the code returns an error or panics then the transactions is rolled back
 // Otherwise the transaction is committed.
 func WithTransaction(db *sqlx.DB, fn func(txn *sqlx.Tx) error) (err error) {
+	if err = internal.InjectDBFault(); err != nil {
+		return fmt.Errorf("WithTransaction.Begin: %w", err)
+	}
 	txn, err := db.Beginx()
 	if err != nil {
 		return fmt.Errorf("WithTransaction.Begin: %w", err)
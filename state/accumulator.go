@@ -8,6 +8,7 @@ import (
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
+	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sqlutil"
 	"github.com/tidwall/gjson"
 )
@@ -167,7 +168,7 @@ func (a *Accumulator) Initialise(roomID string, state []json.RawMessage) (Initia
 		// we don't race with multiple calls to Initialise with the same room ID.
 		snapshotID, err := a.roomsTable.CurrentAfterSnapshotID(txn, roomID)
 		if err != nil {
-			return fmt.Errorf("error fetching snapshot id for room %s: %s", roomID, err)
+			return fmt.Errorf("error fetching snapshot id for room %s: %w", roomID, err)
 		}
 		if snapshotID > 0 {
 			// Poller A has received a gappy sync v2 response with a state block, and
@@ -189,7 +190,7 @@ func (a *Accumulator) Initialise(roomID string, state []json.RawMessage) (Initia
 			}
 			unknownEventIDs, err := a.eventsTable.SelectUnknownEventIDs(txn, eventIDs)
 			if err != nil {
-				return fmt.Errorf("error determing which event IDs are unknown: %s", err)
+				return fmt.Errorf("error determing which event IDs are unknown: %w", err)
 			}
 			for unknownEventID := range unknownEventIDs {
 				res.PrependTimelineEvents = append(res.PrependTimelineEvents, eventIDToRawEvent[unknownEventID])
@@ -207,7 +208,7 @@ func (a *Accumulator) Initialise(roomID string, state []json.RawMessage) (Initia
 			}
 		}
 		if err := ensureFieldsSet(events); err != nil {
-			return fmt.Errorf("events malformed: %s", err)
+			return fmt.Errorf("events malformed: %w", err)
 		}
 		eventIDToNID, err := a.eventsTable.Insert(txn, events, false)
 		if err != nil {
@@ -263,7 +264,7 @@ func (a *Accumulator) Initialise(roomID string, state []json.RawMessage) (Initia
 		}
 
 		if err = a.spacesTable.HandleSpaceUpdates(txn, events); err != nil {
-			return fmt.Errorf("HandleSpaceUpdates: %s", err)
+			return fmt.Errorf("HandleSpaceUpdates: %w", err)
 		}
 
 		// check for metadata events
@@ -306,7 +307,7 @@ func (a *Accumulator) Accumulate(roomID string, prevBatch string, timeline []jso
 				RoomID: roomID,
 			}
 			if err := e.ensureFieldsSetOnEvent(); err != nil {
-				return fmt.Errorf("event malformed: %s", err)
+				return fmt.Errorf("event malformed: %w", err)
 			}
 			if _, ok := seenEvents[e.ID]; ok {
 				logger.Warn().Str("event_id", e.ID).Str("room_id", roomID).Msg(
@@ -380,12 +381,12 @@ func (a *Accumulator) Accumulate(roomID string, prevBatch string, timeline []jso
 				if snapID != 0 {
 					oldStripped, err = a.strippedEventsForSnapshot(txn, snapID)
 					if err != nil {
-						return fmt.Errorf("failed to load stripped state events for snapshot %d: %s", snapID, err)
+						return fmt.Errorf("failed to load stripped state events for snapshot %d: %w", snapID, err)
 					}
 				}
 				newStripped, replacedNID, err := a.calculateNewSnapshot(oldStripped, ev)
 				if err != nil {
-					return fmt.Errorf("failed to calculateNewSnapshot: %s", err)
+					return fmt.Errorf("failed to calculateNewSnapshot: %w", err)
 				}
 				replacesNID = replacedNID
 				memNIDs, otherNIDs := newStripped.NIDs()
@@ -399,13 +400,23 @@ func (a *Accumulator) Accumulate(roomID string, prevBatch string, timeline []jso
 				}
 				snapID = newSnapshot.SnapshotID
 			}
-			if err := a.eventsTable.UpdateBeforeSnapshotID(txn, ev.NID, beforeSnapID, replacesNID); err != nil {
+			if err := a.eventsTable.UpdateBeforeSnapshotID(txn, roomID, ev.NID, beforeSnapID, replacesNID); err != nil {
 				return err
 			}
 		}
 
+		redactions := make(map[string]json.RawMessage)
+		for _, ev := range newEvents {
+			if redacts := internal.RedactsEventID(gjson.ParseBytes(ev.JSON)); redacts != "" {
+				redactions[redacts] = ev.JSON
+			}
+		}
+		if err = a.eventsTable.Redact(txn, roomID, redactions); err != nil {
+			return fmt.Errorf("failed to apply redactions: %w", err)
+		}
+
 		if err = a.spacesTable.HandleSpaceUpdates(txn, newEvents); err != nil {
-			return fmt.Errorf("HandleSpaceUpdates: %s", err)
+			return fmt.Errorf("HandleSpaceUpdates: %w", err)
 		}
 
 		// the last fetched snapshot ID is the current one
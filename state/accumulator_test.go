@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 
 	"github.com/matrix-org/sliding-sync/sync2"
@@ -190,6 +191,48 @@ func TestAccumulatorAccumulate(t *testing.T) {
 	}
 }
 
+// Test that redactions strip the content of the redacted event in the database, whether the event was
+// accumulated earlier or in the same timeline as the redaction.
+func TestAccumulatorRedactions(t *testing.T) {
+	roomID := "!TestAccumulatorRedactions:localhost"
+	db, close := connectToDB(t)
+	defer close()
+	accumulator := NewAccumulator(db)
+	_, err := accumulator.Initialise(roomID, []json.RawMessage{
+		[]byte(`{"event_id":"$create", "type":"m.room.create", "state_key":"", "content":{"creator":"@me:localhost"}}`),
+	})
+	if err != nil {
+		t.Fatalf("failed to Initialise accumulator: %s", err)
+	}
+	_, _, err = accumulator.Accumulate(roomID, "", []json.RawMessage{
+		[]byte(`{"event_id":"$old", "type":"m.room.message", "sender":"@me:localhost", "content":{"body":"secret","msgtype":"m.text"}}`),
+	})
+	if err != nil {
+		t.Fatalf("failed to Accumulate: %s", err)
+	}
+	_, _, err = accumulator.Accumulate(roomID, "", []json.RawMessage{
+		[]byte(`{"event_id":"$new", "type":"m.room.message", "sender":"@me:localhost", "content":{"body":"also secret","msgtype":"m.text"}}`),
+		[]byte(`{"event_id":"$redact_old", "type":"m.room.redaction", "sender":"@me:localhost", "redacts":"$old", "content":{}}`),
+		[]byte(`{"event_id":"$redact_new", "type":"m.room.redaction", "sender":"@me:localhost", "content":{"redacts":"$new"}}`),
+	})
+	if err != nil {
+		t.Fatalf("failed to Accumulate: %s", err)
+	}
+	events, err := accumulator.eventsTable.SelectByIDs(nil, true, []string{"$old", "$new"})
+	if err != nil {
+		t.Fatalf("failed to select events: %s", err)
+	}
+	for _, ev := range events {
+		if body := gjson.GetBytes(ev.JSON, "content.body"); body.Exists() {
+			t.Errorf("event %s was not redacted: %s", ev.ID, string(ev.JSON))
+		}
+		wantRedactedBy := "$redact_" + strings.TrimPrefix(ev.ID, "$")
+		if gjson.GetBytes(ev.JSON, "unsigned.redacted_because.event_id").Str != wantRedactedBy {
+			t.Errorf("event %s missing redacted_because: %s", ev.ID, string(ev.JSON))
+		}
+	}
+}
+
 func TestAccumulatorDelta(t *testing.T) {
 	roomID := "!TestAccumulatorDelta:localhost"
 	db, close := connectToDB(t)
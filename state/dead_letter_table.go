@@ -0,0 +1,80 @@
+package state
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// DeadLetter is an event which failed to be processed by the caches, and has been skipped.
+type DeadLetter struct {
+	EventNID int64  `db:"event_nid" json:"event_nid"`
+	RoomID   string `db:"room_id" json:"room_id"`
+	EventID  string `db:"event_id" json:"event_id"`
+	Error    string `db:"error" json:"error"`
+	Failures int    `db:"failures" json:"failures"`
+	FailedAt int64  `db:"failed_at" json:"failed_at"`
+}
+
+// DeadLetterTable stores events which failed to be processed, so they can be retried or discarded
+// by an admin. The event itself remains in the events table.
+type DeadLetterTable struct {
+	db *sqlx.DB
+}
+
+func NewDeadLetterTable(db *sqlx.DB) *DeadLetterTable {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE TABLE IF NOT EXISTS syncv3_dead_letters (
+		event_nid BIGINT NOT NULL PRIMARY KEY,
+		room_id TEXT NOT NULL,
+		event_id TEXT NOT NULL,
+		error TEXT NOT NULL,
+		failures INTEGER NOT NULL DEFAULT 1,
+		failed_at BIGINT NOT NULL
+	);
+	`)
+	return &DeadLetterTable{db}
+}
+
+// Insert parks an event in the dead-letter table after it failed to be processed `failures` times. If the
+// event is already there, the error is replaced and the failure count is increased.
+func (t *DeadLetterTable) Insert(eventNID int64, roomID, eventID, errMsg string, failures int) error {
+	_, err := t.db.Exec(`
+	INSERT INTO syncv3_dead_letters (event_nid, room_id, event_id, error, failures, failed_at) VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT (event_nid) DO UPDATE SET error=$4, failed_at=$6, failures=syncv3_dead_letters.failures+$5`,
+		eventNID, roomID, eventID, errMsg, failures, time.Now().UnixMilli(),
+	)
+	return err
+}
+
+// Select returns the dead letter for this event NID, or nil if it does not exist.
+func (t *DeadLetterTable) Select(eventNID int64) (*DeadLetter, error) {
+	var dl DeadLetter
+	err := t.db.Get(&dl, `SELECT event_nid, room_id, event_id, error, failures, failed_at FROM syncv3_dead_letters WHERE event_nid=$1`, eventNID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &dl, nil
+}
+
+// SelectAll returns all dead letters, oldest event first.
+func (t *DeadLetterTable) SelectAll() ([]DeadLetter, error) {
+	var dls []DeadLetter
+	err := t.db.Select(&dls, `SELECT event_nid, room_id, event_id, error, failures, failed_at FROM syncv3_dead_letters ORDER BY event_nid ASC`)
+	return dls, err
+}
+
+// Delete removes the dead letter for this event NID. Returns true if a row was deleted.
+func (t *DeadLetterTable) Delete(eventNID int64) (bool, error) {
+	result, err := t.db.Exec(`DELETE FROM syncv3_dead_letters WHERE event_nid=$1`, eventNID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
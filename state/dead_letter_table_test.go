@@ -0,0 +1,55 @@
+package state
+
+import (
+	"testing"
+)
+
+func TestDeadLetterTable(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewDeadLetterTable(db)
+	roomID := "!TestDeadLetterTable:localhost"
+
+	// missing rows return nil
+	dl, err := table.Select(123456789)
+	assertNoError(t, err)
+	if dl != nil {
+		t.Fatalf("Select on missing row returned %+v", dl)
+	}
+
+	assertNoError(t, table.Insert(123456789, roomID, "$A", "first error", 3))
+	assertNoError(t, table.Insert(123456790, roomID, "$B", "error B", 3))
+	// inserting again adds to the failure count and replaces the error
+	assertNoError(t, table.Insert(123456789, roomID, "$A", "second error", 1))
+	dl, err = table.Select(123456789)
+	assertNoError(t, err)
+	if dl == nil {
+		t.Fatalf("Select returned no row")
+	}
+	if dl.Failures != 4 || dl.Error != "second error" || dl.EventID != "$A" || dl.RoomID != roomID {
+		t.Fatalf("Select returned wrong row: %+v", dl)
+	}
+
+	all, err := table.SelectAll()
+	assertNoError(t, err)
+	var found int
+	for _, dl := range all {
+		if dl.RoomID == roomID {
+			found++
+		}
+	}
+	if found != 2 {
+		t.Fatalf("SelectAll: got %d rows for room, want 2", found)
+	}
+
+	deleted, err := table.Delete(123456789)
+	assertNoError(t, err)
+	if !deleted {
+		t.Fatalf("Delete did not delete the row")
+	}
+	deleted, err = table.Delete(123456789)
+	assertNoError(t, err)
+	if deleted {
+		t.Fatalf("Delete deleted a missing row")
+	}
+}
@@ -43,7 +43,12 @@ func NewDeviceDataTable(db *sqlx.DB) *DeviceDataTable {
 func (t *DeviceDataTable) Select(userID, deviceID string, swap bool) (dd *internal.DeviceData, err error) {
 	err = sqlutil.WithTransaction(t.db, func(txn *sqlx.Tx) error {
 		var row DeviceDataRow
-		err = t.db.Get(&row, `SELECT data FROM syncv3_device_data WHERE user_id=$1 AND device_id=$2`, userID, deviceID)
+		query := `SELECT data FROM syncv3_device_data WHERE user_id=$1 AND device_id=$2`
+		if swap {
+			// lock the row so changes upserted whilst swapping are not lost
+			query += ` FOR UPDATE`
+		}
+		err = txn.Get(&row, query, userID, deviceID)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				// if there is no device data for this user, it's not an error.
@@ -75,7 +80,7 @@ func (t *DeviceDataTable) Select(userID, deviceID string, swap bool) (dd *intern
 		if err != nil {
 			return err
 		}
-		_, err = t.db.Exec(`UPDATE syncv3_device_data SET data=$1 WHERE user_id=$2 AND device_id=$3`, data, userID, deviceID)
+		_, err = txn.Exec(`UPDATE syncv3_device_data SET data=$1 WHERE user_id=$2 AND device_id=$3`, data, userID, deviceID)
 		dd = &tempDD
 		dd.ChangedBits = changedBits
 		return err
@@ -88,13 +93,22 @@ func (t *DeviceDataTable) DeleteDevice(userID, deviceID string) error {
 	return err
 }
 
-// Upsert combines what is in the database for this user|device with the partial entry `dd`
+// Upsert combines what is in the database for this user|device with the partial entry `dd`. Changes
+// accumulate until they are swapped by Select, even if several pollers upsert the same device at once.
 func (t *DeviceDataTable) Upsert(dd *internal.DeviceData) (pos int64, err error) {
 	err = sqlutil.WithTransaction(t.db, func(txn *sqlx.Tx) error {
+		// make sure there is a row to lock, so concurrent upserts for a new device are combined too
+		_, err = txn.Exec(
+			`INSERT INTO syncv3_device_data(user_id, device_id, data) VALUES($1,$2,'{}') ON CONFLICT (user_id, device_id) DO NOTHING`,
+			dd.UserID, dd.DeviceID,
+		)
+		if err != nil {
+			return err
+		}
 		// select what already exists
 		var row DeviceDataRow
-		err = t.db.Get(&row, `SELECT data FROM syncv3_device_data WHERE user_id=$1 AND device_id=$2`, dd.UserID, dd.DeviceID)
-		if err != nil && err != sql.ErrNoRows {
+		err = txn.Get(&row, `SELECT data FROM syncv3_device_data WHERE user_id=$1 AND device_id=$2 FOR UPDATE`, dd.UserID, dd.DeviceID)
+		if err != nil {
 			return err
 		}
 		// unmarshal and combine
@@ -118,9 +132,8 @@ func (t *DeviceDataTable) Upsert(dd *internal.DeviceData) (pos int64, err error)
 		if err != nil {
 			return err
 		}
-		err = t.db.QueryRow(
-			`INSERT INTO syncv3_device_data(user_id, device_id, data) VALUES($1,$2,$3)
-			ON CONFLICT (user_id, device_id) DO UPDATE SET data=$3, id=nextval('syncv3_device_data_seq') RETURNING id`,
+		err = txn.QueryRow(
+			`UPDATE syncv3_device_data SET data=$3, id=nextval('syncv3_device_data_seq') WHERE user_id=$1 AND device_id=$2 RETURNING id`,
 			dd.UserID, dd.DeviceID, data,
 		).Scan(&pos)
 		return err
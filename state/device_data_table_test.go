@@ -1,7 +1,9 @@
 package state
 
 import (
+	"fmt"
 	"reflect"
+	"sync"
 	"testing"
 
 	"github.com/matrix-org/sliding-sync/internal"
@@ -237,3 +239,37 @@ func TestDeviceDataTableBitset(t *testing.T) {
 	bothUpdate.SetOTKCountChanged()
 	assertDeviceData(t, *got, bothUpdate)
 }
+
+// Device list changes from concurrent upserts, e.g from two pollers for the same device, must all
+// accumulate rather than overwriting each other.
+func TestDeviceDataTableConcurrentUpserts(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewDeviceDataTable(db)
+	userID := "@bobTestDeviceDataTableConcurrentUpserts"
+	deviceID := "BOBTestDeviceDataTableConcurrentUpserts"
+	var changed []string
+	for i := 0; i < 20; i++ {
+		changed = append(changed, fmt.Sprintf("@user%d:localhost", i))
+	}
+	var wg sync.WaitGroup
+	wg.Add(len(changed))
+	for _, changedUserID := range changed {
+		changedUserID := changedUserID
+		go func() {
+			defer wg.Done()
+			_, err := table.Upsert(&internal.DeviceData{
+				UserID:   userID,
+				DeviceID: deviceID,
+				DeviceLists: internal.DeviceLists{
+					New: internal.ToDeviceListChangesMap([]string{changedUserID}, nil),
+				},
+			})
+			assertNoError(t, err)
+		}()
+	}
+	wg.Wait()
+	got, err := table.Select(userID, deviceID, true)
+	assertNoError(t, err)
+	assertVal(t, "changed device lists", got.DeviceLists.Sent, internal.ToDeviceListChangesMap(changed, nil))
+}
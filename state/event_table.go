@@ -1,9 +1,17 @@
 package state
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"io"
 	"math"
+	"sync"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
@@ -101,9 +109,19 @@ type membershipEvent struct {
 	Membership string
 }
 
+// encryptedEventPrefix marks event JSON which has been encrypted at rest. Plaintext event JSON always
+// starts with '{' so the two can be told apart, which allows encryption to be enabled on an existing database.
+const encryptedEventPrefix = 0x01
+
 // EventTable stores events. A unique numeric ID is associated with each event.
 type EventTable struct {
 	db *sqlx.DB
+	// if set, event JSON is encrypted with this before being written
+	aead cipher.AEAD
+	// the unique constraint which duplicate events conflict with on insert. Loaded on first use, as it
+	// depends on whether the table is partitioned. See insertConflictTarget.
+	conflictTargetMu sync.Mutex
+	conflictTarget   string
 }
 
 // NewEventTable makes a new EventTable
@@ -133,8 +151,158 @@ func NewEventTable(db *sqlx.DB) *EventTable {
 	CREATE INDEX IF NOT EXISTS syncv3_nid_room_state_idx ON syncv3_events(room_id, event_nid, is_state);
 
 	CREATE UNIQUE INDEX IF NOT EXISTS syncv3_events_room_event_nid_type_skey_idx ON syncv3_events(event_nid, event_type, state_key);
+	-- index for finding snapshots which no event refers to
+	CREATE INDEX IF NOT EXISTS syncv3_events_before_snapshot_idx ON syncv3_events(before_state_snapshot_id);
 	`)
-	return &EventTable{db}
+	return &EventTable{db: db}
+}
+
+// PartitionEventsTable converts the events table into a table hash-partitioned on room ID with this many
+// partitions. This keeps each partition and its indexes small enough to vacuum quickly on deployments with
+// hundreds of millions of events, and queries for a room only touch that room's partition. Existing events
+// are copied in one transaction whilst writes are blocked, which can take a long time on a large database.
+// Does nothing if the table is already partitioned.
+//
+// Postgres requires unique constraints on a partitioned table to include the partition key, so once the
+// table is partitioned event IDs are only unique within a room.
+func PartitionEventsTable(db *sqlx.DB, partitions int) error {
+	partitioned, err := eventsTablePartitioned(db)
+	if err != nil {
+		return err
+	}
+	if partitioned {
+		var existing int
+		err = db.QueryRow(`SELECT count(*) FROM pg_inherits WHERE inhparent = 'syncv3_events'::regclass`).Scan(&existing)
+		if err != nil {
+			return fmt.Errorf("failed to count event partitions: %w", err)
+		}
+		if existing != partitions {
+			logger.Warn().Int("partitions", existing).Int("want", partitions).Msg(
+				"events table is already partitioned, the number of partitions cannot be changed",
+			)
+		}
+		return nil
+	}
+	start := time.Now()
+	logger.Info().Int("partitions", partitions).Msg("partitioning events table, this may take a while")
+	stmts := []string{
+		// stop events being written whilst they are copied
+		`LOCK TABLE syncv3_events IN EXCLUSIVE MODE`,
+		`CREATE TABLE syncv3_events_partitioned (LIKE syncv3_events INCLUDING DEFAULTS) PARTITION BY HASH (room_id)`,
+	}
+	for i := 0; i < partitions; i++ {
+		stmts = append(stmts, fmt.Sprintf(
+			`CREATE TABLE syncv3_events_p%d PARTITION OF syncv3_events_partitioned FOR VALUES WITH (MODULUS %d, REMAINDER %d)`,
+			i, partitions, i,
+		))
+	}
+	stmts = append(stmts,
+		`INSERT INTO syncv3_events_partitioned SELECT * FROM syncv3_events`,
+		`DROP TABLE syncv3_events`,
+		`ALTER TABLE syncv3_events_partitioned RENAME TO syncv3_events`,
+		// the same constraints and indexes as NewEventTable, with room_id added to the unique ones
+		`ALTER TABLE syncv3_events ADD PRIMARY KEY (event_nid, room_id)`,
+		`ALTER TABLE syncv3_events ADD UNIQUE (event_id, room_id)`,
+		`CREATE INDEX syncv3_events_type_sk_idx ON syncv3_events(event_type, state_key)`,
+		`CREATE INDEX syncv3_events_type_room_nid_idx ON syncv3_events(event_type, room_id, event_nid)`,
+		`CREATE INDEX syncv3_nid_room_state_idx ON syncv3_events(room_id, event_nid, is_state)`,
+		`CREATE UNIQUE INDEX syncv3_events_room_event_nid_type_skey_idx ON syncv3_events(event_nid, event_type, state_key, room_id)`,
+		`CREATE INDEX syncv3_events_before_snapshot_idx ON syncv3_events(before_state_snapshot_id)`,
+	)
+	err = sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+		for _, stmt := range stmts {
+			if _, err := txn.Exec(stmt); err != nil {
+				return fmt.Errorf("%s: %w", stmt, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to partition events table: %w", err)
+	}
+	logger.Info().Int("partitions", partitions).Dur("took", time.Since(start)).Msg("partitioned events table")
+	return nil
+}
+
+func eventsTablePartitioned(q sqlx.Queryer) (bool, error) {
+	var partitioned bool
+	err := q.QueryRowx(`SELECT EXISTS(SELECT 1 FROM pg_partitioned_table WHERE partrelid = 'syncv3_events'::regclass)`).Scan(&partitioned)
+	if err != nil {
+		return false, fmt.Errorf("failed to check if events are partitioned: %w", err)
+	}
+	return partitioned, nil
+}
+
+// insertConflictTarget returns the unique constraint which inserting a duplicate event conflicts with. Event
+// IDs are unique by themselves, unless the table is partitioned when they are unique within a room.
+func (t *EventTable) insertConflictTarget(txn *sqlx.Tx) (string, error) {
+	t.conflictTargetMu.Lock()
+	defer t.conflictTargetMu.Unlock()
+	if t.conflictTarget != "" {
+		return t.conflictTarget, nil
+	}
+	partitioned, err := eventsTablePartitioned(txn)
+	if err != nil {
+		return "", err
+	}
+	if partitioned {
+		t.conflictTarget = "(event_id, room_id)"
+	} else {
+		t.conflictTarget = "(event_id)"
+	}
+	return t.conflictTarget, nil
+}
+
+// EnableEncryption encrypts event JSON written from now on with a key derived from the secret, and
+// decrypts encrypted event JSON when it is read. Events which were written before encryption was enabled
+// are still readable, but are not encrypted.
+func (t *EventTable) EnableEncryption(secret string) error {
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return err
+	}
+	t.aead, err = cipher.NewGCM(block)
+	return err
+}
+
+func (t *EventTable) encryptJSON(js []byte) ([]byte, error) {
+	if t.aead == nil {
+		return js, nil
+	}
+	nonce := make([]byte, t.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, 1+len(nonce)+len(js)+t.aead.Overhead())
+	out = append(out, encryptedEventPrefix)
+	out = append(out, nonce...)
+	return t.aead.Seal(out, nonce, js, nil), nil
+}
+
+func (t *EventTable) decryptJSON(b []byte) ([]byte, error) {
+	if len(b) == 0 || b[0] != encryptedEventPrefix {
+		return b, nil // plaintext
+	}
+	if t.aead == nil {
+		return nil, fmt.Errorf("event is encrypted but no event encryption key is set")
+	}
+	nonceSize := t.aead.NonceSize()
+	if len(b) < 1+nonceSize {
+		return nil, fmt.Errorf("encrypted event is too short")
+	}
+	return t.aead.Open(nil, b[1:1+nonceSize], b[1+nonceSize:], nil)
+}
+
+func (t *EventTable) decryptEvents(events []Event) error {
+	for i := range events {
+		js, err := t.decryptJSON(events[i].JSON)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt event %d: %w", events[i].NID, err)
+		}
+		events[i].JSON = js
+	}
+	return nil
 }
 
 func (t *EventTable) SelectHighestNID() (highest int64, err error) {
@@ -166,13 +334,30 @@ func (t *EventTable) Insert(txn *sqlx.Tx, events []Event, checkFields bool) (map
 		}
 		events[i].JSON = js
 	}
+	if t.aead != nil {
+		// encrypt a copy so callers can keep using the plaintext events
+		encrypted := make([]Event, len(events))
+		copy(encrypted, events)
+		for i := range encrypted {
+			js, err := t.encryptJSON(encrypted[i].JSON)
+			if err != nil {
+				return nil, err
+			}
+			encrypted[i].JSON = js
+		}
+		events = encrypted
+	}
+	conflictTarget, err := t.insertConflictTarget(txn)
+	if err != nil {
+		return nil, err
+	}
 	chunks := sqlutil.Chunkify(8, MaxPostgresParameters, EventChunker(events))
 	var eventID string
 	var eventNID int
 	for _, chunk := range chunks {
 		rows, err := txn.NamedQuery(`
 		INSERT INTO syncv3_events (event_id, event, event_type, state_key, room_id, membership, prev_batch, is_state)
-        VALUES (:event_id, :event, :event_type, :state_key, :room_id, :membership, :prev_batch, :is_state) ON CONFLICT (event_id) DO NOTHING RETURNING event_id, event_nid`, chunk)
+        VALUES (:event_id, :event, :event_type, :state_key, :room_id, :membership, :prev_batch, :is_state) ON CONFLICT `+conflictTarget+` DO NOTHING RETURNING event_id, event_nid`, chunk)
 		if err != nil {
 			return nil, err
 		}
@@ -200,6 +385,9 @@ func (t *EventTable) selectAny(txn *sqlx.Tx, numWanted int, queryStr string, pqA
 			return nil, fmt.Errorf("events table query %s got %d events wanted %d. err=%s", queryStr, len(events), numWanted, err)
 		}
 	}
+	if err == nil {
+		err = t.decryptEvents(events)
+	}
 	return
 }
 
@@ -288,14 +476,49 @@ func (t *EventTable) SelectUnknownEventIDs(txn *sqlx.Tx, maybeUnknownEventIDs []
 	return unknownMap, nil
 }
 
-// UpdateBeforeSnapshotID sets the before_state_snapshot_id field to `snapID` for the given NIDs.
-func (t *EventTable) UpdateBeforeSnapshotID(txn *sqlx.Tx, eventNID, snapID, replacesNID int64) error {
+// UpdateBeforeSnapshotID sets the before_state_snapshot_id field to `snapID` for the given NIDs. The room ID
+// lets Postgres skip the other rooms' partitions if the table is partitioned.
+func (t *EventTable) UpdateBeforeSnapshotID(txn *sqlx.Tx, roomID string, eventNID, snapID, replacesNID int64) error {
 	_, err := txn.Exec(
-		`UPDATE syncv3_events SET before_state_snapshot_id=$1, event_replaces_nid=$2 WHERE event_nid = $3`, snapID, replacesNID, eventNID,
+		`UPDATE syncv3_events SET before_state_snapshot_id=$1, event_replaces_nid=$2 WHERE event_nid = $3 AND room_id = $4`,
+		snapID, replacesNID, eventNID, roomID,
 	)
 	return err
 }
 
+// Redact strips the content of the events in this room which are redacted by the given redaction events,
+// keyed on the ID of the event they redact. Events which are unknown or in a different room are ignored.
+func (t *EventTable) Redact(txn *sqlx.Tx, roomID string, redactions map[string]json.RawMessage) error {
+	if len(redactions) == 0 {
+		return nil
+	}
+	eventIDs := make([]string, 0, len(redactions))
+	for eventID := range redactions {
+		eventIDs = append(eventIDs, eventID)
+	}
+	events, err := t.SelectByIDs(txn, false, eventIDs)
+	if err != nil {
+		return fmt.Errorf("failed to select redacted events: %w", err)
+	}
+	for _, ev := range events {
+		if ev.RoomID != roomID {
+			continue
+		}
+		js, err := internal.RedactEventJSON(ev.JSON, redactions[ev.ID])
+		if err != nil {
+			return fmt.Errorf("failed to redact event %s: %w", ev.ID, err)
+		}
+		js, err = t.encryptJSON(js)
+		if err != nil {
+			return err
+		}
+		if _, err = txn.Exec(`UPDATE syncv3_events SET event=$1 WHERE event_nid=$2 AND room_id=$3`, js, ev.NID, roomID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // query the latest events in each of the room IDs given, using highestNID as the highest event.
 func (t *EventTable) LatestEventInRooms(txn *sqlx.Tx, roomIDs []string, highestNID int64) (events []Event, err error) {
 	// the position (event nid) may be for a random different room, so we need to find the highest nid <= this position for this room
@@ -308,6 +531,9 @@ func (t *EventTable) LatestEventInRooms(txn *sqlx.Tx, roomIDs []string, highestN
 	if err == sql.ErrNoRows {
 		err = nil
 	}
+	if err == nil {
+		err = t.decryptEvents(events)
+	}
 	return
 }
 
@@ -316,7 +542,10 @@ func (t *EventTable) SelectEventsBetween(txn *sqlx.Tx, roomID string, lowerExclu
 	err := txn.Select(&events, `SELECT event_nid, event FROM syncv3_events WHERE event_nid > $1 AND event_nid <= $2 AND room_id = $3 ORDER BY event_nid ASC LIMIT $4`,
 		lowerExclusive, upperInclusive, roomID, limit,
 	)
-	return events, err
+	if err != nil {
+		return nil, err
+	}
+	return events, t.decryptEvents(events)
 }
 
 func (t *EventTable) SelectLatestEventsBetween(txn *sqlx.Tx, roomID string, lowerExclusive, upperInclusive int64, limit int) ([]Event, error) {
@@ -325,13 +554,19 @@ func (t *EventTable) SelectLatestEventsBetween(txn *sqlx.Tx, roomID string, lowe
 	err := txn.Select(&events, `SELECT event_nid, event FROM syncv3_events WHERE event_nid > $1 AND event_nid <= $2 AND room_id = $3 AND is_state=FALSE ORDER BY event_nid DESC LIMIT $4`,
 		lowerExclusive, upperInclusive, roomID, limit,
 	)
-	return events, err
+	if err != nil {
+		return nil, err
+	}
+	return events, t.decryptEvents(events)
 }
 
-func (t *EventTable) selectLatestEventInAllRooms(txn *sqlx.Tx) ([]Event, error) {
+// selectLatestEventInRooms returns the latest event in each of the given rooms, or in all rooms if roomIDs is nil.
+func (t *EventTable) selectLatestEventInRooms(txn *sqlx.Tx, roomIDs []string) ([]Event, error) {
 	result := []Event{}
 	rows, err := txn.Query(
-		`SELECT room_id, event FROM syncv3_events WHERE event_nid in (SELECT MAX(event_nid) FROM syncv3_events GROUP BY room_id)`,
+		`SELECT room_id, event FROM syncv3_events WHERE event_nid in (
+			SELECT MAX(event_nid) FROM syncv3_events WHERE $1::text[] IS NULL OR room_id = ANY($1) GROUP BY room_id
+		)`, pq.StringArray(roomIDs),
 	)
 	if err != nil {
 		return nil, err
@@ -344,7 +579,54 @@ func (t *EventTable) selectLatestEventInAllRooms(txn *sqlx.Tx) ([]Event, error)
 		}
 		result = append(result, ev)
 	}
-	return result, nil
+	return result, t.decryptEvents(result)
+}
+
+// selectCreateEvents returns the m.room.create event of every room. This uses the index on
+// (event_type, state_key), so doesn't scan every event.
+func (t *EventTable) selectCreateEvents(txn *sqlx.Tx) ([]Event, error) {
+	result := []Event{}
+	// rooms only have one create event, but pick the first if a broken server sent another
+	rows, err := txn.Query(
+		`SELECT DISTINCT ON (room_id) room_id, event FROM syncv3_events
+		WHERE event_type='m.room.create' AND state_key='' ORDER BY room_id, event_nid ASC`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ev Event
+		if err := rows.Scan(&ev.RoomID, &ev.JSON); err != nil {
+			return nil, err
+		}
+		result = append(result, ev)
+	}
+	return result, t.decryptEvents(result)
+}
+
+// selectLatestRelevantEventInRooms is like selectLatestEventInRooms but skips events of the ignored
+// types. Rooms which only have ignored events are not returned.
+func (t *EventTable) selectLatestRelevantEventInRooms(txn *sqlx.Tx, ignoredTypes, roomIDs []string) ([]Event, error) {
+	result := []Event{}
+	rows, err := txn.Query(
+		`SELECT room_id, event FROM syncv3_events WHERE event_nid in (
+			SELECT MAX(event_nid) FROM syncv3_events WHERE event_type != ALL($1) AND ($2::text[] IS NULL OR room_id = ANY($2))
+			GROUP BY room_id
+		)`, pq.StringArray(ignoredTypes), pq.StringArray(roomIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ev Event
+		if err := rows.Scan(&ev.RoomID, &ev.JSON); err != nil {
+			return nil, err
+		}
+		result = append(result, ev)
+	}
+	return result, t.decryptEvents(result)
 }
 
 // Select all events between the bounds matching the type, state_key given.
@@ -357,7 +639,10 @@ func (t *EventTable) SelectEventsWithTypeStateKey(eventType, stateKey string, lo
 		ORDER BY event_nid ASC`,
 		lowerExclusive, upperInclusive, eventType, stateKey,
 	)
-	return events, err
+	if err != nil {
+		return nil, err
+	}
+	return events, t.decryptEvents(events)
 }
 
 // Select all events between the bounds matching the type, state_key given, in the rooms specified only.
@@ -376,7 +661,10 @@ func (t *EventTable) SelectEventsWithTypeStateKeyInRooms(roomIDs []string, event
 	err = t.db.Select(&events,
 		t.db.Rebind(query), args...,
 	)
-	return events, err
+	if err != nil {
+		return nil, err
+	}
+	return events, t.decryptEvents(events)
 }
 
 // Select all events matching the given event type in a room. Used to implement the room member stream (paginated room lists)
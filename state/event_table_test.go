@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"database/sql"
 	"fmt"
+	"strings"
 	"testing"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/tidwall/gjson"
 
 	"github.com/matrix-org/sliding-sync/sqlutil"
@@ -88,7 +90,7 @@ func TestEventTable(t *testing.T) {
 	// set a snapshot ID on them
 	var firstSnapshotID int64 = 55
 	for _, nid := range idToNIDs {
-		if err = table.UpdateBeforeSnapshotID(txn, nid, firstSnapshotID, 0); err != nil {
+		if err = table.UpdateBeforeSnapshotID(txn, roomID, nid, firstSnapshotID, 0); err != nil {
 			t.Fatalf("UpdateSnapshotID: %s", err)
 		}
 	}
@@ -946,3 +948,157 @@ func TestEventTableSelectUnknownEventIDs(t *testing.T) {
 		}
 	}
 }
+
+func TestEventTableEncryption(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	txn, err := db.Beginx()
+	if err != nil {
+		t.Fatalf("failed to start txn: %s", err)
+	}
+	defer txn.Rollback()
+	roomID := "!TestEventTableEncryption:localhost"
+	plainJSON := []byte(`{"event_id":"$plain_TestEventTableEncryption","type":"T1","state_key":"","room_id":"` + roomID + `","content":{"secret":"plain"}}`)
+	encJSON := []byte(`{"event_id":"$enc_TestEventTableEncryption","type":"T2","state_key":"","room_id":"` + roomID + `","content":{"secret":"shh"}}`)
+
+	// events written before encryption is enabled remain readable afterwards
+	table := NewEventTable(db)
+	if _, err = table.Insert(txn, []Event{{JSON: plainJSON}}, true); err != nil {
+		t.Fatalf("Insert failed: %s", err)
+	}
+	if err = table.EnableEncryption("secret"); err != nil {
+		t.Fatalf("EnableEncryption failed: %s", err)
+	}
+	encEvents := []Event{{JSON: encJSON}}
+	if _, err = table.Insert(txn, encEvents, true); err != nil {
+		t.Fatalf("Insert failed: %s", err)
+	}
+	if !bytes.Equal(encEvents[0].JSON, encJSON) {
+		t.Fatalf("Insert modified the caller's event JSON: %s", string(encEvents[0].JSON))
+	}
+
+	// the database does not have the plaintext
+	var raw []byte
+	if err = txn.QueryRow(`SELECT event FROM syncv3_events WHERE event_id=$1`, "$enc_TestEventTableEncryption").Scan(&raw); err != nil {
+		t.Fatalf("failed to select raw event: %s", err)
+	}
+	if bytes.Contains(raw, []byte("shh")) {
+		t.Fatalf("event JSON was stored in plaintext: %s", string(raw))
+	}
+
+	events, err := table.SelectByIDs(txn, true, []string{"$plain_TestEventTableEncryption", "$enc_TestEventTableEncryption"})
+	if err != nil {
+		t.Fatalf("SelectByIDs failed: %s", err)
+	}
+	if !bytes.Equal(events[0].JSON, plainJSON) {
+		t.Errorf("got plaintext event %s want %s", string(events[0].JSON), string(plainJSON))
+	}
+	if !bytes.Equal(events[1].JSON, encJSON) {
+		t.Errorf("got encrypted event %s want %s", string(events[1].JSON), string(encJSON))
+	}
+
+	// without the key, encrypted events cannot be read
+	if _, err = NewEventTable(db).SelectByIDs(txn, true, []string{"$enc_TestEventTableEncryption"}); err == nil {
+		t.Errorf("SelectByIDs without a key succeeded, want an error")
+	}
+	// and with the wrong key, they cannot be read either
+	wrongKeyTable := NewEventTable(db)
+	if err = wrongKeyTable.EnableEncryption("wrong"); err != nil {
+		t.Fatalf("EnableEncryption failed: %s", err)
+	}
+	if _, err = wrongKeyTable.SelectByIDs(txn, true, []string{"$enc_TestEventTableEncryption"}); err == nil {
+		t.Errorf("SelectByIDs with the wrong key succeeded, want an error")
+	}
+}
+
+func TestPartitionEventsTable(t *testing.T) {
+	// use a separate schema so the other tests keep an unpartitioned table
+	db, close := connectToDB(t)
+	defer close()
+	db.MustExec(`DROP SCHEMA IF EXISTS syncv3_partition_test CASCADE; CREATE SCHEMA syncv3_partition_test;`)
+	defer db.MustExec(`DROP SCHEMA syncv3_partition_test CASCADE`)
+	pdb, err := sqlx.Open("postgres", postgresConnectionString+" search_path=syncv3_partition_test")
+	if err != nil {
+		t.Fatalf("failed to open SQL db: %s", err)
+	}
+	defer pdb.Close()
+
+	table := NewEventTable(pdb)
+	roomA := "!a:TestPartitionEventsTable"
+	roomB := "!b:TestPartitionEventsTable"
+	newEvent := func(id, roomID string) Event {
+		return Event{
+			JSON: []byte(`{"event_id":"` + id + `","type":"m.room.message","room_id":"` + roomID + `","content":{}}`),
+		}
+	}
+	var before map[string]int
+	err = sqlutil.WithTransaction(pdb, func(txn *sqlx.Tx) error {
+		before, err = table.Insert(txn, []Event{newEvent("$1", roomA), newEvent("$2", roomB)}, true)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Insert failed: %s", err)
+	}
+
+	if err = PartitionEventsTable(pdb, 4); err != nil {
+		t.Fatalf("PartitionEventsTable: %s", err)
+	}
+	var numPartitions int
+	if err = pdb.QueryRow(`SELECT count(*) FROM pg_inherits WHERE inhparent = 'syncv3_events'::regclass`).Scan(&numPartitions); err != nil {
+		t.Fatalf("failed to count partitions: %s", err)
+	}
+	if numPartitions != 4 {
+		t.Fatalf("got %d partitions want 4", numPartitions)
+	}
+	// partitioning again does nothing, and making the table again is fine
+	if err = PartitionEventsTable(pdb, 4); err != nil {
+		t.Fatalf("PartitionEventsTable again: %s", err)
+	}
+	table = NewEventTable(pdb)
+	var indexes []string
+	err = pdb.Select(&indexes, `SELECT indexname FROM pg_indexes WHERE schemaname = 'syncv3_partition_test' AND tablename = 'syncv3_events'`)
+	if err != nil {
+		t.Fatalf("failed to select indexes: %s", err)
+	}
+	hasIndex := make(map[string]bool, len(indexes))
+	for _, index := range indexes {
+		hasIndex[index] = true
+	}
+	for _, index := range expectedIndexes {
+		if (strings.HasPrefix(index, "syncv3_events") || index == "syncv3_nid_room_state_idx") && !hasIndex[index] {
+			t.Errorf("index %s is missing after partitioning", index)
+		}
+	}
+
+	err = sqlutil.WithTransaction(pdb, func(txn *sqlx.Tx) error {
+		// existing events keep their NIDs
+		nids, err := table.SelectNIDsByIDs(txn, []string{"$1", "$2"})
+		if err != nil {
+			return err
+		}
+		for id, nid := range before {
+			if nids[id] != int64(nid) {
+				t.Errorf("event %s: got NID %d want %d", id, nids[id], nid)
+			}
+		}
+		// duplicates are still ignored, and new events continue the NID sequence
+		idToNID, err := table.Insert(txn, []Event{newEvent("$1", roomA), newEvent("$3", roomA)}, true)
+		if err != nil {
+			return err
+		}
+		if len(idToNID) != 1 || int64(idToNID["$3"]) <= nids["$2"] {
+			t.Errorf("Insert after partitioning: got %v", idToNID)
+		}
+		events, err := table.SelectEventsBetween(txn, roomA, EventsStart, EventsEnd, 10)
+		if err != nil {
+			return err
+		}
+		if len(events) != 2 || events[0].NID != nids["$1"] || events[1].NID != int64(idToNID["$3"]) {
+			t.Errorf("SelectEventsBetween: got %v want the NIDs of $1 and $3", events)
+		}
+		return table.UpdateBeforeSnapshotID(txn, roomA, int64(idToNID["$3"]), 1, 0)
+	})
+	if err != nil {
+		t.Fatalf("failed to use partitioned table: %s", err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 )
 
 // InvitesTable stores invites for each user.
@@ -47,6 +48,13 @@ func (t *InvitesTable) RemoveInvite(userID, roomID string) error {
 	return err
 }
 
+// RemoveInvites removes any invites for this user to these rooms. Returns the rooms which had invites.
+func (t *InvitesTable) RemoveInvites(userID string, roomIDs []string) (removed []string, err error) {
+	err = t.db.Select(&removed, `DELETE FROM syncv3_invites WHERE user_id = $1 AND room_id = ANY($2) RETURNING room_id`,
+		userID, pq.StringArray(roomIDs))
+	return
+}
+
 func (t *InvitesTable) InsertInvite(userID, roomID string, inviteRoomState []json.RawMessage) error {
 	blob, err := json.Marshal(inviteRoomState)
 	if err != nil {
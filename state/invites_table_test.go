@@ -134,3 +134,46 @@ func jsonArrStr(a []json.RawMessage) (result string) {
 	}
 	return
 }
+
+func TestInviteTableRemoveInvites(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewInvitesTable(db)
+	alice := "@alice:TestInviteTableRemoveInvites"
+	bob := "@bob:TestInviteTableRemoveInvites"
+	roomA := "!a:TestInviteTableRemoveInvites"
+	roomB := "!b:TestInviteTableRemoveInvites"
+	roomC := "!c:TestInviteTableRemoveInvites"
+	inviteState := []json.RawMessage{[]byte(`{"foo":"bar"}`)}
+	for _, userID := range []string{alice, bob} {
+		for _, roomID := range []string{roomA, roomB} {
+			if err := table.InsertInvite(userID, roomID, inviteState); err != nil {
+				t.Fatalf("failed to InsertInvite: %s", err)
+			}
+		}
+	}
+
+	// roomC has no invite so isn't returned
+	removed, err := table.RemoveInvites(alice, []string{roomA, roomC})
+	if err != nil {
+		t.Fatalf("failed to RemoveInvites: %s", err)
+	}
+	if !reflect.DeepEqual(removed, []string{roomA}) {
+		t.Errorf("RemoveInvites: got %v want [%s]", removed, roomA)
+	}
+	invites, err := table.SelectAllInvitesForUser(alice)
+	if err != nil {
+		t.Fatalf("failed to SelectAllInvitesForUser: %s", err)
+	}
+	if _, ok := invites[roomB]; !ok || len(invites) != 1 {
+		t.Errorf("alice: got invites %v want only %s", invites, roomB)
+	}
+	// other users' invites are untouched
+	invites, err = table.SelectAllInvitesForUser(bob)
+	if err != nil {
+		t.Fatalf("failed to SelectAllInvitesForUser: %s", err)
+	}
+	if len(invites) != 2 {
+		t.Errorf("bob: got %d invites want 2", len(invites))
+	}
+}
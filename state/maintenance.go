@@ -0,0 +1,297 @@
+package state
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The tables which are written to on every poll, so their statistics go stale quickly.
+var hotTables = []string{
+	"syncv3_events", "syncv3_snapshots", "syncv3_rooms", "syncv3_to_device_messages", "syncv3_receipts",
+	"syncv3_unread", "syncv3_thread_unread", "syncv3_account_data", "syncv3_invites", "syncv3_device_data",
+}
+
+// The partitions of syncv3_events are named with this prefix, if it is partitioned. See PartitionEventsTable.
+const eventsPartitionPrefix = "syncv3_events_p"
+
+// The indexes made when the tables are made. If one is missing, e.g because creating it failed part way
+// through a migration, queries silently fall back to sequential scans.
+var expectedIndexes = []string{
+	"syncv3_events_type_sk_idx",
+	"syncv3_events_type_room_nid_idx",
+	"syncv3_nid_room_state_idx",
+	"syncv3_events_room_event_nid_type_skey_idx",
+	"syncv3_events_before_snapshot_idx",
+	"syncv3_to_device_messages_device_idx",
+	"syncv3_to_device_messages_ukey_idx",
+	"syncv3_to_device_messages_pos_device_idx",
+	"syncv3_to_device_messages_inserted_at_idx",
+	"syncv3_receipts_by_event_idx",
+	"syncv3_receipts_by_user_idx",
+	"syncv3_receipts_private_by_event_idx",
+	"syncv3_receipts_private_by_user_idx",
+	"syncv3_spaces_child_idx",
+}
+
+// Tables are analyzed when more than this fraction of their rows changed since they were last analyzed.
+const analyzeModifiedFraction = 0.1
+
+// The number of unreferenced snapshots to delete per query, so the database isn't locked up for long.
+const snapshotGCBatchSize = 1000
+
+type tableStats struct {
+	Table                string `db:"relname"`
+	LiveTuples           int64  `db:"n_live_tup"`
+	DeadTuples           int64  `db:"n_dead_tup"`
+	ModifiedSinceAnalyze int64  `db:"n_mod_since_analyze"`
+	TotalBytes           int64  `db:"total_bytes"`
+}
+
+type indexStats struct {
+	Index string `db:"indexrelname"`
+	Scans int64  `db:"idx_scan"`
+	Bytes int64  `db:"index_bytes"`
+}
+
+// Maintenance keeps the proxy's tables healthy on long-running deployments. It analyzes hot tables
+// whose statistics have gone stale, deletes state snapshots which are no longer used, checks that the
+// expected indexes exist, and reports table and index bloat via Prometheus metrics.
+type Maintenance struct {
+	db        *sqlx.DB
+	snapshots *SnapshotTable
+	// Only snapshots which existed at the previous run are deleted. Snapshot IDs are sent to the sync3
+	// handler when rooms are initialised, so this gives the handler time to load them.
+	snapshotHighWater int64
+
+	deadTuples     *prometheus.GaugeVec
+	liveTuples     *prometheus.GaugeVec
+	tableBytes     *prometheus.GaugeVec
+	indexBytes     *prometheus.GaugeVec
+	indexScans     *prometheus.GaugeVec
+	missingIndexes prometheus.Gauge
+	analyzed       *prometheus.CounterVec
+	snapshotsGCed  prometheus.Counter
+}
+
+func NewMaintenance(db *sqlx.DB) *Maintenance {
+	return &Maintenance{db: db, snapshots: &SnapshotTable{db}}
+}
+
+// RegisterPrometheusMetrics reports the table and index stats gathered by Run.
+func (m *Maintenance) RegisterPrometheusMetrics() {
+	m.deadTuples = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "db",
+		Name:      "dead_tuples",
+		Help:      "Number of dead rows in each table, which take up space until vacuumed.",
+	}, []string{"table"})
+	m.liveTuples = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "db",
+		Name:      "live_tuples",
+		Help:      "Estimated number of rows in each table.",
+	}, []string{"table"})
+	m.tableBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "db",
+		Name:      "table_bytes",
+		Help:      "Size of each table including its indexes and TOAST data.",
+	}, []string{"table"})
+	m.indexBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "db",
+		Name:      "index_bytes",
+		Help:      "Size of each index.",
+	}, []string{"index"})
+	m.indexScans = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "db",
+		Name:      "index_scans",
+		Help:      "Number of scans of each index since the statistics were reset. Indexes with none may be unused.",
+	}, []string{"index"})
+	m.missingIndexes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "db",
+		Name:      "missing_indexes",
+		Help:      "Number of expected indexes which do not exist.",
+	})
+	m.analyzed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "db",
+		Name:      "analyze",
+		Help:      "Number of times each table was analyzed because its statistics were stale.",
+	}, []string{"table"})
+	m.snapshotsGCed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "db",
+		Name:      "snapshots_deleted",
+		Help:      "Number of state snapshots deleted because nothing referred to them.",
+	})
+	prometheus.MustRegister(m.deadTuples, m.liveTuples, m.tableBytes, m.indexBytes, m.indexScans, m.missingIndexes, m.analyzed, m.snapshotsGCed)
+}
+
+// Teardown unregisters the Prometheus metrics, if they were registered.
+func (m *Maintenance) Teardown() {
+	if m.analyzed == nil {
+		return
+	}
+	prometheus.Unregister(m.deadTuples)
+	prometheus.Unregister(m.liveTuples)
+	prometheus.Unregister(m.tableBytes)
+	prometheus.Unregister(m.indexBytes)
+	prometheus.Unregister(m.indexScans)
+	prometheus.Unregister(m.missingIndexes)
+	prometheus.Unregister(m.analyzed)
+	prometheus.Unregister(m.snapshotsGCed)
+}
+
+// Run does maintenance straight away, then every interval. Blocks forever, so run this in a goroutine.
+func (m *Maintenance) Run(interval time.Duration) {
+	if missing, err := m.MissingIndexes(); err != nil {
+		logger.Err(err).Msg("Maintenance: failed to check indexes")
+		sentry.CaptureException(err)
+	} else if len(missing) > 0 {
+		// only checked at startup, as indexes are only made at startup
+		logger.Error().Strs("indexes", missing).Msg("Maintenance: expected indexes are missing, queries may be slow. Restart to recreate them.")
+		if m.missingIndexes != nil {
+			m.missingIndexes.Set(float64(len(missing)))
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := m.RunOnce(); err != nil {
+			logger.Err(err).Msg("Maintenance: failed")
+			sentry.CaptureException(err)
+		}
+		<-ticker.C
+	}
+}
+
+// RunOnce deletes unreferenced snapshots, analyzes the hot tables with stale statistics and updates the
+// bloat metrics.
+func (m *Maintenance) RunOnce() error {
+	if _, err := m.CollectSnapshots(); err != nil {
+		return fmt.Errorf("failed to delete unreferenced snapshots: %w", err)
+	}
+	stats, err := m.tableStats()
+	if err != nil {
+		return fmt.Errorf("failed to select table stats: %w", err)
+	}
+	for _, st := range m.staleTables(stats) {
+		start := time.Now()
+		// table names come from hotTables, not user input
+		if _, err = m.db.Exec(`ANALYZE ` + pq.QuoteIdentifier(st)); err != nil {
+			return fmt.Errorf("failed to analyze %s: %w", st, err)
+		}
+		logger.Debug().Str("table", st).Dur("took", time.Since(start)).Msg("Maintenance: analyzed table")
+		if m.analyzed != nil {
+			m.analyzed.WithLabelValues(st).Inc()
+		}
+	}
+	if m.analyzed == nil {
+		return nil
+	}
+	for _, st := range stats {
+		m.deadTuples.WithLabelValues(st.Table).Set(float64(st.DeadTuples))
+		m.liveTuples.WithLabelValues(st.Table).Set(float64(st.LiveTuples))
+		m.tableBytes.WithLabelValues(st.Table).Set(float64(st.TotalBytes))
+	}
+	var indexes []indexStats
+	err = m.db.Select(&indexes, `SELECT indexrelname, idx_scan, pg_relation_size(indexrelid) AS index_bytes
+	FROM pg_stat_user_indexes WHERE relname LIKE 'syncv3_%'`)
+	if err != nil {
+		return fmt.Errorf("failed to select index stats: %w", err)
+	}
+	for _, ix := range indexes {
+		m.indexBytes.WithLabelValues(ix.Index).Set(float64(ix.Bytes))
+		m.indexScans.WithLabelValues(ix.Index).Set(float64(ix.Scans))
+	}
+	return nil
+}
+
+// CollectSnapshots deletes the snapshots which nothing refers to, out of those which existed when this
+// was last called. Returns the number of snapshots deleted.
+func (m *Maintenance) CollectSnapshots() (total int64, err error) {
+	start := time.Now()
+	highWater := m.snapshotHighWater
+	// remember the latest snapshot before deleting, so snapshots made whilst deleting get a full interval
+	if m.snapshotHighWater, err = m.snapshots.MaxID(); err != nil {
+		return 0, err
+	}
+	if highWater == 0 {
+		return 0, nil
+	}
+	for {
+		deleted, err := m.snapshots.DeleteUnreferenced(highWater, snapshotGCBatchSize)
+		if err != nil {
+			return total, err
+		}
+		total += deleted
+		if deleted < snapshotGCBatchSize {
+			break
+		}
+	}
+	if total > 0 {
+		logger.Info().Int64("deleted", total).Dur("took", time.Since(start)).Msg("Maintenance: deleted unreferenced snapshots")
+		if m.snapshotsGCed != nil {
+			m.snapshotsGCed.Add(float64(total))
+		}
+	}
+	return total, nil
+}
+
+// MissingIndexes returns the names of the expected indexes which do not exist, in sorted order.
+func (m *Maintenance) MissingIndexes() ([]string, error) {
+	var existing []string
+	err := m.db.Select(&existing, `SELECT indexname FROM pg_indexes WHERE indexname = ANY($1)`, pq.StringArray(expectedIndexes))
+	if err != nil {
+		return nil, err
+	}
+	exists := make(map[string]bool, len(existing))
+	for _, name := range existing {
+		exists[name] = true
+	}
+	var missing []string
+	for _, name := range expectedIndexes {
+		if !exists[name] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+func (m *Maintenance) tableStats() (stats []tableStats, err error) {
+	err = m.db.Select(&stats, `SELECT relname, n_live_tup, n_dead_tup, n_mod_since_analyze,
+	pg_total_relation_size(relid) AS total_bytes FROM pg_stat_user_tables WHERE relname LIKE 'syncv3_%'`)
+	return
+}
+
+// staleTables returns the hot tables where enough rows changed since they were last analyzed that the
+// query planner may be working from the wrong row counts.
+func (m *Maintenance) staleTables(stats []tableStats) []string {
+	isHot := make(map[string]bool, len(hotTables))
+	for _, t := range hotTables {
+		isHot[t] = true
+	}
+	var stale []string
+	for _, st := range stats {
+		// a partitioned table has no rows of its own, so its partitions are checked instead
+		hot := isHot[st.Table] || strings.HasPrefix(st.Table, eventsPartitionPrefix)
+		if !hot || st.ModifiedSinceAnalyze == 0 {
+			continue
+		}
+		if float64(st.ModifiedSinceAnalyze) > analyzeModifiedFraction*float64(st.LiveTuples) {
+			stale = append(stale, st.Table)
+		}
+	}
+	return stale
+}
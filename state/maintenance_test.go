@@ -0,0 +1,63 @@
+package state
+
+import (
+	"testing"
+)
+
+func TestMaintenanceMissingIndexes(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	// make the tables and their indexes
+	NewEventTable(db)
+	NewToDeviceTable(db)
+	NewReceiptTable(db)
+	m := NewMaintenance(db)
+	missing, err := m.MissingIndexes()
+	if err != nil {
+		t.Fatalf("MissingIndexes: %s", err)
+	}
+	if len(missing) != 0 {
+		t.Fatalf("MissingIndexes: got %v want none", missing)
+	}
+
+	db.MustExec(`DROP INDEX syncv3_to_device_messages_inserted_at_idx`)
+	defer NewToDeviceTable(db) // recreate it for other tests
+	missing, err = m.MissingIndexes()
+	if err != nil {
+		t.Fatalf("MissingIndexes: %s", err)
+	}
+	if len(missing) != 1 || missing[0] != "syncv3_to_device_messages_inserted_at_idx" {
+		t.Fatalf("MissingIndexes: got %v want [syncv3_to_device_messages_inserted_at_idx]", missing)
+	}
+}
+
+func TestMaintenanceRunOnce(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	NewEventTable(db)
+	NewSnapshotsTable(db)
+	NewRoomsTable(db)
+	m := NewMaintenance(db)
+	if err := m.RunOnce(); err != nil {
+		t.Fatalf("RunOnce: %s", err)
+	}
+	// the second run collects the snapshots which existed at the first
+	if err := m.RunOnce(); err != nil {
+		t.Fatalf("RunOnce: %s", err)
+	}
+}
+
+func TestMaintenanceStaleTables(t *testing.T) {
+	m := NewMaintenance(nil)
+	stats := []tableStats{
+		{Table: "syncv3_events", LiveTuples: 1000, ModifiedSinceAnalyze: 500},
+		{Table: "syncv3_rooms", LiveTuples: 1000, ModifiedSinceAnalyze: 10},
+		{Table: "syncv3_unread", LiveTuples: 0, ModifiedSinceAnalyze: 0},
+		{Table: "syncv3_txns", LiveTuples: 1000, ModifiedSinceAnalyze: 1000}, // not hot
+		{Table: "syncv3_events_p3", LiveTuples: 1000, ModifiedSinceAnalyze: 200},
+	}
+	stale := m.staleTables(stats)
+	if len(stale) != 2 || stale[0] != "syncv3_events" || stale[1] != "syncv3_events_p3" {
+		t.Errorf("staleTables: got %v want [syncv3_events syncv3_events_p3]", stale)
+	}
+}
@@ -0,0 +1,71 @@
+package state
+
+import (
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// QueuedNotification is a pubsub payload which has been written to the notification queue but not yet
+// delivered.
+type QueuedNotification struct {
+	ID          int64  `db:"id"`
+	Chan        string `db:"chan"`
+	PayloadType string `db:"payload_type"`
+	Payload     []byte `db:"payload"`
+}
+
+// NotificationQueueTable stores pubsub payloads until they have been delivered, so delivery can resume
+// after a crash without re-polling the homeserver.
+type NotificationQueueTable struct {
+	db *sqlx.DB
+}
+
+func NewNotificationQueueTable(db *sqlx.DB) *NotificationQueueTable {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE SEQUENCE IF NOT EXISTS syncv3_notification_queue_seq;
+	CREATE TABLE IF NOT EXISTS syncv3_notification_queue (
+		id BIGINT PRIMARY KEY NOT NULL DEFAULT nextval('syncv3_notification_queue_seq'),
+		chan TEXT NOT NULL,
+		payload_type TEXT NOT NULL,
+		payload BYTEA NOT NULL,
+		queued_at BIGINT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS syncv3_notification_queue_chan_idx ON syncv3_notification_queue(chan, id);
+	`)
+	return &NotificationQueueTable{db}
+}
+
+// Insert adds a payload to the end of the queue for this channel.
+func (t *NotificationQueueTable) Insert(chanName, payloadType string, payload []byte) (id int64, err error) {
+	err = t.db.QueryRow(
+		`INSERT INTO syncv3_notification_queue (chan, payload_type, payload, queued_at) VALUES ($1, $2, $3, $4) RETURNING id`,
+		chanName, payloadType, payload, time.Now().UnixMilli(),
+	).Scan(&id)
+	return
+}
+
+// Select returns up to `limit` payloads at the front of the queue for this channel, oldest first.
+func (t *NotificationQueueTable) Select(chanName string, limit int) ([]QueuedNotification, error) {
+	var notifications []QueuedNotification
+	err := t.db.Select(&notifications,
+		`SELECT id, chan, payload_type, payload FROM syncv3_notification_queue WHERE chan=$1 ORDER BY id ASC LIMIT $2`,
+		chanName, limit,
+	)
+	return notifications, err
+}
+
+// Delete removes these payloads from this channel, once they have been delivered. Payloads are deleted by ID
+// rather than by range, as IDs are assigned before commit so a lower ID can become visible after a higher one.
+func (t *NotificationQueueTable) Delete(chanName string, ids []int64) error {
+	_, err := t.db.Exec(`DELETE FROM syncv3_notification_queue WHERE chan=$1 AND id = ANY($2)`, chanName, pq.Int64Array(ids))
+	return err
+}
+
+// Count returns the number of undelivered payloads for this channel.
+func (t *NotificationQueueTable) Count(chanName string) (count int, err error) {
+	err = t.db.QueryRow(`SELECT count(*) FROM syncv3_notification_queue WHERE chan=$1`, chanName).Scan(&count)
+	return
+}
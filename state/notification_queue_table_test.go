@@ -0,0 +1,95 @@
+package state
+
+import (
+	"testing"
+)
+
+func TestNotificationQueueTable(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewNotificationQueueTable(db)
+	chanA := "TestNotificationQueueTable_a"
+	chanB := "TestNotificationQueueTable_b"
+
+	firstID, err := table.Insert(chanA, "A", []byte(`{"n":1}`))
+	assertNoError(t, err)
+	_, err = table.Insert(chanB, "B", []byte(`{"n":2}`))
+	assertNoError(t, err)
+	lastID, err := table.Insert(chanA, "A", []byte(`{"n":3}`))
+	assertNoError(t, err)
+	if lastID <= firstID {
+		t.Fatalf("IDs are not increasing: %d then %d", firstID, lastID)
+	}
+
+	// payloads are returned in order, per channel
+	got, err := table.Select(chanA, 10)
+	assertNoError(t, err)
+	if len(got) != 2 || string(got[0].Payload) != `{"n":1}` || string(got[1].Payload) != `{"n":3}` {
+		t.Fatalf("Select returned wrong payloads: %+v", got)
+	}
+	if got[0].ID != firstID || got[0].PayloadType != "A" || got[0].Chan != chanA {
+		t.Fatalf("Select returned wrong row: %+v", got[0])
+	}
+	got, err = table.Select(chanA, 1)
+	assertNoError(t, err)
+	if len(got) != 1 || got[0].ID != firstID {
+		t.Fatalf("Select with limit returned wrong payloads: %+v", got)
+	}
+
+	// deleting only removes delivered payloads on this channel
+	assertNoError(t, table.Delete(chanA, []int64{firstID}))
+	count, err := table.Count(chanA)
+	assertNoError(t, err)
+	if count != 1 {
+		t.Fatalf("Count: got %d want 1", count)
+	}
+	count, err = table.Count(chanB)
+	assertNoError(t, err)
+	if count != 1 {
+		t.Fatalf("Count: got %d want 1", count)
+	}
+	assertNoError(t, table.Delete(chanA, []int64{lastID}))
+	got, err = table.Select(chanA, 10)
+	assertNoError(t, err)
+	if len(got) != 0 {
+		t.Fatalf("Select returned delivered payloads: %+v", got)
+	}
+}
+
+// Tests that a payload which commits after a payload with a higher ID isn't deleted when the higher ID is.
+func TestNotificationQueueTableOutOfOrderCommits(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewNotificationQueueTable(db)
+	chanName := "TestNotificationQueueTableOutOfOrderCommits"
+
+	// the first payload is given the lower ID but hasn't committed yet
+	txn, err := db.Beginx()
+	assertNoError(t, err)
+	defer txn.Rollback()
+	var lowID int64
+	err = txn.QueryRow(
+		`INSERT INTO syncv3_notification_queue (chan, payload_type, payload, queued_at) VALUES ($1, 'A', '{}', 0) RETURNING id`,
+		chanName,
+	).Scan(&lowID)
+	assertNoError(t, err)
+	highID, err := table.Insert(chanName, "B", []byte(`{}`))
+	assertNoError(t, err)
+	if highID <= lowID {
+		t.Fatalf("IDs are not increasing: %d then %d", lowID, highID)
+	}
+	got, err := table.Select(chanName, 10)
+	assertNoError(t, err)
+	if len(got) != 1 || got[0].ID != highID {
+		t.Fatalf("Select returned wrong payloads: %+v", got)
+	}
+
+	// the lower ID commits whilst the higher one is being delivered
+	assertNoError(t, txn.Commit())
+	assertNoError(t, table.Delete(chanName, []int64{got[0].ID}))
+	got, err = table.Select(chanName, 10)
+	assertNoError(t, err)
+	if len(got) != 1 || got[0].ID != lowID {
+		t.Fatalf("Select: got %+v want the payload which committed late", got)
+	}
+}
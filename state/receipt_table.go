@@ -77,7 +77,7 @@ func (t *ReceiptTable) Insert(roomID string, ephEvent json.RawMessage) (receipts
 		return nil
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to insert receipts: %s", err)
+		return nil, fmt.Errorf("failed to insert receipts: %w", err)
 	}
 	// no new receipts
 	if len(readReceipts) == 0 && len(privateReceipts) == 0 {
@@ -96,6 +96,59 @@ func (t *ReceiptTable) SelectReceiptsForEvents(roomID string, eventIDs []string)
 	return
 }
 
+// SelectReceiptsForEventsInRooms is SelectReceiptsForEvents for many rooms in one query. Returns the
+// receipts keyed on room ID. Rooms without receipts are omitted.
+func (t *ReceiptTable) SelectReceiptsForEventsInRooms(roomIDToEventIDs map[string][]string) (map[string][]internal.Receipt, error) {
+	roomIDs := make([]string, 0, len(roomIDToEventIDs))
+	var eventIDs []string
+	for roomID, ids := range roomIDToEventIDs {
+		roomIDs = append(roomIDs, roomID)
+		eventIDs = append(eventIDs, ids...)
+	}
+	if len(eventIDs) == 0 {
+		return nil, nil
+	}
+	var receipts []internal.Receipt
+	err := t.db.Select(&receipts, `SELECT room_id, event_id, user_id, ts, thread_id FROM syncv3_receipts
+		WHERE room_id = ANY($1) AND event_id = ANY($2)`, pq.StringArray(roomIDs), pq.StringArray(eventIDs))
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string][]internal.Receipt)
+	for _, r := range receipts {
+		result[r.RoomID] = append(result[r.RoomID], r)
+	}
+	return result, nil
+}
+
+// SelectReceiptsForUserInRooms is SelectReceiptsForUser for many rooms in one query per receipt type.
+// Returns the receipts keyed on room ID. Rooms without receipts are omitted.
+func (t *ReceiptTable) SelectReceiptsForUserInRooms(roomIDs []string, userID string) (map[string][]internal.Receipt, error) {
+	if len(roomIDs) == 0 {
+		return nil, nil
+	}
+	var receipts []internal.Receipt
+	err := t.db.Select(&receipts, `SELECT room_id, event_id, user_id, ts, thread_id FROM syncv3_receipts
+	WHERE room_id = ANY($1) AND user_id = $2`, pq.StringArray(roomIDs), userID)
+	if err != nil {
+		return nil, err
+	}
+	var privReceipts []internal.Receipt
+	err = t.db.Select(&privReceipts, `SELECT room_id, event_id, user_id, ts, thread_id FROM syncv3_receipts_private
+	WHERE room_id = ANY($1) AND user_id = $2`, pq.StringArray(roomIDs), userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range privReceipts {
+		privReceipts[i].IsPrivate = true
+	}
+	result := make(map[string][]internal.Receipt)
+	for _, r := range append(receipts, privReceipts...) {
+		result[r.RoomID] = append(result[r.RoomID], r)
+	}
+	return result, nil
+}
+
 // Select all (including private) receipts for this user in this room.
 func (t *ReceiptTable) SelectReceiptsForUser(roomID, userID string) (receipts []internal.Receipt, err error) {
 	err = t.db.Select(&receipts, `SELECT room_id, event_id, user_id, ts, thread_id FROM syncv3_receipts
@@ -117,6 +170,8 @@ func (t *ReceiptTable) bulkInsert(tableName string, txn *sqlx.Tx, receipts []int
 	if len(receipts) == 0 {
 		return
 	}
+	// Only the latest receipt per user per thread is kept. Pollers for different users can deliver the
+	// same receipts at different times, so a receipt older than the stored one must not replace it.
 	chunks := sqlutil.Chunkify(5, MaxPostgresParameters, ReceiptChunker(receipts))
 	var eventID string
 	var roomID string
@@ -126,7 +181,7 @@ func (t *ReceiptTable) bulkInsert(tableName string, txn *sqlx.Tx, receipts []int
 	for _, chunk := range chunks {
 		rows, err := txn.NamedQuery(`
 			INSERT INTO `+tableName+` AS old (room_id, event_id, user_id, ts, thread_id)
-			VALUES (:room_id, :event_id, :user_id, :ts, :thread_id) ON CONFLICT (room_id, user_id, thread_id) DO UPDATE SET event_id=excluded.event_id, ts=excluded.ts WHERE old.event_id <> excluded.event_id
+			VALUES (:room_id, :event_id, :user_id, :ts, :thread_id) ON CONFLICT (room_id, user_id, thread_id) DO UPDATE SET event_id=excluded.event_id, ts=excluded.ts WHERE old.event_id <> excluded.event_id AND old.ts <= excluded.ts
 			RETURNING room_id, user_id, thread_id, event_id, ts`, chunk)
 		if err != nil {
 			return nil, err
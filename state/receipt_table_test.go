@@ -212,3 +212,82 @@ func TestReceiptTable(t *testing.T) {
 		},
 	})
 }
+
+func TestReceiptTableKeepsLatest(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	roomID := "!TestReceiptTableKeepsLatest:localhost"
+	table := NewReceiptTable(db)
+	_, err := table.Insert(roomID, json.RawMessage(`{
+		"content": {"$new:localhost": {"m.read": {"@alice:localhost": {"ts": 2000}}}},
+		"type": "m.receipt"
+	}`))
+	assertNoError(t, err)
+
+	// an older receipt delivered late by another poller is not a delta and doesn't replace the newer one
+	newReceipts, err := table.Insert(roomID, json.RawMessage(`{
+		"content": {"$old:localhost": {"m.read": {"@alice:localhost": {"ts": 1000}}}},
+		"type": "m.receipt"
+	}`))
+	assertNoError(t, err)
+	parsedReceiptsEqual(t, newReceipts, nil)
+	got, err := table.SelectReceiptsForUser(roomID, "@alice:localhost")
+	assertNoError(t, err)
+	parsedReceiptsEqual(t, got, []internal.Receipt{
+		{RoomID: roomID, EventID: "$new:localhost", UserID: "@alice:localhost", TS: 2000},
+	})
+}
+
+func TestReceiptTableSelectInRooms(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	roomA := "!A:TestReceiptTableSelectInRooms"
+	roomB := "!B:TestReceiptTableSelectInRooms"
+	roomC := "!C:TestReceiptTableSelectInRooms"
+	table := NewReceiptTable(db)
+	_, err := table.Insert(roomA, json.RawMessage(`{
+		"content": {"$a:localhost": {
+			"m.read": {"@alice:localhost": {"ts": 1}, "@bob:localhost": {"ts": 2}}
+		}},
+		"type": "m.receipt"
+	}`))
+	assertNoError(t, err)
+	_, err = table.Insert(roomB, json.RawMessage(`{
+		"content": {"$b:localhost": {
+			"m.read": {"@bob:localhost": {"ts": 3}},
+			"m.read.private": {"@alice:localhost": {"ts": 4}}
+		}},
+		"type": "m.receipt"
+	}`))
+	assertNoError(t, err)
+
+	got, err := table.SelectReceiptsForEventsInRooms(map[string][]string{
+		roomA: {"$a:localhost"},
+		roomB: {"$b:localhost"},
+		roomC: {"$c:localhost"},
+	})
+	assertNoError(t, err)
+	if len(got) != 2 {
+		t.Fatalf("SelectReceiptsForEventsInRooms: got %d rooms want 2: %+v", len(got), got)
+	}
+	parsedReceiptsEqual(t, got[roomA], []internal.Receipt{
+		{RoomID: roomA, EventID: "$a:localhost", UserID: "@alice:localhost", TS: 1},
+		{RoomID: roomA, EventID: "$a:localhost", UserID: "@bob:localhost", TS: 2},
+	})
+	// private receipts are excluded
+	parsedReceiptsEqual(t, got[roomB], []internal.Receipt{
+		{RoomID: roomB, EventID: "$b:localhost", UserID: "@bob:localhost", TS: 3},
+	})
+
+	own, err := table.SelectReceiptsForUserInRooms([]string{roomA, roomB, roomC}, "@alice:localhost")
+	assertNoError(t, err)
+	if len(own) != 2 {
+		t.Fatalf("SelectReceiptsForUserInRooms: got %d rooms want 2: %+v", len(own), own)
+	}
+	parsedReceiptsEqual(t, own[roomA], []internal.Receipt{
+		{RoomID: roomA, EventID: "$a:localhost", UserID: "@alice:localhost", TS: 1},
+	})
+	parsedReceiptsEqual(t, own[roomB], []internal.Receipt{
+		{RoomID: roomB, EventID: "$b:localhost", UserID: "@alice:localhost", TS: 4, IsPrivate: true},
+	})
+}
@@ -0,0 +1,151 @@
+package state
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+)
+
+// How often to ask the replica how far it has replayed the primary's write-ahead log, at most. Writes the
+// replica is known to have replayed are answered from memory.
+const replicaCheckInterval = 100 * time.Millisecond
+
+// How long to send all reads to the primary after the replica fails a query.
+const replicaRetryAfter = 30 * time.Second
+
+// How long to wait for the replica to say how far it has replayed before using the primary instead.
+const replicaCheckTimeout = time.Second
+
+// The position in the write-ahead log as a byte offset, so positions can be compared in Go. On a database
+// which isn't replicating from anything, pg_last_wal_replay_lsn is NULL, and the database is up to date
+// with itself.
+const (
+	primaryLSNQuery = `SELECT (pg_current_wal_lsn() - '0/0'::pg_lsn)::bigint`
+	replicaLSNQuery = `SELECT (COALESCE(pg_last_wal_replay_lsn(), pg_current_wal_lsn()) - '0/0'::pg_lsn)::bigint`
+)
+
+// replica is a read-only copy of the database which lags behind the primary by some amount. After every
+// write to the events table, the primary's write-ahead log position (LSN) is recorded. Reads are only sent
+// to the replica when it has replayed the log up to the latest recorded position, so reads from it see
+// every write which completed before the read began, including events which were redacted in place and
+// events with lower NIDs which were committed after higher ones.
+type replica struct {
+	db *sqlx.DB
+
+	mu          sync.Mutex
+	writtenLSN  int64     // the primary's LSN after the latest write
+	replayedLSN int64     // the highest LSN known to be replayed on the replica
+	checkedAt   time.Time // when the replica was last asked for replayedLSN
+	failedAt    time.Time // when the replica last failed a query
+}
+
+// wrote records the primary's LSN after a write. Reads go to the primary until the replica has replayed it.
+func (r *replica) wrote(lsn int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if lsn > r.writtenLSN {
+		r.writtenLSN = lsn
+	}
+}
+
+// caughtUp returns true if the replica has replayed every write recorded so far, and has not recently
+// failed. The replica is not queried with the mutex held, so a slow replica only delays the caller which
+// asks it; other callers use the primary until it answers.
+func (r *replica) caughtUp() bool {
+	r.mu.Lock()
+	now := time.Now()
+	if now.Sub(r.failedAt) < replicaRetryAfter {
+		r.mu.Unlock()
+		return false
+	}
+	writtenLSN := r.writtenLSN
+	if writtenLSN <= r.replayedLSN {
+		r.mu.Unlock()
+		return true
+	}
+	if now.Sub(r.checkedAt) < replicaCheckInterval {
+		r.mu.Unlock()
+		return false
+	}
+	r.checkedAt = now
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), replicaCheckTimeout)
+	defer cancel()
+	var replayedLSN int64
+	err := r.db.QueryRowContext(ctx, replicaLSNQuery).Scan(&replayedLSN)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		logger.Warn().Err(err).Msg("replica: failed to select replayed LSN, reading from the primary")
+		r.failedAt = time.Now()
+		return false
+	}
+	// the replica only moves forwards, so keep the highest LSN in case a slower check returned after a faster one
+	if replayedLSN > r.replayedLSN {
+		r.replayedLSN = replayedLSN
+	}
+	return writtenLSN <= r.replayedLSN
+}
+
+func (r *replica) markFailed() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failedAt = time.Now()
+}
+
+// SetReadReplica sends reads at an event position to the read-only database at postgresURI, when it has
+// replayed every write to the primary made so far. Otherwise, or if the replica is failing, reads go to the
+// primary. Writes always go to the primary.
+func (s *Storage) SetReadReplica(postgresURI string) error {
+	db, err := sqlx.Open("postgres", postgresURI)
+	if err != nil {
+		return err
+	}
+	s.replica = &replica{db: db}
+	return nil
+}
+
+// noteWrite records the primary's LSN after writing events, so reads go to the primary until the replica
+// has the write. It must be called before the caller is told about the write. If the LSN cannot be
+// selected, reads go to the primary for a while as the replica can't be known to be up to date.
+func (s *Storage) noteWrite() {
+	if s.replica == nil {
+		return
+	}
+	var lsn int64
+	if err := s.accumulator.db.QueryRow(primaryLSNQuery).Scan(&lsn); err != nil {
+		logger.Warn().Err(err).Msg("replica: failed to select primary LSN, reading from the primary for a while")
+		s.replica.markFailed()
+		return
+	}
+	s.replica.wrote(lsn)
+}
+
+// withReadTransaction runs fn in a transaction on the replica if it has replayed every write so far, else
+// on the primary. fn must only read. If the replica cannot be reached the primary is used instead. pos is
+// the event position being read at, for logging.
+func (s *Storage) withReadTransaction(pos int64, fn func(txn *sqlx.Tx) error) error {
+	if s.replica == nil || !s.replica.caughtUp() {
+		return sqlutil.WithTransaction(s.accumulator.db, fn)
+	}
+	ran := false
+	err := sqlutil.WithTransaction(s.replica.db, func(txn *sqlx.Tx) error {
+		ran = true
+		return fn(txn)
+	})
+	if err == nil {
+		return nil
+	}
+	logger.Warn().Err(err).Int64("pos", pos).Msg("replica: read failed, reading from the primary for a while")
+	s.replica.markFailed()
+	if ran {
+		// fn may have partially filled in its results, so it is not safe to run it again
+		return err
+	}
+	return sqlutil.WithTransaction(s.accumulator.db, fn)
+}
@@ -0,0 +1,111 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+func TestStorageReadReplica(t *testing.T) {
+	ctx := context.Background()
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	// the test database is its own replica, as it is always caught up
+	if err := store.SetReadReplica(postgresConnectionString); err != nil {
+		t.Fatalf("SetReadReplica: %s", err)
+	}
+	roomID := "!TestStorageReadReplica:localhost"
+	alice := "@alice:localhost"
+	stateEvents := []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+	}
+	if _, err := store.Initialise(roomID, stateEvents); err != nil {
+		t.Fatalf("Initialise: %s", err)
+	}
+	pos, err := store.LatestEventNID()
+	if err != nil {
+		t.Fatalf("LatestEventNID: %s", err)
+	}
+	if store.replica.writtenLSN == 0 {
+		t.Fatalf("Initialise did not record the primary's LSN")
+	}
+	if !store.replica.caughtUp() {
+		t.Fatalf("caughtUp returned false for an up to date replica")
+	}
+	got, err := store.RoomStateAt(ctx, roomID, pos, map[string][]string{"m.room.create": nil})
+	if err != nil {
+		t.Fatalf("RoomStateAt: %s", err)
+	}
+	if len(got) != 1 || !bytes.Equal(got[0].JSON, stateEvents[0]) {
+		t.Errorf("RoomStateAt: got %+v want the create event", got)
+	}
+
+	// writes the replica hasn't replayed are read from the primary, and the replica is asked again at
+	// most once per interval
+	replayedLSN := store.replica.replayedLSN
+	store.replica.wrote(math.MaxInt64)
+	store.replica.checkedAt = time.Now()
+	if store.replica.caughtUp() {
+		t.Errorf("caughtUp returned true for a write beyond the replayed LSN")
+	}
+	store.replica.checkedAt = time.Time{}
+	if store.replica.caughtUp() {
+		t.Errorf("caughtUp returned true for a write beyond the replayed LSN")
+	}
+	if store.replica.replayedLSN < replayedLSN {
+		t.Errorf("replica replayedLSN went backwards: got %d want at least %d", store.replica.replayedLSN, replayedLSN)
+	}
+}
+
+func TestStorageReadReplicaFallback(t *testing.T) {
+	ctx := context.Background()
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	if err := store.SetReadReplica("host=/nonexistent dbname=syncv3_test sslmode=disable connect_timeout=1"); err != nil {
+		t.Fatalf("SetReadReplica: %s", err)
+	}
+	roomID := "!TestStorageReadReplicaFallback:localhost"
+	alice := "@alice:localhost"
+	stateEvents := []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+	}
+	if _, err := store.Initialise(roomID, stateEvents); err != nil {
+		t.Fatalf("Initialise: %s", err)
+	}
+	pos, err := store.LatestEventNID()
+	if err != nil {
+		t.Fatalf("LatestEventNID: %s", err)
+	}
+	// the replica can't be asked how far it has got, so the primary is used
+	got, err := store.RoomStateAt(ctx, roomID, pos, map[string][]string{"m.room.create": nil})
+	if err != nil {
+		t.Fatalf("RoomStateAt: %s", err)
+	}
+	if len(got) != 1 || !bytes.Equal(got[0].JSON, stateEvents[0]) {
+		t.Errorf("RoomStateAt: got %+v want the create event", got)
+	}
+	if store.replica.failedAt.IsZero() {
+		t.Errorf("replica was not marked as failed")
+	}
+
+	// the replica was thought to be caught up, but then can't be connected to, so the primary is used
+	store.replica.failedAt = time.Time{}
+	store.replica.replayedLSN = store.replica.writtenLSN
+	got, err = store.RoomStateAt(ctx, roomID, pos, map[string][]string{"m.room.create": nil})
+	if err != nil {
+		t.Fatalf("RoomStateAt: %s", err)
+	}
+	if len(got) != 1 || !bytes.Equal(got[0].JSON, stateEvents[0]) {
+		t.Errorf("RoomStateAt: got %+v want the create event", got)
+	}
+	if store.replica.caughtUp() {
+		t.Errorf("caughtUp returned true for a replica which just failed")
+	}
+}
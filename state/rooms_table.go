@@ -35,8 +35,10 @@ func NewRoomsTable(db *sqlx.DB) *RoomsTable {
 	return &RoomsTable{}
 }
 
-func (t *RoomsTable) SelectRoomInfos(txn *sqlx.Tx) (infos []RoomInfo, err error) {
-	err = txn.Select(&infos, `SELECT room_id, is_encrypted, upgraded_room_id, predecessor_room_id, type FROM syncv3_rooms`)
+// SelectRoomInfos returns the room info for the given rooms, or for all rooms if none are given.
+func (t *RoomsTable) SelectRoomInfos(txn *sqlx.Tx, roomIDs ...string) (infos []RoomInfo, err error) {
+	err = txn.Select(&infos, `SELECT room_id, is_encrypted, upgraded_room_id, predecessor_room_id, type FROM syncv3_rooms
+	WHERE $1::text[] IS NULL OR room_id = ANY($1)`, pq.StringArray(roomIDs))
 	return
 }
 
@@ -108,6 +110,24 @@ func (t *RoomsTable) LatestNIDs(txn *sqlx.Tx, roomIDs []string) (nids map[string
 	return
 }
 
+// Return the snapshot for each of these rooms AFTER their latest event has been applied. Unknown rooms
+// are missing from the map.
+func (t *RoomsTable) CurrentAfterSnapshotIDs(txn *sqlx.Tx, roomIDs []string) (map[string]int64, error) {
+	var rows []struct {
+		RoomID     string `db:"room_id"`
+		SnapshotID int64  `db:"current_snapshot_id"`
+	}
+	err := txn.Select(&rows, `SELECT room_id, current_snapshot_id FROM syncv3_rooms WHERE room_id = ANY($1)`, pq.StringArray(roomIDs))
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		result[row.RoomID] = row.SnapshotID
+	}
+	return result, nil
+}
+
 // Return the snapshot for this room AFTER the latest event has been applied.
 func (t *RoomsTable) CurrentAfterSnapshotID(txn *sqlx.Tx, roomID string) (snapshotID int64, err error) {
 	err = txn.QueryRow(`SELECT current_snapshot_id FROM syncv3_rooms WHERE room_id=$1`, roomID).Scan(&snapshotID)
@@ -56,6 +56,15 @@ func TestRoomsTable(t *testing.T) {
 		t.Fatalf("current snapshot id mismatch, got %d want %d", id, 101)
 	}
 
+	// Select many, ignoring unknown rooms
+	ids, err := table.CurrentAfterSnapshotIDs(txn, []string{roomID, "!unknown:localhost"})
+	if err != nil {
+		t.Fatalf("Failed to select current snapshot IDs: %s", err)
+	}
+	if len(ids) != 1 || ids[roomID] != 101 {
+		t.Fatalf("current snapshot ids mismatch, got %v want %v", ids, map[string]int64{roomID: 101})
+	}
+
 	// add encrypted room
 	encryptedRoomID := "!encrypted:localhost"
 	if err = table.Upsert(txn, RoomInfo{
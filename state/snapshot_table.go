@@ -66,6 +66,20 @@ func (s *SnapshotTable) Select(txn *sqlx.Tx, snapshotID int64) (row SnapshotRow,
 	return
 }
 
+// SelectMany selects the rows for these snapshot IDs in a single query. Returns a map of snapshot ID to row.
+func (s *SnapshotTable) SelectMany(txn *sqlx.Tx, snapshotIDs []int64) (map[int64]SnapshotRow, error) {
+	var rows []SnapshotRow
+	err := txn.Select(&rows, `SELECT * FROM syncv3_snapshots WHERE snapshot_id = ANY($1)`, pq.Int64Array(snapshotIDs))
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[int64]SnapshotRow, len(rows))
+	for _, row := range rows {
+		result[row.SnapshotID] = row
+	}
+	return result, nil
+}
+
 // Insert the row. Modifies SnapshotID to be the inserted primary key.
 func (s *SnapshotTable) Insert(txn *sqlx.Tx, row *SnapshotRow) error {
 	var id int64
@@ -83,6 +97,29 @@ func (s *SnapshotTable) Insert(txn *sqlx.Tx, row *SnapshotRow) error {
 	return err
 }
 
+// MaxID returns the highest snapshot ID, or 0 if there are no snapshots.
+func (s *SnapshotTable) MaxID() (id int64, err error) {
+	err = s.db.QueryRow(`SELECT COALESCE(MAX(snapshot_id), 0) FROM syncv3_snapshots`).Scan(&id)
+	return
+}
+
+// DeleteUnreferenced deletes up to `limit` snapshots with IDs no higher than `maxID` which are neither the
+// current state of a room nor the state before any event. Nothing can refer to these snapshots again, as
+// new events only refer to the current snapshot or to snapshots made in the same transaction. Returns the
+// number of snapshots deleted.
+func (s *SnapshotTable) DeleteUnreferenced(maxID int64, limit int) (int64, error) {
+	result, err := s.db.Exec(`DELETE FROM syncv3_snapshots WHERE snapshot_id IN (
+		SELECT snapshot_id FROM syncv3_snapshots s WHERE snapshot_id <= $1
+		AND NOT EXISTS (SELECT 1 FROM syncv3_rooms r WHERE r.current_snapshot_id = s.snapshot_id)
+		AND NOT EXISTS (SELECT 1 FROM syncv3_events e WHERE e.before_state_snapshot_id = s.snapshot_id)
+		LIMIT $2
+	)`, maxID, limit)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 // Delete the snapshot IDs given
 func (s *SnapshotTable) Delete(txn *sqlx.Tx, snapshotIDs []int64) error {
 	query, args, err := sqlx.In(`DELETE FROM syncv3_snapshots WHERE snapshot_id = ANY(?)`, pq.Int64Array(snapshotIDs))
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/lib/pq"
+	"github.com/matrix-org/sliding-sync/testutils"
 )
 
 func TestSnapshotTable(t *testing.T) {
@@ -49,9 +50,102 @@ func TestSnapshotTable(t *testing.T) {
 		t.Errorf("mismatched other events, got: %+v want: %+v", got.OtherEvents, want.OtherEvents)
 	}
 
+	// Select many snapshots at once
+	want2 := &SnapshotRow{
+		RoomID:           "B",
+		OtherEvents:      pq.Int64Array{8},
+		MembershipEvents: pq.Int64Array{9},
+	}
+	if err = table.Insert(txn, want2); err != nil {
+		t.Fatalf("Failed to insert: %s", err)
+	}
+	gotMany, err := table.SelectMany(txn, []int64{want.SnapshotID, want2.SnapshotID})
+	if err != nil {
+		t.Fatalf("Failed to select many: %s", err)
+	}
+	if !reflect.DeepEqual(gotMany, map[int64]SnapshotRow{want.SnapshotID: *want, want2.SnapshotID: *want2}) {
+		t.Errorf("SelectMany: got %+v want %+v and %+v", gotMany, *want, *want2)
+	}
+
 	// Delete the snapshot
-	err = table.Delete(txn, []int64{want.SnapshotID})
+	err = table.Delete(txn, []int64{want.SnapshotID, want2.SnapshotID})
 	if err != nil {
 		t.Fatalf("failed to delete snapshot: %s", err)
 	}
 }
+
+func TestSnapshotTableDeleteUnreferenced(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewSnapshotsTable(db)
+	roomsTable := NewRoomsTable(db)
+	eventsTable := NewEventTable(db)
+	roomID := "!TestSnapshotTableDeleteUnreferenced:localhost"
+
+	txn, err := db.Beginx()
+	if err != nil {
+		t.Fatalf("failed to start txn: %s", err)
+	}
+	snapshots := make([]*SnapshotRow, 4)
+	for i := range snapshots {
+		snapshots[i] = &SnapshotRow{
+			RoomID:           roomID,
+			OtherEvents:      pq.Int64Array{},
+			MembershipEvents: pq.Int64Array{},
+		}
+		if err = table.Insert(txn, snapshots[i]); err != nil {
+			t.Fatalf("Failed to insert: %s", err)
+		}
+	}
+	unreferenced, beforeEvent, current, afterMax := snapshots[0], snapshots[1], snapshots[2], snapshots[3]
+	if err = roomsTable.Upsert(txn, RoomInfo{ID: roomID}, current.SnapshotID, 1); err != nil {
+		t.Fatalf("Failed to upsert room: %s", err)
+	}
+	events := []Event{{
+		RoomID: roomID,
+		JSON:   testutils.NewStateEvent(t, "m.room.create", "", "@alice:localhost", map[string]interface{}{}),
+	}}
+	if _, err = eventsTable.Insert(txn, events, true); err != nil {
+		t.Fatalf("Failed to insert event: %s", err)
+	}
+	nids, err := eventsTable.SelectNIDsByIDs(txn, []string{events[0].ID})
+	if err != nil {
+		t.Fatalf("Failed to select event NID: %s", err)
+	}
+	if err = eventsTable.UpdateBeforeSnapshotID(txn, roomID, nids[events[0].ID], beforeEvent.SnapshotID, 0); err != nil {
+		t.Fatalf("Failed to update before snapshot ID: %s", err)
+	}
+	if err = txn.Commit(); err != nil {
+		t.Fatalf("failed to commit: %s", err)
+	}
+
+	if _, err = table.DeleteUnreferenced(current.SnapshotID, 1000); err != nil {
+		t.Fatalf("DeleteUnreferenced: %s", err)
+	}
+	txn, err = db.Beginx()
+	if err != nil {
+		t.Fatalf("failed to start txn: %s", err)
+	}
+	defer txn.Rollback()
+	got, err := table.SelectMany(txn, []int64{
+		unreferenced.SnapshotID, beforeEvent.SnapshotID, current.SnapshotID, afterMax.SnapshotID,
+	})
+	if err != nil {
+		t.Fatalf("Failed to select many: %s", err)
+	}
+	if _, ok := got[unreferenced.SnapshotID]; ok {
+		t.Errorf("DeleteUnreferenced: unreferenced snapshot %d was not deleted", unreferenced.SnapshotID)
+	}
+	for _, snap := range []*SnapshotRow{beforeEvent, current, afterMax} {
+		if _, ok := got[snap.SnapshotID]; !ok {
+			t.Errorf("DeleteUnreferenced: snapshot %d was deleted", snap.SnapshotID)
+		}
+	}
+	maxID, err := table.MaxID()
+	if err != nil {
+		t.Fatalf("MaxID: %s", err)
+	}
+	if maxID < afterMax.SnapshotID {
+		t.Errorf("MaxID: got %d want at least %d", maxID, afterMax.SnapshotID)
+	}
+}
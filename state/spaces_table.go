@@ -38,7 +38,7 @@ func NewSpaceRelationFromEvent(ev Event) (sr *SpaceRelation, isDeleted bool) {
 			Parent:      ev.RoomID,
 			Child:       ev.StateKey,
 			Relation:    RelationMSpaceChild,
-			Ordering:    event.Get("content.ordering").Str,
+			Ordering:    validSpaceOrdering(event.Get("content.ordering").Str),
 			IsSuggested: event.Get("content.suggested").Bool(),
 		}, !event.Get("content.via").IsArray()
 	case "m.space.parent":
@@ -53,6 +53,20 @@ func NewSpaceRelationFromEvent(ev Event) (sr *SpaceRelation, isDeleted bool) {
 	}
 }
 
+// validSpaceOrdering returns the ordering if it is valid according to the spec, else "". Invalid orderings
+// must be ignored by clients, so storing them would only make the children sort differently to clients.
+func validSpaceOrdering(ordering string) string {
+	if len(ordering) > 50 {
+		return ""
+	}
+	for i := 0; i < len(ordering); i++ {
+		if ordering[i] < 0x20 || ordering[i] > 0x7E {
+			return ""
+		}
+	}
+	return ordering
+}
+
 // SpacesTable stores the space graph for all users.
 type SpacesTable struct{}
 
@@ -67,6 +81,7 @@ func NewSpacesTable(db *sqlx.DB) *SpacesTable {
 		ordering TEXT NOT NULL, -- "" for unset
 		UNIQUE(parent, child, relation)
 	);
+	CREATE INDEX IF NOT EXISTS syncv3_spaces_child_idx ON syncv3_spaces(child, relation);
 	`)
 	return &SpacesTable{}
 }
@@ -119,6 +134,21 @@ func (t *SpacesTable) SelectChildren(txn *sqlx.Tx, spaces []string) (map[string]
 	return result, nil
 }
 
+// Select all relations where these rooms are the child, from both m.space.child events in the parent and
+// m.space.parent events in the child. Returns a map of child room ID to relations.
+func (t *SpacesTable) SelectParents(txn *sqlx.Tx, children []string) (map[string][]SpaceRelation, error) {
+	result := make(map[string][]SpaceRelation)
+	var data []SpaceRelation
+	err := txn.Select(&data, `SELECT parent, child, relation, ordering, suggested FROM syncv3_spaces WHERE child = ANY($1)`, pq.StringArray(children))
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range data {
+		result[d.Child] = append(result[d.Child], d)
+	}
+	return result, nil
+}
+
 func (t *SpacesTable) HandleSpaceUpdates(txn *sqlx.Tx, events []Event) error {
 	// pull out relations, and bucket them so the last event wins to ensure we always use the latest
 	// values in case someone repeatedly adds/removes the same space
@@ -150,10 +180,10 @@ func (t *SpacesTable) HandleSpaceUpdates(txn *sqlx.Tx, events []Event) error {
 	}
 	// update the database
 	if err := t.BulkInsert(txn, added); err != nil {
-		return fmt.Errorf("failed to BulkInsert: %s", err)
+		return fmt.Errorf("failed to BulkInsert: %w", err)
 	}
 	if err := t.BulkDelete(txn, removed); err != nil {
-		return fmt.Errorf("failed to BulkDelete: %s", err)
+		return fmt.Errorf("failed to BulkDelete: %w", err)
 	}
 
 	return nil
@@ -90,6 +90,16 @@ func TestSpacesTable(t *testing.T) {
 	}
 	matchAnyOrder(t, children, []SpaceRelation{s1, s2})
 
+	// select by child
+	result, err = table.SelectParents(txn, []string{child1, "!unknown"})
+	if err != nil {
+		t.Fatalf("SelectParents: %s", err)
+	}
+	if len(result) != 1 {
+		t.Fatalf("SelectParents: want 1 child, got %+v", result)
+	}
+	matchAnyOrder(t, result[child1], []SpaceRelation{s1})
+
 	// basic delete
 	if err = table.BulkDelete(txn, []SpaceRelation{s1, s2}); err != nil {
 		t.Fatalf("BulkDelete: %s", err)
@@ -141,6 +151,21 @@ func TestNewSpaceRelationFromEvent(t *testing.T) {
 				IsSuggested: true,
 			},
 		},
+		// child: invalid ordering is ignored
+		{
+			event: Event{
+				Type:     "m.space.child",
+				StateKey: "!child",
+				RoomID:   "!parent",
+				JSON:     json.RawMessage(`{"type":"m.space.child","state_key":"!child","room_id":"!parent","content":{"via":["example.com"],"ordering":"ab\ncd"}}`),
+			},
+			wantDeleted: false,
+			wantRelation: &SpaceRelation{
+				Parent:   "!parent",
+				Child:    "!child",
+				Relation: RelationMSpaceChild,
+			},
+		},
 		// child: redacted
 		{
 			event: Event{
@@ -0,0 +1,163 @@
+package state
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+)
+
+// LoadStartupSnapshot reads a snapshot previously written with SaveStartupSnapshot. Returns nil and no error
+// if there is no snapshot at this path. The snapshot may be out of date: call CatchUpStartupSnapshot before
+// using it.
+func LoadStartupSnapshot(path string) (*StartupSnapshot, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read startup snapshot %s: %w", path, err)
+	}
+	var ss StartupSnapshot
+	if err := json.NewDecoder(gz).Decode(&ss); err != nil {
+		return nil, fmt.Errorf("failed to decode startup snapshot %s: %w", path, err)
+	}
+	return &ss, nil
+}
+
+// SaveStartupSnapshot writes the snapshot to path as gzipped JSON. The file is replaced atomically so a
+// crash whilst writing never leaves a truncated snapshot behind.
+func SaveStartupSnapshot(path string, ss *StartupSnapshot) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // no-op once renamed
+	gz := gzip.NewWriter(f)
+	if err := json.NewEncoder(gz).Encode(ss); err != nil {
+		f.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// CatchUpStartupSnapshot updates a snapshot taken at ss.LatestEventNID to the current state of the database.
+// Only rooms which have had events since the snapshot was taken are reloaded, which is far cheaper than
+// calling GlobalSnapshot on large databases.
+func (s *Storage) CatchUpStartupSnapshot(ss *StartupSnapshot) error {
+	// take the position first: anything which happens whilst we are catching up is then reloaded next time.
+	latestNID, err := s.LatestEventNID()
+	if err != nil {
+		return err
+	}
+	var roomIDs []string
+	err = s.DB.Select(&roomIDs, `SELECT DISTINCT room_id FROM syncv3_events WHERE event_nid > $1`, ss.LatestEventNID)
+	if err != nil {
+		return fmt.Errorf("failed to select rooms changed since snapshot: %w", err)
+	}
+	if len(roomIDs) == 0 {
+		ss.LatestEventNID = latestNID
+		return nil
+	}
+	metadata, err := s.MetadataForRooms(roomIDs)
+	if err != nil {
+		return fmt.Errorf("failed to load metadata for rooms changed since snapshot: %w", err)
+	}
+	var joined, invited map[string][]string
+	err = sqlutil.WithTransaction(s.accumulator.db, func(txn *sqlx.Tx) error {
+		joined, err = s.currentMembers(txn, roomIDs, "join", "_join")
+		if err != nil {
+			return err
+		}
+		invited, err = s.currentMembers(txn, roomIDs, "invite", "_invite")
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load members for rooms changed since snapshot: %w", err)
+	}
+	if ss.GlobalMetadata == nil {
+		ss.GlobalMetadata = make(map[string]internal.RoomMetadata)
+	}
+	if ss.AllJoinedMembers == nil {
+		ss.AllJoinedMembers = make(map[string][]string)
+	}
+	if ss.AllInvitedMembers == nil {
+		ss.AllInvitedMembers = make(map[string][]string)
+	}
+	for _, roomID := range roomIDs {
+		if m, ok := metadata[roomID]; ok {
+			ss.GlobalMetadata[roomID] = m
+		} else {
+			delete(ss.GlobalMetadata, roomID)
+		}
+		if members, ok := joined[roomID]; ok {
+			ss.AllJoinedMembers[roomID] = members
+		} else {
+			delete(ss.AllJoinedMembers, roomID)
+		}
+		if members, ok := invited[roomID]; ok {
+			ss.AllInvitedMembers[roomID] = members
+		} else {
+			delete(ss.AllInvitedMembers, roomID)
+		}
+	}
+	ss.LatestEventNID = latestNID
+	return nil
+}
+
+// WarmStartupSnapshot loads the snapshot at path and catches it up with the database. If there is no usable
+// snapshot at path, a full snapshot is taken with GlobalSnapshot and written to path for next time.
+func (s *Storage) WarmStartupSnapshot(path string) (ss StartupSnapshot, err error) {
+	loaded, err := LoadStartupSnapshot(path)
+	if err != nil {
+		logger.Warn().Err(err).Str("path", path).Msg("ignoring unusable startup snapshot")
+	}
+	if loaded != nil {
+		if err = s.CatchUpStartupSnapshot(loaded); err != nil {
+			return ss, err
+		}
+		return *loaded, nil
+	}
+	ss, err = s.GlobalSnapshot()
+	if err != nil {
+		return ss, err
+	}
+	if err := SaveStartupSnapshot(path, &ss); err != nil {
+		logger.Err(err).Str("path", path).Msg("failed to save startup snapshot")
+	}
+	return ss, nil
+}
+
+// RefreshStartupSnapshot catches up the snapshot at path with the database and writes it back, so the next
+// WarmStartupSnapshot has little to catch up on.
+func (s *Storage) RefreshStartupSnapshot(path string) error {
+	ss, err := LoadStartupSnapshot(path)
+	if err != nil || ss == nil {
+		// start again from scratch
+		snapshot, err := s.GlobalSnapshot()
+		if err != nil {
+			return err
+		}
+		ss = &snapshot
+	} else if err = s.CatchUpStartupSnapshot(ss); err != nil {
+		return err
+	}
+	return SaveStartupSnapshot(path, ss)
+}
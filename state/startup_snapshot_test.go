@@ -0,0 +1,112 @@
+package state
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+func TestStartupSnapshotSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json.gz")
+	ss, err := LoadStartupSnapshot(path)
+	assertNoError(t, err)
+	if ss != nil {
+		t.Fatalf("LoadStartupSnapshot: got %+v for a missing file, want nil", ss)
+	}
+	roomType := "m.space"
+	want := &StartupSnapshot{
+		GlobalMetadata: map[string]internal.RoomMetadata{
+			"!a:localhost": {
+				RoomID:               "!a:localhost",
+				Heroes:               []internal.Hero{{ID: "@bob:localhost", Name: "Bob"}},
+				NameEvent:            "My Room",
+				JoinCount:            2,
+				InviteCount:          1,
+				LastMessageTimestamp: 1234,
+				RoomType:             &roomType,
+				ChildSpaceRooms:      map[string]struct{}{"!child:localhost": {}},
+			},
+		},
+		AllJoinedMembers: map[string][]string{
+			"!a:localhost": {"@alice:localhost", "@bob:localhost"},
+		},
+		AllInvitedMembers: map[string][]string{
+			"!a:localhost": {"@charlie:localhost"},
+		},
+		LatestEventNID: 42,
+	}
+	assertNoError(t, SaveStartupSnapshot(path, want))
+	got, err := LoadStartupSnapshot(path)
+	assertNoError(t, err)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LoadStartupSnapshot:\ngot:  %+v\nwant: %+v", got, want)
+	}
+}
+
+// Test that catching up an old snapshot produces the same result as taking a new one.
+func TestStartupSnapshotCatchUp(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	alice := "@alice_TestStartupSnapshotCatchUp:localhost"
+	bob := "@bob_TestStartupSnapshotCatchUp:localhost"
+	charlie := "@charlie_TestStartupSnapshotCatchUp:localhost"
+	roomUnchanged := "!unchanged_TestStartupSnapshotCatchUp:localhost"
+	roomChanged := "!changed_TestStartupSnapshotCatchUp:localhost"
+	roomNew := "!new_TestStartupSnapshotCatchUp:localhost"
+	_, err := store.Initialise(roomUnchanged, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+	})
+	assertNoError(t, err)
+	_, err = store.Initialise(roomChanged, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+		testutils.NewJoinEvent(t, bob),
+	})
+	assertNoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "snapshot.json.gz")
+	ss, err := store.WarmStartupSnapshot(path)
+	assertNoError(t, err)
+	if _, ok := ss.GlobalMetadata[roomNew]; ok {
+		t.Fatalf("snapshot contains a room which doesn't exist yet")
+	}
+
+	// things happen whilst the proxy is down
+	_, _, err = store.Accumulate(roomChanged, "", []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "Changed"}),
+		testutils.NewStateEvent(t, "m.room.member", bob, bob, map[string]interface{}{"membership": "leave"}),
+		testutils.NewStateEvent(t, "m.room.member", charlie, alice, map[string]interface{}{"membership": "invite"}),
+	})
+	assertNoError(t, err)
+	_, err = store.Initialise(roomNew, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", charlie, map[string]interface{}{"creator": charlie}),
+		testutils.NewJoinEvent(t, charlie),
+	})
+	assertNoError(t, err)
+
+	got, err := store.WarmStartupSnapshot(path)
+	assertNoError(t, err)
+	want, err := store.GlobalSnapshot()
+	assertNoError(t, err)
+	assertValue(t, "LatestEventNID", got.LatestEventNID, want.LatestEventNID)
+	for _, roomID := range []string{roomUnchanged, roomChanged, roomNew} {
+		assertValue(t, "joined members in "+roomID, got.AllJoinedMembers[roomID], want.AllJoinedMembers[roomID])
+		assertValue(t, "invited members in "+roomID, got.AllInvitedMembers[roomID], want.AllInvitedMembers[roomID])
+		gotMetadata, wantMetadata := got.GlobalMetadata[roomID], want.GlobalMetadata[roomID]
+		gotMetadata.Heroes = sortHeroes(gotMetadata.Heroes)
+		wantMetadata.Heroes = sortHeroes(wantMetadata.Heroes)
+		assertValue(t, "metadata for "+roomID, gotMetadata, wantMetadata)
+	}
+	assertValue(t, "changed room name", got.GlobalMetadata[roomChanged].NameEvent, "Changed")
+
+	// refreshing writes the caught up snapshot back, so it has nothing left to catch up on
+	assertNoError(t, store.RefreshStartupSnapshot(path))
+	refreshed, err := LoadStartupSnapshot(path)
+	assertNoError(t, err)
+	assertValue(t, "refreshed LatestEventNID", refreshed.LatestEventNID, want.LatestEventNID)
+}
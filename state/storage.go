@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/getsentry/sentry-go"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/jmoiron/sqlx"
@@ -26,8 +27,11 @@ const MaxPostgresParameters = 65535
 
 // StartupSnapshot represents a snapshot of startup data for the sliding sync HTTP API instances
 type StartupSnapshot struct {
-	GlobalMetadata   map[string]internal.RoomMetadata // room_id -> metadata
-	AllJoinedMembers map[string][]string              // room_id -> [user_id]
+	GlobalMetadata    map[string]internal.RoomMetadata // room_id -> metadata
+	AllJoinedMembers  map[string][]string              // room_id -> [user_id]
+	AllInvitedMembers map[string][]string              // room_id -> [user_id]
+	// The latest event NID when the snapshot was taken. Used to catch up snapshots loaded from disk.
+	LatestEventNID int64
 }
 
 type Storage struct {
@@ -40,7 +44,15 @@ type Storage struct {
 	TransactionsTable *TransactionsTable
 	DeviceDataTable   *DeviceDataTable
 	ReceiptTable      *ReceiptTable
+	DeadLetterTable   *DeadLetterTable
+	ThreadUnreadTable *ThreadUnreadTable
 	DB                *sqlx.DB
+	// Decides which events count as a room's latest event for LastMessageTimestamp.
+	LatestEventFilter *internal.LatestEventFilter
+	// Custom state event types whose current content is kept in room metadata. See RoomMetadata.IndexedState.
+	IndexedStateTypes []string
+	// Optional read-only copy of the database for reads at an event position. See SetReadReplica.
+	replica *replica
 }
 
 func NewStorage(postgresURI string) *Storage {
@@ -68,7 +80,11 @@ func NewStorage(postgresURI string) *Storage {
 		TransactionsTable: NewTransactionsTable(db),
 		DeviceDataTable:   NewDeviceDataTable(db),
 		ReceiptTable:      NewReceiptTable(db),
+		DeadLetterTable:   NewDeadLetterTable(db),
+		ThreadUnreadTable: NewThreadUnreadTable(db),
 		DB:                db,
+		LatestEventFilter: internal.NewLatestEventFilter(internal.DefaultIgnoredLatestEventTypes),
+		IndexedStateTypes: internal.DefaultIndexedStateTypes,
 	}
 }
 
@@ -76,6 +92,12 @@ func (s *Storage) LatestEventNID() (int64, error) {
 	return s.accumulator.eventsTable.SelectHighestNID()
 }
 
+// NumRooms returns the number of rooms the proxy knows about.
+func (s *Storage) NumRooms() (count int, err error) {
+	err = s.DB.QueryRow(`SELECT count(*) FROM syncv3_rooms`).Scan(&count)
+	return
+}
+
 func (s *Storage) AccountData(userID, roomID string, eventTypes []string) (data []AccountData, err error) {
 	err = sqlutil.WithTransaction(s.accumulator.db, func(txn *sqlx.Tx) error {
 		data, err = s.AccountDataTable.Select(txn, userID, eventTypes, roomID)
@@ -84,6 +106,22 @@ func (s *Storage) AccountData(userID, roomID string, eventTypes []string) (data
 	return
 }
 
+// AccountDataForRooms returns the account data of the given types in each room, in one transaction.
+// Global account data uses AccountDataGlobalRoom as the room ID.
+func (s *Storage) AccountDataForRooms(userID string, roomIDToTypes map[string][]string) (data []AccountData, err error) {
+	err = sqlutil.WithTransaction(s.accumulator.db, func(txn *sqlx.Tx) error {
+		for roomID, eventTypes := range roomIDToTypes {
+			roomData, err := s.AccountDataTable.Select(txn, userID, eventTypes, roomID)
+			if err != nil {
+				return err
+			}
+			data = append(data, roomData...)
+		}
+		return nil
+	})
+	return
+}
+
 func (s *Storage) RoomAccountDatasWithType(userID, eventType string) (data []AccountData, err error) {
 	err = sqlutil.WithTransaction(s.accumulator.db, func(txn *sqlx.Tx) error {
 		data, err = s.AccountDataTable.SelectWithType(txn, userID, eventType)
@@ -102,14 +140,17 @@ func (s *Storage) AccountDatas(userID string, roomIDs ...string) (datas []Accoun
 	return
 }
 
-func (s *Storage) InsertAccountData(userID, roomID string, events []json.RawMessage) (data []AccountData, err error) {
-	data = make([]AccountData, len(events))
-	for i := range events {
-		data[i] = AccountData{
-			UserID: userID,
-			RoomID: roomID,
-			Data:   events[i],
-			Type:   gjson.ParseBytes(events[i]).Get("type").Str,
+// InsertAccountData stores the account data events for each room in one transaction. Global account data
+// uses AccountDataGlobalRoom as the room ID.
+func (s *Storage) InsertAccountData(userID string, roomIDToEvents map[string][]json.RawMessage) (data []AccountData, err error) {
+	for roomID, events := range roomIDToEvents {
+		for i := range events {
+			data = append(data, AccountData{
+				UserID: userID,
+				RoomID: roomID,
+				Data:   events[i],
+				Type:   gjson.ParseBytes(events[i]).Get("type").Str,
+			})
 		}
 	}
 	err = sqlutil.WithTransaction(s.accumulator.db, func(txn *sqlx.Tx) error {
@@ -119,16 +160,39 @@ func (s *Storage) InsertAccountData(userID, roomID string, events []json.RawMess
 	return data, err
 }
 
+// DeleteUserData deletes all data derived from this user's sync v2 stream: unread counts, account data and
+// invites. This is used to garbage collect long-inactive users, and will be rehydrated by an initial sync
+// if they return. Receipts are shared room data so are kept.
+func (s *Storage) DeleteUserData(userID string) error {
+	return sqlutil.WithTransaction(s.accumulator.db, func(txn *sqlx.Tx) error {
+		for _, table := range []string{"syncv3_unread", "syncv3_thread_unread", "syncv3_account_data", "syncv3_invites"} {
+			if _, err := txn.Exec(`DELETE FROM `+table+` WHERE user_id = $1`, userID); err != nil {
+				return fmt.Errorf("failed to delete from %s: %w", table, err)
+			}
+		}
+		return nil
+	})
+}
+
 // GlobalSnapshot snapshots the entire database for the purposes of initialising
 // a sliding sync instance. It will atomically grab metadata for all rooms and all joined members
 // in a single transaction.
 func (s *Storage) GlobalSnapshot() (ss StartupSnapshot, err error) {
+	// taken before the snapshot, so events which arrive whilst it is being taken are reloaded on catch up
+	ss.LatestEventNID, err = s.LatestEventNID()
+	if err != nil {
+		return
+	}
 	err = sqlutil.WithTransaction(s.accumulator.db, func(txn *sqlx.Tx) error {
 		var metadata map[string]internal.RoomMetadata
 		ss.AllJoinedMembers, metadata, err = s.AllJoinedMembers(txn)
 		if err != nil {
 			return err
 		}
+		ss.AllInvitedMembers, err = s.currentMembers(txn, nil, "invite", "_invite")
+		if err != nil {
+			return err
+		}
 		err = s.MetadataForAllRooms(txn, metadata)
 		if err != nil {
 			return err
@@ -139,16 +203,69 @@ func (s *Storage) GlobalSnapshot() (ss StartupSnapshot, err error) {
 	return
 }
 
+// MembershipSnapshot is GlobalSnapshot without room metadata, for when room metadata is loaded lazily.
+func (s *Storage) MembershipSnapshot() (ss StartupSnapshot, err error) {
+	ss.LatestEventNID, err = s.LatestEventNID()
+	if err != nil {
+		return
+	}
+	err = sqlutil.WithTransaction(s.accumulator.db, func(txn *sqlx.Tx) error {
+		ss.AllJoinedMembers, err = s.currentMembers(txn, nil, "join", "_join")
+		if err != nil {
+			return err
+		}
+		ss.AllInvitedMembers, err = s.currentMembers(txn, nil, "invite", "_invite")
+		return err
+	})
+	return
+}
+
+// MetadataForRooms loads the current metadata for the given rooms, in the same way GlobalSnapshot does for
+// all rooms. Unknown rooms are not included in the result.
+func (s *Storage) MetadataForRooms(roomIDs []string) (result map[string]internal.RoomMetadata, err error) {
+	result = make(map[string]internal.RoomMetadata, len(roomIDs))
+	if len(roomIDs) == 0 {
+		return result, nil
+	}
+	err = sqlutil.WithTransaction(s.accumulator.db, func(txn *sqlx.Tx) error {
+		rows, err := txn.Query(
+			`SELECT room_id, count(state_key) FROM syncv3_events WHERE (membership='join' OR membership='_join') AND event_nid IN (
+				SELECT UNNEST(membership_events) FROM syncv3_snapshots JOIN syncv3_rooms ON syncv3_snapshots.snapshot_id = syncv3_rooms.current_snapshot_id
+				WHERE syncv3_rooms.room_id = ANY($1)
+			) GROUP BY room_id`, pq.StringArray(roomIDs),
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var metadata internal.RoomMetadata
+			if err := rows.Scan(&metadata.RoomID, &metadata.JoinCount); err != nil {
+				return err
+			}
+			result[metadata.RoomID] = metadata
+		}
+		return s.metadataForRooms(txn, roomIDs, result)
+	})
+	return
+}
+
 // Extract hero info for all rooms.
 func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, result map[string]internal.RoomMetadata) error {
+	return s.metadataForRooms(txn, nil, result)
+}
+
+// metadataForRooms populates result for the given rooms, or for all rooms if roomIDs is nil.
+func (s *Storage) metadataForRooms(txn *sqlx.Tx, roomIDs []string, result map[string]internal.RoomMetadata) error {
+	roomFilter := pq.StringArray(roomIDs)
 	// Select the invited member counts
 	rows, err := txn.Query(`
 	SELECT room_id, count(state_key) FROM syncv3_events
 		WHERE (membership='_invite' OR membership = 'invite') AND event_type='m.room.member' AND event_nid IN (
 			SELECT unnest(membership_events) FROM syncv3_snapshots WHERE syncv3_snapshots.snapshot_id IN (
-				SELECT current_snapshot_id FROM syncv3_rooms
+				SELECT current_snapshot_id FROM syncv3_rooms WHERE $1::text[] IS NULL OR room_id = ANY($1)
 			)
-		) GROUP BY room_id`)
+		) GROUP BY room_id`, roomFilter)
 	if err != nil {
 		return err
 	}
@@ -165,33 +282,60 @@ func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, result map[string]internal.R
 	}
 
 	// work out latest timestamps
-	events, err := s.accumulator.eventsTable.selectLatestEventInAllRooms(txn)
+	events, err := s.accumulator.eventsTable.selectLatestEventInRooms(txn, roomIDs)
 	if err != nil {
 		return err
 	}
 	for _, ev := range events {
 		metadata := result[ev.RoomID]
-		metadata.LastMessageTimestamp = gjson.ParseBytes(ev.JSON).Get("origin_server_ts").Uint()
+		metadata.LatestEventTimestamp = gjson.ParseBytes(ev.JSON).Get("origin_server_ts").Uint()
+		// rooms which only have ignored events still need a timestamp to be sorted by
+		metadata.LastMessageTimestamp = metadata.LatestEventTimestamp
 		// it's possible the latest event is a brand new room not caught by the first SELECT for joined
 		// rooms e.g when you're invited to a room so we need to make sure to se the metadata again here
 		metadata.RoomID = ev.RoomID
 		result[ev.RoomID] = metadata
 	}
+	if ignoredTypes := s.LatestEventFilter.IgnoredTypes(); len(ignoredTypes) > 0 {
+		events, err = s.accumulator.eventsTable.selectLatestRelevantEventInRooms(txn, ignoredTypes, roomIDs)
+		if err != nil {
+			return err
+		}
+		for _, ev := range events {
+			metadata := result[ev.RoomID]
+			metadata.LastMessageTimestamp = gjson.ParseBytes(ev.JSON).Get("origin_server_ts").Uint()
+			result[ev.RoomID] = metadata
+		}
+	}
 
-	// Select the name / canonical alias for all rooms
-	roomIDToStateEvents, err := s.currentNotMembershipStateEventsInAllRooms(txn, []string{
-		"m.room.name", "m.room.canonical_alias",
-	})
+	// Select the name / canonical alias / avatar / room version / join rules / indexed state for all rooms
+	eventTypes := append([]string{
+		"m.room.name", "m.room.canonical_alias", "m.room.avatar", "m.room.create", "m.room.join_rules",
+	}, s.IndexedStateTypes...)
+	indexedTypes := make(map[string]bool, len(s.IndexedStateTypes))
+	for _, evType := range s.IndexedStateTypes {
+		indexedTypes[evType] = true
+	}
+	roomIDToStateEvents, err := s.currentNotMembershipStateEventsInRooms(txn, eventTypes, roomIDs)
 	if err != nil {
-		return fmt.Errorf("failed to load state events for all rooms: %s", err)
+		return fmt.Errorf("failed to load state events for all rooms: %w", err)
 	}
 	for roomID, stateEvents := range roomIDToStateEvents {
 		metadata := result[roomID]
 		for _, ev := range stateEvents {
+			if indexedTypes[ev.Type] {
+				metadata.SetIndexedState(ev.Type, ev.StateKey, json.RawMessage(gjson.GetBytes(ev.JSON, "content").Raw))
+			}
 			if ev.Type == "m.room.name" && ev.StateKey == "" {
 				metadata.NameEvent = gjson.ParseBytes(ev.JSON).Get("content.name").Str
 			} else if ev.Type == "m.room.canonical_alias" && ev.StateKey == "" {
 				metadata.CanonicalAlias = gjson.ParseBytes(ev.JSON).Get("content.alias").Str
+			} else if ev.Type == "m.room.avatar" && ev.StateKey == "" {
+				metadata.AvatarEvent = gjson.ParseBytes(ev.JSON).Get("content.url").Str
+			} else if ev.Type == "m.room.create" && ev.StateKey == "" {
+				metadata.RoomVersion = gjson.ParseBytes(ev.JSON).Get("content.room_version").Str
+			} else if ev.Type == "m.room.join_rules" && ev.StateKey == "" {
+				metadata.JoinRule = gjson.ParseBytes(ev.JSON).Get("content.join_rule").Str
 			}
 		}
 		result[roomID] = metadata
@@ -209,12 +353,12 @@ func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, result map[string]internal.R
 			membership='join' OR membership='invite' OR membership='_join'
 		) AND event_type='m.room.member' AND event_nid IN (
 			SELECT unnest(membership_events) FROM syncv3_snapshots WHERE syncv3_snapshots.snapshot_id IN (
-				SELECT current_snapshot_id FROM syncv3_rooms
+				SELECT current_snapshot_id FROM syncv3_rooms WHERE $1::text[] IS NULL OR room_id = ANY($1)
 			)
 		)
-	) rf WHERE rank <= 6`)
+	) rf WHERE rank <= 6`, roomFilter)
 	if err != nil {
-		return fmt.Errorf("failed to query heroes: %s", err)
+		return fmt.Errorf("failed to query heroes: %w", err)
 	}
 	defer rows.Close()
 	seen := map[string]bool{}
@@ -225,6 +369,10 @@ func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, result map[string]internal.R
 		if err := rows.Scan(&roomID, &event, &rank); err != nil {
 			return err
 		}
+		event, err = s.accumulator.eventsTable.decryptJSON(event)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt hero: %w", err)
+		}
 		ev := gjson.ParseBytes(event)
 		targetUser := ev.Get("state_key").Str
 		key := roomID + " " + targetUser
@@ -239,9 +387,9 @@ func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, result map[string]internal.R
 		})
 		result[roomID] = metadata
 	}
-	roomInfos, err := s.accumulator.roomsTable.SelectRoomInfos(txn)
+	roomInfos, err := s.accumulator.roomsTable.SelectRoomInfos(txn, roomIDs...)
 	if err != nil {
-		return fmt.Errorf("failed to select room infos: %s", err)
+		return fmt.Errorf("failed to select room infos: %w", err)
 	}
 	var spaceRoomIDs []string
 	for _, info := range roomInfos {
@@ -259,7 +407,7 @@ func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, result map[string]internal.R
 	// select space children
 	spaceRoomToRelations, err := s.accumulator.spacesTable.SelectChildren(txn, spaceRoomIDs)
 	if err != nil {
-		return fmt.Errorf("failed to select space children: %s", err)
+		return fmt.Errorf("failed to select space children: %w", err)
 	}
 	for roomID, relations := range spaceRoomToRelations {
 		metadata := result[roomID]
@@ -275,16 +423,18 @@ func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, result map[string]internal.R
 	return nil
 }
 
-// Returns all current NOT MEMBERSHIP state events matching the event types given in all rooms. Returns a map of
-// room ID to events in that room.
-func (s *Storage) currentNotMembershipStateEventsInAllRooms(txn *sqlx.Tx, eventTypes []string) (map[string][]Event, error) {
+// Returns all current NOT MEMBERSHIP state events matching the event types given in the given rooms, or in all
+// rooms if roomIDs is nil. Returns a map of room ID to events in that room.
+func (s *Storage) currentNotMembershipStateEventsInRooms(txn *sqlx.Tx, eventTypes, roomIDs []string) (map[string][]Event, error) {
 	query, args, err := sqlx.In(
 		`SELECT syncv3_events.room_id, syncv3_events.event_type, syncv3_events.state_key, syncv3_events.event FROM syncv3_events
 		WHERE syncv3_events.event_type IN (?)
 		AND syncv3_events.event_nid IN (
-			SELECT unnest(events) FROM syncv3_snapshots WHERE syncv3_snapshots.snapshot_id IN (SELECT current_snapshot_id FROM syncv3_rooms)
+			SELECT unnest(events) FROM syncv3_snapshots WHERE syncv3_snapshots.snapshot_id IN (
+				SELECT current_snapshot_id FROM syncv3_rooms WHERE ?::text[] IS NULL OR room_id = ANY(?)
+			)
 		)`,
-		eventTypes,
+		eventTypes, pq.StringArray(roomIDs), pq.StringArray(roomIDs),
 	)
 	if err != nil {
 		return nil, err
@@ -300,17 +450,24 @@ func (s *Storage) currentNotMembershipStateEventsInAllRooms(txn *sqlx.Tx, eventT
 		if err := rows.Scan(&ev.RoomID, &ev.Type, &ev.StateKey, &ev.JSON); err != nil {
 			return nil, err
 		}
+		if ev.JSON, err = s.accumulator.eventsTable.decryptJSON(ev.JSON); err != nil {
+			return nil, err
+		}
 		result[ev.RoomID] = append(result[ev.RoomID], ev)
 	}
 	return result, nil
 }
 
 func (s *Storage) Accumulate(roomID, prevBatch string, timeline []json.RawMessage) (numNew int, timelineNIDs []int64, err error) {
-	return s.accumulator.Accumulate(roomID, prevBatch, timeline)
+	numNew, timelineNIDs, err = s.accumulator.Accumulate(roomID, prevBatch, timeline)
+	s.noteWrite()
+	return
 }
 
-func (s *Storage) Initialise(roomID string, state []json.RawMessage) (InitialiseResult, error) {
-	return s.accumulator.Initialise(roomID, state)
+func (s *Storage) Initialise(roomID string, state []json.RawMessage) (res InitialiseResult, err error) {
+	res, err = s.accumulator.Initialise(roomID, state)
+	s.noteWrite()
+	return
 }
 
 func (s *Storage) EventNIDs(eventNIDs []int64) ([]json.RawMessage, error) {
@@ -333,7 +490,7 @@ func (s *Storage) StateSnapshot(snapID int64) (state []json.RawMessage, err erro
 		}
 		events, err := s.accumulator.eventsTable.SelectByNIDs(txn, true, append(snapshotRow.MembershipEvents, snapshotRow.OtherEvents...))
 		if err != nil {
-			return fmt.Errorf("failed to select state snapshot %v: %s", snapID, err)
+			return fmt.Errorf("failed to select state snapshot %v: %w", snapID, err)
 		}
 		state = make([]json.RawMessage, len(events))
 		for i := range events {
@@ -352,7 +509,7 @@ func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []str
 	defer span.End()
 	roomToEvents = make(map[string][]Event, len(roomIDs))
 	roomIndex := make(map[string]int, len(roomIDs))
-	err = sqlutil.WithTransaction(s.accumulator.db, func(txn *sqlx.Tx) error {
+	err = s.withReadTransaction(pos, func(txn *sqlx.Tx) error {
 		// we have 2 ways to pull the latest events:
 		//  - superfast rooms table (which races as it can be updated before the new state hits the dispatcher)
 		//  - slower events table query
@@ -375,7 +532,7 @@ func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []str
 		}
 		latestEvents, err := s.accumulator.eventsTable.SelectByNIDs(txn, true, fastNIDs)
 		if err != nil {
-			return fmt.Errorf("failed to select latest nids in rooms %v: %s", roomIDs, err)
+			return fmt.Errorf("failed to select latest nids in rooms %v: %w", roomIDs, err)
 		}
 		if len(slowRooms) > 0 {
 			logger.Warn().Int("slow_rooms", len(slowRooms)).Msg("RoomStateAfterEventPosition: pos value provided is far behind the database copy, performance degraded")
@@ -385,25 +542,40 @@ func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []str
 			}
 			latestEvents = append(latestEvents, latestSlowEvents...)
 		}
+		var roomsNeedingCurrentSnapshot []string
 		for i, ev := range latestEvents {
 			roomIndex[ev.RoomID] = i
 			if ev.BeforeStateSnapshotID == 0 {
-				// if there is no before snapshot then this last event NID is _part of_ the initial state,
-				// ergo the state after this == the current state and we can safely ignore the lastEventNID
-				ev.BeforeStateSnapshotID = 0
-				ev.BeforeStateSnapshotID, err = s.accumulator.roomsTable.CurrentAfterSnapshotID(txn, ev.RoomID)
-				if err != nil {
-					return err
-				}
-				latestEvents[i] = ev
+				roomsNeedingCurrentSnapshot = append(roomsNeedingCurrentSnapshot, ev.RoomID)
+			}
+		}
+		if len(roomsNeedingCurrentSnapshot) > 0 {
+			// if there is no before snapshot then this last event NID is _part of_ the initial state,
+			// ergo the state after this == the current state and we can safely ignore the lastEventNID
+			currentSnapshotIDs, err := s.accumulator.roomsTable.CurrentAfterSnapshotIDs(txn, roomsNeedingCurrentSnapshot)
+			if err != nil {
+				return err
+			}
+			for _, roomID := range roomsNeedingCurrentSnapshot {
+				latestEvents[roomIndex[roomID]].BeforeStateSnapshotID = currentSnapshotIDs[roomID]
 			}
 		}
 
 		if len(eventTypesToStateKeys) == 0 {
+			// load the snapshots and then their events for all rooms at once, rather than a query per room
+			snapIDs := make([]int64, len(latestEvents))
+			for i := range latestEvents {
+				snapIDs[i] = latestEvents[i].BeforeStateSnapshotID
+			}
+			snapshots, err := s.accumulator.snapshotTable.SelectMany(txn, snapIDs)
+			if err != nil {
+				return err
+			}
+			var allNIDs []int64
 			for _, ev := range latestEvents {
-				snapshotRow, err := s.accumulator.snapshotTable.Select(txn, ev.BeforeStateSnapshotID)
-				if err != nil {
-					return err
+				snapshotRow, ok := snapshots[ev.BeforeStateSnapshotID]
+				if !ok {
+					return fmt.Errorf("missing state snapshot %v for room %v", ev.BeforeStateSnapshotID, ev.RoomID)
 				}
 				allStateEventNIDs := append(snapshotRow.MembershipEvents, snapshotRow.OtherEvents...)
 				// we need to roll forward if this event is state
@@ -432,11 +604,15 @@ func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []str
 						}
 					}
 				}
-				events, err := s.accumulator.eventsTable.SelectByNIDs(txn, true, allStateEventNIDs)
-				if err != nil {
-					return fmt.Errorf("failed to select state snapshot %v for room %v: %s", ev.BeforeStateSnapshotID, ev.RoomID, err)
-				}
-				roomToEvents[ev.RoomID] = events
+				allNIDs = append(allNIDs, allStateEventNIDs...)
+			}
+			events, err := s.accumulator.eventsTable.SelectByNIDs(txn, true, allNIDs)
+			if err != nil {
+				return fmt.Errorf("failed to select state snapshots for rooms %v: %w", roomIDs, err)
+			}
+			// events are sorted by NID, so each room's events stay sorted
+			for _, ev := range events {
+				roomToEvents[ev.RoomID] = append(roomToEvents[ev.RoomID], ev)
 			}
 		} else {
 			// do an optimised query to pull out only the event types and state keys we care about.
@@ -484,28 +660,37 @@ func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []str
 				args...,
 			)
 			if err != nil {
-				return fmt.Errorf("failed to form sql query: %s", err)
+				return fmt.Errorf("failed to form sql query: %w", err)
 			}
 			rows, err := s.accumulator.db.Query(s.accumulator.db.Rebind(query), args...)
 			if err != nil {
-				return fmt.Errorf("failed to execute query: %s", err)
+				return fmt.Errorf("failed to execute query: %w", err)
 			}
 			defer rows.Close()
+			seenNIDs := make(map[int64]bool)
 			for rows.Next() {
 				var ev Event
 				if err := rows.Scan(&ev.NID, &ev.RoomID, &ev.Type, &ev.StateKey, &ev.JSON); err != nil {
 					return err
 				}
+				if ev.JSON, err = s.accumulator.eventsTable.decryptJSON(ev.JSON); err != nil {
+					return err
+				}
 				i := roomIndex[ev.RoomID]
 				if latestEvents[i].ReplacesNID == ev.NID {
 					// this event is replaced by the last event
 					ev = latestEvents[i]
 				}
+				seenNIDs[ev.NID] = true
 				roomToEvents[ev.RoomID] = append(roomToEvents[ev.RoomID], ev)
 			}
-			// handle the most recent events which won't be in the snapshot but may need to be.
-			// we handle the replace case but don't handle brand new state events
+			// handle the most recent events which won't be in the snapshot but may need to be. Replacements
+			// are handled above. The latest event is already in the snapshot if it came from a state block,
+			// and isn't room state at all if it is a timeline event without a state key.
 			for i := range latestEvents {
+				if seenNIDs[latestEvents[i].NID] || !gjson.ParseBytes(latestEvents[i].JSON).Get("state_key").Exists() {
+					continue
+				}
 				if latestEvents[i].ReplacesNID == 0 {
 					// check if we should include it
 					for evType, stateKeys := range eventTypesToStateKeys {
@@ -531,42 +716,73 @@ func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []str
 	return
 }
 
+// RoomStateAt returns the state of a single room after the event position `pos`, filtered as with
+// RoomStateAfterEventPosition. Use this to serve state which matches an older timeline, rather than the
+// current state of the room.
+func (s *Storage) RoomStateAt(ctx context.Context, roomID string, pos int64, eventTypesToStateKeys map[string][]string) ([]Event, error) {
+	roomToEvents, err := s.RoomStateAfterEventPosition(ctx, []string{roomID}, pos, eventTypesToStateKeys)
+	if err != nil {
+		return nil, err
+	}
+	return roomToEvents[roomID], nil
+}
+
 func (s *Storage) LatestEventsInRooms(userID string, roomIDs []string, to int64, limit int) (map[string][]json.RawMessage, map[string]string, error) {
-	roomIDToRanges, err := s.visibleEventNIDsBetweenForRooms(userID, roomIDs, 0, to)
+	return s.LatestEventsInRoomsBetween(userID, roomIDs, 0, to, limit)
+}
+
+// LatestEventsInRoomsBetween returns the latest `limit` events visible to this user in each room, between
+// the event positions from and to inclusive, along with a prev_batch token for the earliest event returned.
+func (s *Storage) LatestEventsInRoomsBetween(userID string, roomIDs []string, from, to int64, limit int) (map[string][]json.RawMessage, map[string]string, error) {
+	roomIDToRanges, err := s.visibleEventNIDsBetweenForRooms(userID, roomIDs, from, to)
 	if err != nil {
 		return nil, nil, err
 	}
-	result := make(map[string][]json.RawMessage, len(roomIDs))
-	prevBatches := make(map[string]string, len(roomIDs))
-	err = sqlutil.WithTransaction(s.accumulator.db, func(txn *sqlx.Tx) error {
+	return s.LatestEventsInRanges(roomIDToRanges, to, limit)
+}
+
+// LatestEventsInRanges returns the latest `limit` events in each room which fall inside that room's
+// inclusive event NID ranges, as returned by VisibleEventNIDsBetween, along with a prev_batch token for the
+// earliest event returned. Ranges must be in ascending order and must not go beyond `to`.
+func (s *Storage) LatestEventsInRanges(roomIDToRanges map[string][][2]int64, to int64, limit int) (map[string][]json.RawMessage, map[string]string, error) {
+	result, prevBatches, _, err := s.LatestEventsInRangesWithLimited(roomIDToRanges, to, limit)
+	return result, prevBatches, err
+}
+
+// LatestEventsInRangesWithLimited is LatestEventsInRanges, but also returns the set of rooms which have more
+// than `limit` events inside their ranges, i.e the rooms whose timelines are limited.
+func (s *Storage) LatestEventsInRangesWithLimited(roomIDToRanges map[string][][2]int64, to int64, limit int) (map[string][]json.RawMessage, map[string]string, map[string]bool, error) {
+	result := make(map[string][]json.RawMessage, len(roomIDToRanges))
+	prevBatches := make(map[string]string, len(roomIDToRanges))
+	limited := make(map[string]bool)
+	err := s.withReadTransaction(to, func(txn *sqlx.Tx) error {
 		for roomID, ranges := range roomIDToRanges {
 			var earliestEventNID int64
 			var roomEvents []json.RawMessage
 			// start at the most recent range as we want to return the most recent `limit` events
-			for i := len(ranges) - 1; i >= 0; i-- {
-				if len(roomEvents) >= limit {
-					break
-				}
+			for i := len(ranges) - 1; i >= 0 && !limited[roomID]; i-- {
 				r := ranges[i]
-				// the most recent event will be first
-				events, err := s.EventsTable.SelectLatestEventsBetween(txn, roomID, r[0]-1, r[1], limit)
+				// the most recent event will be first. Fetch one more than we need, to know if there are
+				// older events which didn't fit.
+				events, err := s.EventsTable.SelectLatestEventsBetween(txn, roomID, r[0]-1, r[1], limit-len(roomEvents)+1)
 				if err != nil {
-					return fmt.Errorf("room %s failed to SelectEventsBetween: %s", roomID, err)
+					return fmt.Errorf("room %s failed to SelectEventsBetween: %w", roomID, err)
 				}
 				// keep pushing to the front so we end up with A,B,C
 				for _, ev := range events {
-					roomEvents = append([]json.RawMessage{ev.JSON}, roomEvents...)
-					earliestEventNID = ev.NID
 					if len(roomEvents) >= limit {
+						limited[roomID] = true
 						break
 					}
+					roomEvents = append([]json.RawMessage{ev.JSON}, roomEvents...)
+					earliestEventNID = ev.NID
 				}
 			}
 			if earliestEventNID != 0 {
 				// the oldest event needs a prev batch token, so find one now
 				prevBatch, err := s.EventsTable.SelectClosestPrevBatch(roomID, earliestEventNID)
 				if err != nil {
-					return fmt.Errorf("failed to select prev_batch for room %s : %s", roomID, err)
+					return fmt.Errorf("failed to select prev_batch for room %s : %w", roomID, err)
 				}
 				prevBatches[roomID] = prevBatch
 			}
@@ -574,7 +790,58 @@ func (s *Storage) LatestEventsInRooms(userID string, roomIDs []string, to int64,
 		}
 		return nil
 	})
-	return result, prevBatches, err
+	return result, prevBatches, limited, err
+}
+
+// EventContext returns the event with this ID along with up to `limit` events either side of it in the
+// room, as visible to this user at position `to`. Events before are returned most recent first, and events
+// after are returned oldest first. Only events within the same visible range as the event are returned.
+// Returns a nil event if the event is unknown or not visible to this user.
+func (s *Storage) EventContext(userID, roomID, eventID string, to int64, limit int) (before []json.RawMessage, event json.RawMessage, after []json.RawMessage, err error) {
+	roomIDToRanges, err := s.visibleEventNIDsBetweenForRooms(userID, []string{roomID}, 0, to)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	err = s.withReadTransaction(to, func(txn *sqlx.Tx) error {
+		events, err := s.EventsTable.SelectByIDs(txn, false, []string{eventID})
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 || events[0].RoomID != roomID {
+			return nil
+		}
+		nid := events[0].NID
+		var visibleRange [2]int64
+		visible := false
+		for _, r := range roomIDToRanges[roomID] {
+			if nid >= r[0] && nid <= r[1] {
+				visibleRange = r
+				visible = true
+				break
+			}
+		}
+		if !visible {
+			return nil
+		}
+		event = events[0].JSON
+		// the most recent event will be first, which matches the order of events_before in /context
+		beforeEvents, err := s.EventsTable.SelectLatestEventsBetween(txn, roomID, visibleRange[0]-1, nid-1, limit)
+		if err != nil {
+			return err
+		}
+		for _, ev := range beforeEvents {
+			before = append(before, ev.JSON)
+		}
+		afterEvents, err := s.EventsTable.SelectEventsBetween(txn, roomID, nid, visibleRange[1], limit)
+		if err != nil {
+			return err
+		}
+		for _, ev := range afterEvents {
+			after = append(after, ev.JSON)
+		}
+		return nil
+	})
+	return
 }
 
 func (s *Storage) visibleEventNIDsBetweenForRooms(userID string, roomIDs []string, from, to int64) (map[string][][2]int64, error) {
@@ -585,18 +852,18 @@ func (s *Storage) visibleEventNIDsBetweenForRooms(userID string, roomIDs []strin
 		// if from==0 then this query will return nothing, so optimise it out
 		membershipEvents, err = s.accumulator.eventsTable.SelectEventsWithTypeStateKeyInRooms(roomIDs, "m.room.member", userID, 0, from)
 		if err != nil {
-			return nil, fmt.Errorf("VisibleEventNIDsBetweenForRooms.SelectEventsWithTypeStateKeyInRooms: %s", err)
+			return nil, fmt.Errorf("VisibleEventNIDsBetweenForRooms.SelectEventsWithTypeStateKeyInRooms: %w", err)
 		}
 	}
 	joinedRoomIDs, err := s.joinedRoomsAfterPositionWithEvents(membershipEvents, userID, from)
 	if err != nil {
-		return nil, fmt.Errorf("failed to work out joined rooms for %s at pos %d: %s", userID, from, err)
+		return nil, fmt.Errorf("failed to work out joined rooms for %s at pos %d: %w", userID, from, err)
 	}
 
 	// load membership deltas for *THESE* rooms for this user
 	membershipEvents, err = s.accumulator.eventsTable.SelectEventsWithTypeStateKeyInRooms(roomIDs, "m.room.member", userID, from, to)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load membership events: %s", err)
+		return nil, fmt.Errorf("failed to load membership events: %w", err)
 	}
 
 	return s.visibleEventNIDsWithData(joinedRoomIDs, membershipEvents, userID, from, to)
@@ -631,13 +898,13 @@ func (s *Storage) VisibleEventNIDsBetween(userID string, from, to int64) (map[st
 	// load *ALL* joined rooms for this user at from (inclusive)
 	joinedRoomIDs, err := s.JoinedRoomsAfterPosition(userID, from)
 	if err != nil {
-		return nil, fmt.Errorf("failed to work out joined rooms for %s at pos %d: %s", userID, from, err)
+		return nil, fmt.Errorf("failed to work out joined rooms for %s at pos %d: %w", userID, from, err)
 	}
 
 	// load *ALL* membership deltas for all rooms for this user
 	membershipEvents, err := s.accumulator.eventsTable.SelectEventsWithTypeStateKey("m.room.member", userID, from, to)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load membership events: %s", err)
+		return nil, fmt.Errorf("failed to load membership events: %w", err)
 	}
 
 	return s.visibleEventNIDsWithData(joinedRoomIDs, membershipEvents, userID, from, to)
@@ -720,16 +987,31 @@ func (s *Storage) visibleEventNIDsWithData(joinedRoomIDs []string, membershipEve
 	return result, nil
 }
 
-func (s *Storage) RoomMembershipDelta(roomID string, from, to int64, limit int) (eventJSON []json.RawMessage, upTo int64, err error) {
-	err = sqlutil.WithTransaction(s.accumulator.db, func(txn *sqlx.Tx) error {
-		nids, err := s.accumulator.eventsTable.SelectEventNIDsWithTypeInRoom(txn, "m.room.member", limit, roomID, from, to)
+// RoomMembershipDelta returns up to `limit` m.room.member events in the room with event positions in the
+// range (fromExcl, toIncl]. `upTo` is the position the caller has caught up to, which is toIncl unless the
+// delta was truncated. If `limited` is true there were more than `limit` membership changes: the caller
+// can call this again from `upTo`, or if the gap is too large it should resync the member list from
+// RoomMembersAtPosition instead of replaying deltas.
+func (s *Storage) RoomMembershipDelta(roomID string, fromExcl, toIncl int64, limit int) (eventJSON []json.RawMessage, upTo int64, limited bool, err error) {
+	upTo = toIncl
+	err = s.withReadTransaction(toIncl, func(txn *sqlx.Tx) error {
+		// fetch one more than we need so we know if there are more events
+		nids, err := s.accumulator.eventsTable.SelectEventNIDsWithTypeInRoom(txn, "m.room.member", limit+1, roomID, fromExcl, toIncl)
 		if err != nil {
 			return err
 		}
+		if len(nids) > limit {
+			limited = true
+			nids = nids[:limit]
+			if limit > 0 {
+				upTo = nids[limit-1]
+			} else {
+				upTo = fromExcl
+			}
+		}
 		if len(nids) == 0 {
 			return nil
 		}
-		upTo = nids[len(nids)-1]
 		events, err := s.accumulator.eventsTable.SelectByNIDs(txn, true, nids)
 		if err != nil {
 			return err
@@ -743,26 +1025,171 @@ func (s *Storage) RoomMembershipDelta(roomID string, from, to int64, limit int)
 	return
 }
 
-func (s *Storage) AllJoinedMembers(txn *sqlx.Tx) (result map[string][]string, metadata map[string]internal.RoomMetadata, err error) {
-	rows, err := txn.Query(
-		`SELECT room_id, state_key from syncv3_events WHERE (membership='join' OR membership='_join') AND event_nid IN (
-			SELECT UNNEST(membership_events) FROM syncv3_snapshots JOIN syncv3_rooms ON syncv3_snapshots.snapshot_id = syncv3_rooms.current_snapshot_id
-		) ORDER BY event_nid ASC`,
-	)
+// MemberPage is a page of m.room.member state events, sorted by state key.
+type MemberPage struct {
+	Members []Event
+	// The page token for the following page, or nil if this is the last page. Requesting a page again with
+	// the same token returns the same page, including the last page, so clients can safely retry.
+	Next *string
+	// The number of members across all pages.
+	Total int
+}
+
+// newMemberPage makes a page from the sorted members after the page token `from`. The page token is the
+// state key of the last member on the previous page.
+func newMemberPage(sorted []Event, from string, limit int) MemberPage {
+	start := sort.Search(len(sorted), func(i int) bool {
+		return sorted[i].StateKey > from
+	})
+	end := start + limit
+	if limit <= 0 || end >= len(sorted) {
+		return MemberPage{Members: sorted[start:], Total: len(sorted)}
+	}
+	next := sorted[end-1].StateKey
+	return MemberPage{Members: sorted[start:end], Next: &next, Total: len(sorted)}
+}
+
+// RoomMembersAtPosition returns a page of the m.room.member state events in the room after the event
+// position `pos`. `from` is the page token returned by a previous call, or "" for the first page. A limit <= 0
+// returns all remaining members. Pages are pinned to `pos`, so paginating is stable even if a later state
+// reset rewrites the room's member state: callers which want the latest members must restart from a newer pos.
+func (s *Storage) RoomMembersAtPosition(ctx context.Context, roomID string, pos int64, from string, limit int) (MemberPage, error) {
+	all, err := s.RoomStateAt(ctx, roomID, pos, map[string][]string{"m.room.member": nil})
 	if err != nil {
-		return nil, nil, err
+		return MemberPage{}, err
 	}
-	defer rows.Close()
-	result = make(map[string][]string)
-	var roomID string
-	var joinedUserID string
-	for rows.Next() {
-		if err := rows.Scan(&roomID, &joinedUserID); err != nil {
-			return nil, nil, err
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].StateKey < all[j].StateKey
+	})
+	return newMemberPage(all, from, limit), nil
+}
+
+// MemberPowerLevels returns the power level of each of these users in the room after the event position
+// `pos`. Use the same position as RoomMembersAtPosition so member pages and their power levels match.
+func (s *Storage) MemberPowerLevels(ctx context.Context, roomID string, pos int64, userIDs []string) (map[string]int64, error) {
+	events, err := s.RoomStateAt(ctx, roomID, pos, map[string][]string{
+		"m.room.create":       {""},
+		"m.room.power_levels": {""},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var powerLevels gjson.Result
+	var creator string
+	for _, ev := range events {
+		switch ev.Type {
+		case "m.room.create":
+			creator = gjson.GetBytes(ev.JSON, "sender").Str
+		case "m.room.power_levels":
+			powerLevels = gjson.ParseBytes(ev.JSON)
+		}
+	}
+	result := make(map[string]int64, len(userIDs))
+	for _, userID := range userIDs {
+		result[userID] = internal.UserPowerLevel(powerLevels, creator, userID)
+	}
+	return result, nil
+}
+
+// FilterRoomMember filters the members returned by CurrentRoomMembers.
+type FilterRoomMember struct {
+	// Only return members with one of these memberships e.g ["join", "invite"]. Empty means all memberships.
+	Memberships []string
+	// Only return members whose display name or user ID contains this string, case-insensitively.
+	// Empty means all members.
+	NameLike string
+}
+
+// escapeLike escapes the wildcard characters in s so it can be matched literally by LIKE.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// CurrentRoomMembers returns a page of the current m.room.member state events in the room which match the
+// filter. Filtering and pagination is done in the database so large rooms do not need to be loaded into
+// memory. `from` is a page token and a limit <= 0 returns all remaining members, as with RoomMembersAtPosition.
+func (s *Storage) CurrentRoomMembers(roomID string, filter FilterRoomMember, from string, limit int) (page MemberPage, err error) {
+	// encrypted events cannot be inspected by the database, so match display names after decrypting them.
+	// This means loading every member to count them, so we may as well paginate in memory too.
+	matchNamesAfterDecrypt := filter.NameLike != "" && s.accumulator.eventsTable.aead != nil
+	err = sqlutil.WithTransaction(s.accumulator.db, func(txn *sqlx.Tx) error {
+		snapID, err := s.accumulator.roomsTable.CurrentAfterSnapshotID(txn, roomID)
+		if err != nil {
+			return err
 		}
-		users := result[roomID]
-		users = append(users, joinedUserID)
-		result[roomID] = users
+		where := `event_nid IN (SELECT unnest(membership_events) FROM syncv3_snapshots WHERE snapshot_id = $1)`
+		args := []interface{}{snapID}
+		if len(filter.Memberships) > 0 {
+			// profile changes are stored with a leading underscore e.g _join
+			memberships := make([]string, 0, 2*len(filter.Memberships))
+			for _, m := range filter.Memberships {
+				memberships = append(memberships, m, "_"+m)
+			}
+			args = append(args, pq.StringArray(memberships))
+			where += fmt.Sprintf(" AND membership = ANY($%d)", len(args))
+		}
+		if filter.NameLike != "" && !matchNamesAfterDecrypt {
+			args = append(args, "%"+escapeLike(filter.NameLike)+"%")
+			where += fmt.Sprintf(
+				` AND (state_key ILIKE $%d OR convert_from(event, 'UTF8')::jsonb->'content'->>'displayname' ILIKE $%d)`,
+				len(args), len(args),
+			)
+		}
+		if !matchNamesAfterDecrypt {
+			if err = txn.QueryRow(`SELECT count(*) FROM syncv3_events WHERE `+where, args...).Scan(&page.Total); err != nil {
+				return err
+			}
+			args = append(args, from)
+			where += fmt.Sprintf(" AND state_key > $%d", len(args))
+		}
+		query := `SELECT event_nid, room_id, event_type, state_key, event FROM syncv3_events WHERE ` + where + ` ORDER BY state_key ASC`
+		if limit > 0 && !matchNamesAfterDecrypt {
+			// fetch one more than we need to know if there is another page
+			args = append(args, limit+1)
+			query += fmt.Sprintf(" LIMIT $%d", len(args))
+		}
+		rows, err := txn.Query(query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var ev Event
+			if err := rows.Scan(&ev.NID, &ev.RoomID, &ev.Type, &ev.StateKey, &ev.JSON); err != nil {
+				return err
+			}
+			if ev.JSON, err = s.accumulator.eventsTable.decryptJSON(ev.JSON); err != nil {
+				return err
+			}
+			if matchNamesAfterDecrypt {
+				nameLike := strings.ToLower(filter.NameLike)
+				displayName := gjson.GetBytes(ev.JSON, "content.displayname").Str
+				if !strings.Contains(strings.ToLower(ev.StateKey), nameLike) && !strings.Contains(strings.ToLower(displayName), nameLike) {
+					continue
+				}
+			}
+			page.Members = append(page.Members, ev)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return MemberPage{}, err
+	}
+	if matchNamesAfterDecrypt {
+		return newMemberPage(page.Members, from, limit), nil
+	}
+	if limit > 0 && len(page.Members) > limit {
+		page.Members = page.Members[:limit]
+		next := page.Members[limit-1].StateKey
+		page.Next = &next
+	}
+	return page, nil
+}
+
+func (s *Storage) AllJoinedMembers(txn *sqlx.Tx) (result map[string][]string, metadata map[string]internal.RoomMetadata, err error) {
+	result, err = s.currentMembers(txn, nil, "join", "_join")
+	if err != nil {
+		return nil, nil, err
 	}
 	metadata = make(map[string]internal.RoomMetadata)
 	for roomID, joinedMembers := range result {
@@ -773,15 +1200,176 @@ func (s *Storage) AllJoinedMembers(txn *sqlx.Tx) (result map[string][]string, me
 	return result, metadata, nil
 }
 
+// RoomVersionInfo is the version of a room and how many members it has, so admins planning room upgrades
+// can see how many users each upgrade would affect.
+type RoomVersionInfo struct {
+	RoomID string `json:"room_id"`
+	// from the create event, or internal.DefaultRoomVersion if it was not specified
+	RoomVersion    string  `json:"room_version"`
+	JoinCount      int     `json:"joined_count"`
+	InviteCount    int     `json:"invited_count"`
+	UpgradedRoomID *string `json:"upgraded_room_id,omitempty"`
+}
+
+// RoomVersions returns the version and current member counts of every room with a create event. Reads
+// every room, so should only be used by the admin API.
+func (s *Storage) RoomVersions() (infos []RoomVersionInfo, err error) {
+	err = sqlutil.WithTransaction(s.accumulator.db, func(txn *sqlx.Tx) error {
+		createEvents, err := s.accumulator.eventsTable.selectCreateEvents(txn)
+		if err != nil {
+			return fmt.Errorf("failed to select create events: %w", err)
+		}
+		roomIDToInfo := make(map[string]*RoomVersionInfo, len(createEvents))
+		infos = make([]RoomVersionInfo, len(createEvents))
+		for i, ev := range createEvents {
+			infos[i].RoomID = ev.RoomID
+			infos[i].RoomVersion = gjson.GetBytes(ev.JSON, "content.room_version").Str
+			if infos[i].RoomVersion == "" {
+				infos[i].RoomVersion = internal.DefaultRoomVersion
+			}
+			roomIDToInfo[ev.RoomID] = &infos[i]
+		}
+		rows, err := txn.Query(
+			`SELECT room_id, membership, count(state_key) FROM syncv3_events WHERE membership = ANY($1) AND event_nid IN (
+				SELECT UNNEST(membership_events) FROM syncv3_snapshots JOIN syncv3_rooms ON syncv3_snapshots.snapshot_id = syncv3_rooms.current_snapshot_id
+			) GROUP BY room_id, membership`, pq.StringArray{"join", "_join", "invite", "_invite"},
+		)
+		if err != nil {
+			return fmt.Errorf("failed to count members: %w", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var roomID, membership string
+			var count int
+			if err := rows.Scan(&roomID, &membership, &count); err != nil {
+				return err
+			}
+			info := roomIDToInfo[roomID]
+			if info == nil {
+				continue
+			}
+			if membership == "join" || membership == "_join" {
+				info.JoinCount += count
+			} else {
+				info.InviteCount += count
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		roomInfos, err := s.accumulator.roomsTable.SelectRoomInfos(txn)
+		if err != nil {
+			return fmt.Errorf("failed to select room infos: %w", err)
+		}
+		for _, roomInfo := range roomInfos {
+			if info := roomIDToInfo[roomInfo.ID]; info != nil {
+				info.UpgradedRoomID = roomInfo.UpgradedRoomID
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// CurrentMembers returns the users who are currently joined to and invited to the room, in the order
+// they got that membership.
+func (s *Storage) CurrentMembers(roomID string) (joined, invited []string, err error) {
+	err = sqlutil.WithTransaction(s.accumulator.db, func(txn *sqlx.Tx) error {
+		joinedMembers, err := s.currentMembers(txn, []string{roomID}, "join", "_join")
+		if err != nil {
+			return err
+		}
+		invitedMembers, err := s.currentMembers(txn, []string{roomID}, "invite", "_invite")
+		if err != nil {
+			return err
+		}
+		joined = joinedMembers[roomID]
+		invited = invitedMembers[roomID]
+		return nil
+	})
+	return
+}
+
+// currentMembers returns room ID -> user IDs with one of the given memberships in the current state of the
+// given rooms, or of all rooms if roomIDs is nil. User IDs are ordered by event NID.
+func (s *Storage) currentMembers(txn *sqlx.Tx, roomIDs []string, memberships ...string) (map[string][]string, error) {
+	rows, err := txn.Query(
+		`SELECT room_id, state_key from syncv3_events WHERE membership = ANY($2) AND event_nid IN (
+			SELECT UNNEST(membership_events) FROM syncv3_snapshots JOIN syncv3_rooms ON syncv3_snapshots.snapshot_id = syncv3_rooms.current_snapshot_id
+			WHERE $1::text[] IS NULL OR syncv3_rooms.room_id = ANY($1)
+		) ORDER BY event_nid ASC`, pq.StringArray(roomIDs), pq.StringArray(memberships),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string][]string)
+	var roomID string
+	var userID string
+	for rows.Next() {
+		if err := rows.Scan(&roomID, &userID); err != nil {
+			return nil, err
+		}
+		result[roomID] = append(result[roomID], userID)
+	}
+	return result, rows.Err()
+}
+
 func (s *Storage) JoinedRoomsAfterPosition(userID string, pos int64) ([]string, error) {
 	// fetch all the membership events up to and including pos
 	membershipEvents, err := s.accumulator.eventsTable.SelectEventsWithTypeStateKey("m.room.member", userID, 0, pos)
 	if err != nil {
-		return nil, fmt.Errorf("JoinedRoomsAfterPosition.SelectEventsWithTypeStateKey: %s", err)
+		return nil, fmt.Errorf("JoinedRoomsAfterPosition.SelectEventsWithTypeStateKey: %w", err)
 	}
 	return s.joinedRoomsAfterPositionWithEvents(membershipEvents, userID, pos)
 }
 
+// UsersShareJoinedRoom returns true if both users are currently joined to at least one room.
+func (s *Storage) UsersShareJoinedRoom(userID, otherUserID string) (bool, error) {
+	pos, err := s.LatestEventNID()
+	if err != nil {
+		return false, err
+	}
+	rooms, err := s.JoinedRoomsAfterPosition(userID, pos)
+	if err != nil {
+		return false, err
+	}
+	otherRooms, err := s.JoinedRoomsAfterPosition(otherUserID, pos)
+	if err != nil {
+		return false, err
+	}
+	roomSet := make(map[string]struct{}, len(rooms))
+	for _, roomID := range rooms {
+		roomSet[roomID] = struct{}{}
+	}
+	for _, roomID := range otherRooms {
+		if _, ok := roomSet[roomID]; ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// JoinTimestampsAfterPosition returns the origin_server_ts of the user's join event for each room they
+// are joined to at this position. Profile changes do not count as joins.
+func (s *Storage) JoinTimestampsAfterPosition(userID string, pos int64) (map[string]int64, error) {
+	membershipEvents, err := s.accumulator.eventsTable.SelectEventsWithTypeStateKey("m.room.member", userID, 0, pos)
+	if err != nil {
+		return nil, fmt.Errorf("JoinTimestampsAfterPosition.SelectEventsWithTypeStateKey: %w", err)
+	}
+	joinedAt := make(map[string]int64)
+	for _, ev := range membershipEvents {
+		if gjson.GetBytes(ev.JSON, "content.membership").Str != "join" {
+			delete(joinedAt, ev.RoomID)
+			continue
+		}
+		if _, ok := joinedAt[ev.RoomID]; !ok {
+			joinedAt[ev.RoomID] = gjson.GetBytes(ev.JSON, "origin_server_ts").Int()
+		}
+	}
+	return joinedAt, nil
+}
+
 func (s *Storage) joinedRoomsAfterPositionWithEvents(membershipEvents []Event, userID string, pos int64) ([]string, error) {
 	joinedRoomsSet := make(map[string]bool)
 	for _, ev := range membershipEvents {
@@ -812,4 +1400,9 @@ func (s *Storage) Teardown() {
 	if err != nil {
 		panic("Storage.Teardown: " + err.Error())
 	}
+	if s.replica != nil {
+		if err = s.replica.db.Close(); err != nil {
+			panic("Storage.Teardown: " + err.Error())
+		}
+	}
 }
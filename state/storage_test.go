@@ -112,6 +112,94 @@ func TestStorageRoomStateBeforeAndAfterEventPosition(t *testing.T) {
 	}
 }
 
+// Tests that state for many rooms is loaded in one go, with each room's events kept separate and in order.
+func TestStorageRoomStateAfterEventPositionManyRooms(t *testing.T) {
+	ctx := context.Background()
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	alice := "@alice:localhost"
+	roomToEvents := map[string][]json.RawMessage{
+		"!TestStorageRoomStateAfterEventPositionManyRooms_a:localhost": {
+			testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+			testutils.NewJoinEvent(t, alice),
+		},
+		"!TestStorageRoomStateAfterEventPositionManyRooms_b:localhost": {
+			testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+			testutils.NewJoinEvent(t, alice),
+			testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "B"}),
+		},
+	}
+	var roomIDs []string
+	for roomID, events := range roomToEvents {
+		if _, _, err := store.Accumulate(roomID, "", events); err != nil {
+			t.Fatalf("Accumulate returned error: %s", err)
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	pos, err := store.LatestEventNID()
+	if err != nil {
+		t.Fatalf("LatestEventNID: %s", err)
+	}
+	got, err := store.RoomStateAfterEventPosition(ctx, roomIDs, pos, nil)
+	if err != nil {
+		t.Fatalf("RoomStateAfterEventPosition: %s", err)
+	}
+	for roomID, wantEvents := range roomToEvents {
+		if len(got[roomID]) != len(wantEvents) {
+			t.Errorf("%s: got %d events want %d", roomID, len(got[roomID]), len(wantEvents))
+			continue
+		}
+		for i := range wantEvents {
+			if !bytes.Equal(got[roomID][i].JSON, wantEvents[i]) {
+				t.Errorf("%s: pos %d\ngot  %s\nwant %s", roomID, i, got[roomID][i].JSON, wantEvents[i])
+			}
+		}
+	}
+}
+
+// Tests that filtered state only includes the room's latest event once, and only if it is state.
+func TestStorageRoomStateAt(t *testing.T) {
+	ctx := context.Background()
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestStorageRoomStateAt:localhost"
+	alice := "@alice:localhost"
+	stateEvents := []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+		testutils.NewStateEvent(t, "m.room.join_rules", "", alice, map[string]interface{}{"join_rule": "invite"}),
+	}
+	if _, err := store.Initialise(roomID, stateEvents); err != nil {
+		t.Fatalf("Initialise: %s", err)
+	}
+	pos, err := store.LatestEventNID()
+	if err != nil {
+		t.Fatalf("LatestEventNID: %s", err)
+	}
+	// the join rules are the latest event, and are part of the current snapshot as they came from a state block
+	got, err := store.RoomStateAt(ctx, roomID, pos, map[string][]string{"m.room.join_rules": nil})
+	if err != nil {
+		t.Fatalf("RoomStateAt: %s", err)
+	}
+	if len(got) != 1 || !bytes.Equal(got[0].JSON, stateEvents[2]) {
+		t.Errorf("RoomStateAt: got %+v want only the join rules", got)
+	}
+
+	// a message is the latest event, and is not state
+	message := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "hello"})
+	_, latestNIDs, err := store.Accumulate(roomID, "", []json.RawMessage{message})
+	if err != nil {
+		t.Fatalf("Accumulate: %s", err)
+	}
+	got, err = store.RoomStateAt(ctx, roomID, latestNIDs[0], map[string][]string{"m.room.message": nil, "m.room.create": nil})
+	if err != nil {
+		t.Fatalf("RoomStateAt: %s", err)
+	}
+	if len(got) != 1 || !bytes.Equal(got[0].JSON, stateEvents[0]) {
+		t.Errorf("RoomStateAt: got %+v want only the create event", got)
+	}
+}
+
 func TestStorageJoinedRoomsAfterPosition(t *testing.T) {
 	store := NewStorage(postgresConnectionString)
 	defer store.Teardown()
@@ -175,9 +263,9 @@ func TestStorageJoinedRoomsAfterPosition(t *testing.T) {
 		t.Fatalf("JoinedRoomsAfterPosition for %s got %v rooms want %v", bob, len(bobJoinedRooms), 3)
 	}
 
-	// also test currentNotMembershipStateEventsInAllRooms
+	// also test currentNotMembershipStateEventsInRooms
 	txn := store.DB.MustBeginTx(context.Background(), nil)
-	roomIDToCreateEvents, err := store.currentNotMembershipStateEventsInAllRooms(txn, []string{"m.room.create"})
+	roomIDToCreateEvents, err := store.currentNotMembershipStateEventsInRooms(txn, []string{"m.room.create"}, nil)
 	if err != nil {
 		t.Fatalf("CurrentStateEventsInAllRooms returned error: %s", err)
 	}
@@ -243,6 +331,22 @@ func TestStorageJoinedRoomsAfterPosition(t *testing.T) {
 			t.Errorf("hero info for %s got %d joined users, want %d", roomID, gotHI.JoinCount, wantHI.JoinCount)
 		}
 	}
+
+	// loading a subset of rooms should give the same metadata as loading all rooms
+	someMetadata, err := store.MetadataForRooms([]string{invitedRoomID, bobJoinedRoomID, "!unknown:localhost"})
+	if err != nil {
+		t.Fatalf("MetadataForRooms: %s", err)
+	}
+	if len(someMetadata) != 2 {
+		t.Errorf("MetadataForRooms: got %d rooms want 2", len(someMetadata))
+	}
+	for _, roomID := range []string{invitedRoomID, bobJoinedRoomID} {
+		got, want := someMetadata[roomID], roomIDToMetadata[roomID]
+		if got.RoomID != roomID || got.JoinCount != want.JoinCount || got.InviteCount != want.InviteCount ||
+			got.LastMessageTimestamp != want.LastMessageTimestamp || got.NameEvent != want.NameEvent || len(got.Heroes) != len(want.Heroes) {
+			t.Errorf("MetadataForRooms: got %+v want %+v", got, want)
+		}
+	}
 }
 
 // Test the examples on VisibleEventNIDsBetween docs
@@ -586,6 +690,7 @@ func TestGlobalSnapshot(t *testing.T) {
 			testutils.NewStateEvent(t, "m.room.create", "", bob, map[string]interface{}{"creator": bob, "type": roomType}),
 			testutils.NewJoinEvent(t, bob),
 			testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "My Room"}),
+			testutils.NewStateEvent(t, "m.room.avatar", "", alice, map[string]interface{}{"url": "mxc://x/avatar"}),
 		},
 		roomAliceBob: {
 			testutils.NewStateEvent(t, "m.room.create", "", bob, map[string]interface{}{"creator": bob}),
@@ -630,6 +735,16 @@ func TestGlobalSnapshot(t *testing.T) {
 	if !reflect.DeepEqual(snapshot.AllJoinedMembers, wantJoinedMembers) {
 		t.Errorf("Snapshot.AllJoinedMembers:\ngot:  %+v\nwant: %+v", snapshot.AllJoinedMembers, wantJoinedMembers)
 	}
+	wantInvitedMembers := map[string][]string{
+		roomSpace: {alice},
+	}
+	if !reflect.DeepEqual(snapshot.AllInvitedMembers, wantInvitedMembers) {
+		t.Errorf("Snapshot.AllInvitedMembers:\ngot:  %+v\nwant: %+v", snapshot.AllInvitedMembers, wantInvitedMembers)
+	}
+	joined, invited, err := store.CurrentMembers(roomSpace)
+	assertNoError(t, err)
+	assertValue(t, "CurrentMembers joined", joined, []string{bob})
+	assertValue(t, "CurrentMembers invited", invited, []string{alice})
 	wantMetadata := map[string]internal.RoomMetadata{
 		roomAlice: {
 			RoomID:               roomAlice,
@@ -645,6 +760,7 @@ func TestGlobalSnapshot(t *testing.T) {
 			LastMessageTimestamp: gjson.ParseBytes(roomIDToEventMap[roomBob][len(roomIDToEventMap[roomBob])-1]).Get("origin_server_ts").Uint(),
 			Heroes:               []internal.Hero{{ID: bob}},
 			NameEvent:            "My Room",
+			AvatarEvent:          "mxc://x/avatar",
 			RoomType:             &roomType,
 		},
 		roomAliceBob: {
@@ -674,6 +790,7 @@ func TestGlobalSnapshot(t *testing.T) {
 
 func assertRoomMetadata(t *testing.T, got, want internal.RoomMetadata) {
 	t.Helper()
+	assertValue(t, "AvatarEvent", got.AvatarEvent, want.AvatarEvent)
 	assertValue(t, "CanonicalAlias", got.CanonicalAlias, want.CanonicalAlias)
 	assertValue(t, "ChildSpaceRooms", got.ChildSpaceRooms, want.ChildSpaceRooms)
 	assertValue(t, "Encrypted", got.Encrypted, want.Encrypted)
@@ -717,3 +834,584 @@ func verifyRange(t *testing.T, result map[string][][2]int64, roomID string, want
 		}
 	}
 }
+
+func TestStorageLatestEventsInRoomsBetween(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestStorageLatestEventsInRoomsBetween:localhost"
+	alice := "@alice_TestStorageLatestEventsInRoomsBetween:localhost"
+	_, err := store.Initialise(roomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+	})
+	if err != nil {
+		t.Fatalf("failed to initialise: %s", err)
+	}
+	timeline := []json.RawMessage{
+		testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "1"}),
+		testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "2"}),
+		testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "3"}),
+	}
+	_, timelineNIDs, err := store.Accumulate(roomID, "", timeline)
+	if err != nil {
+		t.Fatalf("failed to accumulate: %s", err)
+	}
+	to := timelineNIDs[len(timelineNIDs)-1]
+
+	// from is inclusive
+	got, _, err := store.LatestEventsInRoomsBetween(alice, []string{roomID}, timelineNIDs[1], to, 10)
+	if err != nil {
+		t.Fatalf("LatestEventsInRoomsBetween: %s", err)
+	}
+	if len(got[roomID]) != 2 {
+		t.Fatalf("LatestEventsInRoomsBetween: got %d events want 2", len(got[roomID]))
+	}
+	for i, ev := range got[roomID] {
+		gotID := gjson.GetBytes(ev, "event_id").Str
+		wantID := gjson.GetBytes(timeline[i+1], "event_id").Str
+		if gotID != wantID {
+			t.Errorf("LatestEventsInRoomsBetween: event %d got %s want %s", i, gotID, wantID)
+		}
+	}
+
+	// nothing after the latest event
+	got, _, err = store.LatestEventsInRoomsBetween(alice, []string{roomID}, to+1, to, 10)
+	if err != nil {
+		t.Fatalf("LatestEventsInRoomsBetween: %s", err)
+	}
+	if len(got[roomID]) != 0 {
+		t.Fatalf("LatestEventsInRoomsBetween: got %d events after the latest event, want 0", len(got[roomID]))
+	}
+
+	// events after alice leaves are not returned, but her leave event is
+	bob := "@bob_TestStorageLatestEventsInRoomsBetween:localhost"
+	afterLeave := []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.member", alice, alice, map[string]interface{}{"membership": "leave"}),
+		testutils.NewEvent(t, "m.room.message", bob, map[string]interface{}{"body": "4"}),
+	}
+	_, afterLeaveNIDs, err := store.Accumulate(roomID, "", afterLeave)
+	if err != nil {
+		t.Fatalf("failed to accumulate: %s", err)
+	}
+	ranges, err := store.VisibleEventNIDsBetween(alice, timelineNIDs[2], afterLeaveNIDs[1])
+	if err != nil {
+		t.Fatalf("VisibleEventNIDsBetween: %s", err)
+	}
+	got, _, err = store.LatestEventsInRanges(ranges, afterLeaveNIDs[1], 10)
+	if err != nil {
+		t.Fatalf("LatestEventsInRanges: %s", err)
+	}
+	wantIDs := []string{gjson.GetBytes(timeline[2], "event_id").Str, gjson.GetBytes(afterLeave[0], "event_id").Str}
+	if len(got[roomID]) != len(wantIDs) {
+		t.Fatalf("LatestEventsInRanges: got %d events want %d", len(got[roomID]), len(wantIDs))
+	}
+	for i, ev := range got[roomID] {
+		if gotID := gjson.GetBytes(ev, "event_id").Str; gotID != wantIDs[i] {
+			t.Errorf("LatestEventsInRanges: event %d got %s want %s", i, gotID, wantIDs[i])
+		}
+	}
+
+	// the timeline is only limited if there are more visible events than the limit
+	_, _, limited, err := store.LatestEventsInRangesWithLimited(ranges, afterLeaveNIDs[1], len(wantIDs))
+	if err != nil {
+		t.Fatalf("LatestEventsInRangesWithLimited: %s", err)
+	}
+	if limited[roomID] {
+		t.Errorf("LatestEventsInRangesWithLimited: room is limited with a limit of %d, want not limited", len(wantIDs))
+	}
+	got, _, limited, err = store.LatestEventsInRangesWithLimited(ranges, afterLeaveNIDs[1], len(wantIDs)-1)
+	if err != nil {
+		t.Fatalf("LatestEventsInRangesWithLimited: %s", err)
+	}
+	if !limited[roomID] {
+		t.Errorf("LatestEventsInRangesWithLimited: room is not limited with a limit of %d, want limited", len(wantIDs)-1)
+	}
+	if len(got[roomID]) != len(wantIDs)-1 {
+		t.Fatalf("LatestEventsInRangesWithLimited: got %d events want %d", len(got[roomID]), len(wantIDs)-1)
+	}
+}
+
+func TestStorageRoomMembersAtPosition(t *testing.T) {
+	ctx := context.Background()
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestStorageRoomMembersAtPosition:localhost"
+	alice := "@alice_TestStorageRoomMembersAtPosition:localhost"
+	bob := "@bob_TestStorageRoomMembersAtPosition:localhost"
+	charlie := "@charlie_TestStorageRoomMembersAtPosition:localhost"
+	_, nids, err := store.Accumulate(roomID, "", []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+		testutils.NewJoinEvent(t, charlie),
+		testutils.NewJoinEvent(t, bob),
+	})
+	if err != nil {
+		t.Fatalf("Accumulate returned error: %s", err)
+	}
+	latest := nids[len(nids)-1]
+
+	var got []string
+	from := ""
+	for i := 0; i < 3; i++ {
+		page, err := store.RoomMembersAtPosition(ctx, roomID, latest, from, 2)
+		if err != nil {
+			t.Fatalf("RoomMembersAtPosition: %s", err)
+		}
+		if page.Total != 3 {
+			t.Errorf("RoomMembersAtPosition: got total %d want 3", page.Total)
+		}
+		for _, m := range page.Members {
+			got = append(got, m.StateKey)
+		}
+		if page.Next == nil {
+			break
+		}
+		from = *page.Next
+	}
+	want := []string{alice, bob, charlie}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("RoomMembersAtPosition: got %v want %v", got, want)
+	}
+
+	// requesting the last page again returns the same page
+	page, err := store.RoomMembersAtPosition(ctx, roomID, latest, from, 2)
+	if err != nil {
+		t.Fatalf("RoomMembersAtPosition: %s", err)
+	}
+	if len(page.Members) != 1 || page.Members[0].StateKey != charlie || page.Next != nil {
+		t.Fatalf("RoomMembersAtPosition: got %+v when re-requesting the last page, want only charlie", page)
+	}
+
+	// bob had not joined yet at an earlier position
+	page, err = store.RoomMembersAtPosition(ctx, roomID, nids[2], "", 0)
+	if err != nil {
+		t.Fatalf("RoomMembersAtPosition: %s", err)
+	}
+	if len(page.Members) != 2 || page.Next != nil || page.Total != 2 {
+		t.Fatalf("RoomMembersAtPosition: got %+v at earlier position, want 2 members and no next page", page)
+	}
+}
+
+func TestStorageMemberPowerLevels(t *testing.T) {
+	ctx := context.Background()
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestStorageMemberPowerLevels:localhost"
+	alice := "@alice_TestStorageMemberPowerLevels:localhost"
+	bob := "@bob_TestStorageMemberPowerLevels:localhost"
+	_, nids, err := store.Accumulate(roomID, "", []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+		testutils.NewJoinEvent(t, bob),
+		testutils.NewStateEvent(t, "m.room.power_levels", "", alice, map[string]interface{}{
+			"users": map[string]interface{}{alice: 100, bob: 50},
+		}),
+	})
+	if err != nil {
+		t.Fatalf("Accumulate returned error: %s", err)
+	}
+
+	testCases := []struct {
+		name string
+		pos  int64
+		want map[string]int64
+	}{
+		{name: "before power levels", pos: nids[2], want: map[string]int64{alice: 100, bob: 0}},
+		{name: "after power levels", pos: nids[3], want: map[string]int64{alice: 100, bob: 50}},
+	}
+	for _, tc := range testCases {
+		got, err := store.MemberPowerLevels(ctx, roomID, tc.pos, []string{alice, bob})
+		if err != nil {
+			t.Fatalf("%s: MemberPowerLevels: %s", tc.name, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: MemberPowerLevels: got %v want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestStorageRoomMembershipDelta(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestStorageRoomMembershipDelta:localhost"
+	alice := "@alice_TestStorageRoomMembershipDelta:localhost"
+	bob := "@bob_TestStorageRoomMembershipDelta:localhost"
+	charlie := "@charlie_TestStorageRoomMembershipDelta:localhost"
+	_, nids, err := store.Accumulate(roomID, "", []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+		testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "hi"}),
+		testutils.NewJoinEvent(t, bob),
+		testutils.NewJoinEvent(t, charlie),
+	})
+	if err != nil {
+		t.Fatalf("Accumulate returned error: %s", err)
+	}
+	latest := nids[len(nids)-1]
+
+	// everything after alice's join fits
+	events, upTo, limited, err := store.RoomMembershipDelta(roomID, nids[1], latest, 10)
+	if err != nil {
+		t.Fatalf("RoomMembershipDelta: %s", err)
+	}
+	if len(events) != 2 || limited || upTo != latest {
+		t.Fatalf("RoomMembershipDelta: got %d events limited=%v upTo=%d, want 2 events, not limited, upTo=%d", len(events), limited, upTo, latest)
+	}
+
+	// truncated delta
+	events, upTo, limited, err = store.RoomMembershipDelta(roomID, 0, latest, 2)
+	if err != nil {
+		t.Fatalf("RoomMembershipDelta: %s", err)
+	}
+	if len(events) != 2 || !limited || upTo != nids[3] {
+		t.Fatalf("RoomMembershipDelta: got %d events limited=%v upTo=%d, want 2 events, limited, upTo=%d", len(events), limited, upTo, nids[3])
+	}
+	if gjson.GetBytes(events[1], "state_key").Str != bob {
+		t.Fatalf("RoomMembershipDelta: wrong events returned: %v", events)
+	}
+}
+
+func TestStorageDeleteUserData(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	alice := "@alice_TestStorageDeleteUserData:localhost"
+	bob := "@bob_TestStorageDeleteUserData:localhost"
+	roomID := "!TestStorageDeleteUserData:localhost"
+	one := 1
+	for _, userID := range []string{alice, bob} {
+		if err := store.UnreadTable.UpdateUnreadCounters(userID, roomID, &one, &one); err != nil {
+			t.Fatalf("UpdateUnreadCounters: %s", err)
+		}
+		if _, err := store.InsertAccountData(userID, map[string][]json.RawMessage{
+			roomID: {json.RawMessage(`{"type":"m.tag","content":{"tags":{}}}`)},
+		}); err != nil {
+			t.Fatalf("InsertAccountData: %s", err)
+		}
+		if err := store.InvitesTable.InsertInvite(userID, roomID, []json.RawMessage{
+			testutils.NewStateEvent(t, "m.room.member", userID, bob, map[string]interface{}{"membership": "invite"}),
+		}); err != nil {
+			t.Fatalf("InsertInvite: %s", err)
+		}
+	}
+	if err := store.DeleteUserData(alice); err != nil {
+		t.Fatalf("DeleteUserData: %s", err)
+	}
+	for _, tc := range []struct {
+		userID  string
+		wantLen int
+	}{{alice, 0}, {bob, 1}} {
+		numUnread := 0
+		err := store.UnreadTable.SelectAllNonZeroCountsForUser(tc.userID, func(roomID string, highlightCount, notificationCount int) {
+			numUnread++
+		})
+		if err != nil {
+			t.Fatalf("SelectAllNonZeroCountsForUser: %s", err)
+		}
+		if numUnread != tc.wantLen {
+			t.Errorf("%s: got %d unread counts want %d", tc.userID, numUnread, tc.wantLen)
+		}
+		datas, err := store.AccountDatas(tc.userID, roomID)
+		if err != nil {
+			t.Fatalf("AccountDatas: %s", err)
+		}
+		if len(datas) != tc.wantLen {
+			t.Errorf("%s: got %d account data events want %d", tc.userID, len(datas), tc.wantLen)
+		}
+		invites, err := store.InvitesTable.SelectAllInvitesForUser(tc.userID)
+		if err != nil {
+			t.Fatalf("SelectAllInvitesForUser: %s", err)
+		}
+		if len(invites) != tc.wantLen {
+			t.Errorf("%s: got %d invites want %d", tc.userID, len(invites), tc.wantLen)
+		}
+	}
+}
+
+func TestStorageJoinTimestampsAfterPosition(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	alice := "@alice_TestStorageJoinTimestampsAfterPosition:localhost"
+	joinedRoomID := "!joined_TestStorageJoinTimestampsAfterPosition:localhost"
+	leftRoomID := "!left_TestStorageJoinTimestampsAfterPosition:localhost"
+	joinTime := time.UnixMilli(1000)
+	_, nids, err := store.Accumulate(joinedRoomID, "", []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice, testutils.WithTimestamp(joinTime)),
+		// a profile change is not a join
+		testutils.NewStateEvent(t, "m.room.member", alice, alice, map[string]interface{}{
+			"membership":  "join",
+			"displayname": "Alice",
+		}, testutils.WithTimestamp(joinTime.Add(time.Second))),
+	})
+	if err != nil {
+		t.Fatalf("Accumulate: %s", err)
+	}
+	_, leftNIDs, err := store.Accumulate(leftRoomID, "", []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+		testutils.NewStateEvent(t, "m.room.member", alice, alice, map[string]interface{}{"membership": "leave"}),
+	})
+	if err != nil {
+		t.Fatalf("Accumulate: %s", err)
+	}
+	joinedAt, err := store.JoinTimestampsAfterPosition(alice, leftNIDs[len(leftNIDs)-1])
+	if err != nil {
+		t.Fatalf("JoinTimestampsAfterPosition: %s", err)
+	}
+	want := map[string]int64{joinedRoomID: 1000}
+	if !reflect.DeepEqual(joinedAt, want) {
+		t.Fatalf("JoinTimestampsAfterPosition: got %v want %v", joinedAt, want)
+	}
+	// before the profile change, the join time is the same
+	joinedAt, err = store.JoinTimestampsAfterPosition(alice, nids[1])
+	if err != nil {
+		t.Fatalf("JoinTimestampsAfterPosition: %s", err)
+	}
+	if !reflect.DeepEqual(joinedAt, want) {
+		t.Fatalf("JoinTimestampsAfterPosition: got %v want %v", joinedAt, want)
+	}
+}
+
+func TestStorageCurrentRoomMembers(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestStorageCurrentRoomMembers:localhost"
+	alice := "@alice:localhost"
+	bob := "@bob:localhost"
+	charlie := "@charlie:localhost"
+	doris := "@doris:localhost"
+	eve := "@eve:localhost"
+	_, _, err := store.Accumulate(roomID, "", []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+		testutils.NewJoinEvent(t, bob),
+		testutils.NewStateEvent(t, "m.room.member", charlie, alice, map[string]interface{}{
+			"membership":  "invite",
+			"displayname": "Chuck",
+		}),
+		testutils.NewStateEvent(t, "m.room.member", doris, alice, map[string]interface{}{"membership": "ban"}),
+		testutils.NewJoinEvent(t, eve),
+		testutils.NewStateEvent(t, "m.room.member", eve, eve, map[string]interface{}{"membership": "leave"}),
+		// a profile change is still a join
+		testutils.NewStateEvent(t, "m.room.member", bob, bob, map[string]interface{}{
+			"membership":  "join",
+			"displayname": "Bob",
+		}),
+	})
+	if err != nil {
+		t.Fatalf("Accumulate: %s", err)
+	}
+	testCases := []struct {
+		name      string
+		filter    FilterRoomMember
+		from      string
+		limit     int
+		want      []string
+		wantNext  string // "" means no next page
+		wantTotal int
+	}{
+		{
+			name:      "no filter returns all members",
+			want:      []string{alice, bob, charlie, doris, eve},
+			wantTotal: 5,
+		},
+		{
+			name:      "joined and invited members",
+			filter:    FilterRoomMember{Memberships: []string{"join", "invite"}},
+			want:      []string{alice, bob, charlie},
+			wantTotal: 3,
+		},
+		{
+			name:      "banned members",
+			filter:    FilterRoomMember{Memberships: []string{"ban"}},
+			want:      []string{doris},
+			wantTotal: 1,
+		},
+		{
+			name:      "first page",
+			filter:    FilterRoomMember{Memberships: []string{"join", "invite"}},
+			limit:     2,
+			want:      []string{alice, bob},
+			wantNext:  bob,
+			wantTotal: 3,
+		},
+		{
+			name:      "last page",
+			filter:    FilterRoomMember{Memberships: []string{"join", "invite"}},
+			from:      bob,
+			limit:     2,
+			want:      []string{charlie},
+			wantTotal: 3,
+		},
+		{
+			name:      "name_like matches user IDs case-insensitively",
+			filter:    FilterRoomMember{NameLike: "BO"},
+			want:      []string{bob},
+			wantTotal: 1,
+		},
+		{
+			name:      "name_like matches display names",
+			filter:    FilterRoomMember{NameLike: "chu"},
+			want:      []string{charlie},
+			wantTotal: 1,
+		},
+		{
+			name:      "name_like combined with memberships",
+			filter:    FilterRoomMember{NameLike: "e", Memberships: []string{"join"}},
+			want:      []string{alice},
+			wantTotal: 1,
+		},
+		{
+			name:      "name_like wildcards are matched literally",
+			filter:    FilterRoomMember{NameLike: "_"},
+			want:      []string{},
+			wantTotal: 0,
+		},
+	}
+	for _, tc := range testCases {
+		page, err := store.CurrentRoomMembers(roomID, tc.filter, tc.from, tc.limit)
+		if err != nil {
+			t.Fatalf("%s: CurrentRoomMembers: %s", tc.name, err)
+		}
+		got := make([]string, len(page.Members))
+		for i := range page.Members {
+			got[i] = page.Members[i].StateKey
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got members %v want %v", tc.name, got, tc.want)
+		}
+		next := ""
+		if page.Next != nil {
+			next = *page.Next
+		}
+		if next != tc.wantNext {
+			t.Errorf("%s: got next %q want %q", tc.name, next, tc.wantNext)
+		}
+		if page.Total != tc.wantTotal {
+			t.Errorf("%s: got total %d want %d", tc.name, page.Total, tc.wantTotal)
+		}
+	}
+}
+
+func TestStorageRoomVersions(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	alice := "@alice:localhost"
+	bob := "@bob:localhost"
+	charlie := "@charlie:localhost"
+	v1RoomID := "!TestStorageRoomVersions_v1:localhost"
+	v10RoomID := "!TestStorageRoomVersions_v10:localhost"
+	roomIDToEvents := map[string][]json.RawMessage{
+		v1RoomID: {
+			testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+			testutils.NewJoinEvent(t, alice),
+			testutils.NewJoinEvent(t, bob),
+			testutils.NewStateEvent(t, "m.room.tombstone", "", alice, map[string]interface{}{"replacement_room": v10RoomID}),
+		},
+		v10RoomID: {
+			testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice, "room_version": "10"}),
+			testutils.NewJoinEvent(t, alice),
+			testutils.NewStateEvent(t, "m.room.member", bob, alice, map[string]interface{}{"membership": "invite"}),
+			testutils.NewJoinEvent(t, charlie),
+			testutils.NewStateEvent(t, "m.room.member", charlie, charlie, map[string]interface{}{"membership": "leave"}),
+		},
+	}
+	for roomID, events := range roomIDToEvents {
+		if _, _, err := store.Accumulate(roomID, "", events); err != nil {
+			t.Fatalf("Accumulate: %s", err)
+		}
+	}
+	infos, err := store.RoomVersions()
+	if err != nil {
+		t.Fatalf("RoomVersions: %s", err)
+	}
+	got := make(map[string]RoomVersionInfo)
+	for _, info := range infos {
+		if _, ok := roomIDToEvents[info.RoomID]; ok {
+			got[info.RoomID] = info
+		}
+	}
+	want := map[string]RoomVersionInfo{
+		v1RoomID:  {RoomID: v1RoomID, RoomVersion: "1", JoinCount: 2, UpgradedRoomID: &v10RoomID},
+		v10RoomID: {RoomID: v10RoomID, RoomVersion: "10", JoinCount: 1, InviteCount: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("RoomVersions: got %+v want %+v", got, want)
+	}
+}
+
+func TestStorageEventContext(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestStorageEventContext:localhost"
+	alice := "@alice_TestStorageEventContext:localhost"
+	bob := "@bob_TestStorageEventContext:localhost"
+	_, err := store.Initialise(roomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+	})
+	if err != nil {
+		t.Fatalf("failed to initialise: %s", err)
+	}
+	timeline := []json.RawMessage{
+		testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "1"}),
+		testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "2"}),
+		testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "3"}),
+		testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "4"}),
+		testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "5"}),
+	}
+	_, timelineNIDs, err := store.Accumulate(roomID, "", timeline)
+	if err != nil {
+		t.Fatalf("failed to accumulate: %s", err)
+	}
+	to := timelineNIDs[len(timelineNIDs)-1]
+	eventIDs := func(events []json.RawMessage) (ids []string) {
+		for _, ev := range events {
+			ids = append(ids, gjson.GetBytes(ev, "event_id").Str)
+		}
+		return
+	}
+	wantIDs := eventIDs(timeline)
+
+	before, event, after, err := store.EventContext(alice, roomID, wantIDs[2], to, 1)
+	if err != nil {
+		t.Fatalf("EventContext: %s", err)
+	}
+	if got := gjson.GetBytes(event, "event_id").Str; got != wantIDs[2] {
+		t.Errorf("EventContext: got event %s want %s", got, wantIDs[2])
+	}
+	if got := eventIDs(before); !reflect.DeepEqual(got, []string{wantIDs[1]}) {
+		t.Errorf("EventContext: got events before %v want %v", got, wantIDs[1:2])
+	}
+	if got := eventIDs(after); !reflect.DeepEqual(got, []string{wantIDs[3]}) {
+		t.Errorf("EventContext: got events after %v want %v", got, wantIDs[3:4])
+	}
+
+	// events before are most recent first, and events after the load position are not returned
+	before, _, after, err = store.EventContext(alice, roomID, wantIDs[3], timelineNIDs[3], 10)
+	if err != nil {
+		t.Fatalf("EventContext: %s", err)
+	}
+	if got, want := eventIDs(before), []string{wantIDs[2], wantIDs[1], wantIDs[0]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("EventContext: got events before %v want %v", got, want)
+	}
+	if len(after) != 0 {
+		t.Errorf("EventContext: got %d events after the load position, want 0", len(after))
+	}
+
+	// unknown events and users who were never joined get no event
+	_, event, _, err = store.EventContext(alice, roomID, "$unknown", to, 10)
+	if err != nil {
+		t.Fatalf("EventContext: %s", err)
+	}
+	if event != nil {
+		t.Errorf("EventContext: got event for unknown event ID: %s", string(event))
+	}
+	_, event, _, err = store.EventContext(bob, roomID, wantIDs[2], to, 10)
+	if err != nil {
+		t.Fatalf("EventContext: %s", err)
+	}
+	if event != nil {
+		t.Errorf("EventContext: got event for user who was never joined: %s", string(event))
+	}
+}
@@ -0,0 +1,81 @@
+package state
+
+import (
+	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+)
+
+type threadUnreadRow struct {
+	RoomID            string `db:"room_id"`
+	UserID            string `db:"user_id"`
+	ThreadID          string `db:"thread_id"`
+	NotificationCount int    `db:"notification_count"`
+	HighlightCount    int    `db:"highlight_count"`
+}
+
+// ThreadUnreadTable stores per-thread unread counts per-user, as per MSC3773.
+type ThreadUnreadTable struct {
+	db *sqlx.DB
+}
+
+func NewThreadUnreadTable(db *sqlx.DB) *ThreadUnreadTable {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE TABLE IF NOT EXISTS syncv3_thread_unread (
+		room_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		thread_id TEXT NOT NULL, -- the event ID of the thread root
+		notification_count BIGINT NOT NULL DEFAULT 0,
+		highlight_count BIGINT NOT NULL DEFAULT 0,
+		UNIQUE(user_id, room_id, thread_id)
+	);
+	`)
+	return &ThreadUnreadTable{db}
+}
+
+// ReplaceThreadCounts replaces all thread counts for this user in this room. Threads which are not
+// in `counts` no longer have any unread messages.
+func (t *ThreadUnreadTable) ReplaceThreadCounts(userID, roomID string, counts map[string]internal.ThreadUnreadCounts) error {
+	return sqlutil.WithTransaction(t.db, func(txn *sqlx.Tx) error {
+		_, err := txn.Exec(`DELETE FROM syncv3_thread_unread WHERE user_id=$1 AND room_id=$2`, userID, roomID)
+		if err != nil {
+			return err
+		}
+		for threadID, c := range counts {
+			if c.HighlightCount == 0 && c.NotificationCount == 0 {
+				continue
+			}
+			_, err = txn.Exec(
+				`INSERT INTO syncv3_thread_unread(room_id, user_id, thread_id, notification_count, highlight_count) VALUES($1, $2, $3, $4, $5)`,
+				roomID, userID, threadID, c.NotificationCount, c.HighlightCount,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SelectAllForUser returns all non-zero thread counts for this user, as a map of room ID to thread ID to counts.
+func (t *ThreadUnreadTable) SelectAllForUser(userID string) (map[string]map[string]internal.ThreadUnreadCounts, error) {
+	var rows []threadUnreadRow
+	err := t.db.Select(&rows,
+		`SELECT room_id, user_id, thread_id, notification_count, highlight_count FROM syncv3_thread_unread WHERE user_id=$1`, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]map[string]internal.ThreadUnreadCounts)
+	for _, row := range rows {
+		if result[row.RoomID] == nil {
+			result[row.RoomID] = make(map[string]internal.ThreadUnreadCounts)
+		}
+		result[row.RoomID][row.ThreadID] = internal.ThreadUnreadCounts{
+			HighlightCount:    row.HighlightCount,
+			NotificationCount: row.NotificationCount,
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,45 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+func TestThreadUnreadTable(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewThreadUnreadTable(db)
+	userID := "@alice:TestThreadUnreadTable"
+	roomA := "!a:TestThreadUnreadTable"
+	roomB := "!b:TestThreadUnreadTable"
+
+	got, err := table.SelectAllForUser(userID)
+	assertNoError(t, err)
+	if len(got) != 0 {
+		t.Fatalf("SelectAllForUser on empty table returned %v", got)
+	}
+
+	assertNoError(t, table.ReplaceThreadCounts(userID, roomA, map[string]internal.ThreadUnreadCounts{
+		"$thread1": {NotificationCount: 3, HighlightCount: 1},
+		"$thread2": {NotificationCount: 1},
+		"$thread3": {}, // zero counts are not stored
+	}))
+	assertNoError(t, table.ReplaceThreadCounts(userID, roomB, map[string]internal.ThreadUnreadCounts{
+		"$thread4": {NotificationCount: 2},
+	}))
+	// replace the counts in room A, removing thread 1
+	assertNoError(t, table.ReplaceThreadCounts(userID, roomA, map[string]internal.ThreadUnreadCounts{
+		"$thread2": {NotificationCount: 5},
+	}))
+	got, err = table.SelectAllForUser(userID)
+	assertNoError(t, err)
+	want := map[string]map[string]internal.ThreadUnreadCounts{
+		roomA: {"$thread2": {NotificationCount: 5}},
+		roomB: {"$thread4": {NotificationCount: 2}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("SelectAllForUser: got %+v want %+v", got, want)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
@@ -19,6 +20,8 @@ const (
 // ToDeviceTable stores to_device messages for devices.
 type ToDeviceTable struct {
 	db *sqlx.DB
+	// if > 0, the max number of messages to keep for each device. The oldest are dropped first.
+	maxPerDevice int
 }
 
 type ToDeviceRow struct {
@@ -52,8 +55,11 @@ func NewToDeviceTable(db *sqlx.DB) *ToDeviceTable {
 		message TEXT NOT NULL,
 		-- nullable as these fields are not on all to-device events
 		unique_key TEXT,
-		action SMALLINT DEFAULT 0 -- 0 means unknown
+		action SMALLINT DEFAULT 0, -- 0 means unknown
+		inserted_at BIGINT NOT NULL DEFAULT (extract(epoch from now()) * 1000)::BIGINT
 	);
+	-- tables made before messages could expire
+	ALTER TABLE syncv3_to_device_messages ADD COLUMN IF NOT EXISTS inserted_at BIGINT NOT NULL DEFAULT (extract(epoch from now()) * 1000)::BIGINT;
 	CREATE TABLE IF NOT EXISTS syncv3_to_device_ack_pos (
 		device_id TEXT NOT NULL PRIMARY KEY,
 		unack_pos BIGINT NOT NULL
@@ -61,8 +67,16 @@ func NewToDeviceTable(db *sqlx.DB) *ToDeviceTable {
 	CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_device_idx ON syncv3_to_device_messages(device_id);
 	CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_ukey_idx ON syncv3_to_device_messages(unique_key, device_id);
 	CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_pos_device_idx ON syncv3_to_device_messages(position, device_id);
+	CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_inserted_at_idx ON syncv3_to_device_messages(inserted_at);
 	`)
-	return &ToDeviceTable{db}
+	return &ToDeviceTable{db: db}
+}
+
+// SetMaxMessagesPerDevice caps the number of messages kept for each device, so devices which never
+// acknowledge their messages don't grow the table forever. When exceeded, the oldest messages are
+// dropped. Zero means no cap.
+func (t *ToDeviceTable) SetMaxMessagesPerDevice(max int) {
+	t.maxPerDevice = max
 }
 
 func (t *ToDeviceTable) SetUnackedPosition(deviceID string, pos int64) error {
@@ -81,6 +95,16 @@ func (t *ToDeviceTable) DeleteAllMessagesForDevice(deviceID string) error {
 	return err
 }
 
+// DeleteMessagesInsertedBefore deletes messages for all devices which were inserted before this time,
+// whether or not they have been acknowledged. Returns the number of messages deleted.
+func (t *ToDeviceTable) DeleteMessagesInsertedBefore(before time.Time) (int64, error) {
+	res, err := t.db.Exec(`DELETE FROM syncv3_to_device_messages WHERE inserted_at < $1`, before.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 // Query to-device messages for this device, exclusive of from and inclusive of to. If a to value is unknown, use -1.
 func (t *ToDeviceTable) Messages(deviceID string, from, limit int64) (msgs []json.RawMessage, upTo int64, err error) {
 	upTo = from
@@ -111,7 +135,7 @@ func (t *ToDeviceTable) InsertMessages(deviceID string, msgs []json.RawMessage)
 		var unackPos int64
 		err = txn.QueryRow(`SELECT unack_pos FROM syncv3_to_device_ack_pos WHERE device_id=$1`, deviceID).Scan(&unackPos)
 		if err != nil && err != sql.ErrNoRows {
-			return fmt.Errorf("unable to select unacked pos: %s", err)
+			return fmt.Errorf("unable to select unacked pos: %w", err)
 		}
 
 		// Some of these events may be "cancel" actions. If we find events for the unique key of this event, then delete them
@@ -158,7 +182,7 @@ func (t *ToDeviceTable) InsertMessages(deviceID string, msgs []json.RawMessage)
 			err = txn.Select(&cancelled, `DELETE FROM syncv3_to_device_messages WHERE unique_key = ANY($1) AND device_id = $2 AND position > $3 RETURNING unique_key`,
 				pq.StringArray(cancels), deviceID, unackPos)
 			if err != nil {
-				return fmt.Errorf("failed to delete cancelled events: %s", err)
+				return fmt.Errorf("failed to delete cancelled events: %w", err)
 			}
 			cancelledInDBSet := make(map[string]struct{}, len(cancelled))
 			for _, ukey := range cancelled {
@@ -204,7 +228,26 @@ func (t *ToDeviceTable) InsertMessages(deviceID string, msgs []json.RawMessage)
 			}
 			result.Close()
 		}
+		if t.maxPerDevice > 0 {
+			return t.dropOldestMessages(txn, deviceID)
+		}
 		return nil
 	})
 	return lastPos, err
 }
+
+// dropOldestMessages deletes the oldest messages for this device which exceed the per-device cap.
+func (t *ToDeviceTable) dropOldestMessages(txn *sqlx.Tx, deviceID string) error {
+	res, err := txn.Exec(`DELETE FROM syncv3_to_device_messages WHERE device_id = $1 AND position <= (
+		SELECT position FROM syncv3_to_device_messages WHERE device_id = $1 ORDER BY position DESC OFFSET $2 LIMIT 1
+	)`, deviceID, t.maxPerDevice)
+	if err != nil {
+		return fmt.Errorf("failed to drop oldest messages: %w", err)
+	}
+	if dropped, _ := res.RowsAffected(); dropped > 0 {
+		logger.Warn().Str("device", deviceID).Int64("dropped", dropped).Int("max", t.maxPerDevice).Msg(
+			"ToDeviceTable: device has too many unacknowledged to-device messages, dropped the oldest",
+		)
+	}
+	return nil
+}
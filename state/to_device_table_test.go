@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/tidwall/gjson"
 )
@@ -337,3 +338,76 @@ func newRoomKeyEvent(t *testing.T, action, reqID, reqDeviceID string, body map[s
 	}
 	return json.RawMessage(b)
 }
+
+func TestToDeviceTableMaxPerDevice(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewToDeviceTable(db)
+	table.SetMaxMessagesPerDevice(2)
+	deviceID := "TestToDeviceTableMaxPerDevice"
+	otherDeviceID := "TestToDeviceTableMaxPerDevice_other"
+	msgs := []json.RawMessage{
+		json.RawMessage(`{"sender":"alice","type":"something","content":{"n":1}}`),
+		json.RawMessage(`{"sender":"alice","type":"something","content":{"n":2}}`),
+		json.RawMessage(`{"sender":"alice","type":"something","content":{"n":3}}`),
+	}
+	if _, err := table.InsertMessages(otherDeviceID, msgs[:1]); err != nil {
+		t.Fatalf("InsertMessages: %s", err)
+	}
+	if _, err := table.InsertMessages(deviceID, msgs); err != nil {
+		t.Fatalf("InsertMessages: %s", err)
+	}
+	gotMsgs, _, err := table.Messages(deviceID, 0, 10)
+	if err != nil {
+		t.Fatalf("Messages: %s", err)
+	}
+	if len(gotMsgs) != 2 || !bytes.Equal(gotMsgs[0], msgs[1]) || !bytes.Equal(gotMsgs[1], msgs[2]) {
+		t.Fatalf("Messages: got %s want the newest 2 messages", gotMsgs)
+	}
+	// other devices are unaffected
+	gotMsgs, _, err = table.Messages(otherDeviceID, 0, 10)
+	if err != nil {
+		t.Fatalf("Messages: %s", err)
+	}
+	if len(gotMsgs) != 1 {
+		t.Fatalf("Messages: got %d messages for other device, want 1", len(gotMsgs))
+	}
+}
+
+func TestToDeviceTableDeleteMessagesInsertedBefore(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewToDeviceTable(db)
+	deviceID := "TestToDeviceTableDeleteMessagesInsertedBefore"
+	msgs := []json.RawMessage{
+		json.RawMessage(`{"sender":"alice","type":"something","content":{}}`),
+	}
+	if _, err := table.InsertMessages(deviceID, msgs); err != nil {
+		t.Fatalf("InsertMessages: %s", err)
+	}
+	// nothing is old enough yet
+	if _, err := table.DeleteMessagesInsertedBefore(time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("DeleteMessagesInsertedBefore: %s", err)
+	}
+	gotMsgs, _, err := table.Messages(deviceID, 0, 10)
+	if err != nil {
+		t.Fatalf("Messages: %s", err)
+	}
+	if len(gotMsgs) != 1 {
+		t.Fatalf("Messages: got %d messages want 1", len(gotMsgs))
+	}
+	deleted, err := table.DeleteMessagesInsertedBefore(time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("DeleteMessagesInsertedBefore: %s", err)
+	}
+	if deleted < 1 {
+		t.Errorf("DeleteMessagesInsertedBefore: deleted %d want at least 1", deleted)
+	}
+	gotMsgs, _, err = table.Messages(deviceID, 0, 10)
+	if err != nil {
+		t.Fatalf("Messages: %s", err)
+	}
+	if len(gotMsgs) != 0 {
+		t.Fatalf("Messages: got %d messages want 0", len(gotMsgs))
+	}
+}
@@ -32,6 +32,8 @@ func NewTransactionsTable(db *sqlx.DB) *TransactionsTable {
 	return &TransactionsTable{db}
 }
 
+// Insert the transaction IDs for events sent by this device. Transaction IDs which are already known for
+// this device are kept, as the same event can be seen more than once e.g after a gappy sync.
 func (t *TransactionsTable) Insert(deviceID string, eventIDToTxnID map[string]string) error {
 	ts := time.Now()
 	rows := make([]txnRow, 0, len(eventIDToTxnID))
@@ -45,13 +47,14 @@ func (t *TransactionsTable) Insert(deviceID string, eventIDToTxnID map[string]st
 	}
 	result, err := t.db.NamedQuery(`
 		INSERT INTO syncv3_txns (user_id, event_id, txn_id, ts)
-        VALUES (:user_id, :event_id, :txn_id, :ts)`, rows)
+        VALUES (:user_id, :event_id, :txn_id, :ts) ON CONFLICT (user_id, event_id) DO NOTHING`, rows)
 	if err == nil {
 		result.Close()
 	}
 	return err
 }
 
+// Clean deletes transaction IDs which were inserted at or before boundaryTime.
 func (t *TransactionsTable) Clean(boundaryTime time.Time) error {
 	_, err := t.db.Exec(`DELETE FROM syncv3_txns WHERE ts <= $1`, boundaryTime.UnixMilli())
 	return err
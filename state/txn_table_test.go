@@ -59,6 +59,19 @@ func TestTransactionTable(t *testing.T) {
 		eventB: txnIDB,
 	})
 
+	// inserting a known event again is not an error
+	err = table.Insert(userID, map[string]string{
+		eventA: txnIDA,
+		eventB: txnIDB,
+	})
+	assertNoError(t, err)
+	gotTxns, err = table.Select(userID, []string{eventA, eventB})
+	assertNoError(t, err)
+	assertTxns(t, gotTxns, map[string]string{
+		eventA: txnIDA,
+		eventB: txnIDB,
+	})
+
 	// different user select
 	gotTxns, err = table.Select("@another", []string{eventA, eventB})
 	assertNoError(t, err)
@@ -9,6 +9,7 @@ import (
 	"net/url"
 
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/tidwall/gjson"
 )
 
@@ -21,8 +22,10 @@ type Client interface {
 	// WhoAmI asks the homeserver to lookup the access token using the CSAPI /whoami
 	// endpoint. The response must contain a device ID (meaning that we assume the
 	// homeserver supports Matrix >= 1.1.)
-	WhoAmI(accessToken string) (userID, deviceID string, err error)
+	WhoAmI(ctx context.Context, accessToken string) (userID, deviceID string, err error)
 	DoSyncV2(ctx context.Context, accessToken, since string, isFirst bool, toDeviceOnly bool) (*SyncResponse, int, error)
+	// EventContext returns the event and up to `limit` events around it using the CSAPI /context endpoint.
+	EventContext(ctx context.Context, accessToken, roomID, eventID string, limit int) (*ContextResponse, error)
 }
 
 // HTTPClient represents a Sync v2 Client.
@@ -33,8 +36,8 @@ type HTTPClient struct {
 }
 
 // Return sync2.HTTP401 if this request returns 401
-func (v *HTTPClient) WhoAmI(accessToken string) (string, string, error) {
-	req, err := http.NewRequest("GET", v.DestinationServer+"/_matrix/client/r0/account/whoami", nil)
+func (v *HTTPClient) WhoAmI(ctx context.Context, accessToken string) (string, string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", v.DestinationServer+"/_matrix/client/r0/account/whoami", nil)
 	if err != nil {
 		return "", "", err
 	}
@@ -79,12 +82,44 @@ func (v *HTTPClient) DoSyncV2(ctx context.Context, accessToken, since string, is
 		if err := json.NewDecoder(res.Body).Decode(&svr); err != nil {
 			return nil, 0, fmt.Errorf("DoSyncV2: response body decode JSON failed: %w", err)
 		}
+		internal.InjectPollerDelay(ctx)
 		return &svr, 200, nil
 	default:
 		return nil, res.StatusCode, fmt.Errorf("DoSyncV2: response returned %s", res.Status)
 	}
 }
 
+// EventContext performs a /context request. Returns sync2.HTTP401 if this request returns 401.
+func (v *HTTPClient) EventContext(ctx context.Context, accessToken, roomID, eventID string, limit int) (*ContextResponse, error) {
+	contextURL := fmt.Sprintf(
+		"%s/_matrix/client/r0/rooms/%s/context/%s?limit=%d",
+		v.DestinationServer, url.PathEscape(roomID), url.PathEscape(eventID), limit,
+	)
+	req, err := http.NewRequestWithContext(ctx, "GET", contextURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("EventContext: NewRequest failed: %w", err)
+	}
+	req.Header.Set("User-Agent", "sync-v3-proxy-"+ProxyVersion)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	res, err := v.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("EventContext: request failed: %w", err)
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 200:
+		var cr ContextResponse
+		if err := json.NewDecoder(res.Body).Decode(&cr); err != nil {
+			return nil, fmt.Errorf("EventContext: response body decode JSON failed: %w", err)
+		}
+		return &cr, nil
+	case 401:
+		return nil, HTTP401
+	default:
+		return nil, fmt.Errorf("EventContext: response returned %s", res.Status)
+	}
+}
+
 func (v *HTTPClient) createSyncURL(since string, isFirst, toDeviceOnly bool) string {
 	qps := "?"
 	if isFirst { // first time polling for v2-sync in this process
@@ -107,7 +142,11 @@ func (v *HTTPClient) createSyncURL(since string, isFirst, toDeviceOnly bool) str
 		timelineLimit = 1
 	}
 	room := map[string]interface{}{}
-	room["timeline"] = map[string]interface{}{"limit": timelineLimit}
+	room["timeline"] = map[string]interface{}{
+		"limit": timelineLimit,
+		// MSC3773: ask for per-thread notification counts
+		"unread_thread_notifications": true,
+	}
 
 	if toDeviceOnly {
 		// no rooms match this filter, so we get everything but room data
@@ -122,6 +161,12 @@ func (v *HTTPClient) createSyncURL(since string, isFirst, toDeviceOnly bool) str
 	return v.DestinationServer + "/_matrix/client/r0/sync" + qps
 }
 
+type ContextResponse struct {
+	Event        json.RawMessage   `json:"event"`
+	EventsBefore []json.RawMessage `json:"events_before"`
+	EventsAfter  []json.RawMessage `json:"events_after"`
+}
+
 type SyncResponse struct {
 	NextBatch   string         `json:"next_batch"`
 	AccountData EventsResponse `json:"account_data"`
@@ -151,6 +196,8 @@ type SyncV2JoinResponse struct {
 	Ephemeral           EventsResponse      `json:"ephemeral"`
 	AccountData         EventsResponse      `json:"account_data"`
 	UnreadNotifications UnreadNotifications `json:"unread_notifications"`
+	// MSC3773: thread root event ID -> counts. nil if the server does not support threads.
+	UnreadThreadNotifications map[string]UnreadNotifications `json:"unread_thread_notifications,omitempty"`
 }
 
 type UnreadNotifications struct {
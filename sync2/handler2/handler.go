@@ -5,7 +5,10 @@ import (
 	"github.com/getsentry/sentry-go"
 	"hash/fnv"
 	"os"
+	"reflect"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/pubsub"
@@ -34,11 +37,24 @@ type Handler struct {
 		Highlight int
 		Notif     int
 	}
+	// room_id+user_id => thread_id => counts
+	threadUnreadMap map[string]map[string]internal.ThreadUnreadCounts
 	// room_id => fnv_hash([typing user ids])
 	typingMap map[string]uint64
 
 	numPollers prometheus.Gauge
 	subSystem  string
+	// closed on Teardown to stop the inactive user GC loop, if running
+	gcStop chan struct{}
+
+	// how long to keep the to-device messages and device data of devices whose token expired
+	departedGracePeriod time.Duration
+	// labelled by result: cleaned or cancelled
+	departedCleanups *prometheus.CounterVec
+
+	// device_id => the latest since token which is yet to be written, if since tokens are batched
+	sinceMu      *sync.Mutex
+	pendingSince map[string]string
 }
 
 func NewHandler(
@@ -55,7 +71,10 @@ func NewHandler(
 			Highlight int
 			Notif     int
 		}),
-		typingMap: make(map[string]uint64),
+		threadUnreadMap: make(map[string]map[string]internal.ThreadUnreadCounts),
+		typingMap:       make(map[string]uint64),
+		gcStop:          make(chan struct{}),
+		sinceMu:         &sync.Mutex{},
 	}
 	pMap.SetCallbacks(h)
 
@@ -84,18 +103,33 @@ func (h *Handler) Listen() {
 
 func (h *Handler) Teardown() {
 	// stop polling and tear down DB conns
+	close(h.gcStop)
+	// terminate pollers first so they stop queueing since tokens, then write the queued tokens
+	h.pMap.Terminate()
+	h.FlushSinceTokens()
 	h.v3Sub.Teardown()
 	h.v2Pub.Close()
 	h.Store.Teardown()
 	h.v2Store.Teardown()
-	h.pMap.Terminate()
 	if h.numPollers != nil {
 		prometheus.Unregister(h.numPollers)
 	}
+	if h.departedCleanups != nil {
+		prometheus.Unregister(h.departedCleanups)
+	}
+}
+
+// SetDepartedDeviceGracePeriod sets how long to keep the to-device messages and device data of a device
+// whose access token has expired before deleting them. A token which is rejected by mistake and then
+// used again within this period doesn't lose any to-device messages. Zero deletes them straight away.
+// Departed devices are stored, and their data is deleted by StartDepartedDeviceCleanup.
+func (h *Handler) SetDepartedDeviceGracePeriod(d time.Duration) {
+	h.departedGracePeriod = d
 }
 
 func (h *Handler) StartV2Pollers() {
-	devices, err := h.v2Store.AllDevices()
+	// archived devices are only polled again when they next make a request
+	devices, err := h.v2Store.UnarchivedDevices()
 	if err != nil {
 		logger.Err(err).Msg("StartV2Pollers: failed to query devices")
 		sentry.CaptureException(err)
@@ -152,14 +186,325 @@ func (h *Handler) OnTerminated(userID, deviceID string) {
 
 func (h *Handler) OnExpiredToken(userID, deviceID string) {
 	h.v2Store.RemoveDevice(deviceID)
-	h.Store.ToDeviceTable.DeleteAllMessagesForDevice(deviceID)
-	h.Store.DeviceDataTable.DeleteDevice(userID, deviceID)
+	h.scheduleDepartedDeviceCleanup(userID, deviceID)
 	// also notify v3 side so it can remove the connection from ConnMap
 	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2ExpiredToken{
 		DeviceID: deviceID,
 	})
 }
 
+// scheduleDepartedDeviceCleanup deletes the to-device messages and device data for this device once the
+// grace period has passed, unless the device syncs again before then. The departure is stored so the
+// cleanup survives restarts.
+func (h *Handler) scheduleDepartedDeviceCleanup(userID, deviceID string) {
+	if h.departedGracePeriod <= 0 {
+		h.cleanupDepartedDevice(userID, deviceID)
+		return
+	}
+	if err := h.v2Store.MarkDeviceDeparted(userID, deviceID, time.Now()); err != nil {
+		// the data will be kept until the device comes back or is garbage collected for being inactive
+		logger.Err(err).Str("user", userID).Str("device", deviceID).Msg("failed to mark device as departed")
+		sentry.CaptureException(err)
+	}
+}
+
+// cancelDepartedDeviceCleanup keeps the data for this device, as it is syncing again.
+func (h *Handler) cancelDepartedDeviceCleanup(deviceID string) {
+	if h.departedGracePeriod <= 0 {
+		return
+	}
+	departed, err := h.v2Store.UnmarkDeviceDeparted(deviceID)
+	if err != nil {
+		logger.Err(err).Str("device", deviceID).Msg("failed to unmark departed device")
+		sentry.CaptureException(err)
+		return
+	}
+	if departed {
+		logger.Info().Str("device", deviceID).Msg("departed device synced again, keeping its data")
+		if h.departedCleanups != nil {
+			h.departedCleanups.WithLabelValues("cancelled").Inc()
+		}
+	}
+}
+
+// StartDepartedDeviceCleanup deletes the data of devices which departed more than the grace period ago
+// every `interval`. Blocks until Teardown is called, so run this in a goroutine.
+func (h *Handler) StartDepartedDeviceCleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.gcStop:
+			return
+		case <-ticker.C:
+			h.CleanupDepartedDevices()
+		}
+	}
+}
+
+// CleanupDepartedDevices deletes the to-device messages and device data of devices whose access token
+// expired more than the grace period ago. This is the only per-device data left behind: connections are
+// removed as soon as the token expires, and device list changes are part of the device data.
+//
+// Devices are only known to have departed when the homeserver rejects their token. Devices which are
+// deleted on the homeserver without their token being used again, e.g because the proxy was not polling
+// them, are cleaned up when they are garbage collected for being inactive instead.
+func (h *Handler) CleanupDepartedDevices() {
+	before := time.Now().Add(-h.departedGracePeriod)
+	devices, err := h.v2Store.DepartedDevicesBefore(before)
+	if err != nil {
+		logger.Err(err).Msg("CleanupDepartedDevices: failed to query departed devices")
+		sentry.CaptureException(err)
+		return
+	}
+	for _, d := range devices {
+		// the device may have come back since it was selected
+		claimed, err := h.v2Store.ClaimDepartedDevice(d.DeviceID, before)
+		if err != nil {
+			logger.Err(err).Str("device", d.DeviceID).Msg("CleanupDepartedDevices: failed to claim departed device")
+			sentry.CaptureException(err)
+			continue
+		}
+		if claimed {
+			h.cleanupDepartedDevice(d.UserID, d.DeviceID)
+		}
+	}
+}
+
+func (h *Handler) cleanupDepartedDevice(userID, deviceID string) {
+	if err := h.Store.ToDeviceTable.DeleteAllMessagesForDevice(deviceID); err != nil {
+		logger.Err(err).Str("user", userID).Str("device", deviceID).Msg("failed to delete to-device messages of departed device")
+		sentry.CaptureException(err)
+	}
+	if err := h.Store.DeviceDataTable.DeleteDevice(userID, deviceID); err != nil {
+		logger.Err(err).Str("user", userID).Str("device", deviceID).Msg("failed to delete device data of departed device")
+		sentry.CaptureException(err)
+	}
+	if h.departedCleanups != nil {
+		h.departedCleanups.WithLabelValues("cleaned").Inc()
+	}
+}
+
+// StartInactiveUserGC checks every `interval` for devices which have not made a request for `inactiveFor`,
+// and archives them. Blocks until Teardown is called, so run this in a goroutine.
+func (h *Handler) StartInactiveUserGC(inactiveFor, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.gcStop:
+			return
+		case <-ticker.C:
+			h.CollectInactiveUsers(inactiveFor)
+		}
+	}
+}
+
+// StartTransactionIDExpiry deletes transaction IDs older than `maxAge` every `interval`. They are only
+// needed for clients to match up their local echo, which happens shortly after sending. Blocks until
+// Teardown is called, so run this in a goroutine.
+func (h *Handler) StartTransactionIDExpiry(maxAge, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.gcStop:
+			return
+		case <-ticker.C:
+			if err := h.Store.TransactionsTable.Clean(time.Now().Add(-maxAge)); err != nil {
+				logger.Err(err).Msg("StartTransactionIDExpiry: failed to delete old transaction IDs")
+				sentry.CaptureException(err)
+			}
+		}
+	}
+}
+
+// StartPollerBackpressure treats devices which have not made a request for `inactiveFor` as low priority,
+// refreshing the set every `interval`. Low priority pollers pause when database writes are slow, see
+// sync2.PollerMap.SetBackpressureThreshold. Blocks until Teardown is called, so run this in a goroutine.
+func (h *Handler) StartPollerBackpressure(inactiveFor, interval time.Duration) {
+	h.RefreshLowPriorityPollers(inactiveFor)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.gcStop:
+			return
+		case <-ticker.C:
+			h.RefreshLowPriorityPollers(inactiveFor)
+		}
+	}
+}
+
+// RefreshLowPriorityPollers marks the pollers of devices which have not made a request for `inactiveFor`
+// as low priority. If this fails, e.g because the database is struggling, the previous set is kept.
+func (h *Handler) RefreshLowPriorityPollers(inactiveFor time.Duration) {
+	devices, err := h.v2Store.InactiveDevices(time.Now().Add(-inactiveFor))
+	if err != nil {
+		logger.Err(err).Msg("RefreshLowPriorityPollers: failed to query inactive devices")
+		return
+	}
+	deviceIDs := make([]string, len(devices))
+	for i := range devices {
+		deviceIDs[i] = devices[i].DeviceID
+	}
+	h.pMap.SetLowPriorityDevices(deviceIDs)
+}
+
+// StartSinceTokenBatching writes since tokens every `interval` in one query for all devices, rather than
+// after every poll of every device, to reduce write load on large deployments. A since token is only queued
+// once the data it covers has been written, so if the proxy crashes devices poll some data again, which is
+// deduplicated, rather than missing any. Blocks until Teardown is called, so run this in a goroutine.
+func (h *Handler) StartSinceTokenBatching(interval time.Duration) {
+	h.sinceMu.Lock()
+	if h.pendingSince == nil {
+		h.pendingSince = make(map[string]string)
+	}
+	h.sinceMu.Unlock()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.gcStop:
+			return // Teardown flushes
+		case <-ticker.C:
+			h.FlushSinceTokens()
+		}
+	}
+}
+
+// FlushSinceTokens writes the since tokens queued by StartSinceTokenBatching. If this fails they are
+// retried on the next flush, unless the device has polled again since.
+func (h *Handler) FlushSinceTokens() {
+	h.sinceMu.Lock()
+	batch := h.pendingSince
+	if len(batch) == 0 {
+		h.sinceMu.Unlock()
+		return
+	}
+	h.pendingSince = make(map[string]string, len(batch))
+	h.sinceMu.Unlock()
+	start := time.Now()
+	if err := h.v2Store.UpdateDeviceSinces(batch); err != nil {
+		logger.Err(err).Int("devices", len(batch)).Msg("V2: failed to persist since tokens")
+		sentry.CaptureException(err)
+		h.sinceMu.Lock()
+		for deviceID, since := range batch {
+			if _, ok := h.pendingSince[deviceID]; !ok {
+				h.pendingSince[deviceID] = since
+			}
+		}
+		h.sinceMu.Unlock()
+		return
+	}
+	logger.Trace().Int("devices", len(batch)).Dur("took", time.Since(start)).Msg("V2: persisted since tokens")
+}
+
+// queuedSince returns the since token of this device which is yet to be written, if any.
+func (h *Handler) queuedSince(deviceID string) (since string, ok bool) {
+	h.sinceMu.Lock()
+	defer h.sinceMu.Unlock()
+	since, ok = h.pendingSince[deviceID]
+	return
+}
+
+// StartToDeviceExpiry deletes to-device messages older than `maxAge` every `interval`, so messages for
+// devices which never come back don't pile up. Blocks until Teardown is called, so run this in a goroutine.
+func (h *Handler) StartToDeviceExpiry(maxAge, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.gcStop:
+			return
+		case <-ticker.C:
+			h.ExpireToDeviceMessages(maxAge)
+		}
+	}
+}
+
+// ExpireToDeviceMessages deletes to-device messages which were inserted more than `maxAge` ago.
+func (h *Handler) ExpireToDeviceMessages(maxAge time.Duration) {
+	deleted, err := h.Store.ToDeviceTable.DeleteMessagesInsertedBefore(time.Now().Add(-maxAge))
+	if err != nil {
+		logger.Err(err).Msg("ExpireToDeviceMessages: failed to delete expired to-device messages")
+		sentry.CaptureException(err)
+		return
+	}
+	if deleted > 0 {
+		logger.Info().Int64("deleted", deleted).Dur("max_age", maxAge).Msg("ExpireToDeviceMessages: deleted expired to-device messages")
+	}
+}
+
+// CollectInactiveUsers archives devices which have not made a request for `inactiveFor`. Archiving a device
+// stops its poller and deletes its to-device messages and device data. Once all of a user's devices are
+// archived, all data derived from their v2 stream is deleted. If the user returns, their device will be
+// unarchived and do an initial sync, rehydrating this data.
+func (h *Handler) CollectInactiveUsers(inactiveFor time.Duration) {
+	before := time.Now().Add(-inactiveFor)
+	devices, err := h.v2Store.InactiveDevices(before)
+	if err != nil {
+		logger.Err(err).Msg("CollectInactiveUsers: failed to query inactive devices")
+		sentry.CaptureException(err)
+		return
+	}
+	userToDeviceIDs := make(map[string][]string)
+	for _, d := range devices {
+		archived, err := h.v2Store.ArchiveDevice(d.DeviceID, before)
+		if err != nil {
+			logger.Err(err).Str("device", d.DeviceID).Msg("CollectInactiveUsers: failed to archive device")
+			sentry.CaptureException(err)
+			continue
+		}
+		if !archived {
+			// the device made a request since it was selected, so keep it
+			continue
+		}
+		h.pMap.TerminateDevice(d.DeviceID)
+		h.Store.ToDeviceTable.DeleteAllMessagesForDevice(d.DeviceID)
+		h.Store.DeviceDataTable.DeleteDevice(d.UserID, d.DeviceID)
+		userToDeviceIDs[d.UserID] = append(userToDeviceIDs[d.UserID], d.DeviceID)
+	}
+	for userID, deviceIDs := range userToDeviceIDs {
+		active, err := h.v2Store.UserHasUnarchivedDevices(userID)
+		if err != nil {
+			logger.Err(err).Str("user", userID).Msg("CollectInactiveUsers: failed to check for active devices")
+			sentry.CaptureException(err)
+			continue
+		}
+		if active {
+			continue
+		}
+		if err = h.Store.DeleteUserData(userID); err != nil {
+			logger.Err(err).Str("user", userID).Msg("CollectInactiveUsers: failed to delete user data")
+			sentry.CaptureException(err)
+			continue
+		}
+		// forget the counts we've seen for this user, else they will be deduplicated and not written back
+		// to the database when the user returns.
+		h.pMap.Execute(func() {
+			for key := range h.unreadMap {
+				if strings.HasSuffix(key, userID) {
+					delete(h.unreadMap, key)
+				}
+			}
+			for key := range h.threadUnreadMap {
+				if strings.HasSuffix(key, userID) {
+					delete(h.threadUnreadMap, key)
+				}
+			}
+		})
+		logger.Info().Str("user", userID).Strs("devices", deviceIDs).Msg("CollectInactiveUsers: archived inactive user")
+		h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2UserArchived{
+			UserID:    userID,
+			DeviceIDs: deviceIDs,
+		})
+	}
+	if len(devices) > 0 {
+		logger.Info().Int("num_devices", len(devices)).Int("num_users", len(userToDeviceIDs)).Msg("CollectInactiveUsers: archived inactive devices")
+	}
+}
+
 func (h *Handler) addPrometheusMetrics() {
 	h.numPollers = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "sliding_sync",
@@ -168,10 +513,25 @@ func (h *Handler) addPrometheusMetrics() {
 		Help:      "Number of active sync v2 pollers.",
 	})
 	prometheus.MustRegister(h.numPollers)
+	h.departedCleanups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: h.subSystem,
+		Name:      "departed_device_cleanups",
+		Help:      "Number of devices with expired tokens whose data was deleted (cleaned) or kept as they synced again (cancelled).",
+	}, []string{"result"})
+	prometheus.MustRegister(h.departedCleanups)
 }
 
-// Emits nothing as no downstream components need it.
+// Emits nothing as no downstream components need it. If since tokens are batched, the token is written on
+// the next flush.
 func (h *Handler) UpdateDeviceSince(deviceID, since string) {
+	h.sinceMu.Lock()
+	if h.pendingSince != nil {
+		h.pendingSince[deviceID] = since
+		h.sinceMu.Unlock()
+		return
+	}
+	h.sinceMu.Unlock()
 	err := h.v2Store.UpdateDeviceSince(deviceID, since)
 	if err != nil {
 		logger.Err(err).Str("device", deviceID).Str("since", since).Msg("V2: failed to persist since token")
@@ -253,6 +613,13 @@ func (h *Handler) Initialise(roomID string, state []json.RawMessage) []json.RawM
 			SnapshotNID: res.SnapshotID,
 		})
 	}
+	if len(res.PrependTimelineEvents) > 0 {
+		// The unknown state events will be accumulated as timeline events, but any membership changes
+		// in the gap are lost so counts need recalculating.
+		h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2GappySync{
+			RoomID: roomID,
+		})
+	}
 	return res.PrependTimelineEvents
 }
 
@@ -338,20 +705,39 @@ func (h *Handler) UpdateUnreadCounts(roomID, userID string, highlightCount, noti
 	})
 }
 
-func (h *Handler) OnAccountData(userID, roomID string, events []json.RawMessage) {
-	data, err := h.Store.InsertAccountData(userID, roomID, events)
+func (h *Handler) UpdateThreadUnreadCounts(roomID, userID string, threadCounts map[string]internal.ThreadUnreadCounts) {
+	// only touch the DB and notify if they have changed, as with UpdateUnreadCounts
+	key := roomID + userID
+	if existing, ok := h.threadUnreadMap[key]; ok && reflect.DeepEqual(existing, threadCounts) {
+		return // dupe
+	}
+	h.threadUnreadMap[key] = threadCounts
+
+	err := h.Store.ThreadUnreadTable.ReplaceThreadCounts(userID, roomID, threadCounts)
 	if err != nil {
-		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to update account data")
+		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to update thread unread counters")
+		sentry.CaptureException(err)
+	}
+	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2ThreadUnreadCounts{
+		RoomID: roomID,
+		UserID: userID,
+		Counts: threadCounts,
+	})
+}
+
+func (h *Handler) OnAccountData(userID string, roomIDToEvents map[string][]json.RawMessage) {
+	data, err := h.Store.InsertAccountData(userID, roomIDToEvents)
+	if err != nil {
+		logger.Err(err).Str("user", userID).Int("rooms", len(roomIDToEvents)).Msg("failed to update account data")
 		sentry.CaptureException(err)
 		return
 	}
-	var types []string
+	types := make(map[string][]string)
 	for _, d := range data {
-		types = append(types, d.Type)
+		types[d.RoomID] = append(types[d.RoomID], d.Type)
 	}
 	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2AccountData{
 		UserID: userID,
-		RoomID: roomID,
 		Types:  types,
 	})
 }
@@ -369,6 +755,21 @@ func (h *Handler) OnInvite(userID, roomID string, inviteState []json.RawMessage)
 	})
 }
 
+// OnJoinedRooms retires any invites for these rooms. Accepted invites are normally retired when the join
+// event is processed, but that relies on the event carrying the previous membership, which isn't the
+// case when the join is only seen in the state of a gappy or initial sync.
+func (h *Handler) OnJoinedRooms(userID string, roomIDs []string) {
+	retired, err := h.Store.InvitesTable.RemoveInvites(userID, roomIDs)
+	if err != nil {
+		logger.Err(err).Str("user", userID).Int("rooms", len(roomIDs)).Msg("failed to retire invites for joined rooms")
+		sentry.CaptureException(err)
+		return
+	}
+	if len(retired) > 0 {
+		logger.Info().Str("user", userID).Strs("rooms", retired).Msg("retired invites for joined rooms")
+	}
+}
+
 func (h *Handler) OnLeftRoom(userID, roomID string) {
 	// remove any invites for this user if they are rejecting an invite
 	err := h.Store.InvitesTable.RemoveInvite(userID, roomID)
@@ -393,6 +794,11 @@ func (h *Handler) EnsurePolling(p *pubsub.V3EnsurePolling) {
 		sentry.CaptureException(err)
 		return
 	}
+	// the poller may have moved on since the token in the database was written
+	if since, ok := h.queuedSince(dev.DeviceID); ok {
+		dev.Since = since
+	}
+	h.cancelDepartedDeviceCleanup(dev.DeviceID)
 	// don't block us from consuming more pubsub messages just because someone wants to sync
 	go func() {
 		// blocks until an initial sync is done
@@ -408,6 +814,10 @@ func (h *Handler) EnsurePolling(p *pubsub.V3EnsurePolling) {
 	}()
 }
 
+func (h *Handler) Nudge(p *pubsub.V3Nudge) {
+	h.pMap.Nudge(p.DeviceID)
+}
+
 func typingHash(ephEvent json.RawMessage) uint64 {
 	h := fnv.New64a()
 	for _, userID := range gjson.ParseBytes(ephEvent).Get("content.user_ids").Array() {
@@ -17,6 +17,24 @@ import (
 // alias time.Sleep so tests can monkey patch it out
 var timeSleep = time.Sleep
 
+// The min time between nudges, so clients can't make pollers hammer the upstream server.
+var minNudgeInterval = time.Second
+
+// How long low priority pollers wait before checking whether the database has recovered, and the longest
+// they wait in total before polling anyway. Polling occasionally keeps their data from going too stale, and
+// keeps the write latency up to date when every poller is low priority.
+var (
+	backpressureCheckInterval = 5 * time.Second
+	maxBackpressurePause      = time.Minute
+)
+
+// When one of a user's access tokens expires, the user's other tokens are checked with the homeserver.
+// This bounds how many are checked at once across all users, and how long each check can take.
+const (
+	maxConcurrentTokenChecks = 4
+	tokenCheckTimeout        = 10 * time.Second
+)
+
 // V2DataReceiver is the receiver for all the v2 sync data the poller gets
 type V2DataReceiver interface {
 	// Update the since token for this device. Called AFTER all other data in this sync response has been processed.
@@ -34,12 +52,18 @@ type V2DataReceiver interface {
 	AddToDeviceMessages(userID, deviceID string, msgs []json.RawMessage) // start/end stream pos
 	// UpdateUnreadCounts sets the highlight_count and notification_count for this user in this room.
 	UpdateUnreadCounts(roomID, userID string, highlightCount, notifCount *int)
-	// Set the latest account data for this user.
-	OnAccountData(userID, roomID string, events []json.RawMessage) // ping update with types? Can you race when re-querying?
+	// UpdateThreadUnreadCounts sets the complete set of per-thread unread counts for this user in this room.
+	UpdateThreadUnreadCounts(roomID, userID string, threadCounts map[string]internal.ThreadUnreadCounts)
+	// Set the latest account data for this user: room ID -> events, with global account data under
+	// AccountDataGlobalRoom. Called at most once per poll, as initial syncs can have hundreds of events.
+	OnAccountData(userID string, roomIDToEvents map[string][]json.RawMessage)
 	// Sent when there is a room in the `invite` section of the v2 response.
 	OnInvite(userID, roomID string, inviteState []json.RawMessage) // invitestate in db
 	// Sent when there is a room in the `leave` section of the v2 response.
 	OnLeftRoom(userID, roomID string)
+	// Sent when the user's join event is in the `join` section of the v2 response, in either the state or
+	// the timeline. Called at most once per poll.
+	OnJoinedRooms(userID string, roomIDs []string)
 	// Sent when there is a _change_ in E2EE data, not all the time
 	OnE2EEData(userID, deviceID string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int)
 	// Sent when the poll loop terminates
@@ -58,6 +82,19 @@ type PollerMap struct {
 	executorRunning          bool
 	processHistogramVec      *prometheus.HistogramVec
 	timelineSizeHistogramVec *prometheus.HistogramVec
+	pausedGauge              prometheus.Gauge
+
+	// If > 0, pollers for low priority devices pause whilst the average time taken to write poll data to
+	// the database is over this.
+	backpressureThreshold time.Duration
+	// moving average of the time taken to write poll data, in nanoseconds. Only touched on the executor.
+	writeLatency      time.Duration
+	writeLatencyNanos *atomic.Int64
+	lowPriorityMu     *sync.Mutex
+	lowPriority       map[string]struct{} // device_id set
+
+	// limits the number of access tokens being checked at once after another token expired
+	tokenChecks chan struct{}
 }
 
 // NewPollerMap makes a new PollerMap. Guarantees that the V2DataReceiver will be called on the same
@@ -90,6 +127,11 @@ func NewPollerMap(v2Client Client, enablePrometheus bool) *PollerMap {
 		pollerMu: &sync.Mutex{},
 		Pollers:  make(map[string]*poller),
 		executor: make(chan func(), 0),
+
+		writeLatencyNanos: &atomic.Int64{},
+		lowPriorityMu:     &sync.Mutex{},
+		lowPriority:       make(map[string]struct{}),
+		tokenChecks:       make(chan struct{}, maxConcurrentTokenChecks),
 	}
 	if enablePrometheus {
 		pm.processHistogramVec = prometheus.NewHistogramVec(prometheus.HistogramOpts{
@@ -108,7 +150,13 @@ func NewPollerMap(v2Client Client, enablePrometheus bool) *PollerMap {
 			Buckets:   []float64{0.0, 1.0, 2.0, 5.0, 10.0, 20.0, 50.0},
 		}, []string{"limited"})
 		prometheus.MustRegister(pm.timelineSizeHistogramVec)
-
+		pm.pausedGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "poller",
+			Name:      "paused",
+			Help:      "Number of low priority pollers paused because database writes are slow",
+		})
+		prometheus.MustRegister(pm.pausedGauge)
 	}
 	return pm
 }
@@ -117,6 +165,48 @@ func (h *PollerMap) SetCallbacks(callbacks V2DataReceiver) {
 	h.callbacks = callbacks
 }
 
+// SetBackpressureThreshold makes pollers for low priority devices pause whilst writing poll data to the
+// database takes longer than this on average, so the database has more capacity for active users. Zero
+// disables this.
+func (h *PollerMap) SetBackpressureThreshold(threshold time.Duration) {
+	h.backpressureThreshold = threshold
+}
+
+// SetLowPriorityDevices replaces the set of devices whose pollers pause when database writes are slow.
+func (h *PollerMap) SetLowPriorityDevices(deviceIDs []string) {
+	lowPriority := make(map[string]struct{}, len(deviceIDs))
+	for _, deviceID := range deviceIDs {
+		lowPriority[deviceID] = struct{}{}
+	}
+	h.lowPriorityMu.Lock()
+	h.lowPriority = lowPriority
+	h.lowPriorityMu.Unlock()
+}
+
+// WriteLatency returns the moving average of the time taken to write poll data to the database.
+func (h *PollerMap) WriteLatency() time.Duration {
+	return time.Duration(h.writeLatencyNanos.Load())
+}
+
+// trackWriteLatency updates the moving average write latency. Must be called on the executor.
+func (h *PollerMap) trackWriteLatency(dur time.Duration) {
+	// weight recent writes so the average reacts within a few polls, in both directions
+	h.writeLatency = (h.writeLatency*4 + dur) / 5
+	h.writeLatencyNanos.Store(int64(h.writeLatency))
+}
+
+// shouldPause returns true if the poller for this device should wait before polling again, because it
+// is low priority and database writes are slow.
+func (h *PollerMap) shouldPause(deviceID string) bool {
+	if h.backpressureThreshold <= 0 || h.WriteLatency() <= h.backpressureThreshold {
+		return false
+	}
+	h.lowPriorityMu.Lock()
+	defer h.lowPriorityMu.Unlock()
+	_, isLowPriority := h.lowPriority[deviceID]
+	return isLowPriority
+}
+
 // Terminate all pollers. Useful in tests.
 func (h *PollerMap) Terminate() {
 	h.pollerMu.Lock()
@@ -130,9 +220,35 @@ func (h *PollerMap) Terminate() {
 	if h.timelineSizeHistogramVec != nil {
 		prometheus.Unregister(h.timelineSizeHistogramVec)
 	}
+	if h.pausedGauge != nil {
+		prometheus.Unregister(h.pausedGauge)
+	}
 	close(h.executor)
 }
 
+// TerminateDevice stops the poller for this device, if there is one. Returns true if a poller was terminated.
+func (h *PollerMap) TerminateDevice(deviceID string) bool {
+	h.pollerMu.Lock()
+	defer h.pollerMu.Unlock()
+	p, ok := h.Pollers[deviceID]
+	if !ok || p.terminated.Load() {
+		return false
+	}
+	p.Terminate()
+	return true
+}
+
+// Nudge makes the poller for this device poll again straight away rather than waiting for its current
+// request to return. Does nothing if there is no poller for this device.
+func (h *PollerMap) Nudge(deviceID string) {
+	h.pollerMu.Lock()
+	p, ok := h.Pollers[deviceID]
+	h.pollerMu.Unlock()
+	if ok {
+		p.Nudge()
+	}
+}
+
 func (h *PollerMap) NumPollers() (count int) {
 	h.pollerMu.Lock()
 	defer h.pollerMu.Unlock()
@@ -183,6 +299,10 @@ func (h *PollerMap) EnsurePolling(accessToken, userID, deviceID, v2since string,
 	poller = newPoller(userID, accessToken, deviceID, h.v2Client, h, logger, !needToWait && !isStartup)
 	poller.processHistogramVec = h.processHistogramVec
 	poller.timelineSizeVec = h.timelineSizeHistogramVec
+	poller.pausedGauge = h.pausedGauge
+	poller.shouldPause = func() bool {
+		return h.shouldPause(deviceID)
+	}
 	go poller.Poll(v2since)
 	h.Pollers[deviceID] = poller
 
@@ -200,6 +320,24 @@ func (h *PollerMap) execute() {
 	}
 }
 
+// Execute runs fn on the goroutine which processes poller callbacks, blocking until it has run. Use this
+// to safely mutate state which is otherwise only touched by callbacks.
+func (h *PollerMap) Execute(fn func()) {
+	h.pollerMu.Lock()
+	if !h.executorRunning {
+		h.executorRunning = true
+		go h.execute()
+	}
+	h.pollerMu.Unlock()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	h.executor <- func() {
+		fn()
+		wg.Done()
+	}
+	wg.Wait()
+}
+
 func (h *PollerMap) UpdateDeviceSince(deviceID, since string) {
 	h.callbacks.UpdateDeviceSince(deviceID, since)
 }
@@ -207,7 +345,9 @@ func (h *PollerMap) Accumulate(deviceID, roomID, prevBatch string, timeline []js
 	var wg sync.WaitGroup
 	wg.Add(1)
 	h.executor <- func() {
+		start := time.Now()
 		h.callbacks.Accumulate(deviceID, roomID, prevBatch, timeline)
+		h.trackWriteLatency(time.Since(start))
 		wg.Done()
 	}
 	wg.Wait()
@@ -216,7 +356,9 @@ func (h *PollerMap) Initialise(roomID string, state []json.RawMessage) (result [
 	var wg sync.WaitGroup
 	wg.Add(1)
 	h.executor <- func() {
+		start := time.Now()
 		result = h.callbacks.Initialise(roomID, state)
+		h.trackWriteLatency(time.Since(start))
 		wg.Done()
 	}
 	wg.Wait()
@@ -241,6 +383,16 @@ func (h *PollerMap) OnInvite(userID, roomID string, inviteState []json.RawMessag
 	wg.Wait()
 }
 
+func (h *PollerMap) OnJoinedRooms(userID string, roomIDs []string) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	h.executor <- func() {
+		h.callbacks.OnJoinedRooms(userID, roomIDs)
+		wg.Done()
+	}
+	wg.Wait()
+}
+
 func (h *PollerMap) OnLeftRoom(userID, roomID string) {
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -261,8 +413,54 @@ func (h *PollerMap) OnTerminated(userID, deviceID string) {
 	h.callbacks.OnTerminated(userID, deviceID)
 }
 
+// OnExpiredToken is called when a poller's access token is rejected by the homeserver. This is
+// often caused by the user signing out all their devices at once, so check the access tokens of all
+// the user's other pollers and expire them now rather than waiting for each poller to notice on its
+// next request. This closes the window where revoked tokens could continue to read cached data.
+// The other tokens are checked in the background, so the expired poller isn't held up.
 func (h *PollerMap) OnExpiredToken(userID, deviceID string) {
 	h.callbacks.OnExpiredToken(userID, deviceID)
+	go h.expireOtherInvalidTokens(userID, deviceID)
+}
+
+// expireOtherInvalidTokens checks the access tokens of the user's other pollers, at most
+// maxConcurrentTokenChecks at a time across all users, and expires those the homeserver rejects.
+// Returns once all the tokens have been checked.
+func (h *PollerMap) expireOtherInvalidTokens(userID, expiredDeviceID string) {
+	h.pollerMu.Lock()
+	var others []*poller
+	for deviceID, p := range h.Pollers {
+		if deviceID == expiredDeviceID || p.userID != userID || p.terminated.Load() {
+			continue
+		}
+		others = append(others, p)
+	}
+	h.pollerMu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, p := range others {
+		h.tokenChecks <- struct{}{}
+		wg.Add(1)
+		go func(p *poller) {
+			defer func() {
+				<-h.tokenChecks
+				wg.Done()
+			}()
+			ctx, cancel := context.WithTimeout(context.Background(), tokenCheckTimeout)
+			defer cancel()
+			_, _, err := h.v2Client.WhoAmI(ctx, p.accessToken)
+			if err != HTTP401 {
+				// either the token is still valid or we couldn't tell, in which case the poller will find out.
+				return
+			}
+			p.logger.Warn().Str("expired_device", expiredDeviceID).Msg(
+				"Poller: access token invalidated along with another device, terminating loop",
+			)
+			p.Terminate()
+			h.callbacks.OnExpiredToken(userID, p.deviceID)
+		}(p)
+	}
+	wg.Wait()
 }
 
 func (h *PollerMap) UpdateUnreadCounts(roomID, userID string, highlightCount, notifCount *int) {
@@ -275,11 +473,21 @@ func (h *PollerMap) UpdateUnreadCounts(roomID, userID string, highlightCount, no
 	wg.Wait()
 }
 
-func (h *PollerMap) OnAccountData(userID, roomID string, events []json.RawMessage) {
+func (h *PollerMap) UpdateThreadUnreadCounts(roomID, userID string, threadCounts map[string]internal.ThreadUnreadCounts) {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	h.executor <- func() {
-		h.callbacks.OnAccountData(userID, roomID, events)
+		h.callbacks.UpdateThreadUnreadCounts(roomID, userID, threadCounts)
+		wg.Done()
+	}
+	wg.Wait()
+}
+
+func (h *PollerMap) OnAccountData(userID string, roomIDToEvents map[string][]json.RawMessage) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	h.executor <- func() {
+		h.callbacks.OnAccountData(userID, roomIDToEvents)
 		wg.Done()
 	}
 	wg.Wait()
@@ -324,9 +532,18 @@ type poller struct {
 	terminated *atomic.Bool
 	wg         *sync.WaitGroup
 
+	// cancels the current long poll, if it can be cancelled. Protected by nudgeMu.
+	cancelPoll context.CancelFunc
+	lastNudge  time.Time
+	nudgeMu    *sync.Mutex
+
+	// returns true if this poller should wait before polling again. Can be nil.
+	shouldPause func() bool
+
 	pollHistogramVec    *prometheus.HistogramVec
 	processHistogramVec *prometheus.HistogramVec
 	timelineSizeVec     *prometheus.HistogramVec
+	pausedGauge         prometheus.Gauge
 }
 
 func newPoller(userID, accessToken, deviceID string, client Client, receiver V2DataReceiver, logger zerolog.Logger, initialToDeviceOnly bool) *poller {
@@ -342,6 +559,7 @@ func newPoller(userID, accessToken, deviceID string, client Client, receiver V2D
 		logger:              logger,
 		wg:                  &wg,
 		initialToDeviceOnly: initialToDeviceOnly,
+		nudgeMu:             &sync.Mutex{},
 	}
 }
 
@@ -354,6 +572,26 @@ func (p *poller) Terminate() {
 	p.terminated.CompareAndSwap(false, true)
 }
 
+// Nudge cancels the current long poll so the poller polls again straight away, which reduces the time it
+// takes for the user's own actions to come down their sync stream. Initial syncs are never cancelled, and
+// nudges within minNudgeInterval of the last one are ignored.
+func (p *poller) Nudge() {
+	p.nudgeMu.Lock()
+	defer p.nudgeMu.Unlock()
+	if p.cancelPoll == nil || time.Since(p.lastNudge) < minNudgeInterval {
+		return
+	}
+	p.lastNudge = time.Now()
+	p.cancelPoll()
+	p.cancelPoll = nil
+}
+
+func (p *poller) setCancelPoll(cancel context.CancelFunc) {
+	p.nudgeMu.Lock()
+	defer p.nudgeMu.Unlock()
+	p.cancelPoll = cancel
+}
+
 // Poll will block forever, repeatedly calling v2 sync. Do this in a goroutine.
 // Returns if the access token gets invalidated or if there was a fatal error processing v2 responses.
 // Use WaitUntilInitialSync() to wait until the first poll has been processed.
@@ -373,15 +611,31 @@ func (p *poller) Poll(since string) {
 			p.logger.Warn().Str("duration", waitTime.String()).Int("fail-count", failCount).Msg("Poller: waiting before next poll")
 			timeSleep(waitTime)
 		}
+		if !firstTime {
+			// never pause the first poll as the client may be waiting for it
+			p.waitForBackpressure()
+		}
 		if p.terminated.Load() {
 			break
 		}
 		start := time.Now()
-		resp, statusCode, err := p.client.DoSyncV2(context.Background(), p.accessToken, since, firstTime, p.initialToDeviceOnly)
+		ctx, cancel := context.WithCancel(context.Background())
+		if since != "" && !firstTime {
+			p.setCancelPoll(cancel)
+		}
+		resp, statusCode, err := p.client.DoSyncV2(ctx, p.accessToken, since, firstTime, p.initialToDeviceOnly)
+		p.setCancelPoll(nil)
+		nudged := ctx.Err() != nil
+		cancel()
 		p.trackRequestDuration(time.Since(start), since == "", firstTime)
 		if p.terminated.Load() {
 			break
 		}
+		if err != nil && nudged {
+			// poll again with the same since token
+			p.logger.Trace().Msg("Poller: nudged, polling again")
+			continue
+		}
 		if err != nil {
 			// check if temporary
 			if statusCode != 401 {
@@ -402,7 +656,7 @@ func (p *poller) Poll(since string) {
 		start = time.Now()
 		failCount = 0
 		p.parseE2EEData(resp)
-		p.parseGlobalAccountData(resp)
+		p.parseAccountData(resp)
 		p.parseRoomsResponse(resp)
 		p.parseToDeviceMessages(resp)
 
@@ -410,7 +664,7 @@ func (p *poller) Poll(since string) {
 		wasFirst := firstTime
 
 		since = resp.NextBatch
-		// persist the since token (TODO: this could get slow if we hammer the DB too much)
+		// persist the since token now that its data has been written. The receiver may batch these writes.
 		p.receiver.UpdateDeviceSince(p.deviceID, since)
 
 		if firstTime {
@@ -426,6 +680,24 @@ func (p *poller) Poll(since string) {
 	}
 }
 
+// waitForBackpressure blocks whilst this poller should pause, up to maxBackpressurePause.
+func (p *poller) waitForBackpressure() {
+	if p.shouldPause == nil || !p.shouldPause() {
+		return
+	}
+	p.logger.Debug().Msg("Poller: database writes are slow, pausing low priority poller")
+	if p.pausedGauge != nil {
+		p.pausedGauge.Inc()
+		defer p.pausedGauge.Dec()
+	}
+	for waited := time.Duration(0); waited < maxBackpressurePause && !p.terminated.Load(); waited += backpressureCheckInterval {
+		timeSleep(backpressureCheckInterval)
+		if !p.shouldPause() {
+			return
+		}
+	}
+}
+
 func (p *poller) trackRequestDuration(dur time.Duration, isInitial, isFirst bool) {
 	if p.pollHistogramVec == nil {
 		return
@@ -499,11 +771,33 @@ func (p *poller) parseE2EEData(res *SyncResponse) {
 	}
 }
 
-func (p *poller) parseGlobalAccountData(res *SyncResponse) {
-	if len(res.AccountData.Events) == 0 {
+// parseAccountData sends the global and room account data in this response to the receiver in one go.
+func (p *poller) parseAccountData(res *SyncResponse) {
+	roomIDToEvents := make(map[string][]json.RawMessage)
+	if len(res.AccountData.Events) > 0 {
+		roomIDToEvents[AccountDataGlobalRoom] = res.AccountData.Events
+	}
+	for roomID, roomData := range res.Rooms.Join {
+		if len(roomData.AccountData.Events) > 0 {
+			roomIDToEvents[roomID] = roomData.AccountData.Events
+		}
+	}
+	if len(roomIDToEvents) == 0 {
 		return
 	}
-	p.receiver.OnAccountData(p.userID, AccountDataGlobalRoom, res.AccountData.Events)
+	p.receiver.OnAccountData(p.userID, roomIDToEvents)
+}
+
+// hasOwnJoin returns true if these events contain a join event for the polling user.
+func (p *poller) hasOwnJoin(events []json.RawMessage) bool {
+	for _, ev := range events {
+		parsed := gjson.ParseBytes(ev)
+		if parsed.Get("type").Str == "m.room.member" && parsed.Get("state_key").Str == p.userID &&
+			parsed.Get("content.membership").Str == "join" {
+			return true
+		}
+	}
+	return false
 }
 
 func (p *poller) parseRoomsResponse(res *SyncResponse) {
@@ -511,7 +805,12 @@ func (p *poller) parseRoomsResponse(res *SyncResponse) {
 	timelineCalls := 0
 	typingCalls := 0
 	receiptCalls := 0
+	var joinedRoomIDs []string
 	for roomID, roomData := range res.Rooms.Join {
+		// check before prepending state events to the timeline, so the join isn't counted twice
+		if p.hasOwnJoin(roomData.State.Events) || p.hasOwnJoin(roomData.Timeline.Events) {
+			joinedRoomIDs = append(joinedRoomIDs, roomID)
+		}
 		if len(roomData.State.Events) > 0 {
 			stateCalls++
 			prependStateEvents := p.receiver.Initialise(roomID, roomData.State.Events)
@@ -546,10 +845,6 @@ func (p *poller) parseRoomsResponse(res *SyncResponse) {
 			}
 		}
 
-		// process account data
-		if len(roomData.AccountData.Events) > 0 {
-			p.receiver.OnAccountData(p.userID, roomID, roomData.AccountData.Events)
-		}
 		if len(roomData.Timeline.Events) > 0 {
 			timelineCalls++
 			p.trackTimelineSize(len(roomData.Timeline.Events), roomData.Timeline.Limited)
@@ -564,6 +859,23 @@ func (p *poller) parseRoomsResponse(res *SyncResponse) {
 				roomID, p.userID, roomData.UnreadNotifications.HighlightCount, roomData.UnreadNotifications.NotificationCount,
 			)
 		}
+		if roomData.UnreadThreadNotifications != nil {
+			threadCounts := make(map[string]internal.ThreadUnreadCounts, len(roomData.UnreadThreadNotifications))
+			for threadID, counts := range roomData.UnreadThreadNotifications {
+				var tc internal.ThreadUnreadCounts
+				if counts.HighlightCount != nil {
+					tc.HighlightCount = *counts.HighlightCount
+				}
+				if counts.NotificationCount != nil {
+					tc.NotificationCount = *counts.NotificationCount
+				}
+				threadCounts[threadID] = tc
+			}
+			p.receiver.UpdateThreadUnreadCounts(roomID, p.userID, threadCounts)
+		}
+	}
+	if len(joinedRoomIDs) > 0 {
+		p.receiver.OnJoinedRooms(p.userID, joinedRoomIDs)
 	}
 	for roomID, roomData := range res.Rooms.Leave {
 		// TODO: do we care about state?
@@ -5,11 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"reflect"
 	"strconv"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/rs/zerolog"
 )
 
@@ -249,6 +251,44 @@ func TestPollerPollFromNothing(t *testing.T) {
 	}
 }
 
+// Check that global and room account data from one poll is sent to the receiver in a single call.
+func TestPollerCoalescesAccountData(t *testing.T) {
+	roomA := "!a:bar"
+	roomB := "!b:bar"
+	tagEvent := json.RawMessage(`{"type":"m.tag","content":{"tags":{}}}`)
+	pushRulesEvent := json.RawMessage(`{"type":"m.push_rules","content":{}}`)
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		if since != "" {
+			return nil, 401, fmt.Errorf("terminated")
+		}
+		var roomAResp, roomBResp, roomCResp SyncV2JoinResponse
+		roomAResp.AccountData.Events = []json.RawMessage{tagEvent}
+		roomBResp.AccountData.Events = []json.RawMessage{tagEvent}
+		res := &SyncResponse{NextBatch: "next"}
+		res.AccountData.Events = []json.RawMessage{pushRulesEvent}
+		res.Rooms.Join = map[string]SyncV2JoinResponse{
+			roomA:    roomAResp,
+			roomB:    roomBResp,
+			"!c:bar": roomCResp, // no account data
+		}
+		return res, 200, nil
+	})
+	poller := newPoller("@alice:localhost", "Authorization: hello world", "FOOBAR", client, accumulator, zerolog.New(os.Stderr), false)
+	poller.Poll("")
+
+	if len(accumulator.accountData) != 1 {
+		t.Fatalf("got %d OnAccountData calls, want 1", len(accumulator.accountData))
+	}
+	want := map[string][]json.RawMessage{
+		AccountDataGlobalRoom: {pushRulesEvent},
+		roomA:                 {tagEvent},
+		roomB:                 {tagEvent},
+	}
+	if !reflect.DeepEqual(accumulator.accountData[0], want) {
+		t.Errorf("OnAccountData: got %v want %v", accumulator.accountData[0], want)
+	}
+}
+
 // Check that a call to Poll starts polling with an existing since token and accumulates timeline entries
 func TestPollerPollFromExisting(t *testing.T) {
 	deviceID := "FOOBAR"
@@ -438,16 +478,223 @@ func TestPollerUnblocksIfTerminatedInitially(t *testing.T) {
 	}
 }
 
+// Tests that nudging a poller cancels its long poll and polls again straight away, without backing off.
+func TestPollerNudge(t *testing.T) {
+	deviceID := "FOOBAR"
+	accumulator, client := newMocks(nil)
+	longPolling := make(chan struct{}, 2)
+	var mu sync.Mutex
+	numLongPolls := 0
+	client.fnWithContext = func(ctx context.Context, authHeader, since string) (*SyncResponse, int, error) {
+		if since == "0" {
+			// the first poll can't be nudged
+			return &SyncResponse{NextBatch: "1"}, 200, nil
+		}
+		mu.Lock()
+		numLongPolls++
+		n := numLongPolls
+		mu.Unlock()
+		if n > 1 {
+			return nil, 401, fmt.Errorf("terminated")
+		}
+		longPolling <- struct{}{}
+		select {
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		case <-time.After(5 * time.Second):
+			t.Errorf("long poll was not cancelled")
+			return nil, 401, fmt.Errorf("terminated")
+		}
+	}
+	timeSleep = func(d time.Duration) {
+		t.Errorf("poller backed off for %v after being nudged", d)
+	}
+	defer func() {
+		timeSleep = time.Sleep
+	}()
+	poller := newPoller("@alice:localhost", "Authorization: hello world", deviceID, client, accumulator, zerolog.New(os.Stderr), false)
+	pollUnblocked := make(chan struct{})
+	go func() {
+		poller.Poll("0")
+		close(pollUnblocked)
+	}()
+	select {
+	case <-longPolling:
+	case <-time.After(time.Second):
+		t.Fatalf("poller did not start long polling")
+	}
+	poller.Nudge()
+	select {
+	case <-pollUnblocked:
+	case <-time.After(time.Second):
+		t.Fatalf("Poll() did not unblock")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if numLongPolls != 2 {
+		t.Errorf("got %d long polls, want 2", numLongPolls)
+	}
+	if accumulator.deviceIDToSince[deviceID] != "1" {
+		t.Errorf("got since %q want 1", accumulator.deviceIDToSince[deviceID])
+	}
+}
+
+// Tests that when one device's token expires, the user's other devices are checked and expired if their
+// tokens are also invalid.
+func TestPollerMapExpiresOtherInvalidTokens(t *testing.T) {
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		return nil, 0, fmt.Errorf("unused")
+	})
+	validTokens := map[string]bool{
+		"bob_token":     true,
+		"alice_valid_2": true,
+	}
+	client.whoami = func(authHeader string) (string, string, error) {
+		if validTokens[authHeader] {
+			return "", "", nil
+		}
+		return "", "", HTTP401
+	}
+	receiver := &expiringDataReceiver{mockDataReceiver: accumulator}
+	pm := NewPollerMap(client, false)
+	pm.SetCallbacks(receiver)
+	logger := zerolog.New(os.Stderr)
+	pm.Pollers["ALICE_1"] = newPoller("@alice:localhost", "alice_invalid_1", "ALICE_1", client, pm, logger, false)
+	pm.Pollers["ALICE_2"] = newPoller("@alice:localhost", "alice_valid_2", "ALICE_2", client, pm, logger, false)
+	pm.Pollers["ALICE_3"] = newPoller("@alice:localhost", "alice_invalid_3", "ALICE_3", client, pm, logger, false)
+	pm.Pollers["BOB"] = newPoller("@bob:localhost", "bob_token", "BOB", client, pm, logger, false)
+
+	pm.OnExpiredToken("@alice:localhost", "ALICE_1")
+
+	wantExpired := map[string]bool{
+		"ALICE_1": true,
+		"ALICE_3": true,
+	}
+	// the other tokens are checked in the background
+	start := time.Now()
+	for time.Since(start) < time.Second {
+		receiver.mu.Lock()
+		numExpired := len(receiver.expired)
+		receiver.mu.Unlock()
+		if numExpired >= len(wantExpired) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if len(receiver.expired) != len(wantExpired) {
+		t.Fatalf("got expired devices %v want %v", receiver.expired, wantExpired)
+	}
+	for _, deviceID := range receiver.expired {
+		if !wantExpired[deviceID] {
+			t.Errorf("device %v was expired but shouldn't have been", deviceID)
+		}
+	}
+	if !pm.Pollers["ALICE_3"].terminated.Load() {
+		t.Errorf("ALICE_3 poller was not terminated")
+	}
+	if pm.Pollers["ALICE_2"].terminated.Load() {
+		t.Errorf("ALICE_2 poller was terminated")
+	}
+	if pm.Pollers["BOB"].terminated.Load() {
+		t.Errorf("BOB poller was terminated")
+	}
+}
+
+// Tests that low priority pollers pause whilst database writes are slow, and resume when they recover.
+func TestPollerMapBackpressure(t *testing.T) {
+	pm := NewPollerMap(&mockClient{}, false)
+	pm.SetBackpressureThreshold(100 * time.Millisecond)
+	pm.SetLowPriorityDevices([]string{"INACTIVE"})
+	if pm.shouldPause("INACTIVE") {
+		t.Errorf("low priority poller paused before any writes")
+	}
+	for i := 0; i < 20; i++ {
+		pm.trackWriteLatency(time.Second)
+	}
+	if !pm.shouldPause("INACTIVE") {
+		t.Errorf("low priority poller did not pause when writes were slow, latency %v", pm.WriteLatency())
+	}
+	if pm.shouldPause("ACTIVE") {
+		t.Errorf("active poller paused when writes were slow")
+	}
+	for i := 0; i < 20; i++ {
+		pm.trackWriteLatency(time.Millisecond)
+	}
+	if pm.shouldPause("INACTIVE") {
+		t.Errorf("low priority poller still paused after writes recovered, latency %v", pm.WriteLatency())
+	}
+}
+
+// Tests that paused pollers check for recovery periodically, and poll anyway after maxBackpressurePause.
+func TestPollerWaitForBackpressure(t *testing.T) {
+	var slept time.Duration
+	timeSleep = func(d time.Duration) {
+		slept += d
+	}
+	defer func() {
+		timeSleep = time.Sleep
+	}()
+	accumulator, client := newMocks(nil)
+	poller := newPoller("@alice:localhost", "Authorization: hello world", "FOOBAR", client, accumulator, zerolog.New(os.Stderr), false)
+
+	// recovers after a while
+	checks := 0
+	poller.shouldPause = func() bool {
+		checks++
+		return checks <= 3
+	}
+	poller.waitForBackpressure()
+	if want := 3 * backpressureCheckInterval; slept != want {
+		t.Errorf("slept for %v want %v", slept, want)
+	}
+
+	// never recovers
+	slept = 0
+	poller.shouldPause = func() bool {
+		return true
+	}
+	poller.waitForBackpressure()
+	if slept != maxBackpressurePause {
+		t.Errorf("slept for %v want %v", slept, maxBackpressurePause)
+	}
+}
+
+type expiringDataReceiver struct {
+	*mockDataReceiver
+	mu      sync.Mutex
+	expired []string
+}
+
+func (s *expiringDataReceiver) OnExpiredToken(userID, deviceID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expired = append(s.expired, deviceID)
+}
+
 type mockClient struct {
-	fn func(authHeader, since string) (*SyncResponse, int, error)
+	fn     func(authHeader, since string) (*SyncResponse, int, error)
+	whoami func(authHeader string) (string, string, error)
+	// if set, used instead of fn
+	fnWithContext func(ctx context.Context, authHeader, since string) (*SyncResponse, int, error)
 }
 
 func (c *mockClient) DoSyncV2(ctx context.Context, authHeader, since string, isFirst, toDeviceOnly bool) (*SyncResponse, int, error) {
+	if c.fnWithContext != nil {
+		return c.fnWithContext(ctx, authHeader, since)
+	}
 	return c.fn(authHeader, since)
 }
-func (c *mockClient) WhoAmI(authHeader string) (string, string, error) {
+func (c *mockClient) WhoAmI(ctx context.Context, authHeader string) (string, string, error) {
+	if c.whoami != nil {
+		return c.whoami(authHeader)
+	}
 	return "@alice:localhost", "device_123", nil
 }
+func (c *mockClient) EventContext(ctx context.Context, authHeader, roomID, eventID string, limit int) (*ContextResponse, error) {
+	return nil, fmt.Errorf("not implemented")
+}
 
 type mockDataReceiver struct {
 	states          map[string][]json.RawMessage
@@ -455,6 +702,8 @@ type mockDataReceiver struct {
 	deviceIDToSince map[string]string
 	incomingProcess chan struct{}
 	unblockProcess  chan struct{}
+	// one entry per OnAccountData call
+	accountData []map[string][]json.RawMessage
 }
 
 func (a *mockDataReceiver) Accumulate(userID, roomID, prevBatch string, timeline []json.RawMessage) {
@@ -482,10 +731,15 @@ func (s *mockDataReceiver) AddToDeviceMessages(userID, deviceID string, msgs []j
 
 func (s *mockDataReceiver) UpdateUnreadCounts(roomID, userID string, highlightCount, notifCount *int) {
 }
-func (s *mockDataReceiver) OnAccountData(userID, roomID string, events []json.RawMessage)          {}
+func (s *mockDataReceiver) UpdateThreadUnreadCounts(roomID, userID string, threadCounts map[string]internal.ThreadUnreadCounts) {
+}
+func (s *mockDataReceiver) OnAccountData(userID string, roomIDToEvents map[string][]json.RawMessage) {
+	s.accountData = append(s.accountData, roomIDToEvents)
+}
 func (s *mockDataReceiver) OnReceipt(userID, roomID, ephEvenType string, ephEvent json.RawMessage) {}
 func (s *mockDataReceiver) OnInvite(userID, roomID string, inviteState []json.RawMessage)          {}
 func (s *mockDataReceiver) OnLeftRoom(userID, roomID string)                                       {}
+func (s *mockDataReceiver) OnJoinedRooms(userID string, roomIDs []string)                          {}
 func (s *mockDataReceiver) OnE2EEData(userID, deviceID string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) {
 }
 func (s *mockDataReceiver) OnTerminated(userID, deviceID string)   {}
@@ -11,9 +11,10 @@ import (
 	"io"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/matrix-org/sliding-sync/sqlutil"
 	"github.com/rs/zerolog"
 )
@@ -55,7 +56,24 @@ func NewStore(postgresURI, secret string) *Storage {
 		user_id TEXT NOT NULL, -- populated from /whoami
 		v2_token_encrypted TEXT NOT NULL,
 		since TEXT NOT NULL
+	);
+	-- tracks when each device last made a request to the proxy, so inactive devices can be garbage collected.
+	CREATE TABLE IF NOT EXISTS syncv3_sync2_device_activity (
+		device_id TEXT PRIMARY KEY,
+		last_seen_ts BIGINT NOT NULL,
+		archived BOOLEAN NOT NULL DEFAULT FALSE
+	);
+	-- devices whose access token expired. Their to-device messages and device data are deleted once they
+	-- have been gone for the grace period, unless they come back first.
+	CREATE TABLE IF NOT EXISTS syncv3_sync2_departed_devices (
+		device_id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		departed_at BIGINT NOT NULL
 	);`)
+	// devices which predate the activity table are treated as having been seen now.
+	db.MustExec(`
+	INSERT INTO syncv3_sync2_device_activity(device_id, last_seen_ts)
+	SELECT device_id, $1 FROM syncv3_sync2_devices ON CONFLICT (device_id) DO NOTHING`, time.Now().UnixMilli())
 
 	// derive the key from the secret
 	hash := sha256.New()
@@ -94,12 +112,12 @@ func (s *Storage) decrypt(nonceAndEncToken string) (string, error) {
 	nonce := segs[0]
 	nonceBytes, err := hex.DecodeString(nonce)
 	if err != nil {
-		return "", fmt.Errorf("decrypt nonce: failed to decode hex: %s", err)
+		return "", fmt.Errorf("decrypt nonce: failed to decode hex: %w", err)
 	}
 	encToken := segs[1]
 	ciphertext, err := hex.DecodeString(encToken)
 	if err != nil {
-		return "", fmt.Errorf("decrypt token: failed to decode hex: %s", err)
+		return "", fmt.Errorf("decrypt token: failed to decode hex: %w", err)
 	}
 	block, err := aes.NewCipher(s.key256)
 	if err != nil {
@@ -120,7 +138,7 @@ func (s *Storage) Device(deviceID string) (*Device, error) {
 	var d Device
 	err := s.db.Get(&d, `SELECT device_id, user_id, since, v2_token_encrypted FROM syncv3_sync2_devices WHERE device_id=$1`, deviceID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to lookup device '%s': %s", deviceID, err)
+		return nil, fmt.Errorf("failed to lookup device '%s': %w", deviceID, err)
 	}
 	d.AccessToken, err = s.decrypt(d.AccessTokenEncrypted)
 	return &d, err
@@ -137,14 +155,118 @@ func (s *Storage) AllDevices() (devices []Device, err error) {
 	return
 }
 
+// UnarchivedDevices returns all devices which have not been archived due to inactivity.
+func (s *Storage) UnarchivedDevices() (devices []Device, err error) {
+	err = s.db.Select(&devices, `SELECT device_id, user_id, since, v2_token_encrypted FROM syncv3_sync2_devices
+	WHERE device_id NOT IN (SELECT device_id FROM syncv3_sync2_device_activity WHERE archived)`)
+	if err != nil {
+		return
+	}
+	for i := range devices {
+		devices[i].AccessToken, _ = s.decrypt(devices[i].AccessTokenEncrypted)
+	}
+	return
+}
+
+// InactiveDevices returns all unarchived devices which have not made a request since `before`.
+// Access tokens are not decrypted.
+func (s *Storage) InactiveDevices(before time.Time) (devices []Device, err error) {
+	err = s.db.Select(&devices, `SELECT d.device_id, d.user_id, d.since, d.v2_token_encrypted
+	FROM syncv3_sync2_devices d JOIN syncv3_sync2_device_activity a ON d.device_id = a.device_id
+	WHERE NOT a.archived AND a.last_seen_ts < $1`, before.UnixMilli())
+	return
+}
+
+// CountUsers returns the number of users with a device, and how many of those have made a request since
+// `activeSince`.
+func (s *Storage) CountUsers(activeSince time.Time) (total, active int, err error) {
+	err = s.db.QueryRow(`SELECT count(DISTINCT d.user_id),
+	count(DISTINCT d.user_id) FILTER (WHERE a.last_seen_ts >= $1)
+	FROM syncv3_sync2_devices d LEFT JOIN syncv3_sync2_device_activity a ON d.device_id = a.device_id`,
+		activeSince.UnixMilli()).Scan(&total, &active)
+	return
+}
+
+// ArchiveDevice marks this device as archived and forgets its since token, so if the device comes back
+// it will do an initial sync to rehydrate its data. The device is only archived if it has not made a
+// request since `before`, as it may have come back since it was returned by InactiveDevices. Returns
+// true if the device was archived.
+func (s *Storage) ArchiveDevice(deviceID string, before time.Time) (archived bool, err error) {
+	err = sqlutil.WithTransaction(s.db, func(txn *sqlx.Tx) error {
+		res, err := txn.Exec(`UPDATE syncv3_sync2_device_activity SET archived = TRUE
+		WHERE device_id = $1 AND NOT archived AND last_seen_ts < $2`, deviceID, before.UnixMilli())
+		if err != nil {
+			return err
+		}
+		ra, err := res.RowsAffected()
+		if err != nil || ra == 0 {
+			return err
+		}
+		archived = true
+		_, err = txn.Exec(`UPDATE syncv3_sync2_devices SET since = '' WHERE device_id = $1`, deviceID)
+		return err
+	})
+	return archived && err == nil, err
+}
+
+// UserHasUnarchivedDevices returns true if this user has at least one device which has not been archived.
+func (s *Storage) UserHasUnarchivedDevices(userID string) (exists bool, err error) {
+	err = s.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM syncv3_sync2_devices d
+	JOIN syncv3_sync2_device_activity a ON d.device_id = a.device_id WHERE d.user_id = $1 AND NOT a.archived)`,
+		userID).Scan(&exists)
+	return
+}
+
 func (s *Storage) RemoveDevice(deviceID string) error {
 	_, err := s.db.Exec(
 		`DELETE FROM syncv3_sync2_devices WHERE device_id = $1`, deviceID,
 	)
+	if err == nil {
+		_, err = s.db.Exec(`DELETE FROM syncv3_sync2_device_activity WHERE device_id = $1`, deviceID)
+	}
 	log.Info().Str("device", deviceID).Msg("Deleting device")
 	return err
 }
 
+// MarkDeviceDeparted records that this device's access token expired at `departedAt`. If the device
+// was already marked, the earlier time is kept.
+func (s *Storage) MarkDeviceDeparted(userID, deviceID string, departedAt time.Time) error {
+	_, err := s.db.Exec(`INSERT INTO syncv3_sync2_departed_devices(device_id, user_id, departed_at) VALUES($1,$2,$3)
+	ON CONFLICT (device_id) DO NOTHING`, deviceID, userID, departedAt.UnixMilli())
+	return err
+}
+
+// UnmarkDeviceDeparted forgets that this device departed, as it has come back. Returns true if the device
+// was marked as departed.
+func (s *Storage) UnmarkDeviceDeparted(deviceID string) (bool, error) {
+	res, err := s.db.Exec(`DELETE FROM syncv3_sync2_departed_devices WHERE device_id = $1`, deviceID)
+	if err != nil {
+		return false, err
+	}
+	ra, err := res.RowsAffected()
+	return ra > 0, err
+}
+
+// DepartedDevicesBefore returns the devices which departed before `before`. Access tokens are not returned.
+func (s *Storage) DepartedDevicesBefore(before time.Time) (devices []Device, err error) {
+	err = s.db.Select(&devices, `SELECT device_id, user_id FROM syncv3_sync2_departed_devices WHERE departed_at < $1`,
+		before.UnixMilli())
+	return
+}
+
+// ClaimDepartedDevice forgets that this device departed if it departed before `before`, returning true if
+// it did. Only delete the device's data if this returns true, as the device may have come back since it
+// was returned by DepartedDevicesBefore.
+func (s *Storage) ClaimDepartedDevice(deviceID string, before time.Time) (bool, error) {
+	res, err := s.db.Exec(`DELETE FROM syncv3_sync2_departed_devices WHERE device_id = $1 AND departed_at < $2`,
+		deviceID, before.UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	ra, err := res.RowsAffected()
+	return ra > 0, err
+}
+
 func (s *Storage) InsertDevice(deviceID, accessToken string) (*Device, error) {
 	var device Device
 	device.AccessToken = accessToken
@@ -162,6 +284,19 @@ func (s *Storage) InsertDevice(deviceID, accessToken string) (*Device, error) {
 		}
 		device.DeviceID = deviceID
 
+		// bump the last seen time, unarchiving the device if need be. To avoid a write on every request,
+		// this is only done if the last seen time is over an hour old.
+		now := time.Now()
+		_, err = txn.Exec(`
+			INSERT INTO syncv3_sync2_device_activity(device_id, last_seen_ts) VALUES($1,$2)
+			ON CONFLICT (device_id) DO UPDATE SET last_seen_ts = $2, archived = FALSE
+			WHERE syncv3_sync2_device_activity.archived OR syncv3_sync2_device_activity.last_seen_ts < $3`,
+			deviceID, now.UnixMilli(), now.Add(-time.Hour).UnixMilli(),
+		)
+		if err != nil {
+			return err
+		}
+
 		// if we inserted a row that means it's a brand new device ergo there is no since token
 		if ra, err := result.RowsAffected(); err == nil && ra == 1 {
 			return nil
@@ -174,7 +309,27 @@ func (s *Storage) InsertDevice(deviceID, accessToken string) (*Device, error) {
 }
 
 func (s *Storage) UpdateDeviceSince(deviceID, since string) error {
-	_, err := s.db.Exec(`UPDATE syncv3_sync2_devices SET since = $1 WHERE device_id = $2`, since, deviceID)
+	// don't resurrect the since token of an archived device, else it won't rehydrate when it returns.
+	_, err := s.db.Exec(`UPDATE syncv3_sync2_devices SET since = $1 WHERE device_id = $2 AND device_id NOT IN (
+		SELECT device_id FROM syncv3_sync2_device_activity WHERE archived
+	)`, since, deviceID)
+	return err
+}
+
+// UpdateDeviceSinces sets the since tokens of many devices in one query, keyed on device ID. Like
+// UpdateDeviceSince, archived devices are not updated.
+func (s *Storage) UpdateDeviceSinces(deviceIDToSince map[string]string) error {
+	deviceIDs := make([]string, 0, len(deviceIDToSince))
+	sinces := make([]string, 0, len(deviceIDToSince))
+	for deviceID, since := range deviceIDToSince {
+		deviceIDs = append(deviceIDs, deviceID)
+		sinces = append(sinces, since)
+	}
+	_, err := s.db.Exec(`UPDATE syncv3_sync2_devices AS d SET since = u.since
+	FROM unnest($1::text[], $2::text[]) AS u(device_id, since)
+	WHERE d.device_id = u.device_id AND d.device_id NOT IN (
+		SELECT device_id FROM syncv3_sync2_device_activity WHERE archived
+	)`, pq.StringArray(deviceIDs), pq.StringArray(sinces))
 	return err
 }
 
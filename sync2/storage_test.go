@@ -4,6 +4,7 @@ import (
 	"os"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/sliding-sync/testutils"
 )
@@ -87,3 +88,220 @@ func assertEqual(t *testing.T, got, want, msg string) {
 		t.Fatalf("%s: got %s want %s", msg, got, want)
 	}
 }
+
+func TestStorageInactiveDevices(t *testing.T) {
+	store := NewStore(postgresConnectionString, "my_secret")
+	deviceID := "TestStorageInactiveDevices"
+	userID := "@TestStorageInactiveDevices:localhost"
+	if _, err := store.InsertDevice(deviceID, "token"); err != nil {
+		t.Fatalf("InsertDevice: %s", err)
+	}
+	if err := store.UpdateUserIDForDevice(deviceID, userID); err != nil {
+		t.Fatalf("UpdateUserIDForDevice: %s", err)
+	}
+	if err := store.UpdateDeviceSince(deviceID, "s1"); err != nil {
+		t.Fatalf("UpdateDeviceSince: %s", err)
+	}
+	isInactive := func(before time.Time) bool {
+		t.Helper()
+		devices, err := store.InactiveDevices(before)
+		if err != nil {
+			t.Fatalf("InactiveDevices: %s", err)
+		}
+		for _, d := range devices {
+			if d.DeviceID == deviceID {
+				return true
+			}
+		}
+		return false
+	}
+	if isInactive(time.Now().Add(-time.Minute)) {
+		t.Fatalf("device was inactive despite just being inserted")
+	}
+	if !isInactive(time.Now().Add(time.Minute)) {
+		t.Fatalf("device was not inactive")
+	}
+	// devices which made a request after the cutoff are not archived
+	archived, err := store.ArchiveDevice(deviceID, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("ArchiveDevice: %s", err)
+	}
+	if archived {
+		t.Fatalf("ArchiveDevice archived a device which made a request after the cutoff")
+	}
+	if !isInactive(time.Now().Add(time.Minute)) {
+		t.Fatalf("device was not inactive after a failed archive")
+	}
+	device, err := store.Device(deviceID)
+	if err != nil {
+		t.Fatalf("Device: %s", err)
+	}
+	assertEqual(t, device.Since, "s1", "since token was forgotten by a failed archive")
+	archived, err = store.ArchiveDevice(deviceID, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("ArchiveDevice: %s", err)
+	}
+	if !archived {
+		t.Fatalf("ArchiveDevice did not archive an inactive device")
+	}
+	if isInactive(time.Now().Add(time.Minute)) {
+		t.Fatalf("archived device was returned as inactive")
+	}
+	hasDevices, err := store.UserHasUnarchivedDevices(userID)
+	if err != nil {
+		t.Fatalf("UserHasUnarchivedDevices: %s", err)
+	}
+	if hasDevices {
+		t.Fatalf("UserHasUnarchivedDevices: got true want false")
+	}
+
+	// the device returns: it should be unarchived and do an initial sync
+	device, err = store.InsertDevice(deviceID, "token")
+	if err != nil {
+		t.Fatalf("InsertDevice: %s", err)
+	}
+	assertEqual(t, device.Since, "", "Device.Since mismatch")
+	hasDevices, err = store.UserHasUnarchivedDevices(userID)
+	if err != nil {
+		t.Fatalf("UserHasUnarchivedDevices: %s", err)
+	}
+	if !hasDevices {
+		t.Fatalf("UserHasUnarchivedDevices: got false want true")
+	}
+}
+
+func TestStorageCountUsers(t *testing.T) {
+	store := NewStore(postgresConnectionString, "my_secret")
+	countUsers := func(activeSince time.Time) (int, int) {
+		t.Helper()
+		total, active, err := store.CountUsers(activeSince)
+		if err != nil {
+			t.Fatalf("CountUsers: %s", err)
+		}
+		return total, active
+	}
+	totalBefore, _ := countUsers(time.Now().Add(-time.Minute))
+	_, activeInFutureBefore := countUsers(time.Now().Add(time.Minute))
+	// two devices for the same user count once
+	userID := "@TestStorageCountUsers:localhost"
+	for _, deviceID := range []string{"TestStorageCountUsers_A", "TestStorageCountUsers_B"} {
+		if _, err := store.InsertDevice(deviceID, "token_"+deviceID); err != nil {
+			t.Fatalf("InsertDevice: %s", err)
+		}
+		if err := store.UpdateUserIDForDevice(deviceID, userID); err != nil {
+			t.Fatalf("UpdateUserIDForDevice: %s", err)
+		}
+	}
+	total, active := countUsers(time.Now().Add(-time.Minute))
+	if total != totalBefore+1 {
+		t.Errorf("got %d total users, want %d", total, totalBefore+1)
+	}
+	if active < 1 {
+		t.Errorf("got %d active users, want at least 1", active)
+	}
+	if _, activeInFuture := countUsers(time.Now().Add(time.Minute)); activeInFuture != activeInFutureBefore {
+		t.Errorf("got %d users active in the future, want %d", activeInFuture, activeInFutureBefore)
+	}
+}
+
+func TestStorageUpdateDeviceSinces(t *testing.T) {
+	store := NewStore(postgresConnectionString, "my_secret")
+	deviceA := "TestStorageUpdateDeviceSinces_A"
+	deviceB := "TestStorageUpdateDeviceSinces_B"
+	archived := "TestStorageUpdateDeviceSinces_archived"
+	for _, deviceID := range []string{deviceA, deviceB, archived} {
+		if _, err := store.InsertDevice(deviceID, "token_"+deviceID); err != nil {
+			t.Fatalf("InsertDevice: %s", err)
+		}
+	}
+	if _, err := store.ArchiveDevice(archived, time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("ArchiveDevice: %s", err)
+	}
+	err := store.UpdateDeviceSinces(map[string]string{
+		deviceA:   "a1",
+		deviceB:   "b1",
+		archived:  "x1",
+		"unknown": "u1",
+	})
+	if err != nil {
+		t.Fatalf("UpdateDeviceSinces: %s", err)
+	}
+	for deviceID, want := range map[string]string{deviceA: "a1", deviceB: "b1", archived: ""} {
+		device, err := store.Device(deviceID)
+		if err != nil {
+			t.Fatalf("Device: %s", err)
+		}
+		assertEqual(t, device.Since, want, "Device.Since mismatch for "+deviceID)
+	}
+}
+
+func TestStorageDepartedDevices(t *testing.T) {
+	store := NewStore(postgresConnectionString, "my_secret")
+	deviceID := "TestStorageDepartedDevices"
+	userID := "@TestStorageDepartedDevices:localhost"
+	departedAt := time.Now()
+	isDeparted := func(before time.Time) bool {
+		t.Helper()
+		devices, err := store.DepartedDevicesBefore(before)
+		if err != nil {
+			t.Fatalf("DepartedDevicesBefore: %s", err)
+		}
+		for _, d := range devices {
+			if d.DeviceID == deviceID {
+				assertEqual(t, d.UserID, userID, "departed device has the wrong user ID")
+				return true
+			}
+		}
+		return false
+	}
+	if err := store.MarkDeviceDeparted(userID, deviceID, departedAt); err != nil {
+		t.Fatalf("MarkDeviceDeparted: %s", err)
+	}
+	// marking it again keeps the earlier time
+	if err := store.MarkDeviceDeparted(userID, deviceID, departedAt.Add(time.Hour)); err != nil {
+		t.Fatalf("MarkDeviceDeparted: %s", err)
+	}
+	if isDeparted(departedAt.Add(-time.Minute)) {
+		t.Fatalf("device departed before it was marked")
+	}
+	if !isDeparted(departedAt.Add(time.Minute)) {
+		t.Fatalf("device was not departed")
+	}
+
+	// devices which came back are not claimed
+	claimed, err := store.ClaimDepartedDevice(deviceID, departedAt.Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("ClaimDepartedDevice: %s", err)
+	}
+	if claimed {
+		t.Fatalf("claimed a device before it departed")
+	}
+	departed, err := store.UnmarkDeviceDeparted(deviceID)
+	if err != nil {
+		t.Fatalf("UnmarkDeviceDeparted: %s", err)
+	}
+	if !departed {
+		t.Fatalf("UnmarkDeviceDeparted returned false for a departed device")
+	}
+	claimed, err = store.ClaimDepartedDevice(deviceID, departedAt.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("ClaimDepartedDevice: %s", err)
+	}
+	if claimed {
+		t.Fatalf("claimed a device which came back")
+	}
+
+	if err := store.MarkDeviceDeparted(userID, deviceID, departedAt); err != nil {
+		t.Fatalf("MarkDeviceDeparted: %s", err)
+	}
+	claimed, err = store.ClaimDepartedDevice(deviceID, departedAt.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("ClaimDepartedDevice: %s", err)
+	}
+	if !claimed {
+		t.Fatalf("did not claim a departed device")
+	}
+	if isDeparted(departedAt.Add(time.Minute)) {
+		t.Fatalf("claimed device is still departed")
+	}
+}
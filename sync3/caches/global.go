@@ -3,19 +3,28 @@ package caches
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"hash/fnv"
 	"os"
 	"sort"
 	"sync"
+	"time"
 
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/state"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 )
 
 const PosAlwaysProcess = -2
 const PosDoNotProcess = -1
 
+// The number of times to try reloading an evicted room whilst new events for it keep arriving.
+const maxReloadAttempts = 3
+
 type EventData struct {
 	Event     json.RawMessage
 	RoomID    string
@@ -49,27 +58,306 @@ var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.C
 // The purpose of global cache is to store global-level information about all rooms the server is aware of.
 // Global-level information is represented as internal.RoomMetadata and includes things like Heroes, join/invite
 // counts, if the room is encrypted, etc. Basically anything that is the same for all users of the system. This
-// information is populated at startup from the database and then kept up-to-date by hooking into the
-// Dispatcher for new events.
+// information is populated at startup from the database (or lazily, see SetLazyLoading) and then kept
+// up-to-date by hooking into the Dispatcher for new events.
 type GlobalCache struct {
 	LoadJoinedRoomsOverride func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, err error)
 
 	// inserts are done by v2 poll loops, selects are done by v3 request threads
 	// there are lots of overlapping keys as many users (threads) can be joined to the same room (key)
-	// hence you must lock this with `mu` before r/w
-	roomIDToMetadata   map[string]*internal.RoomMetadata
-	roomIDToMetadataMu *sync.RWMutex
+	// hence rooms are split across shards, each with their own lock. See roomShard.
+	shards [numRoomShards]*roomShard
+	// If set, bounds the number of rooms held in memory. Rooms which haven't been used recently are
+	// evicted and reloaded from the database when next loaded. See SetMaxRooms.
+	// Never use the LRU whilst holding a shard lock, as evicting a room locks that room's shard.
+	lru *lru.Cache
+	// If true, rooms which aren't held in memory are loaded from the database when first used. See SetLazyLoading.
+	lazy bool
+	// If true, RoomMetadata.ContentHints are updated with new messages. See SetContentHints.
+	contentHints bool
+
+	// Decides which events update a room's LastMessageTimestamp. If nil, all events do.
+	LatestEventFilter *internal.LatestEventFilter
+	// The state event types whose content is kept in RoomMetadata.IndexedState. See SetIndexedStateTypes.
+	indexedStateTypes map[string]bool
+	// If set, used to exclude functional members from member counts. See SetMembershipTracker.
+	memberships MembershipTracker
 
 	// for loading room state not held in-memory TODO: remove to another struct along with associated functions
 	store *state.Storage
+	// room ID -> *cachedRoomState, for the rooms whose required_state was loaded most recently.
+	roomState *lru.Cache
+
+	// nil unless AddPrometheusMetrics is called
+	lookups     *prometheus.CounterVec
+	evictions   *prometheus.CounterVec
+	numRooms    prometheus.GaugeFunc
+	cachedBytes prometheus.GaugeFunc
+}
+
+// The number of shards rooms are split across. Pollers and request threads mostly touch different rooms,
+// so this reduces how often they wait on each other.
+const numRoomShards = 32
+
+// roomShard holds the rooms whose hashed room ID falls into this shard. You must lock `mu` before r/w.
+type roomShard struct {
+	mu       sync.RWMutex
+	metadata map[string]*internal.RoomMetadata
+	// evicted room ID -> the number of events received for this room since it was evicted.
+	evicted map[string]int
+	// room ID -> closed when the room has finished loading, so concurrent loads of the same room are only
+	// done once.
+	loading map[string]chan struct{}
+	// room ID -> the events most recently received in the room. See SeenEvent. When the number of rooms is
+	// bounded, only rooms in `metadata` have an entry, and it is removed when the room is evicted.
+	recentEvents map[string]*recentEvents
+}
+
+// The number of event IDs per room to remember for de-duplication.
+const recentEventsPerRoom = 32
+
+// recentEvents is a ring buffer of hashed event IDs. Hashes are used rather than event IDs to keep the
+// memory used per room small.
+type recentEvents struct {
+	hashes [recentEventsPerRoom]uint64
+	next   int
 }
 
 func NewGlobalCache(store *state.Storage) *GlobalCache {
-	return &GlobalCache{
-		roomIDToMetadataMu: &sync.RWMutex{},
-		store:              store,
-		roomIDToMetadata:   make(map[string]*internal.RoomMetadata),
+	c := &GlobalCache{
+		store: store,
 	}
+	c.roomState, _ = lru.New(roomStateCacheSize)
+	for i := range c.shards {
+		c.shards[i] = &roomShard{
+			metadata:     make(map[string]*internal.RoomMetadata),
+			evicted:      make(map[string]int),
+			loading:      make(map[string]chan struct{}),
+			recentEvents: make(map[string]*recentEvents),
+		}
+	}
+	if store != nil {
+		c.LatestEventFilter = store.LatestEventFilter
+		c.SetIndexedStateTypes(store.IndexedStateTypes)
+	}
+	return c
+}
+
+// SetIndexedStateTypes sets the custom state event types whose current content is kept in room metadata,
+// so it can be used without loading room state. Must be called before any events are received. Rooms
+// loaded from the database include these types if they are also set in state.Storage.IndexedStateTypes.
+func (c *GlobalCache) SetIndexedStateTypes(evTypes []string) {
+	c.indexedStateTypes = make(map[string]bool, len(evTypes))
+	for _, evType := range evTypes {
+		c.indexedStateTypes[evType] = true
+	}
+}
+
+// shard returns the shard which holds this room.
+func (c *GlobalCache) shard(roomID string) *roomShard {
+	return c.shards[shardIndex(roomID)]
+}
+
+func shardIndex(roomID string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(roomID))
+	return h.Sum32() % numRoomShards
+}
+
+// SeenEvent remembers that this event was received in this room, and returns true if it was already received
+// recently. Pollers can deliver the same event more than once e.g after reconnecting, which would otherwise
+// bump the room twice and send the event to clients twice. Only the last recentEventsPerRoom events are
+// remembered per room. If SetMaxRooms was called, events are only remembered for rooms the cache holds, so
+// the memory used is bounded in the same way as room metadata.
+func (c *GlobalCache) SeenEvent(roomID, eventID string) bool {
+	if eventID == "" {
+		return false
+	}
+	h := fnv.New64a()
+	h.Write([]byte(eventID))
+	hash := h.Sum64()
+	s := c.shard(roomID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	recent := s.recentEvents[roomID]
+	if recent == nil {
+		if c.lru != nil && s.metadata[roomID] == nil {
+			return false
+		}
+		recent = &recentEvents{}
+		s.recentEvents[roomID] = recent
+	}
+	for _, seen := range recent.hashes {
+		if seen == hash {
+			return true
+		}
+	}
+	recent.hashes[recent.next] = hash
+	recent.next = (recent.next + 1) % recentEventsPerRoom
+	return false
+}
+
+// SetMaxRooms bounds the number of rooms the cache holds metadata for, so the memory used doesn't grow
+// with the number of rooms on the server. Rooms which haven't been used recently are evicted, and reloaded
+// from the database when next needed. Must be called before Startup.
+func (c *GlobalCache) SetMaxRooms(maxRooms int) {
+	if maxRooms <= 0 {
+		return
+	}
+	c.lru, _ = lru.NewWithEvict(maxRooms, func(key, _ interface{}) {
+		roomID := key.(string)
+		s := c.shard(roomID)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.metadata, roomID)
+		delete(s.recentEvents, roomID)
+		s.evicted[roomID] = 0
+		c.recordEviction(metricsCacheRooms)
+	})
+}
+
+// SetLazyLoading makes the cache load a room's metadata from the database the first time it is needed,
+// rather than being given the metadata for every room in Startup. Must be called before Startup.
+func (c *GlobalCache) SetLazyLoading() {
+	c.lazy = true
+}
+
+// SetContentHints makes the cache derive RoomMetadata.ContentHints from new messages. This is cheap, but
+// costs a little CPU for every message so is off by default. Must be called before any events are received.
+func (c *GlobalCache) SetContentHints() {
+	c.contentHints = true
+}
+
+// ContentHintsEnabled returns true if SetContentHints was called.
+func (c *GlobalCache) ContentHintsEnabled() bool {
+	return c.contentHints
+}
+
+// markUsed marks the room as recently used, which may evict another room. Must not hold any shard locks.
+func (c *GlobalCache) markUsed(roomID string) {
+	if c.lru != nil {
+		c.lru.Add(roomID, nil)
+	}
+}
+
+// ReloadRoom replaces the metadata held for this room with the metadata in the database, e.g if the metadata
+// held in memory is wrong. The current metadata is used until the reload finishes. Returns an error wrapping
+// internal.ErrRoomNotFound if the room isn't in the database.
+func (c *GlobalCache) ReloadRoom(ctx context.Context, roomID string) error {
+	s := c.shard(roomID)
+	s.mu.Lock()
+	_, wasEvicted := s.evicted[roomID]
+	if !wasEvicted {
+		// reload it in the same way as an evicted room, so events which arrive whilst loading aren't lost
+		s.evicted[roomID] = 0
+	}
+	s.mu.Unlock()
+	c.InvalidateRoomState(roomID)
+	_, err := c.reloadRooms(ctx, []string{roomID})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.evicted[roomID]; !ok && s.metadata[roomID] != nil {
+		return nil
+	}
+	// the room wasn't reloaded, so carry on using the metadata we have
+	if !wasEvicted {
+		delete(s.evicted, roomID)
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("reload %s: %w", roomID, internal.ErrRoomNotFound)
+}
+
+// reloadEvictedRooms loads the metadata for any of the given rooms which have been evicted, or which have
+// not been loaded yet when lazy loading. If another goroutine is already loading a room, this waits for it
+// rather than loading the room again. Returns the number of rooms loaded from the database.
+func (c *GlobalCache) reloadEvictedRooms(ctx context.Context, roomIDs []string) (numLoaded int) {
+	if c.lru == nil && !c.lazy {
+		return 0
+	}
+	numLoaded, err := c.reloadRooms(ctx, roomIDs)
+	if err != nil {
+		logger.Err(err).Msg("failed to reload evicted rooms")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+	}
+	return numLoaded
+}
+
+// reloadRooms loads the metadata for any of the given rooms which are marked as evicted. See reloadEvictedRooms.
+func (c *GlobalCache) reloadRooms(ctx context.Context, roomIDs []string) (numLoaded int, err error) {
+	var waitFor []chan struct{}
+	toLoad := roomIDs
+	for attempt := 0; attempt < maxReloadAttempts && len(toLoad) > 0; attempt++ {
+		// remember how many events each room has had, so we can tell if any arrived whilst loading
+		numEvents := make(map[string]int)
+		var evictedRoomIDs []string
+		for _, roomID := range toLoad {
+			s := c.shard(roomID)
+			s.mu.Lock()
+			if _, ok := s.evicted[roomID]; !ok && c.lazy && s.metadata[roomID] == nil {
+				// never loaded, so load it in the same way as an evicted room
+				s.evicted[roomID] = 0
+			}
+			if n, ok := s.evicted[roomID]; ok {
+				if ch, ok := s.loading[roomID]; ok {
+					waitFor = append(waitFor, ch)
+				} else {
+					s.loading[roomID] = make(chan struct{})
+					numEvents[roomID] = n
+					evictedRoomIDs = append(evictedRoomIDs, roomID)
+				}
+			}
+			s.mu.Unlock()
+		}
+		if len(evictedRoomIDs) == 0 {
+			break
+		}
+		dbStart := time.Now()
+		var metadatas map[string]internal.RoomMetadata
+		metadatas, err = c.store.MetadataForRooms(evictedRoomIDs)
+		internal.TrackDBTime(ctx, dbStart)
+		toLoad = nil
+		var loaded []string
+		for _, roomID := range evictedRoomIDs {
+			s := c.shard(roomID)
+			s.mu.Lock()
+			close(s.loading[roomID])
+			delete(s.loading, roomID)
+			n, ok := s.evicted[roomID]
+			metadata, found := metadatas[roomID]
+			switch {
+			case err != nil || !ok:
+				// failed, or someone else reloaded it
+			case n != numEvents[roomID] && attempt < maxReloadAttempts-1:
+				// events which arrived whilst loading may not be in the loaded metadata, so try again
+				toLoad = append(toLoad, roomID)
+			case !found:
+				// the room doesn't exist, so stop tracking it unless we have metadata for it already e.g
+				// from ReloadRoom, which then decides what to do
+				if s.metadata[roomID] == nil {
+					delete(s.evicted, roomID)
+				}
+			default:
+				delete(s.evicted, roomID)
+				s.metadata[roomID] = &metadata
+				loaded = append(loaded, roomID)
+			}
+			s.mu.Unlock()
+		}
+		numLoaded += len(loaded)
+		for _, roomID := range loaded {
+			c.markUsed(roomID)
+		}
+		if err != nil {
+			err = fmt.Errorf("failed to load metadata for %d rooms: %s", len(evictedRoomIDs), err)
+			break
+		}
+	}
+	for _, ch := range waitFor {
+		<-ch
+	}
+	return numLoaded, err
 }
 
 func (c *GlobalCache) OnRegistered(_ context.Context, _ int64) error {
@@ -80,23 +368,49 @@ func (c *GlobalCache) OnRegistered(_ context.Context, _ int64) error {
 // Always returns copies of the room metadata so ownership can be passed to other threads.
 // Keeps the ordering of the room IDs given.
 func (c *GlobalCache) LoadRooms(ctx context.Context, roomIDs ...string) map[string]*internal.RoomMetadata {
-	c.roomIDToMetadataMu.RLock()
-	defer c.roomIDToMetadataMu.RUnlock()
+	numLoaded := c.reloadEvictedRooms(ctx, roomIDs)
+	// group the rooms by shard so each shard is locked once, rather than once per room. This matters when
+	// loading all of a user's rooms for their lists.
+	var shardToRoomIDs [numRoomShards][]string
+	for _, roomID := range roomIDs {
+		i := shardIndex(roomID)
+		shardToRoomIDs[i] = append(shardToRoomIDs[i], roomID)
+	}
 	result := make(map[string]*internal.RoomMetadata, len(roomIDs))
-	for i := range roomIDs {
-		roomID := roomIDs[i]
-		sr := c.roomIDToMetadata[roomID]
-		if sr == nil {
-			logger.Warn().Str("room", roomID).Msg("GlobalCache.LoadRoom: no metadata for this room")
+	var missing []string
+	for i, shardRoomIDs := range shardToRoomIDs {
+		if len(shardRoomIDs) == 0 {
 			continue
 		}
-		srCopy := *sr
-		// copy the heroes or else we may modify the same slice which would be bad :(
-		srCopy.Heroes = make([]internal.Hero, len(sr.Heroes))
-		for i := range sr.Heroes {
-			srCopy.Heroes[i] = sr.Heroes[i]
+		s := c.shards[i]
+		s.mu.RLock()
+		for _, roomID := range shardRoomIDs {
+			sr := s.metadata[roomID]
+			if sr == nil {
+				missing = append(missing, roomID)
+				continue
+			}
+			// The copy is a snapshot: the cache replaces the slices and maps in the metadata rather than
+			// modifying them, so they can be shared with the copy. Cap the heroes so appending to the copy's
+			// heroes can't write into the cache's array.
+			srCopy := *sr
+			srCopy.Heroes = sr.Heroes[:len(sr.Heroes):len(sr.Heroes)]
+			result[roomID] = &srCopy
+		}
+		s.mu.RUnlock()
+	}
+	for _, metadata := range result {
+		c.excludeFunctionalMembers(metadata)
+	}
+	if len(missing) > 0 {
+		logger.Warn().Strs("rooms", missing).Msg("GlobalCache.LoadRooms: no metadata for these rooms")
+	}
+	// rooms loaded from the database are misses, even though they are in memory now
+	c.recordLookups(metricsCacheRooms, len(result)-numLoaded, len(missing)+numLoaded)
+	if c.lru != nil {
+		for roomID := range result {
+			c.lru.Get(roomID) // mark as recently used
 		}
-		result[roomID] = &srCopy
 	}
 	return result
 }
@@ -107,6 +421,7 @@ func (c *GlobalCache) LoadJoinedRooms(ctx context.Context, userID string) (pos i
 	if c.LoadJoinedRoomsOverride != nil {
 		return c.LoadJoinedRoomsOverride(userID)
 	}
+	defer internal.TrackDBTime(ctx, time.Now())
 	initialLoadPosition, err := c.store.LatestEventNID()
 	if err != nil {
 		return 0, nil, err
@@ -121,6 +436,7 @@ func (c *GlobalCache) LoadJoinedRooms(ctx context.Context, userID string) (pos i
 }
 
 func (c *GlobalCache) LoadStateEvent(ctx context.Context, roomID string, loadPosition int64, evType, stateKey string) json.RawMessage {
+	defer internal.TrackDBTime(ctx, time.Now())
 	roomIDToStateEvents, err := c.store.RoomStateAfterEventPosition(ctx, []string{roomID}, loadPosition, map[string][]string{
 		evType: {stateKey},
 	})
@@ -136,7 +452,8 @@ func (c *GlobalCache) LoadStateEvent(ctx context.Context, roomID string, loadPos
 	return nil
 }
 
-// TODO: remove? Doesn't touch global cache fields
+// LoadRoomState returns the required state of each room as of loadPosition. Required state which only lists
+// exact (type, state key) pairs is served from memory where possible.
 func (c *GlobalCache) LoadRoomState(ctx context.Context, roomIDs []string, loadPosition int64, requiredStateMap *internal.RequiredStateMap, roomToUsersInTimeline map[string][]string) map[string][]json.RawMessage {
 	if c.store == nil {
 		return nil
@@ -145,32 +462,104 @@ func (c *GlobalCache) LoadRoomState(ctx context.Context, roomIDs []string, loadP
 		return nil
 	}
 	resultMap := make(map[string][]json.RawMessage, len(roomIDs))
-	roomIDToStateEvents, err := c.store.RoomStateAfterEventPosition(ctx, roomIDs, loadPosition, requiredStateMap.QueryStateMap())
+	var roomIDToStateEvents map[string][]state.Event
+	var err error
+	if tuples, ok := requiredStateMap.ExactStateTuples(); ok {
+		// e.g pinned rooms asking for their name and avatar on every request, which we can serve from memory
+		roomIDToStateEvents, err = c.loadStateTuples(ctx, roomIDs, loadPosition, tuples)
+	} else {
+		dbStart := time.Now()
+		roomIDToStateEvents, err = c.store.RoomStateAfterEventPosition(ctx, roomIDs, loadPosition, requiredStateMap.QueryStateMap())
+		internal.TrackDBTime(ctx, dbStart)
+		if essential := requiredStateMap.EssentialStateTuples(); err == nil && len(essential) > 0 {
+			// the essential state is served from memory even when the rest has to come from the database
+			var essentialEvents map[string][]state.Event
+			essentialEvents, err = c.loadStateTuples(ctx, roomIDs, loadPosition, essential)
+			if err == nil {
+				roomIDToStateEvents = mergeStateEvents(roomIDToStateEvents, essentialEvents)
+			}
+		}
+	}
 	if err != nil {
 		logger.Err(err).Strs("rooms", roomIDs).Int64("pos", loadPosition).Msg("failed to load room state")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		return nil
 	}
 	for roomID, stateEvents := range roomIDToStateEvents {
+		sharedNames := sharedDisplayNames(stateEvents)
 		var result []json.RawMessage
 		for _, ev := range stateEvents {
-			if requiredStateMap.Include(ev.Type, ev.StateKey) {
-				result = append(result, ev.JSON)
-			} else if requiredStateMap.IsLazyLoading() {
-				usersInTimeline := roomToUsersInTimeline[roomID]
-				for _, userID := range usersInTimeline {
+			include := requiredStateMap.Include(ev.Type, ev.StateKey)
+			if !include && requiredStateMap.IsLazyLoading() {
+				for _, userID := range roomToUsersInTimeline[roomID] {
 					if ev.StateKey == userID {
-						result = append(result, ev.JSON)
+						include = true
+						break
 					}
 				}
 			}
+			if !include {
+				continue
+			}
+			if ev.Type == "m.room.member" && len(sharedNames) > 0 {
+				result = append(result, annotateDisambiguatedName(ctx, ev, sharedNames))
+			} else {
+				result = append(result, ev.JSON)
+			}
 		}
 		resultMap[roomID] = result
 	}
-	// TODO: cache?
 	return resultMap
 }
 
+// sharedDisplayNames returns the display names which are used by more than one joined or invited member
+// in these state events. When lazy loading, all member events are loaded so this considers the whole room.
+// Otherwise, only the members requested are considered.
+func sharedDisplayNames(stateEvents []state.Event) map[string]struct{} {
+	counts := make(map[string]int)
+	for _, ev := range stateEvents {
+		if ev.Type != "m.room.member" {
+			continue
+		}
+		content := gjson.GetBytes(ev.JSON, "content")
+		membership := content.Get("membership").Str
+		name := content.Get("displayname").Str
+		if name == "" || (membership != "join" && membership != "invite") {
+			continue
+		}
+		counts[name]++
+	}
+	var shared map[string]struct{}
+	for name, count := range counts {
+		if count < 2 {
+			continue
+		}
+		if shared == nil {
+			shared = make(map[string]struct{})
+		}
+		shared[name] = struct{}{}
+	}
+	return shared
+}
+
+// annotateDisambiguatedName adds `unsigned.disambiguated_name` to a member event if its display name is
+// shared with another member, so clients can render unambiguous names without the full member list.
+func annotateDisambiguatedName(ctx context.Context, ev state.Event, sharedNames map[string]struct{}) json.RawMessage {
+	content := gjson.GetBytes(ev.JSON, "content")
+	membership := content.Get("membership").Str
+	name := content.Get("displayname").Str
+	if _, ok := sharedNames[name]; !ok || (membership != "join" && membership != "invite") {
+		return ev.JSON
+	}
+	newJSON, err := sjson.SetBytes(ev.JSON, "unsigned.disambiguated_name", internal.DisambiguatedName(name, ev.StateKey))
+	if err != nil {
+		logger.Err(err).Str("room", ev.RoomID).Msg("annotateDisambiguatedName: sjson failed")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return ev.JSON
+	}
+	return newJSON
+}
+
 // Startup will populate the cache with the provided metadata.
 // Must be called prior to starting any v2 pollers else this operation can race. Consider:
 //   - V2 poll loop started early
@@ -179,8 +568,6 @@ func (c *GlobalCache) LoadRoomState(ctx context.Context, roomIDs []string, loadP
 //   - OnNewEvents is called with the join event
 //   - join event is processed twice.
 func (c *GlobalCache) Startup(roomIDToMetadata map[string]internal.RoomMetadata) error {
-	c.roomIDToMetadataMu.Lock()
-	defer c.roomIDToMetadataMu.Unlock()
 	// sort room IDs for ease of debugging and for determinism
 	roomIDs := make([]string, len(roomIDToMetadata))
 	i := 0
@@ -193,7 +580,19 @@ func (c *GlobalCache) Startup(roomIDToMetadata map[string]internal.RoomMetadata)
 		metadata := roomIDToMetadata[roomID]
 		internal.Assert("room ID is set", metadata.RoomID != "")
 		internal.Assert("last message timestamp exists", metadata.LastMessageTimestamp > 1)
-		c.roomIDToMetadata[roomID] = &metadata
+		s := c.shard(roomID)
+		s.mu.Lock()
+		s.metadata[roomID] = &metadata
+		s.mu.Unlock()
+	}
+	if c.lru != nil {
+		// recently active rooms are the most likely to be used, so add them last so they aren't evicted
+		sort.SliceStable(roomIDs, func(i, j int) bool {
+			return roomIDToMetadata[roomIDs[i]].LastMessageTimestamp < roomIDToMetadata[roomIDs[j]].LastMessageTimestamp
+		})
+		for _, roomID := range roomIDs {
+			c.markUsed(roomID)
+		}
 	}
 	return nil
 }
@@ -204,9 +603,18 @@ func (c *GlobalCache) Startup(roomIDToMetadata map[string]internal.RoomMetadata)
 
 func (c *GlobalCache) OnEphemeralEvent(ctx context.Context, roomID string, ephEvent json.RawMessage) {
 	evType := gjson.ParseBytes(ephEvent).Get("type").Str
-	c.roomIDToMetadataMu.Lock()
-	defer c.roomIDToMetadataMu.Unlock()
-	metadata := c.roomIDToMetadata[roomID]
+	s := c.shard(roomID)
+	s.mu.Lock()
+	if _, ok := s.evicted[roomID]; ok {
+		// nobody has used this room recently, so nobody is waiting to see who is typing
+		s.mu.Unlock()
+		return
+	}
+	metadata := s.metadata[roomID]
+	if metadata == nil && c.lazy {
+		s.mu.Unlock()
+		return // nobody has used this room yet
+	}
 	if metadata == nil {
 		metadata = &internal.RoomMetadata{
 			RoomID:          roomID,
@@ -218,20 +626,71 @@ func (c *GlobalCache) OnEphemeralEvent(ctx context.Context, roomID string, ephEv
 	case "m.typing":
 		metadata.TypingEvent = ephEvent
 	}
-	c.roomIDToMetadata[roomID] = metadata
+	s.metadata[roomID] = metadata
+	s.mu.Unlock()
+	c.markUsed(roomID)
 }
 
 func (c *GlobalCache) OnReceipt(ctx context.Context, receipt internal.Receipt) {
 	// nothing to do but we need it because the Dispatcher demands it.
 }
 
+// RecountMembers replaces the join and invite counts for this room with counts from the given members, and
+// removes any heroes who are no longer joined or invited. Use this when membership events may have been
+// missed, as counts are otherwise updated incrementally from new events.
+func (c *GlobalCache) RecountMembers(roomID string, joined, invited []string) {
+	s := c.shard(roomID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	metadata := s.metadata[roomID]
+	if metadata == nil {
+		// either we don't know about this room, or it was evicted and will be reloaded with the right counts
+		return
+	}
+	metadata.JoinCount = len(joined)
+	metadata.InviteCount = len(invited)
+	members := make(map[string]struct{}, len(joined)+len(invited))
+	for _, userID := range joined {
+		members[userID] = struct{}{}
+	}
+	for _, userID := range invited {
+		members[userID] = struct{}{}
+	}
+	// don't filter in place, as loaded copies of the metadata may share the slice
+	var heroes []internal.Hero
+	for _, h := range metadata.Heroes {
+		if _, ok := members[h.ID]; ok {
+			heroes = append(heroes, h)
+		}
+	}
+	metadata.Heroes = heroes
+}
+
 func (c *GlobalCache) OnNewEvent(
 	ctx context.Context, ed *EventData,
 ) {
+	c.updateCachedRoomState(ed)
+	c.redactCachedRoomState(ed)
 	// update global state
-	c.roomIDToMetadataMu.Lock()
-	defer c.roomIDToMetadataMu.Unlock()
-	metadata := c.roomIDToMetadata[ed.RoomID]
+	var used bool
+	defer func() {
+		// runs after the shard is unlocked, as this may evict a room
+		if used {
+			c.markUsed(ed.RoomID)
+		}
+	}()
+	s := c.shard(ed.RoomID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	metadata := s.metadata[ed.RoomID]
+	if metadata == nil && c.lazy {
+		// the event is already in the database, so it will be included when the room is first loaded. Only
+		// count events for rooms which are being loaded, so rooms nobody uses aren't tracked.
+		if n, ok := s.evicted[ed.RoomID]; ok {
+			s.evicted[ed.RoomID] = n + 1
+		}
+		return
+	}
 	if metadata == nil {
 		metadata = &internal.RoomMetadata{
 			RoomID:          ed.RoomID,
@@ -247,6 +706,10 @@ func (c *GlobalCache) OnNewEvent(
 		if ed.StateKey != nil && *ed.StateKey == "" {
 			metadata.Encrypted = true
 		}
+	case "m.room.avatar":
+		if ed.StateKey != nil && *ed.StateKey == "" {
+			metadata.AvatarEvent = ed.Content.Get("url").Str
+		}
 	case "m.room.tombstone":
 		if ed.StateKey != nil && *ed.StateKey == "" {
 			newRoomID := ed.Content.Get("replacement_room").Str
@@ -270,23 +733,30 @@ func (c *GlobalCache) OnNewEvent(
 			if predecessorRoomID != "" {
 				metadata.PredecessorRoomID = &predecessorRoomID
 			}
+			metadata.RoomVersion = ed.Content.Get("room_version").Str
+		}
+	case "m.room.join_rules":
+		if ed.StateKey != nil && *ed.StateKey == "" {
+			metadata.JoinRule = ed.Content.Get("join_rule").Str
 		}
 	case "m.space.child": // only track space child changes for now, not parents
 		if ed.StateKey != nil {
 			isDeleted := !ed.Content.Get("via").IsArray()
-			if isDeleted {
-				delete(metadata.ChildSpaceRooms, *ed.StateKey)
-			} else {
-				metadata.ChildSpaceRooms[*ed.StateKey] = struct{}{}
-			}
+			metadata.SetChildSpaceRoom(*ed.StateKey, !isDeleted)
+		}
+	case "m.room.message":
+		if c.contentHints && ed.StateKey == nil {
+			metadata.ContentHints.AddMessage(ed.Content)
 		}
 	case "m.room.member":
 		if ed.StateKey != nil {
 			membership := ed.Content.Get("membership").Str
 			eventJSON := gjson.ParseBytes(ed.Event)
+			// The dispatcher tracks who is joined and invited, so its counts are correct even when this
+			// event doesn't look like a membership change e.g. after a gappy sync where the change was missed.
+			metadata.JoinCount = ed.JoinCount
+			metadata.InviteCount = ed.InviteCount
 			if internal.IsMembershipChange(eventJSON) {
-				metadata.JoinCount = ed.JoinCount
-				metadata.InviteCount = ed.InviteCount
 				if membership == "leave" || membership == "ban" {
 					// remove this user as a hero
 					metadata.RemoveHero(*ed.StateKey)
@@ -302,24 +772,27 @@ func (c *GlobalCache) OnNewEvent(
 				}
 			}
 			if len(metadata.Heroes) < 6 && (membership == "join" || membership == "invite") {
-				// try to find the existing hero e.g they changed their display name
-				found := false
-				for i := range metadata.Heroes {
-					if metadata.Heroes[i].ID == *ed.StateKey {
-						metadata.Heroes[i].Name = ed.Content.Get("displayname").Str
-						found = true
-						break
-					}
-				}
-				if !found {
-					metadata.Heroes = append(metadata.Heroes, internal.Hero{
-						ID:   *ed.StateKey,
-						Name: ed.Content.Get("displayname").Str,
-					})
-				}
+				// updates the existing hero if they changed their display name
+				metadata.SetHero(internal.Hero{
+					ID:   *ed.StateKey,
+					Name: ed.Content.Get("displayname").Str,
+				})
 			}
 		}
 	}
-	metadata.LastMessageTimestamp = ed.Timestamp
-	c.roomIDToMetadata[ed.RoomID] = metadata
+	if ed.StateKey != nil && c.indexedStateTypes[ed.EventType] {
+		metadata.SetIndexedState(ed.EventType, *ed.StateKey, json.RawMessage(ed.Content.Raw))
+	}
+	metadata.LatestEventTimestamp = ed.Timestamp
+	// ignored events don't make the room more recent, unless we have nothing better
+	if c.LatestEventFilter.IsRelevant(ed.EventType) || metadata.LastMessageTimestamp == 0 {
+		metadata.LastMessageTimestamp = ed.Timestamp
+	}
+	if n, ok := s.evicted[ed.RoomID]; ok {
+		// the event is already in the database, so it will be included when the room is reloaded
+		s.evicted[ed.RoomID] = n + 1
+		return
+	}
+	s.metadata[ed.RoomID] = metadata
+	used = true
 }
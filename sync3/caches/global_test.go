@@ -4,12 +4,19 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync3"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 	"github.com/matrix-org/sliding-sync/testutils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tidwall/gjson"
 )
 
 func TestGlobalCacheLoadState(t *testing.T) {
@@ -233,3 +240,778 @@ func TestGlobalCacheLoadState(t *testing.T) {
 		})
 	}
 }
+
+func TestGlobalCacheLoadStateDisambiguatesNames(t *testing.T) {
+	ctx := context.Background()
+	store := state.NewStorage(postgresConnectionString)
+	roomID := "!TestGlobalCacheLoadStateDisambiguatesNames:localhost"
+	alice := "@alice_TestGlobalCacheLoadStateDisambiguatesNames:localhost"
+	bob := "@bob_TestGlobalCacheLoadStateDisambiguatesNames:localhost"
+	charlie := "@charlie_TestGlobalCacheLoadStateDisambiguatesNames:localhost"
+	_, nids, err := store.Accumulate(roomID, "", []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewStateEvent(t, "m.room.member", alice, alice, map[string]interface{}{"membership": "join", "displayname": "Sam"}),
+		testutils.NewStateEvent(t, "m.room.member", bob, bob, map[string]interface{}{"membership": "join", "displayname": "Sam"}),
+		testutils.NewStateEvent(t, "m.room.member", charlie, charlie, map[string]interface{}{"membership": "join", "displayname": "Charlie"}),
+	})
+	if err != nil {
+		t.Fatalf("Accumulate: %s", err)
+	}
+	globalCache := caches.NewGlobalCache(store)
+	rs := sync3.RoomSubscription{
+		RequiredState: [][2]string{{"m.room.member", sync3.StateKeyLazy}},
+	}
+	// only alice and charlie are in the timeline, but alice shares a name with bob
+	gotMap := globalCache.LoadRoomState(ctx, []string{roomID}, nids[len(nids)-1], rs.RequiredStateMap(alice), map[string][]string{
+		roomID: {alice, charlie},
+	})
+	got := gotMap[roomID]
+	if len(got) != 2 {
+		t.Fatalf("LoadRoomState: got %d events want 2", len(got))
+	}
+	for _, ev := range got {
+		userID := gjson.GetBytes(ev, "state_key").Str
+		gotName := gjson.GetBytes(ev, "unsigned.disambiguated_name")
+		switch userID {
+		case alice:
+			if gotName.Str != "Sam ("+alice+")" {
+				t.Errorf("alice: got disambiguated name %q", gotName.Str)
+			}
+		case charlie:
+			if gotName.Exists() {
+				t.Errorf("charlie: unexpected disambiguated name %q", gotName.Str)
+			}
+		default:
+			t.Errorf("unexpected member event for %s", userID)
+		}
+	}
+}
+
+// Test that exact required_state is served from memory once loaded, and kept up to date with new events.
+func TestGlobalCacheLoadStateFromMemory(t *testing.T) {
+	ctx := context.Background()
+	store := state.NewStorage(postgresConnectionString)
+	roomID := "!TestGlobalCacheLoadStateFromMemory:localhost"
+	alice := "@alice_TestGlobalCacheLoadStateFromMemory:localhost"
+	events := []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+		testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "Old name"}),
+	}
+	_, nids, err := store.Accumulate(roomID, "", events)
+	if err != nil {
+		t.Fatalf("Accumulate: %s", err)
+	}
+	latest := nids[len(nids)-1]
+	globalCache := caches.NewGlobalCache(store)
+	rs := sync3.RoomSubscription{
+		RequiredState: [][2]string{{"m.room.name", ""}, {"m.room.topic", ""}},
+	}
+	assertName := func(loadPos int64, want json.RawMessage) {
+		t.Helper()
+		got := globalCache.LoadRoomState(ctx, []string{roomID}, loadPos, rs.RequiredStateMap(alice), nil)[roomID]
+		if len(got) != 1 || !bytes.Equal(got[0], want) {
+			t.Fatalf("LoadRoomState at %d: got %s want %s", loadPos, got, want)
+		}
+	}
+	assertName(latest, events[2])
+
+	// a new name event which isn't in the database, so it can only come from memory
+	newName := testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "New name"})
+	stateKey := ""
+	globalCache.OnNewEvent(ctx, &caches.EventData{
+		Event:     newName,
+		RoomID:    roomID,
+		EventType: "m.room.name",
+		StateKey:  &stateKey,
+		Content:   gjson.GetBytes(newName, "content"),
+		LatestPos: latest + 1,
+	})
+	assertName(latest+1, newName)
+	// connections which haven't seen the new event yet get the old one from the database
+	assertName(latest, events[2])
+
+	// once invalidated, the room is loaded from the database again
+	globalCache.InvalidateRoomState(roomID)
+	assertName(latest+1, events[2])
+}
+
+// Test that essential state is served from memory even when the rest of required_state is lazy loaded
+// from the database.
+func TestGlobalCacheLoadEssentialStateFromMemory(t *testing.T) {
+	ctx := context.Background()
+	store := state.NewStorage(postgresConnectionString)
+	roomID := "!TestGlobalCacheLoadEssentialStateFromMemory:localhost"
+	alice := "@alice_TestGlobalCacheLoadEssentialStateFromMemory:localhost"
+	events := []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+		testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "Old name"}),
+	}
+	_, nids, err := store.Accumulate(roomID, "", events)
+	if err != nil {
+		t.Fatalf("Accumulate: %s", err)
+	}
+	latest := nids[len(nids)-1]
+	globalCache := caches.NewGlobalCache(store)
+	boolTrue := true
+	rs := sync3.RoomSubscription{
+		EssentialState: &boolTrue,
+		RequiredState:  [][2]string{{"m.room.member", sync3.StateKeyLazy}},
+	}
+	assertState := func(loadPos int64, want ...json.RawMessage) {
+		t.Helper()
+		got := globalCache.LoadRoomState(ctx, []string{roomID}, loadPos, rs.RequiredStateMap(alice), map[string][]string{
+			roomID: {alice},
+		})[roomID]
+		if len(got) != len(want) {
+			t.Fatalf("LoadRoomState at %d: got %s want %s", loadPos, got, want)
+		}
+		for i := range want {
+			if !bytes.Equal(got[i], want[i]) {
+				t.Fatalf("LoadRoomState at %d: got %s want %s", loadPos, got, want)
+			}
+		}
+	}
+	assertState(latest, events...)
+
+	// a new name event which isn't in the database, so it can only come from memory
+	newName := testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "New name"})
+	stateKey := ""
+	globalCache.OnNewEvent(ctx, &caches.EventData{
+		Event:     newName,
+		RoomID:    roomID,
+		EventType: "m.room.name",
+		StateKey:  &stateKey,
+		Content:   gjson.GetBytes(newName, "content"),
+		LatestPos: latest + 1,
+	})
+	assertState(latest+1, events[0], events[1], newName)
+}
+
+func TestGlobalCacheLatestEventFilter(t *testing.T) {
+	ctx := context.Background()
+	roomID := "!TestGlobalCacheLatestEventFilter:localhost"
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.LatestEventFilter = internal.NewLatestEventFilter([]string{"m.reaction"})
+	check := func(wantLastMessage, wantLatestEvent uint64) {
+		t.Helper()
+		metadata := globalCache.LoadRooms(ctx, roomID)[roomID]
+		if metadata.LastMessageTimestamp != wantLastMessage {
+			t.Errorf("got LastMessageTimestamp %d want %d", metadata.LastMessageTimestamp, wantLastMessage)
+		}
+		if metadata.LatestEventTimestamp != wantLatestEvent {
+			t.Errorf("got LatestEventTimestamp %d want %d", metadata.LatestEventTimestamp, wantLatestEvent)
+		}
+	}
+	// an ignored event is used if there is nothing better
+	globalCache.OnNewEvent(ctx, &caches.EventData{
+		RoomID: roomID, EventType: "m.reaction", Timestamp: 100,
+	})
+	check(100, 100)
+	globalCache.OnNewEvent(ctx, &caches.EventData{
+		RoomID: roomID, EventType: "m.room.message", Timestamp: 200,
+	})
+	check(200, 200)
+	// ignored events don't update the last message timestamp
+	globalCache.OnNewEvent(ctx, &caches.EventData{
+		RoomID: roomID, EventType: "m.reaction", Timestamp: 300,
+	})
+	check(200, 300)
+	globalCache.OnNewEvent(ctx, &caches.EventData{
+		RoomID: roomID, EventType: "m.room.message", Timestamp: 400,
+	})
+	check(400, 400)
+}
+
+func TestGlobalCacheTracksAvatarEncryptionAndType(t *testing.T) {
+	ctx := context.Background()
+	roomID := "!TestGlobalCacheTracksAvatarEncryptionAndType:localhost"
+	globalCache := caches.NewGlobalCache(nil)
+	emptyStateKey := ""
+	events := []*caches.EventData{
+		{
+			RoomID: roomID, EventType: "m.room.create", StateKey: &emptyStateKey, Timestamp: 100,
+			Content: gjson.Parse(`{"type":"m.space","room_version":"10"}`),
+		},
+		{
+			RoomID: roomID, EventType: "m.room.avatar", StateKey: &emptyStateKey, Timestamp: 200,
+			Content: gjson.Parse(`{"url":"mxc://x/avatar"}`),
+		},
+		{
+			RoomID: roomID, EventType: "m.room.encryption", StateKey: &emptyStateKey, Timestamp: 300,
+			Content: gjson.Parse(`{"algorithm":"m.megolm.v1.aes-sha2"}`),
+		},
+	}
+	for _, ed := range events {
+		globalCache.OnNewEvent(ctx, ed)
+	}
+	metadata := globalCache.LoadRooms(ctx, roomID)[roomID]
+	if metadata.AvatarEvent != "mxc://x/avatar" {
+		t.Errorf("got AvatarEvent %q want %q", metadata.AvatarEvent, "mxc://x/avatar")
+	}
+	if !metadata.Encrypted {
+		t.Errorf("room is not encrypted")
+	}
+	if metadata.RoomType == nil || *metadata.RoomType != "m.space" {
+		t.Errorf("got RoomType %v want m.space", metadata.RoomType)
+	}
+	// removing the avatar clears it
+	globalCache.OnNewEvent(ctx, &caches.EventData{
+		RoomID: roomID, EventType: "m.room.avatar", StateKey: &emptyStateKey, Timestamp: 400,
+		Content: gjson.Parse(`{}`),
+	})
+	metadata = globalCache.LoadRooms(ctx, roomID)[roomID]
+	if metadata.AvatarEvent != "" {
+		t.Errorf("got AvatarEvent %q want none", metadata.AvatarEvent)
+	}
+}
+
+func TestGlobalCacheRecountMembers(t *testing.T) {
+	ctx := context.Background()
+	roomID := "!TestGlobalCacheRecountMembers:localhost"
+	alice := "@alice:localhost"
+	bob := "@bob:localhost"
+	globalCache := caches.NewGlobalCache(nil)
+	for _, userID := range []string{alice, bob} {
+		userID := userID
+		globalCache.OnNewEvent(ctx, &caches.EventData{
+			Event:     testutils.NewJoinEvent(t, userID),
+			RoomID:    roomID,
+			EventType: "m.room.member",
+			StateKey:  &userID,
+			Content:   gjson.Parse(`{"membership":"join"}`),
+			JoinCount: 2,
+		})
+	}
+	// bob left during a gappy sync, and someone was invited
+	globalCache.RecountMembers(roomID, []string{alice}, []string{"@charlie:localhost"})
+	metadata := globalCache.LoadRooms(ctx, roomID)[roomID]
+	if metadata.JoinCount != 1 || metadata.InviteCount != 1 {
+		t.Errorf("got join/invite counts %d/%d want 1/1", metadata.JoinCount, metadata.InviteCount)
+	}
+	if len(metadata.Heroes) != 1 || metadata.Heroes[0].ID != alice {
+		t.Errorf("got heroes %+v want just alice", metadata.Heroes)
+	}
+}
+
+// Metadata loaded by a request must not change when the pollers update the room, as requests read it
+// without holding any locks.
+func TestGlobalCacheLoadRoomsIsSnapshot(t *testing.T) {
+	ctx := context.Background()
+	roomID := "!TestGlobalCacheLoadRoomsIsSnapshot:localhost"
+	alice := "@alice:localhost"
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.OnNewEvent(ctx, &caches.EventData{
+		Event:     testutils.NewJoinEvent(t, alice),
+		RoomID:    roomID,
+		EventType: "m.room.member",
+		StateKey:  &alice,
+		Content:   gjson.Parse(`{"membership":"join","displayname":"Alice"}`),
+		JoinCount: 1,
+	})
+	snapshot := globalCache.LoadRooms(ctx, roomID)[roomID]
+
+	// change alice's display name and add a space child
+	globalCache.OnNewEvent(ctx, &caches.EventData{
+		Event:     testutils.NewJoinEvent(t, alice),
+		RoomID:    roomID,
+		EventType: "m.room.member",
+		StateKey:  &alice,
+		Content:   gjson.Parse(`{"membership":"join","displayname":"Alice 2"}`),
+		JoinCount: 1,
+	})
+	childRoomID := "!child:localhost"
+	globalCache.OnNewEvent(ctx, &caches.EventData{
+		Event:     testutils.NewStateEvent(t, "m.space.child", childRoomID, alice, map[string]interface{}{"via": []string{"localhost"}}),
+		RoomID:    roomID,
+		EventType: "m.space.child",
+		StateKey:  &childRoomID,
+		Content:   gjson.Parse(`{"via":["localhost"]}`),
+		JoinCount: 1,
+	})
+	if len(snapshot.Heroes) != 1 || snapshot.Heroes[0].Name != "Alice" {
+		t.Errorf("snapshot heroes changed: %+v", snapshot.Heroes)
+	}
+	if len(snapshot.ChildSpaceRooms) != 0 {
+		t.Errorf("snapshot space children changed: %v", snapshot.ChildSpaceRooms)
+	}
+
+	// modifying a loaded copy must not change the cache
+	loaded := globalCache.LoadRooms(ctx, roomID)[roomID]
+	loaded.Heroes = append(loaded.Heroes, internal.Hero{ID: "@bob:localhost"})
+	loaded.RemoveHero(alice)
+	metadata := globalCache.LoadRooms(ctx, roomID)[roomID]
+	if len(metadata.Heroes) != 1 || metadata.Heroes[0].ID != alice || metadata.Heroes[0].Name != "Alice 2" {
+		t.Errorf("got heroes %+v want just alice with the new name", metadata.Heroes)
+	}
+	if _, ok := metadata.ChildSpaceRooms[childRoomID]; !ok {
+		t.Errorf("got space children %v want %s", metadata.ChildSpaceRooms, childRoomID)
+	}
+}
+
+func TestGlobalCacheMaxRooms(t *testing.T) {
+	ctx := context.Background()
+	store := state.NewStorage(postgresConnectionString)
+	alice := "@alice:localhost"
+	roomA := "!a_TestGlobalCacheMaxRooms:localhost"
+	roomB := "!b_TestGlobalCacheMaxRooms:localhost"
+	roomC := "!c_TestGlobalCacheMaxRooms:localhost"
+	base := time.Now().Add(-time.Hour)
+	roomIDs := []string{roomA, roomB, roomC}
+	names := []string{"A", "B", "C"}
+	for i, roomID := range roomIDs {
+		// rooms are increasingly recent, so A is the least recently used
+		ts := testutils.WithTimestamp(base.Add(time.Duration(i) * time.Minute))
+		_, _, err := store.Accumulate(roomID, "", []json.RawMessage{
+			testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}, ts),
+			testutils.NewJoinEvent(t, alice, ts),
+			testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": names[i]}, ts),
+		})
+		if err != nil {
+			t.Fatalf("Accumulate: %s", err)
+		}
+	}
+	metadata, err := store.MetadataForRooms(roomIDs)
+	if err != nil {
+		t.Fatalf("MetadataForRooms: %s", err)
+	}
+	globalCache := caches.NewGlobalCache(store)
+	globalCache.SetMaxRooms(2)
+	if err = globalCache.Startup(metadata); err != nil {
+		t.Fatalf("Startup: %s", err)
+	}
+	nameEvent := func(roomID, name string) *caches.EventData {
+		ev := testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": name})
+		stateKey := ""
+		return &caches.EventData{
+			Event:     ev,
+			RoomID:    roomID,
+			EventType: "m.room.name",
+			StateKey:  &stateKey,
+			Content:   gjson.GetBytes(ev, "content"),
+			Timestamp: uint64(time.Now().UnixMilli()),
+		}
+	}
+	checkName := func(roomID, wantName string) {
+		t.Helper()
+		got := globalCache.LoadRooms(ctx, roomID)[roomID]
+		if got == nil {
+			t.Fatalf("LoadRooms(%s) returned no metadata", roomID)
+		}
+		if got.NameEvent != wantName {
+			t.Errorf("LoadRooms(%s) got name %q want %q", roomID, got.NameEvent, wantName)
+		}
+	}
+
+	// A was evicted at startup. Events for evicted rooms are picked up from the database when reloaded.
+	ed := nameEvent(roomA, "A2")
+	if _, _, err = store.Accumulate(roomA, "", []json.RawMessage{ed.Event}); err != nil {
+		t.Fatalf("Accumulate: %s", err)
+	}
+	globalCache.OnNewEvent(ctx, ed)
+	checkName(roomA, "A2") // evicts B
+	checkName(roomB, "B")  // evicts C
+
+	// B is held in memory, so events update it directly
+	globalCache.OnNewEvent(ctx, nameEvent(roomB, "B in memory"))
+	checkName(roomB, "B in memory")
+
+	// C is not held in memory, so this event is dropped in favour of what is in the database
+	globalCache.OnNewEvent(ctx, nameEvent(roomC, "C not stored"))
+	checkName(roomC, "C")
+}
+
+func TestGlobalCacheLazyLoading(t *testing.T) {
+	ctx := context.Background()
+	store := state.NewStorage(postgresConnectionString)
+	alice := "@alice:localhost"
+	roomA := "!a_TestGlobalCacheLazyLoading:localhost"
+	roomB := "!b_TestGlobalCacheLazyLoading:localhost"
+	for _, roomID := range []string{roomA, roomB} {
+		_, _, err := store.Accumulate(roomID, "", []json.RawMessage{
+			testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+			testutils.NewJoinEvent(t, alice),
+			testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": roomID}),
+		})
+		if err != nil {
+			t.Fatalf("Accumulate: %s", err)
+		}
+	}
+	globalCache := caches.NewGlobalCache(store)
+	globalCache.SetLazyLoading()
+	if err := globalCache.Startup(nil); err != nil {
+		t.Fatalf("Startup: %s", err)
+	}
+
+	// events for rooms which haven't been loaded are picked up from the database when they are
+	ev := testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "A2"})
+	if _, _, err := store.Accumulate(roomA, "", []json.RawMessage{ev}); err != nil {
+		t.Fatalf("Accumulate: %s", err)
+	}
+	stateKey := ""
+	globalCache.OnNewEvent(ctx, &caches.EventData{
+		Event:     ev,
+		RoomID:    roomA,
+		EventType: "m.room.name",
+		StateKey:  &stateKey,
+		Content:   gjson.GetBytes(ev, "content"),
+		Timestamp: uint64(time.Now().UnixMilli()),
+		JoinCount: 1,
+	})
+
+	// concurrent loads of the same rooms all see the loaded metadata
+	results := make(chan map[string]*internal.RoomMetadata, 5)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			results <- globalCache.LoadRooms(ctx, roomA, roomB)
+		}()
+	}
+	for i := 0; i < cap(results); i++ {
+		rooms := <-results
+		if rooms[roomA] == nil || rooms[roomA].NameEvent != "A2" {
+			t.Errorf("LoadRooms: got room A %+v want name A2", rooms[roomA])
+		}
+		if rooms[roomB] == nil || rooms[roomB].NameEvent != roomB || rooms[roomB].JoinCount != 1 {
+			t.Errorf("LoadRooms: got room B %+v want name %s and 1 joined user", rooms[roomB], roomB)
+		}
+	}
+
+	// once loaded, events update the room directly
+	ev = testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "B in memory"})
+	globalCache.OnNewEvent(ctx, &caches.EventData{
+		Event:     ev,
+		RoomID:    roomB,
+		EventType: "m.room.name",
+		StateKey:  &stateKey,
+		Content:   gjson.GetBytes(ev, "content"),
+		Timestamp: uint64(time.Now().UnixMilli()),
+		JoinCount: 1,
+	})
+	if got := globalCache.LoadRooms(ctx, roomB)[roomB]; got == nil || got.NameEvent != "B in memory" {
+		t.Errorf("LoadRooms: got room B %+v want name 'B in memory'", got)
+	}
+}
+
+// Test that rooms in different shards can be used concurrently whilst being evicted, without deadlocking.
+func TestGlobalCacheConcurrentRooms(t *testing.T) {
+	ctx := context.Background()
+	globalCache := caches.NewGlobalCache(state.NewStorage(postgresConnectionString))
+	globalCache.SetMaxRooms(10)
+	if err := globalCache.Startup(nil); err != nil {
+		t.Fatalf("Startup: %s", err)
+	}
+	alice := "@alice:localhost"
+	stateKey := ""
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				roomID := fmt.Sprintf("!%d_TestGlobalCacheConcurrentRooms:localhost", (i*100+j)%50)
+				ev := testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": roomID})
+				globalCache.OnNewEvent(ctx, &caches.EventData{
+					Event:     ev,
+					RoomID:    roomID,
+					EventType: "m.room.name",
+					StateKey:  &stateKey,
+					Content:   gjson.GetBytes(ev, "content"),
+					Timestamp: uint64(time.Now().UnixMilli()),
+				})
+				globalCache.LoadRooms(ctx, roomID)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestGlobalCacheLoadRoomsBatch(t *testing.T) {
+	ctx := context.Background()
+	globalCache := caches.NewGlobalCache(nil)
+	metadata := make(map[string]internal.RoomMetadata)
+	var roomIDs []string
+	for i := 0; i < 100; i++ {
+		roomID := fmt.Sprintf("!%d:localhost", i)
+		metadata[roomID] = internal.RoomMetadata{
+			RoomID:    roomID,
+			NameEvent: roomID,
+			Heroes:    []internal.Hero{{ID: "@bob:localhost"}},
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	if err := globalCache.Startup(metadata); err != nil {
+		t.Fatalf("Startup: %s", err)
+	}
+	rooms := globalCache.LoadRooms(ctx, append(roomIDs, "!unknown:localhost")...)
+	if len(rooms) != len(roomIDs) {
+		t.Fatalf("LoadRooms: got %d rooms want %d", len(rooms), len(roomIDs))
+	}
+	for _, roomID := range roomIDs {
+		if rooms[roomID] == nil || rooms[roomID].NameEvent != roomID {
+			t.Errorf("LoadRooms: got %+v for %s", rooms[roomID], roomID)
+		}
+	}
+	// results are copies
+	rooms[roomIDs[0]].Heroes[0].ID = "@charlie:localhost"
+	if got := globalCache.LoadRooms(ctx, roomIDs[0])[roomIDs[0]]; got.Heroes[0].ID != "@bob:localhost" {
+		t.Errorf("LoadRooms: modifying the result modified the cache: got hero %s", got.Heroes[0].ID)
+	}
+}
+
+func TestGlobalCacheSeenEvent(t *testing.T) {
+	globalCache := caches.NewGlobalCache(nil)
+	roomA := "!a:localhost"
+	roomB := "!b:localhost"
+	if globalCache.SeenEvent(roomA, "$1") {
+		t.Fatalf("SeenEvent: new event was seen")
+	}
+	if !globalCache.SeenEvent(roomA, "$1") {
+		t.Fatalf("SeenEvent: duplicate event was not seen")
+	}
+	// events are tracked per room
+	if globalCache.SeenEvent(roomB, "$1") {
+		t.Fatalf("SeenEvent: event in another room was seen")
+	}
+	// events without IDs are never duplicates
+	if globalCache.SeenEvent(roomA, "") || globalCache.SeenEvent(roomA, "") {
+		t.Fatalf("SeenEvent: event without an ID was seen")
+	}
+	// only recent events are remembered
+	for i := 0; i < 100; i++ {
+		globalCache.SeenEvent(roomA, fmt.Sprintf("$other%d", i))
+	}
+	if globalCache.SeenEvent(roomA, "$1") {
+		t.Fatalf("SeenEvent: old event was still remembered")
+	}
+}
+
+func TestGlobalCacheSeenEventEviction(t *testing.T) {
+	roomA := "!a:localhost"
+	roomB := "!b:localhost"
+	roomC := "!c:localhost"
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.SetMaxRooms(2)
+	err := globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA: {RoomID: roomA, LastMessageTimestamp: 100},
+		roomB: {RoomID: roomB, LastMessageTimestamp: 200},
+	})
+	if err != nil {
+		t.Fatalf("Startup: %s", err)
+	}
+	globalCache.SeenEvent(roomA, "$1")
+	// rooms which aren't held aren't remembered
+	globalCache.SeenEvent(roomC, "$1")
+	if globalCache.SeenEvent(roomC, "$1") {
+		t.Fatalf("SeenEvent: event in a room which isn't held was remembered")
+	}
+	// an event in C evicts A, which forgets its events
+	globalCache.OnNewEvent(context.Background(), &caches.EventData{
+		Event:     json.RawMessage(`{"event_id":"$2","type":"m.room.message","content":{}}`),
+		RoomID:    roomC,
+		EventType: "m.room.message",
+		Timestamp: 300,
+	})
+	if globalCache.SeenEvent(roomA, "$1") {
+		t.Fatalf("SeenEvent: event in an evicted room was remembered")
+	}
+}
+
+func TestGlobalCacheIndexedState(t *testing.T) {
+	ctx := context.Background()
+	roomID := "!TestGlobalCacheIndexedState:localhost"
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.SetIndexedStateTypes([]string{"io.element.functional_members"})
+	emptyStateKey := ""
+	globalCache.OnNewEvent(ctx, &caches.EventData{
+		RoomID: roomID, EventType: "io.element.functional_members", StateKey: &emptyStateKey, Timestamp: 100,
+		Content: gjson.Parse(`{"service_members":["@bot:localhost"]}`),
+	})
+	globalCache.OnNewEvent(ctx, &caches.EventData{
+		RoomID: roomID, EventType: "im.vector.modular.widgets", StateKey: &emptyStateKey, Timestamp: 200,
+		Content: gjson.Parse(`{"type":"jitsi"}`),
+	})
+	metadata := globalCache.LoadRooms(ctx, roomID)[roomID]
+	got := metadata.IndexedStateContent("io.element.functional_members", "")
+	if string(got) != `{"service_members":["@bot:localhost"]}` {
+		t.Errorf("got functional members %s", string(got))
+	}
+	if _, ok := metadata.IndexedState["im.vector.modular.widgets"]; ok {
+		t.Errorf("state event type which isn't indexed was indexed")
+	}
+	// removing the state event removes it from the index, without changing copies already loaded
+	globalCache.OnNewEvent(ctx, &caches.EventData{
+		RoomID: roomID, EventType: "io.element.functional_members", StateKey: &emptyStateKey, Timestamp: 300,
+		Content: gjson.Parse(`{}`),
+	})
+	if got := globalCache.LoadRooms(ctx, roomID)[roomID].IndexedStateContent("io.element.functional_members", ""); got != nil {
+		t.Errorf("got functional members %s after removal", string(got))
+	}
+	if metadata.IndexedStateContent("io.element.functional_members", "") == nil {
+		t.Errorf("removal modified a loaded copy of the metadata")
+	}
+}
+
+func TestGlobalCacheMetrics(t *testing.T) {
+	ctx := context.Background()
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.AddPrometheusMetrics()
+	defer globalCache.RemovePrometheusMetrics()
+	roomID := "!TestGlobalCacheMetrics:localhost"
+	err := globalCache.Startup(map[string]internal.RoomMetadata{
+		roomID: {RoomID: roomID, LastMessageTimestamp: 1000, TypingEvent: json.RawMessage(`{"type":"m.typing"}`)},
+	})
+	if err != nil {
+		t.Fatalf("Startup: %s", err)
+	}
+	globalCache.LoadRooms(ctx, roomID, "!unknown:localhost")
+	globalCache.LoadRooms(ctx, roomID)
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %s", err)
+	}
+	got := make(map[string]float64)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			name := family.GetName()
+			for _, label := range m.GetLabel() {
+				name += " " + label.GetValue()
+			}
+			got[name] = m.GetCounter().GetValue() + m.GetGauge().GetValue()
+		}
+	}
+	want := map[string]float64{
+		"sliding_sync_cache_lookups rooms hit":  2,
+		"sliding_sync_cache_lookups rooms miss": 1,
+		"sliding_sync_cache_num_rooms":          1,
+		"sliding_sync_cache_json_bytes":         float64(len(`{"type":"m.typing"}`)),
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("%s: got %v want %v", name, got[name], value)
+		}
+	}
+}
+
+type fakeMembershipTracker struct {
+	joined  map[string]bool
+	invited map[string]bool
+}
+
+func (t *fakeMembershipTracker) IsUserJoined(userID, roomID string) bool {
+	return t.joined[userID]
+}
+
+func (t *fakeMembershipTracker) IsUserInvited(userID, roomID string) bool {
+	return t.invited[userID]
+}
+
+func TestGlobalCacheExcludesFunctionalMembers(t *testing.T) {
+	ctx := context.Background()
+	roomID := "!TestGlobalCacheExcludesFunctionalMembers:localhost"
+	alice := "@alice:localhost"
+	bob := "@bob:localhost"
+	bot := "@bot:localhost"
+	bridge := "@bridge:localhost"
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.SetMembershipTracker(&fakeMembershipTracker{
+		joined:  map[string]bool{alice: true, bob: true, bot: true},
+		invited: map[string]bool{bridge: true},
+	})
+	metadata := internal.RoomMetadata{
+		RoomID:               roomID,
+		Heroes:               []internal.Hero{{ID: bot, Name: "Bot"}, {ID: bob, Name: "Bob"}, {ID: bridge, Name: "Bridge"}},
+		JoinCount:            3,
+		InviteCount:          1,
+		LastMessageTimestamp: 1000,
+	}
+	err := globalCache.Startup(map[string]internal.RoomMetadata{roomID: metadata})
+	if err != nil {
+		t.Fatalf("Startup: %s", err)
+	}
+	// without the functional members state event, bots are shown
+	got := globalCache.LoadRooms(ctx, roomID)[roomID]
+	if len(got.Heroes) != 3 || got.JoinCount != 3 || got.InviteCount != 1 {
+		t.Fatalf("got heroes %v join count %d invite count %d", got.Heroes, got.JoinCount, got.InviteCount)
+	}
+
+	metadata.SetIndexedState(internal.FunctionalMembersEventType, "", json.RawMessage(
+		fmt.Sprintf(`{"service_members":["%s","%s","@not-joined:localhost"]}`, bot, bridge),
+	))
+	globalCache = caches.NewGlobalCache(nil)
+	globalCache.SetMembershipTracker(&fakeMembershipTracker{
+		joined:  map[string]bool{alice: true, bob: true, bot: true},
+		invited: map[string]bool{bridge: true},
+	})
+	err = globalCache.Startup(map[string]internal.RoomMetadata{roomID: metadata})
+	if err != nil {
+		t.Fatalf("Startup: %s", err)
+	}
+	got = globalCache.LoadRooms(ctx, roomID)[roomID]
+	if len(got.Heroes) != 1 || got.Heroes[0].ID != bob {
+		t.Errorf("got heroes %v want only %s", got.Heroes, bob)
+	}
+	if got.JoinCount != 2 {
+		t.Errorf("got join count %d want 2", got.JoinCount)
+	}
+	if got.InviteCount != 0 {
+		t.Errorf("got invite count %d want 0", got.InviteCount)
+	}
+	got.RemoveHero(alice)
+	if name := internal.CalculateRoomName(got, 5); name != "Bob" {
+		t.Errorf("got room name %q want Bob", name)
+	}
+	// the cached metadata is unchanged
+	if got = globalCache.LoadRooms(ctx, roomID)[roomID]; got.JoinCount != 2 || len(got.Heroes) != 1 {
+		t.Errorf("excluding functional members twice: got heroes %v join count %d", got.Heroes, got.JoinCount)
+	}
+}
+
+func TestGlobalCacheReloadRoom(t *testing.T) {
+	ctx := context.Background()
+	store := state.NewStorage(postgresConnectionString)
+	alice := "@alice:localhost"
+	roomID := "!TestGlobalCacheReloadRoom:localhost"
+	_, _, err := store.Accumulate(roomID, "", []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+		testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "Stored"}),
+	})
+	if err != nil {
+		t.Fatalf("Accumulate: %s", err)
+	}
+	metadata, err := store.MetadataForRooms([]string{roomID})
+	if err != nil {
+		t.Fatalf("MetadataForRooms: %s", err)
+	}
+	// the cache has the wrong name, e.g due to a bug
+	wrong := metadata[roomID]
+	wrong.NameEvent = "Corrupted"
+	wrong.JoinCount = 42
+	globalCache := caches.NewGlobalCache(store)
+	if err = globalCache.Startup(map[string]internal.RoomMetadata{roomID: wrong}); err != nil {
+		t.Fatalf("Startup: %s", err)
+	}
+	if err = globalCache.ReloadRoom(ctx, roomID); err != nil {
+		t.Fatalf("ReloadRoom: got %v want nil", err)
+	}
+	got := globalCache.LoadRooms(ctx, roomID)[roomID]
+	if got.NameEvent != "Stored" || got.JoinCount != 1 {
+		t.Errorf("ReloadRoom: got name %q join count %d want Stored, 1", got.NameEvent, got.JoinCount)
+	}
+	// events after reloading still update the room
+	stateKey := ""
+	globalCache.OnNewEvent(ctx, &caches.EventData{
+		RoomID: roomID, EventType: "m.room.name", StateKey: &stateKey, Timestamp: uint64(time.Now().UnixMilli()),
+		Content: gjson.Parse(`{"name":"Live"}`),
+	})
+	if got = globalCache.LoadRooms(ctx, roomID)[roomID]; got.NameEvent != "Live" {
+		t.Errorf("after ReloadRoom: got name %q want Live", got.NameEvent)
+	}
+
+	err = globalCache.ReloadRoom(ctx, "!unknown_TestGlobalCacheReloadRoom:localhost")
+	if !errors.Is(err, internal.ErrRoomNotFound) {
+		t.Errorf("ReloadRoom unknown room: got %v want ErrRoomNotFound", err)
+	}
+}
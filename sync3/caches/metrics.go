@@ -0,0 +1,119 @@
+package caches
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The names of the caches, used as the "cache" label on metrics.
+const (
+	metricsCacheRooms     = "rooms"
+	metricsCacheRoomState = "room_state"
+)
+
+// AddPrometheusMetrics exposes the size of the cache, how often lookups are served from memory and how often
+// rooms are evicted. Must be called before Startup. Nothing is recorded if this is not called.
+func (c *GlobalCache) AddPrometheusMetrics() {
+	c.lookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "cache",
+		Name:      "lookups",
+		Help:      "Number of rooms looked up in the cache, by whether they were held in memory.",
+	}, []string{"cache", "result"})
+	c.evictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "cache",
+		Name:      "evictions",
+		Help:      "Number of rooms evicted from the cache to make room for others.",
+	}, []string{"cache"})
+	c.numRooms = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "cache",
+		Name:      "num_rooms",
+		Help:      "Number of rooms whose metadata is held in memory.",
+	}, func() float64 {
+		return float64(c.numRoomsInMemory())
+	})
+	c.cachedBytes = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "cache",
+		Name:      "json_bytes",
+		Help:      "Number of bytes of event JSON held in memory.",
+	}, func() float64 {
+		return float64(c.jsonBytesInMemory())
+	})
+	prometheus.MustRegister(c.lookups)
+	prometheus.MustRegister(c.evictions)
+	prometheus.MustRegister(c.numRooms)
+	prometheus.MustRegister(c.cachedBytes)
+}
+
+// RemovePrometheusMetrics unregisters the metrics added by AddPrometheusMetrics, if any.
+func (c *GlobalCache) RemovePrometheusMetrics() {
+	if c.lookups == nil {
+		return
+	}
+	prometheus.Unregister(c.lookups)
+	prometheus.Unregister(c.evictions)
+	prometheus.Unregister(c.numRooms)
+	prometheus.Unregister(c.cachedBytes)
+}
+
+func (c *GlobalCache) recordLookups(cache string, hits, misses int) {
+	if c.lookups == nil {
+		return
+	}
+	if hits > 0 {
+		c.lookups.WithLabelValues(cache, "hit").Add(float64(hits))
+	}
+	if misses > 0 {
+		c.lookups.WithLabelValues(cache, "miss").Add(float64(misses))
+	}
+}
+
+func (c *GlobalCache) recordEviction(cache string) {
+	if c.evictions == nil {
+		return
+	}
+	c.evictions.WithLabelValues(cache).Inc()
+}
+
+func (c *GlobalCache) numRoomsInMemory() (count int) {
+	for _, s := range c.shards {
+		s.mu.RLock()
+		count += len(s.metadata)
+		s.mu.RUnlock()
+	}
+	return
+}
+
+// jsonBytesInMemory returns the size of the event JSON held for rooms: typing events, indexed state and
+// cached room state.
+func (c *GlobalCache) jsonBytesInMemory() (size int) {
+	for _, s := range c.shards {
+		s.mu.RLock()
+		for _, metadata := range s.metadata {
+			size += len(metadata.TypingEvent)
+			for _, stateKeys := range metadata.IndexedState {
+				for _, content := range stateKeys {
+					size += len(content)
+				}
+			}
+		}
+		s.mu.RUnlock()
+	}
+	for _, key := range c.roomState.Keys() {
+		val, ok := c.roomState.Peek(key)
+		if !ok {
+			continue
+		}
+		rs := val.(*cachedRoomState)
+		rs.mu.Lock()
+		for _, ev := range rs.events {
+			if ev != nil {
+				size += len(ev.JSON)
+			}
+		}
+		rs.mu.Unlock()
+	}
+	return
+}
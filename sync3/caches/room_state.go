@@ -0,0 +1,217 @@
+package caches
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/tidwall/gjson"
+)
+
+// The number of rooms to hold state events for in memory.
+const roomStateCacheSize = 1000
+
+// cachedRoomState holds the current state events of a room which clients have asked for in their
+// required_state, so they can be served again without going to the database.
+type cachedRoomState struct {
+	mu sync.Mutex
+	// (event type, state key) => the current state event, or nil if the room has no such state event.
+	events map[[2]string]*state.Event
+}
+
+// loadStateTuples returns these state events in each room, as of loadPosition. Rooms whose state events
+// are held in memory and haven't changed since loadPosition are served from memory.
+func (c *GlobalCache) loadStateTuples(ctx context.Context, roomIDs []string, loadPosition int64, tuples [][2]string) (map[string][]state.Event, error) {
+	result := make(map[string][]state.Event, len(roomIDs))
+	var missing []string
+	for _, roomID := range roomIDs {
+		events, ok := c.cachedStateTuples(roomID, loadPosition, tuples)
+		if !ok {
+			missing = append(missing, roomID)
+			continue
+		}
+		if len(events) > 0 {
+			result[roomID] = events
+		}
+	}
+	c.recordLookups(metricsCacheRoomState, len(roomIDs)-len(missing), len(missing))
+	if len(missing) == 0 {
+		return result, nil
+	}
+	queryStateMap := make(map[string][]string)
+	for _, tuple := range tuples {
+		queryStateMap[tuple[0]] = append(queryStateMap[tuple[0]], tuple[1])
+	}
+	dbStart := time.Now()
+	roomIDToStateEvents, err := c.store.RoomStateAfterEventPosition(ctx, missing, loadPosition, queryStateMap)
+	internal.TrackDBTime(ctx, dbStart)
+	if err != nil {
+		return nil, err
+	}
+	for _, roomID := range missing {
+		events := roomIDToStateEvents[roomID]
+		if len(events) > 0 {
+			result[roomID] = events
+		}
+		c.cacheStateTuples(roomID, tuples, events)
+	}
+	return result, nil
+}
+
+// mergeStateEvents adds the state events in `extra` to `roomIDToStateEvents` which it doesn't already have,
+// keeping each room's events sorted by NID.
+func mergeStateEvents(roomIDToStateEvents, extra map[string][]state.Event) map[string][]state.Event {
+	if roomIDToStateEvents == nil {
+		roomIDToStateEvents = make(map[string][]state.Event, len(extra))
+	}
+	for roomID, extraEvents := range extra {
+		events := roomIDToStateEvents[roomID]
+		have := make(map[[2]string]struct{}, len(events))
+		for _, ev := range events {
+			have[[2]string{ev.Type, ev.StateKey}] = struct{}{}
+		}
+		added := false
+		for _, ev := range extraEvents {
+			if _, ok := have[[2]string{ev.Type, ev.StateKey}]; ok {
+				continue
+			}
+			events = append(events, ev)
+			added = true
+		}
+		if added {
+			sort.SliceStable(events, func(i, j int) bool {
+				return events[i].NID < events[j].NID
+			})
+		}
+		roomIDToStateEvents[roomID] = events
+	}
+	return roomIDToStateEvents
+}
+
+// cachedStateTuples returns these state events in the room from memory, sorted by NID. Returns false if any
+// of them aren't held in memory or have changed since loadPosition.
+func (c *GlobalCache) cachedStateTuples(roomID string, loadPosition int64, tuples [][2]string) ([]state.Event, bool) {
+	val, ok := c.roomState.Get(roomID)
+	if !ok {
+		return nil, false
+	}
+	rs := val.(*cachedRoomState)
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	events := make([]state.Event, 0, len(tuples))
+	for _, tuple := range tuples {
+		ev, ok := rs.events[tuple]
+		if !ok {
+			return nil, false
+		}
+		if ev == nil {
+			continue // the room doesn't have this state event
+		}
+		if ev.NID > loadPosition {
+			return nil, false
+		}
+		events = append(events, *ev)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].NID < events[j].NID
+	})
+	return events, true
+}
+
+// cacheStateTuples remembers these state events loaded from the database. Tuples without an event are
+// remembered as missing. Events which have arrived since the database was queried are kept.
+func (c *GlobalCache) cacheStateTuples(roomID string, tuples [][2]string, events []state.Event) {
+	rs := &cachedRoomState{
+		events: make(map[[2]string]*state.Event),
+	}
+	existing, ok, evicted := c.roomState.PeekOrAdd(roomID, rs)
+	if ok {
+		rs = existing.(*cachedRoomState)
+	}
+	if evicted {
+		c.recordEviction(metricsCacheRoomState)
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for i := range events {
+		ev := events[i]
+		tuple := [2]string{ev.Type, ev.StateKey}
+		if existing := rs.events[tuple]; existing != nil && existing.NID >= ev.NID {
+			continue
+		}
+		rs.events[tuple] = &ev
+	}
+	for _, tuple := range tuples {
+		if _, exists := rs.events[tuple]; !exists {
+			rs.events[tuple] = nil
+		}
+	}
+}
+
+// updateCachedRoomState applies a new state event to the room's cached state, if the room's state is
+// held in memory.
+func (c *GlobalCache) updateCachedRoomState(ed *EventData) {
+	if ed.StateKey == nil {
+		return
+	}
+	val, ok := c.roomState.Peek(ed.RoomID)
+	if !ok {
+		return
+	}
+	rs := val.(*cachedRoomState)
+	tuple := [2]string{ed.EventType, *ed.StateKey}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if ed.LatestPos <= 0 {
+		// we don't know when this event happened, so reload it from the database when it is next needed
+		delete(rs.events, tuple)
+		return
+	}
+	rs.events[tuple] = &state.Event{
+		NID:      ed.LatestPos,
+		Type:     ed.EventType,
+		StateKey: *ed.StateKey,
+		RoomID:   ed.RoomID,
+		JSON:     ed.Event,
+	}
+}
+
+// redactCachedRoomState redacts the room's cached state event which this redaction event redacts, if any.
+func (c *GlobalCache) redactCachedRoomState(ed *EventData) {
+	redacts := internal.RedactsEventID(gjson.ParseBytes(ed.Event))
+	if redacts == "" {
+		return
+	}
+	val, ok := c.roomState.Peek(ed.RoomID)
+	if !ok {
+		return
+	}
+	rs := val.(*cachedRoomState)
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for tuple, ev := range rs.events {
+		if ev == nil || gjson.GetBytes(ev.JSON, "event_id").Str != redacts {
+			continue
+		}
+		js, err := internal.RedactEventJSON(ev.JSON, ed.Event)
+		if err != nil {
+			logger.Err(err).Str("room", ed.RoomID).Str("event_id", redacts).Msg("failed to redact cached state event")
+			// reload it from the database, which has the redacted event, when it is next needed
+			delete(rs.events, tuple)
+			continue
+		}
+		// events handed out by cachedStateTuples are copies, but share the JSON, so don't modify it in place
+		redacted := *ev
+		redacted.JSON = js
+		rs.events[tuple] = &redacted
+	}
+}
+
+// InvalidateRoomState forgets the state events held in memory for this room, e.g because the room's state
+// changed without us seeing the events which changed it.
+func (c *GlobalCache) InvalidateRoomState(roomID string) {
+	c.roomState.Remove(roomID)
+}
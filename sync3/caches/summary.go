@@ -0,0 +1,45 @@
+package caches
+
+import (
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// MembershipTracker reports who is currently joined to or invited to a room. Implemented by sync3.Dispatcher.
+type MembershipTracker interface {
+	IsUserJoined(userID, roomID string) bool
+	IsUserInvited(userID, roomID string) bool
+}
+
+// SetMembershipTracker sets where to find the membership of a room's functional members, so they can be
+// excluded from the room's member counts. If unset, functional members are only excluded from heroes.
+func (c *GlobalCache) SetMembershipTracker(t MembershipTracker) {
+	c.memberships = t
+}
+
+// excludeFunctionalMembers removes the room's functional members (e.g bots and bridges) from the heroes and
+// member counts of this copy of the room's metadata, so they don't appear in the room's name or summary.
+// Functional members are listed in the io.element.functional_members state event.
+func (c *GlobalCache) excludeFunctionalMembers(metadata *internal.RoomMetadata) {
+	functionalMembers := metadata.FunctionalMembers()
+	if len(functionalMembers) == 0 {
+		return
+	}
+	// don't filter in place, as the heroes are shared with the cache
+	heroes := make([]internal.Hero, 0, len(metadata.Heroes))
+	for _, h := range metadata.Heroes {
+		if _, ok := functionalMembers[h.ID]; !ok {
+			heroes = append(heroes, h)
+		}
+	}
+	metadata.Heroes = heroes
+	if c.memberships == nil {
+		return
+	}
+	for userID := range functionalMembers {
+		if c.memberships.IsUserJoined(userID, metadata.RoomID) && metadata.JoinCount > 0 {
+			metadata.JoinCount--
+		} else if c.memberships.IsUserInvited(userID, metadata.RoomID) && metadata.InviteCount > 0 {
+			metadata.InviteCount--
+		}
+	}
+}
@@ -79,6 +79,17 @@ func (u *UnreadCountUpdate) Type() string {
 	return fmt.Sprintf("UnreadCountUpdate[%s]", u.RoomID())
 }
 
+// ThreadUnreadCountsUpdate represents a change in the per-thread unread counts in a room. Threads which
+// no longer have unread messages are included with zero counts.
+type ThreadUnreadCountsUpdate struct {
+	RoomID string
+	Counts map[string]internal.ThreadUnreadCounts
+}
+
+func (u *ThreadUnreadCountsUpdate) Type() string {
+	return fmt.Sprintf("ThreadUnreadCountsUpdate[%s] len=%v", u.RoomID, len(u.Counts))
+}
+
 // AccountDataUpdate represents the (global) `account_data` section of a v2 sync response.
 type AccountDataUpdate struct {
 	AccountData []state.AccountData
@@ -4,7 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/getsentry/sentry-go"
 
@@ -33,6 +35,8 @@ type UserRoomData struct {
 	HasLeft           bool
 	NotificationCount int
 	HighlightCount    int
+	// thread ID -> unread counts, only for threads with unread messages
+	ThreadUnreadCounts map[string]internal.ThreadUnreadCounts
 	// (event_id, last_event_id) -> closest prev_batch
 	// We mux in last_event_id so we can invalidate prev batch tokens for the same event ID when a new timeline event
 	// comes in, without having to do a SQL query.
@@ -48,6 +52,17 @@ type UserRoomData struct {
 	Tags map[string]float64
 	// the load state of the timeline
 	LoadPos int64
+	// The origin_server_ts of the user's join event in this room, in milliseconds. 0 if not joined.
+	// Profile changes do not update this.
+	JoinedAt int64
+	// True if this invite arrived as part of a burst of invites. See SetInviteSpamShield.
+	IsCollapsedInvite bool
+	// True if the sender of this invite shares a joined room with the user.
+	InviterKnown bool
+	// The timestamp of the latest event in this room which wasn't sent by a user this user ignores. Rooms
+	// are sorted by this instead of RoomMetadata.LastMessageTimestamp, so ignored users don't bump rooms.
+	// Only set if the user ignores anyone, else 0.
+	BumpTimestamp uint64
 }
 
 func NewUserRoomData() UserRoomData {
@@ -92,12 +107,16 @@ type InviteData struct {
 	InviteState          []json.RawMessage
 	Heroes               []internal.Hero
 	InviteEvent          *EventData
+	Sender               string // the sender of the invite event
 	NameEvent            string // the content of m.room.name, NOT the calculated name
 	CanonicalAlias       string
+	AvatarEvent          string
 	LastMessageTimestamp uint64
 	Encrypted            bool
 	IsDM                 bool
 	RoomType             string
+	RoomVersion          string
+	JoinRule             string
 }
 
 func NewInviteData(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) *InviteData {
@@ -126,6 +145,7 @@ func NewInviteData(ctx context.Context, userID, roomID string, inviteState []jso
 					LatestPos: PosAlwaysProcess,
 				}
 				id.IsDM = j.Get("is_direct").Bool()
+				id.Sender = j.Get("sender").Str
 			} else if target == j.Get("sender").Str {
 				id.Heroes = append(id.Heroes, internal.Hero{
 					ID:   target,
@@ -136,10 +156,15 @@ func NewInviteData(ctx context.Context, userID, roomID string, inviteState []jso
 			id.NameEvent = j.Get("content.name").Str
 		case "m.room.canonical_alias":
 			id.CanonicalAlias = j.Get("content.alias").Str
+		case "m.room.avatar":
+			id.AvatarEvent = j.Get("content.url").Str
 		case "m.room.encryption":
 			id.Encrypted = true
 		case "m.room.create":
 			id.RoomType = j.Get("content.type").Str
+			id.RoomVersion = j.Get("content.room_version").Str
+		case "m.room.join_rules":
+			id.JoinRule = j.Get("content.join_rule").Str
 		}
 	}
 	if id.InviteEvent == nil {
@@ -169,11 +194,14 @@ func (i *InviteData) RoomMetadata() *internal.RoomMetadata {
 		Heroes:               i.Heroes,
 		NameEvent:            i.NameEvent,
 		CanonicalAlias:       i.CanonicalAlias,
+		AvatarEvent:          i.AvatarEvent,
 		InviteCount:          1,
 		JoinCount:            1,
 		LastMessageTimestamp: i.LastMessageTimestamp,
 		Encrypted:            i.Encrypted,
 		RoomType:             roomType,
+		RoomVersion:          i.RoomVersion,
+		JoinRule:             i.JoinRule,
 	}
 }
 
@@ -200,18 +228,39 @@ type UserCache struct {
 	globalCache          *GlobalCache
 	txnIDs               TransactionIDFetcher
 	latestPos            int64
+	// room ID -> heroes for this user, cached until the membership or functional members of the room change
+	roomToHeroes   map[string][]internal.Hero
+	roomToHeroesMu *sync.Mutex
+	// the set of users in this user's m.ignored_user_list
+	ignoredUsers   map[string]struct{}
+	ignoredUsersMu *sync.RWMutex
+	// if > 0, invites are collapsed when there are already this many invites sent within inviteBurstWindow
+	inviteBurstThreshold int
+	inviteBurstWindow    time.Duration
+	// the rooms this user is joined to, so each new connection doesn't have to ask the database. Valid as of
+	// joinedRoomsPos. If !joinedRoomsValid, the next call to LoadJoinedRooms loads them from the database.
+	joinedRooms      map[string]struct{}
+	joinedRoomsPos   int64
+	joinedRoomsValid bool
+	joinedRoomsGen   int // incremented on invalidation, so stale database loads are not cached
+	joinedRoomsMu    *sync.Mutex
 }
 
 func NewUserCache(userID string, globalCache *GlobalCache, store *state.Storage, txnIDs TransactionIDFetcher) *UserCache {
 	uc := &UserCache{
-		UserID:       userID,
-		roomToDataMu: &sync.RWMutex{},
-		roomToData:   make(map[string]UserRoomData),
-		listeners:    make(map[int]UserCacheListener),
-		listenersMu:  &sync.RWMutex{},
-		store:        store,
-		globalCache:  globalCache,
-		txnIDs:       txnIDs,
+		UserID:         userID,
+		roomToDataMu:   &sync.RWMutex{},
+		roomToData:     make(map[string]UserRoomData),
+		listeners:      make(map[int]UserCacheListener),
+		listenersMu:    &sync.RWMutex{},
+		store:          store,
+		globalCache:    globalCache,
+		txnIDs:         txnIDs,
+		roomToHeroes:   make(map[string][]internal.Hero),
+		roomToHeroesMu: &sync.Mutex{},
+		ignoredUsers:   make(map[string]struct{}),
+		ignoredUsersMu: &sync.RWMutex{},
+		joinedRoomsMu:  &sync.Mutex{},
 	}
 	return uc
 }
@@ -236,7 +285,7 @@ func (c *UserCache) OnRegistered(ctx context.Context, _ int64) error {
 	// the OnRegistered callback which has locking guarantees. This is why...
 	latestPos, joinedRooms, err := c.globalCache.LoadJoinedRooms(ctx, c.UserID)
 	if err != nil {
-		return fmt.Errorf("failed to load joined rooms: %s", err)
+		return fmt.Errorf("failed to load joined rooms: %w", err)
 	}
 
 	// There is a race condition here as the global cache is a snapshot in time. If you register
@@ -272,6 +321,9 @@ func (c *UserCache) OnRegistered(ctx context.Context, _ int64) error {
 
 	// the db pos is _always_ equal to or ahead of the dispatcher, so we will discard any position less than this.
 	c.latestPos = latestPos
+	// for the same reason, this is an exact snapshot of the joined rooms which we can keep up to date
+	c.setJoinedRooms(c.joinedRoomsGen, latestPos, joinedRooms)
+	c.refreshBumpTimestamps()
 	for _, room := range joinedRooms {
 		// inject space children events
 		if room.IsSpace() {
@@ -288,14 +340,86 @@ func (c *UserCache) OnRegistered(ctx context.Context, _ int64) error {
 	return nil
 }
 
+// LoadJoinedRooms returns the metadata for all rooms this user is joined to, along with the position the
+// list of rooms is valid at. Connections should ignore events at or before this position. The list is
+// cached and kept up to date with membership events, so the database is only consulted when the cache
+// cannot be kept exact.
+func (c *UserCache) LoadJoinedRooms(ctx context.Context) (pos int64, joinedRooms map[string]*internal.RoomMetadata, err error) {
+	if c.globalCache.LoadJoinedRoomsOverride != nil {
+		return c.globalCache.LoadJoinedRooms(ctx, c.UserID)
+	}
+	c.joinedRoomsMu.Lock()
+	if c.joinedRoomsValid {
+		pos = c.joinedRoomsPos
+		roomIDs := make([]string, 0, len(c.joinedRooms))
+		for roomID := range c.joinedRooms {
+			roomIDs = append(roomIDs, roomID)
+		}
+		c.joinedRoomsMu.Unlock()
+		return pos, c.globalCache.LoadRooms(ctx, roomIDs...), nil
+	}
+	gen := c.joinedRoomsGen
+	c.joinedRoomsMu.Unlock()
+
+	pos, joinedRooms, err = c.globalCache.LoadJoinedRooms(ctx, c.UserID)
+	if err != nil {
+		return 0, nil, err
+	}
+	c.setJoinedRooms(gen, pos, joinedRooms)
+	return pos, joinedRooms, nil
+}
+
+// setJoinedRooms caches the joined rooms, unless they have been invalidated since generation `gen`.
+func (c *UserCache) setJoinedRooms(gen int, pos int64, joinedRooms map[string]*internal.RoomMetadata) {
+	c.joinedRoomsMu.Lock()
+	defer c.joinedRoomsMu.Unlock()
+	if gen != c.joinedRoomsGen {
+		return
+	}
+	c.joinedRooms = make(map[string]struct{}, len(joinedRooms))
+	for roomID := range joinedRooms {
+		c.joinedRooms[roomID] = struct{}{}
+	}
+	if pos > c.joinedRoomsPos {
+		c.joinedRoomsPos = pos
+	}
+	c.joinedRoomsValid = true
+}
+
+// trackJoinedRooms keeps the cached joined rooms up to date with this event.
+func (c *UserCache) trackJoinedRooms(eventData *EventData) {
+	c.joinedRoomsMu.Lock()
+	defer c.joinedRoomsMu.Unlock()
+	if eventData.EventType == "m.room.member" && eventData.StateKey != nil && *eventData.StateKey == c.UserID {
+		if eventData.LatestPos == 0 {
+			// This is initial room state, which has no position to give to connections. Nothing loaded
+			// before it can include the room, so go back to the database.
+			c.joinedRoomsValid = false
+			c.joinedRoomsGen++
+			return
+		}
+		if !c.joinedRoomsValid {
+			// nothing to keep up to date, they will be loaded from the database
+		} else if eventData.Content.Get("membership").Str == "join" {
+			c.joinedRooms[eventData.RoomID] = struct{}{}
+		} else {
+			delete(c.joinedRooms, eventData.RoomID)
+		}
+	}
+	if eventData.LatestPos > c.joinedRoomsPos {
+		c.joinedRoomsPos = eventData.LatestPos
+	}
+}
+
 func (c *UserCache) LazyLoadTimelines(ctx context.Context, loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]UserRoomData {
 	if c.LazyRoomDataOverride != nil {
 		return c.LazyRoomDataOverride(loadPos, roomIDs, maxTimelineEvents)
 	}
 	result := make(map[string]UserRoomData)
 	var lazyRoomIDs []string
+	roomIDToData := c.LoadRoomDatas(roomIDs...)
 	for _, roomID := range roomIDs {
-		urd := c.LoadRoomData(roomID)
+		urd := roomIDToData[roomID]
 		if len(urd.Timeline) > 0 && urd.LoadPos <= loadPos {
 			timeline := urd.Timeline
 			if len(timeline) > maxTimelineEvents {
@@ -351,7 +475,9 @@ func (c *UserCache) LazyLoadTimelines(ctx context.Context, loadPos int64, roomID
 	if len(lazyRoomIDs) == 0 {
 		return result
 	}
+	dbStart := time.Now()
 	roomIDToEvents, roomIDToPrevBatch, err := c.store.LatestEventsInRooms(c.UserID, lazyRoomIDs, loadPos, maxTimelineEvents)
+	internal.TrackDBTime(ctx, dbStart)
 	if err != nil {
 		logger.Err(err).Strs("rooms", lazyRoomIDs).Msg("failed to get LatestEventsInRooms")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -363,6 +489,7 @@ func (c *UserCache) LazyLoadTimelines(ctx context.Context, loadPos int64, roomID
 		if !ok {
 			urd = NewUserRoomData()
 		}
+		events = c.filterIgnoredEvents(events)
 		urd.Timeline = events
 		urd.LoadPos = loadPos
 		if len(events) > 0 {
@@ -377,6 +504,21 @@ func (c *UserCache) LazyLoadTimelines(ctx context.Context, loadPos int64, roomID
 	return result
 }
 
+// PrefetchTimelines loads the latest timeline events in the background for rooms which do not already
+// have enough events cached, so that a later request for these rooms can be served from memory.
+func (c *UserCache) PrefetchTimelines(ctx context.Context, loadPos int64, roomIDs []string, maxTimelineEvents int) {
+	var missing []string
+	for _, roomID := range roomIDs {
+		if len(c.LoadRoomData(roomID).Timeline) < maxTimelineEvents {
+			missing = append(missing, roomID)
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+	go c.LazyLoadTimelines(ctx, loadPos, missing, maxTimelineEvents)
+}
+
 func (c *UserCache) LoadRoomData(roomID string) UserRoomData {
 	c.roomToDataMu.RLock()
 	defer c.roomToDataMu.RUnlock()
@@ -387,6 +529,21 @@ func (c *UserCache) LoadRoomData(roomID string) UserRoomData {
 	return data
 }
 
+// LoadRoomDatas is LoadRoomData for many rooms at once, which only takes the lock once.
+func (c *UserCache) LoadRoomDatas(roomIDs ...string) map[string]UserRoomData {
+	result := make(map[string]UserRoomData, len(roomIDs))
+	c.roomToDataMu.RLock()
+	defer c.roomToDataMu.RUnlock()
+	for _, roomID := range roomIDs {
+		data, ok := c.roomToData[roomID]
+		if !ok {
+			data = NewUserRoomData()
+		}
+		result[roomID] = data
+	}
+	return result
+}
+
 type roomUpdateCache struct {
 	roomID         string
 	globalRoomData *internal.RoomMetadata
@@ -407,6 +564,33 @@ func (c *roomUpdateCache) UserRoomMetadata() *UserRoomData {
 	return c.userRoomData
 }
 
+// Heroes returns the heroes for this room from the perspective of this user, i.e excluding the user.
+// The result is cached until the membership or functional members of the room change. The metadata
+// should be the metadata the user is allowed to see, which is the invite metadata for invites.
+func (c *UserCache) Heroes(metadata *internal.RoomMetadata) []internal.Hero {
+	c.roomToHeroesMu.Lock()
+	defer c.roomToHeroesMu.Unlock()
+	heroes, ok := c.roomToHeroes[metadata.RoomID]
+	if ok {
+		return heroes
+	}
+	heroes = make([]internal.Hero, 0, len(metadata.Heroes))
+	for _, h := range metadata.Heroes {
+		if h.ID == c.UserID {
+			continue
+		}
+		heroes = append(heroes, h)
+	}
+	c.roomToHeroes[metadata.RoomID] = heroes
+	return heroes
+}
+
+func (c *UserCache) invalidateHeroes(roomID string) {
+	c.roomToHeroesMu.Lock()
+	delete(c.roomToHeroes, roomID)
+	c.roomToHeroesMu.Unlock()
+}
+
 // snapshots the user cache / global cache data for this room for sending to connections
 func (c *UserCache) newRoomUpdate(ctx context.Context, roomID string) RoomUpdate {
 	u := c.LoadRoomData(roomID)
@@ -435,7 +619,7 @@ func (c *UserCache) Invites() map[string]UserRoomData {
 	defer c.roomToDataMu.Unlock()
 	invites := make(map[string]UserRoomData)
 	for roomID, urd := range c.roomToData {
-		if !urd.IsInvite || urd.Invite == nil {
+		if !urd.IsInvite || urd.Invite == nil || urd.IsCollapsedInvite {
 			continue
 		}
 		invites[roomID] = urd
@@ -538,6 +722,18 @@ func (c *UserCache) emitOnUpdate(ctx context.Context, update Update) {
 	}
 }
 
+// SetJoinTimestamps sets when the user joined each room, in milliseconds. Used to seed a new cache, so
+// no updates are emitted.
+func (c *UserCache) SetJoinTimestamps(joinedAt map[string]int64) {
+	for roomID, ts := range joinedAt {
+		data := c.LoadRoomData(roomID)
+		data.JoinedAt = ts
+		c.roomToDataMu.Lock()
+		c.roomToData[roomID] = data
+		c.roomToDataMu.Unlock()
+	}
+}
+
 func (c *UserCache) OnUnreadCounts(ctx context.Context, roomID string, highlightCount, notifCount *int) {
 	data := c.LoadRoomData(roomID)
 	hasCountDecreased := false
@@ -563,6 +759,40 @@ func (c *UserCache) OnUnreadCounts(ctx context.Context, roomID string, highlight
 	c.emitOnRoomUpdate(ctx, roomUpdate)
 }
 
+// OnThreadUnreadCounts sets the complete set of thread unread counts for this room.
+func (c *UserCache) OnThreadUnreadCounts(ctx context.Context, roomID string, counts map[string]internal.ThreadUnreadCounts) {
+	data := c.LoadRoomData(roomID)
+	changed := make(map[string]internal.ThreadUnreadCounts)
+	current := make(map[string]internal.ThreadUnreadCounts)
+	for threadID, tc := range counts {
+		if tc.HighlightCount == 0 && tc.NotificationCount == 0 {
+			continue
+		}
+		current[threadID] = tc
+		if data.ThreadUnreadCounts[threadID] != tc {
+			changed[threadID] = tc
+		}
+	}
+	// threads which are no longer unread are sent with zero counts so clients know to clear them
+	for threadID := range data.ThreadUnreadCounts {
+		if _, exists := current[threadID]; !exists {
+			changed[threadID] = internal.ThreadUnreadCounts{}
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+	data.ThreadUnreadCounts = current
+	c.roomToDataMu.Lock()
+	c.roomToData[roomID] = data
+	c.roomToDataMu.Unlock()
+
+	c.emitOnUpdate(ctx, &ThreadUnreadCountsUpdate{
+		RoomID: roomID,
+		Counts: changed,
+	})
+}
+
 func (c *UserCache) OnSpaceUpdate(ctx context.Context, parentRoomID, childRoomID string, isDeleted bool, eventData *EventData) {
 	if eventData.LatestPos > 0 && eventData.LatestPos < c.latestPos {
 		// this is possible when we race when seeding spaces on init with live data
@@ -587,20 +817,176 @@ func (c *UserCache) OnSpaceUpdate(ctx context.Context, parentRoomID, childRoomID
 	c.emitOnRoomUpdate(ctx, roomUpdate)
 }
 
+// IsIgnored returns true if the given user is in this user's m.ignored_user_list.
+func (c *UserCache) IsIgnored(userID string) bool {
+	c.ignoredUsersMu.RLock()
+	defer c.ignoredUsersMu.RUnlock()
+	_, ignored := c.ignoredUsers[userID]
+	return ignored
+}
+
+func (c *UserCache) hasIgnoredUsers() bool {
+	c.ignoredUsersMu.RLock()
+	defer c.ignoredUsersMu.RUnlock()
+	return len(c.ignoredUsers) > 0
+}
+
+// bumpsRoom returns true if events of this type change a room's LastMessageTimestamp. See
+// GlobalCache.LatestEventFilter.
+func (c *UserCache) bumpsRoom(eventType string) bool {
+	if c.globalCache == nil {
+		return true
+	}
+	return c.globalCache.LatestEventFilter.IsRelevant(eventType)
+}
+
+// The number of recent events to look through for one not sent by an ignored user, per room.
+const bumpTimestampSearchLimit = 20
+
+// refreshBumpTimestamps works out UserRoomData.BumpTimestamp for every joined room from the database, or
+// clears it if the user doesn't ignore anyone. If every recent event in a room was sent by an ignored
+// user, the room is sorted by the oldest of them. Does nothing if the joined rooms aren't known yet, as
+// this is called again when they are loaded.
+func (c *UserCache) refreshBumpTimestamps() {
+	if !c.hasIgnoredUsers() {
+		c.roomToDataMu.Lock()
+		for roomID, urd := range c.roomToData {
+			if urd.BumpTimestamp != 0 {
+				urd.BumpTimestamp = 0
+				c.roomToData[roomID] = urd
+			}
+		}
+		c.roomToDataMu.Unlock()
+		return
+	}
+	if c.store == nil {
+		return
+	}
+	c.joinedRoomsMu.Lock()
+	if !c.joinedRoomsValid {
+		c.joinedRoomsMu.Unlock()
+		return
+	}
+	pos := c.joinedRoomsPos
+	roomIDs := make([]string, 0, len(c.joinedRooms))
+	for roomID := range c.joinedRooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	c.joinedRoomsMu.Unlock()
+	if len(roomIDs) == 0 {
+		return
+	}
+	roomIDToEvents, _, err := c.store.LatestEventsInRooms(c.UserID, roomIDs, pos, bumpTimestampSearchLimit)
+	if err != nil {
+		logger.Err(err).Str("user", c.UserID).Msg("failed to load latest events to work out bump timestamps")
+		return
+	}
+	c.roomToDataMu.Lock()
+	defer c.roomToDataMu.Unlock()
+	for roomID, events := range roomIDToEvents {
+		var bumpTimestamp uint64
+		visible := c.filterIgnoredEvents(events)
+		for i := len(visible) - 1; i >= 0; i-- {
+			ev := gjson.ParseBytes(visible[i])
+			if c.bumpsRoom(ev.Get("type").Str) {
+				bumpTimestamp = ev.Get("origin_server_ts").Uint()
+				break
+			}
+		}
+		if bumpTimestamp == 0 && len(events) > 0 {
+			bumpTimestamp = gjson.GetBytes(events[0], "origin_server_ts").Uint()
+		}
+		urd, ok := c.roomToData[roomID]
+		if !ok {
+			urd = NewUserRoomData()
+		}
+		urd.BumpTimestamp = bumpTimestamp
+		c.roomToData[roomID] = urd
+	}
+}
+
+// filterIgnoredEvents removes non-state events sent by ignored users, matching the behaviour of
+// Synapse. Returns the input slice if there is nothing to remove.
+func (c *UserCache) filterIgnoredEvents(events []json.RawMessage) []json.RawMessage {
+	c.ignoredUsersMu.RLock()
+	defer c.ignoredUsersMu.RUnlock()
+	if len(c.ignoredUsers) == 0 {
+		return events
+	}
+	filtered := make([]json.RawMessage, 0, len(events))
+	for _, ev := range events {
+		parsed := gjson.ParseBytes(ev)
+		if _, ignored := c.ignoredUsers[parsed.Get("sender").Str]; ignored && !parsed.Get("state_key").Exists() {
+			continue
+		}
+		filtered = append(filtered, ev)
+	}
+	return filtered
+}
+
+// setIgnoredUsers replaces the set of ignored users from the content of an m.ignored_user_list event.
+// Cached timelines are dropped as they may contain events from newly ignored users, or be missing events
+// from newly unignored users.
+func (c *UserCache) setIgnoredUsers(content gjson.Result) {
+	ignored := make(map[string]struct{})
+	content.Get("ignored_users").ForEach(func(k, _ gjson.Result) bool {
+		ignored[k.Str] = struct{}{}
+		return true
+	})
+	c.ignoredUsersMu.Lock()
+	c.ignoredUsers = ignored
+	c.ignoredUsersMu.Unlock()
+
+	c.roomToDataMu.Lock()
+	for roomID, urd := range c.roomToData {
+		if len(urd.Timeline) > 0 {
+			urd.Timeline = nil
+			c.roomToData[roomID] = urd
+		}
+	}
+	c.roomToDataMu.Unlock()
+	c.refreshBumpTimestamps()
+}
+
 func (c *UserCache) OnNewEvent(ctx context.Context, eventData *EventData) {
+	c.trackJoinedRooms(eventData)
+	// events from ignored users are dropped entirely so they don't appear in timelines or bump the room
+	if eventData.StateKey == nil && c.IsIgnored(eventData.Sender) {
+		return
+	}
 	// add this to our tracked timelines if we have one
 	urd := c.LoadRoomData(eventData.RoomID)
+	if c.hasIgnoredUsers() && c.bumpsRoom(eventData.EventType) && eventData.Timestamp > urd.BumpTimestamp {
+		urd.BumpTimestamp = eventData.Timestamp
+	}
+	if redacts := internal.RedactsEventID(gjson.ParseBytes(eventData.Event)); redacts != "" {
+		urd.Timeline = redactTimeline(urd.Timeline, redacts, eventData.Event)
+	}
 	if len(urd.Timeline) > 0 {
 		// we're tracking timelines, add this message too
 		urd.Timeline = append(urd.Timeline, eventData.Event)
 		urd.LoadPos = eventData.LatestPos
 	}
-	// reset the IsInvite field when the user actually joins/rejects the invite
-	if urd.IsInvite && eventData.EventType == "m.room.member" && eventData.StateKey != nil && *eventData.StateKey == c.UserID {
-		urd.IsInvite = eventData.Content.Get("membership").Str == "invite"
-		if !urd.IsInvite {
-			urd.HighlightCount = 0
+	if eventData.EventType == "m.room.member" && eventData.StateKey != nil && *eventData.StateKey == c.UserID {
+		membership := eventData.Content.Get("membership").Str
+		// reset the IsInvite field when the user actually joins/rejects the invite
+		if urd.IsInvite {
+			urd.IsInvite = membership == "invite"
+			if !urd.IsInvite {
+				urd.HighlightCount = 0
+				urd.IsCollapsedInvite = false
+			}
 		}
+		if membership != "join" {
+			urd.JoinedAt = 0
+		} else if urd.JoinedAt == 0 {
+			// only set on the first join, not on subsequent profile changes
+			urd.JoinedAt = int64(eventData.Timestamp)
+		}
+	}
+	if eventData.EventType == "m.room.member" || eventData.EventType == internal.FunctionalMembersEventType {
+		// membership changes can change the heroes in this room, and functional members are excluded from them
+		c.invalidateHeroes(eventData.RoomID)
 	}
 	if eventData.EventType == "m.space.child" && eventData.StateKey != nil {
 		// the children for a space we are a part of have changed. Find the room that was affected and update our cache value.
@@ -620,7 +1006,92 @@ func (c *UserCache) OnNewEvent(ctx context.Context, eventData *EventData) {
 	c.emitOnRoomUpdate(ctx, roomUpdate)
 }
 
+// redactTimeline returns the timeline with the event `redacts` redacted by this redaction event. The
+// timeline is copied if it contains the event, as it may be shared with earlier copies of the room data.
+func redactTimeline(timeline []json.RawMessage, redacts string, redaction json.RawMessage) []json.RawMessage {
+	for i, ev := range timeline {
+		if gjson.GetBytes(ev, "event_id").Str != redacts {
+			continue
+		}
+		redacted, err := internal.RedactEventJSON(ev, redaction)
+		if err != nil {
+			logger.Err(err).Str("event_id", redacts).Msg("failed to redact timeline event")
+			return timeline
+		}
+		newTimeline := make([]json.RawMessage, len(timeline))
+		copy(newTimeline, timeline)
+		newTimeline[i] = redacted
+		return newTimeline
+	}
+	return timeline
+}
+
+// SetInviteSpamShield collapses invites which arrive in a burst, to protect clients from invite spam.
+// An invite is collapsed if at least `threshold` other invites were sent within `window` of it. Collapsed
+// invites are not returned by Invites() and do not wake up connections. Instead, they are summarised by
+// CollapsedInvites. Must be called before any invites are processed.
+func (c *UserCache) SetInviteSpamShield(threshold int, window time.Duration) {
+	c.inviteBurstThreshold = threshold
+	c.inviteBurstWindow = window
+}
+
+// isInviteBurst returns true if the invite to roomID sent at `ts` is part of a burst of invites.
+func (c *UserCache) isInviteBurst(roomID string, ts uint64) bool {
+	if c.inviteBurstThreshold <= 0 {
+		return false
+	}
+	window := uint64(c.inviteBurstWindow.Milliseconds())
+	c.roomToDataMu.RLock()
+	defer c.roomToDataMu.RUnlock()
+	count := 0
+	for otherRoomID, urd := range c.roomToData {
+		if otherRoomID == roomID || !urd.IsInvite || urd.Invite == nil {
+			continue
+		}
+		otherTs := urd.Invite.LastMessageTimestamp
+		if otherTs+window >= ts && ts+window >= otherTs {
+			count++
+		}
+	}
+	return count >= c.inviteBurstThreshold
+}
+
+// sharesRoomWith returns true if this user and userID are both joined to at least one room.
+func (c *UserCache) sharesRoomWith(ctx context.Context, userID string) bool {
+	if c.store == nil || userID == "" {
+		return false
+	}
+	shared, err := c.store.UsersShareJoinedRoom(c.UserID, userID)
+	if err != nil {
+		logger.Err(err).Str("user", c.UserID).Str("inviter", userID).Msg("failed to check if the inviter shares a room")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return false
+	}
+	return shared
+}
+
+// CollapsedInvites returns the number of collapsed invites and up to `sampleSize` of their room IDs, sorted.
+func (c *UserCache) CollapsedInvites(sampleSize int) (count int, sample []string) {
+	if c.inviteBurstThreshold <= 0 {
+		return 0, nil
+	}
+	c.roomToDataMu.RLock()
+	for roomID, urd := range c.roomToData {
+		if urd.IsInvite && urd.IsCollapsedInvite && urd.Invite != nil {
+			count++
+			sample = append(sample, roomID)
+		}
+	}
+	c.roomToDataMu.RUnlock()
+	sort.Strings(sample)
+	if len(sample) > sampleSize {
+		sample = sample[:sampleSize]
+	}
+	return count, sample
+}
+
 func (c *UserCache) OnInvite(ctx context.Context, roomID string, inviteStateEvents []json.RawMessage) {
+	c.invalidateHeroes(roomID)
 	inviteData := NewInviteData(ctx, c.UserID, roomID, inviteStateEvents)
 	if inviteData == nil {
 		return // malformed invite
@@ -632,9 +1103,18 @@ func (c *UserCache) OnInvite(ctx context.Context, roomID string, inviteStateEven
 	urd.HighlightCount = InvitesAreHighlightsValue
 	urd.IsDM = inviteData.IsDM
 	urd.Invite = inviteData
+	urd.IsCollapsedInvite = c.isInviteBurst(roomID, inviteData.LastMessageTimestamp)
+	if !urd.IsCollapsedInvite {
+		// don't hit the database for every invite in a burst
+		urd.InviterKnown = c.sharesRoomWith(ctx, inviteData.Sender)
+	}
 	c.roomToDataMu.Lock()
 	c.roomToData[roomID] = urd
 	c.roomToDataMu.Unlock()
+	if urd.IsCollapsedInvite {
+		// don't wake up connections for invite spam
+		return
+	}
 
 	up := &InviteUpdate{
 		RoomUpdate: &roomUpdateCache{
@@ -650,8 +1130,13 @@ func (c *UserCache) OnInvite(ctx context.Context, roomID string, inviteStateEven
 }
 
 func (c *UserCache) OnLeftRoom(ctx context.Context, roomID string) {
+	c.invalidateHeroes(roomID)
+	c.joinedRoomsMu.Lock()
+	delete(c.joinedRooms, roomID)
+	c.joinedRoomsMu.Unlock()
 	urd := c.LoadRoomData(roomID)
 	urd.IsInvite = false
+	urd.IsCollapsedInvite = false
 	urd.HasLeft = true
 	urd.Invite = nil
 	urd.HighlightCount = 0
@@ -706,6 +1191,8 @@ func (c *UserCache) OnAccountData(ctx context.Context, datas []state.AccountData
 				c.roomToData[dmRoomID] = u
 			}
 			c.roomToDataMu.Unlock()
+		} else if d.Type == "m.ignored_user_list" && d.RoomID == state.AccountDataGlobalRoom {
+			c.setIgnoredUsers(gjson.ParseBytes(d.Data).Get("content"))
 		} else if d.Type == "m.tag" {
 			content := gjson.ParseBytes(d.Data).Get("content.tags")
 			if tagUpdates[d.RoomID] == nil {
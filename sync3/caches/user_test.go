@@ -6,8 +6,13 @@ import (
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/matrix-org/sliding-sync/testutils"
+	"github.com/tidwall/gjson"
 )
 
 type txnIDFetcher struct {
@@ -91,6 +96,153 @@ func TestAnnotateWithTransactionIDs(t *testing.T) {
 	}
 }
 
+// Test that heroes exclude the user, are cached, and are recalculated when the cache is invalidated.
+func TestUserCacheHeroes(t *testing.T) {
+	userID := "@alice:localhost"
+	roomID := "!heroes:localhost"
+	uc := caches.NewUserCache(userID, caches.NewGlobalCache(nil), nil, &txnIDFetcher{})
+	metadata := &internal.RoomMetadata{
+		RoomID: roomID,
+		Heroes: []internal.Hero{
+			{ID: "@bob:localhost", Name: "Bob"},
+			{ID: userID, Name: "Alice"},
+		},
+	}
+	want := []internal.Hero{{ID: "@bob:localhost", Name: "Bob"}}
+	if got := uc.Heroes(metadata); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Heroes: got %v want %v", got, want)
+	}
+	// cached, so changes to the metadata are not seen
+	metadata.Heroes = append(metadata.Heroes, internal.Hero{ID: "@charlie:localhost"})
+	if got := uc.Heroes(metadata); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Heroes was not cached: got %v want %v", got, want)
+	}
+	// leaving the room invalidates the cache
+	uc.OnLeftRoom(context.Background(), roomID)
+	want = append(want, internal.Hero{ID: "@charlie:localhost"})
+	if got := uc.Heroes(metadata); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Heroes was not invalidated: got %v want %v", got, want)
+	}
+	// as does a change to the functional members, who are excluded from heroes
+	metadata.Heroes = metadata.Heroes[:2]
+	emptyStateKey := ""
+	uc.OnNewEvent(context.Background(), &caches.EventData{
+		RoomID:    roomID,
+		EventType: internal.FunctionalMembersEventType,
+		StateKey:  &emptyStateKey,
+	})
+	want = want[:1]
+	if got := uc.Heroes(metadata); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Heroes was not invalidated by functional members: got %v want %v", got, want)
+	}
+}
+
+type updateRecorder struct {
+	updates []caches.Update
+}
+
+func (r *updateRecorder) OnRoomUpdate(ctx context.Context, up caches.RoomUpdate) {
+	r.updates = append(r.updates, up)
+}
+func (r *updateRecorder) OnUpdate(ctx context.Context, up caches.Update) {
+	r.updates = append(r.updates, up)
+}
+
+func TestUserCacheThreadUnreadCounts(t *testing.T) {
+	ctx := context.Background()
+	roomID := "!threads:localhost"
+	uc := caches.NewUserCache("@alice:localhost", nil, nil, &txnIDFetcher{})
+	rec := &updateRecorder{}
+	uc.Subsribe(rec)
+
+	uc.OnThreadUnreadCounts(ctx, roomID, map[string]internal.ThreadUnreadCounts{
+		"$a": {NotificationCount: 2},
+		"$b": {HighlightCount: 1, NotificationCount: 1},
+	})
+	// no change, no update
+	uc.OnThreadUnreadCounts(ctx, roomID, map[string]internal.ThreadUnreadCounts{
+		"$a": {NotificationCount: 2},
+		"$b": {HighlightCount: 1, NotificationCount: 1},
+	})
+	// $a is read, $b is unchanged
+	uc.OnThreadUnreadCounts(ctx, roomID, map[string]internal.ThreadUnreadCounts{
+		"$b": {HighlightCount: 1, NotificationCount: 1},
+	})
+	if len(rec.updates) != 2 {
+		t.Fatalf("got %d updates, want 2", len(rec.updates))
+	}
+	second := rec.updates[1].(*caches.ThreadUnreadCountsUpdate)
+	want := map[string]internal.ThreadUnreadCounts{"$a": {}}
+	if !reflect.DeepEqual(second.Counts, want) {
+		t.Fatalf("got counts %v want %v", second.Counts, want)
+	}
+	got := uc.LoadRoomData(roomID).ThreadUnreadCounts
+	want = map[string]internal.ThreadUnreadCounts{"$b": {HighlightCount: 1, NotificationCount: 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got stored counts %v want %v", got, want)
+	}
+}
+
+func TestUserCacheIgnoredUsers(t *testing.T) {
+	ctx := context.Background()
+	roomID := "!ignore:localhost"
+	uc := caches.NewUserCache("@alice:localhost", caches.NewGlobalCache(nil), nil, &txnIDFetcher{})
+	rec := &updateRecorder{}
+	uc.Subsribe(rec)
+	uc.OnAccountData(ctx, []state.AccountData{{
+		UserID: "@alice:localhost",
+		RoomID: state.AccountDataGlobalRoom,
+		Type:   "m.ignored_user_list",
+		Data:   []byte(`{"type":"m.ignored_user_list","content":{"ignored_users":{"@spammer:localhost":{}}}}`),
+	}})
+	rec.updates = nil
+	if !uc.IsIgnored("@spammer:localhost") || uc.IsIgnored("@bob:localhost") {
+		t.Fatalf("IsIgnored returned the wrong values")
+	}
+	uc.OnNewEvent(ctx, &caches.EventData{
+		RoomID:    roomID,
+		EventType: "m.room.message",
+		Sender:    "@bob:localhost",
+		Timestamp: 100,
+	})
+	rec.updates = nil
+	// messages from ignored users are dropped, and don't change the timestamp the room is sorted by
+	uc.OnNewEvent(ctx, &caches.EventData{
+		RoomID:    roomID,
+		EventType: "m.room.message",
+		Sender:    "@spammer:localhost",
+		Timestamp: 200,
+	})
+	if len(rec.updates) != 0 {
+		t.Fatalf("got %d updates for an ignored user's message, want 0", len(rec.updates))
+	}
+	if got := uc.LoadRoomData(roomID).BumpTimestamp; got != 100 {
+		t.Fatalf("BumpTimestamp: got %d want 100", got)
+	}
+	// but their state events are not
+	stateKey := "@spammer:localhost"
+	uc.OnNewEvent(ctx, &caches.EventData{
+		RoomID:    roomID,
+		EventType: "m.room.member",
+		StateKey:  &stateKey,
+		Sender:    "@spammer:localhost",
+	})
+	if len(rec.updates) != 1 {
+		t.Fatalf("got %d updates for an ignored user's state event, want 1", len(rec.updates))
+	}
+
+	// unignoring everyone goes back to sorting by the room's latest message
+	uc.OnAccountData(ctx, []state.AccountData{{
+		UserID: "@alice:localhost",
+		RoomID: state.AccountDataGlobalRoom,
+		Type:   "m.ignored_user_list",
+		Data:   []byte(`{"type":"m.ignored_user_list","content":{"ignored_users":{}}}`),
+	}})
+	if got := uc.LoadRoomData(roomID).BumpTimestamp; got != 0 {
+		t.Fatalf("BumpTimestamp after unignoring: got %d want 0", got)
+	}
+}
+
 func js(in interface{}) string {
 	b, _ := json.Marshal(in)
 	return string(b)
@@ -123,3 +275,140 @@ func convertIDTxnToEventStub(roomToEventIDs map[string][][2]string) map[string][
 	}
 	return result
 }
+
+func TestUserCacheInviteSpamShield(t *testing.T) {
+	ctx := context.Background()
+	alice := "@alice:localhost"
+	spammer := "@spammer:localhost"
+	uc := caches.NewUserCache(alice, caches.NewGlobalCache(nil), nil, &txnIDFetcher{})
+	uc.SetInviteSpamShield(2, time.Minute)
+	rec := &updateRecorder{}
+	uc.Subsribe(rec)
+	invite := func(roomID string, ts time.Time) {
+		uc.OnInvite(ctx, roomID, []json.RawMessage{
+			testutils.NewStateEvent(t, "m.room.member", alice, spammer, map[string]interface{}{"membership": "invite"}, testutils.WithTimestamp(ts)),
+		})
+	}
+	start := time.Now()
+	invite("!a:localhost", start)
+	invite("!b:localhost", start.Add(time.Second))
+	// there are already 2 invites within a minute of this one
+	invite("!c:localhost", start.Add(2*time.Second))
+	// but not this one
+	invite("!d:localhost", start.Add(10*time.Minute))
+	// re-invites to the same room don't count towards the burst
+	invite("!d:localhost", start.Add(10*time.Minute))
+
+	if len(rec.updates) != 4 {
+		t.Errorf("got %d updates, want 4: collapsed invites should not emit updates", len(rec.updates))
+	}
+	invites := uc.Invites()
+	for _, roomID := range []string{"!a:localhost", "!b:localhost", "!d:localhost"} {
+		if _, ok := invites[roomID]; !ok {
+			t.Errorf("Invites() is missing %s", roomID)
+		}
+	}
+	if _, ok := invites["!c:localhost"]; ok || len(invites) != 3 {
+		t.Errorf("Invites() got %v, want the collapsed invite to be excluded", invites)
+	}
+	count, sample := uc.CollapsedInvites(5)
+	if count != 1 || !reflect.DeepEqual(sample, []string{"!c:localhost"}) {
+		t.Errorf("CollapsedInvites got (%d, %v) want (1, [!c:localhost])", count, sample)
+	}
+	// the inviter is never known without a store
+	if invites["!a:localhost"].InviterKnown {
+		t.Errorf("InviterKnown was set without a store")
+	}
+
+	// rejecting the collapsed invite removes it
+	uc.OnLeftRoom(ctx, "!c:localhost")
+	if count, _ = uc.CollapsedInvites(5); count != 0 {
+		t.Errorf("CollapsedInvites got %d after rejecting the invite, want 0", count)
+	}
+}
+
+func TestUserCacheJoinedRooms(t *testing.T) {
+	ctx := context.Background()
+	store := state.NewStorage(postgresConnectionString)
+	alice := "@alice_TestUserCacheJoinedRooms:localhost"
+	roomA := "!a_TestUserCacheJoinedRooms:localhost"
+	roomB := "!b_TestUserCacheJoinedRooms:localhost"
+	for _, roomID := range []string{roomA, roomB} {
+		_, _, err := store.Accumulate(roomID, "", []json.RawMessage{
+			testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+			testutils.NewJoinEvent(t, alice),
+		})
+		if err != nil {
+			t.Fatalf("Accumulate: %s", err)
+		}
+	}
+	globalCache := caches.NewGlobalCache(store)
+	globalCache.SetLazyLoading()
+	uc := caches.NewUserCache(alice, globalCache, store, &txnIDFetcher{})
+	if err := uc.OnRegistered(ctx, 0); err != nil {
+		t.Fatalf("OnRegistered: %s", err)
+	}
+	assertJoinedRooms := func(wantPos int64, wantRoomIDs ...string) {
+		t.Helper()
+		pos, rooms, err := uc.LoadJoinedRooms(ctx)
+		if err != nil {
+			t.Fatalf("LoadJoinedRooms: %s", err)
+		}
+		if wantPos > 0 && pos != wantPos {
+			t.Errorf("LoadJoinedRooms: got pos %d want %d", pos, wantPos)
+		}
+		if len(rooms) != len(wantRoomIDs) {
+			t.Errorf("LoadJoinedRooms: got %d rooms want %v", len(rooms), wantRoomIDs)
+		}
+		for _, roomID := range wantRoomIDs {
+			if rooms[roomID] == nil {
+				t.Errorf("LoadJoinedRooms: missing room %s", roomID)
+			}
+		}
+	}
+	latestPos, err := store.LatestEventNID()
+	if err != nil {
+		t.Fatalf("LatestEventNID: %s", err)
+	}
+	assertJoinedRooms(latestPos, roomA, roomB)
+
+	// membership events keep the cache up to date, without going back to the database
+	leaveEvent := testutils.NewStateEvent(t, "m.room.member", alice, alice, map[string]interface{}{"membership": "leave"})
+	uc.OnNewEvent(ctx, &caches.EventData{
+		Event:     leaveEvent,
+		RoomID:    roomB,
+		EventType: "m.room.member",
+		StateKey:  &alice,
+		Content:   gjson.GetBytes(leaveEvent, "content"),
+		LatestPos: latestPos + 10,
+	})
+	assertJoinedRooms(latestPos+10, roomA)
+
+	// initial room state has no position, so the rooms are loaded from the database again, where alice
+	// is still joined to both rooms.
+	joinEvent := testutils.NewJoinEvent(t, alice)
+	uc.OnNewEvent(ctx, &caches.EventData{
+		Event:     joinEvent,
+		RoomID:    roomB,
+		EventType: "m.room.member",
+		StateKey:  &alice,
+		Content:   gjson.GetBytes(joinEvent, "content"),
+	})
+	assertJoinedRooms(0, roomA, roomB)
+}
+
+func TestUserCacheLoadRoomDatas(t *testing.T) {
+	uc := caches.NewUserCache("@alice:localhost", caches.NewGlobalCache(nil), nil, &txnIDFetcher{})
+	notifCount := 3
+	uc.OnUnreadCounts(context.Background(), "!a:localhost", nil, &notifCount)
+	datas := uc.LoadRoomDatas("!a:localhost", "!b:localhost")
+	if len(datas) != 2 {
+		t.Fatalf("LoadRoomDatas: got %d rooms want 2", len(datas))
+	}
+	if datas["!a:localhost"].NotificationCount != 3 {
+		t.Errorf("LoadRoomDatas: got notification count %d want 3", datas["!a:localhost"].NotificationCount)
+	}
+	if datas["!b:localhost"].Tags == nil {
+		t.Errorf("LoadRoomDatas: unknown room was not given default data")
+	}
+}
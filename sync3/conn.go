@@ -199,24 +199,23 @@ func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request) (resp *Respo
 		// To ensure this doesn't take too long, be cheeky and inject a low timeout value to ensure we
 		// don't needlessly block.
 		req.SetTimeoutMSecs(1)
+		// the buffered response is returned rather than the one we're about to make, so don't stream it
+		req.SetStreamer(nil)
 	}
 
 	resp, err := c.tryRequest(ctx, req)
 	if err != nil {
-		herr, ok := err.(*internal.HandlerError)
-		if !ok {
-			herr = &internal.HandlerError{
-				StatusCode: 500,
-				Err:        err,
-			}
-		}
-		return nil, herr
+		return nil, internal.ToHandlerError(err)
 	}
 	// assign the last client request now _after_ we have processed the request so we don't incorrectly
 	// cache errors or panics and result in getting wedged or tightlooping.
 	c.lastClientRequest = *req
+	c.lastClientRequest.streamer = nil // don't hold onto the http.ResponseWriter
 	// this position is the highest stored pos +1
-	resp.Pos = fmt.Sprintf("%d", c.lastPos+1)
+	resp.Pos = Position{
+		Conn:       c.lastPos + 1,
+		Extensions: resp.Extensions.Positions(),
+	}.String()
 	resp.TxnID = req.TxnID
 	// buffer it
 	c.serverResponses = append(c.serverResponses, *resp)
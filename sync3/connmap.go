@@ -80,6 +80,17 @@ func (m *ConnMap) CloseConn(connID ConnID) {
 	m.cache.Remove(connID.String()) // this will fire TTL callbacks which calls closeConn
 }
 
+// CloseConnsForUser closes all connections for this user.
+func (m *ConnMap) CloseConnsForUser(userID string) {
+	m.mu.Lock()
+	// copy as closeConn modifies the slice in place
+	conns := append([]*Conn{}, m.userIDToConn[userID]...)
+	m.mu.Unlock()
+	for _, conn := range conns {
+		m.CloseConn(conn.ConnID)
+	}
+}
+
 func (m *ConnMap) closeConnExpires(connID string, value interface{}) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -5,9 +5,11 @@ import (
 	"encoding/json"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 	"github.com/tidwall/gjson"
 )
@@ -32,6 +34,13 @@ type Dispatcher struct {
 	userToReceiver   map[string]Receiver
 	userToReceiverMu *sync.RWMutex
 	latestPos        int64
+
+	// if > 0, per-user receivers are invoked asynchronously. See SetAsync.
+	queueSize  int
+	onOverflow func(userID string)
+
+	// nil unless AddPrometheusMetrics is called
+	fanOutDuration prometheus.Histogram
 }
 
 func NewDispatcher() *Dispatcher {
@@ -43,21 +52,95 @@ func NewDispatcher() *Dispatcher {
 	}
 }
 
+// SetAsync makes the dispatcher invoke per-user receivers on their own goroutine, with up to queueSize
+// pending updates each, so a slow receiver cannot stall the delivery of events to everyone else. Global
+// receivers are still invoked synchronously so caches update before any user is told about an event.
+// If a receiver falls queueSize updates behind or panics, further updates are dropped, it is unregistered
+// and onOverflow is called once for that user, who must then be reloaded from the database.
+// Must be called before any receivers are registered.
+func (d *Dispatcher) SetAsync(queueSize int, onOverflow func(userID string)) {
+	d.queueSize = queueSize
+	d.onOverflow = onOverflow
+}
+
+// AddPrometheusMetrics exposes how long it takes to notify all listeners of an event.
+func (d *Dispatcher) AddPrometheusMetrics() {
+	d.fanOutDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "cache",
+		Name:      "fan_out_duration_secs",
+		Help:      "Time taken in seconds to notify the global and per-user caches of a new event.",
+		Buckets:   []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1},
+	})
+	prometheus.MustRegister(d.fanOutDuration)
+}
+
+// RemovePrometheusMetrics unregisters the metrics added by AddPrometheusMetrics, if any.
+func (d *Dispatcher) RemovePrometheusMetrics() {
+	if d.fanOutDuration != nil {
+		prometheus.Unregister(d.fanOutDuration)
+	}
+}
+
+// Do calls fn in order with the updates sent to this user's receiver. Use it for updates which go straight
+// to a user cache rather than through the dispatcher, so they are not reordered with respect to events.
+func (d *Dispatcher) Do(userID string, fn func()) {
+	d.userToReceiverMu.RLock()
+	q, ok := d.userToReceiver[userID].(*queuedReceiver)
+	d.userToReceiverMu.RUnlock()
+	if !ok {
+		fn()
+		return
+	}
+	q.enqueue(fn)
+}
+
 func (d *Dispatcher) IsUserJoined(userID, roomID string) bool {
 	return d.jrt.IsUserJoined(userID, roomID)
 }
 
-// Load joined members into the dispatcher.
+func (d *Dispatcher) IsUserInvited(userID, roomID string) bool {
+	return d.jrt.IsUserInvited(userID, roomID)
+}
+
+// Load joined and invited members into the dispatcher.
 // MUST BE CALLED BEFORE V2 POLL LOOPS START.
-func (d *Dispatcher) Startup(roomToJoinedUsers map[string][]string) error {
+func (d *Dispatcher) Startup(roomToJoinedUsers, roomToInvitedUsers map[string][]string) error {
 	// populate joined rooms tracker
-	d.jrt.Startup(roomToJoinedUsers)
+	d.jrt.Startup(roomToJoinedUsers, roomToInvitedUsers)
 	return nil
 }
 
+// RecountRoom replaces the joined and invited members of this room. Join and invite counts are maintained
+// incrementally as membership events arrive, so this should be called with the members from the database
+// when membership events may have been missed e.g. after a gappy v2 sync.
+func (d *Dispatcher) RecountRoom(roomID string, joined, invited []string) {
+	d.jrt.SetRoomMembers(roomID, joined, invited)
+}
+
 func (d *Dispatcher) Unregister(userID string) {
 	d.userToReceiverMu.Lock()
 	defer d.userToReceiverMu.Unlock()
+	d.unregister(userID)
+}
+
+// hasReceiver returns true if this user has a receiver registered. Receivers are unregistered on other
+// goroutines, e.g when an async receiver overflows, so this takes the lock.
+func (d *Dispatcher) hasReceiver(userID string) bool {
+	if userID == DispatcherAllUsers {
+		return false // safety guard to prevent dupe global callbacks
+	}
+	d.userToReceiverMu.RLock()
+	defer d.userToReceiverMu.RUnlock()
+	_, exists := d.userToReceiver[userID]
+	return exists
+}
+
+// must hold userToReceiverMu
+func (d *Dispatcher) unregister(userID string) {
+	if q, ok := d.userToReceiver[userID].(*queuedReceiver); ok {
+		q.stop()
+	}
 	delete(d.userToReceiver, userID)
 }
 
@@ -66,11 +149,41 @@ func (d *Dispatcher) Register(ctx context.Context, userID string, r Receiver) er
 	defer d.userToReceiverMu.Unlock()
 	if _, ok := d.userToReceiver[userID]; ok {
 		logger.Warn().Str("user", userID).Msg("Dispatcher.Register: receiver already registered")
+		d.unregister(userID)
+	}
+	if d.queueSize > 0 && userID != DispatcherAllUsers {
+		q := newQueuedReceiver(r, d.queueSize)
+		q.onOverflow = func() {
+			d.overflowed(userID, q)
+		}
+		r = q
 	}
 	d.userToReceiver[userID] = r
 	return r.OnRegistered(ctx, d.latestPos)
 }
 
+// overflowed is called when the receiver r has dropped updates for this user, because it fell behind or
+// panicked. It is called on its own goroutine, as the receiver overflows whilst the dispatcher holds
+// userToReceiverMu.
+func (d *Dispatcher) overflowed(userID string, r Receiver) {
+	d.userToReceiverMu.Lock()
+	// the user may have been re-registered with a fresh receiver since
+	current := d.userToReceiver[userID] == r
+	if current {
+		d.unregister(userID)
+	}
+	d.userToReceiverMu.Unlock()
+	if !current {
+		return
+	}
+	logger.Warn().Str("user", userID).Int("queue_size", d.queueSize).Msg(
+		"Dispatcher: receiver is too far behind or failed, dropping updates and unregistering it",
+	)
+	if d.onOverflow != nil {
+		d.onOverflow(userID)
+	}
+}
+
 func (d *Dispatcher) newEventData(event json.RawMessage, roomID string, latestPos int64) *caches.EventData {
 	// parse the event to pull out fields we care about
 	var stateKey *string
@@ -127,25 +240,44 @@ func (d *Dispatcher) OnNewInitialRoomState(ctx context.Context, roomID string, s
 	inviteCount := d.jrt.NumInvitedUsersForRoom(roomID)
 
 	// work out who to notify
-	userIDs, joinCount := d.jrt.JoinedUsersForRoom(roomID, func(userID string) bool {
-		if userID == DispatcherAllUsers {
-			return false // safety guard to prevent dupe global callbacks
-		}
-		_, exists := d.userToReceiver[userID]
-		return exists
-	})
+	userIDs, joinCount := d.jrt.JoinedUsersForRoom(roomID, d.hasReceiver)
 
 	// notify listeners
 	for _, ed := range eventDatas {
 		ed.InviteCount = inviteCount
 		ed.JoinCount = joinCount
-		d.notifyListeners(ctx, ed, userIDs, "", forceInitial, "")
+		d.notifyListeners(ctx, &NewEvent{
+			ed:                 ed,
+			userIDs:            userIDs,
+			shouldForceInitial: forceInitial,
+		})
 	}
 }
 
 func (d *Dispatcher) OnNewEvent(
 	ctx context.Context, roomID string, event json.RawMessage, pos int64,
 ) {
+	d.NotifyNewEvent(ctx, d.PrepareNewEvent(roomID, event, pos))
+}
+
+// NewEvent is an event which has been applied to the joined rooms tracker, and which is waiting to be sent
+// to receivers. See PrepareNewEvent.
+type NewEvent struct {
+	ed                 *caches.EventData
+	userIDs            []string
+	targetUser         string
+	shouldForceInitial bool
+	membership         string
+
+	// progress through notifying receivers, so a retried NotifyNewEvent skips receivers which succeeded
+	notifiedGlobal bool
+	notifiedUsers  int
+	notifiedTarget bool
+}
+
+// PrepareNewEvent applies a new event to the joined rooms tracker and works out who to notify about it.
+// This must only be done once per event, so the result is passed to NotifyNewEvent, which may be retried.
+func (d *Dispatcher) PrepareNewEvent(roomID string, event json.RawMessage, pos int64) *NewEvent {
 	// keep track of the latest position. We don't care about it, but Receivers do if they want
 	// to atomically load from the global cache and receive updates.
 	if pos > d.latestPos {
@@ -177,25 +309,25 @@ func (d *Dispatcher) OnNewEvent(
 	}
 
 	// notify all people in this room
-	userIDs, joinCount := d.jrt.JoinedUsersForRoom(ed.RoomID, func(userID string) bool {
-		if userID == DispatcherAllUsers {
-			return false // safety guard to prevent dupe global callbacks
-		}
-		_, exists := d.userToReceiver[userID]
-		return exists
-	})
+	userIDs, joinCount := d.jrt.JoinedUsersForRoom(ed.RoomID, d.hasReceiver)
 	ed.JoinCount = joinCount
-	d.notifyListeners(ctx, ed, userIDs, targetUser, shouldForceInitial, membership)
+	return &NewEvent{
+		ed:                 ed,
+		userIDs:            userIDs,
+		targetUser:         targetUser,
+		shouldForceInitial: shouldForceInitial,
+		membership:         membership,
+	}
+}
+
+// NotifyNewEvent sends a prepared event to the global receiver and then to each user's receiver. If a
+// receiver panics, calling this again carries on from that receiver, so nobody is sent the event twice.
+func (d *Dispatcher) NotifyNewEvent(ctx context.Context, ne *NewEvent) {
+	d.notifyListeners(ctx, ne)
 }
 
 func (d *Dispatcher) OnEphemeralEvent(ctx context.Context, roomID string, ephEvent json.RawMessage) {
-	notifyUserIDs, _ := d.jrt.JoinedUsersForRoom(roomID, func(userID string) bool {
-		if userID == DispatcherAllUsers {
-			return false // safety guard to prevent dupe global callbacks
-		}
-		_, exists := d.userToReceiver[userID]
-		return exists
-	})
+	notifyUserIDs, _ := d.jrt.JoinedUsersForRoom(roomID, d.hasReceiver)
 
 	d.userToReceiverMu.RLock()
 	defer d.userToReceiverMu.RUnlock()
@@ -217,13 +349,7 @@ func (d *Dispatcher) OnEphemeralEvent(ctx context.Context, roomID string, ephEve
 }
 
 func (d *Dispatcher) OnReceipt(ctx context.Context, receipt internal.Receipt) {
-	notifyUserIDs, _ := d.jrt.JoinedUsersForRoom(receipt.RoomID, func(userID string) bool {
-		if userID == DispatcherAllUsers {
-			return false // safety guard to prevent dupe global callbacks
-		}
-		_, exists := d.userToReceiver[userID]
-		return exists
-	})
+	notifyUserIDs, _ := d.jrt.JoinedUsersForRoom(receipt.RoomID, d.hasReceiver)
 
 	d.userToReceiverMu.RLock()
 	defer d.userToReceiverMu.RUnlock()
@@ -244,46 +370,58 @@ func (d *Dispatcher) OnReceipt(ctx context.Context, receipt internal.Receipt) {
 	}
 }
 
-func (d *Dispatcher) notifyListeners(ctx context.Context, ed *caches.EventData, userIDs []string, targetUser string, shouldForceInitial bool, membership string) {
-	internal.Logf(ctx, "dispatcher", "%s: notify %d users (nid=%d,join_count=%d)", ed.RoomID, len(userIDs), ed.LatestPos, ed.JoinCount)
+func (d *Dispatcher) notifyListeners(ctx context.Context, ne *NewEvent) {
+	ed := ne.ed
+	internal.Logf(ctx, "dispatcher", "%s: notify %d users (nid=%d,join_count=%d)", ed.RoomID, len(ne.userIDs), ed.LatestPos, ed.JoinCount)
+	if d.fanOutDuration != nil {
+		start := time.Now()
+		defer func() {
+			d.fanOutDuration.Observe(time.Since(start).Seconds())
+		}()
+	}
 	// invoke listeners
 	d.userToReceiverMu.RLock()
 	defer d.userToReceiverMu.RUnlock()
 
 	// global listeners (invoke before per-user listeners so caches can update)
-	listener := d.userToReceiver[DispatcherAllUsers]
-	if listener != nil {
-		listener.OnNewEvent(ctx, ed)
+	if !ne.notifiedGlobal {
+		listener := d.userToReceiver[DispatcherAllUsers]
+		if listener != nil {
+			listener.OnNewEvent(ctx, ed)
+		}
+		ne.notifiedGlobal = true
 	}
 
 	// per-user listeners
-	notifiedTarget := false
-	for _, userID := range userIDs {
+	for ; ne.notifiedUsers < len(ne.userIDs); ne.notifiedUsers++ {
+		userID := ne.userIDs[ne.notifiedUsers]
 		l := d.userToReceiver[userID]
 		if l != nil {
 			edd := *ed
-			if targetUser == userID {
-				notifiedTarget = true
-				if shouldForceInitial {
+			if ne.targetUser == userID {
+				ne.notifiedTarget = true
+				if ne.shouldForceInitial {
 					edd.ForceInitial = true
 				}
 			}
 			l.OnNewEvent(ctx, &edd)
 		}
 	}
-	if targetUser != "" && !notifiedTarget { // e.g invites/leaves where you aren't joined yet but need to know about it
+	if ne.targetUser != "" && !ne.notifiedTarget { // e.g invites/leaves where you aren't joined yet but need to know about it
 		// We expect invites to come down the invitee's poller, which triggers OnInvite code paths and
 		// not normal event codepaths. We need the separate code path to ensure invite stripped state
 		// is sent to the conn and not live data. Hence, if we get the invite event early from a different
 		// connection, do not send it to the target, as they must wait for the invite on their poller.
-		if membership != "invite" {
-			if shouldForceInitial {
-				ed.ForceInitial = true
+		if ne.membership != "invite" {
+			edd := *ed
+			if ne.shouldForceInitial {
+				edd.ForceInitial = true
 			}
-			l := d.userToReceiver[targetUser]
+			l := d.userToReceiver[ne.targetUser]
 			if l != nil {
-				l.OnNewEvent(ctx, ed)
+				l.OnNewEvent(ctx, &edd)
 			}
 		}
+		ne.notifiedTarget = true
 	}
 }
@@ -0,0 +1,186 @@
+package sync3
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/tidwall/gjson"
+)
+
+type recordingReceiver struct {
+	block   chan struct{} // if set, updates block until this is closed
+	panicOn string        // if set, panic when sent the event with this ID
+	updates chan string
+}
+
+func newRecordingReceiver() *recordingReceiver {
+	return &recordingReceiver{
+		updates: make(chan string, 100),
+	}
+}
+
+func (r *recordingReceiver) OnNewEvent(ctx context.Context, event *caches.EventData) {
+	if r.block != nil {
+		<-r.block
+	}
+	if r.panicOn != "" && gjson.GetBytes(event.Event, "event_id").Str == r.panicOn {
+		panic("recordingReceiver: panicOn")
+	}
+	r.updates <- gjson.GetBytes(event.Event, "event_id").Str
+}
+func (r *recordingReceiver) OnReceipt(ctx context.Context, receipt internal.Receipt) {}
+func (r *recordingReceiver) OnEphemeralEvent(ctx context.Context, roomID string, ephEvent json.RawMessage) {
+}
+func (r *recordingReceiver) OnRegistered(ctx context.Context, latestPos int64) error {
+	return nil
+}
+
+func (r *recordingReceiver) next(t *testing.T) string {
+	t.Helper()
+	select {
+	case update := <-r.updates:
+		return update
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for update")
+		return ""
+	}
+}
+
+func TestDispatcherAsyncSlowReceiver(t *testing.T) {
+	ctx := context.Background()
+	roomID := "!a:localhost"
+	overflowed := make(chan string, 10)
+	d := NewDispatcher()
+	d.SetAsync(2, func(userID string) {
+		overflowed <- userID
+	})
+	d.Startup(map[string][]string{
+		roomID: {"@alice:localhost", "@bob:localhost"},
+	}, nil)
+	alice := newRecordingReceiver()
+	alice.block = make(chan struct{})
+	defer close(alice.block)
+	bob := newRecordingReceiver()
+	for userID, r := range map[string]Receiver{"@alice:localhost": alice, "@bob:localhost": bob} {
+		if err := d.Register(ctx, userID, r); err != nil {
+			t.Fatalf("Register: %s", err)
+		}
+	}
+
+	// bob gets every event, even though alice isn't processing anything. Wait for bob to process each event
+	// before sending the next, so only alice falls behind.
+	eventIDs := []string{"$1", "$2", "$3", "$4", "$5"}
+	for i, eventID := range eventIDs {
+		d.OnNewEvent(ctx, roomID, json.RawMessage(`{"type":"m.room.message","event_id":"`+eventID+`","content":{}}`), int64(i+1))
+		if got := bob.next(t); got != eventID {
+			t.Errorf("bob got event %s want %s", got, eventID)
+		}
+	}
+	select {
+	case userID := <-overflowed:
+		if userID != "@alice:localhost" {
+			t.Errorf("overflow for %s want alice", userID)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for alice to overflow")
+	}
+	d.userToReceiverMu.RLock()
+	_, registered := d.userToReceiver["@alice:localhost"]
+	d.userToReceiverMu.RUnlock()
+	if registered {
+		t.Errorf("alice is still registered after overflowing")
+	}
+	if len(overflowed) != 0 {
+		t.Errorf("overflow called %d more times", len(overflowed))
+	}
+}
+
+func TestDispatcherAsyncPanickingReceiver(t *testing.T) {
+	ctx := context.Background()
+	roomID := "!a:localhost"
+	overflowed := make(chan string, 10)
+	d := NewDispatcher()
+	d.SetAsync(10, func(userID string) {
+		overflowed <- userID
+	})
+	d.Startup(map[string][]string{
+		roomID: {"@alice:localhost", "@bob:localhost"},
+	}, nil)
+	alice := newRecordingReceiver()
+	alice.panicOn = "$2"
+	bob := newRecordingReceiver()
+	for userID, r := range map[string]Receiver{"@alice:localhost": alice, "@bob:localhost": bob} {
+		if err := d.Register(ctx, userID, r); err != nil {
+			t.Fatalf("Register: %s", err)
+		}
+	}
+
+	eventIDs := []string{"$1", "$2", "$3"}
+	for i, eventID := range eventIDs {
+		d.OnNewEvent(ctx, roomID, json.RawMessage(`{"type":"m.room.message","event_id":"`+eventID+`","content":{}}`), int64(i+1))
+	}
+	for _, eventID := range eventIDs {
+		if got := bob.next(t); got != eventID {
+			t.Errorf("bob got event %s want %s", got, eventID)
+		}
+	}
+	// alice's panic doesn't crash the process, and she is dropped like a receiver which overflowed
+	if got := alice.next(t); got != "$1" {
+		t.Errorf("alice got event %s want $1", got)
+	}
+	select {
+	case userID := <-overflowed:
+		if userID != "@alice:localhost" {
+			t.Errorf("overflow for %s want alice", userID)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for alice to be unregistered")
+	}
+	d.userToReceiverMu.RLock()
+	_, registered := d.userToReceiver["@alice:localhost"]
+	d.userToReceiverMu.RUnlock()
+	if registered {
+		t.Errorf("alice is still registered after panicking")
+	}
+	if len(alice.updates) != 0 {
+		t.Errorf("alice got %d updates after panicking", len(alice.updates))
+	}
+}
+
+func TestDispatcherAsyncDoIsOrdered(t *testing.T) {
+	ctx := context.Background()
+	roomID := "!a:localhost"
+	d := NewDispatcher()
+	d.SetAsync(10, nil)
+	d.Startup(map[string][]string{
+		roomID: {"@alice:localhost"},
+	}, nil)
+	alice := newRecordingReceiver()
+	if err := d.Register(ctx, "@alice:localhost", alice); err != nil {
+		t.Fatalf("Register: %s", err)
+	}
+
+	d.OnNewEvent(ctx, roomID, json.RawMessage(`{"type":"m.room.message","event_id":"$1","content":{}}`), 1)
+	d.Do("@alice:localhost", func() {
+		alice.updates <- "do"
+	})
+	d.OnNewEvent(ctx, roomID, json.RawMessage(`{"type":"m.room.message","event_id":"$2","content":{}}`), 2)
+	for _, want := range []string{"$1", "do", "$2"} {
+		if got := alice.next(t); got != want {
+			t.Errorf("got %s want %s", got, want)
+		}
+	}
+
+	// users without a receiver are called inline
+	called := false
+	d.Do("@bob:localhost", func() {
+		called = true
+	})
+	if !called {
+		t.Errorf("Do did not call fn for unregistered user")
+	}
+}
@@ -6,17 +6,52 @@ import (
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"time"
 )
 
 // Client created request params
 type AccountDataRequest struct {
 	Core
+	// If set, only account data of these types is sent e.g ["m.push_rules"].
+	Types []string `json:"types"`
+	// Account data of these types is never sent. Takes priority over Types.
+	NotTypes []string `json:"not_types"`
 }
 
 func (r *AccountDataRequest) Name() string {
 	return "AccountDataRequest"
 }
 
+func (r *AccountDataRequest) ApplyDelta(gnext GenericRequest) {
+	r.Core.ApplyDelta(gnext)
+	next := gnext.(*AccountDataRequest)
+	// nil means they didn't specify this field, so leave it unchanged.
+	if next.Types != nil {
+		r.Types = next.Types
+	}
+	if next.NotTypes != nil {
+		r.NotTypes = next.NotTypes
+	}
+}
+
+// filter removes account data which the client does not want based on its type.
+func (r *AccountDataRequest) filter(events []state.AccountData) []state.AccountData {
+	if r.Types == nil && r.NotTypes == nil {
+		return events
+	}
+	var result []state.AccountData
+	for _, ev := range events {
+		if r.Types != nil && !containsString(r.Types, ev.Type) {
+			continue
+		}
+		if containsString(r.NotTypes, ev.Type) {
+			continue
+		}
+		result = append(result, ev)
+	}
+	return result
+}
+
 // Server response
 type AccountDataResponse struct {
 	Global []json.RawMessage            `json:"global,omitempty"`
@@ -30,6 +65,15 @@ func (r *AccountDataResponse) HasData(isInitial bool) bool {
 	return len(r.Rooms) > 0 || len(r.Global) > 0
 }
 
+func containsString(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
+
 func accountEventsAsJSON(events []state.AccountData) []json.RawMessage {
 	j := make([]json.RawMessage, len(events))
 	for i := range events {
@@ -43,10 +87,12 @@ func (r *AccountDataRequest) AppendLive(ctx context.Context, res *Response, extC
 	roomToMsgs := map[string][]json.RawMessage{}
 	switch update := up.(type) {
 	case *caches.AccountDataUpdate:
-		globalMsgs = accountEventsAsJSON(update.AccountData)
+		globalMsgs = accountEventsAsJSON(r.filter(update.AccountData))
 	case *caches.RoomAccountDataUpdate:
 		if r.RoomInScope(update.RoomID(), extCtx) {
-			roomToMsgs[update.RoomID()] = accountEventsAsJSON(update.AccountData)
+			if accountData := r.filter(update.AccountData); len(accountData) > 0 {
+				roomToMsgs[update.RoomID()] = accountEventsAsJSON(accountData)
+			}
 		}
 	case caches.RoomUpdate:
 		if !r.RoomInScope(update.RoomID(), extCtx) {
@@ -54,7 +100,10 @@ func (r *AccountDataRequest) AppendLive(ctx context.Context, res *Response, extC
 		}
 		// if this is a room update which is included in the response, send account data for this room
 		if _, exists := extCtx.RoomIDToTimeline[update.RoomID()]; exists {
+			dbStart := time.Now()
 			roomAccountData, err := extCtx.Store.AccountDatas(extCtx.UserID, update.RoomID())
+			internal.TrackDBTime(ctx, dbStart)
+			roomAccountData = r.filter(roomAccountData)
 			if err != nil {
 				logger.Err(err).Str("user", extCtx.UserID).Str("room", update.RoomID()).Msg("failed to fetch room account data")
 				internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -80,6 +129,8 @@ func (r *AccountDataRequest) AppendLive(ctx context.Context, res *Response, extC
 }
 
 func (r *AccountDataRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
+	// this is almost entirely DB lookups so count the whole thing towards the request's DB time
+	defer internal.TrackDBTime(ctx, time.Now())
 	roomIDs := make([]string, len(extCtx.RoomIDToTimeline))
 	i := 0
 	for roomID := range extCtx.RoomIDToTimeline {
@@ -100,7 +151,7 @@ func (r *AccountDataRequest) ProcessInitial(ctx context.Context, res *Response,
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		} else {
 			extRes.Rooms = make(map[string][]json.RawMessage)
-			for _, ad := range roomsAccountData {
+			for _, ad := range r.filter(roomsAccountData) {
 				extRes.Rooms[ad.RoomID] = append(extRes.Rooms[ad.RoomID], ad.Data)
 			}
 		}
@@ -112,7 +163,7 @@ func (r *AccountDataRequest) ProcessInitial(ctx context.Context, res *Response,
 			logger.Err(err).Str("user", extCtx.UserID).Msg("failed to fetch global account data")
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		} else {
-			extRes.Global = accountEventsAsJSON(globalAccountData)
+			extRes.Global = accountEventsAsJSON(r.filter(globalAccountData))
 		}
 	}
 	if len(extRes.Rooms) > 0 || len(extRes.Global) > 0 {
@@ -105,3 +105,62 @@ func TestLiveAccountDataAggregation(t *testing.T) {
 		t.Fatalf("got  %+v\nwant %+v", res.AccountData.Global, wantGlobalAccountData)
 	}
 }
+
+// Test that account data is filtered by type on live updates
+func TestLiveAccountDataTypeFilter(t *testing.T) {
+	boolTrue := true
+	ext := &AccountDataRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+		},
+		Types:    []string{"m.push_rules", "m.direct"},
+		NotTypes: []string{"m.direct"},
+	}
+	var res Response
+	var extCtx Context
+	global := &caches.AccountDataUpdate{
+		AccountData: []state.AccountData{
+			{
+				Type: "m.push_rules",
+				Data: []byte(`{"type":"m.push_rules"}`),
+			},
+			{
+				Type: "m.direct",
+				Data: []byte(`{"type":"m.direct"}`),
+			},
+			{
+				Type: "m.ignored_user_list",
+				Data: []byte(`{"type":"m.ignored_user_list"}`),
+			},
+		},
+	}
+	room := &caches.RoomAccountDataUpdate{
+		RoomUpdate: &dummyRoomUpdate{
+			roomID: roomA,
+			globalMetadata: &internal.RoomMetadata{
+				RoomID: roomA,
+			},
+		},
+		AccountData: []state.AccountData{
+			{
+				Type: "m.fully_read",
+				Data: []byte(`{"type":"m.fully_read"}`),
+			},
+		},
+	}
+	ext.AppendLive(ctx, &res, extCtx, room)
+	if res.AccountData != nil {
+		t.Fatalf("got account data for a filtered out type: %+v", res.AccountData)
+	}
+	ext.AppendLive(ctx, &res, extCtx, global)
+	if res.AccountData == nil {
+		t.Fatalf("account data response is empty")
+	}
+	wantGlobal := []json.RawMessage{global.AccountData[0].Data}
+	if !reflect.DeepEqual(res.AccountData.Global, wantGlobal) {
+		t.Fatalf("got global account data %v want %v", res.AccountData.Global, wantGlobal)
+	}
+	if len(res.AccountData.Rooms) != 0 {
+		t.Fatalf("got room account data %v want none", res.AccountData.Rooms)
+	}
+}
@@ -0,0 +1,82 @@
+package extensions
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Deferred tracks the extensions on a connection which took longer than Handler.ExtensionTimeout to
+// produce their data. Rather than holding up the whole response, the rest of the response is sent and
+// the extension keeps running in the background. Its data is sent in the next response once it is ready.
+// The extension is not run again until its deferred data has been sent.
+type Deferred struct {
+	mu sync.Mutex
+	// extension type => in-flight ProcessInitial call
+	pending map[string]*deferredCall
+}
+
+type deferredCall struct {
+	done chan struct{}
+	res  Response
+}
+
+func NewDeferred() *Deferred {
+	return &Deferred{
+		pending: make(map[string]*deferredCall),
+	}
+}
+
+// Pending returns the number of extensions whose data has not been sent yet.
+func (d *Deferred) Pending() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.pending)
+}
+
+// process calls ext.ProcessInitial, waiting at most `timeout` for it to finish. If it finishes in time, or
+// a previously deferred call has since finished, its data is added to res.
+func (d *Deferred) process(ctx context.Context, ext GenericRequest, res *Response, extCtx Context, timeout time.Duration) {
+	key := reflect.TypeOf(ext).String()
+	d.mu.Lock()
+	call := d.pending[key]
+	d.mu.Unlock()
+	if call == nil {
+		call = &deferredCall{
+			done: make(chan struct{}),
+		}
+		// the request may be modified by the next request whilst we are still running, so use a copy
+		ext = shallowCopy(ext)
+		go func() {
+			defer close(call.done)
+			ext.ProcessInitial(ctx, &call.res, extCtx)
+		}()
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-call.done:
+		d.mu.Lock()
+		delete(d.pending, key)
+		d.mu.Unlock()
+		res.merge(call.res)
+	case <-timer.C:
+		d.mu.Lock()
+		d.pending[key] = call
+		d.mu.Unlock()
+		logger.Warn().Str("user", extCtx.UserID).Str("device", extCtx.DeviceID).Str("extension", ext.Name()).Dur("timeout", timeout).Msg(
+			"extension exceeded its deadline, sending its data in a later response",
+		)
+	}
+}
+
+func shallowCopy(ext GenericRequest) GenericRequest {
+	v := reflect.ValueOf(ext)
+	if v.Kind() != reflect.Ptr {
+		return ext
+	}
+	cp := reflect.New(v.Elem().Type())
+	cp.Elem().Set(v.Elem())
+	return cp.Interface().(GenericRequest)
+}
@@ -0,0 +1,83 @@
+package extensions
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+const slowExtensionName = "org.matrix.sliding_sync.test_slow"
+
+// an extension which doesn't return from ProcessInitial until unblock is closed
+type slowExtensionRequest struct {
+	Core
+	unblock chan struct{}
+	calls   *int32
+}
+
+func (r *slowExtensionRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
+	atomic.AddInt32(r.calls, 1)
+	<-r.unblock
+	res.SetCustom(slowExtensionName, &testExtensionResponse{Value: "slow"})
+}
+
+func (r *slowExtensionRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
+}
+
+func TestHandlerDefersSlowExtensions(t *testing.T) {
+	enabled := true
+	var calls int32
+	unblock := make(chan struct{})
+	req := Request{
+		Custom: map[string]GenericRequest{
+			testExtensionName: &testExtensionRequest{Core: Core{Enabled: &enabled}, Value: "fast"},
+			slowExtensionName: &slowExtensionRequest{Core: Core{Enabled: &enabled}, unblock: unblock, calls: &calls},
+		},
+	}
+	h := &Handler{
+		ExtensionTimeout: 50 * time.Millisecond,
+	}
+	extCtx := Context{
+		Deferred: NewDeferred(),
+	}
+	assertResponse := func(res Response, wantSlow bool) {
+		t.Helper()
+		if fast, ok := res.Custom[testExtensionName].(*testExtensionResponse); !ok || fast.Value != "fast" {
+			t.Errorf("missing fast extension response: %+v", res.Custom)
+		}
+		_, gotSlow := res.Custom[slowExtensionName]
+		if gotSlow != wantSlow {
+			t.Errorf("got slow extension response %v want %v", gotSlow, wantSlow)
+		}
+	}
+
+	// the slow extension is deferred, but the rest of the response is returned
+	assertResponse(h.Handle(context.Background(), req, extCtx), false)
+	if extCtx.Deferred.Pending() != 1 {
+		t.Fatalf("got %d pending extensions want 1", extCtx.Deferred.Pending())
+	}
+	// it isn't run again whilst it is still running
+	assertResponse(h.Handle(context.Background(), req, extCtx), false)
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("slow extension called %d times want 1", n)
+	}
+
+	// once it finishes, its data is sent in the next response
+	close(unblock)
+	assertResponse(h.Handle(context.Background(), req, extCtx), true)
+	if extCtx.Deferred.Pending() != 0 {
+		t.Fatalf("got %d pending extensions want 0", extCtx.Deferred.Pending())
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("slow extension called %d times want 1", n)
+	}
+
+	// now it is fast, it is processed as normal
+	assertResponse(h.Handle(context.Background(), req, extCtx), true)
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("slow extension called %d times want 2", n)
+	}
+}
@@ -0,0 +1,130 @@
+package extensions
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+type dummyE2EEFetcher struct {
+	dd *internal.DeviceData
+}
+
+func (f *dummyE2EEFetcher) DeviceData(context context.Context, userID, deviceID string, isInitial bool) *internal.DeviceData {
+	return f.dd
+}
+
+// Test that OTK counts and fallback key types are only sent when they have changed or on initial syncs,
+// and that device list changes are always sent.
+func TestE2EEProcessInitial(t *testing.T) {
+	boolTrue := true
+	ext := &E2EERequest{
+		Core: Core{
+			Enabled: &boolTrue,
+		},
+	}
+	dd := &internal.DeviceData{
+		UserID:           "@alice:localhost",
+		DeviceID:         "ALICE",
+		OTKCounts:        map[string]int{"signed_curve25519": 50},
+		FallbackKeyTypes: []string{"signed_curve25519"},
+	}
+	fetcher := &dummyE2EEFetcher{dd: dd}
+	extCtx := Context{
+		Handler: &Handler{
+			E2EEFetcher: fetcher,
+		},
+		UserID:   dd.UserID,
+		DeviceID: dd.DeviceID,
+	}
+
+	// incremental sync with no changes returns nothing
+	var res Response
+	ext.ProcessInitial(ctx, &res, extCtx)
+	if res.E2EE != nil {
+		t.Fatalf("incremental sync with no changes returned data: %+v", res.E2EE)
+	}
+
+	// initial sync always returns OTK counts and fallback keys
+	extCtx.IsInitial = true
+	ext.ProcessInitial(ctx, &res, extCtx)
+	if res.E2EE == nil {
+		t.Fatalf("initial sync returned no data")
+	}
+	if !reflect.DeepEqual(res.E2EE.OTKCounts, dd.OTKCounts) {
+		t.Errorf("got OTK counts %v want %v", res.E2EE.OTKCounts, dd.OTKCounts)
+	}
+	if !reflect.DeepEqual(res.E2EE.FallbackKeyTypes, dd.FallbackKeyTypes) {
+		t.Errorf("got fallback key types %v want %v", res.E2EE.FallbackKeyTypes, dd.FallbackKeyTypes)
+	}
+
+	// incremental sync with changed OTK counts and device lists
+	extCtx.IsInitial = false
+	dd.SetOTKCountChanged()
+	dd.DeviceLists.Sent = map[string]int{
+		"@bob:localhost":     internal.DeviceListChanged,
+		"@charlie:localhost": internal.DeviceListChanged,
+		"@doris:localhost":   internal.DeviceListLeft,
+	}
+	res = Response{}
+	ext.ProcessInitial(ctx, &res, extCtx)
+	if res.E2EE == nil {
+		t.Fatalf("incremental sync with changes returned no data")
+	}
+	if res.E2EE.FallbackKeyTypes != nil {
+		t.Errorf("got fallback key types %v but they did not change", res.E2EE.FallbackKeyTypes)
+	}
+	if !reflect.DeepEqual(res.E2EE.OTKCounts, dd.OTKCounts) {
+		t.Errorf("got OTK counts %v want %v", res.E2EE.OTKCounts, dd.OTKCounts)
+	}
+	if res.E2EE.DeviceLists == nil {
+		t.Fatalf("missing device lists")
+	}
+	sort.Strings(res.E2EE.DeviceLists.Changed)
+	if !reflect.DeepEqual(res.E2EE.DeviceLists.Changed, []string{"@bob:localhost", "@charlie:localhost"}) {
+		t.Errorf("got changed %v", res.E2EE.DeviceLists.Changed)
+	}
+	if !reflect.DeepEqual(res.E2EE.DeviceLists.Left, []string{"@doris:localhost"}) {
+		t.Errorf("got left %v", res.E2EE.DeviceLists.Left)
+	}
+}
+
+// Test that live updates do not recalculate E2EE data when the response already has data.
+func TestE2EEAppendLiveDoesNotRecalculate(t *testing.T) {
+	boolTrue := true
+	ext := &E2EERequest{
+		Core: Core{
+			Enabled: &boolTrue,
+		},
+	}
+	fetcher := &dummyE2EEFetcher{dd: &internal.DeviceData{
+		OTKCounts: map[string]int{"signed_curve25519": 1},
+	}}
+	fetcher.dd.SetOTKCountChanged()
+	extCtx := Context{
+		Handler: &Handler{
+			E2EEFetcher: fetcher,
+		},
+	}
+	existing := &E2EEResponse{
+		OTKCounts: map[string]int{"signed_curve25519": 99},
+	}
+	res := Response{
+		E2EE: existing,
+	}
+	ext.AppendLive(ctx, &res, extCtx, caches.DeviceDataUpdate{})
+	if res.E2EE != existing {
+		t.Fatalf("AppendLive replaced an existing E2EE response")
+	}
+
+	// with no data, the update is processed
+	res = Response{}
+	ext.AppendLive(ctx, &res, extCtx, caches.DeviceDataUpdate{})
+	if res.E2EE == nil || res.E2EE.OTKCounts["signed_curve25519"] != 1 {
+		t.Fatalf("AppendLive did not process device data update: %+v", res.E2EE)
+	}
+}
@@ -3,8 +3,11 @@ package extensions
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"os"
 	"reflect"
+	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/state"
@@ -27,6 +30,8 @@ type GenericRequest interface {
 	OnlyLists() []string
 	// Returns the value of the `rooms` JSON key. nil for "not specified".
 	OnlyRooms() []string
+	// Returns the value of the `list_ranges` JSON key. nil for "not specified".
+	OnlyListRanges() map[string][][2]int64
 	// Overwrite fields in the request by side-effecting on this struct.
 	ApplyDelta(next GenericRequest)
 	// ProcessInitial provides a means for extensions to return data to clients immediately.
@@ -59,6 +64,9 @@ type Core struct {
 	Enabled *bool    `json:"enabled"`
 	Lists   []string `json:"lists"`
 	Rooms   []string `json:"rooms"`
+	// list name => index ranges in that list, e.g to only process the rooms on screen in a huge list.
+	// A list which is also in Lists is processed in full.
+	ListRanges map[string][][2]int64 `json:"list_ranges"`
 }
 
 func (r *Core) Name() string {
@@ -77,6 +85,10 @@ func (r *Core) OnlyRooms() []string {
 	return r.Rooms
 }
 
+func (r *Core) OnlyListRanges() map[string][][2]int64 {
+	return r.ListRanges
+}
+
 func (r *Core) ApplyDelta(gnext GenericRequest) {
 	if gnext == nil {
 		return
@@ -94,6 +106,10 @@ func (r *Core) ApplyDelta(gnext GenericRequest) {
 	if nextRooms != nil {
 		r.Rooms = nextRooms
 	}
+	nextListRanges := gnext.OnlyListRanges()
+	if nextListRanges != nil {
+		r.ListRanges = nextListRanges
+	}
 }
 
 // RoomInScope determines whether a given room ought to be processed by this extension,
@@ -101,7 +117,7 @@ func (r *Core) ApplyDelta(gnext GenericRequest) {
 // updates for a room based on additional criteria.
 func (r *Core) RoomInScope(roomID string, extCtx Context) bool {
 	// If the extension hasn't had its scope configured, process everything.
-	if r.Lists == nil && r.Rooms == nil {
+	if r.Lists == nil && r.Rooms == nil && r.ListRanges == nil {
 		return true
 	}
 
@@ -122,6 +138,22 @@ func (r *Core) RoomInScope(roomID string, extCtx Context) bool {
 		}
 	}
 
+	// If the room is within the ranges of a list that this extension should process, process the update.
+	// Index positions are those at the time of the update, so the rooms in scope follow the list as it
+	// moves.
+	listIndexes := extCtx.RoomIDsToListIndexes[roomID]
+	for listName, ranges := range r.ListRanges {
+		index, ok := listIndexes[listName]
+		if !ok {
+			continue
+		}
+		for _, rng := range ranges {
+			if rng[0] <= int64(index) && int64(index) <= rng[1] {
+				return true
+			}
+		}
+	}
+
 	// Otherwise ignore the update.
 	return false
 }
@@ -136,14 +168,49 @@ func ExtensionEnabled(r GenericRequest) bool {
 
 // Request is the JSON request body under 'extensions'.
 //
-// To add new extensions, add a field here and return it in fields() whilst setting it correctly
-// in setFields().
+// To add new extensions, either Register them or add a field here and return it in fields() whilst
+// setting it correctly in setFields().
 type Request struct {
 	ToDevice    *ToDeviceRequest    `json:"to_device"`
 	E2EE        *E2EERequest        `json:"e2ee"`
 	AccountData *AccountDataRequest `json:"account_data"`
 	Typing      *TypingRequest      `json:"typing"`
 	Receipts    *ReceiptsRequest    `json:"receipts"`
+	// Registered extensions, keyed on their JSON key.
+	Custom map[string]GenericRequest `json:"-"`
+}
+
+func (r *Request) UnmarshalJSON(b []byte) error {
+	type builtinRequest Request
+	var builtin builtinRequest
+	if err := json.Unmarshal(b, &builtin); err != nil {
+		return err
+	}
+	*r = Request(builtin)
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	for name, val := range raw {
+		factory, ok := lookupFactory(name)
+		if !ok {
+			continue
+		}
+		ext := factory()
+		if err := json.Unmarshal(val, ext); err != nil {
+			return fmt.Errorf("extension %s: %w", name, err)
+		}
+		if r.Custom == nil {
+			r.Custom = make(map[string]GenericRequest)
+		}
+		r.Custom[name] = ext
+	}
+	return nil
+}
+
+func (r Request) MarshalJSON() ([]byte, error) {
+	type builtinRequest Request
+	return mergeCustom(builtinRequest(r), r.Custom)
 }
 
 func (r *Request) fields() []GenericRequest {
@@ -163,6 +230,9 @@ func (r *Request) setFields(fields []GenericRequest) {
 
 func (r Request) EnabledExtensions() (exts []GenericRequest) {
 	fields := r.fields()
+	for _, name := range sortedKeys(r.Custom) {
+		fields = append(fields, r.Custom[name])
+	}
 	for _, f := range fields {
 		f := f
 		if isNil(f) {
@@ -198,25 +268,126 @@ func (r Request) ApplyDelta(next *Request) Request {
 	if hasChanges {
 		r.setFields(currFields)
 	}
+	if len(next.Custom) > 0 {
+		// copy the map so we don't modify the previous request
+		custom := make(map[string]GenericRequest, len(r.Custom)+len(next.Custom))
+		for name, curr := range r.Custom {
+			custom[name] = curr
+		}
+		for name, nextExt := range next.Custom {
+			if isNil(nextExt) {
+				continue
+			}
+			if curr, ok := custom[name]; ok && !isNil(curr) {
+				curr.ApplyDelta(nextExt)
+			} else {
+				custom[name] = nextExt
+			}
+		}
+		r.Custom = custom
+	}
 
 	return r
 }
 
+// ApplyPositions applies extension sub-positions decoded from the request `pos`, as returned by
+// Response.Positions. Positions explicitly set in the request body take precedence.
+func (r *Request) ApplyPositions(positions map[string]string) {
+	for name, pos := range positions {
+		ext := r.streamRequest(name)
+		if ext != nil && ext.Position() == "" {
+			ext.SetPosition(pos)
+		}
+	}
+}
+
+// streamRequest returns the request for the stream extension `name`, creating an empty request if the
+// client didn't send one. Returns nil if `name` is not a stream extension.
+func (r *Request) streamRequest(name string) StreamRequest {
+	if name == "to_device" {
+		if r.ToDevice == nil {
+			r.ToDevice = &ToDeviceRequest{}
+		}
+		return r.ToDevice
+	}
+	if ext, ok := r.Custom[name]; ok && !isNil(ext) {
+		sr, _ := ext.(StreamRequest)
+		return sr
+	}
+	factory, ok := lookupFactory(name)
+	if !ok {
+		return nil
+	}
+	sr, ok := factory().(StreamRequest)
+	if !ok {
+		return nil
+	}
+	if r.Custom == nil {
+		r.Custom = make(map[string]GenericRequest)
+	}
+	r.Custom[name] = sr
+	return sr
+}
+
 // Response represents the top-level `extensions` key in the JSON response.
 //
-// To add a new extension, add a field here and in fields().
+// To add a new extension, either use SetCustom from a registered extension or add a field here and
+// in fields().
 type Response struct {
 	ToDevice    *ToDeviceResponse    `json:"to_device,omitempty"`
 	E2EE        *E2EEResponse        `json:"e2ee,omitempty"`
 	AccountData *AccountDataResponse `json:"account_data,omitempty"`
 	Typing      *TypingResponse      `json:"typing,omitempty"`
 	Receipts    *ReceiptsResponse    `json:"receipts,omitempty"`
+	// Responses from registered extensions, keyed on their JSON key.
+	Custom map[string]GenericResponse `json:"-"`
 }
 
 func (r Response) fields() []GenericResponse {
-	return []GenericResponse{
+	fields := []GenericResponse{
 		r.ToDevice, r.E2EE, r.AccountData, r.Typing, r.Receipts,
 	}
+	for _, name := range sortedKeys(r.Custom) {
+		fields = append(fields, r.Custom[name])
+	}
+	return fields
+}
+
+// SetCustom sets the response for a registered extension, replacing any existing response.
+func (r *Response) SetCustom(name string, data GenericResponse) {
+	if r.Custom == nil {
+		r.Custom = make(map[string]GenericResponse)
+	}
+	r.Custom[name] = data
+}
+
+// merge sets the extension responses in other which are not already set in r.
+func (r *Response) merge(other Response) {
+	if r.ToDevice == nil {
+		r.ToDevice = other.ToDevice
+	}
+	if r.E2EE == nil {
+		r.E2EE = other.E2EE
+	}
+	if r.AccountData == nil {
+		r.AccountData = other.AccountData
+	}
+	if r.Typing == nil {
+		r.Typing = other.Typing
+	}
+	if r.Receipts == nil {
+		r.Receipts = other.Receipts
+	}
+	for name, data := range other.Custom {
+		if _, exists := r.Custom[name]; !exists {
+			r.SetCustom(name, data)
+		}
+	}
+}
+
+func (r Response) MarshalJSON() ([]byte, error) {
+	type builtinResponse Response
+	return mergeCustom(builtinResponse(r), r.Custom)
 }
 
 func (r Response) HasData(isInitial bool) bool {
@@ -233,6 +404,32 @@ func (r Response) HasData(isInitial bool) bool {
 	return false
 }
 
+// Positions returns the sub-positions of extensions which have their own streams, keyed on the
+// extension's JSON key. These are encoded into the response `pos` so clients can re-request
+// extension data without the room data being sent again.
+func (r Response) Positions() map[string]string {
+	var positions map[string]string
+	add := func(name string, res StreamResponse) {
+		pos := res.NextPosition()
+		if pos == "" {
+			return
+		}
+		if positions == nil {
+			positions = make(map[string]string)
+		}
+		positions[name] = pos
+	}
+	if r.ToDevice != nil {
+		add("to_device", r.ToDevice)
+	}
+	for name, res := range r.Custom {
+		if sr, ok := res.(StreamResponse); ok && !isNil(sr) {
+			add(name, sr)
+		}
+	}
+	return positions
+}
+
 type Context struct {
 	*Handler
 	// RoomIDToTimeline is a map from room IDs to slices of event IDs. The keys are the
@@ -253,6 +450,11 @@ type Context struct {
 	// enclose those sliding windows. Values should be nonnil and nonempty, and may
 	// contain multiple list names.
 	RoomIDsToLists map[string][]string
+	// Map from room IDs to list names to the index position of the room in that list, for the same rooms
+	// as RoomIDsToLists. Used to scope extensions to ranges of a list.
+	RoomIDsToListIndexes map[string]map[string]int
+	// The extensions on this connection which are running late. If nil, extensions are never deferred.
+	Deferred *Deferred
 }
 
 type HandlerInterface interface {
@@ -264,6 +466,9 @@ type Handler struct {
 	Store       *state.Storage
 	E2EEFetcher E2EEFetcher
 	GlobalCache *caches.GlobalCache
+	// If > 0, the longest an extension can take to process a request before its data is deferred to the
+	// next response. See Deferred.
+	ExtensionTimeout time.Duration
 }
 
 func (h *Handler) HandleLiveUpdate(update caches.Update, req Request, res *Response, extCtx Context) {
@@ -279,7 +484,11 @@ func (h *Handler) Handle(ctx context.Context, req Request, extCtx Context) (res
 	exts := req.EnabledExtensions()
 	for _, ext := range exts {
 		childCtx, region := internal.StartSpan(ctx, "extension_"+ext.Name())
-		ext.ProcessInitial(childCtx, &res, extCtx)
+		if h.ExtensionTimeout > 0 && extCtx.Deferred != nil {
+			extCtx.Deferred.process(childCtx, ext, &res, extCtx, h.ExtensionTimeout)
+		} else {
+			ext.ProcessInitial(childCtx, &res, extCtx)
+		}
 		region.End()
 	}
 	return
@@ -214,3 +214,69 @@ func TestExtension_ApplyDelta(t *testing.T) {
 		}
 	}
 }
+
+func TestCoreRoomInScope(t *testing.T) {
+	extCtx := Context{
+		RoomIDsToLists: map[string][]string{
+			roomA: {"a"},
+			roomB: {"a", "b"},
+		},
+		RoomIDsToListIndexes: map[string]map[string]int{
+			roomA: {"a": 0},
+			roomB: {"a": 1, "b": 0},
+		},
+	}
+	testCases := []struct {
+		name      string
+		core      Core
+		wantRooms map[string]bool
+	}{
+		{
+			name:      "unscoped processes everything",
+			core:      Core{},
+			wantRooms: map[string]bool{roomA: true, roomB: true, roomC: true},
+		},
+		{
+			name:      "scoped to list b",
+			core:      Core{Lists: []string{"b"}},
+			wantRooms: map[string]bool{roomA: false, roomB: true, roomC: false},
+		},
+		{
+			name:      "scoped to room C",
+			core:      Core{Rooms: []string{roomC}},
+			wantRooms: map[string]bool{roomA: false, roomB: false, roomC: true},
+		},
+		{
+			name:      "scoped to list b and room C",
+			core:      Core{Lists: []string{"b"}, Rooms: []string{roomC}},
+			wantRooms: map[string]bool{roomA: false, roomB: true, roomC: true},
+		},
+		{
+			name:      "scoped to a range of list a",
+			core:      Core{ListRanges: map[string][][2]int64{"a": {{1, 5}}}},
+			wantRooms: map[string]bool{roomA: false, roomB: true, roomC: false},
+		},
+		{
+			name:      "scoped to a range of list b which has moved past room B",
+			core:      Core{ListRanges: map[string][][2]int64{"b": {{1, 5}}}},
+			wantRooms: map[string]bool{roomA: false, roomB: false, roomC: false},
+		},
+		{
+			name:      "scoped to a range of list b and all of list a",
+			core:      Core{Lists: []string{"a"}, ListRanges: map[string][][2]int64{"b": {{1, 5}}}},
+			wantRooms: map[string]bool{roomA: true, roomB: true, roomC: false},
+		},
+		{
+			name:      "scoped to nothing",
+			core:      Core{Lists: []string{}, Rooms: []string{}},
+			wantRooms: map[string]bool{roomA: false, roomB: false, roomC: false},
+		},
+	}
+	for _, tc := range testCases {
+		for roomID, want := range tc.wantRooms {
+			if got := tc.core.RoomInScope(roomID, extCtx); got != want {
+				t.Errorf("%s: RoomInScope(%s) got %v want %v", tc.name, roomID, got, want)
+			}
+		}
+	}
+}
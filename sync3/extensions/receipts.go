@@ -6,17 +6,34 @@ import (
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"time"
 )
 
 // Client created request params
 type ReceiptsRequest struct {
 	Core
+	// If true, only the user's own receipts are sent. Other users' receipts are stripped, for clients
+	// which do not want to show read markers.
+	OnlyOwn *bool `json:"only_own"`
 }
 
 func (r *ReceiptsRequest) Name() string {
 	return "ReceiptsRequest"
 }
 
+func (r *ReceiptsRequest) ApplyDelta(gnext GenericRequest) {
+	r.Core.ApplyDelta(gnext)
+	next := gnext.(*ReceiptsRequest)
+	// nil means they didn't specify this field, so leave it unchanged.
+	if next.OnlyOwn != nil {
+		r.OnlyOwn = next.OnlyOwn
+	}
+}
+
+func (r *ReceiptsRequest) onlyOwn() bool {
+	return r.OnlyOwn != nil && *r.OnlyOwn
+}
+
 // Server response
 type ReceiptsResponse struct {
 	// room_id -> m.receipt ephemeral event
@@ -36,6 +53,9 @@ func (r *ReceiptsRequest) AppendLive(ctx context.Context, res *Response, extCtx
 		if !r.RoomInScope(update.RoomID(), extCtx) {
 			break
 		}
+		if r.onlyOwn() && update.Receipt.UserID != extCtx.UserID {
+			break
+		}
 
 		// a live receipt event happened, send this back
 		if res.Receipts == nil {
@@ -83,29 +103,40 @@ func (r *ReceiptsRequest) AppendLive(ctx context.Context, res *Response, extCtx
 }
 
 func (r *ReceiptsRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
+	defer internal.TrackDBTime(ctx, time.Now())
 	// grab receipts for all timelines for all the rooms we're going to return
-	rooms := make(map[string]json.RawMessage)
+	roomIDToTimeline := make(map[string][]string, len(extCtx.RoomIDToTimeline))
+	roomIDs := make([]string, 0, len(extCtx.RoomIDToTimeline))
 	for roomID, timeline := range extCtx.RoomIDToTimeline {
 		if !r.RoomInScope(roomID, extCtx) {
 			continue
 		}
-		receipts, err := extCtx.Store.ReceiptTable.SelectReceiptsForEvents(roomID, timeline)
-		if err != nil {
-			logger.Err(err).Str("user", extCtx.UserID).Str("room", roomID).Msg("failed to SelectReceiptsForEvents")
-			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
-			continue
-		}
-		// always include your own receipts
-		ownReceipts, err := extCtx.Store.ReceiptTable.SelectReceiptsForUser(roomID, extCtx.UserID)
+		roomIDToTimeline[roomID] = timeline
+		roomIDs = append(roomIDs, roomID)
+	}
+	var receipts map[string][]internal.Receipt
+	if !r.onlyOwn() {
+		var err error
+		receipts, err = extCtx.Store.ReceiptTable.SelectReceiptsForEventsInRooms(roomIDToTimeline)
 		if err != nil {
-			logger.Err(err).Str("user", extCtx.UserID).Str("room", roomID).Msg("failed to SelectReceiptsForUser")
+			logger.Err(err).Str("user", extCtx.UserID).Int("rooms", len(roomIDs)).Msg("failed to SelectReceiptsForEventsInRooms")
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
-			continue
+			return
 		}
-		if len(receipts) == 0 && len(ownReceipts) == 0 {
+	}
+	// always include your own receipts
+	ownReceipts, err := extCtx.Store.ReceiptTable.SelectReceiptsForUserInRooms(roomIDs, extCtx.UserID)
+	if err != nil {
+		logger.Err(err).Str("user", extCtx.UserID).Int("rooms", len(roomIDs)).Msg("failed to SelectReceiptsForUserInRooms")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	rooms := make(map[string]json.RawMessage)
+	for _, roomID := range roomIDs {
+		if len(receipts[roomID]) == 0 && len(ownReceipts[roomID]) == 0 {
 			continue
 		}
-		rooms[roomID], _ = state.PackReceiptsIntoEDU(append(receipts, ownReceipts...))
+		rooms[roomID], _ = state.PackReceiptsIntoEDU(append(receipts[roomID], ownReceipts[roomID]...))
 	}
 	if len(rooms) > 0 {
 		res.Receipts = &ReceiptsResponse{
@@ -74,3 +74,56 @@ func TestLiveReceiptsAggregation(t *testing.T) {
 		t.Fatalf("got  %+v\nwant %+v", res.Receipts.Rooms, want)
 	}
 }
+
+// Test that only_own strips other users' receipts from live updates
+func TestLiveReceiptsOnlyOwn(t *testing.T) {
+	boolTrue := true
+	ext := &ReceiptsRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+		},
+		OnlyOwn: &boolTrue,
+	}
+	var res Response
+	extCtx := Context{
+		UserID: "@me:here",
+	}
+	ownReceipt := &caches.ReceiptUpdate{
+		Receipt: internal.Receipt{
+			RoomID:  roomA,
+			EventID: "$aaa",
+			UserID:  "@me:here",
+			TS:      12345,
+		},
+		RoomUpdate: &dummyRoomUpdate{
+			roomID: roomA,
+		},
+	}
+	otherReceipt := &caches.ReceiptUpdate{
+		Receipt: internal.Receipt{
+			RoomID:  roomB,
+			EventID: "$bbb",
+			UserID:  "@someone:here",
+			TS:      45678,
+		},
+		RoomUpdate: &dummyRoomUpdate{
+			roomID: roomB,
+		},
+	}
+	ext.AppendLive(ctx, &res, extCtx, otherReceipt)
+	if res.Receipts != nil {
+		t.Fatalf("got receipts response for another user's receipt: %+v", res.Receipts)
+	}
+	ext.AppendLive(ctx, &res, extCtx, ownReceipt)
+	if res.Receipts == nil {
+		t.Fatalf("receipts response is empty")
+	}
+	eduA, err := state.PackReceiptsIntoEDU([]internal.Receipt{ownReceipt.Receipt})
+	assertNoError(t, err)
+	want := map[string]json.RawMessage{
+		roomA: eduA,
+	}
+	if !reflect.DeepEqual(res.Receipts.Rooms, want) {
+		t.Fatalf("got  %+v\nwant %+v", res.Receipts.Rooms, want)
+	}
+}
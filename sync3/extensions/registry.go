@@ -0,0 +1,100 @@
+package extensions
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Factory creates an empty request for an extension, which the client's JSON is unmarshalled into.
+type Factory func() GenericRequest
+
+var (
+	registry   = map[string]Factory{}
+	registryMu = &sync.RWMutex{}
+)
+
+// the JSON keys of extensions which have dedicated fields on Request and Response
+var builtinNames = map[string]bool{
+	"to_device":    true,
+	"e2ee":         true,
+	"account_data": true,
+	"typing":       true,
+	"receipts":     true,
+}
+
+// Register adds an extension which will be parsed from the JSON key `name` under `extensions` in the
+// request. The extension is processed like any other extension: ProcessInitial and AppendLive are
+// called when it is enabled, and it is scoped to lists/rooms by the Core mixin. Extensions should
+// write their response via Response.SetCustom using the same name.
+//
+// This is intended to be called from init() functions. Panics if the name is already registered.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if builtinNames[name] {
+		panic(fmt.Sprintf("extensions.Register: %s is a built-in extension", name))
+	}
+	if _, exists := registry[name]; exists {
+		panic(fmt.Sprintf("extensions.Register: %s is already registered", name))
+	}
+	registry[name] = factory
+}
+
+// StreamRequest is implemented by extension requests which page through their own stream, like
+// to-device messages. The position of the stream is encoded into the response `pos`, so clients which
+// fail to process some data can re-request it without the room data being sent again. Registered
+// extensions which implement this, and whose responses implement StreamResponse, get this for free.
+type StreamRequest interface {
+	GenericRequest
+	// Position returns the position the client wants data from, or "" if unspecified.
+	Position() string
+	// SetPosition sets the position the client wants data from. Positions must not contain '.' or '~'.
+	SetPosition(pos string)
+}
+
+// StreamResponse is implemented by the responses of stream extensions.
+type StreamResponse interface {
+	GenericResponse
+	// NextPosition returns the position to request the next batch of data from, or "" if unknown.
+	NextPosition() string
+}
+
+func lookupFactory(name string) (Factory, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	factory, ok := registry[name]
+	return factory, ok
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// mergeCustom marshals the built-in fields and then adds in any custom fields as extra JSON keys.
+func mergeCustom[V any](builtin interface{}, custom map[string]V) ([]byte, error) {
+	b, err := json.Marshal(builtin)
+	if err != nil || len(custom) == 0 {
+		return b, err
+	}
+	merged := make(map[string]json.RawMessage)
+	if err = json.Unmarshal(b, &merged); err != nil {
+		return nil, err
+	}
+	for name, val := range custom {
+		if isNil(val) {
+			continue
+		}
+		merged[name], err = json.Marshal(val)
+		if err != nil {
+			return nil, fmt.Errorf("extension %s: %w", name, err)
+		}
+	}
+	return json.Marshal(merged)
+}
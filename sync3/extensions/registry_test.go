@@ -0,0 +1,189 @@
+package extensions
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+const testExtensionName = "org.matrix.sliding_sync.test"
+
+type testExtensionRequest struct {
+	Core
+	Value string `json:"value"`
+}
+
+func (r *testExtensionRequest) Name() string {
+	return "TestExtensionRequest"
+}
+
+func (r *testExtensionRequest) ApplyDelta(gnext GenericRequest) {
+	r.Core.ApplyDelta(gnext)
+	next := gnext.(*testExtensionRequest)
+	if next.Value != "" {
+		r.Value = next.Value
+	}
+}
+
+func (r *testExtensionRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
+	res.SetCustom(testExtensionName, &testExtensionResponse{Value: r.Value})
+}
+
+func (r *testExtensionRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
+}
+
+type testExtensionResponse struct {
+	Value string `json:"value"`
+}
+
+func (r *testExtensionResponse) HasData(isInitial bool) bool {
+	return r.Value != ""
+}
+
+const testStreamExtensionName = "org.matrix.sliding_sync.test_stream"
+
+// a registered extension with its own stream
+type testStreamRequest struct {
+	testExtensionRequest
+	Since string `json:"since"`
+}
+
+func (r *testStreamRequest) ApplyDelta(gnext GenericRequest) {
+	r.Core.ApplyDelta(gnext)
+	next := gnext.(*testStreamRequest)
+	if next.Since != "" {
+		r.Since = next.Since
+	}
+}
+
+func (r *testStreamRequest) Position() string {
+	return r.Since
+}
+
+func (r *testStreamRequest) SetPosition(pos string) {
+	r.Since = pos
+}
+
+type testStreamResponse struct {
+	NextBatch string `json:"next_batch"`
+}
+
+func (r *testStreamResponse) HasData(isInitial bool) bool {
+	return r.NextBatch != ""
+}
+
+func (r *testStreamResponse) NextPosition() string {
+	return r.NextBatch
+}
+
+func init() {
+	Register(testExtensionName, func() GenericRequest {
+		return &testExtensionRequest{}
+	})
+	Register(testStreamExtensionName, func() GenericRequest {
+		return &testStreamRequest{}
+	})
+}
+
+func TestRegisteredExtension(t *testing.T) {
+	var req Request
+	err := json.Unmarshal([]byte(`{
+		"typing": {"enabled": true},
+		"org.matrix.sliding_sync.test": {"enabled": true, "value": "foo"},
+		"org.matrix.sliding_sync.unknown": {"enabled": true}
+	}`), &req)
+	assertNoError(t, err)
+	if req.Typing == nil {
+		t.Fatalf("built-in extension was not parsed")
+	}
+	if len(req.Custom) != 1 {
+		t.Fatalf("got %d custom extensions, want 1", len(req.Custom))
+	}
+	if len(req.EnabledExtensions()) != 2 {
+		t.Fatalf("got %d enabled extensions, want 2", len(req.EnabledExtensions()))
+	}
+
+	// sticky params are applied to registered extensions
+	req = req.ApplyDelta(&Request{
+		Custom: map[string]GenericRequest{
+			testExtensionName: &testExtensionRequest{Value: "bar"},
+		},
+	})
+	ext := req.Custom[testExtensionName].(*testExtensionRequest)
+	if ext.Value != "bar" || !ExtensionEnabled(ext) {
+		t.Fatalf("ApplyDelta did not update registered extension: %+v", ext)
+	}
+
+	h := &Handler{}
+	res := h.Handle(ctx, Request{Custom: req.Custom}, Context{})
+	if !res.HasData(false) {
+		t.Fatalf("response from registered extension has no data")
+	}
+	b, err := json.Marshal(res)
+	assertNoError(t, err)
+	want := `{"org.matrix.sliding_sync.test":{"value":"bar"}}`
+	if string(b) != want {
+		t.Fatalf("got %s want %s", string(b), want)
+	}
+}
+
+func TestRegisterPanicsOnDuplicate(t *testing.T) {
+	for _, name := range []string{testExtensionName, "to_device"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Register(%s) did not panic", name)
+				}
+			}()
+			Register(name, func() GenericRequest { return &testExtensionRequest{} })
+		}()
+	}
+}
+
+func TestStreamExtensionPositions(t *testing.T) {
+	res := Response{
+		ToDevice: &ToDeviceResponse{NextBatch: "5"},
+	}
+	res.SetCustom(testStreamExtensionName, &testStreamResponse{NextBatch: "abc"})
+	res.SetCustom(testExtensionName, &testExtensionResponse{Value: "not a stream"})
+	positions := res.Positions()
+	want := map[string]string{
+		"to_device":             "5",
+		testStreamExtensionName: "abc",
+	}
+	if !reflect.DeepEqual(positions, want) {
+		t.Fatalf("Positions: got %v want %v", positions, want)
+	}
+
+	// stream extensions are created if the client didn't send them
+	var req Request
+	req.ApplyPositions(positions)
+	if req.ToDevice == nil || req.ToDevice.Since != "5" {
+		t.Errorf("ApplyPositions: to_device got %+v want since 5", req.ToDevice)
+	}
+	ext, ok := req.Custom[testStreamExtensionName].(*testStreamRequest)
+	if !ok || ext.Since != "abc" {
+		t.Errorf("ApplyPositions: custom stream got %+v want since abc", req.Custom[testStreamExtensionName])
+	}
+
+	// positions in the request body take precedence, and unknown or non-stream extensions are ignored
+	req = Request{
+		Custom: map[string]GenericRequest{
+			testStreamExtensionName: &testStreamRequest{Since: "def"},
+		},
+	}
+	req.ApplyPositions(map[string]string{
+		testStreamExtensionName:        "abc",
+		testExtensionName:              "1",
+		"org.matrix.sliding_sync.nope": "2",
+	})
+	if got := req.Custom[testStreamExtensionName].(*testStreamRequest).Since; got != "def" {
+		t.Errorf("ApplyPositions: overwrote position in request body, got %s", got)
+	}
+	if len(req.Custom) != 1 {
+		t.Errorf("ApplyPositions: created non-stream extensions: %v", req.Custom)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/matrix-org/sliding-sync/internal"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 )
@@ -40,6 +41,16 @@ func (r *ToDeviceRequest) ApplyDelta(gnext GenericRequest) {
 	}
 }
 
+// Implements StreamRequest
+func (r *ToDeviceRequest) Position() string {
+	return r.Since
+}
+
+// Implements StreamRequest
+func (r *ToDeviceRequest) SetPosition(pos string) {
+	r.Since = pos
+}
+
 // Server response
 type ToDeviceResponse struct {
 	NextBatch string            `json:"next_batch"`
@@ -50,6 +61,11 @@ func (r *ToDeviceResponse) HasData(isInitial bool) bool {
 	return len(r.Events) > 0
 }
 
+// Implements StreamResponse
+func (r *ToDeviceResponse) NextPosition() string {
+	return r.NextBatch
+}
+
 func (r *ToDeviceRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
 	_, ok := up.(caches.DeviceEventsUpdate)
 	if !ok {
@@ -60,6 +76,7 @@ func (r *ToDeviceRequest) AppendLive(ctx context.Context, res *Response, extCtx
 }
 
 func (r *ToDeviceRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
+	defer internal.TrackDBTime(ctx, time.Now())
 	if r.Limit == 0 {
 		r.Limit = 100 // default to 100
 	}
@@ -0,0 +1,62 @@
+package extensions
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Test that the since token and limit are sticky, and are only replaced when the client sends new values.
+func TestToDeviceApplyDelta(t *testing.T) {
+	boolTrue := true
+	boolFalse := false
+	req := &ToDeviceRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+		},
+		Limit: 50,
+		Since: "5",
+	}
+	// missing fields do not clobber
+	req.ApplyDelta(&ToDeviceRequest{})
+	if req.Limit != 50 || req.Since != "5" {
+		t.Fatalf("ApplyDelta with empty request modified fields: limit=%d since=%s", req.Limit, req.Since)
+	}
+	if req.Enabled == nil || !*req.Enabled {
+		t.Fatalf("ApplyDelta with empty request modified enabled flag")
+	}
+	// new since tokens replace old ones
+	req.ApplyDelta(&ToDeviceRequest{
+		Since: "10",
+	})
+	if req.Limit != 50 || req.Since != "10" {
+		t.Fatalf("ApplyDelta did not update since: limit=%d since=%s", req.Limit, req.Since)
+	}
+	// core fields are applied
+	req.ApplyDelta(&ToDeviceRequest{
+		Core: Core{
+			Enabled: &boolFalse,
+		},
+		Limit: 10,
+	})
+	if req.Limit != 10 || req.Since != "10" {
+		t.Fatalf("ApplyDelta did not update limit: limit=%d since=%s", req.Limit, req.Since)
+	}
+	if req.Enabled == nil || *req.Enabled {
+		t.Fatalf("ApplyDelta did not disable the extension")
+	}
+}
+
+func TestToDeviceResponseHasData(t *testing.T) {
+	res := &ToDeviceResponse{
+		NextBatch: "5",
+	}
+	if res.HasData(false) {
+		t.Fatalf("HasData returned true for a response with only a next_batch")
+	}
+	res.Events = []json.RawMessage{
+		json.RawMessage(`{"type":"m.room_key","content":{}}`),
+	}
+	if !res.HasData(false) {
+		t.Fatalf("HasData returned false for a response with events")
+	}
+}
@@ -7,7 +7,8 @@ import (
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 )
 
-// Client created request params
+// Client created request params. To follow typing in a single room, set `rooms` to that room. Typing
+// notifications are coalesced: a response contains at most one m.typing event per room, the latest one.
 type TypingRequest struct {
 	Core
 }
@@ -65,24 +66,28 @@ func (r *TypingRequest) AppendLive(ctx context.Context, res *Response, extCtx Co
 	res.Typing.Rooms[roomID] = typingEvent
 }
 
+// ProcessInitial returns the current typing users for all the rooms in the response. Typing notifications
+// are ephemeral so they are never persisted: the latest m.typing EDU for each room is held in-memory in the
+// global cache, fed by the v2 pollers.
 func (r *TypingRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
-	// grab typing users for all the rooms we're going to return
+	// grab typing users for all the rooms we're going to return which the client wants to know about
 	rooms := make(map[string]json.RawMessage)
 	roomIDs := make([]string, 0, len(extCtx.RoomIDToTimeline))
 	for roomID := range extCtx.RoomIDToTimeline {
+		if !r.RoomInScope(roomID, extCtx) {
+			continue
+		}
 		roomIDs = append(roomIDs, roomID)
 	}
+	if len(roomIDs) == 0 {
+		return
+	}
 	roomToGlobalMetadata := extCtx.GlobalCache.LoadRooms(ctx, roomIDs...)
-	for roomID := range extCtx.RoomIDToTimeline {
+	for _, roomID := range roomIDs {
 		meta := roomToGlobalMetadata[roomID]
 		if meta == nil || meta.TypingEvent == nil {
 			continue
 		}
-
-		if !r.RoomInScope(roomID, extCtx) {
-			continue
-		}
-
 		rooms[roomID] = meta.TypingEvent
 	}
 	if len(rooms) == 0 {
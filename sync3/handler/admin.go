@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/rs/zerolog/hlog"
+)
+
+// AdminPathPrefix is the path prefix for all admin API endpoints.
+const AdminPathPrefix = "/_syncv3/admin/"
+
+// WithAdminAPI wraps the sync handler and serves the admin API on paths starting with AdminPathPrefix.
+// All other requests are passed to next. Admin requests must have an `Authorization: Bearer <token>`
+// header matching the configured admin token.
+func WithAdminAPI(next http.Handler, h *SyncLiveHandler, token string) http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc(AdminPathPrefix+"dead_letters", h.adminListDeadLetters).Methods("GET")
+	r.HandleFunc(AdminPathPrefix+"dead_letters/{nid}/retry", h.adminRetryDeadLetter).Methods("POST")
+	r.HandleFunc(AdminPathPrefix+"dead_letters/{nid}", h.adminDiscardDeadLetter).Methods("DELETE")
+	r.HandleFunc(AdminPathPrefix+"costs", h.adminListCosts).Methods("GET")
+	r.HandleFunc(AdminPathPrefix+"tenants", h.adminListTenants).Methods("GET")
+	r.HandleFunc(AdminPathPrefix+"rooms/{room_id}/reload", h.adminReloadRoom).Methods("POST")
+	r.HandleFunc(AdminPathPrefix+"users/{user_id}/reload", h.adminReloadUser).Methods("POST")
+	r.HandleFunc(AdminPathPrefix+"room_versions", h.adminListRoomVersions).Methods("GET")
+	r.HandleFunc(AdminPathPrefix+"room_versions/{version}", h.adminListRoomsForVersion).Methods("GET")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, AdminPathPrefix) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		authHeader := req.Header.Get("Authorization")
+		got := strings.TrimPrefix(authHeader, "Bearer ")
+		if got == authHeader || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			hlog.FromRequest(req).Warn().Str("path", req.URL.Path).Msg("rejected admin request with bad token")
+			writeAdminError(w, &internal.HandlerError{
+				StatusCode: 401,
+				Err:        fmt.Errorf("invalid admin token"),
+			})
+			return
+		}
+		r.ServeHTTP(w, req)
+	})
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Err(err).Msg("failed to JSON-encode admin response")
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, herr *internal.HandlerError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(herr.StatusCode)
+	w.Write(herr.JSON())
+}
@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithAdminAPIAuth(t *testing.T) {
+	var calledNext bool
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calledNext = true
+	})
+	h := WithAdminAPI(next, &SyncLiveHandler{}, "secret")
+
+	// non-admin requests go to the next handler
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/_matrix/client/v3/sync", nil))
+	if !calledNext {
+		t.Fatalf("non-admin request was not passed to the next handler")
+	}
+
+	// admin requests with a missing or bad token are rejected
+	for _, authHeader := range []string{"", "Bearer nope", "secret"} {
+		calledNext = false
+		req := httptest.NewRequest("GET", AdminPathPrefix+"dead_letters", nil)
+		if authHeader != "" {
+			req.Header.Set("Authorization", authHeader)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != 401 {
+			t.Errorf("auth header %q: got HTTP %d want 401", authHeader, w.Code)
+		}
+		if calledNext {
+			t.Errorf("auth header %q: admin request was passed to the next handler", authHeader)
+		}
+	}
+
+	// unknown admin paths with a valid token 404
+	req := httptest.NewRequest("GET", AdminPathPrefix+"unknown", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != 404 {
+		t.Errorf("unknown admin path: got HTTP %d want 404", w.Code)
+	}
+}
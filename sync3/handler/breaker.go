@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// CircuitBreaker trips when too many storage errors happen within a time window. Whilst tripped, requests
+// which need the database to make progress are rejected immediately rather than piling more load onto a
+// struggling database, and existing connections are served from in-memory caches with `degraded: true`.
+// After a cooldown, a single request is let through to probe the database: if it succeeds the breaker
+// closes, else it stays open for another cooldown.
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	state     breakerState
+	failures  []time.Time
+	openedAt  time.Time
+	probing   bool
+}
+
+// NewCircuitBreaker makes a breaker which trips after `threshold` failures within `window`, and probes
+// the database again after `cooldown`.
+func NewCircuitBreaker(threshold int, window, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+	}
+}
+
+// Allow returns true if a request which needs the database should be attempted. The caller must report
+// the outcome with Success or Failure.
+func (b *CircuitBreaker) Allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// Degraded returns true if the breaker is not closed.
+func (b *CircuitBreaker) Degraded() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state != breakerClosed
+}
+
+// Success records that a database operation succeeded.
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		logger.Info().Msg("storage circuit breaker closed, database has recovered")
+	}
+	b.state = breakerClosed
+	b.probing = false
+	b.failures = b.failures[:0]
+}
+
+// Failure records that a database operation failed.
+func (b *CircuitBreaker) Failure(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerHalfOpen:
+		b.state = breakerOpen
+		b.openedAt = now
+		b.probing = false
+		return
+	case breakerOpen:
+		return
+	}
+	// drop failures which have fallen out of the window
+	i := 0
+	for i < len(b.failures) && now.Sub(b.failures[i]) > b.window {
+		i++
+	}
+	b.failures = append(b.failures[i:], now)
+	if len(b.failures) >= b.threshold {
+		logger.Warn().Int("failures", len(b.failures)).Str("window", b.window.String()).Msg(
+			"storage circuit breaker tripped, serving degraded responses",
+		)
+		b.state = breakerOpen
+		b.openedAt = now
+		b.failures = b.failures[:0]
+	}
+}
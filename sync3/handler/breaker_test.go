@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := NewCircuitBreaker(3, time.Minute, 30*time.Second)
+	now := time.Now()
+	b.Failure(now)
+	b.Failure(now.Add(time.Second))
+	// the first failure falls out of the window
+	b.Failure(now.Add(61 * time.Second))
+	if b.Degraded() || !b.Allow(now.Add(61*time.Second)) {
+		t.Fatalf("breaker tripped with failures outside the window")
+	}
+	now = now.Add(62 * time.Second)
+	b.Failure(now)
+	b.Failure(now)
+	if !b.Degraded() {
+		t.Fatalf("breaker did not trip")
+	}
+	if b.Allow(now.Add(time.Second)) {
+		t.Fatalf("breaker allowed a request whilst open")
+	}
+
+	// after the cooldown, a single probe is allowed
+	now = now.Add(31 * time.Second)
+	if !b.Allow(now) {
+		t.Fatalf("breaker did not allow a probe after the cooldown")
+	}
+	if b.Allow(now) {
+		t.Fatalf("breaker allowed a second probe")
+	}
+	// the probe fails, so the breaker is open for another cooldown
+	b.Failure(now)
+	if b.Allow(now.Add(time.Second)) {
+		t.Fatalf("breaker allowed a request after a failed probe")
+	}
+	now = now.Add(31 * time.Second)
+	if !b.Allow(now) {
+		t.Fatalf("breaker did not allow a probe after the cooldown")
+	}
+	b.Success()
+	if b.Degraded() || !b.Allow(now) {
+		t.Fatalf("breaker did not close after a successful probe")
+	}
+}
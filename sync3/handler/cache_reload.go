@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// POST /_syncv3/admin/rooms/{room_id}/reload
+// Replaces the room's metadata, members and cached state with what is in the database, e.g if the caches
+// have become corrupted. Users' caches keep their per-room data: reload the user to replace that too.
+func (h *SyncLiveHandler) adminReloadRoom(w http.ResponseWriter, req *http.Request) {
+	roomID := mux.Vars(req)["room_id"]
+	joined, invited, err := h.Storage.CurrentMembers(roomID)
+	if err != nil {
+		writeAdminError(w, &internal.HandlerError{StatusCode: 500, Err: fmt.Errorf("failed to load current members: %w", err)})
+		return
+	}
+	h.Dispatcher.RecountRoom(roomID, joined, invited)
+	if err := h.GlobalCache.ReloadRoom(req.Context(), roomID); err != nil {
+		writeAdminError(w, internal.ToHandlerError(err))
+		return
+	}
+	logger.Info().Str("room", roomID).Msg("reloaded room from the database via the admin API")
+	writeAdminJSON(w, struct{}{})
+}
+
+// POST /_syncv3/admin/users/{user_id}/reload
+// Replaces the user's cache with one loaded from the database and closes their connections, so their
+// clients start again with the new cache. Does nothing if the user has no cache.
+func (h *SyncLiveHandler) adminReloadUser(w http.ResponseWriter, req *http.Request) {
+	userID := mux.Vars(req)["user_id"]
+	if h.CacheForUser(userID) == nil {
+		writeAdminJSON(w, map[string]interface{}{
+			"reloaded": false,
+		})
+		return
+	}
+	h.Dispatcher.Unregister(userID)
+	h.userCaches.Delete(userID)
+	h.ConnMap.CloseConnsForUser(userID)
+	if _, err := h.userCache(userID); err != nil {
+		// the cache is rebuilt when the user next makes a request
+		writeAdminError(w, &internal.HandlerError{StatusCode: 500, Err: fmt.Errorf("failed to reload user cache: %w", err)})
+		return
+	}
+	logger.Info().Str("user", userID).Msg("reloaded user cache from the database via the admin API")
+	writeAdminJSON(w, map[string]interface{}{
+		"reloaded": true,
+	})
+}
@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+// conformanceVector is a shareable test vector for MSC3575. See testdata/conformance/README.md.
+type conformanceVector struct {
+	Description string `json:"description"`
+	Rooms       []struct {
+		RoomID               string `json:"room_id"`
+		Name                 string `json:"name"`
+		LastMessageTimestamp uint64 `json:"last_message_timestamp"`
+	} `json:"rooms"`
+	Steps []struct {
+		Events []struct {
+			RoomID    string `json:"room_id"`
+			Timestamp int64  `json:"timestamp"`
+		} `json:"events"`
+		Request  sync3.Request  `json:"request"`
+		Response sync3.Response `json:"response"`
+	} `json:"steps"`
+}
+
+// Run every test vector in testdata/conformance against a ConnState backed by in-memory caches.
+func TestConformance(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "conformance", "*.json"))
+	if err != nil {
+		t.Fatalf("failed to list test vectors: %s", err)
+	}
+	if len(files) == 0 {
+		t.Fatalf("no test vectors found")
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", file, err)
+		}
+		var vector conformanceVector
+		if err := json.Unmarshal(data, &vector); err != nil {
+			t.Fatalf("failed to parse %s: %s", file, err)
+		}
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			t.Log(vector.Description)
+			runConformanceVector(t, &vector)
+		})
+	}
+}
+
+func runConformanceVector(t *testing.T, vector *conformanceVector) {
+	ctx := context.Background()
+	userID := "@conformance:localhost"
+	connID := sync3.ConnID{DeviceID: "d"}
+	metadata := make(map[string]internal.RoomMetadata, len(vector.Rooms))
+	joinedRooms := make(map[string][]string, len(vector.Rooms))
+	for _, r := range vector.Rooms {
+		metadata[r.RoomID] = internal.RoomMetadata{
+			RoomID:               r.RoomID,
+			NameEvent:            r.Name,
+			LastMessageTimestamp: r.LastMessageTimestamp,
+		}
+		joinedRooms[r.RoomID] = []string{userID}
+	}
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(metadata)
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(joinedRooms, nil)
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joined map[string]*internal.RoomMetadata, err error) {
+		joined = make(map[string]*internal.RoomMetadata, len(metadata))
+		for roomID := range metadata {
+			m := metadata[roomID]
+			joined[roomID] = &m
+		}
+		return 1, joined, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = mockLazyRoomOverride
+	dispatcher.Register(ctx, userCache.UserID, userCache)
+	dispatcher.Register(ctx, sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, connID.DeviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, 1000)
+
+	pos := int64(1)
+	for i, step := range vector.Steps {
+		for _, ev := range step.Events {
+			pos++
+			dispatcher.OnNewEvent(ctx, ev.RoomID, testutils.NewEvent(
+				t, "m.room.message", userID, map[string]interface{}{"body": "conformance"},
+				testutils.WithTimestamp(time.UnixMilli(ev.Timestamp)),
+			), pos)
+		}
+		req := step.Request
+		res, err := cs.OnIncomingRequest(ctx, connID, &req, false)
+		if err != nil {
+			t.Fatalf("step %d: OnIncomingRequest returned error: %s", i, err)
+		}
+		checkResponse(t, false, res, &step.Response)
+	}
+}
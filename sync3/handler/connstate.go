@@ -13,10 +13,21 @@ import (
 	"github.com/tidwall/gjson"
 )
 
+// The max number of room IDs of collapsed invites to send to the client.
+const collapsedInviteSampleSize = 5
+
+// The number of rooms to load between flushes when streaming a response.
+const streamRoomBatchSize = 10
+
 type JoinChecker interface {
 	IsUserJoined(userID, roomID string) bool
 }
 
+// EventContextFetcher loads the events around an event, for room subscriptions with `event_context`.
+type EventContextFetcher interface {
+	EventContext(ctx context.Context, userID, deviceID, roomID string, loadPos int64, req sync3.EventContextRequest) *sync3.EventContext
+}
+
 // ConnState tracks all high-level connection state for this connection, like the combined request
 // and the underlying sorted room list. It doesn't track positions of the connection.
 type ConnState struct {
@@ -43,6 +54,37 @@ type ConnState struct {
 
 	extensionsHandler   extensions.HandlerInterface
 	processHistogramVec *prometheus.HistogramVec
+	// extensions which ran late on this connection, to be sent in a later response
+	deferredExtensions *extensions.Deferred
+	// rooms whose data wasn't loaded before the request deadline, to be sent in the next response
+	deferredRooms []BuiltSubscription
+
+	// if true, include debugging information in responses e.g relevant_rooms
+	debug bool
+
+	// if set, the lists on this connection are periodically snapshotted
+	listSnapshot *listSnapshotConn
+
+	// if set, limits the number of live list ops sent to the client
+	opLimiter *opLimiter
+
+	// if > 0, the number of timeline events to prefetch for rooms the user is likely to open soon
+	prefetchTimelineLimit int
+
+	// if set, used to load the events around an event for room subscriptions with `event_context`
+	eventContextFetcher EventContextFetcher
+
+	// server-configured caps on the lists and room subscriptions this connection can have
+	limits sync3.Limits
+
+	// the number of collapsed invites last sent to the client
+	lastCollapsedInviteCount int
+
+	// if set, called when the connection is destroyed
+	onDestroy func()
+
+	// if set, the sticky request is recorded here for the diagnostics endpoint
+	diagnostics *connDiagnostics
 }
 
 func NewConnState(
@@ -62,6 +104,7 @@ func NewConnState(
 		joinChecker:         joinChecker,
 		lazyCache:           NewLazyCache(),
 		processHistogramVec: histVec,
+		deferredExtensions:  extensions.NewDeferred(),
 	}
 	cs.live = &connStateLive{
 		ConnState:     cs,
@@ -84,18 +127,22 @@ func NewConnState(
 //   - load() bases its current state based on the latest position, which includes processing of these N events.
 //   - post load() we read N events, processing them a 2nd time.
 func (s *ConnState) load(ctx context.Context) error {
-	initialLoadPosition, joinedRooms, err := s.globalCache.LoadJoinedRooms(ctx, s.userID)
+	initialLoadPosition, joinedRooms, err := s.userCache.LoadJoinedRooms(ctx)
 	if err != nil {
 		return err
 	}
+	joinedRoomIDs := make([]string, 0, len(joinedRooms))
+	for roomID := range joinedRooms {
+		joinedRoomIDs = append(joinedRoomIDs, roomID)
+	}
+	roomIDToUserData := s.userCache.LoadRoomDatas(joinedRoomIDs...)
 	rooms := make([]sync3.RoomConnMetadata, len(joinedRooms))
 	i := 0
 	for _, metadata := range joinedRooms {
 		metadata.RemoveHero(s.userID)
-		urd := s.userCache.LoadRoomData(metadata.RoomID)
 		rooms[i] = sync3.RoomConnMetadata{
 			RoomMetadata: *metadata,
-			UserRoomData: urd,
+			UserRoomData: roomIDToUserData[metadata.RoomID],
 		}
 		i++
 	}
@@ -123,7 +170,11 @@ func (s *ConnState) OnIncomingRequest(ctx context.Context, cid sync3.ConnID, req
 		s.load(ctx)
 		region.End()
 	}
-	return s.onIncomingRequest(ctx, req, isInitial)
+	resp, err := s.onIncomingRequest(ctx, req, isInitial)
+	if s.listSnapshot != nil && err == nil {
+		s.listSnapshot.setLists(s.lists, s.muxedReq.Lists)
+	}
+	return resp, err
 }
 
 // onIncomingRequest is a callback which fires when the client makes a request to the server. Whilst each request may
@@ -132,8 +183,14 @@ func (s *ConnState) OnIncomingRequest(ctx context.Context, cid sync3.ConnID, req
 func (s *ConnState) onIncomingRequest(ctx context.Context, req *sync3.Request, isInitial bool) (*sync3.Response, error) {
 	start := time.Now()
 	// ApplyDelta works fine if s.muxedReq is nil
-	var delta *sync3.RequestDelta
-	s.muxedReq, delta = s.muxedReq.ApplyDelta(req)
+	muxedReq, delta := s.muxedReq.ApplyDelta(req)
+	if herr := s.limits.CheckSession(muxedReq); herr != nil {
+		return nil, herr
+	}
+	s.muxedReq = muxedReq
+	if s.diagnostics != nil {
+		s.diagnostics.setStickyRequest(muxedReq)
+	}
 	internal.Logf(ctx, "connstate", "new subs=%v unsubs=%v num_lists=%v", len(delta.Subs), len(delta.Unsubs), len(delta.Lists))
 	for key, l := range delta.Lists {
 		listData := ""
@@ -147,29 +204,57 @@ func (s *ConnState) onIncomingRequest(ctx context.Context, req *sync3.Request, i
 	// work out which rooms we'll return data for and add their relevant subscriptions to the builder
 	// for it to mix together
 	builder := NewRoomsBuilder()
+	if delta.ProfileSwitch != nil {
+		s.switchProfile(ctx, delta)
+	}
 	// works out which rooms are subscribed to but doesn't pull room data
 	s.buildRoomSubscriptions(ctx, builder, delta.Subs, delta.Unsubs)
 	// works out how rooms get moved about but doesn't pull room data
 	respLists := s.buildListSubscriptions(ctx, builder, delta.Lists)
+	s.addDeferredRooms(ctx, builder)
 
 	// pull room data and set changes on the response
-	response := &sync3.Response{
-		Rooms: s.buildRooms(ctx, builder.BuildSubscriptions()), // pull room data
-		Lists: respLists,
+	var response *sync3.Response
+	if streamer := req.Streamer(); streamer != nil && isInitial && builder.NumRooms() >= streamer.MinRooms {
+		// Send the lists straight away, then rooms as they are loaded. The counts are final as initial
+		// responses with rooms in them don't wait for live updates.
+		s.setListCounts(respLists)
+		if err := streamer.WriteLists(respLists); err != nil {
+			// the client has probably gone away, keep building the response so it can be retransmitted
+			logger.Warn().Err(err).Str("user", s.userID).Msg("failed to stream lists")
+			streamer = nil
+		}
+		response = &sync3.Response{
+			Rooms: s.buildRooms(ctx, builder.BuildSubscriptionBatches(streamRoomBatchSize), streamer),
+			Lists: respLists,
+		}
+	} else {
+		builtSubs := builder.BuildSubscriptions()
+		if _, ok := ctx.Deadline(); ok {
+			// load the most important rooms first, in batches, so we can stop when the deadline is near
+			builtSubs = builder.BuildSubscriptionBatches(streamRoomBatchSize)
+		}
+		response = &sync3.Response{
+			Rooms: s.buildRooms(ctx, builtSubs, nil), // pull room data
+			Lists: respLists,
+		}
 	}
 
 	// Handle extensions AFTER processing lists as extensions may need to know which rooms the client
 	// is being notified about (e.g. for room account data)
 	ctx, region := internal.StartSpan(ctx, "extensions")
 	response.Extensions = s.extensionsHandler.Handle(ctx, s.muxedReq.Extensions, extensions.Context{
-		UserID:           s.userID,
-		DeviceID:         s.deviceID,
-		RoomIDToTimeline: response.RoomIDsToTimelineEventIDs(),
-		IsInitial:        isInitial,
+		UserID:               s.userID,
+		DeviceID:             s.deviceID,
+		RoomIDToTimeline:     response.RoomIDsToTimelineEventIDs(),
+		IsInitial:            isInitial,
+		Deferred:             s.deferredExtensions,
+		RoomIDsToLists:       s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists),
+		RoomIDsToListIndexes: s.lists.ListIndexesByVisibleRoomIDs(s.muxedReq.Lists),
 	})
 	region.End()
 
-	if response.ListOps() > 0 || len(response.Rooms) > 0 || response.Extensions.HasData(isInitial) {
+	if response.ListOps() > 0 || len(response.Rooms) > 0 || len(response.RoomsMeta) > 0 || response.Extensions.HasData(isInitial) {
 		// we're going to immediately return, so track how long this took. We don't do this for long
 		// polling requests as high numbers mean nothing. We need to check if we will block as otherwise
 		// we will have tons of fast requests logged (as they get tracked and then hit live streaming)
@@ -184,18 +269,59 @@ func (s *ConnState) onIncomingRequest(ctx context.Context, req *sync3.Request, i
 	region.End()
 
 	// counts are AFTER events are applied, hence after liveUpdate
-	for listKey := range response.Lists {
-		l := response.Lists[listKey]
-		l.Count = s.lists.Count(listKey)
-		response.Lists[listKey] = l
+	s.setListCounts(response.Lists)
+	// live updates may have bumped rooms, so set bump stamps once all rooms are in the response
+	s.setBumpStamps(response.Rooms)
+
+	// collapsed invites don't wake up the connection, so piggyback changes on whatever we send next
+	count, sample := s.userCache.CollapsedInvites(collapsedInviteSampleSize)
+	if count != s.lastCollapsedInviteCount || (isInitial && count > 0) {
+		response.CollapsedInvites = &sync3.CollapsedInvites{
+			Count:  count,
+			Sample: sample,
+		}
+		s.lastCollapsedInviteCount = count
 	}
 	return response, nil
 }
 
-func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBuilder, listKey string, prevReqList, nextReqList *sync3.RequestList) sync3.ResponseList {
+func (s *ConnState) setListCounts(respLists map[string]sync3.ResponseList) {
+	for listKey := range respLists {
+		l := respLists[listKey]
+		l.Count = s.lists.Count(listKey)
+		if s.debug {
+			if reqList, ok := s.muxedReq.Lists[listKey]; ok {
+				l.RelevantRooms = s.lists.RoomIDsInRanges(listKey, reqList.Ranges)
+			}
+		}
+		respLists[listKey] = l
+	}
+}
+
+// bumpStamp returns the timestamp the room is sorted by in this connection's lists, or 0 if the room
+// isn't in the lists.
+func (s *ConnState) bumpStamp(roomID string) uint64 {
+	r := s.lists.ReadOnlyRoom(roomID)
+	if r == nil {
+		return 0
+	}
+	return r.LastMessageTimestamp
+}
+
+func (s *ConnState) setBumpStamps(rooms map[string]sync3.Room) {
+	for roomID, room := range rooms {
+		if stamp := s.bumpStamp(roomID); stamp != room.BumpStamp {
+			room.BumpStamp = stamp
+			rooms[roomID] = room
+		}
+	}
+}
+
+func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBuilder, listKey string, prevReqList, nextReqList *sync3.RequestList, resumed bool) sync3.ResponseList {
 	ctx, span := internal.StartSpan(ctx, "onIncomingListRequest")
 	defer span.End()
 	roomList, overwritten := s.lists.AssignList(ctx, listKey, nextReqList.Filters, nextReqList.Sort, sync3.DoNotOverwrite)
+	roomList.SetPinnedRooms(nextReqList.PinnedRooms)
 
 	if nextReqList.ShouldGetAllRooms() {
 		if overwritten || prevReqList.FiltersChanged(nextReqList) {
@@ -221,7 +347,9 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 	var responseOperations []sync3.ResponseOp
 
 	var prevRange sync3.SliceRanges
-	if prevReqList != nil {
+	if prevReqList != nil && !resumed {
+		// the client wasn't told about changes whilst the list was inactive, so resumed lists re-SYNC
+		// every range
 		prevRange = prevReqList.Ranges
 	}
 
@@ -237,7 +365,7 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 	filtersChanged := prevReqList.FiltersChanged(nextReqList)
 	if sortChanged || filtersChanged {
 		// the sort/filter operations have changed, invalidate everything (if there were previous syncs), re-sort and re-SYNC
-		if prevReqList != nil {
+		if prevRange != nil {
 			// there were previous syncs for this list, INVALIDATE the lot
 			logger.Trace().Interface("range", prevRange).Msg("INVALIDATEing because sort/filter ops have changed")
 			allRoomIDs := roomList.RoomIDs()
@@ -256,6 +384,7 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 		if filtersChanged {
 			// we need to re-create the list as the rooms may have completely changed
 			roomList, _ = s.lists.AssignList(ctx, listKey, nextReqList.Filters, nextReqList.Sort, sync3.Overwrite)
+			roomList.SetPinnedRooms(nextReqList.PinnedRooms)
 		}
 		// resort as either we changed the sort order or we added/removed a bunch of rooms
 		if err := roomList.Sort(nextReqList.Sort); err != nil {
@@ -316,6 +445,7 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 			}
 			if reqStateChanged {
 				newRS.RequiredState = nextReqList.RequiredState
+				newRS.EssentialState = nextReqList.EssentialState
 			}
 			newSubID := builder.AddSubscription(newRS)
 			// all the current rooms need to be added to this subscription
@@ -361,11 +491,29 @@ func (s *ConnState) buildListSubscriptions(ctx context.Context, builder *RoomsBu
 			s.lists.DeleteList(listKey)
 			continue
 		}
-		result[listKey] = s.onIncomingListRequest(ctx, builder, listKey, list.Prev, list.Curr)
+		result[listKey] = s.onIncomingListRequest(ctx, builder, listKey, list.Prev, list.Curr, list.Resumed)
 	}
 	return result
 }
 
+// switchProfile parks the lists of the previous profile and unparks the lists of the new one, so
+// switching back and forth between profiles doesn't rebuild the lists each time.
+func (s *ConnState) switchProfile(ctx context.Context, delta *sync3.RequestDelta) {
+	ps := delta.ProfileSwitch
+	for listKey, list := range ps.Parked {
+		s.lists.ParkList(listKey, parkedListKey(ps.From, listKey), list.Sort)
+	}
+	for listKey, list := range delta.Lists {
+		if list.Resumed {
+			s.lists.UnparkList(ctx, parkedListKey(ps.To, listKey), listKey)
+		}
+	}
+}
+
+func parkedListKey(profile, listKey string) string {
+	return profile + "\x00" + listKey
+}
+
 func (s *ConnState) buildRoomSubscriptions(ctx context.Context, builder *RoomsBuilder, subs, unsubs []string) {
 	ctx, span := internal.StartSpan(ctx, "buildRoomSubscriptions")
 	defer span.End()
@@ -391,14 +539,21 @@ func (s *ConnState) buildRoomSubscriptions(ctx context.Context, builder *RoomsBu
 	}
 }
 
-func (s *ConnState) buildRooms(ctx context.Context, builtSubs []BuiltSubscription) map[string]sync3.Room {
+// buildRooms loads the room data for builtSubs. If streamer is set, rooms are written to it as each
+// subscription is loaded.
+func (s *ConnState) buildRooms(ctx context.Context, builtSubs []BuiltSubscription, streamer *sync3.ResponseStreamer) map[string]sync3.Room {
 	ctx, span := internal.StartSpan(ctx, "buildRooms")
 	defer span.End()
 	result := make(map[string]sync3.Room)
 	for _, bs := range builtSubs {
+		if deadlineNear(ctx) {
+			// return what we have, and send the rest in the next response
+			s.deferredRooms = append(s.deferredRooms, bs)
+			continue
+		}
 		roomIDs := bs.RoomIDs
+		var oldRoomIDs []string
 		if bs.RoomSubscription.IncludeOldRooms != nil {
-			var oldRoomIDs []string
 			for _, currRoomID := range bs.RoomIDs { // <- the list of subs we definitely are including
 				// append old rooms if we are joined to them
 				currRoom := s.lists.ReadOnlyRoom(currRoomID)
@@ -430,10 +585,42 @@ func (s *ConnState) buildRooms(ctx context.Context, builtSubs []BuiltSubscriptio
 		for roomID, room := range rooms {
 			result[roomID] = room
 		}
+		if streamer != nil {
+			err := streamer.WriteRooms(roomIDs, result)
+			if err == nil {
+				err = streamer.WriteRooms(oldRoomIDs, result)
+			}
+			if err != nil {
+				logger.Warn().Err(err).Str("user", s.userID).Msg("failed to stream rooms")
+				streamer = nil
+			}
+		}
 	}
 	return result
 }
 
+// addDeferredRooms adds the rooms which weren't loaded before a previous request's deadline to the builder,
+// if they are still subscribed to or visible in a list.
+func (s *ConnState) addDeferredRooms(ctx context.Context, builder *RoomsBuilder) {
+	if len(s.deferredRooms) == 0 {
+		return
+	}
+	visible := s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists)
+	for _, bs := range s.deferredRooms {
+		var roomIDs []string
+		for _, roomID := range bs.RoomIDs {
+			_, subscribed := s.roomSubscriptions[roomID]
+			if (subscribed || len(visible[roomID]) > 0) && !builder.IncludesRoom(roomID) {
+				roomIDs = append(roomIDs, roomID)
+			}
+		}
+		if len(roomIDs) > 0 {
+			builder.AddRoomsToSubscription(ctx, builder.AddSubscription(bs.RoomSubscription), roomIDs)
+		}
+	}
+	s.deferredRooms = nil
+}
+
 func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSubscription, roomIDs ...string) map[string]sync3.Room {
 	ctx, span := internal.StartSpan(ctx, "getInitialRoomData")
 	defer span.End()
@@ -485,9 +672,26 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 				requiredState = make([]json.RawMessage, 0)
 			}
 		}
+		var heroes []sync3.Hero
+		if roomSub.HeroesEnabled() {
+			heroes = sync3.NewHeroes(s.userCache.Heroes(metadata))
+		}
+		var threadCounts map[string]internal.ThreadUnreadCounts
+		if roomSub.ThreadsEnabled() && len(userRoomData.ThreadUnreadCounts) > 0 {
+			// copy the counts, as the map belongs to the user cache and live updates add to the response's map
+			threadCounts = make(map[string]internal.ThreadUnreadCounts, len(userRoomData.ThreadUnreadCounts))
+			for threadID, counts := range userRoomData.ThreadUnreadCounts {
+				threadCounts[threadID] = counts
+			}
+		}
+		var roomType string
+		if metadata.RoomType != nil {
+			roomType = *metadata.RoomType
+		}
 		prevBatch, _ := userRoomData.PrevBatch()
 		rooms[roomID] = sync3.Room{
 			Name:              internal.CalculateRoomName(metadata, 5), // TODO: customisable?
+			Avatar:            metadata.AvatarEvent,
 			NotificationCount: int64(userRoomData.NotificationCount),
 			HighlightCount:    int64(userRoomData.HighlightCount),
 			Timeline:          roomToTimeline[roomID],
@@ -495,9 +699,21 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 			InviteState:       inviteState,
 			Initial:           true,
 			IsDM:              userRoomData.IsDM,
+			IsEncrypted:       metadata.Encrypted,
+			RoomType:          roomType,
 			JoinedCount:       metadata.JoinCount,
 			InvitedCount:      metadata.InviteCount,
 			PrevBatch:         prevBatch,
+			Heroes:            heroes,
+			ContentHints:      sync3.NewContentHints(&metadata.ContentHints),
+			BumpStamp:         s.bumpStamp(roomID),
+
+			UnreadThreadNotifications: threadCounts,
+		}
+		if sub, ok := s.roomSubscriptions[roomID]; ok && sub.EventContext != nil && s.eventContextFetcher != nil {
+			room := rooms[roomID]
+			room.EventContext = s.eventContextFetcher.EventContext(ctx, s.userID, s.deviceID, roomID, s.loadPosition, *sub.EventContext)
+			rooms[roomID] = room
 		}
 	}
 
@@ -509,6 +725,20 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 	return rooms
 }
 
+// anySubscription returns true if this room is subscribed to, either directly or via a list, with a
+// room subscription for which fn returns true.
+func (s *ConnState) anySubscription(roomID string, fn func(sub sync3.RoomSubscription) bool) bool {
+	if sub, ok := s.roomSubscriptions[roomID]; ok && fn(sub) {
+		return true
+	}
+	for _, listKey := range s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists)[roomID] {
+		if fn(s.muxedReq.Lists[listKey].RoomSubscription) {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *ConnState) trackProcessDuration(dur time.Duration, isInitial bool) {
 	if s.processHistogramVec == nil {
 		return
@@ -523,6 +753,12 @@ func (s *ConnState) trackProcessDuration(dur time.Duration, isInitial bool) {
 // Called when the connection is torn down
 func (s *ConnState) Destroy() {
 	s.userCache.Unsubscribe(s.userCacheID)
+	if s.listSnapshot != nil {
+		s.listSnapshot.untrack()
+	}
+	if s.onDestroy != nil {
+		s.onDestroy()
+	}
 }
 
 func (s *ConnState) Alive() bool {
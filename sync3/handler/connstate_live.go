@@ -12,6 +12,9 @@ import (
 	"github.com/tidwall/gjson"
 )
 
+// rooms at an index lower than this in a list sorted by recency have their timelines prefetched
+const prefetchTopRooms = 5
+
 // the amount of time to try to insert into a full buffer before giving up.
 // Customisable for testing
 var BufferWaitTime = time.Second * 5
@@ -60,9 +63,15 @@ func (s *connStateLive) liveUpdate(
 	if req.TimeoutMSecs() < 100 {
 		req.SetTimeoutMSecs(100)
 	}
+	// remember how many ops each list has so we only rate limit ops caused by live updates
+	opsBefore := make(map[string]int, len(response.Lists))
+	for listKey, resList := range response.Lists {
+		opsBefore[listKey] = len(resList.Ops)
+	}
+	defer s.limitListOps(ctx, response, opsBefore)
 	// block until we get a new event, with appropriate timeout
 	startTime := time.Now()
-	for response.ListOps() == 0 && len(response.Rooms) == 0 && !response.Extensions.HasData(isInitial) {
+	for response.ListOps() == 0 && len(response.Rooms) == 0 && len(response.RoomsMeta) == 0 && !response.Extensions.HasData(isInitial) {
 		timeToWait := time.Duration(req.TimeoutMSecs()) * time.Millisecond
 		timeWaited := time.Since(startTime)
 		timeLeftToWait := timeToWait - timeWaited
@@ -86,23 +95,28 @@ func (s *connStateLive) liveUpdate(
 			s.processLiveUpdate(ctx, update, response)
 			// pass event to extensions AFTER processing
 			roomIDsToLists := s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists)
+			roomIDsToListIndexes := s.lists.ListIndexesByVisibleRoomIDs(s.muxedReq.Lists)
 			s.extensionsHandler.HandleLiveUpdate(update, ex, &response.Extensions, extensions.Context{
-				IsInitial:        false,
-				RoomIDToTimeline: response.RoomIDsToTimelineEventIDs(),
-				UserID:           s.userID,
-				DeviceID:         s.deviceID,
-				RoomIDsToLists:   roomIDsToLists,
+				IsInitial:            false,
+				RoomIDToTimeline:     response.RoomIDsToTimelineEventIDs(),
+				UserID:               s.userID,
+				DeviceID:             s.deviceID,
+				RoomIDsToLists:       roomIDsToLists,
+				RoomIDsToListIndexes: roomIDsToListIndexes,
 			})
-			// if there's more updates and we don't have lots stacked up already, go ahead and process another
-			for len(s.updates) > 0 && response.ListOps() < 50 {
+			// if there's more updates and we don't have lots stacked up already, go ahead and process another.
+			// Don't do this if we are close to the request deadline: the updates will remain buffered and be
+			// sent on the next request instead.
+			for len(s.updates) > 0 && response.ListOps() < 50 && !deadlineNear(ctx) {
 				update = <-s.updates
 				s.processLiveUpdate(ctx, update, response)
 				s.extensionsHandler.HandleLiveUpdate(update, ex, &response.Extensions, extensions.Context{
-					IsInitial:        false,
-					RoomIDToTimeline: response.RoomIDsToTimelineEventIDs(),
-					UserID:           s.userID,
-					DeviceID:         s.deviceID,
-					RoomIDsToLists:   roomIDsToLists,
+					IsInitial:            false,
+					RoomIDToTimeline:     response.RoomIDsToTimelineEventIDs(),
+					UserID:               s.userID,
+					DeviceID:             s.deviceID,
+					RoomIDsToLists:       roomIDsToLists,
+					RoomIDsToListIndexes: roomIDsToListIndexes,
 				})
 			}
 			// Add membership events for users sending typing notifications
@@ -165,6 +179,7 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 	hasUpdates := s.processUpdatesForSubscriptions(ctx, builder, up)
 
 	// do per-list updates (e.g resorting, adding/removing rooms which no longer match filter)
+	opsBefore := response.ListOps()
 	for _, listDelta := range delta.Lists {
 		listKey := listDelta.ListKey
 		list := s.lists.Get(listKey)
@@ -180,7 +195,7 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 	// add in initial rooms FIRST as we replace whatever is in the rooms key for these rooms.
 	// If we do it after appending live updates then we can lose updates because we replace what
 	// we accumulated.
-	rooms := s.buildRooms(ctx, builder.BuildSubscriptions())
+	rooms := s.buildRooms(ctx, builder.BuildSubscriptions(), nil)
 	for roomID, room := range rooms {
 		response.Rooms[roomID] = room
 		// remember what point we snapshotted this room, incase we see live events which we have
@@ -188,8 +203,16 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 		s.loadPositions[roomID] = s.loadPosition
 	}
 
+	// if the room hasn't moved and only its name or avatar changed, tell the client about the change
+	// without sending the room.
+	metaOnly := hasUpdates && roomEventUpdate != nil && len(rooms) == 0 && response.ListOps() == opsBefore &&
+		s.isRoomMetaOnly(roomEventUpdate, delta, response)
+	if metaOnly {
+		s.addRoomMeta(roomEventUpdate, delta, response)
+	}
+
 	// TODO: find a better way to determine if the triggering event should be included e.g ask the lists?
-	if hasUpdates && roomEventUpdate != nil {
+	if hasUpdates && roomEventUpdate != nil && !metaOnly {
 		// include this update in the rooms response TODO: filters on event type?
 		userRoomData := roomUpdate.UserRoomMetadata()
 		r := response.Rooms[roomUpdate.RoomID()]
@@ -228,16 +251,29 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 		response.Rooms[roomUpdate.RoomID()] = r
 	}
 
-	if roomUpdate != nil {
+	if roomUpdate != nil && !metaOnly {
 		// try to find this room in the response. If it's there, then we may need to update some fields.
 		// there's no guarantees that the room will be in the response if say the event caused it to move
 		// off a list.
 		thisRoom, exists := response.Rooms[roomUpdate.RoomID()]
 		if exists {
 			if delta.RoomNameChanged {
-				metadata := roomUpdate.GlobalRoomMetadata()
+				// copy the metadata, as it is shared by every connection which receives this update
+				metadata := *roomUpdate.GlobalRoomMetadata()
 				metadata.RemoveHero(s.userID)
-				thisRoom.Name = internal.CalculateRoomName(metadata, 5) // TODO: customisable?
+				thisRoom.Name = internal.CalculateRoomName(&metadata, 5) // TODO: customisable?
+			}
+			// functional members are excluded from the heroes, so a change to them changes the heroes too
+			heroesChanged := delta.HeroesChanged ||
+				(roomEventUpdate != nil && roomEventUpdate.EventData.EventType == internal.FunctionalMembersEventType)
+			if heroesChanged && s.anySubscription(roomUpdate.RoomID(), sync3.RoomSubscription.HeroesEnabled) {
+				thisRoom.Heroes = sync3.NewHeroes(s.userCache.Heroes(roomUpdate.GlobalRoomMetadata()))
+			}
+			if delta.RoomAvatarChanged {
+				thisRoom.Avatar = roomUpdate.GlobalRoomMetadata().AvatarEvent
+			}
+			if delta.EncryptionChanged {
+				thisRoom.IsEncrypted = roomUpdate.GlobalRoomMetadata().Encrypted
 			}
 			if delta.InviteCountChanged {
 				thisRoom.InvitedCount = roomUpdate.GlobalRoomMetadata().InviteCount
@@ -245,6 +281,10 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 			if delta.JoinCountChanged {
 				thisRoom.JoinedCount = roomUpdate.GlobalRoomMetadata().JoinCount
 			}
+			if s.globalCache.ContentHintsEnabled() {
+				// cheap to work out, so just send the latest hints with every event rather than tracking changes
+				thisRoom.ContentHints = sync3.NewContentHints(&roomUpdate.GlobalRoomMetadata().ContentHints)
+			}
 
 			response.Rooms[roomUpdate.RoomID()] = thisRoom
 		}
@@ -259,9 +299,111 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 			response.Rooms[roomUpdate.RoomID()] = thisRoom
 		}
 	}
+
+	if threadUpdate, ok := up.(*caches.ThreadUnreadCountsUpdate); ok {
+		if s.anySubscription(threadUpdate.RoomID, sync3.RoomSubscription.ThreadsEnabled) {
+			thisRoom := response.Rooms[threadUpdate.RoomID]
+			// build a new map rather than adding to the existing one, which may be shared with a cache
+			threadCounts := make(
+				map[string]internal.ThreadUnreadCounts, len(thisRoom.UnreadThreadNotifications)+len(threadUpdate.Counts),
+			)
+			for threadID, counts := range thisRoom.UnreadThreadNotifications {
+				threadCounts[threadID] = counts
+			}
+			for threadID, counts := range threadUpdate.Counts {
+				threadCounts[threadID] = counts
+			}
+			thisRoom.UnreadThreadNotifications = threadCounts
+			response.Rooms[threadUpdate.RoomID] = thisRoom
+			hasUpdates = true
+		}
+	}
+
+	if s.prefetchTimelineLimit > 0 && roomUpdate != nil {
+		s.prefetch(roomUpdate)
+	}
 	return hasUpdates
 }
 
+// isRoomMetaOnly returns true if this event only changes the name or avatar of a room the client already
+// has, so it can be sent in rooms_meta rather than as a room. Room subscriptions are always sent in full
+// as the client has asked for the room's timeline.
+func (s *connStateLive) isRoomMetaOnly(up *caches.RoomEventUpdate, delta sync3.RoomDelta, response *sync3.Response) bool {
+	if !s.muxedReq.RoomsMetaEnabled() || up.EventData.ForceInitial || up.EventData.StateKey == nil {
+		return false
+	}
+	switch up.EventData.EventType {
+	case "m.room.name", "m.room.avatar", "m.room.canonical_alias":
+	default:
+		return false
+	}
+	if !delta.RoomNameChanged && !delta.RoomAvatarChanged {
+		return false
+	}
+	if delta.EncryptionChanged || delta.JoinCountChanged || delta.InviteCountChanged ||
+		delta.NotificationCountChanged || delta.HighlightCountChanged {
+		return false
+	}
+	if _, exists := s.roomSubscriptions[up.RoomID()]; exists {
+		return false
+	}
+	// the room is already being sent, so add the changes to it instead
+	_, exists := response.Rooms[up.RoomID()]
+	return !exists
+}
+
+func (s *connStateLive) addRoomMeta(up *caches.RoomEventUpdate, delta sync3.RoomDelta, response *sync3.Response) {
+	if response.RoomsMeta == nil {
+		response.RoomsMeta = make(map[string]sync3.RoomMeta)
+	}
+	roomMeta := response.RoomsMeta[up.RoomID()]
+	if delta.RoomNameChanged {
+		metadata := *up.GlobalRoomMetadata()
+		metadata.RemoveHero(s.userID)
+		name := internal.CalculateRoomName(&metadata, 5)
+		roomMeta.Name = &name
+	}
+	if delta.RoomAvatarChanged {
+		avatar := up.GlobalRoomMetadata().AvatarEvent
+		roomMeta.Avatar = &avatar
+	}
+	response.RoomsMeta[up.RoomID()] = roomMeta
+	// the event isn't sent, but the client's view of the room is up to date with it
+	s.loadPositions[up.RoomID()] = up.EventData.LatestPos
+}
+
+// prefetch warms the user cache with the timeline of the updated room if the user is likely to open it
+// soon: either it has just been highlighted or it is at the top of a list sorted by recency.
+func (s *connStateLive) prefetch(up caches.RoomUpdate) {
+	roomID := up.RoomID()
+	if sub, ok := s.roomSubscriptions[roomID]; ok && sub.TimelineLimit >= int64(s.prefetchTimelineLimit) {
+		return // the room is already open
+	}
+	likely := false
+	switch update := up.(type) {
+	case *caches.UnreadCountUpdate:
+		likely = !update.HasCountDecreased && update.UserRoomMetadata().HighlightCount > 0
+	case *caches.RoomEventUpdate:
+		for listKey, reqList := range s.muxedReq.Lists {
+			if len(reqList.Sort) == 0 || reqList.Sort[0] != sync3.SortByRecency {
+				continue
+			}
+			list := s.lists.Get(listKey)
+			if list == nil {
+				continue
+			}
+			if index, ok := list.IndexOf(roomID); ok && index < prefetchTopRooms {
+				likely = true
+				break
+			}
+		}
+	}
+	if !likely {
+		return
+	}
+	s.userCache.PrefetchTimelines(context.Background(), s.loadPosition, []string{roomID}, s.prefetchTimelineLimit)
+}
+
 func (s *connStateLive) processUpdatesForSubscriptions(ctx context.Context, builder *RoomsBuilder, up caches.Update) (hasUpdates bool) {
 	rup, ok := up.(caches.RoomUpdate)
 	if !ok {
@@ -84,7 +84,7 @@ func TestConnStateInitial(t *testing.T) {
 		roomA.RoomID: {userID},
 		roomB.RoomID: {userID},
 		roomC.RoomID: {userID},
-	})
+	}, nil)
 	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, err error) {
 		return 1, map[string]*internal.RoomMetadata{
 			roomA.RoomID: &roomA,
@@ -251,7 +251,7 @@ func TestConnStateMultipleRanges(t *testing.T) {
 		})
 		dispatcher.Startup(map[string][]string{
 			roomID: {userID},
-		})
+		}, nil)
 	}
 	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, err error) {
 		res := make(map[string]*internal.RoomMetadata)
@@ -424,7 +424,7 @@ func TestBumpToOutsideRange(t *testing.T) {
 		roomB.RoomID: {userID},
 		roomC.RoomID: {userID},
 		roomD.RoomID: {userID},
-	})
+	}, nil)
 	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, err error) {
 		return 1, map[string]*internal.RoomMetadata{
 			roomA.RoomID: &roomA,
@@ -490,6 +490,78 @@ func TestBumpToOutsideRange(t *testing.T) {
 	}
 }
 
+// Test that rooms which are bumped to the top of a list sorted by recency have their timelines prefetched.
+func TestConnStatePrefetchesTimelines(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStatePrefetchesTimelines_alice:localhost"
+	deviceID := "yep"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	roomA := newRoomMetadata("!a:localhost", timestampNow)
+	roomB := newRoomMetadata("!b:localhost", timestampNow-1000)
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID: roomA,
+		roomB.RoomID: roomB,
+	})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{
+		roomA.RoomID: {userID},
+		roomB.RoomID: {userID},
+	}, nil)
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+			roomA.RoomID: &roomA,
+			roomB.RoomID: &roomB,
+		}, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, 1000)
+	cs.prefetchTimelineLimit = 20
+	req := &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort: []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges([][2]int64{
+				{0, 0},
+			}),
+		}},
+	}
+	_, err := cs.OnIncomingRequest(context.Background(), ConnID, req, false)
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	prefetched := make(chan []string, 1)
+	userCache.LazyRoomDataOverride = func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]caches.UserRoomData {
+		if maxTimelineEvents == cs.prefetchTimelineLimit {
+			prefetched <- roomIDs
+		}
+		return mockLazyRoomOverride(loadPos, roomIDs, maxTimelineEvents)
+	}
+
+	// B gets bumped to the top of the list
+	newEvent := testutils.NewEvent(t, "unimportant", "me", struct{}{}, testutils.WithTimestamp(gomatrixserverlib.Timestamp(roomA.LastMessageTimestamp+1).Time()))
+	dispatcher.OnNewEvent(context.Background(), roomB.RoomID, newEvent, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = cs.OnIncomingRequest(ctx, ConnID, req, false)
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	select {
+	case roomIDs := <-prefetched:
+		if len(roomIDs) != 1 || roomIDs[0] != roomB.RoomID {
+			t.Fatalf("prefetched %v, want %v", roomIDs, roomB.RoomID)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for room timeline to be prefetched")
+	}
+}
+
 // Test that room subscriptions can be made and that events are pushed for them.
 func TestConnStateRoomSubscriptions(t *testing.T) {
 	ConnID := sync3.ConnID{
@@ -516,7 +588,7 @@ func TestConnStateRoomSubscriptions(t *testing.T) {
 		roomB.RoomID: {userID},
 		roomC.RoomID: {userID},
 		roomD.RoomID: {userID},
-	})
+	}, nil)
 	timeline := map[string]json.RawMessage{
 		roomA.RoomID: testutils.NewEvent(t, "m.room.message", userID, map[string]interface{}{"body": "a"}),
 		roomB.RoomID: testutils.NewEvent(t, "m.room.message", userID, map[string]interface{}{"body": "b"}),
@@ -667,6 +739,92 @@ func TestConnStateRoomSubscriptions(t *testing.T) {
 	})
 }
 
+func TestConnStateDefersRoomsAtDeadline(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateDefersRoomsAtDeadline_alice:localhost"
+	deviceID := "yep"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	roomA := newRoomMetadata("!a:localhost", timestampNow)
+	roomB := newRoomMetadata("!b:localhost", gomatrixserverlib.Timestamp(timestampNow-1000))
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID: roomA,
+		roomB.RoomID: roomB,
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+			roomA.RoomID: &roomA,
+			roomB.RoomID: &roomB,
+		}, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]caches.UserRoomData {
+		result := make(map[string]caches.UserRoomData)
+		for _, roomID := range roomIDs {
+			result[roomID] = caches.NewUserRoomData()
+		}
+		return result
+	}
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, 1000)
+	req := &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort: []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges([][2]int64{
+				{0, 1},
+			}),
+		}},
+	}
+	// the deadline is already within the grace period, so no rooms are loaded
+	ctx, cancel := context.WithTimeout(context.Background(), DeadlineGracePeriod/2)
+	defer cancel()
+	res, err := cs.OnIncomingRequest(ctx, ConnID, req, false)
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, false, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 2,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpRange{
+						Operation: "SYNC",
+						Range:     [2]int64{0, 1},
+						RoomIDs:   []string{roomA.RoomID, roomB.RoomID},
+					},
+				},
+			},
+		},
+	})
+	if len(res.Rooms) != 0 {
+		t.Fatalf("got %d rooms, want none as the deadline was near", len(res.Rooms))
+	}
+
+	// the deferred rooms are sent in the next response
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false)
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, false, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 2,
+			},
+		},
+		Rooms: map[string]sync3.Room{
+			roomA.RoomID: {
+				Name:    roomA.NameEvent,
+				Initial: true,
+			},
+			roomB.RoomID: {
+				Name:    roomB.NameEvent,
+				Initial: true,
+			},
+		},
+	})
+}
+
 func checkResponse(t *testing.T, checkRoomIDsOnly bool, got, want *sync3.Response) {
 	t.Helper()
 	if len(got.Lists) != len(want.Lists) {
@@ -770,3 +928,76 @@ func serialise(t *testing.T, thing interface{}) string {
 func intPtr(val int) *int {
 	return &val
 }
+
+// Test that name changes for rooms in a list window are sent in rooms_meta when the client asks for it.
+func TestConnStateRoomsMeta(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateRoomsMeta_alice:localhost"
+	deviceID := "yep"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	roomA := newRoomMetadata("!a:localhost", timestampNow)
+	roomB := newRoomMetadata("!b:localhost", timestampNow-1000)
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID: roomA,
+		roomB.RoomID: roomB,
+	})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{
+		roomA.RoomID: {userID},
+		roomB.RoomID: {userID},
+	}, nil)
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+			roomA.RoomID: &roomA,
+			roomB.RoomID: &roomB,
+		}, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, 1000)
+	roomsMeta := true
+	_, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort: []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges([][2]int64{
+				{0, 1},
+			}),
+		}},
+		RoomsMeta: &roomsMeta,
+	}, false)
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+
+	// A is renamed, but stays at the top of the list
+	nameEvent := testutils.NewStateEvent(t, "m.room.name", "", "me", map[string]interface{}{
+		"name": "New name",
+	}, testutils.WithTimestamp(gomatrixserverlib.Timestamp(roomA.LastMessageTimestamp+1).Time()))
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, nameEvent, 2)
+
+	// rooms_meta is sticky
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	res, err := cs.OnIncomingRequest(ctx, ConnID, &sync3.Request{}, false)
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if len(res.Rooms) != 0 || res.ListOps() != 0 {
+		t.Errorf("got rooms %v and %d ops, want neither", res.Rooms, res.ListOps())
+	}
+	roomMeta, ok := res.RoomsMeta[roomA.RoomID]
+	if !ok {
+		t.Fatalf("room A missing from rooms_meta: %+v", res.RoomsMeta)
+	}
+	if roomMeta.Name == nil || *roomMeta.Name != "New name" {
+		t.Errorf("got name %v want 'New name'", roomMeta.Name)
+	}
+	if roomMeta.Avatar != nil {
+		t.Errorf("got avatar %v but it didn't change", *roomMeta.Avatar)
+	}
+}
@@ -0,0 +1,185 @@
+package handler
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+// UserCost is the resources used to serve a single user's requests within one hour.
+type UserCost struct {
+	UserID      string `json:"user_id"`
+	Requests    int64  `json:"requests"`
+	DBTimeMS    int64  `json:"db_time_ms"`
+	BytesServed int64  `json:"bytes_served"`
+	Events      int64  `json:"events"`
+
+	dbTime time.Duration
+}
+
+// HourlyCosts is the per-user costs for the hour starting at Hour.
+type HourlyCosts struct {
+	Hour  time.Time   `json:"hour"`
+	Users []*UserCost `json:"users"`
+}
+
+// CostTracker aggregates how much each user costs to serve, bucketed by hour, so operators can find out
+// which users are responsible for load on the proxy. Only the most recent `retentionHours` are kept.
+type CostTracker struct {
+	mu             sync.Mutex
+	retentionHours int
+	// unix time of the start of the hour => user ID => cost
+	hours map[int64]map[string]*UserCost
+	now   func() time.Time
+}
+
+func NewCostTracker(retentionHours int) *CostTracker {
+	return &CostTracker{
+		retentionHours: retentionHours,
+		hours:          make(map[int64]map[string]*UserCost),
+		now:            time.Now,
+	}
+}
+
+// Add the cost of serving a single request for this user to the current hour.
+func (t *CostTracker) Add(userID string, dbTime time.Duration, bytesServed, events int) {
+	hour := t.now().Truncate(time.Hour).Unix()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	users, ok := t.hours[hour]
+	if !ok {
+		users = make(map[string]*UserCost)
+		t.hours[hour] = users
+		t.prune(hour)
+	}
+	c, ok := users[userID]
+	if !ok {
+		c = &UserCost{UserID: userID}
+		users[userID] = c
+	}
+	c.Requests++
+	c.dbTime += dbTime
+	c.BytesServed += int64(bytesServed)
+	c.Events += int64(events)
+}
+
+// prune removes hours which are older than the retention period. Must be called with the lock held.
+func (t *CostTracker) prune(currentHour int64) {
+	oldest := currentHour - int64(t.retentionHours-1)*int64(time.Hour/time.Second)
+	for hour := range t.hours {
+		if hour < oldest {
+			delete(t.hours, hour)
+		}
+	}
+}
+
+// Report returns up to `hours` of the most recent hourly costs, newest first. Each hour contains at most
+// `limit` users, sorted by the most DB time. If userID is set, only costs for that user are returned.
+func (t *CostTracker) Report(hours, limit int, userID string) []HourlyCosts {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	starts := make([]int64, 0, len(t.hours))
+	for hour := range t.hours {
+		starts = append(starts, hour)
+	}
+	sort.Slice(starts, func(i, j int) bool {
+		return starts[i] > starts[j]
+	})
+	if len(starts) > hours {
+		starts = starts[:hours]
+	}
+	result := make([]HourlyCosts, 0, len(starts))
+	for _, hour := range starts {
+		users := make([]*UserCost, 0, len(t.hours[hour]))
+		for _, c := range t.hours[hour] {
+			if userID != "" && c.UserID != userID {
+				continue
+			}
+			// copy so callers can't race with Add
+			cost := *c
+			cost.DBTimeMS = c.dbTime.Milliseconds()
+			users = append(users, &cost)
+		}
+		sort.Slice(users, func(i, j int) bool {
+			if users[i].dbTime == users[j].dbTime {
+				return users[i].UserID < users[j].UserID
+			}
+			return users[i].dbTime > users[j].dbTime
+		})
+		if limit > 0 && len(users) > limit {
+			users = users[:limit]
+		}
+		result = append(result, HourlyCosts{
+			Hour:  time.Unix(hour, 0).UTC(),
+			Users: users,
+		})
+	}
+	return result
+}
+
+// GET /_syncv3/admin/costs?hours=24&limit=100&user_id=@alice:localhost
+// Returns the per-user costs for the most recent hours, with the most expensive users first.
+func (h *SyncLiveHandler) adminListCosts(w http.ResponseWriter, req *http.Request) {
+	if h.CostTracker == nil {
+		writeAdminJSON(w, map[string]interface{}{
+			"hours": []HourlyCosts{},
+		})
+		return
+	}
+	hours, herr := parseIntFromQuery(req.URL, "hours")
+	if herr != nil {
+		writeAdminError(w, herr)
+		return
+	}
+	if hours <= 0 {
+		hours = 24
+	}
+	limit, herr := parseIntFromQuery(req.URL, "limit")
+	if herr != nil {
+		writeAdminError(w, herr)
+		return
+	}
+	if limit <= 0 {
+		limit = 100
+	}
+	writeAdminJSON(w, map[string]interface{}{
+		"hours": h.CostTracker.Report(int(hours), int(limit), req.URL.Query().Get("user_id")),
+	})
+}
+
+// countingResponseWriter counts the number of body bytes written to the underlying writer.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	written int
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.written += n
+	return n, err
+}
+
+// Flush is needed as responses may be streamed to the client, which requires an http.Flusher.
+func (w *countingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// numResponseEvents returns the number of timeline and to-device events in this response.
+func numResponseEvents(resp *sync3.Response) int {
+	if resp == nil {
+		return 0
+	}
+	var n int
+	for _, room := range resp.Rooms {
+		n += len(room.Timeline)
+	}
+	if resp.Extensions.ToDevice != nil {
+		n += len(resp.Extensions.ToDevice.Events)
+	}
+	return n
+}
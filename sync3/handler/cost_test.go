@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCostTrackerBucketsByHour(t *testing.T) {
+	now := time.Date(2023, 1, 1, 10, 30, 0, 0, time.UTC)
+	tracker := NewCostTracker(3)
+	tracker.now = func() time.Time { return now }
+
+	tracker.Add("@alice:localhost", 10*time.Millisecond, 100, 1)
+	tracker.Add("@alice:localhost", 20*time.Millisecond, 200, 2)
+	tracker.Add("@bob:localhost", 50*time.Millisecond, 10, 0)
+	now = now.Add(time.Hour)
+	tracker.Add("@alice:localhost", 5*time.Millisecond, 1, 1)
+
+	report := tracker.Report(24, 100, "")
+	if len(report) != 2 {
+		t.Fatalf("got %d hours, want 2", len(report))
+	}
+	// newest first
+	if !report[0].Hour.Equal(time.Date(2023, 1, 1, 11, 0, 0, 0, time.UTC)) {
+		t.Errorf("got hour %v want 11:00", report[0].Hour)
+	}
+	if len(report[0].Users) != 1 || report[0].Users[0].Requests != 1 {
+		t.Errorf("latest hour: got %+v", report[0].Users)
+	}
+	// most DB time first
+	users := report[1].Users
+	if len(users) != 2 {
+		t.Fatalf("got %d users want 2", len(users))
+	}
+	if users[0].UserID != "@bob:localhost" || users[0].DBTimeMS != 50 {
+		t.Errorf("got first user %+v want bob with 50ms", users[0])
+	}
+	alice := users[1]
+	if alice.Requests != 2 || alice.DBTimeMS != 30 || alice.BytesServed != 300 || alice.Events != 3 {
+		t.Errorf("got alice %+v", alice)
+	}
+
+	// limits and user filtering
+	report = tracker.Report(1, 100, "")
+	if len(report) != 1 || !report[0].Hour.Equal(time.Date(2023, 1, 1, 11, 0, 0, 0, time.UTC)) {
+		t.Errorf("Report(hours=1) returned %+v", report)
+	}
+	report = tracker.Report(24, 1, "")
+	if len(report[1].Users) != 1 || report[1].Users[0].UserID != "@bob:localhost" {
+		t.Errorf("Report(limit=1) returned %+v", report[1].Users)
+	}
+	report = tracker.Report(24, 100, "@alice:localhost")
+	if len(report[1].Users) != 1 || report[1].Users[0].UserID != "@alice:localhost" {
+		t.Errorf("Report(user_id=alice) returned %+v", report[1].Users)
+	}
+}
+
+func TestCostTrackerRetention(t *testing.T) {
+	now := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	tracker := NewCostTracker(2)
+	tracker.now = func() time.Time { return now }
+	for i := 0; i < 5; i++ {
+		tracker.Add("@alice:localhost", time.Millisecond, 1, 1)
+		now = now.Add(time.Hour)
+	}
+	report := tracker.Report(24, 100, "")
+	if len(report) != 2 {
+		t.Fatalf("got %d hours, want 2", len(report))
+	}
+	if !report[1].Hour.Equal(time.Date(2023, 1, 1, 13, 0, 0, 0, time.UTC)) {
+		t.Errorf("got oldest hour %v want 13:00", report[1].Hour)
+	}
+}
+
+func TestCountingResponseWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &countingResponseWriter{ResponseWriter: rec}
+	w.Write([]byte("hello"))
+	w.Flush()
+	w.Write([]byte(" world"))
+	if w.written != 11 {
+		t.Errorf("got %d bytes written want 11", w.written)
+	}
+	if !rec.Flushed {
+		t.Errorf("Flush was not passed to the underlying writer")
+	}
+}
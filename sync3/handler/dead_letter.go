@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/tidwall/gjson"
+)
+
+// The number of times to try processing an event before parking it in the dead-letter table.
+const maxDispatchAttempts = 3
+
+// dispatchNewEvent notifies the caches about a new event. If processing the event panics, it is tried again
+// in case the cause was transient. After maxDispatchAttempts failures the event is parked in the
+// dead-letter table and skipped, so one malformed event cannot wedge ingestion for the room.
+//
+// The joined rooms tracker is updated once, before the first attempt, so retries neither lose whether
+// a join was the user's first nor apply membership changes twice. Retries only notify the receivers which
+// have not yet processed the event, starting with the receiver which panicked. The caches are not rolled
+// back, so a receiver which panicked part way through may have applied some of the event already.
+func (h *SyncLiveHandler) dispatchNewEvent(ctx context.Context, roomID string, event json.RawMessage, nid int64) error {
+	eventID := gjson.GetBytes(event, "event_id").Str
+	ne := h.Dispatcher.PrepareNewEvent(roomID, event, nid)
+	var err error
+	for attempt := 1; attempt <= maxDispatchAttempts; attempt++ {
+		if err = h.tryNotifyNewEvent(ctx, ne); err == nil {
+			return nil
+		}
+		logger.Warn().Str("room", roomID).Str("event_id", eventID).Int64("nid", nid).Int("attempt", attempt).Err(err).Msg(
+			"failed to process event",
+		)
+	}
+	logger.Error().Str("room", roomID).Str("event_id", eventID).Int64("nid", nid).Err(err).Msg(
+		"failed to process event, moving it to the dead-letter table",
+	)
+	if dlErr := h.Storage.DeadLetterTable.Insert(nid, roomID, eventID, err.Error(), maxDispatchAttempts); dlErr != nil {
+		logger.Err(dlErr).Str("room", roomID).Str("event_id", eventID).Msg("failed to insert dead letter")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(dlErr)
+	}
+	return err
+}
+
+// tryNotifyNewEvent notifies the caches about a prepared event once, returning an error if they panic.
+func (h *SyncLiveHandler) tryNotifyNewEvent(ctx context.Context, ne *sync3.NewEvent) (err error) {
+	defer func() {
+		panicErr := recover()
+		if panicErr == nil {
+			return
+		}
+		err = fmt.Errorf("panic: %s", panicErr)
+		logger.Error().Msg(string(debug.Stack()))
+		internal.GetSentryHubFromContextOrDefault(ctx).RecoverWithContext(ctx, panicErr)
+	}()
+	h.Dispatcher.NotifyNewEvent(ctx, ne)
+	return nil
+}
+
+// GET /_syncv3/admin/dead_letters
+func (h *SyncLiveHandler) adminListDeadLetters(w http.ResponseWriter, req *http.Request) {
+	dls, err := h.Storage.DeadLetterTable.SelectAll()
+	if err != nil {
+		writeAdminError(w, &internal.HandlerError{StatusCode: 500, Err: err})
+		return
+	}
+	writeAdminJSON(w, map[string]interface{}{
+		"dead_letters": dls,
+	})
+}
+
+// POST /_syncv3/admin/dead_letters/{nid}/retry
+// Processes the event again, removing it from the dead-letter table if it succeeds.
+func (h *SyncLiveHandler) adminRetryDeadLetter(w http.ResponseWriter, req *http.Request) {
+	nid, herr := parseDeadLetterNID(req)
+	if herr != nil {
+		writeAdminError(w, herr)
+		return
+	}
+	dl, err := h.Storage.DeadLetterTable.Select(nid)
+	if err != nil {
+		writeAdminError(w, &internal.HandlerError{StatusCode: 500, Err: err})
+		return
+	}
+	if dl == nil {
+		writeAdminError(w, &internal.HandlerError{StatusCode: 404, Err: fmt.Errorf("no dead letter for event nid %d", nid)})
+		return
+	}
+	events, err := h.Storage.EventNIDs([]int64{nid})
+	if err != nil || len(events) != 1 {
+		writeAdminError(w, &internal.HandlerError{StatusCode: 500, Err: fmt.Errorf("failed to load event nid %d: %w", nid, err)})
+		return
+	}
+	if err = h.dispatchNewEvent(req.Context(), dl.RoomID, events[0], nid); err != nil {
+		writeAdminError(w, &internal.HandlerError{StatusCode: 500, Err: err})
+		return
+	}
+	if _, err = h.Storage.DeadLetterTable.Delete(nid); err != nil {
+		writeAdminError(w, &internal.HandlerError{StatusCode: 500, Err: err})
+		return
+	}
+	writeAdminJSON(w, struct{}{})
+}
+
+// DELETE /_syncv3/admin/dead_letters/{nid}
+// Discards the dead letter. The event will not be processed by the caches.
+func (h *SyncLiveHandler) adminDiscardDeadLetter(w http.ResponseWriter, req *http.Request) {
+	nid, herr := parseDeadLetterNID(req)
+	if herr != nil {
+		writeAdminError(w, herr)
+		return
+	}
+	deleted, err := h.Storage.DeadLetterTable.Delete(nid)
+	if err != nil {
+		writeAdminError(w, &internal.HandlerError{StatusCode: 500, Err: err})
+		return
+	}
+	if !deleted {
+		writeAdminError(w, &internal.HandlerError{StatusCode: 404, Err: fmt.Errorf("no dead letter for event nid %d", nid)})
+		return
+	}
+	writeAdminJSON(w, struct{}{})
+}
+
+func parseDeadLetterNID(req *http.Request) (int64, *internal.HandlerError) {
+	nidStr := mux.Vars(req)["nid"]
+	nid, err := strconv.ParseInt(nidStr, 10, 64)
+	if err != nil {
+		return 0, &internal.HandlerError{StatusCode: 400, Err: fmt.Errorf("invalid event nid: %s", nidStr)}
+	}
+	return nid, nil
+}
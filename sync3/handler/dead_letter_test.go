@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+// flakyReceiver panics on the first `panics` events it is sent.
+type flakyReceiver struct {
+	panics int
+	calls  int
+	events []*caches.EventData
+}
+
+func (r *flakyReceiver) OnNewEvent(ctx context.Context, event *caches.EventData) {
+	r.calls++
+	if r.calls <= r.panics {
+		panic("flaky receiver")
+	}
+	r.events = append(r.events, event)
+}
+func (r *flakyReceiver) OnReceipt(ctx context.Context, receipt internal.Receipt) {}
+func (r *flakyReceiver) OnEphemeralEvent(ctx context.Context, roomID string, ephEvent json.RawMessage) {
+}
+func (r *flakyReceiver) OnRegistered(ctx context.Context, latestPos int64) error { return nil }
+
+func TestDispatchNewEventRetries(t *testing.T) {
+	ctx := context.Background()
+	receiver := &flakyReceiver{panics: maxDispatchAttempts - 1}
+	dispatcher := sync3.NewDispatcher()
+	if err := dispatcher.Register(ctx, sync3.DispatcherAllUsers, receiver); err != nil {
+		t.Fatalf("Register: %s", err)
+	}
+	h := &SyncLiveHandler{Dispatcher: dispatcher}
+	event := json.RawMessage(`{"event_id":"$a","type":"m.room.message","sender":"@alice:localhost","content":{"body":"hi"}}`)
+	if err := h.dispatchNewEvent(ctx, "!a:localhost", event, 1); err != nil {
+		t.Fatalf("dispatchNewEvent returned an error for an event which succeeded on the last attempt: %s", err)
+	}
+	if receiver.calls != maxDispatchAttempts {
+		t.Fatalf("receiver was called %d times, want %d", receiver.calls, maxDispatchAttempts)
+	}
+}
+
+func TestDispatchNewEventRetriesOnlyFailedReceivers(t *testing.T) {
+	ctx := context.Background()
+	roomID := "!a:localhost"
+	global := &flakyReceiver{}
+	alice := &flakyReceiver{}
+	bob := &flakyReceiver{panics: 1}
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{roomID: {"@alice:localhost"}}, nil)
+	for userID, r := range map[string]sync3.Receiver{
+		sync3.DispatcherAllUsers: global,
+		"@alice:localhost":       alice,
+		"@bob:localhost":         bob,
+	} {
+		if err := dispatcher.Register(ctx, userID, r); err != nil {
+			t.Fatalf("Register: %s", err)
+		}
+	}
+	h := &SyncLiveHandler{Dispatcher: dispatcher}
+	event := json.RawMessage(`{"event_id":"$a","type":"m.room.member","state_key":"@bob:localhost","sender":"@bob:localhost","content":{"membership":"join"}}`)
+	if err := h.dispatchNewEvent(ctx, roomID, event, 1); err != nil {
+		t.Fatalf("dispatchNewEvent returned an error for an event which succeeded on the second attempt: %s", err)
+	}
+	if global.calls != 1 {
+		t.Errorf("global receiver was called %d times, want 1", global.calls)
+	}
+	if alice.calls != 1 {
+		t.Errorf("alice was called %d times, want 1", alice.calls)
+	}
+	if bob.calls != 2 {
+		t.Fatalf("bob was called %d times, want 2", bob.calls)
+	}
+	if !bob.events[0].ForceInitial {
+		t.Errorf("bob's join was not marked ForceInitial on the retry")
+	}
+	if !dispatcher.IsUserJoined("@bob:localhost", roomID) {
+		t.Errorf("bob is not joined to the room")
+	}
+}
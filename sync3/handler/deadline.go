@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// The amount of time before a request deadline where we stop doing optional work and return what
+// we have computed so far. Any remaining live updates stay buffered on the connection, and rooms which
+// haven't been loaded yet are remembered, so both are sent on the next request.
+var DeadlineGracePeriod = 100 * time.Millisecond
+
+// WithRequestDeadlines wraps the sync handler and attaches a deadline to the request context. Initial
+// syncs (no `pos`, or no `since` for v2 compatible requests) and incremental syncs have separate deadlines
+// as initial syncs are expected to take much longer. A zero duration means no deadline is applied for that kind of request.
+//
+// The deadline bounds the total time spent serving the request, including long-polling. When the deadline
+// is near, the handler returns a partial-but-valid response rather than continuing to load rooms or
+// process updates.
+func WithRequestDeadlines(next http.Handler, initial, incremental time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		deadline := incremental
+		query := req.URL.Query()
+		if query.Get("pos") == "" && query.Get("since") == "" {
+			deadline = initial
+		}
+		if deadline <= 0 {
+			next.ServeHTTP(w, req)
+			return
+		}
+		ctx, cancel := context.WithTimeout(req.Context(), deadline)
+		defer cancel()
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// clampTimeoutToDeadline returns the long-poll timeout to use for this request, such that we will return
+// before the context deadline (minus the grace period) is reached. Returns the timeout unchanged if the
+// context has no deadline.
+func clampTimeoutToDeadline(ctx context.Context, timeoutMSecs int) int {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return timeoutMSecs
+	}
+	remaining := time.Until(deadline) - DeadlineGracePeriod
+	if remaining < 0 {
+		remaining = 0
+	}
+	if remainingMSecs := int(remaining.Milliseconds()); remainingMSecs < timeoutMSecs {
+		return remainingMSecs
+	}
+	return timeoutMSecs
+}
+
+// deadlineNear returns true if the context has a deadline which is within the grace period.
+func deadlineNear(ctx context.Context) bool {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return false
+	}
+	return time.Until(deadline) < DeadlineGracePeriod
+}
@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWithRequestDeadlines(t *testing.T) {
+	testCases := []struct {
+		name        string
+		url         string
+		initial     time.Duration
+		incremental time.Duration
+		wantDL      time.Duration // 0 = no deadline
+	}{
+		{name: "initial", url: "/sync", initial: time.Minute, incremental: time.Second, wantDL: time.Minute},
+		{name: "incremental", url: "/sync?pos=5", initial: time.Minute, incremental: time.Second, wantDL: time.Second},
+		{name: "initial no deadline", url: "/sync", incremental: time.Second},
+		{name: "incremental no deadline", url: "/sync?pos=5", initial: time.Minute},
+		{name: "v2 initial", url: "/sync?timeout=0", initial: time.Minute, incremental: time.Second, wantDL: time.Minute},
+		{name: "v2 incremental", url: "/sync?since=5", initial: time.Minute, incremental: time.Second, wantDL: time.Second},
+	}
+	for _, tc := range testCases {
+		var gotDeadline time.Time
+		var hasDeadline bool
+		h := WithRequestDeadlines(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			gotDeadline, hasDeadline = req.Context().Deadline()
+		}), tc.initial, tc.incremental)
+		start := time.Now()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", tc.url, nil))
+		if tc.wantDL == 0 {
+			if hasDeadline {
+				t.Errorf("%s: got deadline %v, want none", tc.name, gotDeadline)
+			}
+			continue
+		}
+		if !hasDeadline {
+			t.Errorf("%s: missing deadline", tc.name)
+			continue
+		}
+		got := gotDeadline.Sub(start)
+		// the deadline is set after start, so can only be later
+		if got < tc.wantDL || got > tc.wantDL+time.Second {
+			t.Errorf("%s: got deadline in %v want %v", tc.name, got, tc.wantDL)
+		}
+	}
+}
+
+func TestClampTimeoutToDeadline(t *testing.T) {
+	// no deadline, unchanged
+	if got := clampTimeoutToDeadline(context.Background(), 10000); got != 10000 {
+		t.Errorf("clampTimeoutToDeadline without deadline: got %v want 10000", got)
+	}
+	// deadline further away than the timeout, unchanged
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if got := clampTimeoutToDeadline(ctx, 10000); got != 10000 {
+		t.Errorf("clampTimeoutToDeadline with far deadline: got %v want 10000", got)
+	}
+	if deadlineNear(ctx) {
+		t.Errorf("deadlineNear returned true for a far deadline")
+	}
+	// deadline sooner than the timeout, clamped to the deadline minus the grace period
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	got := clampTimeoutToDeadline(ctx, 10000)
+	want := int((2*time.Second - DeadlineGracePeriod).Milliseconds())
+	if got > want || got < want-500 {
+		t.Errorf("clampTimeoutToDeadline with near deadline: got %v want ~%v", got, want)
+	}
+	// deadline already passed, clamped to 0
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	time.Sleep(5 * time.Millisecond)
+	if got := clampTimeoutToDeadline(ctx, 10000); got != 0 {
+		t.Errorf("clampTimeoutToDeadline with expired deadline: got %v want 0", got)
+	}
+	if !deadlineNear(ctx) {
+		t.Errorf("deadlineNear returned false for an expired deadline")
+	}
+}
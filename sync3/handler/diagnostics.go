@@ -0,0 +1,243 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+// DiagnosticsPath is where clients can GET a bundle of diagnostics about their connection to attach to bug
+// reports. The bundle contains the connection's sticky request, the state of the device's poller and a summary
+// of recent responses. It never contains event content.
+const DiagnosticsPath = "/_matrix/client/unstable/org.matrix.msc3575/sync/diagnostics"
+
+// The number of recent responses to keep a summary of for each connection.
+const diagnosticsResponseSummaries = 20
+
+// Replaces free text which the user typed in sticky requests, e.g room name searches.
+const diagnosticsRedacted = "<redacted>"
+
+// responseSummary describes a response without any of its content.
+type responseSummary struct {
+	Time       time.Time      `json:"time"`
+	Pos        int64          `json:"pos"`
+	NextPos    string         `json:"next_pos,omitempty"`
+	StatusCode int            `json:"status_code"`
+	Bytes      int            `json:"bytes"`
+	DurationMs int64          `json:"duration_ms"`
+	NumRooms   int            `json:"num_rooms"`
+	NumEvents  int            `json:"num_events"`
+	Ops        map[string]int `json:"ops,omitempty"`
+	ListCounts map[string]int `json:"list_counts,omitempty"`
+}
+
+func summariseResponse(start time.Time, pos int64, resp *sync3.Response, written int, err error) responseSummary {
+	summary := responseSummary{
+		Time:       start,
+		Pos:        pos,
+		StatusCode: http.StatusOK,
+		Bytes:      written,
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		summary.StatusCode = internal.ToHandlerError(err).StatusCode
+	}
+	if resp == nil {
+		return summary
+	}
+	summary.NextPos = resp.Pos
+	summary.NumRooms = len(resp.Rooms)
+	summary.NumEvents = numResponseEvents(resp)
+	for listKey, list := range resp.Lists {
+		if summary.ListCounts == nil {
+			summary.ListCounts = make(map[string]int, len(resp.Lists))
+		}
+		summary.ListCounts[listKey] = list.Count
+		for _, op := range list.Ops {
+			if summary.Ops == nil {
+				summary.Ops = make(map[string]int)
+			}
+			summary.Ops[op.Op()]++
+		}
+	}
+	return summary
+}
+
+// connDiagnostics records what a connection did recently. It is written to by requests on the connection
+// and read by the diagnostics endpoint, so it has its own lock rather than relying on the connection's.
+type connDiagnostics struct {
+	mu            sync.Mutex
+	stickyRequest json.RawMessage
+	responses     []responseSummary // oldest first
+}
+
+// setStickyRequest remembers the connection's combined sticky request, with free text redacted.
+func (d *connDiagnostics) setStickyRequest(req *sync3.Request) {
+	redacted := *req
+	redacted.TxnID = ""
+	redacted.Lists = make(map[string]sync3.RequestList, len(req.Lists))
+	for listKey, list := range req.Lists {
+		if list.Filters != nil && list.Filters.RoomNameFilter != "" {
+			filters := *list.Filters
+			filters.RoomNameFilter = diagnosticsRedacted
+			list.Filters = &filters
+		}
+		redacted.Lists[listKey] = list
+	}
+	// marshal now, as the request is only safe to read on the connection's goroutine
+	js, err := json.Marshal(redacted)
+	if err != nil {
+		logger.Err(err).Msg("failed to marshal sticky request for diagnostics")
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stickyRequest = js
+}
+
+func (d *connDiagnostics) addResponse(summary responseSummary) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.responses = append(d.responses, summary)
+	if len(d.responses) > diagnosticsResponseSummaries {
+		d.responses = d.responses[len(d.responses)-diagnosticsResponseSummaries:]
+	}
+}
+
+func (d *connDiagnostics) snapshot() (json.RawMessage, []responseSummary) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	responses := make([]responseSummary, len(d.responses))
+	copy(responses, d.responses)
+	return d.stickyRequest, responses
+}
+
+// connDiagnosticsMap holds the diagnostics of each connection, keyed on device ID.
+type connDiagnosticsMap struct {
+	mu    sync.Mutex
+	conns map[string]*connDiagnostics
+}
+
+func newConnDiagnosticsMap() *connDiagnosticsMap {
+	return &connDiagnosticsMap{
+		conns: make(map[string]*connDiagnostics),
+	}
+}
+
+// add starts recording diagnostics for a new connection, replacing those of any previous connection.
+func (m *connDiagnosticsMap) add(deviceID string) *connDiagnostics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d := &connDiagnostics{}
+	m.conns[deviceID] = d
+	return d
+}
+
+// remove forgets the diagnostics of a connection, unless a newer connection has replaced them already.
+func (m *connDiagnosticsMap) remove(deviceID string, d *connDiagnostics) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conns[deviceID] == d {
+		delete(m.conns, deviceID)
+	}
+}
+
+func (m *connDiagnosticsMap) get(deviceID string) *connDiagnostics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.conns[deviceID]
+}
+
+// diagnosticsBundle is the response body of the diagnostics endpoint.
+type diagnosticsBundle struct {
+	UserID          string            `json:"user_id"`
+	DeviceID        string            `json:"device_id"`
+	InstanceID      string            `json:"instance_id"`
+	Time            time.Time         `json:"time"`
+	Poller          pollerDiagnostics `json:"poller"`
+	HasConnection   bool              `json:"has_connection"`
+	StickyRequest   json.RawMessage   `json:"sticky_request,omitempty"`
+	RecentResponses []responseSummary `json:"recent_responses"`
+}
+
+type pollerDiagnostics struct {
+	// false if the poller hasn't finished its initial sync since this server started, or its token expired
+	InitialSyncComplete bool `json:"initial_sync_complete"`
+	// false if the device has never been polled, or was archived due to inactivity
+	HasSinceToken bool `json:"has_since_token"`
+}
+
+func (h *SyncLiveHandler) serveDiagnostics(w http.ResponseWriter, req *http.Request) error {
+	if !h.DiagnosticsEnabled {
+		return &internal.HandlerError{
+			StatusCode: 404,
+			Err:        fmt.Errorf("diagnostics are disabled"),
+			ErrCode:    "M_UNRECOGNIZED",
+		}
+	}
+	if req.Method != "GET" {
+		return &internal.HandlerError{
+			StatusCode: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("diagnostics must be a GET"),
+			ErrCode:    "M_UNRECOGNIZED",
+		}
+	}
+	deviceID, accessToken, err := internal.HashedTokenFromRequest(req)
+	if err != nil || accessToken == "" {
+		return &internal.HandlerError{
+			StatusCode: 400,
+			Err:        fmt.Errorf("failed to get device ID from request: %v", err),
+		}
+	}
+	// The device ID is derived from the access token, so only the owner of the token can see the diagnostics
+	// of its device. Tokens which have never been used to sync are rejected rather than checked with the
+	// homeserver, as there is nothing to diagnose.
+	device, err := h.V2Store.Device(deviceID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && device.UserID == "") {
+		return &internal.HandlerError{
+			StatusCode: 401,
+			Err:        fmt.Errorf("unknown access token"),
+			ErrCode:    "M_UNKNOWN_TOKEN",
+		}
+	}
+	if err != nil {
+		return &internal.HandlerError{
+			StatusCode: 500,
+			Err:        err,
+		}
+	}
+	now := time.Now()
+	bundle := diagnosticsBundle{
+		UserID:     device.UserID,
+		DeviceID:   device.DeviceID,
+		InstanceID: h.instanceID,
+		Time:       now,
+		Poller: pollerDiagnostics{
+			InitialSyncComplete: h.V3Pub.InitialSyncComplete(device.UserID, device.DeviceID),
+			HasSinceToken:       device.Since != "",
+		},
+	}
+	if d := h.connDiagnostics.get(deviceID); d != nil {
+		bundle.HasConnection = true
+		bundle.StickyRequest, bundle.RecentResponses = d.snapshot()
+	}
+	js, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return &internal.HandlerError{
+			StatusCode: 500,
+			Err:        err,
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="sliding-sync-diagnostics-%d.json"`, now.Unix()))
+	w.WriteHeader(200)
+	w.Write(js)
+	return nil
+}
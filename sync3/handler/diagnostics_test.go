@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/tidwall/gjson"
+)
+
+func TestSummariseResponse(t *testing.T) {
+	index := 0
+	resp := &sync3.Response{
+		Pos: "5",
+		Rooms: map[string]sync3.Room{
+			"!a": {Timeline: []json.RawMessage{[]byte(`{"content":{"body":"secret"}}`)}},
+			"!b": {},
+		},
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 10,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpRange{Operation: sync3.OpSync, Range: [2]int64{0, 1}, RoomIDs: []string{"!a", "!b"}},
+					&sync3.ResponseOpSingle{Operation: sync3.OpDelete, Index: &index},
+					&sync3.ResponseOpSingle{Operation: sync3.OpInsert, Index: &index, RoomID: "!a"},
+				},
+			},
+			"b": {Count: 3},
+		},
+	}
+	start := time.Now()
+	got := summariseResponse(start, 4, resp, 1234, nil)
+	if got.Pos != 4 || got.NextPos != "5" || got.StatusCode != 200 || got.Bytes != 1234 {
+		t.Errorf("got %+v", got)
+	}
+	if got.NumRooms != 2 || got.NumEvents != 1 {
+		t.Errorf("got %d rooms %d events, want 2 rooms 1 event", got.NumRooms, got.NumEvents)
+	}
+	if got.ListCounts["a"] != 10 || got.ListCounts["b"] != 3 {
+		t.Errorf("got list counts %v", got.ListCounts)
+	}
+	if len(got.Ops) != 3 || got.Ops[sync3.OpSync] != 1 || got.Ops[sync3.OpDelete] != 1 || got.Ops[sync3.OpInsert] != 1 {
+		t.Errorf("got ops %v", got.Ops)
+	}
+
+	got = summariseResponse(start, 4, nil, 0, &internal.HandlerError{StatusCode: 400, Err: fmt.Errorf("bad")})
+	if got.StatusCode != 400 || got.NextPos != "" {
+		t.Errorf("error: got %+v", got)
+	}
+}
+
+func TestConnDiagnosticsStickyRequestRedacted(t *testing.T) {
+	d := &connDiagnostics{}
+	filters := &sync3.RequestFilters{RoomNameFilter: "my secret room"}
+	req := &sync3.Request{
+		TxnID: "txn",
+		Lists: map[string]sync3.RequestList{
+			"a": {Sort: []string{sync3.SortByRecency}, Filters: filters},
+		},
+	}
+	d.setStickyRequest(req)
+	sticky, _ := d.snapshot()
+	if strings.Contains(string(sticky), "my secret room") {
+		t.Errorf("sticky request was not redacted: %s", sticky)
+	}
+	if got := gjson.GetBytes(sticky, "lists.a.filters.room_name_like").Str; got != diagnosticsRedacted {
+		t.Errorf("room_name_like: got %q want %q", got, diagnosticsRedacted)
+	}
+	if got := gjson.GetBytes(sticky, "lists.a.sort.0").Str; got != sync3.SortByRecency {
+		t.Errorf("sort: got %q want %q", got, sync3.SortByRecency)
+	}
+	if gjson.GetBytes(sticky, "txn_id").Str != "" {
+		t.Errorf("txn_id was not removed: %s", sticky)
+	}
+	// the connection's request must not be modified
+	if req.Lists["a"].Filters.RoomNameFilter != "my secret room" || req.TxnID != "txn" {
+		t.Errorf("setStickyRequest modified the request: %+v", req)
+	}
+}
+
+func TestConnDiagnosticsRecentResponses(t *testing.T) {
+	d := &connDiagnostics{}
+	for i := 0; i < diagnosticsResponseSummaries+5; i++ {
+		d.addResponse(responseSummary{Pos: int64(i)})
+	}
+	_, responses := d.snapshot()
+	if len(responses) != diagnosticsResponseSummaries {
+		t.Fatalf("got %d responses want %d", len(responses), diagnosticsResponseSummaries)
+	}
+	if responses[0].Pos != 5 || responses[len(responses)-1].Pos != diagnosticsResponseSummaries+4 {
+		t.Errorf("got positions %d to %d, want the most recent", responses[0].Pos, responses[len(responses)-1].Pos)
+	}
+}
+
+func TestConnDiagnosticsMap(t *testing.T) {
+	m := newConnDiagnosticsMap()
+	first := m.add("DEVICE")
+	second := m.add("DEVICE")
+	// the first connection being destroyed must not remove the diagnostics of the one which replaced it
+	m.remove("DEVICE", first)
+	if m.get("DEVICE") != second {
+		t.Fatalf("replacing connection's diagnostics were removed")
+	}
+	m.remove("DEVICE", second)
+	if m.get("DEVICE") != nil {
+		t.Fatalf("diagnostics were not removed")
+	}
+}
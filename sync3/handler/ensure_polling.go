@@ -1,8 +1,11 @@
 package handler
 
 import (
+	"fmt"
+	"strings"
 	"sync"
 
+	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/pubsub"
 )
 
@@ -28,14 +31,15 @@ func NewEnsurePoller(notifier pubsub.Notifier) *EnsurePoller {
 }
 
 // EnsurePolling blocks until the V2InitialSyncComplete response is received for this device. It is
-// the caller's responsibility to call OnInitialSyncComplete when new events arrive.
-func (p *EnsurePoller) EnsurePolling(userID, deviceID string) {
+// the caller's responsibility to call OnInitialSyncComplete when new events arrive. Returns an error
+// wrapping internal.ErrPollerDead if the device's token expired before the initial sync completed.
+func (p *EnsurePoller) EnsurePolling(userID, deviceID string) error {
 	key := userID + "|" + deviceID
 	p.mu.Lock()
 	// do we need to wait?
 	if p.pendingPolls[key].done {
 		p.mu.Unlock()
-		return
+		return nil
 	}
 	// have we called EnsurePolling for this user/device before?
 	ch := p.pendingPolls[key].ch
@@ -46,7 +50,7 @@ func (p *EnsurePoller) EnsurePolling(userID, deviceID string) {
 		// we should time out here after 100s and return an error or something to kick conns into
 		// trying again
 		<-ch
-		return
+		return p.waitResult(key, deviceID)
 	}
 	// Make a channel to wait until we have done an initial sync
 	ch = make(chan struct{})
@@ -63,6 +67,34 @@ func (p *EnsurePoller) EnsurePolling(userID, deviceID string) {
 	// if by some miracle the notify AND sync completes before we receive on ch then this is
 	// still fine as recv on a closed channel will return immediately.
 	<-ch
+	return p.waitResult(key, deviceID)
+}
+
+// waitResult returns whether the initial sync which was being waited on completed. If the token expired
+// instead, OnExpiredToken removed the pending poll.
+func (p *EnsurePoller) waitResult(key, deviceID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.pendingPolls[key].done {
+		return fmt.Errorf("device %s: %w", deviceID, internal.ErrPollerDead)
+	}
+	return nil
+}
+
+// OnExpiredToken wakes up anyone waiting for the initial sync of this device, as it will never complete.
+// The next EnsurePolling call for the device asks the pollers to poll again.
+func (p *EnsurePoller) OnExpiredToken(deviceID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, pending := range p.pendingPolls {
+		if !strings.HasSuffix(key, "|"+deviceID) {
+			continue
+		}
+		delete(p.pendingPolls, key)
+		if pending.ch != nil {
+			close(pending.ch)
+		}
+	}
 }
 
 func (p *EnsurePoller) OnInitialSyncComplete(payload *pubsub.V2InitialSyncComplete) {
@@ -92,6 +124,20 @@ func (p *EnsurePoller) OnInitialSyncComplete(payload *pubsub.V2InitialSyncComple
 	close(ch)
 }
 
+// InitialSyncComplete returns true if the poller for this device has completed its initial sync.
+func (p *EnsurePoller) InitialSyncComplete(userID, deviceID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pendingPolls[userID+"|"+deviceID].done
+}
+
+// Nudge asks the poller for this device to poll again straight away.
+func (p *EnsurePoller) Nudge(deviceID string) {
+	p.notifier.Notify(p.chanName, &pubsub.V3Nudge{
+		DeviceID: deviceID,
+	})
+}
+
 func (p *EnsurePoller) Teardown() {
 	p.notifier.Close()
 }
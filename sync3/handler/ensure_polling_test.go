@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/pubsub"
+)
+
+type chanNotifier struct {
+	ch chan pubsub.Payload
+}
+
+func (n *chanNotifier) Notify(chanName string, p pubsub.Payload) error {
+	n.ch <- p
+	return nil
+}
+
+func (n *chanNotifier) Close() error { return nil }
+
+func TestEnsurePollerExpiredToken(t *testing.T) {
+	notifier := &chanNotifier{ch: make(chan pubsub.Payload, 10)}
+	p := NewEnsurePoller(notifier)
+	ensurePolling := func() chan error {
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- p.EnsurePolling("@alice:localhost", "DEVICE")
+		}()
+		select {
+		case <-notifier.ch:
+		case <-time.After(time.Second):
+			t.Fatalf("EnsurePolling did not ask the pollers to poll")
+		}
+		return errCh
+	}
+	waitForResult := func(errCh chan error) error {
+		select {
+		case err := <-errCh:
+			return err
+		case <-time.After(time.Second):
+			t.Fatalf("EnsurePolling did not return")
+		}
+		return nil
+	}
+
+	// the token expires whilst waiting for the initial sync
+	errCh := ensurePolling()
+	p.OnExpiredToken("DEVICE")
+	if err := waitForResult(errCh); !errors.Is(err, internal.ErrPollerDead) {
+		t.Errorf("EnsurePolling: got %v want ErrPollerDead", err)
+	}
+
+	// the next request asks the pollers again, and succeeds when the initial sync completes
+	errCh = ensurePolling()
+	p.OnInitialSyncComplete(&pubsub.V2InitialSyncComplete{UserID: "@alice:localhost", DeviceID: "DEVICE"})
+	if err := waitForResult(errCh); err != nil {
+		t.Errorf("EnsurePolling: got %v want nil", err)
+	}
+}
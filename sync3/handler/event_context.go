@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"context"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+const (
+	defaultEventContextLimit = 10
+	maxEventContextLimit     = 100
+)
+
+// Implements EventContextFetcher
+// EventContext returns the events around an event. The proxy only has the events which pollers have
+// seen, so if it does not know about the event it asks the homeserver via /context. Returns nil if
+// the event context could not be loaded.
+func (h *SyncLiveHandler) EventContext(ctx context.Context, userID, deviceID, roomID string, loadPos int64, req sync3.EventContextRequest) *sync3.EventContext {
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = defaultEventContextLimit
+	} else if limit > maxEventContextLimit {
+		limit = maxEventContextLimit
+	}
+	log := logger.With().Str("user", userID).Str("room", roomID).Str("event_id", req.EventID).Logger()
+	before, event, after, err := h.Storage.EventContext(userID, roomID, req.EventID, loadPos, limit)
+	if err != nil {
+		log.Err(err).Msg("failed to load event context from the database")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+	} else if event != nil {
+		return &sync3.EventContext{
+			Event:        event,
+			EventsBefore: before,
+			EventsAfter:  after,
+		}
+	}
+
+	// we don't have this event, ask the homeserver
+	device, err := h.V2Store.Device(deviceID)
+	if err != nil {
+		log.Err(err).Msg("failed to load device for event context")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return nil
+	}
+	// the homeserver splits the limit between events before and after
+	res, err := h.V2.EventContext(ctx, device.AccessToken, roomID, req.EventID, 2*limit)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to load event context from the homeserver")
+		return nil
+	}
+	return &sync3.EventContext{
+		Event:        res.Event,
+		EventsBefore: res.EventsBefore,
+		EventsAfter:  res.EventsAfter,
+	}
+}
@@ -0,0 +1,301 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+// Set to rewrite the files in testdata/golden with the responses the server currently sends, e.g
+//
+//	SYNCV3_UPDATE_GOLDEN=1 go test ./sync3/handler -run TestGoldenResponses
+//
+// then review the diff to check that the change in the protocol is intended.
+const envUpdateGolden = "SYNCV3_UPDATE_GOLDEN"
+
+const goldenUserID = "@golden:localhost"
+
+// goldenRig is a ConnState backed by in-memory caches, with the rooms !a, !b and !c (most recent first).
+type goldenRig struct {
+	t          *testing.T
+	cs         *ConnState
+	dispatcher *sync3.Dispatcher
+	userCache  *caches.UserCache
+	pos        int64
+}
+
+// goldenStep is a request made on the connection, after `before` has injected any live data.
+type goldenStep struct {
+	before  func(rig *goldenRig)
+	request func() sync3.Request
+}
+
+type goldenScenario struct {
+	name  string
+	steps []goldenStep
+}
+
+// Record the full responses for canonical scenarios and compare them to testdata/golden, so that any
+// change to what is sent to clients shows up as a diff in review.
+func TestGoldenResponses(t *testing.T) {
+	scenarios := []goldenScenario{
+		{
+			name: "initial_sync",
+			steps: []goldenStep{
+				{request: goldenListRequest([2]int64{0, 1})},
+			},
+		},
+		{
+			name: "scroll",
+			steps: []goldenStep{
+				{request: goldenListRequest([2]int64{0, 1})},
+				{request: goldenListRequest([2]int64{1, 2})},
+			},
+		},
+		{
+			name: "new_message",
+			steps: []goldenStep{
+				{request: goldenListRequest([2]int64{0, 1})},
+				{
+					before: func(rig *goldenRig) {
+						rig.event("!b:localhost", goldenEvent(rig.t, map[string]interface{}{
+							"type":             "m.room.message",
+							"event_id":         "$b2",
+							"sender":           goldenUserID,
+							"origin_server_ts": 4000,
+							"content":          map[string]interface{}{"body": "New message in B"},
+						}))
+					},
+					request: goldenListRequest([2]int64{0, 1}),
+				},
+			},
+		},
+		{
+			name: "invite",
+			steps: []goldenStep{
+				{request: goldenListRequest([2]int64{0, 1})},
+				{
+					before: func(rig *goldenRig) {
+						rig.userCache.OnInvite(context.Background(), "!d:localhost", []json.RawMessage{
+							goldenEvent(rig.t, map[string]interface{}{
+								"type":      "m.room.name",
+								"state_key": "",
+								"sender":    "@inviter:localhost",
+								"content":   map[string]interface{}{"name": "Room D"},
+							}),
+							goldenEvent(rig.t, map[string]interface{}{
+								"type":             "m.room.member",
+								"state_key":        goldenUserID,
+								"event_id":         "$invite",
+								"sender":           "@inviter:localhost",
+								"origin_server_ts": 5000,
+								"content":          map[string]interface{}{"membership": "invite"},
+							}),
+						})
+					},
+					request: goldenListRequest([2]int64{0, 1}),
+				},
+			},
+		},
+		{
+			name: "leave",
+			steps: []goldenStep{
+				{request: goldenListRequest([2]int64{0, 2})},
+				{
+					before: func(rig *goldenRig) {
+						rig.event("!a:localhost", goldenEvent(rig.t, map[string]interface{}{
+							"type":             "m.room.member",
+							"state_key":        goldenUserID,
+							"event_id":         "$leave",
+							"sender":           goldenUserID,
+							"origin_server_ts": 4000,
+							"content":          map[string]interface{}{"membership": "leave"},
+						}))
+						rig.userCache.OnLeftRoom(context.Background(), "!a:localhost")
+					},
+					request: goldenListRequest([2]int64{0, 2}),
+				},
+			},
+		},
+	}
+	update := os.Getenv(envUpdateGolden) != ""
+	for _, scenario := range scenarios {
+		scenario := scenario
+		t.Run(scenario.name, func(t *testing.T) {
+			got := runGoldenScenario(t, scenario)
+			file := filepath.Join("testdata", "golden", scenario.name+".json")
+			if update {
+				if err := os.WriteFile(file, []byte(got), 0644); err != nil {
+					t.Fatalf("failed to write %s: %s", file, err)
+				}
+				return
+			}
+			data, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatalf("failed to read %s, set %s=1 to create it: %s", file, envUpdateGolden, err)
+			}
+			want := canonicalGoldenJSON(t, data)
+			if got != want {
+				t.Errorf("responses differ from %s, set %s=1 to update it if this is intended:\n%s", file, envUpdateGolden, diffGolden(want, got))
+			}
+		})
+	}
+}
+
+func runGoldenScenario(t *testing.T, scenario goldenScenario) string {
+	ctx := context.Background()
+	rig := newGoldenRig(t)
+	connID := sync3.ConnID{DeviceID: "d"}
+	responses := make([]json.RawMessage, 0, len(scenario.steps))
+	for i, step := range scenario.steps {
+		if step.before != nil {
+			step.before(rig)
+		}
+		req := step.request()
+		res, err := rig.cs.OnIncomingRequest(ctx, connID, &req, i == 0)
+		if err != nil {
+			t.Fatalf("step %d: OnIncomingRequest returned error: %s", i, err)
+		}
+		resJSON, err := json.Marshal(res)
+		if err != nil {
+			t.Fatalf("step %d: failed to marshal response: %s", i, err)
+		}
+		responses = append(responses, resJSON)
+	}
+	data, err := json.Marshal(responses)
+	if err != nil {
+		t.Fatalf("failed to marshal responses: %s", err)
+	}
+	return canonicalGoldenJSON(t, data)
+}
+
+func newGoldenRig(t *testing.T) *goldenRig {
+	ctx := context.Background()
+	metadata := map[string]internal.RoomMetadata{
+		"!a:localhost": {RoomID: "!a:localhost", NameEvent: "Room A", LastMessageTimestamp: 3000},
+		"!b:localhost": {RoomID: "!b:localhost", NameEvent: "Room B", LastMessageTimestamp: 2000},
+		"!c:localhost": {RoomID: "!c:localhost", NameEvent: "Room C", LastMessageTimestamp: 1000},
+	}
+	timelines := make(map[string][]json.RawMessage, len(metadata))
+	joinedRooms := make(map[string][]string, len(metadata))
+	for roomID, m := range metadata {
+		letter := strings.TrimSuffix(strings.TrimPrefix(roomID, "!"), ":localhost")
+		timelines[roomID] = []json.RawMessage{goldenEvent(t, map[string]interface{}{
+			"type":             "m.room.message",
+			"event_id":         "$" + letter,
+			"sender":           goldenUserID,
+			"origin_server_ts": m.LastMessageTimestamp,
+			"content":          map[string]interface{}{"body": "Message in " + m.NameEvent},
+		})}
+		joinedRooms[roomID] = []string{goldenUserID}
+	}
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(metadata)
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joined map[string]*internal.RoomMetadata, err error) {
+		joined = make(map[string]*internal.RoomMetadata, len(metadata))
+		for roomID := range metadata {
+			m := metadata[roomID]
+			joined[roomID] = &m
+		}
+		return 1, joined, nil
+	}
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(joinedRooms, nil)
+	userCache := caches.NewUserCache(goldenUserID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]caches.UserRoomData {
+		result := make(map[string]caches.UserRoomData, len(roomIDs))
+		for _, roomID := range roomIDs {
+			urd := userCache.LoadRoomData(roomID)
+			urd.Timeline = timelines[roomID]
+			result[roomID] = urd
+		}
+		return result
+	}
+	dispatcher.Register(ctx, userCache.UserID, userCache)
+	dispatcher.Register(ctx, sync3.DispatcherAllUsers, globalCache)
+	return &goldenRig{
+		t:          t,
+		cs:         NewConnState(goldenUserID, "d", userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, 1000),
+		dispatcher: dispatcher,
+		userCache:  userCache,
+		pos:        1,
+	}
+}
+
+// event sends a live event in this room to the connection.
+func (r *goldenRig) event(roomID string, ev json.RawMessage) {
+	r.pos++
+	r.dispatcher.OnNewEvent(context.Background(), roomID, ev, r.pos)
+}
+
+func goldenListRequest(ranges ...[2]int64) func() sync3.Request {
+	return func() sync3.Request {
+		return sync3.Request{
+			Lists: map[string]sync3.RequestList{
+				"a": {
+					Ranges: sync3.SliceRanges(ranges),
+					Sort:   []string{sync3.SortByRecency},
+					RoomSubscription: sync3.RoomSubscription{
+						TimelineLimit: 1,
+					},
+				},
+			},
+		}
+	}
+}
+
+// goldenEvent makes event JSON with fixed fields, so responses are the same on every run.
+func goldenEvent(t *testing.T, fields map[string]interface{}) json.RawMessage {
+	t.Helper()
+	ev, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatalf("failed to make event JSON: %s", err)
+	}
+	return ev
+}
+
+// canonicalGoldenJSON indents the JSON with sorted keys, so the golden files diff nicely.
+func canonicalGoldenJSON(t *testing.T, data []byte) string {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatalf("invalid JSON: %s", err)
+	}
+	out, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		t.Fatalf("failed to marshal JSON: %s", err)
+	}
+	return string(out) + "\n"
+}
+
+// diffGolden returns the first line which differs between want and got, with some context.
+func diffGolden(want, got string) string {
+	wantLines := strings.Split(want, "\n")
+	gotLines := strings.Split(got, "\n")
+	i := 0
+	for i < len(wantLines) && i < len(gotLines) && wantLines[i] == gotLines[i] {
+		i++
+	}
+	start := i - 3
+	if start < 0 {
+		start = 0
+	}
+	var sb strings.Builder
+	for _, line := range wantLines[start:i] {
+		sb.WriteString("  " + line + "\n")
+	}
+	if i < len(wantLines) {
+		sb.WriteString("- " + wantLines[i] + "\n")
+	}
+	if i < len(gotLines) {
+		sb.WriteString("+ " + gotLines[i] + "\n")
+	}
+	return sb.String()
+}
@@ -3,6 +3,8 @@ package handler
 import "C"
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/getsentry/sentry-go"
@@ -25,10 +27,21 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
 	"github.com/rs/zerolog/log"
+	"github.com/tidwall/gjson"
 )
 
 const DefaultSessionID = "default"
 
+// Response headers which let clients resume and detect restarts without parsing the response body. They are
+// sent on every response, including errors.
+const (
+	// The pos to resume from. Streamed responses send headers before the new pos is known, so they echo the
+	// request's pos, as do errors.
+	PosHeader = "X-Sliding-Sync-Pos"
+	// A random ID which changes every time the server restarts, at which point connections are lost.
+	InstanceHeader = "X-Sliding-Sync-Instance"
+)
+
 var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
 	Out:        os.Stderr,
 	TimeFormat: "15:04:05",
@@ -44,6 +57,36 @@ type SyncLiveHandler struct {
 	V3Pub      *EnsurePoller
 	ConnMap    *sync3.ConnMap
 	Extensions *extensions.Handler
+	// If true, GET requests are served a sync v2 shaped response. See serveV2Compat.
+	V2CompatEnabled bool
+	// If set, the lists of sampled users are periodically written to disk. See ListSnapshotter.
+	ListSnapshotter *ListSnapshotter
+	// The max number of live list operations to send per list per response, and per minute across all lists
+	// on a connection. When exceeded, the ops are replaced with a SYNC of the list. Zero means no limit.
+	MaxListOpsPerResponse int
+	MaxListOpsPerMinute   int
+	// If set, new connections are rejected and existing connections are marked as degraded when the
+	// database is failing. See CircuitBreaker.
+	StorageBreaker *CircuitBreaker
+	// If > 0, the number of timeline events to prefetch for rooms which the user is likely to open soon.
+	PrefetchTimelineLimit int
+	// Caps on the limits clients can request, per request and per connection.
+	Limits sync3.Limits
+	// If > 0, invites are collapsed when a user receives more than this many invites within
+	// InviteBurstWindow. See UserCache.SetInviteSpamShield.
+	InviteBurstThreshold int
+	InviteBurstWindow    time.Duration
+	// If > 0, initial sync responses with at least this many rooms are streamed to the client as rooms
+	// are loaded, rather than sent once the whole response is ready.
+	EarlyFlushMinRooms int
+	// If true, clients can ask for their poller to poll again straight away. See NotifyPath.
+	NotifyEnabled bool
+	// If true, clients can download diagnostics about their connection. See DiagnosticsPath.
+	DiagnosticsEnabled bool
+	// If set, the cost of serving each user is recorded and can be viewed via the admin API. See CostTracker.
+	CostTracker *CostTracker
+	// If set, users are grouped into tenants with their own quotas. See SetTenants.
+	Tenants *Tenants
 
 	// inserts are done by v2 poll loops, selects are done by v3 request threads
 	// but the v3 requests touch non-overlapping keys, which is a good use case for sync.Map
@@ -53,9 +96,21 @@ type SyncLiveHandler struct {
 
 	GlobalCache            *caches.GlobalCache
 	maxPendingEventUpdates int
+	debug                  bool
+	instanceID             string
+	// the latest event NID in the startup snapshot. Events at or before this are already in the caches, so
+	// are ignored if they are notified again, e.g when a persistent pubsub queue is replayed after a restart.
+	startupEventNID int64
+	// identical initial syncs which are in flight at the same time. See initialSyncFlights.
+	initialSyncs initialSyncFlights
+	// set if StartupInBackground is used
+	startup *startupProgress
+	// recent activity on each connection, recorded if DiagnosticsEnabled
+	connDiagnostics *connDiagnosticsMap
 
-	numConns prometheus.Gauge
-	histVec  *prometheus.HistogramVec
+	numConns     prometheus.Gauge
+	histVec      *prometheus.HistogramVec
+	collapsedOps prometheus.Counter
 }
 
 func NewSync3Handler(
@@ -77,7 +132,11 @@ func NewSync3Handler(
 		Dispatcher:             sync3.NewDispatcher(),
 		GlobalCache:            caches.NewGlobalCache(store),
 		maxPendingEventUpdates: maxPendingEventUpdates,
+		debug:                  debug,
+		instanceID:             newInstanceID(),
+		connDiagnostics:        newConnDiagnosticsMap(),
 	}
+	sh.GlobalCache.SetMembershipTracker(sh.Dispatcher)
 	sh.Extensions = &extensions.Handler{
 		Store:       store,
 		E2EEFetcher: sh,
@@ -97,13 +156,14 @@ func NewSync3Handler(
 }
 
 func (h *SyncLiveHandler) Startup(storeSnapshot *state.StartupSnapshot) error {
-	if err := h.Dispatcher.Startup(storeSnapshot.AllJoinedMembers); err != nil {
-		return fmt.Errorf("failed to load sync3.Dispatcher: %s", err)
+	if err := h.Dispatcher.Startup(storeSnapshot.AllJoinedMembers, storeSnapshot.AllInvitedMembers); err != nil {
+		return fmt.Errorf("failed to load sync3.Dispatcher: %w", err)
 	}
 	h.Dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, h.GlobalCache)
 	if err := h.GlobalCache.Startup(storeSnapshot.GlobalMetadata); err != nil {
-		return fmt.Errorf("failed to populate global cache: %s", err)
+		return fmt.Errorf("failed to populate global cache: %w", err)
 	}
+	h.startupEventNID = storeSnapshot.LatestEventNID
 	return nil
 }
 
@@ -125,12 +185,31 @@ func (h *SyncLiveHandler) Teardown() {
 	h.V2Sub.Teardown()
 	h.V3Pub.Teardown()
 	h.ConnMap.Teardown()
+	if h.ListSnapshotter != nil {
+		h.ListSnapshotter.Stop()
+	}
 	if h.numConns != nil {
 		prometheus.Unregister(h.numConns)
 	}
 	if h.histVec != nil {
 		prometheus.Unregister(h.histVec)
 	}
+	if h.collapsedOps != nil {
+		prometheus.Unregister(h.collapsedOps)
+	}
+	h.GlobalCache.RemovePrometheusMetrics()
+	h.Dispatcher.RemovePrometheusMetrics()
+	if h.Tenants != nil {
+		h.Tenants.teardown()
+	}
+}
+
+// SetTenants enforces per-tenant quotas on connections and requests.
+func (h *SyncLiveHandler) SetTenants(t *Tenants) {
+	if h.numConns != nil {
+		t.addPrometheusMetrics()
+	}
+	h.Tenants = t
 }
 
 func (h *SyncLiveHandler) updateMetrics() {
@@ -154,24 +233,42 @@ func (h *SyncLiveHandler) addPrometheusMetrics() {
 		Help:      "Time taken in seconds for the sliding sync response to calculated, excludes long polling",
 		Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
 	}, []string{"initial"})
+	h.collapsedOps = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "collapsed_list_ops",
+		Help:      "Number of times live list operations were collapsed into a SYNC due to op limits.",
+	})
 	prometheus.MustRegister(h.numConns)
 	prometheus.MustRegister(h.histVec)
+	prometheus.MustRegister(h.collapsedOps)
+	h.GlobalCache.AddPrometheusMetrics()
+	h.Dispatcher.AddPrometheusMetrics()
 }
 
 func (h *SyncLiveHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if req.Method != "POST" {
+	w.Header().Set(InstanceHeader, h.instanceID)
+	if req.URL.Path == ReadyPath {
+		h.serveReady(w)
+		return
+	}
+	var err error
+	if !h.startupReady() {
+		err = notReadyError()
+	} else if req.URL.Path == NotifyPath {
+		err = h.serveNotify(w, req)
+	} else if req.URL.Path == DiagnosticsPath {
+		err = h.serveDiagnostics(w, req)
+	} else if req.Method == "GET" && h.V2CompatEnabled {
+		err = h.serveV2Compat(w, req)
+	} else if req.Method != "POST" {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
+	} else {
+		err = h.serve(w, req)
 	}
-	err := h.serve(w, req)
 	if err != nil {
-		herr, ok := err.(*internal.HandlerError)
-		if !ok {
-			herr = &internal.HandlerError{
-				StatusCode: 500,
-				Err:        err,
-			}
-		}
+		herr := internal.ToHandlerError(err)
 		// artificially wait a bit before sending back the error
 		// this guards against tightlooping when the client hammers the server with invalid requests
 		time.Sleep(time.Second)
@@ -181,7 +278,11 @@ func (h *SyncLiveHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 }
 
 // Entry point for sync v3
-func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error {
+func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) (err error) {
+	// until we have a response, the client should carry on from where they were
+	if pos := req.URL.Query().Get("pos"); pos != "" {
+		w.Header().Set(PosHeader, pos)
+	}
 	var requestBody sync3.Request
 	if req.Body != nil {
 		defer req.Body.Close()
@@ -194,6 +295,7 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 			}
 		}
 	}
+	h.Limits.Clamp(&requestBody)
 	for listKey, l := range requestBody.Lists {
 		if l.Ranges != nil && !l.Ranges.Valid() {
 			return &internal.HandlerError{
@@ -212,20 +314,70 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 		}
 	}
 
+	// identical initial syncs from the same device share one response, so retries don't load every room again
+	var resp *sync3.Response
+	if req.URL.Query().Get("pos") == "" {
+		if key := initialSyncKey(req, &requestBody); key != "" {
+			flight, first := h.initialSyncs.join(key)
+			if !first {
+				if resp := flight.wait(req.Context()); resp != nil {
+					hlog.FromRequest(req).Info().Msg("sending the response of an identical initial sync")
+					return writeSharedInitialSync(w, resp)
+				}
+				// the first request failed, so carry on with this one
+			} else {
+				defer func() {
+					h.initialSyncs.finish(flight, resp)
+				}()
+			}
+		}
+	}
+
 	conn, herr := h.setupConnection(req, &requestBody, req.URL.Query().Get("pos") != "")
 	if herr != nil {
 		logErrorAndReport500s("failed to get or create Conn", herr)
 		return herr
 	}
 	// set pos and timeout if specified
-	cpos, herr := parseIntFromQuery(req.URL, "pos")
-	if herr != nil {
-		return herr
+	position, err := sync3.ParsePosition(req.URL.Query().Get("pos"))
+	if err != nil {
+		return &internal.HandlerError{
+			StatusCode: 400,
+			Err:        fmt.Errorf("invalid pos: %w", err),
+		}
 	}
+	cpos := position.Conn
 	requestBody.SetPos(cpos)
+	// extension positions in the pos let clients re-request extension data independently of room data
+	requestBody.Extensions.ApplyPositions(position.Extensions)
 	internal.SetRequestContextUserID(req.Context(), conn.UserID())
+	if h.Tenants != nil {
+		if herr := h.Tenants.CheckBudget(conn.UserID()); herr != nil {
+			logErrorAndReport500s("tenant quota exceeded", herr)
+			return herr
+		}
+		defer func() {
+			h.Tenants.AddDBTime(conn.UserID(), internal.RequestContextDBTime(req.Context()))
+		}()
+	}
 	log := hlog.FromRequest(req).With().Str("user", conn.UserID()).Int64("pos", cpos).Logger()
 
+	if h.CostTracker != nil {
+		cw := &countingResponseWriter{ResponseWriter: w}
+		w = cw
+		defer func() {
+			h.CostTracker.Add(conn.UserID(), internal.RequestContextDBTime(req.Context()), cw.written, numResponseEvents(resp))
+		}()
+	}
+	if diagnostics := h.connDiagnostics.get(conn.ConnID.DeviceID); diagnostics != nil {
+		cw := &countingResponseWriter{ResponseWriter: w}
+		w = cw
+		start := time.Now()
+		defer func() {
+			diagnostics.addResponse(summariseResponse(start, cpos, resp, cw.written, err))
+		}()
+	}
+
 	var timeout int
 	if req.URL.Query().Get("timeout") == "" {
 		timeout = sync3.DefaultTimeoutMSecs
@@ -237,14 +389,34 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 		timeout = int(timeout64)
 	}
 
+	// make sure we return before the request deadline, if there is one
+	timeout = clampTimeoutToDeadline(req.Context(), timeout)
+
 	requestBody.SetTimeoutMSecs(timeout)
 	log.Trace().Int("timeout", timeout).Msg("recv")
 
-	resp, herr := conn.OnIncomingRequest(req.Context(), &requestBody)
+	var streamer *sync3.ResponseStreamer
+	if h.EarlyFlushMinRooms > 0 && cpos == 0 {
+		streamer = sync3.NewResponseStreamer(w, h.EarlyFlushMinRooms)
+		requestBody.SetStreamer(streamer)
+	}
+
+	resp, herr = conn.OnIncomingRequest(req.Context(), &requestBody)
+	if herr != nil && streamer != nil && streamer.Started() {
+		// we've already sent a 200, so all we can do is cut the response short
+		logErrorAndReport500s("failed to OnIncomingRequest after streaming started", herr)
+		return nil
+	}
 	if herr != nil {
+		if herr.StatusCode >= 500 && h.StorageBreaker != nil {
+			h.StorageBreaker.Failure(time.Now())
+		}
 		logErrorAndReport500s("failed to OnIncomingRequest", herr)
 		return herr
 	}
+	if h.StorageBreaker != nil && h.StorageBreaker.Degraded() {
+		resp.Degraded = true
+	}
 	// for logging
 	var numToDeviceEvents int
 	if resp.Extensions.ToDevice != nil {
@@ -264,7 +436,18 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 		numChangedDevices, numLeftDevices,
 	)
 
+	if streamer != nil && streamer.Started() {
+		if err := streamer.Finish(resp); err != nil {
+			// the status code has already been sent so we can't return an error
+			logErrorAndReport500s("failed to stream result", &internal.HandlerError{
+				StatusCode: 500,
+				Err:        err,
+			})
+		}
+		return nil
+	}
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(PosHeader, resp.Pos)
 	w.WriteHeader(200)
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		herr = &internal.HandlerError{
@@ -308,39 +491,25 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, syncReq *sync3.Requ
 		return nil, internal.ExpiredSessionError()
 	}
 
-	// We're going to make a new connection
-	// Ensure we have the v2 side of things hooked up
-	v2device, err := h.V2Store.InsertDevice(deviceID, accessToken)
-	if err != nil {
-		log.Warn().Err(err).Str("device_id", deviceID).Msg("failed to insert v2 device")
+	// We're going to make a new connection, which needs the database. Fail fast if it is struggling.
+	if h.StorageBreaker != nil && !h.StorageBreaker.Allow(time.Now()) {
 		return nil, &internal.HandlerError{
-			StatusCode: 500,
-			Err:        err,
+			StatusCode: http.StatusServiceUnavailable,
+			Err:        fmt.Errorf("storage is unavailable, try again later"),
 		}
 	}
-	if v2device.UserID == "" {
-		v2device.UserID, _, err = h.V2.WhoAmI(accessToken)
-		if err != nil {
-			if err == sync2.HTTP401 {
-				return nil, &internal.HandlerError{
-					StatusCode: 401,
-					Err:        fmt.Errorf("/whoami returned HTTP 401"),
-				}
-			}
-			log.Warn().Err(err).Str("device_id", deviceID).Msg("failed to get user ID from device ID")
-			return nil, &internal.HandlerError{
-				StatusCode: http.StatusBadGateway,
-				Err:        err,
-			}
-		}
-		if err = h.V2Store.UpdateUserIDForDevice(deviceID, v2device.UserID); err != nil {
-			log.Warn().Err(err).Str("device_id", deviceID).Msg("failed to persist user ID -> device ID mapping")
-			// non-fatal, we can still work without doing this
-		}
+
+	// Ensure we have the v2 side of things hooked up
+	v2device, herr := h.v2DeviceForToken(req, deviceID, accessToken)
+	if herr != nil {
+		return nil, herr
 	}
 
 	log.Trace().Str("user", v2device.UserID).Msg("checking poller exists and is running")
-	h.V3Pub.EnsurePolling(v2device.UserID, v2device.DeviceID)
+	if err := h.V3Pub.EnsurePolling(v2device.UserID, v2device.DeviceID); err != nil {
+		log.Warn().Err(err).Str("user_id", v2device.UserID).Msg("poller stopped before the initial sync completed")
+		return nil, internal.ToHandlerError(err)
+	}
 	log.Trace().Str("user", v2device.UserID).Msg("poller exists and is running")
 	// this may take a while so if the client has given up (e.g timed out) by this point, just stop.
 	// We'll be quicker next time as the poller will already exist.
@@ -354,8 +523,22 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, syncReq *sync3.Requ
 		}
 	}
 
+	// Reserve the connection before doing any work for the tenant.
+	var closeTenantConn func()
+	if h.Tenants != nil {
+		replacing := h.ConnMap.Conn(sync3.ConnID{DeviceID: deviceID}) != nil
+		closeTenantConn, herr = h.Tenants.OpenConn(v2device.UserID, replacing)
+		if herr != nil {
+			return nil, herr
+		}
+	}
+
 	userCache, err := h.userCache(v2device.UserID)
+	h.recordStorageResult(err)
 	if err != nil {
+		if closeTenantConn != nil {
+			closeTenantConn()
+		}
 		log.Warn().Err(err).Str("user_id", v2device.UserID).Msg("failed to load user cache")
 		return nil, &internal.HandlerError{
 			StatusCode: 500,
@@ -374,7 +557,26 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, syncReq *sync3.Requ
 	conn, created := h.ConnMap.CreateConn(sync3.ConnID{
 		DeviceID: deviceID,
 	}, func() sync3.ConnHandler {
-		return NewConnState(v2device.UserID, v2device.DeviceID, userCache, h.GlobalCache, h.Extensions, h.Dispatcher, h.histVec, h.maxPendingEventUpdates)
+		cs := NewConnState(v2device.UserID, v2device.DeviceID, userCache, h.GlobalCache, h.Extensions, h.Dispatcher, h.histVec, h.maxPendingEventUpdates)
+		cs.debug = h.debug
+		if h.ListSnapshotter != nil {
+			cs.listSnapshot = h.ListSnapshotter.track(v2device.UserID, deviceID)
+		}
+		cs.opLimiter = newOpLimiter(h.MaxListOpsPerResponse, h.MaxListOpsPerMinute, h.collapsedOps)
+		cs.prefetchTimelineLimit = h.PrefetchTimelineLimit
+		cs.eventContextFetcher = h
+		cs.limits = h.Limits
+		cs.onDestroy = closeTenantConn
+		if h.DiagnosticsEnabled {
+			cs.diagnostics = h.connDiagnostics.add(deviceID)
+			cs.onDestroy = func() {
+				h.connDiagnostics.remove(deviceID, cs.diagnostics)
+				if closeTenantConn != nil {
+					closeTenantConn()
+				}
+			}
+		}
+		return cs
 	})
 	if created {
 		log.Info().Str("user", v2device.UserID).Str("conn_id", conn.ConnID.String()).Msg("created new connection")
@@ -384,6 +586,54 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, syncReq *sync3.Requ
 	return conn, nil
 }
 
+// recordStorageResult tells the storage circuit breaker, if any, whether a database operation succeeded.
+func (h *SyncLiveHandler) recordStorageResult(err error) {
+	if h.StorageBreaker == nil {
+		return
+	}
+	if err != nil {
+		h.StorageBreaker.Failure(time.Now())
+	} else {
+		h.StorageBreaker.Success()
+	}
+}
+
+// v2DeviceForToken returns the v2 device for this access token, creating it and looking up the user
+// ID via /whoami if this is a new device.
+func (h *SyncLiveHandler) v2DeviceForToken(req *http.Request, deviceID, accessToken string) (*sync2.Device, *internal.HandlerError) {
+	log := hlog.FromRequest(req)
+	v2device, err := h.V2Store.InsertDevice(deviceID, accessToken)
+	h.recordStorageResult(err)
+	if err != nil {
+		log.Warn().Err(err).Str("device_id", deviceID).Msg("failed to insert v2 device")
+		return nil, &internal.HandlerError{
+			StatusCode: 500,
+			Err:        err,
+		}
+	}
+	if v2device.UserID == "" {
+		v2device.UserID, _, err = h.V2.WhoAmI(req.Context(), accessToken)
+		if err != nil {
+			if err == sync2.HTTP401 {
+				return nil, &internal.HandlerError{
+					StatusCode: 401,
+					Err:        fmt.Errorf("/whoami returned HTTP 401"),
+				}
+			}
+			log.Warn().Err(err).Str("device_id", deviceID).Msg("failed to get user ID from device ID")
+			return nil, &internal.HandlerError{
+				StatusCode: http.StatusBadGateway,
+				Err:        err,
+			}
+		}
+		if err = h.V2Store.UpdateUserIDForDevice(deviceID, v2device.UserID); err != nil {
+			log.Warn().Err(err).Str("device_id", deviceID).Msg("failed to persist user ID -> device ID mapping")
+			// non-fatal, we can still work without doing this
+		}
+	}
+	return v2device, nil
+}
+
 func (h *SyncLiveHandler) CacheForUser(userID string) *caches.UserCache {
 	c, ok := h.userCaches.Load(userID)
 	if ok {
@@ -399,26 +649,45 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 		return c.(*caches.UserCache), nil
 	}
 	uc := caches.NewUserCache(userID, h.GlobalCache, h.Storage, h)
+	if h.InviteBurstThreshold > 0 {
+		uc.SetInviteSpamShield(h.InviteBurstThreshold, h.InviteBurstWindow)
+	}
 	// select all non-zero highlight or notif counts and set them, as this is less costly than looping every room/user pair
 	err := h.Storage.UnreadTable.SelectAllNonZeroCountsForUser(userID, func(roomID string, highlightCount, notificationCount int) {
 		uc.OnUnreadCounts(context.Background(), roomID, &highlightCount, &notificationCount)
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to load unread counts: %s", err)
+		return nil, fmt.Errorf("failed to load unread counts: %w", err)
+	}
+	threadCounts, err := h.Storage.ThreadUnreadTable.SelectAllForUser(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load thread unread counts: %w", err)
 	}
-	// select the DM account data event and set DM room status
-	directEvent, err := h.Storage.AccountData(userID, sync2.AccountDataGlobalRoom, []string{"m.direct"})
+	for roomID, counts := range threadCounts {
+		uc.OnThreadUnreadCounts(context.Background(), roomID, counts)
+	}
+	latestPos, err := h.Storage.LatestEventNID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load latest event position: %w", err)
+	}
+	joinedAt, err := h.Storage.JoinTimestampsAfterPosition(userID, latestPos)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load direct message status for rooms: %s", err)
+		return nil, fmt.Errorf("failed to load join timestamps: %w", err)
 	}
-	if len(directEvent) == 1 {
-		uc.OnAccountData(context.Background(), []state.AccountData{directEvent[0]})
+	uc.SetJoinTimestamps(joinedAt)
+	// select the DM account data event and set DM room status, along with the ignored users
+	globalEvents, err := h.Storage.AccountData(userID, sync2.AccountDataGlobalRoom, []string{"m.direct", "m.ignored_user_list"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load direct message status and ignored users: %w", err)
+	}
+	if len(globalEvents) > 0 {
+		uc.OnAccountData(context.Background(), globalEvents)
 	}
 
 	// select all room tag account data and set it
 	tagEvents, err := h.Storage.RoomAccountDatasWithType(userID, "m.tag")
 	if err != nil {
-		return nil, fmt.Errorf("failed to load room tags %s", err)
+		return nil, fmt.Errorf("failed to load room tags %w", err)
 	}
 	if len(tagEvents) > 0 {
 		uc.OnAccountData(context.Background(), tagEvents)
@@ -427,7 +696,7 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 	// select outstanding invites
 	invites, err := h.Storage.InvitesTable.SelectAllInvitesForUser(userID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load outstanding invites for user: %s", err)
+		return nil, fmt.Errorf("failed to load outstanding invites for user: %w", err)
 	}
 	for roomID, inviteState := range invites {
 		uc.OnInvite(context.Background(), roomID, inviteState)
@@ -441,7 +710,7 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 		if err = h.Dispatcher.Register(context.Background(), userID, uc); err != nil {
 			h.Dispatcher.Unregister(userID)
 			h.userCaches.Delete(userID)
-			return nil, fmt.Errorf("failed to register user cache with dispatcher: %s", err)
+			return nil, fmt.Errorf("failed to register user cache with dispatcher: %w", err)
 		}
 	}
 
@@ -523,7 +792,15 @@ func (h *SyncLiveHandler) Accumulate(p *pubsub.V2Accumulate) {
 	internal.Logf(ctx, "room", fmt.Sprintf("%s: %d events", p.RoomID, len(events)))
 	// we have new events, notify active connections
 	for i := range events {
-		h.Dispatcher.OnNewEvent(ctx, p.RoomID, events[i], p.EventNIDs[i])
+		if p.EventNIDs[i] <= h.startupEventNID {
+			continue
+		}
+		if eventID := gjson.GetBytes(events[i], "event_id").Str; h.GlobalCache.SeenEvent(p.RoomID, eventID) {
+			logger.Debug().Str("room", p.RoomID).Str("event_id", eventID).Msg("Accumulate: dropping duplicate event")
+			continue
+		}
+		// errors are handled by moving the event to the dead-letter table, so we can carry on
+		_ = h.dispatchNewEvent(ctx, p.RoomID, events[i], p.EventNIDs[i])
 	}
 }
 
@@ -548,7 +825,22 @@ func (h *SyncLiveHandler) OnUnreadCounts(p *pubsub.V2UnreadCounts) {
 	if !ok {
 		return
 	}
-	userCache.(*caches.UserCache).OnUnreadCounts(ctx, p.RoomID, p.HighlightCount, p.NotificationCount)
+	h.Dispatcher.Do(p.UserID, func() {
+		userCache.(*caches.UserCache).OnUnreadCounts(ctx, p.RoomID, p.HighlightCount, p.NotificationCount)
+	})
+}
+
+// OnThreadUnreadCounts passes the latest per-thread unread counts for a room to the user's cache.
+func (h *SyncLiveHandler) OnThreadUnreadCounts(p *pubsub.V2ThreadUnreadCounts) {
+	ctx, task := internal.StartTask(context.Background(), "OnThreadUnreadCounts")
+	defer task.End()
+	userCache, ok := h.userCaches.Load(p.UserID)
+	if !ok {
+		return
+	}
+	h.Dispatcher.Do(p.UserID, func() {
+		userCache.(*caches.UserCache).OnThreadUnreadCounts(ctx, p.RoomID, p.Counts)
+	})
 }
 
 // push device data updates on waiting conns (otk counts, device list changes)
@@ -589,7 +881,9 @@ func (h *SyncLiveHandler) OnInvite(p *pubsub.V2InviteRoom) {
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		return
 	}
-	userCache.(*caches.UserCache).OnInvite(ctx, p.RoomID, inviteState)
+	h.Dispatcher.Do(p.UserID, func() {
+		userCache.(*caches.UserCache).OnInvite(ctx, p.RoomID, inviteState)
+	})
 }
 
 func (h *SyncLiveHandler) OnLeftRoom(p *pubsub.V2LeaveRoom) {
@@ -599,7 +893,9 @@ func (h *SyncLiveHandler) OnLeftRoom(p *pubsub.V2LeaveRoom) {
 	if !ok {
 		return
 	}
-	userCache.(*caches.UserCache).OnLeftRoom(ctx, p.RoomID)
+	h.Dispatcher.Do(p.UserID, func() {
+		userCache.(*caches.UserCache).OnLeftRoom(ctx, p.RoomID)
+	})
 }
 
 func (h *SyncLiveHandler) OnReceipt(p *pubsub.V2Receipt) {
@@ -621,9 +917,12 @@ func (h *SyncLiveHandler) OnReceipt(p *pubsub.V2Receipt) {
 		if !ok {
 			continue
 		}
-		for _, pr := range privateReceipts {
-			userCache.(*caches.UserCache).OnReceipt(ctx, pr)
-		}
+		privateReceipts := privateReceipts
+		h.Dispatcher.Do(userID, func() {
+			for _, pr := range privateReceipts {
+				userCache.(*caches.UserCache).OnReceipt(ctx, pr)
+			}
+		})
 	}
 	if len(publicReceipts) == 0 {
 		return
@@ -653,21 +952,76 @@ func (h *SyncLiveHandler) OnAccountData(p *pubsub.V2AccountData) {
 	if !ok {
 		return
 	}
-	data, err := h.Storage.AccountData(p.UserID, p.RoomID, p.Types)
+	data, err := h.Storage.AccountDataForRooms(p.UserID, p.Types)
 	if err != nil {
-		logger.Err(err).Str("user", p.UserID).Str("room", p.RoomID).Msg("OnAccountData: failed to lookup")
+		logger.Err(err).Str("user", p.UserID).Int("rooms", len(p.Types)).Msg("OnAccountData: failed to lookup")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		return
 	}
-	userCache.(*caches.UserCache).OnAccountData(ctx, data)
+	h.Dispatcher.Do(p.UserID, func() {
+		userCache.(*caches.UserCache).OnAccountData(ctx, data)
+	})
 }
 
 func (h *SyncLiveHandler) OnExpiredToken(p *pubsub.V2ExpiredToken) {
+	h.V3Pub.OnExpiredToken(p.DeviceID)
 	h.ConnMap.CloseConn(sync3.ConnID{
 		DeviceID: p.DeviceID,
 	})
 }
 
+// EnableAsyncDispatch makes the dispatcher update user caches asynchronously, so a user with slow connections
+// cannot hold up live updates for everyone else. See Dispatcher.SetAsync. Must be called before Startup.
+func (h *SyncLiveHandler) EnableAsyncDispatch(queueSize int) {
+	h.Dispatcher.SetAsync(queueSize, h.onDispatchOverflow)
+}
+
+// onDispatchOverflow is called when a user cache has missed live updates because it fell too far behind or
+// panicked whilst processing one.
+// Drop the cache and the user's connections so they are rebuilt from the database on the next request.
+func (h *SyncLiveHandler) onDispatchOverflow(userID string) {
+	h.userCaches.Delete(userID)
+	h.ConnMap.CloseConnsForUser(userID)
+}
+
+// OnUserArchived drops the in-memory caches for a user whose data has been garbage collected due to
+// inactivity. If they have a connection open (e.g they came back whilst being archived), keep the caches.
+func (h *SyncLiveHandler) OnUserArchived(p *pubsub.V2UserArchived) {
+	for _, deviceID := range p.DeviceIDs {
+		if h.ConnMap.Conn(sync3.ConnID{DeviceID: deviceID}) != nil {
+			return
+		}
+	}
+	h.Dispatcher.Unregister(p.UserID)
+	h.userCaches.Delete(p.UserID)
+}
+
+// OnGappySync recounts the members of the room, as membership events may have been missed.
+func (h *SyncLiveHandler) OnGappySync(p *pubsub.V2GappySync) {
+	ctx, task := internal.StartTask(context.Background(), "OnGappySync")
+	defer task.End()
+	joined, invited, err := h.Storage.CurrentMembers(p.RoomID)
+	if err != nil {
+		logger.Err(err).Str("room", p.RoomID).Msg("OnGappySync: failed to load current members")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	h.Dispatcher.RecountRoom(p.RoomID, joined, invited)
+	h.GlobalCache.RecountMembers(p.RoomID, joined, invited)
+	// the state may have changed in ways we didn't see
+	h.GlobalCache.InvalidateRoomState(p.RoomID)
+}
+
+// newInstanceID returns a random ID for this server instance.
+func newInstanceID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// still unique enough to tell restarts apart
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
 func parseIntFromQuery(u *url.URL, param string) (result int64, err *internal.HandlerError) {
 	queryPos := u.Query().Get(param)
 	if queryPos != "" {
@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResponseHeaders(t *testing.T) {
+	h := &SyncLiveHandler{
+		instanceID: newInstanceID(),
+	}
+	if other := newInstanceID(); other == h.instanceID {
+		t.Fatalf("newInstanceID returned the same ID twice: %s", other)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PUT", "/_matrix/client/unstable/org.matrix.msc3575/sync", nil))
+	if w.Code != 405 {
+		t.Fatalf("got HTTP %d want 405", w.Code)
+	}
+	if got := w.Header().Get(InstanceHeader); got != h.instanceID {
+		t.Errorf("got instance header %q want %q", got, h.instanceID)
+	}
+
+	// errors echo the request's pos
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/_matrix/client/unstable/org.matrix.msc3575/sync?pos=5", strings.NewReader("{")))
+	if w.Code != 400 {
+		t.Fatalf("got HTTP %d want 400", w.Code)
+	}
+	if got := w.Header().Get(PosHeader); got != "5" {
+		t.Errorf("got pos header %q want 5", got)
+	}
+	if got := w.Header().Get(InstanceHeader); got != h.instanceID {
+		t.Errorf("got instance header %q want %q", got, h.instanceID)
+	}
+}
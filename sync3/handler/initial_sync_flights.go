@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+// initialSyncFlights deduplicates identical initial sync requests from the same device which are in flight at
+// the same time, e.g when a flaky client retries its initial sync before the first attempt has finished.
+// The first request does the work and the others are sent its response. Without this, each request would
+// load every room, and each would replace the connection made by the one before it.
+type initialSyncFlights struct {
+	mu      sync.Mutex
+	flights map[string]*initialSyncFlight
+}
+
+type initialSyncFlight struct {
+	key  string
+	done chan struct{}
+	// set before done is closed, if the request succeeded
+	resp *sync3.Response
+}
+
+// join returns the flight for this key, and true if the caller is the first request with this key, in which
+// case the caller must call finish once it has a response.
+func (f *initialSyncFlights) join(key string) (*initialSyncFlight, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if flight, ok := f.flights[key]; ok {
+		return flight, false
+	}
+	if f.flights == nil {
+		f.flights = make(map[string]*initialSyncFlight)
+	}
+	flight := &initialSyncFlight{
+		key:  key,
+		done: make(chan struct{}),
+	}
+	f.flights[key] = flight
+	return flight, true
+}
+
+// finish shares the response with the requests waiting on this flight. resp is nil if the request failed.
+func (f *initialSyncFlights) finish(flight *initialSyncFlight, resp *sync3.Response) {
+	f.mu.Lock()
+	delete(f.flights, flight.key)
+	f.mu.Unlock()
+	flight.resp = resp
+	close(flight.done)
+}
+
+// wait returns the response of the first request, or nil if it failed or ctx was cancelled first.
+func (flight *initialSyncFlight) wait(ctx context.Context) *sync3.Response {
+	select {
+	case <-flight.done:
+		return flight.resp
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// initialSyncKey returns the key which identical initial sync requests share, or "" if the request can't be
+// deduplicated.
+func initialSyncKey(req *http.Request, syncReq *sync3.Request) string {
+	deviceID, _, err := internal.HashedTokenFromRequest(req)
+	if err != nil || deviceID == "" {
+		return ""
+	}
+	body, err := json.Marshal(syncReq)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.New()
+	hash.Write([]byte(deviceID))
+	hash.Write([]byte{0})
+	hash.Write([]byte(req.URL.Query().Get("timeout")))
+	hash.Write([]byte{0})
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// writeSharedInitialSync sends the response of an identical initial sync request to this client.
+func writeSharedInitialSync(w http.ResponseWriter, resp *sync3.Response) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(PosHeader, resp.Pos)
+	w.WriteHeader(200)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		return &internal.HandlerError{
+			StatusCode: 500,
+			Err:        err,
+		}
+	}
+	return nil
+}
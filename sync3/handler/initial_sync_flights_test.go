@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+func TestInitialSyncFlights(t *testing.T) {
+	var flights initialSyncFlights
+	first, isFirst := flights.join("a")
+	if !isFirst {
+		t.Fatalf("join: first request was not first")
+	}
+	second, isFirst := flights.join("a")
+	if isFirst || second != first {
+		t.Fatalf("join: second request did not join the first request's flight")
+	}
+	if _, isFirst = flights.join("b"); !isFirst {
+		t.Fatalf("join: request with a different key joined another flight")
+	}
+
+	want := &sync3.Response{Pos: "1"}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		flights.finish(first, want)
+	}()
+	if got := second.wait(context.Background()); got != want {
+		t.Errorf("wait: got %+v want %+v", got, want)
+	}
+	// finished flights are not joined
+	if _, isFirst = flights.join("a"); !isFirst {
+		t.Errorf("join: request joined a finished flight")
+	}
+
+	// waiting stops when the waiting request is cancelled
+	third, _ := flights.join("c")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got := third.wait(ctx); got != nil {
+		t.Errorf("wait: got %+v for a cancelled request", got)
+	}
+}
+
+func TestInitialSyncKey(t *testing.T) {
+	key := func(token, timeout string, syncReq sync3.Request) string {
+		req := httptest.NewRequest("POST", "/sync?timeout="+timeout, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return initialSyncKey(req, &syncReq)
+	}
+	list := sync3.Request{Lists: map[string]sync3.RequestList{
+		"a": {Ranges: sync3.SliceRanges{{0, 10}}},
+	}}
+	base := key("alice_token", "1000", list)
+	if base == "" {
+		t.Fatalf("initialSyncKey: got no key")
+	}
+	if got := key("alice_token", "1000", list); got != base {
+		t.Errorf("initialSyncKey: identical requests got different keys")
+	}
+	if got := key("bob_token", "1000", list); got == base {
+		t.Errorf("initialSyncKey: requests from different devices got the same key")
+	}
+	if got := key("alice_token", "0", list); got == base {
+		t.Errorf("initialSyncKey: requests with different timeouts got the same key")
+	}
+	if got := key("alice_token", "1000", sync3.Request{}); got == base {
+		t.Errorf("initialSyncKey: requests with different bodies got the same key")
+	}
+	if got := key("", "1000", list); got != "" {
+		t.Errorf("initialSyncKey: got key %s for a request without an access token", got)
+	}
+}
@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// NotifyPath is where clients can POST after doing something on the homeserver e.g sending a message or
+// joining a room. This makes the poller for their device poll again straight away, so the change comes down
+// their sliding sync connection sooner.
+const NotifyPath = "/_matrix/client/unstable/org.matrix.msc3575/sync/notify"
+
+func (h *SyncLiveHandler) serveNotify(w http.ResponseWriter, req *http.Request) error {
+	if !h.NotifyEnabled {
+		return &internal.HandlerError{
+			StatusCode: 404,
+			Err:        fmt.Errorf("notify is disabled"),
+			ErrCode:    "M_UNRECOGNIZED",
+		}
+	}
+	if req.Method != "POST" {
+		return &internal.HandlerError{
+			StatusCode: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("notify must be a POST"),
+			ErrCode:    "M_UNRECOGNIZED",
+		}
+	}
+	deviceID, accessToken, err := internal.HashedTokenFromRequest(req)
+	if err != nil || accessToken == "" {
+		return &internal.HandlerError{
+			StatusCode: 400,
+			Err:        fmt.Errorf("failed to get device ID from request: %v", err),
+		}
+	}
+	// The device ID is derived from the access token so there's no need to check the token here: if it is
+	// wrong, there won't be a poller for the device and nothing will happen.
+	h.V3Pub.Nudge(deviceID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("{}"))
+	return nil
+}
@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/pubsub"
+)
+
+type recordingNotifier struct {
+	payloads []pubsub.Payload
+}
+
+func (n *recordingNotifier) Notify(chanName string, p pubsub.Payload) error {
+	n.payloads = append(n.payloads, p)
+	return nil
+}
+
+func (n *recordingNotifier) Close() error { return nil }
+
+func TestServeNotify(t *testing.T) {
+	notifier := &recordingNotifier{}
+	h := &SyncLiveHandler{
+		V3Pub: NewEnsurePoller(notifier),
+	}
+	newRequest := func(method string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, NotifyPath, nil)
+		req.Header.Set("Authorization", "Bearer secret_token")
+		w := httptest.NewRecorder()
+		if err := h.serveNotify(w, req); err != nil {
+			herr := err.(*internal.HandlerError)
+			w.Code = herr.StatusCode
+		}
+		return w
+	}
+
+	// disabled by default
+	if w := newRequest("POST"); w.Code != 404 {
+		t.Errorf("disabled: got HTTP %d want 404", w.Code)
+	}
+	h.NotifyEnabled = true
+	if w := newRequest("GET"); w.Code != 405 {
+		t.Errorf("GET: got HTTP %d want 405", w.Code)
+	}
+	if len(notifier.payloads) != 0 {
+		t.Fatalf("got %d payloads before a valid request, want 0", len(notifier.payloads))
+	}
+
+	if w := newRequest("POST"); w.Code != 202 {
+		t.Errorf("POST: got HTTP %d want 202", w.Code)
+	}
+	if len(notifier.payloads) != 1 {
+		t.Fatalf("got %d payloads want 1", len(notifier.payloads))
+	}
+	nudge, ok := notifier.payloads[0].(*pubsub.V3Nudge)
+	if !ok {
+		t.Fatalf("got payload %T want *pubsub.V3Nudge", notifier.payloads[0])
+	}
+	req := httptest.NewRequest("POST", NotifyPath, nil)
+	req.Header.Set("Authorization", "Bearer secret_token")
+	wantDeviceID, _, _ := internal.HashedTokenFromRequest(req)
+	if nudge.DeviceID != wantDeviceID {
+		t.Errorf("got device ID %q want %q", nudge.DeviceID, wantDeviceID)
+	}
+}
@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"context"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// opLimiter caps the number of live list operations sent on a connection, both per response and per
+// minute via a token bucket. This protects clients from op floods e.g when a bot is spamming a busy room.
+// When the limit is exceeded, the live ops for a list are collapsed into a SYNC of the list's windows.
+type opLimiter struct {
+	maxPerResponse int
+	perMinute      int
+	tokens         float64
+	lastRefill     time.Time
+	collapsed      prometheus.Counter
+}
+
+// newOpLimiter returns a limiter with the given limits. A limit of 0 means no limit. Returns nil if there
+// are no limits. `collapsed` is incremented every time a list is collapsed and may be nil.
+func newOpLimiter(maxPerResponse, perMinute int, collapsed prometheus.Counter) *opLimiter {
+	if maxPerResponse <= 0 && perMinute <= 0 {
+		return nil
+	}
+	return &opLimiter{
+		maxPerResponse: maxPerResponse,
+		perMinute:      perMinute,
+		tokens:         float64(perMinute),
+		lastRefill:     time.Now(),
+		collapsed:      collapsed,
+	}
+}
+
+// allow returns true if numOps can be sent, consuming tokens if so.
+func (l *opLimiter) allow(numOps int, now time.Time) bool {
+	if l.maxPerResponse > 0 && numOps > l.maxPerResponse {
+		return false
+	}
+	if l.perMinute <= 0 {
+		return true
+	}
+	l.tokens += now.Sub(l.lastRefill).Minutes() * float64(l.perMinute)
+	if l.tokens > float64(l.perMinute) {
+		l.tokens = float64(l.perMinute)
+	}
+	l.lastRefill = now
+	if float64(numOps) > l.tokens {
+		return false
+	}
+	l.tokens -= float64(numOps)
+	return true
+}
+
+// limitListOps checks the live ops added to each list since `opsBefore` was calculated, and collapses them
+// into SYNC ops if they exceed the limits. Ops which were present before live updates were processed are
+// always kept, as they are in response to the client changing their request.
+func (s *connStateLive) limitListOps(ctx context.Context, response *sync3.Response, opsBefore map[string]int) {
+	if s.opLimiter == nil {
+		return
+	}
+	now := time.Now()
+	for listKey, resList := range response.Lists {
+		numLiveOps := len(resList.Ops) - opsBefore[listKey]
+		if numLiveOps <= 0 || s.opLimiter.allow(numLiveOps, now) {
+			continue
+		}
+		internal.Logf(ctx, "connstate", "list[%v] collapsing %d live ops into SYNC", listKey, numLiveOps)
+		resList.Ops = append(resList.Ops[:opsBefore[listKey]], s.syncListWindows(ctx, listKey)...)
+		response.Lists[listKey] = resList
+		if s.opLimiter.collapsed != nil {
+			s.opLimiter.collapsed.Inc()
+		}
+	}
+}
+
+// syncListWindows returns SYNC ops for every window the client has requested on this list.
+func (s *connStateLive) syncListWindows(ctx context.Context, listKey string) []sync3.ResponseOp {
+	intList := s.lists.Get(listKey)
+	reqList, ok := s.muxedReq.Lists[listKey]
+	if intList == nil || !ok || intList.Len() == 0 {
+		return nil
+	}
+	roomIDs := intList.RoomIDs()
+	ranges := reqList.Ranges
+	if reqList.SlowGetAllRooms != nil && *reqList.SlowGetAllRooms {
+		ranges = sync3.SliceRanges{{0, intList.Len() - 1}}
+	}
+	var ops []sync3.ResponseOp
+	for _, r := range ranges {
+		if r[0] >= intList.Len() {
+			continue
+		}
+		r = clampSliceRangeToListSize(ctx, r, intList.Len())
+		ops = append(ops, &sync3.ResponseOpRange{
+			Operation: sync3.OpSync,
+			Range:     r,
+			RoomIDs:   roomIDs[r[0] : r[1]+1],
+		})
+	}
+	return ops
+}
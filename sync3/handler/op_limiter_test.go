@@ -0,0 +1,36 @@
+package handler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOpLimiter(t *testing.T) {
+	if newOpLimiter(0, 0, nil) != nil {
+		t.Fatalf("expected no limiter when there are no limits")
+	}
+	l := newOpLimiter(10, 20, nil)
+	now := l.lastRefill
+	if l.allow(11, now) {
+		t.Fatalf("allowed more ops than the per-response limit")
+	}
+	if !l.allow(10, now) || !l.allow(10, now) {
+		t.Fatalf("did not allow ops within the per-minute limit")
+	}
+	if l.allow(1, now) {
+		t.Fatalf("allowed ops when the bucket was empty")
+	}
+	// half a minute later, half the bucket has refilled
+	now = now.Add(30 * time.Second)
+	if !l.allow(10, now) {
+		t.Fatalf("bucket did not refill")
+	}
+	if l.allow(1, now) {
+		t.Fatalf("bucket refilled too much")
+	}
+	// the bucket never holds more than a minute's worth of tokens
+	now = now.Add(time.Hour)
+	if !l.allow(10, now) || !l.allow(10, now) || l.allow(1, now) {
+		t.Fatalf("bucket exceeded its capacity")
+	}
+}
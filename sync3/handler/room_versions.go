@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+)
+
+// roomVersionSummary is how many rooms are on a room version, and how many members they have. Rooms which
+// have been upgraded are only counted in UpgradedRooms, as they don't need upgrading again.
+type roomVersionSummary struct {
+	RoomVersion   string `json:"room_version"`
+	Rooms         int    `json:"rooms"`
+	UpgradedRooms int    `json:"upgraded_rooms"`
+	// the sum of the member counts of the rooms, so users in several rooms are counted more than once
+	JoinedMembers  int `json:"joined_members"`
+	InvitedMembers int `json:"invited_members"`
+}
+
+// GET /_syncv3/admin/room_versions
+// Summarises the rooms on each room version, for admins planning room upgrades.
+func (h *SyncLiveHandler) adminListRoomVersions(w http.ResponseWriter, req *http.Request) {
+	infos, err := h.Storage.RoomVersions()
+	if err != nil {
+		writeAdminError(w, &internal.HandlerError{StatusCode: 500, Err: fmt.Errorf("failed to load room versions: %w", err)})
+		return
+	}
+	writeAdminJSON(w, map[string]interface{}{
+		"room_versions": summariseRoomVersions(infos),
+	})
+}
+
+// GET /_syncv3/admin/room_versions/{version}
+// Lists the rooms on this room version, including upgraded rooms, with the most joined members first.
+func (h *SyncLiveHandler) adminListRoomsForVersion(w http.ResponseWriter, req *http.Request) {
+	version := mux.Vars(req)["version"]
+	infos, err := h.Storage.RoomVersions()
+	if err != nil {
+		writeAdminError(w, &internal.HandlerError{StatusCode: 500, Err: fmt.Errorf("failed to load room versions: %w", err)})
+		return
+	}
+	rooms := []state.RoomVersionInfo{}
+	for _, info := range infos {
+		if info.RoomVersion == version {
+			rooms = append(rooms, info)
+		}
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		if rooms[i].JoinCount != rooms[j].JoinCount {
+			return rooms[i].JoinCount > rooms[j].JoinCount
+		}
+		return rooms[i].RoomID < rooms[j].RoomID
+	})
+	writeAdminJSON(w, map[string]interface{}{
+		"rooms": rooms,
+	})
+}
+
+// summariseRoomVersions groups rooms by room version, ordered by room version.
+func summariseRoomVersions(infos []state.RoomVersionInfo) []roomVersionSummary {
+	versionToSummary := make(map[string]*roomVersionSummary)
+	for _, info := range infos {
+		summary := versionToSummary[info.RoomVersion]
+		if summary == nil {
+			summary = &roomVersionSummary{RoomVersion: info.RoomVersion}
+			versionToSummary[info.RoomVersion] = summary
+		}
+		if info.UpgradedRoomID != nil {
+			summary.UpgradedRooms++
+			continue
+		}
+		summary.Rooms++
+		summary.JoinedMembers += info.JoinCount
+		summary.InvitedMembers += info.InviteCount
+	}
+	summaries := make([]roomVersionSummary, 0, len(versionToSummary))
+	for _, summary := range versionToSummary {
+		summaries = append(summaries, *summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return lessRoomVersion(summaries[i].RoomVersion, summaries[j].RoomVersion)
+	})
+	return summaries
+}
+
+// lessRoomVersion orders numeric room versions numerically, followed by other versions (e.g experimental
+// ones) alphabetically.
+func lessRoomVersion(a, b string) bool {
+	aNum, aErr := strconv.Atoi(a)
+	bNum, bErr := strconv.Atoi(b)
+	switch {
+	case aErr == nil && bErr == nil:
+		return aNum < bNum
+	case aErr == nil:
+		return true
+	case bErr == nil:
+		return false
+	}
+	return a < b
+}
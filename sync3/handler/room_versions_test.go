@@ -0,0 +1,30 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/state"
+)
+
+func TestSummariseRoomVersions(t *testing.T) {
+	upgradedRoomID := "!new:localhost"
+	infos := []state.RoomVersionInfo{
+		{RoomID: "!a:localhost", RoomVersion: "10", JoinCount: 5, InviteCount: 1},
+		{RoomID: "!b:localhost", RoomVersion: "1", JoinCount: 2},
+		{RoomID: "!c:localhost", RoomVersion: "org.example.experimental", JoinCount: 1},
+		{RoomID: "!d:localhost", RoomVersion: "9", JoinCount: 3, InviteCount: 2},
+		{RoomID: "!e:localhost", RoomVersion: "10", JoinCount: 4},
+		{RoomID: "!f:localhost", RoomVersion: "1", JoinCount: 100, UpgradedRoomID: &upgradedRoomID},
+	}
+	want := []roomVersionSummary{
+		{RoomVersion: "1", Rooms: 1, UpgradedRooms: 1, JoinedMembers: 2},
+		{RoomVersion: "9", Rooms: 1, JoinedMembers: 3, InvitedMembers: 2},
+		{RoomVersion: "10", Rooms: 2, JoinedMembers: 9, InvitedMembers: 1},
+		{RoomVersion: "org.example.experimental", Rooms: 1, JoinedMembers: 1},
+	}
+	got := summariseRoomVersions(infos)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("summariseRoomVersions:\ngot  %+v\nwant %+v", got, want)
+	}
+}
@@ -30,23 +30,20 @@ import (
 type RoomsBuilder struct {
 	subs       []sync3.RoomSubscription
 	subToRooms map[int][]string
+	// room ID -> the order the room was first added in, lower is higher priority
+	priority map[string]int
 }
 
 func NewRoomsBuilder() *RoomsBuilder {
 	return &RoomsBuilder{
 		subToRooms: make(map[int][]string),
+		priority:   make(map[string]int),
 	}
 }
 
 func (rb *RoomsBuilder) IncludesRoom(roomID string) bool {
-	for _, roomIDs := range rb.subToRooms {
-		for _, rid := range roomIDs {
-			if roomID == rid {
-				return true
-			}
-		}
-	}
-	return false
+	_, ok := rb.priority[roomID]
+	return ok
 }
 
 // Add a room subscription to the builder, e.g from a list or room subscription. This should NOT
@@ -60,6 +57,16 @@ func (rb *RoomsBuilder) AddSubscription(rs sync3.RoomSubscription) (id int) {
 func (rb *RoomsBuilder) AddRoomsToSubscription(ctx context.Context, id int, roomIDs []string) {
 	internal.AssertWithContext(ctx, "subscription ID is unknown", id < len(rb.subs))
 	rb.subToRooms[id] = append(rb.subToRooms[id], roomIDs...)
+	for _, roomID := range roomIDs {
+		if _, ok := rb.priority[roomID]; !ok {
+			rb.priority[roomID] = len(rb.priority)
+		}
+	}
+}
+
+// NumRooms returns the number of distinct rooms added to the builder.
+func (rb *RoomsBuilder) NumRooms() int {
+	return len(rb.priority)
 }
 
 // Work out which subscriptions need to be combined and produce a new set of subscriptions -> room IDs.
@@ -121,6 +128,39 @@ func (rb *RoomsBuilder) BuildSubscriptions() (result []BuiltSubscription) {
 	return result
 }
 
+// BuildSubscriptionBatches is like BuildSubscriptions, but splits the result into batches of at most
+// batchSize rooms, ordered by priority. Rooms added to the builder first have the highest priority, so
+// room subscriptions come before lists, and lists are in the order their rooms were added.
+func (rb *RoomsBuilder) BuildSubscriptionBatches(batchSize int) (result []BuiltSubscription) {
+	type roomWithSub struct {
+		roomID string
+		sub    int
+	}
+	built := rb.BuildSubscriptions()
+	var rooms []roomWithSub
+	for i, bs := range built {
+		for _, roomID := range bs.RoomIDs {
+			rooms = append(rooms, roomWithSub{roomID: roomID, sub: i})
+		}
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rb.priority[rooms[i].roomID] < rb.priority[rooms[j].roomID]
+	})
+	// group runs of rooms with the same subscription
+	for i, r := range rooms {
+		last := len(result) - 1
+		if i > 0 && rooms[i-1].sub == r.sub && len(result[last].RoomIDs) < batchSize {
+			result[last].RoomIDs = append(result[last].RoomIDs, r.roomID)
+			continue
+		}
+		result = append(result, BuiltSubscription{
+			RoomSubscription: built[r.sub].RoomSubscription,
+			RoomIDs:          []string{r.roomID},
+		})
+	}
+	return result
+}
+
 func subKey(subIDs ...int) string {
 	// we must sort so subscriptions are commutative
 	sort.Ints(subIDs)
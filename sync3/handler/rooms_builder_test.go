@@ -269,3 +269,30 @@ func TestRoomsBuilder(t *testing.T) {
 		}
 	}
 }
+
+func TestRoomsBuilderSubscriptionBatches(t *testing.T) {
+	rb := NewRoomsBuilder()
+	a := rb.AddSubscription(sync3.RoomSubscription{TimelineLimit: 1})
+	rb.AddRoomsToSubscription(context.Background(), a, []string{"!1", "!2", "!3"})
+	b := rb.AddSubscription(sync3.RoomSubscription{TimelineLimit: 5})
+	rb.AddRoomsToSubscription(context.Background(), b, []string{"!4", "!2", "!5", "!6"})
+	if rb.NumRooms() != 6 {
+		t.Errorf("NumRooms: got %d want 6", rb.NumRooms())
+	}
+	// !2 is in both subscriptions so has a combined subscription, but keeps its priority from the first
+	got := rb.BuildSubscriptionBatches(2)
+	want := [][]string{{"!1"}, {"!2"}, {"!3"}, {"!4", "!5"}, {"!6"}}
+	var gotRoomIDs [][]string
+	for _, bs := range got {
+		gotRoomIDs = append(gotRoomIDs, bs.RoomIDs)
+	}
+	if !reflect.DeepEqual(gotRoomIDs, want) {
+		t.Fatalf("got batches %v want %v", gotRoomIDs, want)
+	}
+	wantTimelineLimits := []int64{1, 5, 1, 5, 5}
+	for i, bs := range got {
+		if bs.RoomSubscription.TimelineLimit != wantTimelineLimits[i] {
+			t.Errorf("batch %d: got timeline_limit %d want %d", i, bs.RoomSubscription.TimelineLimit, wantTimelineLimits[i])
+		}
+	}
+}
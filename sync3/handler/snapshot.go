@@ -0,0 +1,244 @@
+package handler
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+// The max number of snapshots waiting to be written to disk. Snapshots are dropped if the writer falls behind.
+const listSnapshotQueueSize = 64
+
+// listSnapshot is the file format for a single snapshot of a connection's lists.
+type listSnapshot struct {
+	UserID   string                        `json:"user_id"`
+	DeviceID string                        `json:"device_id"`
+	Time     time.Time                     `json:"time"`
+	Lists    map[string]sync3.ListSnapshot `json:"lists"`
+}
+
+// ListSnapshotter periodically dumps the list state of sampled users to gzipped JSON files, so when a user
+// reports that their room list was wrong at a particular time, the state of the server can be reconstructed.
+//
+// Snapshots are written to <dir>/<url-escaped user ID>/<unix timestamp>_<url-escaped device ID>.json.gz and are
+// deleted once they are older than the retention period.
+type ListSnapshotter struct {
+	dir        string
+	interval   time.Duration
+	retention  time.Duration
+	sampleRate float64
+	queue      chan *listSnapshot
+	stop       chan struct{}
+	stopOnce   sync.Once
+
+	connsMu sync.Mutex
+	conns   map[*listSnapshotConn]struct{}
+}
+
+// NewListSnapshotter creates a snapshotter which snapshots a fraction `sampleRate` (0-1) of users every
+// `interval`, keeping files for `retention`. Call Start to begin writing snapshots.
+func NewListSnapshotter(dir string, interval, retention time.Duration, sampleRate float64) *ListSnapshotter {
+	return &ListSnapshotter{
+		dir:        dir,
+		interval:   interval,
+		retention:  retention,
+		sampleRate: sampleRate,
+		queue:      make(chan *listSnapshot, listSnapshotQueueSize),
+		stop:       make(chan struct{}),
+		conns:      make(map[*listSnapshotConn]struct{}),
+	}
+}
+
+// Start the goroutines which take, write and expire snapshots.
+func (s *ListSnapshotter) Start() error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create list snapshot directory: %w", err)
+	}
+	go s.writeLoop()
+	go s.tickLoop()
+	return nil
+}
+
+// Stop taking, writing and expiring snapshots. Queued snapshots are discarded. Safe to call more than once.
+func (s *ListSnapshotter) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+}
+
+// Sampled returns true if this user's lists should be snapshotted. Sampling is based on a hash of the user ID
+// so the same users are sampled across restarts.
+func (s *ListSnapshotter) Sampled(userID string) bool {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	return float64(h.Sum32()%10000) < s.sampleRate*10000
+}
+
+// track starts snapshotting a connection, returning nil if the user isn't sampled. The connection must call
+// setLists whenever its lists may have changed, and untrack when it is destroyed.
+func (s *ListSnapshotter) track(userID, deviceID string) *listSnapshotConn {
+	if !s.Sampled(userID) {
+		return nil
+	}
+	c := &listSnapshotConn{
+		snapshotter: s,
+		userID:      userID,
+		deviceID:    deviceID,
+	}
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	s.conns[c] = struct{}{}
+	return c
+}
+
+// snapshot queues a snapshot of every tracked connection which has lists.
+func (s *ListSnapshotter) snapshot(now time.Time) {
+	s.connsMu.Lock()
+	conns := make([]*listSnapshotConn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.connsMu.Unlock()
+	for _, c := range conns {
+		lists := c.getLists()
+		if lists == nil {
+			continue
+		}
+		select {
+		case s.queue <- &listSnapshot{
+			UserID:   c.userID,
+			DeviceID: c.deviceID,
+			Time:     now,
+			Lists:    lists,
+		}:
+		default:
+			logger.Warn().Str("user", c.userID).Str("device", c.deviceID).Msg("list snapshot queue full, dropping snapshot")
+		}
+	}
+}
+
+func (s *ListSnapshotter) tickLoop() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			s.snapshot(now)
+			s.expire(now.Add(-s.retention))
+		}
+	}
+}
+
+func (s *ListSnapshotter) writeLoop() {
+	for {
+		select {
+		case <-s.stop:
+			return
+		case snapshot := <-s.queue:
+			if err := s.write(snapshot); err != nil {
+				logger.Err(err).Str("user", snapshot.UserID).Str("device", snapshot.DeviceID).Msg("failed to write list snapshot")
+			}
+		}
+	}
+}
+
+func (s *ListSnapshotter) write(snapshot *listSnapshot) error {
+	userDir := filepath.Join(s.dir, url.PathEscape(snapshot.UserID))
+	if err := os.MkdirAll(userDir, 0700); err != nil {
+		return err
+	}
+	filename := fmt.Sprintf("%d_%s.json.gz", snapshot.Time.Unix(), url.PathEscape(snapshot.DeviceID))
+	f, err := os.OpenFile(filepath.Join(userDir, filename), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	if err := json.NewEncoder(gz).Encode(snapshot); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// expire deletes all snapshots older than `before`, along with any user directories which are then empty.
+func (s *ListSnapshotter) expire(before time.Time) {
+	userDirs, err := os.ReadDir(s.dir)
+	if err != nil {
+		logger.Err(err).Msg("failed to read list snapshot directory")
+		return
+	}
+	for _, userDir := range userDirs {
+		if !userDir.IsDir() {
+			continue
+		}
+		userPath := filepath.Join(s.dir, userDir.Name())
+		files, err := os.ReadDir(userPath)
+		if err != nil {
+			logger.Err(err).Str("dir", userPath).Msg("failed to read list snapshot directory")
+			continue
+		}
+		remaining := len(files)
+		for _, file := range files {
+			var ts int64
+			if _, err := fmt.Sscanf(strings.SplitN(file.Name(), "_", 2)[0], "%d", &ts); err != nil {
+				continue
+			}
+			if time.Unix(ts, 0).Before(before) {
+				if err := os.Remove(filepath.Join(userPath, file.Name())); err != nil {
+					logger.Err(err).Str("file", file.Name()).Msg("failed to remove list snapshot")
+					continue
+				}
+				remaining--
+			}
+		}
+		if remaining == 0 {
+			os.Remove(userPath)
+		}
+	}
+}
+
+// listSnapshotConn holds the latest lists of a sampled connection. It is written to by requests on the
+// connection and read by the snapshotter's ticker, so it has its own lock rather than relying on the connection's.
+type listSnapshotConn struct {
+	snapshotter *ListSnapshotter
+	userID      string
+	deviceID    string
+
+	mu    sync.Mutex
+	lists map[string]sync3.ListSnapshot
+}
+
+// setLists remembers the connection's current lists. Lists only change whilst handling a request, so the
+// snapshotter can keep using these until the next request, however long the connection is idle.
+func (c *listSnapshotConn) setLists(lists *sync3.InternalRequestLists, muxedReqLists map[string]sync3.RequestList) {
+	// copy now, as the lists are only safe to read on the connection's goroutine
+	snapshot := lists.Snapshot(muxedReqLists)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lists = snapshot
+}
+
+func (c *listSnapshotConn) getLists() map[string]sync3.ListSnapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lists
+}
+
+// untrack stops snapshotting this connection.
+func (c *listSnapshotConn) untrack() {
+	c.snapshotter.connsMu.Lock()
+	defer c.snapshotter.connsMu.Unlock()
+	delete(c.snapshotter.conns, c)
+}
@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+func TestListSnapshotterWriteAndExpire(t *testing.T) {
+	dir := t.TempDir()
+	snapshotter := NewListSnapshotter(dir, time.Minute, time.Hour, 1)
+	if !snapshotter.Sampled("@alice:localhost") {
+		t.Fatalf("sample rate of 1 should sample everyone")
+	}
+
+	lists := sync3.NewInternalRequestLists()
+	lists.SetRoom(sync3.RoomConnMetadata{
+		RoomMetadata: internal.RoomMetadata{RoomID: "!a:localhost", LastMessageTimestamp: 100},
+	}, true)
+	lists.SetRoom(sync3.RoomConnMetadata{
+		RoomMetadata: internal.RoomMetadata{RoomID: "!b:localhost", LastMessageTimestamp: 200},
+	}, true)
+	sortBy := []string{sync3.SortByRecency}
+	lists.AssignList(context.Background(), "a", nil, sortBy, sync3.Overwrite)
+	reqLists := map[string]sync3.RequestList{"a": {Sort: sortBy}}
+
+	conn := snapshotter.track("@alice:localhost", "DEVICE")
+	// connections without lists yet aren't snapshotted
+	snapshotter.snapshot(time.Now())
+	if len(snapshotter.queue) != 0 {
+		t.Fatalf("snapshot taken before the connection had lists")
+	}
+	conn.setLists(lists, reqLists)
+	snapshotter.snapshot(time.Now())
+	if len(snapshotter.queue) != 1 {
+		t.Fatalf("expected a snapshot to be taken, got %d", len(snapshotter.queue))
+	}
+	snapshot := <-snapshotter.queue
+	if err := snapshotter.write(snapshot); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*.json.gz"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected 1 snapshot file, got %v err=%v", files, err)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("gzip: %s", err)
+	}
+	var got listSnapshot
+	if err := json.NewDecoder(gz).Decode(&got); err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+	f.Close()
+	rooms := got.Lists["a"].Rooms
+	if len(rooms) != 2 || rooms[0].RoomID != "!b:localhost" || rooms[1].RoomID != "!a:localhost" {
+		t.Fatalf("snapshot has wrong rooms: %+v", rooms)
+	}
+
+	// untracked connections aren't snapshotted
+	conn.untrack()
+	snapshotter.snapshot(time.Now())
+	if len(snapshotter.queue) != 0 {
+		t.Fatalf("snapshot taken after the connection was untracked")
+	}
+
+	// not old enough to expire
+	snapshotter.expire(time.Now().Add(-time.Hour))
+	if _, err := os.Stat(files[0]); err != nil {
+		t.Fatalf("snapshot was expired too early: %s", err)
+	}
+	snapshotter.expire(time.Now().Add(time.Hour))
+	if _, err := os.Stat(filepath.Dir(files[0])); !os.IsNotExist(err) {
+		t.Fatalf("expected user directory to be removed, got err=%v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// ReadyPath reports how far through starting up the server is. It returns HTTP 200 once sync requests can
+// be served, and HTTP 503 before then.
+const ReadyPath = "/_syncv3/ready"
+
+// The phases of a background startup, in order.
+const (
+	startupPhaseMemberships = "loading_memberships"
+	startupPhaseRooms       = "loading_rooms"
+	startupPhaseDone        = "done"
+)
+
+// how many rooms to load per batch when warming the global cache in the background
+const startupWarmBatchSize = 500
+
+// startupProgress tracks a background startup. Sync requests can be served from the rooms phase onwards,
+// as room metadata which has not been warmed yet is loaded when it is first used.
+type startupProgress struct {
+	mu          *sync.Mutex
+	phase       string
+	roomsLoaded int
+	roomsTotal  int
+}
+
+type readiness struct {
+	Ready       bool   `json:"ready"`
+	Phase       string `json:"phase"`
+	RoomsLoaded int    `json:"rooms_loaded"`
+	RoomsTotal  int    `json:"rooms_total"`
+}
+
+func (p *startupProgress) readiness() readiness {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return readiness{
+		Ready:       p.phase != startupPhaseMemberships,
+		Phase:       p.phase,
+		RoomsLoaded: p.roomsLoaded,
+		RoomsTotal:  p.roomsTotal,
+	}
+}
+
+func (p *startupProgress) setPhase(phase string, roomsTotal int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.phase = phase
+	p.roomsTotal = roomsTotal
+}
+
+func (p *startupProgress) addRoomsLoaded(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.roomsLoaded += n
+}
+
+// StartupInBackground is an alternative to Startup then Listen for large deployments, where loading every
+// room takes minutes. It returns straight away so the server can start listening. Sync requests are
+// rejected with HTTP 503 until everyone's memberships have loaded, then room metadata is loaded when it is
+// first used, whilst the rest is loaded in the background. Progress is reported at ReadyPath.
+func (h *SyncLiveHandler) StartupInBackground() {
+	h.GlobalCache.SetLazyLoading()
+	h.startup = &startupProgress{
+		mu:    &sync.Mutex{},
+		phase: startupPhaseMemberships,
+	}
+	go func() {
+		storeSnapshot, err := h.Storage.MembershipSnapshot()
+		if err != nil {
+			sentry.CaptureException(err)
+			logger.Panic().Err(err).Msg("StartupInBackground: failed to load memberships")
+		}
+		if err = h.Startup(&storeSnapshot); err != nil {
+			sentry.CaptureException(err)
+			logger.Panic().Err(err).Msg("StartupInBackground: failed to start up")
+		}
+		h.Listen()
+		roomIDs := make([]string, 0, len(storeSnapshot.AllJoinedMembers))
+		for roomID := range storeSnapshot.AllJoinedMembers {
+			roomIDs = append(roomIDs, roomID)
+		}
+		h.startup.setPhase(startupPhaseRooms, len(roomIDs))
+		logger.Info().Int("rooms", len(roomIDs)).Msg("StartupInBackground: memberships loaded, serving requests whilst loading rooms")
+		h.warmGlobalCache(roomIDs)
+		h.startup.setPhase(startupPhaseDone, len(roomIDs))
+		logger.Info().Int("rooms", len(roomIDs)).Msg("StartupInBackground: all rooms loaded")
+	}()
+}
+
+// warmGlobalCache loads the metadata for these rooms in batches, so users don't have to wait for it when
+// they first make a request. Rooms which were loaded by a request in the meantime are not loaded again.
+func (h *SyncLiveHandler) warmGlobalCache(roomIDs []string) {
+	for start := 0; start < len(roomIDs); start += startupWarmBatchSize {
+		end := start + startupWarmBatchSize
+		if end > len(roomIDs) {
+			end = len(roomIDs)
+		}
+		h.GlobalCache.LoadRooms(context.Background(), roomIDs[start:end]...)
+		h.startup.addRoomsLoaded(end - start)
+	}
+}
+
+// startupReady returns true if sync requests can be served. Always true unless StartupInBackground is used.
+func (h *SyncLiveHandler) startupReady() bool {
+	return h.startup == nil || h.startup.readiness().Ready
+}
+
+func (h *SyncLiveHandler) serveReady(w http.ResponseWriter) {
+	r := readiness{
+		Ready: true,
+		Phase: startupPhaseDone,
+	}
+	if h.startup != nil {
+		r = h.startup.readiness()
+	}
+	b, _ := json.Marshal(r)
+	w.Header().Set("Content-Type", "application/json")
+	if !r.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(b)
+}
+
+// notReadyError is returned for sync requests which arrive before StartupInBackground has loaded memberships.
+func notReadyError() *internal.HandlerError {
+	return &internal.HandlerError{
+		StatusCode: http.StatusServiceUnavailable,
+		Err:        fmt.Errorf("server is starting up, try again later"),
+	}
+}
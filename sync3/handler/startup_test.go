@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestServeReady(t *testing.T) {
+	h := &SyncLiveHandler{}
+	getReady := func() (int, readiness) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", ReadyPath, nil))
+		var r readiness
+		if err := json.Unmarshal(w.Body.Bytes(), &r); err != nil {
+			t.Fatalf("failed to decode readiness: %s", err)
+		}
+		return w.Code, r
+	}
+
+	// started up in the foreground, so always ready
+	if code, r := getReady(); code != 200 || !r.Ready || r.Phase != startupPhaseDone {
+		t.Errorf("foreground startup: got HTTP %d %+v want ready", code, r)
+	}
+
+	h.startup = &startupProgress{mu: &sync.Mutex{}, phase: startupPhaseMemberships}
+	if h.startupReady() {
+		t.Errorf("startupReady returned true whilst loading memberships")
+	}
+	if code, r := getReady(); code != 503 || r.Ready || r.Phase != startupPhaseMemberships {
+		t.Errorf("loading memberships: got HTTP %d %+v want not ready", code, r)
+	}
+
+	// requests are served whilst rooms are loaded
+	h.startup.setPhase(startupPhaseRooms, 10)
+	h.startup.addRoomsLoaded(4)
+	if !h.startupReady() {
+		t.Errorf("startupReady returned false whilst loading rooms")
+	}
+	code, r := getReady()
+	want := readiness{Ready: true, Phase: startupPhaseRooms, RoomsLoaded: 4, RoomsTotal: 10}
+	if code != 200 || r != want {
+		t.Errorf("loading rooms: got HTTP %d %+v want 200 %+v", code, r, want)
+	}
+}
@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+// usageCounts are the raw totals which a stats report is calculated from.
+type usageCounts struct {
+	TotalUsers       int
+	DailyActiveUsers int
+	TotalRooms       int
+	LatestEventNID   int64
+}
+
+// statsReport is the JSON body posted to the stats endpoint. It must not contain anything which identifies
+// the deployment or its users.
+type statsReport struct {
+	Version          string `json:"version"`
+	GoVersion        string `json:"go_version"`
+	UptimeSecs       int64  `json:"uptime_secs"`
+	TotalUsers       int    `json:"total_users"`
+	DailyActiveUsers int    `json:"daily_active_users"`
+	TotalRooms       int    `json:"total_rooms"`
+	DailyEvents      int64  `json:"daily_events"`
+}
+
+// StatsReporter periodically posts anonymous aggregate usage statistics to an endpoint, so maintainers can
+// understand the scale of deployments. It is opt-in: nothing is reported unless an endpoint is configured.
+type StatsReporter struct {
+	endpoint string
+	version  string
+	interval time.Duration
+	client   *http.Client
+	counts   func() (usageCounts, error)
+	stop     chan struct{}
+
+	startTime time.Time
+	// the event NID at the time of the last report, used to calculate the number of events per day
+	lastNID  int64
+	lastTime time.Time
+}
+
+// NewStatsReporter creates a reporter which posts to `endpoint` every `interval`. Call Start to begin reporting.
+func NewStatsReporter(endpoint, version string, interval time.Duration, store *state.Storage, v2Store *sync2.Storage) *StatsReporter {
+	return &StatsReporter{
+		endpoint: endpoint,
+		version:  version,
+		interval: interval,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+		counts: func() (c usageCounts, err error) {
+			c.TotalUsers, c.DailyActiveUsers, err = v2Store.CountUsers(time.Now().Add(-24 * time.Hour))
+			if err != nil {
+				return c, fmt.Errorf("CountUsers: %w", err)
+			}
+			c.TotalRooms, err = store.NumRooms()
+			if err != nil {
+				return c, fmt.Errorf("NumRooms: %w", err)
+			}
+			c.LatestEventNID, err = store.LatestEventNID()
+			if err != nil {
+				return c, fmt.Errorf("LatestEventNID: %w", err)
+			}
+			return c, nil
+		},
+		stop: make(chan struct{}),
+	}
+}
+
+// Start reporting. The first report is sent after one interval, so the number of events per day can be
+// calculated from a full interval.
+func (r *StatsReporter) Start() error {
+	counts, err := r.counts()
+	if err != nil {
+		return fmt.Errorf("failed to load initial usage counts: %w", err)
+	}
+	r.startTime = time.Now()
+	r.lastTime = r.startTime
+	r.lastNID = counts.LatestEventNID
+	go r.loop()
+	return nil
+}
+
+// Stop reporting.
+func (r *StatsReporter) Stop() {
+	close(r.stop)
+}
+
+func (r *StatsReporter) loop() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			if err := r.report(time.Now()); err != nil {
+				// reporting is best effort, so don't send this to sentry
+				logger.Warn().Err(err).Str("endpoint", r.endpoint).Msg("failed to report usage stats")
+			}
+		}
+	}
+}
+
+func (r *StatsReporter) report(now time.Time) error {
+	counts, err := r.counts()
+	if err != nil {
+		sentry.CaptureException(err)
+		return err
+	}
+	report := statsReport{
+		Version:          r.version,
+		GoVersion:        runtime.Version(),
+		UptimeSecs:       int64(now.Sub(r.startTime).Seconds()),
+		TotalUsers:       counts.TotalUsers,
+		DailyActiveUsers: counts.DailyActiveUsers,
+		TotalRooms:       counts.TotalRooms,
+	}
+	// event NIDs are allocated sequentially, so the difference is the number of events stored since the last report
+	if elapsed := now.Sub(r.lastTime); elapsed > 0 {
+		report.DailyEvents = int64(float64(counts.LatestEventNID-r.lastNID) * float64(24*time.Hour) / float64(elapsed))
+	}
+	r.lastNID = counts.LatestEventNID
+	r.lastTime = now
+
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	res, err := r.client.Post(r.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("stats endpoint returned HTTP %d", res.StatusCode)
+	}
+	logger.Info().Int("users", report.TotalUsers).Int("rooms", report.TotalRooms).Msg("reported usage stats")
+	return nil
+}
@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStatsReporter(t *testing.T) {
+	reports := make(chan statsReport, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var report statsReport
+		if err := json.NewDecoder(req.Body).Decode(&report); err != nil {
+			t.Errorf("failed to decode stats report: %s", err)
+		}
+		reports <- report
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	counts := usageCounts{
+		TotalUsers:       10,
+		DailyActiveUsers: 4,
+		TotalRooms:       20,
+		LatestEventNID:   1000,
+	}
+	reporter := NewStatsReporter(srv.URL, "v1.2.3", time.Hour, nil, nil)
+	reporter.counts = func() (usageCounts, error) {
+		return counts, nil
+	}
+	if err := reporter.Start(); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	reporter.Stop()
+
+	// 500 events in 12 hours is 1000 events per day
+	counts.LatestEventNID = 1500
+	if err := reporter.report(reporter.startTime.Add(12 * time.Hour)); err != nil {
+		t.Fatalf("report: %s", err)
+	}
+	got := <-reports
+	want := statsReport{
+		Version:          "v1.2.3",
+		GoVersion:        got.GoVersion,
+		UptimeSecs:       12 * 60 * 60,
+		TotalUsers:       10,
+		DailyActiveUsers: 4,
+		TotalRooms:       20,
+		DailyEvents:      1000,
+	}
+	if got != want {
+		t.Errorf("got report %+v want %+v", got, want)
+	}
+	if got.GoVersion == "" {
+		t.Errorf("report is missing the go version")
+	}
+
+	// the next report only counts events since the last report
+	counts.LatestEventNID = 1600
+	if err := reporter.report(reporter.startTime.Add(24 * time.Hour)); err != nil {
+		t.Fatalf("report: %s", err)
+	}
+	if got = <-reports; got.DailyEvents != 200 {
+		t.Errorf("got %d daily events, want 200", got.DailyEvents)
+	}
+}
+
+func TestStatsReporterEndpointError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(500)
+	}))
+	defer srv.Close()
+	reporter := NewStatsReporter(srv.URL, "v1.2.3", time.Hour, nil, nil)
+	reporter.counts = func() (usageCounts, error) {
+		return usageCounts{}, nil
+	}
+	if err := reporter.Start(); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	reporter.Stop()
+	if err := reporter.report(time.Now()); err == nil {
+		t.Errorf("report succeeded despite the endpoint returning a 500")
+	}
+}
@@ -0,0 +1,293 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TenantQuota limits how much of the proxy a single tenant can use. Zero means no limit.
+type TenantQuota struct {
+	// The number of users who can have connections at the same time.
+	MaxUsers int `json:"max_users"`
+	// The number of connections across all users.
+	MaxConns int `json:"max_conns"`
+	// The amount of DB time the tenant's requests can use each hour, in milliseconds.
+	DBBudgetMSPerHour int64 `json:"db_budget_ms_per_hour"`
+}
+
+// TenantConfig describes the tenants served by the proxy, for hosting providers which run one proxy for
+// many customers. By default, every homeserver is its own tenant.
+type TenantConfig struct {
+	// The quota for tenants which aren't in Quotas.
+	Default TenantQuota `json:"default"`
+	// tenant => quota
+	Quotas map[string]TenantQuota `json:"quotas"`
+	// server name => tenant, for tenants with more than one server.
+	Servers map[string]string `json:"servers"`
+}
+
+// LoadTenantConfig reads a JSON encoded TenantConfig from path.
+func LoadTenantConfig(path string) (*TenantConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg TenantConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse tenant config %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// TenantUsage is how much of the proxy a tenant is currently using.
+type TenantUsage struct {
+	Tenant string `json:"tenant"`
+	Users  int    `json:"users"`
+	Conns  int    `json:"conns"`
+	// DB time used so far this hour
+	DBTimeMS int64       `json:"db_time_ms"`
+	Quota    TenantQuota `json:"quota"`
+}
+
+type tenantUsage struct {
+	// user ID => number of connections
+	users map[string]int
+	conns int
+	// unix time of the start of the hour which dbTime is for
+	dbTimeHour int64
+	dbTime     time.Duration
+}
+
+// Tenants groups users into tenants and enforces per-tenant quotas.
+type Tenants struct {
+	cfg   TenantConfig
+	mu    sync.Mutex
+	usage map[string]*tenantUsage
+	now   func() time.Time
+
+	numConns *prometheus.GaugeVec
+	numUsers *prometheus.GaugeVec
+	dbTime   *prometheus.CounterVec
+	rejected *prometheus.CounterVec
+}
+
+func NewTenants(cfg TenantConfig) *Tenants {
+	return &Tenants{
+		cfg:   cfg,
+		usage: make(map[string]*tenantUsage),
+		now:   time.Now,
+	}
+}
+
+func (t *Tenants) addPrometheusMetrics() {
+	t.numConns = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "tenant_conns",
+		Help:      "Number of active sliding sync connections per tenant.",
+	}, []string{"tenant"})
+	t.numUsers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "tenant_users",
+		Help:      "Number of users with active sliding sync connections per tenant.",
+	}, []string{"tenant"})
+	t.dbTime = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "tenant_db_time_secs",
+		Help:      "Time spent in the database serving requests per tenant.",
+	}, []string{"tenant"})
+	t.rejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "tenant_rejected_requests",
+		Help:      "Number of requests rejected because the tenant exceeded a quota.",
+	}, []string{"tenant", "reason"})
+	prometheus.MustRegister(t.numConns)
+	prometheus.MustRegister(t.numUsers)
+	prometheus.MustRegister(t.dbTime)
+	prometheus.MustRegister(t.rejected)
+}
+
+func (t *Tenants) teardown() {
+	if t.numConns == nil {
+		return
+	}
+	prometheus.Unregister(t.numConns)
+	prometheus.Unregister(t.numUsers)
+	prometheus.Unregister(t.dbTime)
+	prometheus.Unregister(t.rejected)
+}
+
+// TenantForUser returns the tenant this user belongs to.
+func (t *Tenants) TenantForUser(userID string) string {
+	server := userID
+	if i := strings.Index(userID, ":"); i >= 0 {
+		server = userID[i+1:]
+	}
+	if tenant, ok := t.cfg.Servers[server]; ok {
+		return tenant
+	}
+	return server
+}
+
+func (t *Tenants) quota(tenant string) TenantQuota {
+	if q, ok := t.cfg.Quotas[tenant]; ok {
+		return q
+	}
+	return t.cfg.Default
+}
+
+// usageFor returns the usage for this tenant, resetting its DB time if the hour has changed. Must be called
+// with the lock held.
+func (t *Tenants) usageFor(tenant string) *tenantUsage {
+	u, ok := t.usage[tenant]
+	if !ok {
+		u = &tenantUsage{
+			users: make(map[string]int),
+		}
+		t.usage[tenant] = u
+	}
+	hour := t.now().Truncate(time.Hour).Unix()
+	if u.dbTimeHour != hour {
+		u.dbTimeHour = hour
+		u.dbTime = 0
+	}
+	return u
+}
+
+// OpenConn reserves a connection for this user. Set replacing if this connection replaces one of the
+// user's existing connections, in which case the connection and user quotas are not checked. Returns an
+// error if the tenant has exceeded a quota. Otherwise, the returned function must be called when the
+// connection is closed. It is safe to call it more than once.
+func (t *Tenants) OpenConn(userID string, replacing bool) (func(), *internal.HandlerError) {
+	tenant := t.TenantForUser(userID)
+	quota := t.quota(tenant)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.usageFor(tenant)
+	if herr := t.checkBudget(tenant, quota, u); herr != nil {
+		return nil, herr
+	}
+	if !replacing {
+		if quota.MaxConns > 0 && u.conns >= quota.MaxConns {
+			return nil, t.reject(tenant, "max_conns", fmt.Errorf("tenant %s has too many connections", tenant))
+		}
+		if _, exists := u.users[userID]; !exists && quota.MaxUsers > 0 && len(u.users) >= quota.MaxUsers {
+			return nil, t.reject(tenant, "max_users", fmt.Errorf("tenant %s has too many users", tenant))
+		}
+	}
+	u.conns++
+	u.users[userID]++
+	t.updateMetrics(tenant, u)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.closeConn(tenant, userID)
+		})
+	}, nil
+}
+
+func (t *Tenants) closeConn(tenant, userID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.usageFor(tenant)
+	u.conns--
+	u.users[userID]--
+	if u.users[userID] <= 0 {
+		delete(u.users, userID)
+	}
+	t.updateMetrics(tenant, u)
+}
+
+// CheckBudget returns an error if this user's tenant has used all of its DB time for this hour.
+func (t *Tenants) CheckBudget(userID string) *internal.HandlerError {
+	tenant := t.TenantForUser(userID)
+	quota := t.quota(tenant)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.checkBudget(tenant, quota, t.usageFor(tenant))
+}
+
+// must hold the lock
+func (t *Tenants) checkBudget(tenant string, quota TenantQuota, u *tenantUsage) *internal.HandlerError {
+	if quota.DBBudgetMSPerHour > 0 && u.dbTime.Milliseconds() >= quota.DBBudgetMSPerHour {
+		return t.reject(tenant, "db_budget", fmt.Errorf("tenant %s has used its database budget for this hour", tenant))
+	}
+	return nil
+}
+
+// AddDBTime records the DB time used to serve a request for this user.
+func (t *Tenants) AddDBTime(userID string, dbTime time.Duration) {
+	tenant := t.TenantForUser(userID)
+	t.mu.Lock()
+	t.usageFor(tenant).dbTime += dbTime
+	t.mu.Unlock()
+	if t.dbTime != nil {
+		t.dbTime.WithLabelValues(tenant).Add(dbTime.Seconds())
+	}
+}
+
+// Usage returns the current usage of every tenant which has been seen, sorted by tenant.
+func (t *Tenants) Usage() []TenantUsage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	result := make([]TenantUsage, 0, len(t.usage))
+	for tenant := range t.usage {
+		u := t.usageFor(tenant)
+		result = append(result, TenantUsage{
+			Tenant:   tenant,
+			Users:    len(u.users),
+			Conns:    u.conns,
+			DBTimeMS: u.dbTime.Milliseconds(),
+			Quota:    t.quota(tenant),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Tenant < result[j].Tenant
+	})
+	return result
+}
+
+// must hold the lock
+func (t *Tenants) reject(tenant, reason string, err error) *internal.HandlerError {
+	if t.rejected != nil {
+		t.rejected.WithLabelValues(tenant, reason).Inc()
+	}
+	return &internal.HandlerError{
+		StatusCode: http.StatusTooManyRequests,
+		Err:        err,
+		ErrCode:    "M_LIMIT_EXCEEDED",
+	}
+}
+
+// must hold the lock
+func (t *Tenants) updateMetrics(tenant string, u *tenantUsage) {
+	if t.numConns == nil {
+		return
+	}
+	t.numConns.WithLabelValues(tenant).Set(float64(u.conns))
+	t.numUsers.WithLabelValues(tenant).Set(float64(len(u.users)))
+}
+
+// GET /_syncv3/admin/tenants
+// Returns the current usage and quota of each tenant.
+func (h *SyncLiveHandler) adminListTenants(w http.ResponseWriter, req *http.Request) {
+	usage := []TenantUsage{}
+	if h.Tenants != nil {
+		usage = h.Tenants.Usage()
+	}
+	writeAdminJSON(w, map[string]interface{}{
+		"tenants": usage,
+	})
+}
@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+func TestTenantForUser(t *testing.T) {
+	tenants := NewTenants(TenantConfig{
+		Servers: map[string]string{
+			"a.example.org": "acme",
+			"b.example.org": "acme",
+		},
+	})
+	testCases := map[string]string{
+		"@alice:a.example.org": "acme",
+		"@bob:b.example.org":   "acme",
+		"@charlie:other.org":   "other.org",
+		"@dave:other.org:8448": "other.org:8448",
+	}
+	for userID, want := range testCases {
+		if got := tenants.TenantForUser(userID); got != want {
+			t.Errorf("TenantForUser(%s): got %s want %s", userID, got, want)
+		}
+	}
+}
+
+func TestTenantConnQuotas(t *testing.T) {
+	tenants := NewTenants(TenantConfig{
+		Default: TenantQuota{MaxUsers: 2, MaxConns: 3},
+		Quotas: map[string]TenantQuota{
+			"big.org": {},
+		},
+	})
+	closeA1, herr := tenants.OpenConn("@alice:small.org", false)
+	assertNoHandlerError(t, herr)
+	_, herr = tenants.OpenConn("@alice:small.org", false)
+	assertNoHandlerError(t, herr)
+	closeB, herr := tenants.OpenConn("@bob:small.org", false)
+	assertNoHandlerError(t, herr)
+	// too many conns
+	_, herr = tenants.OpenConn("@alice:small.org", false)
+	assertQuotaError(t, herr)
+	// but replacing a connection is fine
+	closeReplaced, herr := tenants.OpenConn("@alice:small.org", true)
+	assertNoHandlerError(t, herr)
+	closeReplaced()
+
+	closeA1()
+	closeA1() // no-op
+	// too many users
+	_, herr = tenants.OpenConn("@charlie:small.org", false)
+	assertQuotaError(t, herr)
+	closeB()
+	_, herr = tenants.OpenConn("@charlie:small.org", false)
+	assertNoHandlerError(t, herr)
+
+	// other tenants are unaffected, and can have their own quotas
+	for i := 0; i < 10; i++ {
+		_, herr = tenants.OpenConn("@alice:big.org", false)
+		assertNoHandlerError(t, herr)
+	}
+
+	usage := tenants.Usage()
+	if len(usage) != 2 {
+		t.Fatalf("got %d tenants want 2", len(usage))
+	}
+	if usage[0].Tenant != "big.org" || usage[0].Conns != 10 || usage[0].Users != 1 {
+		t.Errorf("got usage %+v", usage[0])
+	}
+	if usage[1].Tenant != "small.org" || usage[1].Conns != 2 || usage[1].Users != 2 || usage[1].Quota.MaxConns != 3 {
+		t.Errorf("got usage %+v", usage[1])
+	}
+}
+
+func TestTenantDBBudget(t *testing.T) {
+	now := time.Date(2023, 1, 1, 10, 30, 0, 0, time.UTC)
+	tenants := NewTenants(TenantConfig{
+		Default: TenantQuota{DBBudgetMSPerHour: 100},
+	})
+	tenants.now = func() time.Time { return now }
+	assertNoHandlerError(t, tenants.CheckBudget("@alice:a.org"))
+	tenants.AddDBTime("@alice:a.org", 60*time.Millisecond)
+	tenants.AddDBTime("@bob:a.org", 60*time.Millisecond)
+	assertQuotaError(t, tenants.CheckBudget("@alice:a.org"))
+	_, herr := tenants.OpenConn("@charlie:a.org", false)
+	assertQuotaError(t, herr)
+	// other tenants have their own budget
+	assertNoHandlerError(t, tenants.CheckBudget("@alice:b.org"))
+	// the budget resets every hour
+	now = now.Add(time.Hour)
+	assertNoHandlerError(t, tenants.CheckBudget("@alice:a.org"))
+}
+
+func assertNoHandlerError(t *testing.T, herr *internal.HandlerError) {
+	t.Helper()
+	if herr != nil {
+		t.Fatalf("got error: %s", herr)
+	}
+}
+
+func assertQuotaError(t *testing.T, herr *internal.HandlerError) {
+	t.Helper()
+	if herr == nil {
+		t.Fatalf("got no error, want a quota error")
+	}
+	if herr.StatusCode != 429 || herr.ErrCode != "M_LIMIT_EXCEEDED" {
+		t.Fatalf("got error %s (%s), want a quota error", herr, herr.ErrCode)
+	}
+}
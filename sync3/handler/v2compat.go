@@ -0,0 +1,320 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/rs/zerolog/hlog"
+)
+
+// The max number of timeline events to return per room in a v2 compatible response.
+const v2CompatTimelineLimit = 20
+
+// serveV2Compat serves a sync v2 shaped response to legacy clients using the data the proxy already has,
+// so they can point at the proxy during migrations. This is a best-effort approximation of sync v2:
+//   - `state` is the current state of the room rather than the state at the start of the timeline.
+//   - account data is only sent on initial syncs as it is not versioned.
+//   - all pending invites are sent on every response.
+//   - rooms the user has left are only sent on incremental syncs, with the state at the time they left.
+//   - to-device messages, device lists and ephemeral events are not sent.
+//
+// The `since` token is an event position in the proxy's database.
+func (h *SyncLiveHandler) serveV2Compat(w http.ResponseWriter, req *http.Request) error {
+	deviceID, accessToken, err := internal.HashedTokenFromRequest(req)
+	if err != nil || accessToken == "" {
+		hlog.FromRequest(req).Warn().Err(err).Msg("failed to get device ID from request")
+		return &internal.HandlerError{
+			StatusCode: 400,
+			Err:        err,
+		}
+	}
+	v2device, herr := h.v2DeviceForToken(req, deviceID, accessToken)
+	if herr != nil {
+		return herr
+	}
+	if err := h.V3Pub.EnsurePolling(v2device.UserID, v2device.DeviceID); err != nil {
+		return internal.ToHandlerError(err)
+	}
+	internal.SetRequestContextUserID(req.Context(), v2device.UserID)
+
+	since, herr := parseIntFromQuery(req.URL, "since")
+	if herr != nil {
+		return herr
+	}
+	timeout, herr := parseIntFromQuery(req.URL, "timeout")
+	if herr != nil {
+		return herr
+	}
+	timeout = int64(clampTimeoutToDeadline(req.Context(), int(timeout)))
+
+	// Wait for something for this user if the client is up-to-date. Subscribe before building the response,
+	// so anything which arrives whilst it is being built wakes us up.
+	var waiter *v2CompatWaiter
+	var invitesBefore map[string]caches.UserRoomData
+	if since > 0 && timeout > 0 {
+		userCache, err := h.userCache(v2device.UserID)
+		if err != nil {
+			return &internal.HandlerError{
+				StatusCode: 500,
+				Err:        err,
+			}
+		}
+		waiter = &v2CompatWaiter{
+			since: since,
+			wake:  make(chan struct{}, 1),
+		}
+		id := userCache.Subsribe(waiter)
+		defer userCache.Unsubscribe(id)
+		invitesBefore = userCache.Invites()
+	}
+	timer := time.NewTimer(time.Duration(timeout) * time.Millisecond)
+	defer timer.Stop()
+	var res *sync2.SyncResponse
+waitLoop:
+	for {
+		latestPos, err := h.Storage.LatestEventNID()
+		if err != nil {
+			return &internal.HandlerError{
+				StatusCode: 500,
+				Err:        err,
+			}
+		}
+		res, herr = h.v2CompatResponse(req, v2device.UserID, deviceID, since, latestPos)
+		if herr != nil {
+			return herr
+		}
+		if waiter == nil || v2CompatHasChanges(res, invitesBefore) {
+			break
+		}
+		select {
+		case <-req.Context().Done():
+			break waitLoop
+		case <-timer.C:
+			break waitLoop
+		case <-waiter.wake:
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		return &internal.HandlerError{
+			StatusCode: 500,
+			Err:        err,
+		}
+	}
+	return nil
+}
+
+// v2CompatWaiter wakes a long-polling v2 compatible request when the user's cache is told about something
+// which may change the response.
+type v2CompatWaiter struct {
+	since int64
+	wake  chan struct{}
+}
+
+func (w *v2CompatWaiter) OnRoomUpdate(ctx context.Context, up caches.RoomUpdate) {
+	switch update := up.(type) {
+	case *caches.RoomEventUpdate:
+		if update.EventData.LatestPos > w.since {
+			w.notify()
+		}
+	case *caches.InviteUpdate, *caches.LeftRoomUpdate:
+		w.notify()
+	}
+}
+
+func (w *v2CompatWaiter) OnUpdate(ctx context.Context, up caches.Update) {}
+
+func (w *v2CompatWaiter) notify() {
+	select {
+	case w.wake <- struct{}{}:
+	default: // already woken
+	}
+}
+
+// v2CompatHasChanges returns true if the response has anything in it which the client hasn't already seen.
+// All pending invites are sent on every response, so invites only count if they differ from invitesBefore.
+func v2CompatHasChanges(res *sync2.SyncResponse, invitesBefore map[string]caches.UserRoomData) bool {
+	if len(res.Rooms.Join) > 0 || len(res.Rooms.Leave) > 0 || len(res.Rooms.Invite) != len(invitesBefore) {
+		return true
+	}
+	for roomID := range res.Rooms.Invite {
+		if _, ok := invitesBefore[roomID]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// v2CompatResponse builds a sync v2 response for the user containing all changes after `since` up to and
+// including `to`. If since is 0, this is an initial sync.
+func (h *SyncLiveHandler) v2CompatResponse(req *http.Request, userID, deviceID string, since, to int64) (*sync2.SyncResponse, *internal.HandlerError) {
+	ctx := req.Context()
+	isInitial := since == 0
+	userCache, err := h.userCache(userID)
+	if err != nil {
+		return nil, &internal.HandlerError{
+			StatusCode: 500,
+			Err:        err,
+		}
+	}
+	joinedRoomIDs, err := h.Storage.JoinedRoomsAfterPosition(userID, to)
+	if err != nil {
+		return nil, &internal.HandlerError{
+			StatusCode: 500,
+			Err:        err,
+		}
+	}
+	from := since
+	if !isInitial {
+		// since is exclusive, whereas from is inclusive
+		from = since + 1
+	}
+	// Timelines only include events the user could see, so they start at the user's join (or at `from` if
+	// they were already joined) and end at their leave. Rooms which were visible in this window but which the
+	// user is no longer joined or invited to are the rooms they left.
+	roomIDToRanges, err := h.Storage.VisibleEventNIDsBetween(userID, from, to)
+	if err != nil {
+		return nil, &internal.HandlerError{
+			StatusCode: 500,
+			Err:        err,
+		}
+	}
+	joined := make(map[string]bool, len(joinedRoomIDs))
+	for _, roomID := range joinedRoomIDs {
+		joined[roomID] = true
+	}
+	invites := userCache.Invites()
+	var leftRoomIDs []string
+	for roomID := range roomIDToRanges {
+		if joined[roomID] {
+			continue
+		}
+		if _, invited := invites[roomID]; invited || isInitial {
+			// sync v2 doesn't send left rooms on initial syncs unless asked to
+			delete(roomIDToRanges, roomID)
+			continue
+		}
+		leftRoomIDs = append(leftRoomIDs, roomID)
+	}
+	timelines, prevBatches, limited, err := h.Storage.LatestEventsInRangesWithLimited(roomIDToRanges, to, v2CompatTimelineLimit)
+	if err != nil {
+		return nil, &internal.HandlerError{
+			StatusCode: 500,
+			Err:        err,
+		}
+	}
+	timelines = userCache.AnnotateWithTransactionIDs(ctx, deviceID, timelines)
+
+	var changedRoomIDs []string
+	for _, roomID := range joinedRoomIDs {
+		if isInitial || len(timelines[roomID]) > 0 {
+			changedRoomIDs = append(changedRoomIDs, roomID)
+		}
+	}
+	roomToState := make(map[string][]state.Event)
+	if len(changedRoomIDs) > 0 {
+		roomToState, err = h.Storage.RoomStateAfterEventPosition(ctx, changedRoomIDs, to, nil)
+		if err != nil {
+			return nil, &internal.HandlerError{
+				StatusCode: 500,
+				Err:        err,
+			}
+		}
+	}
+
+	res := &sync2.SyncResponse{
+		NextBatch: strconv.FormatInt(to, 10),
+		Rooms: sync2.SyncRoomsResponse{
+			Join:   make(map[string]sync2.SyncV2JoinResponse, len(changedRoomIDs)),
+			Invite: make(map[string]sync2.SyncV2InviteResponse),
+			Leave:  make(map[string]sync2.SyncV2LeaveResponse, len(leftRoomIDs)),
+		},
+	}
+	roomIDToUserData := userCache.LoadRoomDatas(changedRoomIDs...)
+	for _, roomID := range changedRoomIDs {
+		var stateEvents []json.RawMessage
+		for _, ev := range roomToState[roomID] {
+			stateEvents = append(stateEvents, ev.JSON)
+		}
+		urd := roomIDToUserData[roomID]
+		timeline := timelines[roomID]
+		res.Rooms.Join[roomID] = sync2.SyncV2JoinResponse{
+			State: sync2.EventsResponse{
+				Events: stateEvents,
+			},
+			Timeline: sync2.TimelineResponse{
+				Events:    timeline,
+				Limited:   limited[roomID],
+				PrevBatch: prevBatches[roomID],
+			},
+			UnreadNotifications: sync2.UnreadNotifications{
+				HighlightCount:    &urd.HighlightCount,
+				NotificationCount: &urd.NotificationCount,
+			},
+		}
+	}
+	for _, roomID := range leftRoomIDs {
+		// the state when the user left, which is the end of the last range they could see
+		ranges := roomIDToRanges[roomID]
+		leftAt := ranges[len(ranges)-1][1]
+		roomState, err := h.Storage.RoomStateAt(ctx, roomID, leftAt, nil)
+		if err != nil {
+			return nil, &internal.HandlerError{
+				StatusCode: 500,
+				Err:        err,
+			}
+		}
+		var leave sync2.SyncV2LeaveResponse
+		for _, ev := range roomState {
+			leave.State.Events = append(leave.State.Events, ev.JSON)
+		}
+		leave.Timeline.Events = timelines[roomID]
+		leave.Timeline.Limited = limited[roomID]
+		leave.Timeline.PrevBatch = prevBatches[roomID]
+		res.Rooms.Leave[roomID] = leave
+	}
+	for roomID, urd := range invites {
+		res.Rooms.Invite[roomID] = sync2.SyncV2InviteResponse{
+			InviteState: sync2.EventsResponse{
+				Events: urd.Invite.InviteState,
+			},
+		}
+	}
+
+	if isInitial {
+		globalAccountData, err := h.Storage.AccountDatas(userID)
+		if err != nil {
+			return nil, &internal.HandlerError{
+				StatusCode: 500,
+				Err:        err,
+			}
+		}
+		for _, ad := range globalAccountData {
+			res.AccountData.Events = append(res.AccountData.Events, ad.Data)
+		}
+		if len(changedRoomIDs) > 0 {
+			roomAccountData, err := h.Storage.AccountDatas(userID, changedRoomIDs...)
+			if err != nil {
+				return nil, &internal.HandlerError{
+					StatusCode: 500,
+					Err:        err,
+				}
+			}
+			for _, ad := range roomAccountData {
+				room := res.Rooms.Join[ad.RoomID]
+				room.AccountData.Events = append(room.AccountData.Events, ad.Data)
+				res.Rooms.Join[ad.RoomID] = room
+			}
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+func TestV2CompatWaiter(t *testing.T) {
+	ctx := context.Background()
+	w := &v2CompatWaiter{
+		since: 5,
+		wake:  make(chan struct{}, 1),
+	}
+	woken := func() bool {
+		select {
+		case <-w.wake:
+			return true
+		default:
+			return false
+		}
+	}
+	// events the client has already seen don't wake it
+	w.OnRoomUpdate(ctx, &caches.RoomEventUpdate{EventData: &caches.EventData{LatestPos: 5}})
+	if woken() {
+		t.Errorf("woken by an event at the since position")
+	}
+	// other updates don't appear in v2 compatible responses
+	w.OnRoomUpdate(ctx, &caches.UnreadCountUpdate{})
+	if woken() {
+		t.Errorf("woken by an unread count update")
+	}
+	w.OnRoomUpdate(ctx, &caches.RoomEventUpdate{EventData: &caches.EventData{LatestPos: 6}})
+	w.OnRoomUpdate(ctx, &caches.RoomEventUpdate{EventData: &caches.EventData{LatestPos: 7}})
+	if !woken() {
+		t.Errorf("not woken by a new event")
+	}
+	if woken() {
+		t.Errorf("woken twice")
+	}
+	w.OnRoomUpdate(ctx, &caches.InviteUpdate{})
+	if !woken() {
+		t.Errorf("not woken by an invite")
+	}
+}
+
+func TestV2CompatHasChanges(t *testing.T) {
+	invites := map[string]caches.UserRoomData{"!invite:localhost": {}}
+	testCases := []struct {
+		name  string
+		rooms sync2.SyncRoomsResponse
+		want  bool
+	}{
+		{
+			name: "same invites",
+			rooms: sync2.SyncRoomsResponse{
+				Invite: map[string]sync2.SyncV2InviteResponse{"!invite:localhost": {}},
+			},
+		},
+		{
+			name: "joined room",
+			rooms: sync2.SyncRoomsResponse{
+				Join:   map[string]sync2.SyncV2JoinResponse{"!join:localhost": {}},
+				Invite: map[string]sync2.SyncV2InviteResponse{"!invite:localhost": {}},
+			},
+			want: true,
+		},
+		{
+			name: "left room",
+			rooms: sync2.SyncRoomsResponse{
+				Leave:  map[string]sync2.SyncV2LeaveResponse{"!leave:localhost": {}},
+				Invite: map[string]sync2.SyncV2InviteResponse{"!invite:localhost": {}},
+			},
+			want: true,
+		},
+		{
+			name: "different invite",
+			rooms: sync2.SyncRoomsResponse{
+				Invite: map[string]sync2.SyncV2InviteResponse{"!other:localhost": {}},
+			},
+			want: true,
+		},
+		{
+			name:  "invite rejected",
+			rooms: sync2.SyncRoomsResponse{},
+			want:  true,
+		},
+	}
+	for _, tc := range testCases {
+		got := v2CompatHasChanges(&sync2.SyncResponse{Rooms: tc.rooms}, invites)
+		if got != tc.want {
+			t.Errorf("%s: got %v want %v", tc.name, got, tc.want)
+		}
+	}
+}
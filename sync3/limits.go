@@ -0,0 +1,86 @@
+package sync3
+
+import (
+	"fmt"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// Limits are server-configured caps on the values clients can ask for. They allow operators of
+// constrained deployments to bound the size of responses and the amount of state held per connection.
+// Zero means no limit.
+type Limits struct {
+	// The max timeline_limit for lists and room subscriptions.
+	MaxTimelineLimit int64
+	// The max limit for the to_device extension.
+	MaxToDeviceLimit int
+	// The max limit for event_context on room subscriptions.
+	MaxEventContextLimit int64
+	// The max number of lists and room subscriptions a connection can have at once. Lists in inactive
+	// profiles count towards MaxLists as the server keeps them up-to-date.
+	MaxLists             int
+	MaxRoomSubscriptions int
+}
+
+// Clamp lowers any per-request limits in req which exceed the configured limits. Requests are clamped
+// rather than rejected as clients cannot know what the server limits are.
+func (l Limits) Clamp(req *Request) {
+	for listKey, list := range req.Lists {
+		list.RoomSubscription = l.clampRoomSubscription(list.RoomSubscription)
+		req.Lists[listKey] = list
+	}
+	for roomID, sub := range req.RoomSubscriptions {
+		req.RoomSubscriptions[roomID] = l.clampRoomSubscription(sub)
+	}
+	if req.Extensions.ToDevice != nil && l.MaxToDeviceLimit > 0 {
+		// a limit of 0 means the default, which may be higher than the max
+		if req.Extensions.ToDevice.Limit == 0 || req.Extensions.ToDevice.Limit > l.MaxToDeviceLimit {
+			req.Extensions.ToDevice.Limit = l.MaxToDeviceLimit
+		}
+	}
+}
+
+func (l Limits) clampRoomSubscription(rs RoomSubscription) RoomSubscription {
+	if l.MaxTimelineLimit > 0 && rs.TimelineLimit > l.MaxTimelineLimit {
+		rs.TimelineLimit = l.MaxTimelineLimit
+	}
+	if rs.IncludeOldRooms != nil {
+		oldRooms := l.clampRoomSubscription(*rs.IncludeOldRooms)
+		rs.IncludeOldRooms = &oldRooms
+	}
+	if rs.EventContext != nil && l.MaxEventContextLimit > 0 && rs.EventContext.Limit > l.MaxEventContextLimit {
+		ec := *rs.EventContext
+		ec.Limit = l.MaxEventContextLimit
+		rs.EventContext = &ec
+	}
+	return rs
+}
+
+// CheckSession returns an error if the combined request for a connection exceeds the configured
+// limits. Unlike Clamp, there is no sensible way to reduce these, so the request is rejected.
+func (l Limits) CheckSession(muxedReq *Request) *internal.HandlerError {
+	if muxedReq == nil {
+		return nil
+	}
+	if numLists := muxedReq.NumLists(); l.MaxLists > 0 && numLists > l.MaxLists {
+		return &internal.HandlerError{
+			StatusCode: 400,
+			Err:        fmt.Errorf("too many lists: %d > %d", numLists, l.MaxLists),
+		}
+	}
+	for listKey, list := range muxedReq.Lists {
+		if len(list.PinnedRooms) > MaxPinnedRooms {
+			return &internal.HandlerError{
+				StatusCode: 400,
+				Err:        fmt.Errorf("too many pinned_rooms in list %s: %d > %d", listKey, len(list.PinnedRooms), MaxPinnedRooms),
+			}
+		}
+	}
+	if l.MaxRoomSubscriptions > 0 && len(muxedReq.RoomSubscriptions) > l.MaxRoomSubscriptions {
+		return &internal.HandlerError{
+			StatusCode: 400,
+			Err:        fmt.Errorf("too many room subscriptions: %d > %d", len(muxedReq.RoomSubscriptions), l.MaxRoomSubscriptions),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package sync3
+
+import (
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/sync3/extensions"
+)
+
+func TestLimitsClamp(t *testing.T) {
+	limits := Limits{
+		MaxTimelineLimit:     10,
+		MaxToDeviceLimit:     50,
+		MaxEventContextLimit: 5,
+	}
+	req := Request{
+		Lists: map[string]RequestList{
+			"a": {
+				RoomSubscription: RoomSubscription{
+					TimelineLimit: 100,
+					IncludeOldRooms: &RoomSubscription{
+						TimelineLimit: 20,
+					},
+				},
+			},
+			"b": {
+				RoomSubscription: RoomSubscription{
+					TimelineLimit: 3,
+				},
+			},
+		},
+		RoomSubscriptions: map[string]RoomSubscription{
+			"!a:localhost": {
+				TimelineLimit: 11,
+				EventContext: &EventContextRequest{
+					EventID: "$a",
+					Limit:   500,
+				},
+			},
+		},
+		Extensions: extensions.Request{
+			ToDevice: &extensions.ToDeviceRequest{},
+		},
+	}
+	limits.Clamp(&req)
+	if got := req.Lists["a"].TimelineLimit; got != 10 {
+		t.Errorf("list a: got timeline_limit %d want 10", got)
+	}
+	if got := req.Lists["a"].IncludeOldRooms.TimelineLimit; got != 10 {
+		t.Errorf("list a include_old_rooms: got timeline_limit %d want 10", got)
+	}
+	if got := req.Lists["b"].TimelineLimit; got != 3 {
+		t.Errorf("list b: got timeline_limit %d want 3", got)
+	}
+	sub := req.RoomSubscriptions["!a:localhost"]
+	if sub.TimelineLimit != 10 {
+		t.Errorf("room sub: got timeline_limit %d want 10", sub.TimelineLimit)
+	}
+	if sub.EventContext.Limit != 5 || sub.EventContext.EventID != "$a" {
+		t.Errorf("room sub: got event_context %+v want limit 5", *sub.EventContext)
+	}
+	// the default to-device limit is higher than the max
+	if req.Extensions.ToDevice.Limit != 50 {
+		t.Errorf("to_device: got limit %d want 50", req.Extensions.ToDevice.Limit)
+	}
+
+	// zero values mean no limit
+	req = Request{
+		Lists: map[string]RequestList{
+			"a": {
+				RoomSubscription: RoomSubscription{
+					TimelineLimit: 100,
+				},
+			},
+		},
+		Extensions: extensions.Request{
+			ToDevice: &extensions.ToDeviceRequest{},
+		},
+	}
+	Limits{}.Clamp(&req)
+	if got := req.Lists["a"].TimelineLimit; got != 100 {
+		t.Errorf("no limits: got timeline_limit %d want 100", got)
+	}
+	if req.Extensions.ToDevice.Limit != 0 {
+		t.Errorf("no limits: got to_device limit %d want 0", req.Extensions.ToDevice.Limit)
+	}
+}
+
+func TestLimitsCheckSession(t *testing.T) {
+	limits := Limits{
+		MaxLists:             2,
+		MaxRoomSubscriptions: 1,
+	}
+	testCases := []struct {
+		name    string
+		req     *Request
+		wantErr bool
+	}{
+		{
+			name: "nil request",
+		},
+		{
+			name: "within limits",
+			req: &Request{
+				Lists: map[string]RequestList{"a": {}, "b": {}},
+				RoomSubscriptions: map[string]RoomSubscription{
+					"!a:localhost": {},
+				},
+			},
+		},
+		{
+			name: "too many lists",
+			req: &Request{
+				Lists: map[string]RequestList{"a": {}, "b": {}, "c": {}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "too many pinned rooms",
+			req: &Request{
+				Lists: map[string]RequestList{"a": {PinnedRooms: make([]string, MaxPinnedRooms+1)}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "too many room subscriptions",
+			req: &Request{
+				RoomSubscriptions: map[string]RoomSubscription{
+					"!a:localhost": {},
+					"!b:localhost": {},
+				},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		herr := limits.CheckSession(tc.req)
+		if tc.wantErr {
+			if herr == nil {
+				t.Errorf("%s: got no error, want one", tc.name)
+			} else if herr.StatusCode != 400 {
+				t.Errorf("%s: got status %d want 400", tc.name, herr.StatusCode)
+			}
+		} else if herr != nil {
+			t.Errorf("%s: got error %v want none", tc.name, herr)
+		}
+	}
+}
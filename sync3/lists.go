@@ -33,6 +33,9 @@ type RoomListDelta struct {
 
 type RoomDelta struct {
 	RoomNameChanged          bool
+	RoomAvatarChanged        bool
+	HeroesChanged            bool
+	EncryptionChanged        bool
 	JoinCountChanged         bool
 	InviteCountChanged       bool
 	NotificationCountChanged bool
@@ -46,16 +49,32 @@ type RoomDelta struct {
 type InternalRequestLists struct {
 	allRooms map[string]*RoomConnMetadata
 	lists    map[string]*FilteredSortableRooms
+	// Lists which are not in the request right now, e.g because they belong to an inactive profile. They
+	// are kept up-to-date as rooms change so they can be unparked without being rebuilt, but don't
+	// produce list deltas. See ParkList.
+	parked map[string]*parkedList
+}
+
+type parkedList struct {
+	list *FilteredSortableRooms
+	sort []string
+	// true if rooms changed since the list was last sorted
+	unsorted bool
 }
 
 func NewInternalRequestLists() *InternalRequestLists {
 	return &InternalRequestLists{
 		allRooms: make(map[string]*RoomConnMetadata, 10),
 		lists:    make(map[string]*FilteredSortableRooms),
+		parked:   make(map[string]*parkedList),
 	}
 }
 
 func (s *InternalRequestLists) SetRoom(r RoomConnMetadata, replacePreviousTimestamp bool) (delta RoomDelta) {
+	if r.BumpTimestamp > 0 {
+		// the user ignores someone, so sort by the latest event they didn't send
+		r.LastMessageTimestamp = r.BumpTimestamp
+	}
 	existing, exists := s.allRooms[r.RoomID]
 	if exists {
 		if existing.NotificationCount != r.NotificationCount {
@@ -67,11 +86,18 @@ func (s *InternalRequestLists) SetRoom(r RoomConnMetadata, replacePreviousTimest
 		delta.InviteCountChanged = !existing.SameInviteCount(&r.RoomMetadata)
 		delta.JoinCountChanged = !existing.SameJoinCount(&r.RoomMetadata)
 		delta.RoomNameChanged = !existing.SameRoomName(&r.RoomMetadata)
+		delta.RoomAvatarChanged = !existing.SameAvatar(&r.RoomMetadata)
+		delta.HeroesChanged = !existing.SameHeroes(&r.RoomMetadata)
+		delta.EncryptionChanged = existing.Encrypted != r.Encrypted
 		if delta.RoomNameChanged {
-			// update the canonical name to allow room name sorting to continue to work
+			// update the canonical name to allow room name sorting to continue to work. This also
+			// covers the name or canonical alias being removed, which falls back to the next source.
 			r.CanonicalisedName = strings.ToLower(
 				strings.Trim(internal.CalculateRoomName(&r.RoomMetadata, 5), "#!():_@"),
 			)
+		} else {
+			// the incoming metadata doesn't carry the canonical name, so keep the one we calculated
+			r.CanonicalisedName = existing.CanonicalisedName
 		}
 
 		// Don't bump this room in the room list if the update isn't of interest to
@@ -116,9 +142,54 @@ func (s *InternalRequestLists) SetRoom(r RoomConnMetadata, replacePreviousTimest
 			} // else it doesn't exist and it shouldn't exist, so do nothing e.g room isn't relevant to this list
 		}
 	}
+	for _, p := range s.parked {
+		// sorting is deferred until the list is unparked, so lots of changes are cheap
+		_, alreadyExists := p.list.roomIDToIndex[r.RoomID]
+		shouldExist := !r.HasLeft && p.list.filter.Include(&r, s)
+		if alreadyExists && !shouldExist {
+			p.list.Remove(r.RoomID)
+		} else if shouldExist {
+			if !alreadyExists {
+				p.list.Add(r.RoomID)
+			}
+			p.unsorted = true
+		}
+	}
 	return delta
 }
 
+// ParkList moves the list at listKey to parkedKey, keeping it up-to-date with room changes without
+// producing list deltas. Does nothing if there is no list at listKey.
+func (s *InternalRequestLists) ParkList(listKey, parkedKey string, sort []string) {
+	list, ok := s.lists[listKey]
+	if !ok {
+		return
+	}
+	delete(s.lists, listKey)
+	s.parked[parkedKey] = &parkedList{
+		list: list,
+		sort: sort,
+	}
+}
+
+// UnparkList moves the list parked at parkedKey back to listKey, sorting it if rooms changed whilst it
+// was parked. Returns false if there is no list parked at parkedKey.
+func (s *InternalRequestLists) UnparkList(ctx context.Context, parkedKey, listKey string) bool {
+	p, ok := s.parked[parkedKey]
+	if !ok {
+		return false
+	}
+	delete(s.parked, parkedKey)
+	if p.unsorted {
+		if err := p.list.Sort(p.sort); err != nil {
+			logger.Err(err).Strs("sort_by", p.sort).Msg("failed to sort unparked list")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		}
+	}
+	s.lists[listKey] = p.list
+	return true
+}
+
 // Remove a room from all lists e.g retired an invite, left a room
 func (s *InternalRequestLists) RemoveRoom(roomID string) {
 	delete(s.allRooms, roomID)
@@ -174,6 +245,112 @@ func (s *InternalRequestLists) ListsByVisibleRoomIDs(muxedReqLists map[string]Re
 	return listsByRoomIDs
 }
 
+// ListIndexesByVisibleRoomIDs returns the index position of each room in each list it is visible in,
+// keyed on room ID then list name. The rooms are the same as ListsByVisibleRoomIDs.
+func (s *InternalRequestLists) ListIndexesByVisibleRoomIDs(muxedReqLists map[string]RequestList) map[string]map[string]int {
+	indexesByRoomIDs := make(map[string]map[string]int, len(muxedReqLists))
+	add := func(roomID, listName string, index int) {
+		indexes := indexesByRoomIDs[roomID]
+		if indexes == nil {
+			indexes = make(map[string]int)
+			indexesByRoomIDs[roomID] = indexes
+		}
+		indexes[listName] = index
+	}
+	for listName, reqList := range muxedReqLists {
+		sortedRooms := s.lists[listName].SortableRooms
+		if sortedRooms == nil {
+			continue
+		}
+		if reqList.SlowGetAllRooms != nil && *reqList.SlowGetAllRooms {
+			for i, roomID := range sortedRooms.RoomIDs() {
+				add(roomID, listName, i)
+			}
+			continue
+		}
+		for _, subslice := range reqList.Ranges.SliceInto(sortedRooms) {
+			for _, roomID := range subslice.(*SortableRooms).RoomIDs() {
+				if index, ok := sortedRooms.IndexOf(roomID); ok {
+					add(roomID, listName, index)
+				}
+			}
+		}
+	}
+	return indexesByRoomIDs
+}
+
+// RoomIDsInRanges returns the room IDs in each of the given ranges for this list, in the order of the ranges.
+// Ranges which are entirely outside the list are empty, so the result always lines up with the ranges. Used
+// for debugging index bookkeeping.
+func (s *InternalRequestLists) RoomIDsInRanges(listKey string, ranges SliceRanges) [][]string {
+	list := s.lists[listKey]
+	if list == nil {
+		return nil
+	}
+	result := make([][]string, len(ranges))
+	for i, r := range ranges {
+		subslices := SliceRanges{r}.SliceInto(list.SortableRooms)
+		if len(subslices) == 0 {
+			result[i] = []string{}
+			continue
+		}
+		result[i] = subslices[0].(*SortableRooms).RoomIDs()
+	}
+	return result
+}
+
+// ListSnapshot is a point-in-time copy of a list's ordering, along with the values used to sort it.
+type ListSnapshot struct {
+	Sort  []string       `json:"sort"`
+	Rooms []RoomSortKeys `json:"rooms"`
+}
+
+// RoomSortKeys are the values which determine the position of a room in a list.
+type RoomSortKeys struct {
+	RoomID               string `json:"room_id"`
+	CanonicalisedName    string `json:"name"`
+	LastMessageTimestamp uint64 `json:"last_message_timestamp"`
+	HighlightCount       int    `json:"highlight_count"`
+	NotificationCount    int    `json:"notification_count"`
+	JoinedAt             int64  `json:"joined_at,omitempty"`
+	IsDM                 bool   `json:"is_dm,omitempty"`
+	IsInvite             bool   `json:"is_invite,omitempty"`
+}
+
+// Snapshot returns a copy of every list in muxedReqLists, in sorted order. Used for postmortem debugging.
+func (s *InternalRequestLists) Snapshot(muxedReqLists map[string]RequestList) map[string]ListSnapshot {
+	result := make(map[string]ListSnapshot, len(s.lists))
+	for listKey, list := range s.lists {
+		reqList, ok := muxedReqLists[listKey]
+		if !ok || list == nil {
+			continue
+		}
+		roomIDs := list.RoomIDs()
+		snapshot := ListSnapshot{
+			Sort:  reqList.Sort,
+			Rooms: make([]RoomSortKeys, 0, len(roomIDs)),
+		}
+		for _, roomID := range roomIDs {
+			r := s.allRooms[roomID]
+			if r == nil {
+				continue
+			}
+			snapshot.Rooms = append(snapshot.Rooms, RoomSortKeys{
+				RoomID:               roomID,
+				CanonicalisedName:    r.CanonicalisedName,
+				LastMessageTimestamp: r.LastMessageTimestamp,
+				HighlightCount:       r.HighlightCount,
+				NotificationCount:    r.NotificationCount,
+				JoinedAt:             r.JoinedAt,
+				IsDM:                 r.IsDM,
+				IsInvite:             r.IsInvite,
+			})
+		}
+		result[listKey] = snapshot
+	}
+	return result
+}
+
 // Assign a new list at the given key. If Overwrite, any existing list is replaced. If DoNotOverwrite, the existing
 // list is returned if one exists, else a new list is created. Returns the list and true if the list was overwritten.
 func (s *InternalRequestLists) AssignList(ctx context.Context, listKey string, filters *RequestFilters, sort []string, shouldOverwrite OverwriteVal) (*FilteredSortableRooms, bool) {
@@ -43,3 +43,188 @@ func addRooms(list *sync3.InternalRequestLists, n int) {
 		}, true)
 	}
 }
+
+func TestRoomIDsInRanges(t *testing.T) {
+	list := sync3.NewInternalRequestLists()
+	for i := 0; i < 5; i++ {
+		list.SetRoom(sync3.RoomConnMetadata{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID:               fmt.Sprintf("!%d:localhost", i),
+				LastMessageTimestamp: uint64(100 - i),
+			},
+		}, true)
+	}
+	list.AssignList(context.Background(), "a", &sync3.RequestFilters{}, []string{sync3.SortByRecency}, sync3.Overwrite)
+	got := list.RoomIDsInRanges("a", sync3.SliceRanges{{0, 1}, {3, 10}, {20, 30}})
+	// the range outside the list is empty rather than omitted, so clients can match ranges by index
+	want := [][]string{
+		{"!0:localhost", "!1:localhost"},
+		{"!3:localhost", "!4:localhost"},
+		{},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("RoomIDsInRanges: got %v want %v", got, want)
+	}
+	for i := range want {
+		if fmt.Sprint(got[i]) != fmt.Sprint(want[i]) {
+			t.Errorf("RoomIDsInRanges: range %d got %v want %v", i, got[i], want[i])
+		}
+	}
+	if got[2] == nil {
+		t.Errorf("RoomIDsInRanges: range outside the list got nil want an empty slice")
+	}
+	got = list.RoomIDsInRanges("a", sync3.SliceRanges{{10, 20}, {0, 0}})
+	if len(got) != 2 || len(got[0]) != 0 || fmt.Sprint(got[1]) != "[!0:localhost]" {
+		t.Errorf("RoomIDsInRanges: out of bounds then in bounds range got %v want [[] [!0:localhost]]", got)
+	}
+	if got := list.RoomIDsInRanges("unknown", sync3.SliceRanges{{0, 1}}); got != nil {
+		t.Errorf("RoomIDsInRanges: unknown list got %v want nil", got)
+	}
+}
+
+func TestListIndexesByVisibleRoomIDs(t *testing.T) {
+	list := sync3.NewInternalRequestLists()
+	for i := 0; i < 5; i++ {
+		list.SetRoom(sync3.RoomConnMetadata{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID:               fmt.Sprintf("!%d:localhost", i),
+				LastMessageTimestamp: uint64(100 - i),
+			},
+		}, true)
+	}
+	list.AssignList(context.Background(), "a", &sync3.RequestFilters{}, []string{sync3.SortByRecency}, sync3.Overwrite)
+	got := list.ListIndexesByVisibleRoomIDs(map[string]sync3.RequestList{
+		"a": {Ranges: sync3.SliceRanges{{1, 2}, {4, 10}}},
+	})
+	want := map[string]map[string]int{
+		"!1:localhost": {"a": 1},
+		"!2:localhost": {"a": 2},
+		"!4:localhost": {"a": 4},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("ListIndexesByVisibleRoomIDs: got %v want %v", got, want)
+	}
+}
+
+func TestSetRoomByNameSorting(t *testing.T) {
+	list := sync3.NewInternalRequestLists()
+	rooms := map[string]internal.RoomMetadata{
+		"!a:localhost": {RoomID: "!a:localhost", NameEvent: "Bravo", CanonicalAlias: "#zulu:localhost"},
+		"!b:localhost": {RoomID: "!b:localhost", CanonicalAlias: "#charlie:localhost"},
+		"!c:localhost": {RoomID: "!c:localhost", NameEvent: "Delta", CanonicalAlias: "#alpha:localhost"},
+	}
+	for _, metadata := range rooms {
+		list.SetRoom(sync3.RoomConnMetadata{RoomMetadata: metadata}, true)
+	}
+	list.AssignList(context.Background(), "a", &sync3.RequestFilters{}, []string{sync3.SortByName}, sync3.Overwrite)
+	assertOrder := func(msg string, want ...string) {
+		t.Helper()
+		if err := list.Get("a").Sort([]string{sync3.SortByName}); err != nil {
+			t.Fatalf("%s: Sort: %s", msg, err)
+		}
+		got := list.RoomIDsInRanges("a", sync3.SliceRanges{{0, int64(len(want) - 1)}})
+		if len(got) != 1 || fmt.Sprint(got[0]) != fmt.Sprint(want) {
+			t.Errorf("%s: got %v want %v", msg, got, want)
+		}
+	}
+	assertOrder("initial", "!a:localhost", "!b:localhost", "!c:localhost")
+
+	// an update which doesn't touch the name must not lose the room's position
+	b := rooms["!b:localhost"]
+	list.SetRoom(sync3.RoomConnMetadata{
+		RoomMetadata: b,
+		UserRoomData: caches.UserRoomData{NotificationCount: 1},
+	}, true)
+	assertOrder("unrelated update", "!a:localhost", "!b:localhost", "!c:localhost")
+
+	// removing the name falls back to the canonical alias
+	c := rooms["!c:localhost"]
+	c.NameEvent = ""
+	list.SetRoom(sync3.RoomConnMetadata{RoomMetadata: c}, true)
+	assertOrder("name removed", "!c:localhost", "!a:localhost", "!b:localhost")
+
+	// removing the canonical alias falls back to the heroes
+	c.CanonicalAlias = ""
+	c.JoinCount = 2
+	c.Heroes = []internal.Hero{{ID: "@yankee:localhost", Name: "Yankee"}}
+	list.SetRoom(sync3.RoomConnMetadata{RoomMetadata: c}, true)
+	assertOrder("alias removed", "!a:localhost", "!b:localhost", "!c:localhost")
+}
+
+func TestSetRoomBumpTimestamp(t *testing.T) {
+	list := sync3.NewInternalRequestLists()
+	list.SetRoom(sync3.RoomConnMetadata{
+		RoomMetadata: internal.RoomMetadata{RoomID: "!a:localhost", LastMessageTimestamp: 200},
+	}, true)
+	// the latest message in b was sent by someone the user ignores
+	list.SetRoom(sync3.RoomConnMetadata{
+		RoomMetadata: internal.RoomMetadata{RoomID: "!b:localhost", LastMessageTimestamp: 300},
+		UserRoomData: caches.UserRoomData{BumpTimestamp: 100},
+	}, true)
+	list.AssignList(context.Background(), "a", &sync3.RequestFilters{}, []string{sync3.SortByRecency}, sync3.Overwrite)
+	got := list.RoomIDsInRanges("a", sync3.SliceRanges{{0, 1}})
+	want := []string{"!a:localhost", "!b:localhost"}
+	if len(got) != 1 || fmt.Sprint(got[0]) != fmt.Sprint(want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if ts := list.ReadOnlyRoom("!b:localhost").LastMessageTimestamp; ts != 100 {
+		t.Errorf("LastMessageTimestamp: got %d want 100", ts)
+	}
+}
+
+func TestSetRoomHeroesChanged(t *testing.T) {
+	list := sync3.NewInternalRequestLists()
+	metadata := internal.RoomMetadata{
+		RoomID:    "!a:localhost",
+		NameEvent: "My Room",
+		Heroes:    []internal.Hero{{ID: "@bob:localhost", Name: "Bob"}},
+	}
+	list.SetRoom(sync3.RoomConnMetadata{RoomMetadata: metadata}, true)
+	if delta := list.SetRoom(sync3.RoomConnMetadata{RoomMetadata: metadata}, true); delta.HeroesChanged {
+		t.Errorf("HeroesChanged set when the heroes are the same")
+	}
+	// the room has an explicit name, so only the heroes are different
+	metadata.SetHero(internal.Hero{ID: "@bob:localhost", Name: "Robert"})
+	delta := list.SetRoom(sync3.RoomConnMetadata{RoomMetadata: metadata}, true)
+	if !delta.HeroesChanged {
+		t.Errorf("HeroesChanged not set when a hero changed their name")
+	}
+}
+
+func TestParkList(t *testing.T) {
+	ctx := context.Background()
+	list := sync3.NewInternalRequestLists()
+	setRoom := func(roomID string, ts uint64) {
+		list.SetRoom(sync3.RoomConnMetadata{
+			RoomMetadata: internal.RoomMetadata{RoomID: roomID, LastMessageTimestamp: ts},
+		}, true)
+	}
+	setRoom("!a:localhost", 1)
+	setRoom("!b:localhost", 2)
+	sortBy := []string{sync3.SortByRecency}
+	list.AssignList(ctx, "a", &sync3.RequestFilters{}, sortBy, sync3.Overwrite)
+
+	list.ParkList("a", "work\x00a", sortBy)
+	if list.Get("a") != nil || list.Len() != 0 {
+		t.Fatalf("ParkList: list is still active")
+	}
+	// parked lists track room changes but don't produce deltas
+	if delta := list.SetRoom(sync3.RoomConnMetadata{
+		RoomMetadata: internal.RoomMetadata{RoomID: "!c:localhost", LastMessageTimestamp: 3},
+	}, true); len(delta.Lists) != 0 {
+		t.Errorf("SetRoom: got list deltas %v for parked list", delta.Lists)
+	}
+	setRoom("!a:localhost", 4)
+
+	if list.UnparkList(ctx, "personal\x00a", "a") {
+		t.Errorf("UnparkList: unparked a list which doesn't exist")
+	}
+	if !list.UnparkList(ctx, "work\x00a", "a") {
+		t.Fatalf("UnparkList: returned false")
+	}
+	got := list.RoomIDsInRanges("a", sync3.SliceRanges{{0, 2}})
+	want := []string{"!a:localhost", "!c:localhost", "!b:localhost"}
+	if len(got) != 1 || fmt.Sprint(got[0]) != fmt.Sprint(want) {
+		t.Errorf("unparked list: got %v want %v", got, want)
+	}
+}
@@ -0,0 +1,411 @@
+//go:build fastjson
+// +build fastjson
+
+package sync3
+
+// Hand-written marshallers for the hot response types, enabled with `-tags fastjson`. These avoid the
+// reflection cost of encoding/json when serialising large responses. The output must be identical to
+// the reflection-based encoding: see TestResponseMarshalling. Run the benchmarks with and without the
+// tag to compare:
+//   go test ./sync3 -run NONE -bench Marshal
+//   go test ./sync3 -run NONE -bench Marshal -tags fastjson
+//
+// HTML escaping and validation of embedded events is left to encoding/json, which compacts the output
+// of MarshalJSON.
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+func (r Response) MarshalJSON() ([]byte, error) {
+	buf := make([]byte, 0, 512)
+	buf = append(buf, `{"lists":`...)
+	if r.Lists == nil {
+		buf = append(buf, "null"...)
+	} else {
+		buf = append(buf, '{')
+		for i, listKey := range sortedKeys(r.Lists) {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendJSONString(buf, listKey)
+			buf = append(buf, ':')
+			var err error
+			if buf, err = r.Lists[listKey].appendJSON(buf); err != nil {
+				return nil, err
+			}
+		}
+		buf = append(buf, '}')
+	}
+	buf = append(buf, `,"rooms":`...)
+	if r.Rooms == nil {
+		buf = append(buf, "null"...)
+	} else {
+		buf = append(buf, '{')
+		for i, roomID := range sortedKeys(r.Rooms) {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendJSONString(buf, roomID)
+			buf = append(buf, ':')
+			buf = r.Rooms[roomID].appendJSON(buf)
+		}
+		buf = append(buf, '}')
+	}
+	if len(r.RoomsMeta) > 0 {
+		roomsMeta, err := json.Marshal(r.RoomsMeta)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, `,"rooms_meta":`...)
+		buf = append(buf, roomsMeta...)
+	}
+	ext, err := json.Marshal(r.Extensions)
+	if err != nil {
+		return nil, err
+	}
+	buf = append(buf, `,"extensions":`...)
+	buf = append(buf, ext...)
+	buf = append(buf, `,"pos":`...)
+	buf = appendJSONString(buf, r.Pos)
+	if r.TxnID != "" {
+		buf = append(buf, `,"txn_id":`...)
+		buf = appendJSONString(buf, r.TxnID)
+	}
+	if r.Session != "" {
+		buf = append(buf, `,"session_id":`...)
+		buf = appendJSONString(buf, r.Session)
+	}
+	if r.Degraded {
+		buf = append(buf, `,"degraded":true`...)
+	}
+	if r.CollapsedInvites != nil {
+		ci, err := json.Marshal(r.CollapsedInvites)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, `,"collapsed_invites":`...)
+		buf = append(buf, ci...)
+	}
+	buf = append(buf, '}')
+	return buf, nil
+}
+
+func (l ResponseList) MarshalJSON() ([]byte, error) {
+	return l.appendJSON(nil)
+}
+
+func (l ResponseList) appendJSON(buf []byte) ([]byte, error) {
+	buf = append(buf, '{')
+	if len(l.Ops) > 0 {
+		buf = append(buf, `"ops":[`...)
+		for i, op := range l.Ops {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			switch o := op.(type) {
+			case *ResponseOpRange:
+				buf = o.appendJSON(buf)
+			case *ResponseOpSingle:
+				buf = o.appendJSON(buf)
+			default:
+				b, err := json.Marshal(op)
+				if err != nil {
+					return nil, err
+				}
+				buf = append(buf, b...)
+			}
+		}
+		buf = append(buf, "],"...)
+	}
+	buf = append(buf, `"count":`...)
+	buf = strconv.AppendInt(buf, int64(l.Count), 10)
+	if len(l.RelevantRooms) > 0 {
+		buf = append(buf, `,"relevant_rooms":[`...)
+		for i, roomIDs := range l.RelevantRooms {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendJSONStrings(buf, roomIDs)
+		}
+		buf = append(buf, ']')
+	}
+	buf = append(buf, '}')
+	return buf, nil
+}
+
+func (r *ResponseOpRange) MarshalJSON() ([]byte, error) {
+	return r.appendJSON(nil), nil
+}
+
+func (r *ResponseOpRange) appendJSON(buf []byte) []byte {
+	if r == nil {
+		return append(buf, "null"...)
+	}
+	buf = append(buf, `{"op":`...)
+	buf = appendJSONString(buf, r.Operation)
+	buf = append(buf, `,"range":[`...)
+	buf = strconv.AppendInt(buf, r.Range[0], 10)
+	buf = append(buf, ',')
+	buf = strconv.AppendInt(buf, r.Range[1], 10)
+	buf = append(buf, ']')
+	if len(r.RoomIDs) > 0 {
+		buf = append(buf, `,"room_ids":`...)
+		buf = appendJSONStrings(buf, r.RoomIDs)
+	}
+	buf = append(buf, '}')
+	return buf
+}
+
+func (r *ResponseOpSingle) MarshalJSON() ([]byte, error) {
+	return r.appendJSON(nil), nil
+}
+
+func (r *ResponseOpSingle) appendJSON(buf []byte) []byte {
+	if r == nil {
+		return append(buf, "null"...)
+	}
+	buf = append(buf, `{"op":`...)
+	buf = appendJSONString(buf, r.Operation)
+	if r.Index != nil {
+		buf = append(buf, `,"index":`...)
+		buf = strconv.AppendInt(buf, int64(*r.Index), 10)
+	}
+	if r.RoomID != "" {
+		buf = append(buf, `,"room_id":`...)
+		buf = appendJSONString(buf, r.RoomID)
+	}
+	buf = append(buf, '}')
+	return buf
+}
+
+func (r Room) MarshalJSON() ([]byte, error) {
+	return r.appendJSON(nil), nil
+}
+
+func (r Room) appendJSON(buf []byte) []byte {
+	buf = append(buf, '{')
+	if r.Name != "" {
+		buf = append(buf, `"name":`...)
+		buf = appendJSONString(buf, r.Name)
+		buf = append(buf, ',')
+	}
+	if r.Avatar != "" {
+		buf = append(buf, `"avatar":`...)
+		buf = appendJSONString(buf, r.Avatar)
+		buf = append(buf, ',')
+	}
+	if len(r.RequiredState) > 0 {
+		buf = append(buf, `"required_state":`...)
+		buf = appendRawMessages(buf, r.RequiredState)
+		buf = append(buf, ',')
+	}
+	if len(r.Timeline) > 0 {
+		buf = append(buf, `"timeline":`...)
+		buf = appendRawMessages(buf, r.Timeline)
+		buf = append(buf, ',')
+	}
+	if len(r.InviteState) > 0 {
+		buf = append(buf, `"invite_state":`...)
+		buf = appendRawMessages(buf, r.InviteState)
+		buf = append(buf, ',')
+	}
+	buf = append(buf, `"notification_count":`...)
+	buf = strconv.AppendInt(buf, r.NotificationCount, 10)
+	buf = append(buf, `,"highlight_count":`...)
+	buf = strconv.AppendInt(buf, r.HighlightCount, 10)
+	if r.Initial {
+		buf = append(buf, `,"initial":true`...)
+	}
+	if r.IsDM {
+		buf = append(buf, `,"is_dm":true`...)
+	}
+	if r.IsEncrypted {
+		buf = append(buf, `,"is_encrypted":true`...)
+	}
+	if r.RoomType != "" {
+		buf = append(buf, `,"room_type":`...)
+		buf = appendJSONString(buf, r.RoomType)
+	}
+	if r.JoinedCount != 0 {
+		buf = append(buf, `,"joined_count":`...)
+		buf = strconv.AppendInt(buf, int64(r.JoinedCount), 10)
+	}
+	if r.InvitedCount != 0 {
+		buf = append(buf, `,"invited_count":`...)
+		buf = strconv.AppendInt(buf, int64(r.InvitedCount), 10)
+	}
+	if r.PrevBatch != "" {
+		buf = append(buf, `,"prev_batch":`...)
+		buf = appendJSONString(buf, r.PrevBatch)
+	}
+	if r.NumLive != 0 {
+		buf = append(buf, `,"num_live":`...)
+		buf = strconv.AppendInt(buf, int64(r.NumLive), 10)
+	}
+	if len(r.Heroes) > 0 {
+		buf = append(buf, `,"heroes":[`...)
+		for i, h := range r.Heroes {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = append(buf, `{"user_id":`...)
+			buf = appendJSONString(buf, h.ID)
+			if h.DisplayName != "" {
+				buf = append(buf, `,"displayname":`...)
+				buf = appendJSONString(buf, h.DisplayName)
+			}
+			buf = append(buf, '}')
+		}
+		buf = append(buf, ']')
+	}
+	if len(r.UnreadThreadNotifications) > 0 {
+		buf = append(buf, `,"unread_thread_notifications":{`...)
+		for i, threadID := range sortedKeys(r.UnreadThreadNotifications) {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			counts := r.UnreadThreadNotifications[threadID]
+			buf = appendJSONString(buf, threadID)
+			buf = append(buf, `:{"highlight_count":`...)
+			buf = strconv.AppendInt(buf, int64(counts.HighlightCount), 10)
+			buf = append(buf, `,"notification_count":`...)
+			buf = strconv.AppendInt(buf, int64(counts.NotificationCount), 10)
+			buf = append(buf, '}')
+		}
+		buf = append(buf, '}')
+	}
+	if r.EventContext != nil {
+		buf = append(buf, `,"event_context":{"event":`...)
+		if r.EventContext.Event == nil {
+			buf = append(buf, "null"...)
+		} else {
+			buf = append(buf, r.EventContext.Event...)
+		}
+		if len(r.EventContext.EventsBefore) > 0 {
+			buf = append(buf, `,"events_before":`...)
+			buf = appendRawMessages(buf, r.EventContext.EventsBefore)
+		}
+		if len(r.EventContext.EventsAfter) > 0 {
+			buf = append(buf, `,"events_after":`...)
+			buf = appendRawMessages(buf, r.EventContext.EventsAfter)
+		}
+		buf = append(buf, '}')
+	}
+	if r.ContentHints != nil {
+		buf = append(buf, `,"content_hints":{`...)
+		if r.ContentHints.Script != "" {
+			buf = append(buf, `"script":`...)
+			buf = appendJSONString(buf, r.ContentHints.Script)
+		}
+		if r.ContentHints.MediaHeavy {
+			if r.ContentHints.Script != "" {
+				buf = append(buf, ',')
+			}
+			buf = append(buf, `"media_heavy":true`...)
+		}
+		buf = append(buf, '}')
+	}
+	if r.BumpStamp != 0 {
+		buf = append(buf, `,"bump_stamp":`...)
+		buf = strconv.AppendUint(buf, r.BumpStamp, 10)
+	}
+	buf = append(buf, '}')
+	return buf
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func appendRawMessages(buf []byte, msgs []json.RawMessage) []byte {
+	buf = append(buf, '[')
+	for i, msg := range msgs {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		if msg == nil {
+			buf = append(buf, "null"...)
+		} else {
+			buf = append(buf, msg...)
+		}
+	}
+	return append(buf, ']')
+}
+
+func appendJSONStrings(buf []byte, strs []string) []byte {
+	if strs == nil {
+		return append(buf, "null"...)
+	}
+	buf = append(buf, '[')
+	for i, s := range strs {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = appendJSONString(buf, s)
+	}
+	return append(buf, ']')
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendJSONString appends s as a JSON string, escaping it the same way as encoding/json.
+func appendJSONString(buf []byte, s string) []byte {
+	buf = append(buf, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' {
+				i++
+				continue
+			}
+			buf = append(buf, s[start:i]...)
+			switch b {
+			case '"', '\\':
+				buf = append(buf, '\\', b)
+			case '\b':
+				buf = append(buf, '\\', 'b')
+			case '\f':
+				buf = append(buf, '\\', 'f')
+			case '\n':
+				buf = append(buf, '\\', 'n')
+			case '\r':
+				buf = append(buf, '\\', 'r')
+			case '\t':
+				buf = append(buf, '\\', 't')
+			default:
+				buf = append(buf, '\\', 'u', '0', '0', hexDigits[b>>4], hexDigits[b&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		c, size := utf8.DecodeRuneInString(s[i:])
+		if c == utf8.RuneError && size == 1 {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, `\ufffd`...)
+			i += size
+			start = i
+			continue
+		}
+		// U+2028 and U+2029 are valid JSON but not valid JavaScript, so encoding/json escapes them
+		if c == '\u2028' || c == '\u2029' {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, '\\', 'u', '2', '0', '2', hexDigits[c&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	buf = append(buf, s[start:]...)
+	return append(buf, '"')
+}
@@ -0,0 +1,108 @@
+package sync3
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PositionVersion is the version of the `pos` format written by this server. Bump this and add an entry
+// to positionMigrations when changing how extension positions are encoded.
+const PositionVersion = 1
+
+// the reserved extension name used to encode the version of the position
+const positionVersionKey = "v"
+
+// positionMigrations upgrade a decoded position from version N (the key) to version N+1. Positions without
+// a version segment are version 0.
+var positionMigrations = map[int]func(p *Position){
+	// version 1 added the version segment without changing anything else
+	0: func(p *Position) {},
+}
+
+// Position is the decoded form of the `pos` value sent to and from clients. It is made up of the
+// connection position, which tracks room and list data, followed by optional sub-positions for
+// extensions which have their own streams (e.g. to-device messages). Encoded, it looks like:
+//
+//	12~v.1~to_device.55
+//
+// where `v.1` is the version of the format. The version segment is only written when there are extension
+// positions, so a bare integer is a valid position in every version. Older servers treat the version
+// segment as an unknown extension and ignore it. Extension names may contain dots, but extension positions
+// must not contain dots or tildes.
+//
+// Clients treat the whole value as opaque, but including the extension positions lets a client which
+// failed to process some extension data re-request it by sending back an older extension position
+// alongside the latest connection position, without the room data being sent again.
+type Position struct {
+	Conn       int64
+	Extensions map[string]string
+}
+
+// ParsePosition decodes a `pos` value. A bare integer is a valid position with no extension positions.
+// Positions written by older versions are migrated to the current version. Positions written by newer
+// versions keep their connection position, but their extension positions are dropped as they cannot be
+// understood.
+func ParsePosition(pos string) (Position, error) {
+	var p Position
+	if pos == "" {
+		return p, nil
+	}
+	segments := strings.Split(pos, "~")
+	conn, err := strconv.ParseInt(segments[0], 10, 64)
+	if err != nil {
+		return p, fmt.Errorf("invalid connection position: %s", segments[0])
+	}
+	p.Conn = conn
+	segments = segments[1:]
+	version := 0
+	if len(segments) > 0 && strings.HasPrefix(segments[0], positionVersionKey+".") {
+		version, err = strconv.Atoi(strings.TrimPrefix(segments[0], positionVersionKey+"."))
+		if err != nil || version < 0 {
+			return p, fmt.Errorf("invalid position version: %s", segments[0])
+		}
+		segments = segments[1:]
+	}
+	if version > PositionVersion {
+		return p, nil
+	}
+	for _, seg := range segments {
+		// extension names can contain dots when namespaced, but positions cannot
+		i := strings.LastIndex(seg, ".")
+		if i == -1 {
+			return p, fmt.Errorf("invalid extension position: %s", seg)
+		}
+		name, val := seg[:i], seg[i+1:]
+		if name == "" || val == "" || name == positionVersionKey {
+			return p, fmt.Errorf("invalid extension position: %s", seg)
+		}
+		if p.Extensions == nil {
+			p.Extensions = make(map[string]string)
+		}
+		p.Extensions[name] = val
+	}
+	for ; version < PositionVersion; version++ {
+		positionMigrations[version](&p)
+	}
+	return p, nil
+}
+
+// String encodes the position. Extension positions are sorted by name so the encoding is stable.
+func (p Position) String() string {
+	var sb strings.Builder
+	sb.WriteString(strconv.FormatInt(p.Conn, 10))
+	if len(p.Extensions) == 0 {
+		return sb.String()
+	}
+	sb.WriteString("~" + positionVersionKey + "." + strconv.Itoa(PositionVersion))
+	names := make([]string, 0, len(p.Extensions))
+	for name := range p.Extensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sb.WriteString("~" + name + "." + p.Extensions[name])
+	}
+	return sb.String()
+}
@@ -0,0 +1,81 @@
+package sync3
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPositionRoundTrip(t *testing.T) {
+	testCases := []struct {
+		pos  string
+		want Position
+	}{
+		{pos: "", want: Position{}},
+		{pos: "12", want: Position{Conn: 12}},
+		{pos: "12~v.1~to_device.55", want: Position{Conn: 12, Extensions: map[string]string{"to_device": "55"}}},
+		{pos: "3~v.1~a.1~b.2", want: Position{Conn: 3, Extensions: map[string]string{"a": "1", "b": "2"}}},
+		{pos: "4~v.1~org.example.stream.9", want: Position{Conn: 4, Extensions: map[string]string{"org.example.stream": "9"}}},
+	}
+	for _, tc := range testCases {
+		got, err := ParsePosition(tc.pos)
+		if err != nil {
+			t.Errorf("ParsePosition(%q) returned error: %s", tc.pos, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ParsePosition(%q) got %+v want %+v", tc.pos, got, tc.want)
+		}
+		if tc.pos != "" && got.String() != tc.pos {
+			t.Errorf("Position.String() got %q want %q", got.String(), tc.pos)
+		}
+	}
+}
+
+func TestParsePositionVersions(t *testing.T) {
+	testCases := []struct {
+		name    string
+		pos     string
+		want    Position
+		wantStr string
+	}{
+		{
+			name:    "unversioned positions are migrated",
+			pos:     "12~to_device.55",
+			want:    Position{Conn: 12, Extensions: map[string]string{"to_device": "55"}},
+			wantStr: "12~v.1~to_device.55",
+		},
+		{
+			name:    "a version with no extensions",
+			pos:     "12~v.1",
+			want:    Position{Conn: 12},
+			wantStr: "12",
+		},
+		{
+			name:    "newer versions keep the connection position only",
+			pos:     "7~v.99~some:new-format",
+			want:    Position{Conn: 7},
+			wantStr: "7",
+		},
+	}
+	for _, tc := range testCases {
+		got, err := ParsePosition(tc.pos)
+		if err != nil {
+			t.Errorf("%s: ParsePosition(%q) returned error: %s", tc.name, tc.pos, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: ParsePosition(%q) got %+v want %+v", tc.name, tc.pos, got, tc.want)
+		}
+		if got.String() != tc.wantStr {
+			t.Errorf("%s: Position.String() got %q want %q", tc.name, got.String(), tc.wantStr)
+		}
+	}
+}
+
+func TestParsePositionInvalid(t *testing.T) {
+	for _, pos := range []string{"abc", "12~", "12~to_device", "12~.5", "~to_device.5", "12~v.x~a.1", "12~v.1~v.2"} {
+		if _, err := ParsePosition(pos); err == nil {
+			t.Errorf("ParsePosition(%q) did not return an error", pos)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package sync3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"sync"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+// queuedReceiver invokes a Receiver on its own goroutine. Updates are buffered in a bounded queue: if the
+// queue is full, the update is dropped and onOverflow is called. Once overflowed, all further updates are
+// dropped as the receiver is now out of date, so there is no point trying to catch up. The same happens if
+// the receiver panics, as it may have been left part way through an update.
+type queuedReceiver struct {
+	Receiver
+	queue      chan func()
+	done       chan struct{}
+	stopOnce   sync.Once
+	mu         sync.Mutex
+	overflow   bool
+	onOverflow func()
+}
+
+func newQueuedReceiver(r Receiver, queueSize int) *queuedReceiver {
+	q := &queuedReceiver{
+		Receiver: r,
+		queue:    make(chan func(), queueSize),
+		done:     make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+func (q *queuedReceiver) run() {
+	for {
+		select {
+		case fn := <-q.queue:
+			q.call(fn)
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// call fn, treating a panic like an overflow. This goroutine isn't covered by the recovery in the
+// synchronous dispatch path, so without this a panic in a user cache would crash the process.
+func (q *queuedReceiver) call(fn func()) {
+	q.mu.Lock()
+	overflowed := q.overflow
+	q.mu.Unlock()
+	if overflowed {
+		return // the receiver is out of date, so don't process updates which were already queued
+	}
+	defer func() {
+		panicErr := recover()
+		if panicErr == nil {
+			return
+		}
+		logger.Error().Str("panic", fmt.Sprint(panicErr)).Msg("queuedReceiver: receiver panicked, dropping further updates")
+		logger.Error().Msg(string(debug.Stack()))
+		internal.GetSentryHubFromContextOrDefault(context.Background()).Recover(panicErr)
+		q.mu.Lock()
+		alreadyOverflowed := q.overflow
+		q.overflow = true
+		q.mu.Unlock()
+		if !alreadyOverflowed && q.onOverflow != nil {
+			q.onOverflow()
+		}
+	}()
+	fn()
+}
+
+// stop the receiver goroutine. Pending updates are discarded.
+func (q *queuedReceiver) stop() {
+	q.stopOnce.Do(func() {
+		close(q.done)
+	})
+}
+
+func (q *queuedReceiver) enqueue(fn func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.overflow {
+		return
+	}
+	select {
+	case <-q.done:
+		return // unregistered
+	case q.queue <- fn:
+	default:
+		q.overflow = true
+		if q.onOverflow != nil {
+			go q.onOverflow()
+		}
+	}
+}
+
+func (q *queuedReceiver) OnNewEvent(ctx context.Context, event *caches.EventData) {
+	q.enqueue(func() {
+		q.Receiver.OnNewEvent(ctx, event)
+	})
+}
+
+func (q *queuedReceiver) OnReceipt(ctx context.Context, receipt internal.Receipt) {
+	q.enqueue(func() {
+		q.Receiver.OnReceipt(ctx, receipt)
+	})
+}
+
+func (q *queuedReceiver) OnEphemeralEvent(ctx context.Context, roomID string, ephEvent json.RawMessage) {
+	q.enqueue(func() {
+		q.Receiver.OnEphemeralEvent(ctx, roomID, ephEvent)
+	})
+}
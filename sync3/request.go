@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"strings"
+	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync3/extensions"
@@ -15,14 +16,31 @@ var (
 	SortByNotificationLevel = "by_notification_level"
 	SortByNotificationCount = "by_notification_count" // deprecated
 	SortByHighlightCount    = "by_highlight_count"    // deprecated
-	SortBy                  = []string{SortByHighlightCount, SortByName, SortByNotificationCount, SortByRecency, SortByNotificationLevel}
+	SortByJoinedRecency     = "by_joined_recency"
+	SortBy                  = []string{SortByHighlightCount, SortByName, SortByNotificationCount, SortByRecency, SortByNotificationLevel, SortByJoinedRecency}
 
 	Wildcard     = "*"
 	StateKeyLazy = "$LAZY"
 	StateKeyMe   = "$ME"
 
+	// The state which most clients need to render a room in a room list or open it, sent when a room
+	// subscription sets essential_state. These are served from the global cache's memory once loaded,
+	// whatever else is in required_state.
+	EssentialState = [][2]string{
+		{"m.room.create", ""},
+		{"m.room.encryption", ""},
+		{"m.room.name", ""},
+		{"m.room.avatar", ""},
+		{"m.room.canonical_alias", ""},
+		{"m.room.join_rules", ""},
+		{"m.room.topic", ""},
+	}
+
 	DefaultTimelineLimit = int64(20)
 	DefaultTimeoutMSecs  = 10 * 1000 // 10s
+
+	// The max number of pinned_rooms in a list.
+	MaxPinnedRooms = 50
 )
 
 type Request struct {
@@ -32,10 +50,21 @@ type Request struct {
 	RoomSubscriptions map[string]RoomSubscription `json:"room_subscriptions"`
 	UnsubscribeRooms  []string                    `json:"unsubscribe_rooms"`
 	Extensions        extensions.Request          `json:"extensions"`
+	// If true, rooms in list windows whose name or avatar change are sent in rooms_meta rather than
+	// as rooms. Sticky.
+	RoomsMeta *bool `json:"rooms_meta,omitempty"`
+	// The name of the profile which Lists belong to. Switching profile swaps the lists out for the lists
+	// last used with that profile, which are kept up-to-date by the server in the meantime. Sticky.
+	Profile *string `json:"profile,omitempty"`
+
+	// the lists of inactive profiles, keyed on profile name
+	profiles map[string]map[string]RequestList
 
 	// set via query params or inferred
 	pos          int64
 	timeoutMSecs int
+	// if set, the response may be written in parts as it is built
+	streamer *ResponseStreamer
 }
 
 type RequestList struct {
@@ -45,12 +74,39 @@ type RequestList struct {
 	Filters         *RequestFilters `json:"filters"`
 	SlowGetAllRooms *bool           `json:"slow_get_all_rooms,omitempty"`
 	Deleted         bool            `json:"deleted,omitempty"`
+	// Rooms which are always at the top of the list in this order, regardless of the sort order. Pinned
+	// rooms must still match the filters to appear in the list. Sticky; send [] to unpin all rooms.
+	PinnedRooms []string `json:"pinned_rooms,omitempty"`
+}
+
+// ActiveProfile returns the name of the profile the lists belong to. The default profile is "".
+func (r *Request) ActiveProfile() string {
+	if r.Profile == nil {
+		return ""
+	}
+	return *r.Profile
+}
+
+// NumLists returns the number of lists in all profiles, including inactive ones.
+func (r *Request) NumLists() int {
+	n := len(r.Lists)
+	for _, lists := range r.profiles {
+		n += len(lists)
+	}
+	return n
+}
+
+// RoomsMetaEnabled returns true if the client wants name and avatar changes sent in rooms_meta.
+func (r *Request) RoomsMetaEnabled() bool {
+	return r.RoomsMeta != nil && *r.RoomsMeta
 }
 
 func (rl *RequestList) ShouldGetAllRooms() bool {
 	return rl.SlowGetAllRooms != nil && *rl.SlowGetAllRooms
 }
 
+// SortOrderChanged returns true if the order of rooms in the list may have changed, either because the
+// sort order or the pinned rooms changed.
 func (rl *RequestList) SortOrderChanged(next *RequestList) bool {
 	prevLen := 0
 	if rl != nil {
@@ -64,6 +120,18 @@ func (rl *RequestList) SortOrderChanged(next *RequestList) bool {
 			return true
 		}
 	}
+	var prevPinned []string
+	if rl != nil {
+		prevPinned = rl.PinnedRooms
+	}
+	if len(prevPinned) != len(next.PinnedRooms) {
+		return true
+	}
+	for i := range prevPinned {
+		if prevPinned[i] != next.PinnedRooms[i] {
+			return true
+		}
+	}
 	return false
 }
 
@@ -257,6 +325,12 @@ func (r *Request) TimeoutMSecs() int {
 func (r *Request) SetTimeoutMSecs(timeout int) {
 	r.timeoutMSecs = timeout
 }
+func (r *Request) Streamer() *ResponseStreamer {
+	return r.streamer
+}
+func (r *Request) SetStreamer(s *ResponseStreamer) {
+	r.streamer = s
+}
 
 func (r *Request) Same(other *Request) bool {
 	serialised, err := json.Marshal(r)
@@ -278,6 +352,16 @@ type RequestDelta struct {
 	Unsubs []string
 	// The complete union of both lists (contains max(a,b) lists)
 	Lists map[string]RequestListDelta
+	// Set if the request switched profile. The lists of the previous profile are not in Lists.
+	ProfileSwitch *ProfileSwitch
+}
+
+// ProfileSwitch represents a request changing the active profile.
+type ProfileSwitch struct {
+	From string
+	To   string
+	// The lists of the From profile, which are now inactive.
+	Parked map[string]RequestList
 }
 
 // Internal struct used to represent a single list delta.
@@ -286,6 +370,9 @@ type RequestListDelta struct {
 	Prev *RequestList
 	// What is there now, nullable. Combined result.
 	Curr *RequestList
+	// True if the list was inactive until this request switched to its profile. Prev is the list as it
+	// was when it became inactive, but the client has not been told about changes since then.
+	Resumed bool
 }
 
 // Apply this delta on top of the request. Returns a new Request with the combined output, along
@@ -304,17 +391,47 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 			Extensions: r.Extensions.ApplyDelta(&nextReq.Extensions),
 		}
 	}
+	delta = &RequestDelta{}
+
+	// Swap out the lists if the profile changed. The lists of the new profile are then treated as if
+	// they were the lists in the previous request.
+	result.Profile = nextReq.Profile
+	if result.Profile == nil {
+		result.Profile = r.Profile
+	}
+	existingLists := r.Lists
+	if len(r.profiles) > 0 {
+		result.profiles = make(map[string]map[string]RequestList, len(r.profiles))
+		for profile, lists := range r.profiles {
+			result.profiles[profile] = lists
+		}
+	}
+	if prevProfile, profile := r.ActiveProfile(), result.ActiveProfile(); prevProfile != profile {
+		delta.ProfileSwitch = &ProfileSwitch{
+			From:   prevProfile,
+			To:     profile,
+			Parked: r.Lists,
+		}
+		if result.profiles == nil {
+			result.profiles = make(map[string]map[string]RequestList)
+		}
+		if len(r.Lists) > 0 {
+			result.profiles[prevProfile] = r.Lists
+		}
+		existingLists = result.profiles[profile]
+		delete(result.profiles, profile)
+	}
+
 	listKeys := make(set)
 	for k := range nextReq.Lists {
 		listKeys[k] = struct{}{}
 	}
-	for k := range r.Lists {
+	for k := range existingLists {
 		listKeys[k] = struct{}{}
 	}
-	delta = &RequestDelta{}
 	calculatedLists := make(map[string]RequestList, len(nextReq.Lists))
 	for listKey := range listKeys {
-		existingList, existingOk := r.Lists[listKey]
+		existingList, existingOk := existingLists[listKey]
 		nextList, nextOk := nextReq.Lists[listKey]
 		if !nextOk {
 			// copy over what they said before (sticky), no diffs to make
@@ -357,6 +474,18 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 		if includeOldRooms == nil {
 			includeOldRooms = existingList.IncludeOldRooms
 		}
+		includeHeroes := nextList.IncludeHeroes
+		if includeHeroes == nil {
+			includeHeroes = existingList.IncludeHeroes
+		}
+		threads := nextList.Threads
+		if threads == nil {
+			threads = existingList.Threads
+		}
+		essentialState := nextList.EssentialState
+		if essentialState == nil {
+			essentialState = existingList.EssentialState
+		}
 		timelineLimit := nextList.TimelineLimit
 		if timelineLimit == 0 {
 			timelineLimit = existingList.TimelineLimit
@@ -365,17 +494,25 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 		if filters == nil {
 			filters = existingList.Filters
 		}
+		pinnedRooms := nextList.PinnedRooms
+		if pinnedRooms == nil {
+			pinnedRooms = existingList.PinnedRooms
+		}
 
 		calculatedLists[listKey] = RequestList{
 			RoomSubscription: RoomSubscription{
 				RequiredState:   reqState,
 				TimelineLimit:   timelineLimit,
 				IncludeOldRooms: includeOldRooms,
+				IncludeHeroes:   includeHeroes,
+				Threads:         threads,
+				EssentialState:  essentialState,
 			},
 			Ranges:          rooms,
 			Sort:            sort,
 			Filters:         filters,
 			SlowGetAllRooms: slowGetAllRooms,
+			PinnedRooms:     pinnedRooms,
 		}
 	}
 	result.Lists = calculatedLists
@@ -387,10 +524,11 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 			Curr: &l,
 		}
 	}
-	for listKey := range r.Lists {
-		l := r.Lists[listKey]
+	for listKey := range existingLists {
+		l := existingLists[listKey]
 		rld := delta.Lists[listKey]
 		rld.Prev = &l
+		rld.Resumed = delta.ProfileSwitch != nil
 		delta.Lists[listKey] = rld
 	}
 
@@ -438,6 +576,10 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 	if result.BumpEventTypes == nil {
 		result.BumpEventTypes = r.BumpEventTypes
 	}
+	result.RoomsMeta = nextReq.RoomsMeta
+	if result.RoomsMeta == nil {
+		result.RoomsMeta = r.RoomsMeta
+	}
 
 	return
 }
@@ -448,11 +590,20 @@ type RequestFilters struct {
 	IsEncrypted    *bool     `json:"is_encrypted"`
 	IsInvite       *bool     `json:"is_invite"`
 	IsTombstoned   *bool     `json:"is_tombstoned"` // deprecated
+	IsPublic       *bool     `json:"is_public"`
 	RoomTypes      []*string `json:"room_types"`
 	NotRoomTypes   []*string `json:"not_room_types"`
 	RoomNameFilter string    `json:"room_name_like"`
 	Tags           []string  `json:"tags"`
 	NotTags        []string  `json:"not_tags"`
+	// Only include rooms the user joined in the last N milliseconds. This is evaluated when a room is
+	// added to or updated in a list, so rooms are not removed from the list purely due to the passage of time.
+	JoinedWithinMs *int64 `json:"joined_within_ms"`
+	// If true, exclude invites from users who don't share a joined room with the user, as these are likely spam.
+	ExcludeUnknownInviters *bool `json:"exclude_unknown_inviters"`
+	// Only include rooms with a current state event of one of these types. Only works for the state event
+	// types which the proxy is configured to index, as other state is not held in memory.
+	StateTypes []string `json:"state_types"`
 
 	// TODO options to control which events should be live-streamed e.g not_types, types from sync v2
 }
@@ -473,12 +624,34 @@ func (rf *RequestFilters) Include(r *RoomConnMetadata, finder RoomFinder) bool {
 	if rf.IsTombstoned != nil && *rf.IsTombstoned != (r.UpgradedRoomID != nil) {
 		return false
 	}
+	// the join rule is normalised by room version, so unsupported join rules are not treated as public
+	if rf.IsPublic != nil && *rf.IsPublic != r.IsPublic() {
+		return false
+	}
 	if rf.IsDM != nil && *rf.IsDM != r.IsDM {
 		return false
 	}
 	if rf.IsInvite != nil && *rf.IsInvite != r.IsInvite {
 		return false
 	}
+	if rf.ExcludeUnknownInviters != nil && *rf.ExcludeUnknownInviters && r.IsInvite && !r.InviterKnown {
+		return false
+	}
+	if rf.JoinedWithinMs != nil && (r.JoinedAt == 0 || time.Now().UnixMilli()-r.JoinedAt > *rf.JoinedWithinMs) {
+		return false
+	}
+	if len(rf.StateTypes) > 0 {
+		hasState := false
+		for _, evType := range rf.StateTypes {
+			if len(r.IndexedState[evType]) > 0 {
+				hasState = true
+				break
+			}
+		}
+		if !hasState {
+			return false
+		}
+	}
 	if rf.RoomNameFilter != "" && !strings.Contains(strings.ToLower(internal.CalculateRoomName(&r.RoomMetadata, 5)), strings.ToLower(rf.RoomNameFilter)) {
 		return false
 	}
@@ -525,9 +698,43 @@ type RoomSubscription struct {
 	RequiredState   [][2]string       `json:"required_state"`
 	TimelineLimit   int64             `json:"timeline_limit"`
 	IncludeOldRooms *RoomSubscription `json:"include_old_rooms"`
+	IncludeHeroes   *bool             `json:"include_heroes,omitempty"`
+	Threads         *bool             `json:"threads,omitempty"`
+	// If true, EssentialState is sent in addition to RequiredState, so clients don't have to list it. It is
+	// served from memory even when RequiredState has to be loaded from the database.
+	EssentialState *bool `json:"essential_state,omitempty"`
+	// Only honoured on room subscriptions: return the events around this event, e.g to resolve a permalink.
+	EventContext *EventContextRequest `json:"event_context,omitempty"`
+}
+
+type EventContextRequest struct {
+	EventID string `json:"event_id"`
+	// The max number of events to return either side of the event.
+	Limit int64 `json:"limit"`
+}
+
+// ThreadsEnabled returns true if the client asked for per-thread unread counts for rooms matching
+// this subscription.
+func (rs RoomSubscription) ThreadsEnabled() bool {
+	return rs.Threads != nil && *rs.Threads
+}
+
+// HeroesEnabled returns true if the client asked for heroes to be calculated and sent for rooms
+// matching this subscription.
+func (rs RoomSubscription) HeroesEnabled() bool {
+	return rs.IncludeHeroes != nil && *rs.IncludeHeroes
+}
+
+// EssentialStateEnabled returns true if the client asked for EssentialState for rooms matching this
+// subscription.
+func (rs RoomSubscription) EssentialStateEnabled() bool {
+	return rs.EssentialState != nil && *rs.EssentialState
 }
 
 func (rs RoomSubscription) RequiredStateChanged(other RoomSubscription) bool {
+	if rs.EssentialStateEnabled() != other.EssentialStateEnabled() {
+		return true
+	}
 	if len(rs.RequiredState) != len(other.RequiredState) {
 		return true
 	}
@@ -565,6 +772,34 @@ func (rs RoomSubscription) combineRecursive(other RoomSubscription, checkOldRoom
 	// combine together required_state fields, we'll union them later
 	result.RequiredState = append(rs.RequiredState, other.RequiredState...)
 
+	// include heroes if either subscription wants them
+	if rs.HeroesEnabled() {
+		result.IncludeHeroes = rs.IncludeHeroes
+	} else {
+		result.IncludeHeroes = other.IncludeHeroes
+	}
+
+	// include thread counts if either subscription wants them
+	if rs.ThreadsEnabled() {
+		result.Threads = rs.Threads
+	} else {
+		result.Threads = other.Threads
+	}
+
+	// include essential state if either subscription wants it
+	if rs.EssentialStateEnabled() {
+		result.EssentialState = rs.EssentialState
+	} else {
+		result.EssentialState = other.EssentialState
+	}
+
+	// event_context is only set on room subscriptions, so prefer whichever subscription has it
+	if rs.EventContext != nil {
+		result.EventContext = rs.EventContext
+	} else {
+		result.EventContext = other.EventContext
+	}
+
 	if checkOldRooms {
 		// set include_old_rooms if it is unset
 		if rs.IncludeOldRooms == nil {
@@ -621,9 +856,14 @@ func (rs RoomSubscription) RequiredStateMap(userID string) *internal.RequiredSta
 			result[tuple[0]] = append(result[tuple[0]], tuple[1])
 		}
 	}
-	return internal.NewRequiredStateMap(
+	rsm := internal.NewRequiredStateMap(
 		eventTypesWithWildcardStateKeys, stateKeysForWildcardEventType, result, allState, rs.LazyLoadMembers(),
 	)
+	// all state already includes the essential state, and adding it would filter out other state of these types
+	if rs.EssentialStateEnabled() && !allState {
+		rsm.SetEssentialState(EssentialState)
+	}
+	return rsm
 }
 
 // helper to find `null` or literal string matches
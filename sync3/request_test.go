@@ -6,9 +6,14 @@ import (
 	"reflect"
 	"sort"
 	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
 )
 
 func TestRoomSubscriptionUnion(t *testing.T) {
+	boolTrue := true
 	alice := "@alice:localhost"
 	bob := "@bob:localhost"
 	testCases := []struct {
@@ -166,6 +171,34 @@ func TestRoomSubscriptionUnion(t *testing.T) {
 			matches:           [][2]string{{"m.room.member", alice}, {"a", "b"}},
 			noMatches:         [][2]string{{"m.room.member", "@someone-else"}, {"m.room.member", ""}, {"m.room.member", bob}},
 		},
+		{
+			name: "essential state",
+			a:    RoomSubscription{EssentialState: &boolTrue, RequiredState: [][2]string{{"m.room.name", ""}, {"m.room.member", alice}}},
+			// the essential state is loaded separately, see RequiredStateMap.EssentialStateTuples
+			wantQueryStateMap: map[string][]string{
+				"m.room.name":   {""},
+				"m.room.member": {alice},
+			},
+			matches:   [][2]string{{"m.room.create", ""}, {"m.room.topic", ""}, {"m.room.member", alice}},
+			noMatches: [][2]string{{"m.room.power_levels", ""}, {"m.room.member", bob}, {"m.room.topic", "foo"}},
+		},
+		{
+			name: "essential state UNION wildcard state keys",
+			a:    RoomSubscription{RequiredState: [][2]string{{"m.room.topic", Wildcard}}},
+			b:    &RoomSubscription{EssentialState: &boolTrue},
+			wantQueryStateMap: map[string][]string{
+				"m.room.topic": nil,
+			},
+			matches:   [][2]string{{"m.room.create", ""}, {"m.room.topic", ""}, {"m.room.topic", "foo"}},
+			noMatches: [][2]string{{"m.room.power_levels", ""}},
+		},
+		{
+			// essential state must not filter the other state of its event types
+			name:              "essential state with all state",
+			a:                 RoomSubscription{EssentialState: &boolTrue, RequiredState: [][2]string{{Wildcard, Wildcard}}},
+			wantQueryStateMap: make(map[string][]string),
+			matches:           [][2]string{{"m.room.create", ""}, {"m.room.name", "foo"}, {"a", "b"}},
+		},
 	}
 	for _, tc := range testCases {
 		sub := tc.a
@@ -193,6 +226,8 @@ func TestRoomSubscriptionUnion(t *testing.T) {
 }
 
 func TestRoomSubscriptionRequiredStateChanged(t *testing.T) {
+	boolTrue := true
+	boolFalse := false
 	a := RoomSubscription{
 		TimelineLimit: 5,
 		RequiredState: [][2]string{
@@ -217,6 +252,13 @@ func TestRoomSubscriptionRequiredStateChanged(t *testing.T) {
 	assertBool(t, "different length", a.RequiredStateChanged(b), true)
 	// This is TRUE even though semantically it is false
 	assertBool(t, "reordered required_state", a.RequiredStateChanged(c), true)
+	d := a
+	d.EssentialState = &boolTrue
+	assertBool(t, "essential_state enabled", a.RequiredStateChanged(d), true)
+	assertBool(t, "essential_state disabled", d.RequiredStateChanged(a), true)
+	e := a
+	e.EssentialState = &boolFalse
+	assertBool(t, "essential_state false and unset", a.RequiredStateChanged(e), false)
 }
 
 type testData struct {
@@ -805,6 +847,42 @@ func TestRequestListDiffs(t *testing.T) {
 			},
 			sortChanged: &boolTrue,
 		},
+		{
+			name: "same pinned rooms",
+			a: &RequestList{
+				Sort:        []string{SortByName},
+				PinnedRooms: []string{"!a", "!b"},
+			},
+			b: RequestList{
+				Sort:        []string{SortByName},
+				PinnedRooms: []string{"!a", "!b"},
+			},
+			sortChanged: &boolFalse,
+		},
+		{
+			name: "reordered pinned rooms",
+			a: &RequestList{
+				Sort:        []string{SortByName},
+				PinnedRooms: []string{"!a", "!b"},
+			},
+			b: RequestList{
+				Sort:        []string{SortByName},
+				PinnedRooms: []string{"!b", "!a"},
+			},
+			sortChanged: &boolTrue,
+		},
+		{
+			name: "unpinned rooms",
+			a: &RequestList{
+				Sort:        []string{SortByName},
+				PinnedRooms: []string{"!a"},
+			},
+			b: RequestList{
+				Sort:        []string{SortByName},
+				PinnedRooms: []string{},
+			},
+			sortChanged: &boolTrue,
+		},
 	}
 	for _, tc := range testCases {
 		if tc.sortChanged != nil {
@@ -1075,3 +1153,124 @@ func jsonEqual(t *testing.T, name string, got, want interface{}) {
 func listPtr(l RequestList) *RequestList {
 	return &l
 }
+
+func TestRequestFiltersJoinedWithinMs(t *testing.T) {
+	withinMs := int64(time.Hour / time.Millisecond)
+	rf := &RequestFilters{JoinedWithinMs: &withinMs}
+	testCases := []struct {
+		joinedAt int64
+		want     bool
+	}{
+		{joinedAt: 0, want: false}, // not joined
+		{joinedAt: time.Now().Add(-time.Minute).UnixMilli(), want: true},
+		{joinedAt: time.Now().Add(-2 * time.Hour).UnixMilli(), want: false},
+	}
+	for _, tc := range testCases {
+		r := &RoomConnMetadata{UserRoomData: caches.UserRoomData{JoinedAt: tc.joinedAt}}
+		if got := rf.Include(r, finder{}); got != tc.want {
+			t.Errorf("Include: joined_at=%d got %v want %v", tc.joinedAt, got, tc.want)
+		}
+	}
+}
+
+func TestRequestFiltersExcludeUnknownInviters(t *testing.T) {
+	exclude := true
+	rf := &RequestFilters{ExcludeUnknownInviters: &exclude}
+	testCases := []struct {
+		name string
+		urd  caches.UserRoomData
+		want bool
+	}{
+		{name: "joined room", urd: caches.UserRoomData{}, want: true},
+		{name: "invite from known user", urd: caches.UserRoomData{IsInvite: true, InviterKnown: true}, want: true},
+		{name: "invite from unknown user", urd: caches.UserRoomData{IsInvite: true}, want: false},
+	}
+	for _, tc := range testCases {
+		r := &RoomConnMetadata{UserRoomData: tc.urd}
+		if got := rf.Include(r, finder{}); got != tc.want {
+			t.Errorf("Include: %s got %v want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRequestFiltersStateTypes(t *testing.T) {
+	rf := &RequestFilters{StateTypes: []string{"im.vector.modular.widgets"}}
+	var withWidget internal.RoomMetadata
+	withWidget.SetIndexedState("im.vector.modular.widgets", "jitsi", json.RawMessage(`{"type":"jitsi"}`))
+	var removedWidget internal.RoomMetadata
+	removedWidget.SetIndexedState("im.vector.modular.widgets", "jitsi", json.RawMessage(`{"type":"jitsi"}`))
+	removedWidget.SetIndexedState("im.vector.modular.widgets", "jitsi", json.RawMessage(`{}`))
+	var otherState internal.RoomMetadata
+	otherState.SetIndexedState("io.element.functional_members", "", json.RawMessage(`{"service_members":["@bot:localhost"]}`))
+	testCases := []struct {
+		name     string
+		metadata internal.RoomMetadata
+		want     bool
+	}{
+		{name: "no indexed state", want: false},
+		{name: "has widget", metadata: withWidget, want: true},
+		{name: "widget removed", metadata: removedWidget, want: false},
+		{name: "other indexed state", metadata: otherState, want: false},
+	}
+	for _, tc := range testCases {
+		r := &RoomConnMetadata{RoomMetadata: tc.metadata}
+		if got := rf.Include(r, finder{}); got != tc.want {
+			t.Errorf("Include: %s got %v want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRequestApplyDeltaProfiles(t *testing.T) {
+	work := "work"
+	workLists := map[string]RequestList{
+		"a": {Ranges: SliceRanges{{0, 10}}, Sort: []string{SortByName}},
+	}
+	req, _ := (*Request)(nil).ApplyDelta(&Request{Lists: workLists, Profile: &work})
+	if req.ActiveProfile() != work {
+		t.Fatalf("ActiveProfile: got %q want %q", req.ActiveProfile(), work)
+	}
+
+	// switching to another profile parks the lists and starts afresh
+	personal := "personal"
+	req, delta := req.ApplyDelta(&Request{
+		Lists:   map[string]RequestList{"b": {Ranges: SliceRanges{{0, 5}}}},
+		Profile: &personal,
+	})
+	if delta.ProfileSwitch == nil || delta.ProfileSwitch.From != work || delta.ProfileSwitch.To != personal {
+		t.Fatalf("ProfileSwitch: got %+v", delta.ProfileSwitch)
+	}
+	if _, ok := delta.ProfileSwitch.Parked["a"]; !ok {
+		t.Errorf("ProfileSwitch: list 'a' was not parked")
+	}
+	if _, ok := delta.Lists["a"]; ok {
+		t.Errorf("delta.Lists: parked list 'a' is in the delta")
+	}
+	if _, ok := req.Lists["b"]; !ok || len(req.Lists) != 1 {
+		t.Errorf("Lists: got %v want only 'b'", req.Lists)
+	}
+	if req.NumLists() != 2 {
+		t.Errorf("NumLists: got %d want 2", req.NumLists())
+	}
+
+	// a request without a profile stays on the current profile
+	req, delta = req.ApplyDelta(&Request{})
+	if delta.ProfileSwitch != nil || req.ActiveProfile() != personal {
+		t.Errorf("sticky profile: got switch %+v profile %q", delta.ProfileSwitch, req.ActiveProfile())
+	}
+
+	// switching back resumes the parked lists
+	req, delta = req.ApplyDelta(&Request{Profile: &work})
+	ld, ok := delta.Lists["a"]
+	if !ok || !ld.Resumed || ld.Prev == nil || ld.Curr == nil {
+		t.Fatalf("delta.Lists['a']: got %+v want resumed list", ld)
+	}
+	if !reflect.DeepEqual(ld.Curr.Ranges, workLists["a"].Ranges) {
+		t.Errorf("resumed ranges: got %v want %v", ld.Curr.Ranges, workLists["a"].Ranges)
+	}
+	if _, ok := req.Lists["b"]; ok {
+		t.Errorf("Lists: list 'b' of the inactive profile is active")
+	}
+	if req.NumLists() != 2 {
+		t.Errorf("NumLists: got %d want 2", req.NumLists())
+	}
+}
@@ -2,7 +2,6 @@ package sync3
 
 import (
 	"encoding/json"
-	"strconv"
 
 	"github.com/matrix-org/sliding-sync/sync3/extensions"
 	"github.com/tidwall/gjson"
@@ -18,22 +17,40 @@ const (
 type Response struct {
 	Lists map[string]ResponseList `json:"lists"`
 
-	Rooms      map[string]Room     `json:"rooms"`
+	Rooms map[string]Room `json:"rooms"`
+	// Rooms in list windows whose name or avatar changed and which have nothing else to send. Only
+	// set when the client asks for rooms_meta.
+	RoomsMeta  map[string]RoomMeta `json:"rooms_meta,omitempty"`
 	Extensions extensions.Response `json:"extensions"`
 
 	Pos     string `json:"pos"`
 	TxnID   string `json:"txn_id,omitempty"`
 	Session string `json:"session_id,omitempty"`
+	// Set when the server is having trouble with its database and is serving this response from
+	// in-memory caches only. Data may be missing or stale.
+	Degraded bool `json:"degraded,omitempty"`
+	// Invites which arrived in a burst are not sent as rooms, and are summarised here instead.
+	CollapsedInvites *CollapsedInvites `json:"collapsed_invites,omitempty"`
+}
+
+type CollapsedInvites struct {
+	Count int `json:"count"`
+	// A sample of the room IDs of the collapsed invites.
+	Sample []string `json:"sample,omitempty"`
 }
 
 type ResponseList struct {
 	Ops   []ResponseOp `json:"ops,omitempty"`
 	Count int          `json:"count"`
+	// The room IDs in each requested range, in the order the ranges were requested. Only set when
+	// the server is running in debug mode, to let clients check their local list against the server.
+	RelevantRooms [][]string `json:"relevant_rooms,omitempty"`
 }
 
+// PosInt returns the connection position of this response, ignoring any extension positions.
 func (r *Response) PosInt() int64 {
-	p, _ := strconv.ParseInt(r.Pos, 10, 64)
-	return p
+	p, _ := ParsePosition(r.Pos)
+	return p.Conn
 }
 
 func (r *Response) ListOps() int {
@@ -61,30 +78,36 @@ func (r *Response) RoomIDsToTimelineEventIDs() map[string][]string {
 // Custom unmarshal so we can dynamically create the right ResponseOp for Ops
 func (r *Response) UnmarshalJSON(b []byte) error {
 	temporary := struct {
-		Rooms map[string]Room `json:"rooms"`
-		Lists map[string]struct {
-			Ops   []json.RawMessage `json:"ops"`
-			Count int               `json:"count"`
+		Rooms     map[string]Room     `json:"rooms"`
+		RoomsMeta map[string]RoomMeta `json:"rooms_meta"`
+		Lists     map[string]struct {
+			Ops           []json.RawMessage `json:"ops"`
+			Count         int               `json:"count"`
+			RelevantRooms [][]string        `json:"relevant_rooms"`
 		} `json:"lists"`
 		Extensions extensions.Response `json:"extensions"`
 
-		Pos     string `json:"pos"`
-		TxnID   string `json:"txn_id,omitempty"`
-		Session string `json:"session_id,omitempty"`
+		Pos      string `json:"pos"`
+		TxnID    string `json:"txn_id,omitempty"`
+		Session  string `json:"session_id,omitempty"`
+		Degraded bool   `json:"degraded,omitempty"`
 	}{}
 	if err := json.Unmarshal(b, &temporary); err != nil {
 		return err
 	}
 	r.Rooms = temporary.Rooms
+	r.RoomsMeta = temporary.RoomsMeta
 	r.Pos = temporary.Pos
 	r.TxnID = temporary.TxnID
 	r.Session = temporary.Session
+	r.Degraded = temporary.Degraded
 	r.Extensions = temporary.Extensions
 	r.Lists = make(map[string]ResponseList, len(temporary.Lists))
 
 	for listKey, l := range temporary.Lists {
 		var list ResponseList
 		list.Count = l.Count
+		list.RelevantRooms = l.RelevantRooms
 		for _, op := range l.Ops {
 			if gjson.GetBytes(op, "range").Exists() {
 				var oper ResponseOpRange
@@ -0,0 +1,129 @@
+package sync3
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// TestResponseMarshalling checks the JSON encoding of responses. This must pass both with and without
+// the fastjson build tag, to ensure the hand-written marshallers match encoding/json.
+func TestResponseMarshalling(t *testing.T) {
+	index := 3
+	name := "New name"
+	avatar := ""
+	res := Response{
+		Lists: map[string]ResponseList{
+			"b": {Count: 0},
+			"a": {
+				Count: 10,
+				Ops: []ResponseOp{
+					&ResponseOpRange{Operation: OpSync, Range: [2]int64{0, 1}, RoomIDs: []string{"!a:x", "!b:x"}},
+					&ResponseOpRange{Operation: OpInvalidate, Range: [2]int64{5, 9}},
+					&ResponseOpSingle{Operation: OpDelete, Index: &index},
+					&ResponseOpSingle{Operation: OpInsert, Index: &index, RoomID: "!c:x"},
+				},
+				RelevantRooms: [][]string{{"!a:x", "!b:x"}, nil},
+			},
+		},
+		Rooms: map[string]Room{
+			"!b:x": {},
+			"!a:x": {
+				Name:              "Tricky \"name\" <b>&\\ \n\t\x01 \u2028 \u00e9 \U0001F389",
+				Avatar:            "mxc://x/avatar",
+				RequiredState:     []json.RawMessage{json.RawMessage(`{"type":"m.room.create","state_key":""}`)},
+				Timeline:          []json.RawMessage{json.RawMessage(`{"type":"m.room.message","content":{"body":"<hi>"}}`)},
+				NotificationCount: 2,
+				HighlightCount:    1,
+				Initial:           true,
+				IsDM:              true,
+				IsEncrypted:       true,
+				RoomType:          "m.space",
+				JoinedCount:       3,
+				InvitedCount:      1,
+				PrevBatch:         "p1",
+				NumLive:           1,
+				Heroes:            []Hero{{ID: "@bob:x", DisplayName: "Bob"}, {ID: "@charlie:x"}},
+				UnreadThreadNotifications: map[string]internal.ThreadUnreadCounts{
+					"$t2": {NotificationCount: 1},
+					"$t1": {HighlightCount: 1, NotificationCount: 2},
+				},
+				EventContext: &EventContext{
+					Event:        json.RawMessage(`{"event_id":"$e"}`),
+					EventsBefore: []json.RawMessage{json.RawMessage(`{"event_id":"$d"}`)},
+				},
+				ContentHints: &ContentHints{Script: "Latn", MediaHeavy: true},
+				BumpStamp:    1700000000000,
+			},
+			"!c:x": {InviteState: []json.RawMessage{json.RawMessage(`{"type":"m.room.member"}`)}},
+		},
+		RoomsMeta: map[string]RoomMeta{
+			"!e:x": {Name: &name, Avatar: &avatar},
+		},
+		Pos:      "5",
+		TxnID:    "txn",
+		Degraded: true,
+		CollapsedInvites: &CollapsedInvites{
+			Count:  7,
+			Sample: []string{"!d:x", "!e:x"},
+		},
+	}
+	want := `{"lists":{"a":{"ops":[{"op":"SYNC","range":[0,1],"room_ids":["!a:x","!b:x"]},{"op":"INVALIDATE","range":[5,9]},{"op":"DELETE","index":3},{"op":"INSERT","index":3,"room_id":"!c:x"}],"count":10,"relevant_rooms":[["!a:x","!b:x"],null]},"b":{"count":0}},"rooms":{"!a:x":{"name":"Tricky \"name\" \u003cb\u003e\u0026\\ \n\t\u0001 \u2028 é 🎉","avatar":"mxc://x/avatar","required_state":[{"type":"m.room.create","state_key":""}],"timeline":[{"type":"m.room.message","content":{"body":"\u003chi\u003e"}}],"notification_count":2,"highlight_count":1,"initial":true,"is_dm":true,"is_encrypted":true,"room_type":"m.space","joined_count":3,"invited_count":1,"prev_batch":"p1","num_live":1,"heroes":[{"user_id":"@bob:x","displayname":"Bob"},{"user_id":"@charlie:x"}],"unread_thread_notifications":{"$t1":{"highlight_count":1,"notification_count":2},"$t2":{"highlight_count":0,"notification_count":1}},"event_context":{"event":{"event_id":"$e"},"events_before":[{"event_id":"$d"}]},"content_hints":{"script":"Latn","media_heavy":true},"bump_stamp":1700000000000},"!b:x":{"notification_count":0,"highlight_count":0},"!c:x":{"invite_state":[{"type":"m.room.member"}],"notification_count":0,"highlight_count":0}},"rooms_meta":{"!e:x":{"name":"New name","avatar":""}},"extensions":{},"pos":"5","txn_id":"txn","degraded":true,"collapsed_invites":{"count":7,"sample":["!d:x","!e:x"]}}`
+	got, err := json.Marshal(res)
+	if err != nil {
+		t.Fatalf("failed to marshal response: %s", err)
+	}
+	if string(got) != want {
+		t.Fatalf("wrong JSON:\ngot  %s\nwant %s", string(got), want)
+	}
+	// and it can be read back in
+	var roundTrip Response
+	if err := json.Unmarshal(got, &roundTrip); err != nil {
+		t.Fatalf("failed to unmarshal response: %s", err)
+	}
+	if roundTrip.ListOps() != 4 || roundTrip.Rooms["!a:x"].Name != res.Rooms["!a:x"].Name || *roundTrip.RoomsMeta["!e:x"].Name != name {
+		t.Fatalf("response did not round trip: %+v", roundTrip)
+	}
+}
+
+// Compare with `-tags fastjson` to see the gain from the hand-written marshallers.
+func BenchmarkMarshalResponse(b *testing.B) {
+	res := Response{
+		Lists: map[string]ResponseList{},
+		Rooms: map[string]Room{},
+		Pos:   "1",
+	}
+	var roomIDs []string
+	for i := 0; i < 100; i++ {
+		roomID := fmt.Sprintf("!%d:localhost", i)
+		roomIDs = append(roomIDs, roomID)
+		timeline := make([]json.RawMessage, 20)
+		for j := range timeline {
+			timeline[j] = json.RawMessage(fmt.Sprintf(
+				`{"type":"m.room.message","event_id":"$%d_%d","sender":"@alice:localhost","content":{"msgtype":"m.text","body":"hello world"}}`, i, j,
+			))
+		}
+		res.Rooms[roomID] = Room{
+			Name:              fmt.Sprintf("Room %d", i),
+			Timeline:          timeline,
+			NotificationCount: int64(i),
+			JoinedCount:       i,
+			PrevBatch:         "prev",
+		}
+	}
+	res.Lists["a"] = ResponseList{
+		Count: len(roomIDs),
+		Ops: []ResponseOp{
+			&ResponseOpRange{Operation: OpSync, Range: [2]int64{0, int64(len(roomIDs) - 1)}, RoomIDs: roomIDs},
+		},
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := json.Marshal(res); err != nil {
+			b.Fatalf("failed to marshal: %s", err)
+		}
+	}
+}
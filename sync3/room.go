@@ -7,8 +7,11 @@ import (
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 )
 
+// Room is the response for a single room. If you add fields, update the hand-written marshaller in
+// marshal_fastjson.go.
 type Room struct {
 	Name              string            `json:"name,omitempty"`
+	Avatar            string            `json:"avatar,omitempty"`
 	RequiredState     []json.RawMessage `json:"required_state,omitempty"`
 	Timeline          []json.RawMessage `json:"timeline,omitempty"`
 	InviteState       []json.RawMessage `json:"invite_state,omitempty"`
@@ -16,10 +19,80 @@ type Room struct {
 	HighlightCount    int64             `json:"highlight_count"`
 	Initial           bool              `json:"initial,omitempty"`
 	IsDM              bool              `json:"is_dm,omitempty"`
+	IsEncrypted       bool              `json:"is_encrypted,omitempty"`
+	RoomType          string            `json:"room_type,omitempty"`
 	JoinedCount       int               `json:"joined_count,omitempty"`
 	InvitedCount      int               `json:"invited_count,omitempty"`
 	PrevBatch         string            `json:"prev_batch,omitempty"`
 	NumLive           int               `json:"num_live,omitempty"`
+	Heroes            []Hero            `json:"heroes,omitempty"`
+	// MSC3773: thread root event ID -> counts, only sent when `threads` is set on the room subscription.
+	UnreadThreadNotifications map[string]internal.ThreadUnreadCounts `json:"unread_thread_notifications,omitempty"`
+	// The events around an event, only sent when `event_context` is set on the room subscription.
+	EventContext *EventContext `json:"event_context,omitempty"`
+	// Guesses about what the room contains, only sent if the server derives them. See ContentHints.
+	ContentHints *ContentHints `json:"content_hints,omitempty"`
+	// The timestamp this connection sorts the room by in by_recency lists, after bump_event_types are
+	// applied. Clients can use this to check the order of rooms in their lists after applying ops.
+	BumpStamp uint64 `json:"bump_stamp,omitempty"`
+}
+
+// ContentHints are derived from the recent messages in a room, for clients experimenting with grouping
+// rooms by what they contain. They are guesses and may change as new messages arrive.
+type ContentHints struct {
+	// The ISO 15924 code of the script most recent messages are written in, e.g "Latn" or "Cyrl".
+	Script string `json:"script,omitempty"`
+	// True if at least half of the recent messages are images, videos, audio or files.
+	MediaHeavy bool `json:"media_heavy,omitempty"`
+}
+
+// NewContentHints converts the hints for a room into their client representation. Returns nil if nothing
+// has been derived yet.
+func NewContentHints(h *internal.ContentHints) *ContentHints {
+	hints := &ContentHints{
+		Script:     h.Script(),
+		MediaHeavy: h.MediaHeavy(),
+	}
+	if *hints == (ContentHints{}) {
+		return nil
+	}
+	return hints
+}
+
+// RoomMeta is a compact update for a room whose name or avatar changed. Only the changed fields are
+// set. An empty avatar means the avatar was removed.
+type RoomMeta struct {
+	Name   *string `json:"name,omitempty"`
+	Avatar *string `json:"avatar,omitempty"`
+}
+
+// EventContext is an event and the events either side of it in the room, in the same shape as the
+// CSAPI /context response: events_before is in reverse chronological order.
+type EventContext struct {
+	Event        json.RawMessage   `json:"event"`
+	EventsBefore []json.RawMessage `json:"events_before,omitempty"`
+	EventsAfter  []json.RawMessage `json:"events_after,omitempty"`
+}
+
+// Hero is a member of the room used to calculate the room name, sent when `include_heroes` is set.
+type Hero struct {
+	ID          string `json:"user_id"`
+	DisplayName string `json:"displayname,omitempty"`
+}
+
+// NewHeroes converts the heroes for a room into their client representation.
+func NewHeroes(heroes []internal.Hero) []Hero {
+	if len(heroes) == 0 {
+		return nil
+	}
+	result := make([]Hero, len(heroes))
+	for i, h := range heroes {
+		result[i] = Hero{
+			ID:          h.ID,
+			DisplayName: h.Name,
+		}
+	}
+	return result
 }
 
 type RoomConnMetadata struct {
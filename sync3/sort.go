@@ -17,6 +17,7 @@ type SortableRooms struct {
 	finder        RoomFinder
 	roomIDs       []string
 	roomIDToIndex map[string]int // room_id -> index in rooms
+	pinned        map[string]int // room_id -> index in pinned_rooms
 }
 
 func NewSortableRooms(finder RoomFinder, rooms []string) *SortableRooms {
@@ -84,39 +85,29 @@ func (s *SortableRooms) Subslice(i, j int64) Subslicer {
 	}
 }
 
+// SetPinnedRooms sets the rooms which are always sorted to the top of the list, in the order given.
+// Takes effect on the next call to Sort.
+func (s *SortableRooms) SetPinnedRooms(roomIDs []string) {
+	if len(roomIDs) == 0 {
+		s.pinned = nil
+		return
+	}
+	s.pinned = make(map[string]int, len(roomIDs))
+	for i, roomID := range roomIDs {
+		if _, exists := s.pinned[roomID]; !exists {
+			s.pinned[roomID] = i
+		}
+	}
+}
+
 func (s *SortableRooms) Sort(sortBy []string) error {
 	// TODO: find a way to plumb a context into this assert
 	internal.Assert("sortBy is not empty", len(sortBy) != 0)
-	comparators := []func(i, j int) int{}
-	for _, sort := range sortBy {
-		switch sort {
-		case SortByHighlightCount:
-			comparators = append(comparators, s.comparatorSortByHighlightCount)
-		case SortByNotificationCount:
-			comparators = append(comparators, s.comparatorSortByNotificationCount)
-		case SortByName:
-			comparators = append(comparators, s.comparatorSortByName)
-		case SortByRecency:
-			comparators = append(comparators, s.comparatorSortByRecency)
-		case SortByNotificationLevel:
-			comparators = append(comparators, s.comparatorSortByNotificationLevel)
-		default:
-			return fmt.Errorf("unknown sort order: %s", sort)
-		}
+	chain, err := s.comparatorChain(sortBy)
+	if err != nil {
+		return err
 	}
-	sort.SliceStable(s.roomIDs, func(i, j int) bool {
-		for _, fn := range comparators {
-			val := fn(i, j)
-			if val == 1 {
-				return true
-			} else if val == -1 {
-				return false
-			}
-			// continue to next comparator as these are equal
-		}
-		// the two items are identical
-		return false
-	})
+	sort.SliceStable(s.roomIDs, chain.less)
 	for i := range s.roomIDs {
 		s.roomIDToIndex[s.roomIDs[i]] = i
 	}
@@ -124,6 +115,52 @@ func (s *SortableRooms) Sort(sortBy []string) error {
 	return nil
 }
 
+// comparator compares the rooms at index i and j: -1 = false, +1 = true, 0 = match
+type comparator func(i, j int) int
+
+// comparatorChain is a multi-key sort: later comparators are only consulted when all earlier ones
+// consider the two rooms equal.
+type comparatorChain []comparator
+
+func (c comparatorChain) less(i, j int) bool {
+	for _, fn := range c {
+		val := fn(i, j)
+		if val == 1 {
+			return true
+		} else if val == -1 {
+			return false
+		}
+		// continue to next comparator as these are equal
+	}
+	// the two items are identical
+	return false
+}
+
+// comparatorChain returns the comparators for the given sort operations, in order.
+func (s *SortableRooms) comparatorChain(sortBy []string) (comparatorChain, error) {
+	comparators := map[string]comparator{
+		SortByHighlightCount:    s.comparatorSortByHighlightCount,
+		SortByNotificationCount: s.comparatorSortByNotificationCount,
+		SortByName:              s.comparatorSortByName,
+		SortByRecency:           s.comparatorSortByRecency,
+		SortByNotificationLevel: s.comparatorSortByNotificationLevel,
+		SortByJoinedRecency:     s.comparatorSortByJoinedRecency,
+	}
+	chain := make(comparatorChain, 0, len(sortBy)+1)
+	if len(s.pinned) > 0 {
+		// pinned rooms override the sort order
+		chain = append(chain, s.comparatorPinned)
+	}
+	for _, op := range sortBy {
+		fn, ok := comparators[op]
+		if !ok {
+			return nil, fmt.Errorf("unknown sort order: %s", op)
+		}
+		chain = append(chain, fn)
+	}
+	return chain, nil
+}
+
 // Comparator functions: -1 = false, +1 = true, 0 = match
 
 func (s *SortableRooms) resolveRooms(i, j int) (ri, rj *RoomConnMetadata) {
@@ -132,6 +169,23 @@ func (s *SortableRooms) resolveRooms(i, j int) (ri, rj *RoomConnMetadata) {
 	return
 }
 
+func (s *SortableRooms) comparatorPinned(i, j int) int {
+	pi, iPinned := s.pinned[s.roomIDs[i]]
+	pj, jPinned := s.pinned[s.roomIDs[j]]
+	if iPinned && jPinned {
+		if pi < pj {
+			return 1
+		}
+		return -1
+	}
+	if iPinned {
+		return 1
+	} else if jPinned {
+		return -1
+	}
+	return 0
+}
+
 func (s *SortableRooms) comparatorSortByName(i, j int) int {
 	ri, rj := s.resolveRooms(i, j)
 	if ri.CanonicalisedName == rj.CanonicalisedName {
@@ -154,6 +208,17 @@ func (s *SortableRooms) comparatorSortByRecency(i, j int) int {
 	return -1
 }
 
+func (s *SortableRooms) comparatorSortByJoinedRecency(i, j int) int {
+	ri, rj := s.resolveRooms(i, j)
+	if ri.JoinedAt == rj.JoinedAt {
+		return 0
+	}
+	if ri.JoinedAt > rj.JoinedAt {
+		return 1
+	}
+	return -1
+}
+
 func (s *SortableRooms) comparatorSortByHighlightCount(i, j int) int {
 	ri, rj := s.resolveRooms(i, j)
 	if ri.HighlightCount == rj.HighlightCount {
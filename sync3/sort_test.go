@@ -1,6 +1,8 @@
 package sync3
 
 import (
+	"context"
+	"fmt"
 	"reflect"
 	"strings"
 	"testing"
@@ -46,6 +48,7 @@ func TestSortBySingleOperation(t *testing.T) {
 				HighlightCount:    3,
 				NotificationCount: 12,
 				CanonicalisedName: "foo",
+				JoinedAt:          50,
 			},
 		},
 		{
@@ -57,6 +60,7 @@ func TestSortBySingleOperation(t *testing.T) {
 				HighlightCount:    0,
 				NotificationCount: 3,
 				CanonicalisedName: "koo",
+				JoinedAt:          400,
 			},
 		},
 		{
@@ -68,6 +72,7 @@ func TestSortBySingleOperation(t *testing.T) {
 				HighlightCount:    2,
 				NotificationCount: 7,
 				CanonicalisedName: "yoo",
+				JoinedAt:          100,
 			},
 		},
 		{
@@ -79,6 +84,7 @@ func TestSortBySingleOperation(t *testing.T) {
 				HighlightCount:    1,
 				NotificationCount: 1,
 				CanonicalisedName: "boo",
+				JoinedAt:          200,
 			},
 		},
 	}
@@ -87,12 +93,14 @@ func TestSortBySingleOperation(t *testing.T) {
 	// highlight: 1,3,4,2
 	// notif: 1,3,2,4
 	// level+recency: 3,4,1,2 as 3,4,1 have highlights then sorted by recency
+	// joined recency: 2,4,3,1
 	wantMap := map[string][]string{
 		SortByName:              {room4, room1, room2, room3},
 		SortByRecency:           {room3, room4, room2, room1},
 		SortByHighlightCount:    {room1, room3, room4, room2},
 		SortByNotificationCount: {room1, room3, room2, room4},
 		SortByNotificationLevel + " " + SortByRecency: {room3, room4, room1, room2},
+		SortByJoinedRecency:                           {room2, room4, room3, room1},
 	}
 	f := newFinder(rooms)
 	sr := NewSortableRooms(f, f.roomIDs)
@@ -251,6 +259,47 @@ func TestSortableRoomsRemove(t *testing.T) {
 	}
 }
 
+func TestSortPinnedRooms(t *testing.T) {
+	rooms := []*RoomConnMetadata{
+		{RoomMetadata: internal.RoomMetadata{RoomID: "!1:localhost", LastMessageTimestamp: 100}},
+		{RoomMetadata: internal.RoomMetadata{RoomID: "!2:localhost", LastMessageTimestamp: 400}},
+		{RoomMetadata: internal.RoomMetadata{RoomID: "!3:localhost", LastMessageTimestamp: 200}},
+		{RoomMetadata: internal.RoomMetadata{RoomID: "!4:localhost", LastMessageTimestamp: 300}},
+	}
+	f := newFinder(rooms)
+	sr := NewSortableRooms(f, f.roomIDs)
+	// pinned rooms which aren't in the list are ignored
+	sr.SetPinnedRooms([]string{"!3:localhost", "!unknown:localhost", "!1:localhost"})
+	if err := sr.Sort([]string{SortByRecency}); err != nil {
+		t.Fatalf("Sort: %s", err)
+	}
+	want := []string{"!3:localhost", "!1:localhost", "!2:localhost", "!4:localhost"}
+	if !reflect.DeepEqual(sr.roomIDs, want) {
+		t.Errorf("got %v want %v", sr.roomIDs, want)
+	}
+
+	// a pinned room stays where it is when it gets more recent activity than everything else
+	reqList := &RequestList{
+		Ranges:      SliceRanges{{0, 3}},
+		Sort:        []string{SortByRecency},
+		PinnedRooms: []string{"!3:localhost", "!1:localhost"},
+	}
+	f.rooms["!1:localhost"].LastMessageTimestamp = 500
+	ops, _ := CalculateListOps(context.Background(), reqList, sr, "!1:localhost", ListOpChange)
+	if len(ops) != 0 {
+		t.Errorf("got ops %+v for a pinned room, want none", ops)
+	}
+	// unpinning the rooms sorts them normally again
+	sr.SetPinnedRooms(nil)
+	if err := sr.Sort([]string{SortByRecency}); err != nil {
+		t.Fatalf("Sort: %s", err)
+	}
+	want = []string{"!1:localhost", "!2:localhost", "!4:localhost", "!3:localhost"}
+	if !reflect.DeepEqual(sr.roomIDs, want) {
+		t.Errorf("got %v want %v", sr.roomIDs, want)
+	}
+}
+
 // dedicated test as it relies on multiple fields
 func TestSortByNotificationLevel(t *testing.T) {
 	// create the full set of possible sort variables, most recent message last
@@ -383,3 +432,100 @@ func TestSortByNotificationLevel(t *testing.T) {
 		t.Errorf("want: %v", wantRoomIDs)
 	}
 }
+
+// sortKeyRank returns a value for the room which is larger when the room should be sorted earlier,
+// for every sort operation except by_name which sorts ascending.
+func sortKeyRank(op string, r *RoomConnMetadata) int64 {
+	switch op {
+	case SortByHighlightCount:
+		return int64(r.HighlightCount)
+	case SortByNotificationCount:
+		return int64(r.NotificationCount)
+	case SortByRecency:
+		return int64(r.LastMessageTimestamp)
+	case SortByJoinedRecency:
+		return r.JoinedAt
+	case SortByNotificationLevel:
+		if r.HighlightCount > 0 {
+			return 3
+		}
+		if r.NotificationCount > 0 && r.Encrypted {
+			return 2
+		}
+		if r.NotificationCount > 0 {
+			return 1
+		}
+		return 0
+	}
+	panic("unknown sort op " + op)
+}
+
+// compareBy returns -1 if a sorts before b, +1 if b sorts before a and 0 if they are equal for this op.
+func compareBy(op string, a, b *RoomConnMetadata) int {
+	if op == SortByName {
+		return strings.Compare(a.CanonicalisedName, b.CanonicalisedName)
+	}
+	ra, rb := sortKeyRank(op, a), sortKeyRank(op, b)
+	if ra > rb {
+		return -1
+	} else if ra < rb {
+		return 1
+	}
+	return 0
+}
+
+// Test that every pairing of sort operations cascades to the second operation only when the first
+// considers the rooms equal.
+func TestSortByComparatorChain(t *testing.T) {
+	// every field only takes a couple of values so there are lots of ties for each sort operation
+	var rooms []*RoomConnMetadata
+	var roomIDs []string
+	for i := 0; i < 64; i++ {
+		roomID := fmt.Sprintf("!%d:localhost", i)
+		rooms = append(rooms, &RoomConnMetadata{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID:               roomID,
+				LastMessageTimestamp: uint64(i % 2),
+				Encrypted:            (i/2)%2 == 0,
+			},
+			UserRoomData: caches.UserRoomData{
+				HighlightCount:    (i / 4) % 2,
+				NotificationCount: (i / 8) % 2,
+				CanonicalisedName: []string{"a", "b"}[(i/16)%2],
+				JoinedAt:          int64((i / 32) % 2),
+			},
+		})
+		roomIDs = append(roomIDs, roomID)
+	}
+	f := newFinder(rooms)
+	for _, first := range SortBy {
+		for _, second := range SortBy {
+			if first == second {
+				continue
+			}
+			sortBy := []string{first, second}
+			sr := NewSortableRooms(f, append([]string{}, roomIDs...))
+			if err := sr.Sort(sortBy); err != nil {
+				t.Fatalf("Sort %v: %s", sortBy, err)
+			}
+			for i := 1; i < len(sr.roomIDs); i++ {
+				a := f.ReadOnlyRoom(sr.roomIDs[i-1])
+				b := f.ReadOnlyRoom(sr.roomIDs[i])
+				cmp := compareBy(first, a, b)
+				if cmp == 0 {
+					cmp = compareBy(second, a, b)
+				}
+				if cmp > 0 {
+					t.Errorf("Sort %v: %s sorted before %s", sortBy, a.RoomID, b.RoomID)
+				}
+			}
+		}
+	}
+}
+
+func TestSortUnknownOperation(t *testing.T) {
+	sr := NewSortableRooms(newFinder(nil), nil)
+	if err := sr.Sort([]string{SortByRecency, "by_nothing"}); err == nil {
+		t.Fatalf("Sort: expected error for unknown sort operation")
+	}
+}
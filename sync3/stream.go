@@ -0,0 +1,138 @@
+package sync3
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// ResponseStreamer writes a Response to the client in parts, flushing each part as soon as it is written
+// so clients can start rendering large initial syncs before every room has been loaded. The parts are
+// written in the order they appear in the JSON encoding of a Response: first the lists, then rooms in
+// batches, then everything else. `pos` comes after `rooms`, so a client only sees the position once it has
+// received every room.
+//
+// The streamed JSON is equivalent to the JSON encoding of the final Response, except rooms are in the
+// order they were written rather than sorted by room ID.
+type ResponseStreamer struct {
+	// The min number of rooms in a response before it is streamed. Smaller responses are written in one go.
+	MinRooms int
+
+	w       http.ResponseWriter
+	flusher http.Flusher
+	started bool
+	written map[string]struct{}
+	err     error
+}
+
+// NewResponseStreamer returns a streamer which writes to w, or nil if w cannot be flushed.
+func NewResponseStreamer(w http.ResponseWriter, minRooms int) *ResponseStreamer {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil
+	}
+	return &ResponseStreamer{
+		MinRooms: minRooms,
+		w:        w,
+		flusher:  flusher,
+		written:  make(map[string]struct{}),
+	}
+}
+
+// Started returns true if part of the response has been written. Once started, the status code and
+// headers have been sent, so errors can no longer be returned to the client.
+func (s *ResponseStreamer) Started() bool {
+	return s.started
+}
+
+// WriteLists starts the response by writing the lists. Must be called once, before WriteRooms.
+func (s *ResponseStreamer) WriteLists(lists map[string]ResponseList) error {
+	if s.started {
+		return fmt.Errorf("ResponseStreamer: lists already written")
+	}
+	s.started = true
+	s.w.Header().Set("Content-Type", "application/json")
+	s.w.WriteHeader(200)
+	b, err := json.Marshal(lists)
+	if err != nil {
+		s.err = err
+		return err
+	}
+	buf := append([]byte(`{"lists":`), b...)
+	buf = append(buf, `,"rooms":{`...)
+	return s.write(buf)
+}
+
+// WriteRooms writes the rooms in `roomIDs` order. Room IDs which are missing from `rooms` or which have
+// already been written are skipped.
+func (s *ResponseStreamer) WriteRooms(roomIDs []string, rooms map[string]Room) error {
+	if s.err != nil {
+		return s.err
+	}
+	var buf []byte
+	for _, roomID := range roomIDs {
+		room, ok := rooms[roomID]
+		if !ok {
+			continue
+		}
+		if _, ok = s.written[roomID]; ok {
+			continue
+		}
+		key, err := json.Marshal(roomID)
+		if err != nil {
+			s.err = err
+			return err
+		}
+		val, err := json.Marshal(room)
+		if err != nil {
+			s.err = err
+			return err
+		}
+		if len(s.written) > 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, key...)
+		buf = append(buf, ':')
+		buf = append(buf, val...)
+		s.written[roomID] = struct{}{}
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+	return s.write(buf)
+}
+
+// Finish writes the rest of the response. The lists and rooms in `resp` are ignored as they have already
+// been written.
+func (s *ResponseStreamer) Finish(resp *Response) error {
+	if s.err != nil {
+		return s.err
+	}
+	rest := *resp
+	rest.Lists = nil
+	rest.Rooms = nil
+	b, err := json.Marshal(rest)
+	if err != nil {
+		s.err = err
+		return err
+	}
+	// reuse the normal encoding for everything after the rooms, so the two can't drift apart
+	prefix := []byte(`{"lists":null,"rooms":null`)
+	if !bytes.HasPrefix(b, prefix) {
+		s.err = fmt.Errorf("ResponseStreamer: unexpected response encoding: %s", b)
+		return s.err
+	}
+	buf := append([]byte{'}'}, b[len(prefix):]...)
+	buf = append(buf, '\n')
+	return s.write(buf)
+}
+
+func (s *ResponseStreamer) write(b []byte) error {
+	if _, err := s.w.Write(b); err != nil {
+		s.err = err
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
@@ -0,0 +1,76 @@
+package sync3
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResponseStreamer(t *testing.T) {
+	res := Response{
+		Lists: map[string]ResponseList{
+			"a": {
+				Count: 3,
+				Ops: []ResponseOp{
+					&ResponseOpRange{Operation: OpSync, Range: [2]int64{0, 2}, RoomIDs: []string{"!c:x", "!a:x", "!b:x"}},
+				},
+			},
+		},
+		Rooms: map[string]Room{
+			"!a:x": {Name: "A", NotificationCount: 1},
+			"!b:x": {Name: "B"},
+			"!c:x": {Name: "C", Timeline: []json.RawMessage{json.RawMessage(`{"type":"m.room.message"}`)}},
+		},
+		Pos:   "1",
+		TxnID: "txn",
+	}
+	w := httptest.NewRecorder()
+	s := NewResponseStreamer(w, 1)
+	if s == nil {
+		t.Fatalf("NewResponseStreamer returned nil for a flushable writer")
+	}
+	if s.Started() {
+		t.Fatalf("streamer started before anything was written")
+	}
+	if err := s.WriteLists(res.Lists); err != nil {
+		t.Fatalf("WriteLists: %s", err)
+	}
+	if !s.Started() || !w.Flushed {
+		t.Fatalf("lists were not flushed")
+	}
+	// rooms are written in priority order, unknown and duplicate rooms are skipped
+	if err := s.WriteRooms([]string{"!c:x", "!unknown:x"}, res.Rooms); err != nil {
+		t.Fatalf("WriteRooms: %s", err)
+	}
+	if err := s.WriteRooms([]string{"!a:x", "!c:x", "!b:x"}, res.Rooms); err != nil {
+		t.Fatalf("WriteRooms: %s", err)
+	}
+	if err := s.Finish(&res); err != nil {
+		t.Fatalf("Finish: %s", err)
+	}
+	if w.Code != 200 || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("got status %d content-type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	body := w.Body.Bytes()
+	if i, j := bytes.Index(body, []byte(`"!c:x":{`)), bytes.Index(body, []byte(`"!a:x":{`)); i == -1 || j == -1 || i > j {
+		t.Errorf("rooms were not written in the order given: %s", body)
+	}
+
+	// the streamed response must decode to the same response as the normal encoding
+	var got Response
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("streamed response is not valid JSON: %s\n%s", err, body)
+	}
+	gotJSON, err := json.Marshal(got)
+	if err != nil {
+		t.Fatalf("failed to marshal streamed response: %s", err)
+	}
+	wantJSON, err := json.Marshal(res)
+	if err != nil {
+		t.Fatalf("failed to marshal response: %s", err)
+	}
+	if !bytes.Equal(gotJSON, wantJSON) {
+		t.Errorf("streamed response mismatch:\ngot  %s\nwant %s", gotJSON, wantJSON)
+	}
+}
@@ -32,7 +32,7 @@ func NewJoinedRoomsTracker() *JoinedRoomsTracker {
 
 // Startup efficiently sets up the joined rooms tracker, but isn't safe to call with live traffic,
 // as it replaces all known in-memory state. Panics if called on a non-empty tracker.
-func (t *JoinedRoomsTracker) Startup(roomToJoinedUsers map[string][]string) {
+func (t *JoinedRoomsTracker) Startup(roomToJoinedUsers, roomToInvitedUsers map[string][]string) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	if len(t.roomIDToJoinedUsers) > 0 || len(t.userIDToJoinedRooms) > 0 {
@@ -51,6 +51,39 @@ func (t *JoinedRoomsTracker) Startup(roomToJoinedUsers map[string][]string) {
 		}
 		t.roomIDToJoinedUsers[roomID] = userSet
 	}
+	for roomID, userIDs := range roomToInvitedUsers {
+		userSet := make(set)
+		for _, u := range userIDs {
+			userSet[u] = struct{}{}
+		}
+		t.roomIDToInvitedUsers[roomID] = userSet
+	}
+}
+
+// SetRoomMembers replaces the joined and invited users for this room, e.g. after recounting them from the
+// database because some membership events may have been missed.
+func (t *JoinedRoomsTracker) SetRoomMembers(roomID string, joined, invited []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for userID := range t.roomIDToJoinedUsers[roomID] {
+		delete(t.userIDToJoinedRooms[userID], roomID)
+	}
+	joinedUsers := make(set, len(joined))
+	for _, userID := range joined {
+		joinedUsers[userID] = struct{}{}
+		joinedRooms := t.userIDToJoinedRooms[userID]
+		if joinedRooms == nil {
+			joinedRooms = make(set)
+		}
+		joinedRooms[roomID] = struct{}{}
+		t.userIDToJoinedRooms[userID] = joinedRooms
+	}
+	invitedUsers := make(set, len(invited))
+	for _, userID := range invited {
+		invitedUsers[userID] = struct{}{}
+	}
+	t.roomIDToJoinedUsers[roomID] = joinedUsers
+	t.roomIDToInvitedUsers[roomID] = invitedUsers
 }
 
 func (t *JoinedRoomsTracker) IsUserJoined(userID, roomID string) bool {
@@ -66,6 +99,13 @@ func (t *JoinedRoomsTracker) IsUserJoined(userID, roomID string) bool {
 }
 
 // returns true if the state changed
+func (t *JoinedRoomsTracker) IsUserInvited(userID, roomID string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	_, invited := t.roomIDToInvitedUsers[roomID][userID]
+	return invited
+}
+
 func (t *JoinedRoomsTracker) UserJoinedRoom(userID, roomID string) bool {
 	u := make([]string, 1, 1)
 	u[0] = userID
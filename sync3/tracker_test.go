@@ -51,10 +51,13 @@ func TestTracker(t *testing.T) {
 	assertNumEquals(t, jrt.NumInvitedUsersForRoom("room4"), 0)
 	jrt.UsersInvitedToRoom([]string{"bob"}, "room4")
 	assertNumEquals(t, jrt.NumInvitedUsersForRoom("room4"), 1)
+	assertBool(t, "bob should be invited", jrt.IsUserInvited("bob", "room4"), true)
+	assertBool(t, "alice should not be invited", jrt.IsUserInvited("alice", "room4"), false)
 	jrt.UsersInvitedToRoom([]string{"bob"}, "room4") // dupe invites don't bother it
 	assertNumEquals(t, jrt.NumInvitedUsersForRoom("room4"), 1)
 	jrt.UserLeftRoom("bob", "room4")
 	assertNumEquals(t, jrt.NumInvitedUsersForRoom("room4"), 0)
+	assertBool(t, "bob should not be invited", jrt.IsUserInvited("bob", "room4"), false)
 }
 
 func TestTrackerStartup(t *testing.T) {
@@ -68,6 +71,8 @@ func TestTrackerStartup(t *testing.T) {
 		roomA: {alice, bob},
 		roomB: {bob},
 		roomC: {alice},
+	}, map[string][]string{
+		roomB: {alice},
 	})
 	assertEqualSlices(t, "", jrt.JoinedRoomsForUser(alice), []string{roomA, roomC})
 	assertEqualSlices(t, "", jrt.JoinedRoomsForUser(bob), []string{roomA, roomB})
@@ -79,10 +84,33 @@ func TestTrackerStartup(t *testing.T) {
 	assertBool(t, "bob should be joined", jrt.IsUserJoined(bob, roomB), true)
 	assertBool(t, "bob should not be joined", jrt.IsUserJoined(bob, roomC), false)
 	assertInt(t, jrt.NumInvitedUsersForRoom(roomA), 0)
-	assertInt(t, jrt.NumInvitedUsersForRoom(roomB), 0)
+	assertInt(t, jrt.NumInvitedUsersForRoom(roomB), 1)
 	assertInt(t, jrt.NumInvitedUsersForRoom(roomC), 0)
 }
 
+func TestTrackerSetRoomMembers(t *testing.T) {
+	roomA := "!a"
+	roomB := "!b"
+	alice := "@alice"
+	bob := "@bob"
+	charlie := "@charlie"
+	jrt := NewJoinedRoomsTracker()
+	jrt.UsersJoinedRoom([]string{alice, bob}, roomA)
+	jrt.UserJoinedRoom(alice, roomB)
+	jrt.UsersInvitedToRoom([]string{charlie}, roomA)
+
+	// bob left and charlie joined without us seeing the events, and alice invited someone
+	jrt.SetRoomMembers(roomA, []string{alice, charlie}, []string{"@doris"})
+	_, joinCount := jrt.JoinedUsersForRoom(roomA, nil)
+	assertInt(t, joinCount, 2)
+	assertInt(t, jrt.NumInvitedUsersForRoom(roomA), 1)
+	assertBool(t, "bob should not be joined", jrt.IsUserJoined(bob, roomA), false)
+	assertBool(t, "charlie should be joined", jrt.IsUserJoined(charlie, roomA), true)
+	assertEqualSlices(t, "", jrt.JoinedRoomsForUser(alice), []string{roomA, roomB})
+	assertEqualSlices(t, "", jrt.JoinedRoomsForUser(bob), []string{})
+	assertEqualSlices(t, "", jrt.JoinedRoomsForUser(charlie), []string{roomA})
+}
+
 func assertBool(t *testing.T, msg string, got, want bool) {
 	t.Helper()
 	if got != want {
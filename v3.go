@@ -15,6 +15,7 @@ import (
 	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync2"
 	"github.com/matrix-org/sliding-sync/sync2/handler2"
+	"github.com/matrix-org/sliding-sync/sync3"
 	"github.com/matrix-org/sliding-sync/sync3/handler"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
@@ -36,6 +37,127 @@ type Opts struct {
 	// if true, publishing messages will block until the consumer has consumed it.
 	// Assumes a single producer and a single consumer.
 	TestingSynchronousPubsub bool
+	// The maximum amount of time to spend serving an initial sync request (no `pos`). When the deadline
+	// is near, a partial response is returned and the rooms which weren't loaded in time are sent in the
+	// next response. Zero means no deadline.
+	InitialSyncDeadline time.Duration
+	// The maximum amount of time to spend serving an incremental sync request, including long-polling.
+	// Zero means no deadline.
+	IncrementalSyncDeadline time.Duration
+	// If true, GET requests to /sync are served a sync v2 shaped response generated from the proxy's
+	// database, for legacy clients which do not support sliding sync.
+	EnableV2Compat bool
+	// The bearer token required to use the admin API. If empty, the admin API is disabled.
+	AdminToken string
+	// If set, the lists of a sample of users are periodically written to this directory as gzipped JSON
+	// for postmortem debugging.
+	ListSnapshotDir string
+	// How often to snapshot each sampled connection. Defaults to 5 minutes.
+	ListSnapshotInterval time.Duration
+	// How long to keep snapshots for. Defaults to 1 hour.
+	ListSnapshotRetention time.Duration
+	// The fraction of users to snapshot, between 0 and 1.
+	ListSnapshotSampleRate float64
+	// The max number of live list operations to send per list per response, and per minute per connection.
+	// When exceeded, the operations are collapsed into a SYNC of the list. Zero means no limit.
+	MaxListOpsPerResponse int
+	MaxListOpsPerMinute   int
+	// If set, devices which have not made a request for this long have their pollers stopped and their
+	// data deleted. The data is refetched if they return. Zero disables this.
+	InactiveUserGCAfter time.Duration
+	// How long to keep the to-device messages and device data of a device after its access token is
+	// rejected by the homeserver, in case the token is used again. Zero deletes them straight away.
+	DepartedDeviceGrace time.Duration
+	// If > 0, the max number of unacknowledged to-device messages to keep for each device. The oldest
+	// messages are dropped first. Zero means no cap.
+	ToDeviceMaxPerDevice int
+	// If set, to-device messages which have not been acknowledged for this long are deleted. Zero keeps
+	// them until they are acknowledged.
+	ToDeviceMaxAge time.Duration
+	// If set, transaction IDs of sent events are deleted after this long. Zero keeps them forever.
+	TransactionIDMaxAge time.Duration
+	// If set, pollers for devices which have not made a request for a day pause whilst writing poll data to
+	// the database takes longer than this on average, so active users stay responsive. Zero disables this.
+	PollerBackpressure time.Duration
+	// If set, hot tables are analyzed when their statistics go stale and table and index bloat is reported
+	// via metrics, this often. Missing indexes are reported at startup. Zero disables this.
+	DBMaintenanceInterval time.Duration
+	// The number of database errors within 30s which trips the storage circuit breaker. Zero disables
+	// the breaker.
+	StorageBreakerThreshold int
+	// The number of timeline events to prefetch for rooms which the user is likely to open soon, so that
+	// the room subscription is served from memory. Zero disables prefetching.
+	PrefetchTimelineLimit int
+	// If set, event JSON is encrypted in the database with a key derived from this. Events written before
+	// this was set remain readable. Once set, it must not be changed or removed.
+	EventEncryptionKey string
+	// Caps on the limits clients can request, e.g the max timeline_limit. Zero values mean no limit.
+	Limits sync3.Limits
+	// If set, anonymous aggregate usage stats are posted to this URL once a day. Off by default.
+	StatsEndpoint string
+	// The event types which don't make a room more recent, e.g reactions. If nil, defaults to
+	// internal.DefaultIgnoredLatestEventTypes.
+	IgnoredLatestEventTypes []string
+	// If > 0, invites are collapsed into a count when a user receives more than this many invites within
+	// InviteBurstWindow, to protect clients from invite spam. The window defaults to 1 minute.
+	InviteBurstThreshold int
+	InviteBurstWindow    time.Duration
+	// If > 0, initial sync responses with at least this many rooms are streamed to the client, sending the
+	// lists and the highest priority rooms first so clients can start rendering before every room is loaded.
+	EarlyFlushMinRooms int
+	// If > 0, the max number of rooms to hold metadata for in memory. Rooms which haven't been used recently
+	// are evicted and reloaded from the database when needed. Unset means all rooms are held in memory.
+	GlobalCacheMaxRooms int
+	// If true, clients can POST to the notify endpoint after sending events, to make their poller poll again
+	// straight away so their own events come down their sync stream sooner.
+	EnableNotify bool
+	// If true, clients can GET the diagnostics endpoint to download a bundle describing their connection
+	// (sticky request, poller state and recent response sizes and timings, without content) for bug reports.
+	EnableDiagnostics bool
+	// If > 0, the events table is hash-partitioned on room ID into this many partitions at startup, for
+	// deployments with hundreds of millions of events. Existing events are copied, which can take a long time.
+	// The number of partitions cannot be changed afterwards.
+	EventsPartitions int
+	// If > 0, since tokens are written for all devices every interval rather than after every poll, reducing
+	// write load on large deployments at the cost of re-polling up to one interval of data after a crash.
+	SinceBatchInterval time.Duration
+	// If set, the connection string of a read-only replica of the database. Reads of timelines and room state
+	// are sent to it when it has replayed every event written so far, and to the primary otherwise or whilst
+	// the replica is failing. Writes always go to the primary.
+	ReadReplicaDB string
+	// If > 0, the number of hours of per-user costs (DB time, bytes served, events) to keep in memory,
+	// viewable via the admin API.
+	CostAccountingHours int
+	// If set, a snapshot of room metadata and memberships is kept at this path and loaded at startup, so only
+	// rooms which changed since the snapshot need to be loaded from the database.
+	StartupSnapshotPath string
+	// How often to refresh the startup snapshot. Defaults to 10 minutes.
+	StartupSnapshotInterval time.Duration
+	// If true, room metadata is loaded from the database the first time a room is used rather than for every
+	// room at startup. Takes precedence over StartupSnapshotPath.
+	LazyGlobalCache bool
+	// If true, the server starts listening straight away rather than once all rooms are loaded. Requests are
+	// rejected with HTTP 503 until memberships have loaded, then room metadata is loaded lazily whilst the
+	// rest is loaded in the background. Takes precedence over LazyGlobalCache and StartupSnapshotPath.
+	BackgroundStartup bool
+	// If true, rooms include content_hints derived from their recent messages, e.g the script they are
+	// written in and whether they are mostly media, for clients experimenting with grouping rooms.
+	ContentHints bool
+	// If > 0, user caches are updated asynchronously with up to this many pending updates per user, so a user
+	// with slow connections cannot delay live updates for everyone else.
+	AsyncDispatchQueueSize int
+	// If > 0, the longest an extension can take to produce its data before the response is sent without it.
+	// The extension's data is sent in the next response instead.
+	ExtensionTimeout time.Duration
+	// If set, a JSON file describing tenants and their quotas. See handler.TenantConfig.
+	TenantsFile string
+	// If true, payloads from the pollers are written to the database before being delivered, so pollers never
+	// wait for delivery and undelivered payloads are delivered after a restart.
+	PersistentQueue bool
+	// Custom state event types (e.g widgets) whose current content is kept in room metadata, so it can be
+	// used for filtering and sorting rooms without loading room state. These are in addition to
+	// internal.DefaultIndexedStateTypes.
+	IndexedStateTypes []string
 }
 
 type server struct {
@@ -56,6 +178,7 @@ func allowCORS(next http.Handler) http.HandlerFunc {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept, Authorization")
+		w.Header().Set("Access-Control-Expose-Headers", handler.PosHeader+", "+handler.InstanceHeader)
 		if req.Method == "OPTIONS" {
 			w.WriteHeader(200)
 			return
@@ -74,6 +197,30 @@ func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Han
 		DestinationServer: destHomeserver,
 	}
 	store := state.NewStorage(postgresURI)
+	if opts.EventsPartitions > 0 {
+		if err := state.PartitionEventsTable(store.DB, opts.EventsPartitions); err != nil {
+			panic(err)
+		}
+	}
+	if opts.ReadReplicaDB != "" {
+		if err := store.SetReadReplica(opts.ReadReplicaDB); err != nil {
+			panic(err)
+		}
+	}
+	if opts.EventEncryptionKey != "" {
+		if err := store.EventsTable.EnableEncryption(opts.EventEncryptionKey); err != nil {
+			panic(err)
+		}
+	}
+	if opts.IgnoredLatestEventTypes != nil {
+		store.LatestEventFilter = internal.NewLatestEventFilter(opts.IgnoredLatestEventTypes)
+	}
+	if len(opts.IndexedStateTypes) > 0 {
+		store.IndexedStateTypes = append(
+			append([]string{}, internal.DefaultIndexedStateTypes...), opts.IndexedStateTypes...,
+		)
+	}
+	store.ToDeviceTable.SetMaxMessagesPerDevice(opts.ToDeviceMaxPerDevice)
 	storev2 := sync2.NewStore(postgresURI, secret)
 	bufferSize := 50
 	if opts.TestingSynchronousPubsub {
@@ -83,29 +230,179 @@ func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Han
 		opts.MaxPendingEventUpdates = 2000
 	}
 	pubSub := pubsub.NewPubSub(bufferSize)
+	// v2 payloads go from the pollers to the v3 handler, v3 payloads go the other way
+	var v2Pub pubsub.Notifier = pubSub
+	var v2Sub pubsub.Listener = pubSub
+	if opts.PersistentQueue {
+		queue := pubsub.NewPersistentQueue(state.NewNotificationQueueTable(store.DB))
+		v2Pub = queue
+		v2Sub = queue
+		logger.Info().Msg("v2 payloads will be queued in the database")
+	}
 
 	// create v2 handler
-	h2, err := handler2.NewHandler(postgresURI, sync2.NewPollerMap(v2Client, opts.AddPrometheusMetrics), storev2, store, v2Client, pubSub, pubSub, opts.AddPrometheusMetrics)
+	pMap := sync2.NewPollerMap(v2Client, opts.AddPrometheusMetrics)
+	pMap.SetBackpressureThreshold(opts.PollerBackpressure)
+	h2, err := handler2.NewHandler(postgresURI, pMap, storev2, store, v2Client, v2Pub, pubSub, opts.AddPrometheusMetrics)
 	if err != nil {
 		panic(err)
 	}
 
 	// create v3 handler
-	h3, err := handler.NewSync3Handler(store, storev2, v2Client, postgresURI, secret, opts.Debug, pubSub, pubSub, opts.AddPrometheusMetrics, opts.MaxPendingEventUpdates)
+	h3, err := handler.NewSync3Handler(store, storev2, v2Client, postgresURI, secret, opts.Debug, pubSub, v2Sub, opts.AddPrometheusMetrics, opts.MaxPendingEventUpdates)
 	if err != nil {
 		panic(err)
 	}
-	storeSnapshot, err := store.GlobalSnapshot()
-	if err != nil {
-		panic(err)
+	h3.GlobalCache.SetMaxRooms(opts.GlobalCacheMaxRooms)
+	if opts.ContentHints {
+		h3.GlobalCache.SetContentHints()
+	}
+	if opts.AsyncDispatchQueueSize > 0 {
+		h3.EnableAsyncDispatch(opts.AsyncDispatchQueueSize)
+	}
+	var storeSnapshot state.StartupSnapshot
+	switch {
+	case opts.BackgroundStartup:
+		h3.StartupInBackground()
+		logger.Info().Msg("loading memberships in the background, room metadata will be loaded lazily")
+	case opts.LazyGlobalCache:
+		h3.GlobalCache.SetLazyLoading()
+		storeSnapshot, err = store.MembershipSnapshot()
+		if err != nil {
+			panic(err)
+		}
+		logger.Info().Msg("retrieved memberships from database, room metadata will be loaded lazily")
+	case opts.StartupSnapshotPath != "":
+		storeSnapshot, err = store.WarmStartupSnapshot(opts.StartupSnapshotPath)
+		if err != nil {
+			panic(err)
+		}
+		logger.Info().Str("path", opts.StartupSnapshotPath).Msg("retrieved global snapshot from startup snapshot")
+		if opts.StartupSnapshotInterval == 0 {
+			opts.StartupSnapshotInterval = 10 * time.Minute
+		}
+		go refreshStartupSnapshot(store, opts.StartupSnapshotPath, opts.StartupSnapshotInterval)
+	default:
+		storeSnapshot, err = store.GlobalSnapshot()
+		if err != nil {
+			panic(err)
+		}
+		logger.Info().Msg("retrieved global snapshot from database")
+	}
+	if !opts.BackgroundStartup {
+		h3.Startup(&storeSnapshot)
+	}
+	h3.V2CompatEnabled = opts.EnableV2Compat
+	h3.Extensions.ExtensionTimeout = opts.ExtensionTimeout
+	if opts.TenantsFile != "" {
+		tenantConfig, err := handler.LoadTenantConfig(opts.TenantsFile)
+		if err != nil {
+			panic(err)
+		}
+		h3.SetTenants(handler.NewTenants(*tenantConfig))
+		logger.Info().Str("file", opts.TenantsFile).Int("quotas", len(tenantConfig.Quotas)).Msg("tenant quotas enabled")
+	}
+	h3.NotifyEnabled = opts.EnableNotify
+	h3.DiagnosticsEnabled = opts.EnableDiagnostics
+	if opts.CostAccountingHours > 0 {
+		h3.CostTracker = handler.NewCostTracker(opts.CostAccountingHours)
+	}
+	h3.MaxListOpsPerResponse = opts.MaxListOpsPerResponse
+	h3.MaxListOpsPerMinute = opts.MaxListOpsPerMinute
+	h3.PrefetchTimelineLimit = opts.PrefetchTimelineLimit
+	h3.Limits = opts.Limits
+	h3.EarlyFlushMinRooms = opts.EarlyFlushMinRooms
+	if opts.InviteBurstThreshold > 0 {
+		if opts.InviteBurstWindow == 0 {
+			opts.InviteBurstWindow = time.Minute
+		}
+		h3.InviteBurstThreshold = opts.InviteBurstThreshold
+		h3.InviteBurstWindow = opts.InviteBurstWindow
+	}
+	if opts.StorageBreakerThreshold > 0 {
+		h3.StorageBreaker = handler.NewCircuitBreaker(opts.StorageBreakerThreshold, 30*time.Second, 30*time.Second)
+	}
+	if opts.ListSnapshotDir != "" && opts.ListSnapshotSampleRate > 0 {
+		if opts.ListSnapshotInterval == 0 {
+			opts.ListSnapshotInterval = 5 * time.Minute
+		}
+		if opts.ListSnapshotRetention == 0 {
+			opts.ListSnapshotRetention = time.Hour
+		}
+		h3.ListSnapshotter = handler.NewListSnapshotter(
+			opts.ListSnapshotDir, opts.ListSnapshotInterval, opts.ListSnapshotRetention, opts.ListSnapshotSampleRate,
+		)
+		if err := h3.ListSnapshotter.Start(); err != nil {
+			panic(err)
+		}
+		logger.Info().Str("dir", opts.ListSnapshotDir).Float64("sample_rate", opts.ListSnapshotSampleRate).Msg("list snapshots enabled")
+	}
+
+	if opts.StatsEndpoint != "" {
+		reporter := handler.NewStatsReporter(opts.StatsEndpoint, Version, 24*time.Hour, store, storev2)
+		if err := reporter.Start(); err != nil {
+			panic(err)
+		}
+		logger.Info().Str("endpoint", opts.StatsEndpoint).Msg("usage stats reporting enabled")
+	}
+
+	h2.SetDepartedDeviceGracePeriod(opts.DepartedDeviceGrace)
+	if opts.DepartedDeviceGrace > 0 {
+		go h2.StartDepartedDeviceCleanup(time.Minute)
+	}
+	if opts.InactiveUserGCAfter > 0 {
+		go h2.StartInactiveUserGC(opts.InactiveUserGCAfter, time.Hour)
+	}
+	if opts.DBMaintenanceInterval > 0 {
+		maintenance := state.NewMaintenance(store.DB)
+		if opts.AddPrometheusMetrics {
+			maintenance.RegisterPrometheusMetrics()
+		}
+		go maintenance.Run(opts.DBMaintenanceInterval)
+	}
+	if opts.ToDeviceMaxAge > 0 {
+		go h2.StartToDeviceExpiry(opts.ToDeviceMaxAge, time.Hour)
+	}
+	if opts.TransactionIDMaxAge > 0 {
+		go h2.StartTransactionIDExpiry(opts.TransactionIDMaxAge, time.Hour)
+	}
+	if opts.PollerBackpressure > 0 {
+		go h2.StartPollerBackpressure(24*time.Hour, 10*time.Minute)
+	}
+	if opts.SinceBatchInterval > 0 {
+		go h2.StartSinceTokenBatching(opts.SinceBatchInterval)
 	}
-	logger.Info().Msg("retrieved global snapshot from database")
-	h3.Startup(&storeSnapshot)
 
 	// begin consuming from these positions
 	h2.Listen()
-	h3.Listen()
-	return h2, h3
+	if !opts.BackgroundStartup {
+		// otherwise this happens once the background startup has loaded memberships
+		h3.Listen()
+	}
+	var h http.Handler = h3
+	if opts.InitialSyncDeadline > 0 || opts.IncrementalSyncDeadline > 0 {
+		h = handler.WithRequestDeadlines(h, opts.InitialSyncDeadline, opts.IncrementalSyncDeadline)
+	}
+	if opts.AdminToken != "" {
+		h = handler.WithAdminAPI(h, h3, opts.AdminToken)
+	}
+	return h2, h
+}
+
+// refreshStartupSnapshot periodically brings the startup snapshot at path up to date, so a restart only has
+// to catch up on the rooms which changed since the last refresh.
+func refreshStartupSnapshot(store *state.Storage, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		start := time.Now()
+		if err := store.RefreshStartupSnapshot(path); err != nil {
+			logger.Err(err).Str("path", path).Msg("failed to refresh startup snapshot")
+			sentry.CaptureException(err)
+			continue
+		}
+		logger.Debug().Str("path", path).Dur("took", time.Since(start)).Msg("refreshed startup snapshot")
+	}
 }
 
 // RunSyncV3Server is the main entry point to the server
@@ -114,6 +411,10 @@ func RunSyncV3Server(h http.Handler, bindAddr, destV2Server, tlsCert, tlsKey str
 	r := mux.NewRouter()
 	r.Handle("/_matrix/client/v3/sync", allowCORS(h))
 	r.Handle("/_matrix/client/unstable/org.matrix.msc3575/sync", allowCORS(h))
+	r.Handle(handler.NotifyPath, allowCORS(h))
+	r.Handle(handler.DiagnosticsPath, allowCORS(h))
+	r.Handle(handler.ReadyPath, h)
+	r.PathPrefix(handler.AdminPathPrefix).Handler(h)
 
 	serverJSON, _ := json.Marshal(struct {
 		Server  string `json:"server"`